@@ -3,8 +3,8 @@
 script_dir=$(cd `dirname $0`; pwd)
 root_dir=`dirname $script_dir`
 
-test_packages=". ./api"
-go_test_flags="-v -race -timeout 2s"
+test_packages=". ./api ./api/hyperstart ./api/hyperstart/agentmock ./client/proxymock ./client/proxytest ./examples ./proxy-bench ./proxyctl ./shim ./sniff"
+go_test_flags="-v -race -timeout 60s"
 
 echo Running go test on packages "'$test_packages'" with flags "'$go_test_flags'"
 
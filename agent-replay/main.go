@@ -0,0 +1,202 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// agent-replay records and replays the hyperstart messages exchanged between
+// cc-proxy and the agent of a VM, on the ctl and io serial channels.
+//
+// With -record, it relays the channels of a VM to the agent, recording the
+// messages going through. Otherwise, it replays a recording: with -ctl and
+// -io, the proxy side to a live agent, with -listen-ctl and -listen-io, the
+// agent side to a proxy, acting as the agent of the VM registered with those
+// socket paths.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clearcontainers/proxy/sniff"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [options] <recording>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -record <recording> -ctl <path> -io <path> -listen-ctl <path> -listen-io <path>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func printRecord(record *sniff.AgentRecord) {
+	sniff.FormatAgent(os.Stdout, record)
+}
+
+func readRecording(path string) ([]*sniff.AgentRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return sniff.ReadAgentRecording(f)
+}
+
+// listen creates the ctl and io sockets the proxy connects to.
+func listen(ctlPath, ioPath string) (ctl, io net.Listener, err error) {
+	ctl, err = net.Listen("unix", ctlPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	io, err = net.Listen("unix", ioPath)
+	if err != nil {
+		ctl.Close()
+		return nil, nil, err
+	}
+	return ctl, io, nil
+}
+
+// accept waits for the proxy to connect to the ctl and io sockets.
+func accept(ctlPath, ioPath string) (ctl, io net.Conn, err error) {
+	ctlListener, ioListener, err := listen(ctlPath, ioPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ctlListener.Close()
+	defer ioListener.Close()
+
+	if ctl, err = ctlListener.Accept(); err != nil {
+		return nil, nil, err
+	}
+	if io, err = ioListener.Accept(); err != nil {
+		ctl.Close()
+		return nil, nil, err
+	}
+	return ctl, io, nil
+}
+
+// dial connects to the ctl and io sockets of an agent.
+func dial(ctlPath, ioPath string) (ctl, io net.Conn, err error) {
+	if ctl, err = net.Dial("unix", ctlPath); err != nil {
+		return nil, nil, err
+	}
+	if io, err = net.Dial("unix", ioPath); err != nil {
+		ctl.Close()
+		return nil, nil, err
+	}
+	return ctl, io, nil
+}
+
+func record(path, ctlTarget, ioTarget, ctlPath, ioPath string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctlListener, ioListener, err := listen(ctlPath, ioPath)
+	if err != nil {
+		return err
+	}
+
+	// Remove the sockets on exit.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		ctlListener.Close()
+		ioListener.Close()
+	}()
+
+	recorder := sniff.NewAgentRecorder(f)
+	relay := &sniff.AgentRelay{
+		CtlTarget: ctlTarget,
+		IoTarget:  ioTarget,
+		Handler: func(record *sniff.AgentRecord) {
+			printRecord(record)
+			if err := recorder.Record(record); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		},
+	}
+	relay.Serve(ctlListener, ioListener)
+
+	return nil
+}
+
+func main() {
+	recordPath := flag.String("record", "", "relay the channels to the agent and record them to this file")
+	ctlPath := flag.String("ctl", "", "path of the agent ctl socket")
+	ioPath := flag.String("io", "", "path of the agent io socket")
+	listenCtl := flag.String("listen-ctl", "", "path of the ctl socket the proxy connects to")
+	listenIo := flag.String("listen-io", "", "path of the io socket the proxy connects to")
+	speed := flag.Float64("speed", 1, "speed factor applied to the recorded delays between messages, 0 to only wait for the other side")
+	sync := flag.Duration("sync", 5*time.Second, "how long to wait for the other side to catch up with the recording before sending the next message anyway")
+	linger := flag.Duration("linger", time.Second, "how long to wait for messages once the recording has been replayed")
+	flag.Usage = usage
+	flag.Parse()
+
+	agentSide := *listenCtl != "" && *listenIo != ""
+	proxySide := *ctlPath != "" && *ioPath != ""
+
+	if *recordPath != "" {
+		if !agentSide || !proxySide || flag.NArg() != 0 {
+			usage()
+			os.Exit(2)
+		}
+		if err := record(*recordPath, *ctlPath, *ioPath, *listenCtl, *listenIo); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if agentSide == proxySide || flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	records, err := readRecording(flag.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+
+	replayer := &sniff.AgentReplayer{
+		Direction: sniff.ToAgent,
+		Speed:     *speed,
+		Sync:      *sync,
+		Linger:    *linger,
+		Handler:   printRecord,
+	}
+
+	var ctl, io net.Conn
+	if agentSide {
+		replayer.Direction = sniff.FromAgent
+		ctl, io, err = accept(*listenCtl, *listenIo)
+	} else {
+		ctl, io, err = dial(*ctlPath, *ioPath)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if err := replayer.Replay(ctl, io, records); err != nil {
+		fatal(err)
+	}
+}
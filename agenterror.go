@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+)
+
+// hyperstartErrorReply is the error returned by the hyperstart package when
+// hyperstart has answered a command with an ERROR message. The package
+// exports neither an error value to compare to nor the payload of the reply.
+const hyperstartErrorReply = "ERROR received from Hyperstart"
+
+// commandContainer returns the container targeted by the name hyper command,
+// "" if the command doesn't create or remove a container.
+func commandContainer(name string, data []byte) string {
+	var cmd struct {
+		ID        string `json:"id"`
+		Container string `json:"container"`
+	}
+
+	switch name {
+	case hyperapi.CmdNewContainer:
+		if json.Unmarshal(data, &cmd) == nil {
+			return cmd.ID
+		}
+	case hyperapi.CmdRemoveContainer:
+		if json.Unmarshal(data, &cmd) == nil {
+			return cmd.Container
+		}
+	}
+
+	return ""
+}
+
+// trackContainers records the containers created and removed by the name
+// command, which hyperstart has executed successfully.
+func (vm *vm) trackContainers(name string, data []byte) {
+	container := commandContainer(name, data)
+	if container == "" {
+		return
+	}
+
+	vm.Lock()
+	defer vm.Unlock()
+
+	if name == hyperapi.CmdNewContainer {
+		vm.containers[container] = true
+	} else {
+		delete(vm.containers, container)
+	}
+}
+
+func (vm *vm) hasContainer(container string) bool {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.containers[container]
+}
+
+// agentError classifies err, returned when sending the name command to
+// hyperstart, when hyperstart has refused the command. hyperstart doesn't
+// say why, the classification is based on the command and what the proxy
+// knows of the VM.
+func (vm *vm) agentError(name string, data []byte, err error) error {
+	if err == nil || err.Error() != hyperstartErrorReply {
+		return err
+	}
+
+	switch name {
+	case hyperapi.CmdNewContainer:
+		container := commandContainer(name, data)
+		if vm.hasContainer(container) {
+			return newProxyError(api.ErrorCodeContainerExists,
+				"hyperstart refused newcontainer: container %s already exists", container)
+		}
+		return newProxyError(api.ErrorCodeExecFailed,
+			"hyperstart failed to start container %s", container)
+	case hyperapi.CmdExecCmd:
+		return newProxyError(api.ErrorCodeExecFailed,
+			"hyperstart failed to start the process")
+	case hyperapi.CmdWinsize, hyperapi.CmdKillContainer, hyperapi.CmdRemoveContainer:
+		return newProxyError(api.ErrorCodeProcessNotFound,
+			"hyperstart refused %s: no such process or container", name)
+	}
+
+	return newProxyError(api.ErrorCodeAgentError, "hyperstart refused %s", name)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.8,!race
+
+package api
+
+import (
+	"io"
+	"net"
+)
+
+// WriteBuffers writes the concatenation of bufs to w.
+//
+// Sockets get all the buffers in a single writev(2), concurrent writes to
+// the same socket can't be interleaved with them. Other writers get a
+// single Write call with a copy of bufs.
+func WriteBuffers(w io.Writer, bufs [][]byte) (int64, error) {
+	switch w.(type) {
+	case *net.UnixConn, *net.TCPConn:
+		buffers := net.Buffers(bufs)
+		return buffers.WriteTo(w)
+	}
+
+	return writeConcatenated(w, bufs)
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !go1.8 race
+
+package api
+
+import "io"
+
+// WriteBuffers writes the concatenation of bufs to w with a single Write
+// call. net.Buffers, and its use of writev(2), is only available from go
+// 1.8. The race detector doesn't see the synchronization provided by a
+// writev(2) on a socket, unlike the one of a write(2), so race enabled
+// builds don't use it either.
+func WriteBuffers(w io.Writer, bufs [][]byte) (int64, error) {
+	return writeConcatenated(w, bufs)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+)
+
+// CompressionDeflate is the name of the DEFLATE (RFC 1951) compression of
+// stream frames, see ConnectShim.
+const CompressionDeflate = "deflate"
+
+// InflateFrame decompresses the payload of frame in place when its
+// Compressed flag is set.
+func InflateFrame(frame *Frame) error {
+	if !frame.Header.Compressed {
+		return nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(frame.Payload[:frame.Header.PayloadLength]))
+	defer r.Close()
+
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("frame: couldn't inflate payload: %v", err)
+	}
+
+	frame.Payload = payload
+	frame.Header.PayloadLength = len(payload)
+	frame.Header.Compressed = false
+
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflateFrame(t *testing.T) {
+	data := bytes.Repeat([]byte("log line\n"), 100)
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	assert.Nil(t, err)
+	w.Write(data)
+	w.Close()
+
+	frame := NewFrame(TypeStream, int(StreamStdout), compressed.Bytes())
+	frame.Header.Compressed = true
+	err = InflateFrame(frame)
+	assert.Nil(t, err)
+	assert.False(t, frame.Header.Compressed)
+	assert.Equal(t, len(data), frame.Header.PayloadLength)
+	assert.Equal(t, data, frame.Payload)
+
+	// Frames without the Compressed flag are left alone.
+	err = InflateFrame(frame)
+	assert.Nil(t, err)
+	assert.Equal(t, data, frame.Payload)
+
+	// Corrupted payload.
+	frame = NewFrame(TypeStream, int(StreamStdout), []byte("not deflate"))
+	frame.Header.Compressed = true
+	err = InflateFrame(frame)
+	assert.NotNil(t, err)
+}
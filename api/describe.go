@@ -0,0 +1,269 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// payloads are the payloads of a command and of its response, nil when the
+// frame has none.
+type payloads struct {
+	command, response interface{}
+}
+
+// commandPayloads lists the JSON payloads of each command.
+var commandPayloads = map[Command]payloads{
+	CmdRegisterVM:     {RegisterVM{}, RegisterVMResponse{}},
+	CmdUnregisterVM:   {UnregisterVM{}, nil},
+	CmdAttachVM:       {AttachVM{}, AttachVMResponse{}},
+	CmdHyper:          {Hyper{}, HyperResponse{}},
+	CmdConnectShim:    {ConnectShim{}, ConnectShimResponse{}},
+	CmdDisconnectShim: {DisconnectShim{}, nil},
+	CmdSignal:         {Signal{}, nil},
+	CmdStats:          {Stats{}, StatsResponse{}},
+	CmdCapture:        {Capture{}, CaptureResponse{}},
+	CmdPause:          {Pause{}, nil},
+	CmdResume:         {Resume{}, nil},
+	CmdWriteFile:      {WriteFile{}, nil},
+	CmdReadFile:       {ReadFile{}, ReadFileResponse{}},
+	CmdHyperBatch:     {HyperBatch{}, HyperBatchResponse{}},
+	CmdHotplug:        {Hotplug{}, HotplugResponse{}},
+	CmdCancel:         {Cancel{}, nil},
+	CmdRenewTokens:    {RenewTokens{}, RenewTokensResponse{}},
+}
+
+// notificationPayloads lists the JSON payloads of the notifications.
+// NotificationProcessExited carries the exit status as a single byte.
+var notificationPayloads = map[Notification]interface{}{
+	NotificationHyperTimeout:      HyperTimeout{},
+	NotificationVMDegraded:        VMDegraded{},
+	NotificationVMRecovered:       VMRecovered{},
+	NotificationProcessIdle:       ProcessIdle{},
+	NotificationHyperstartLog:     HyperstartLog{},
+	NotificationAgentUnresponsive: AgentUnresponsive{},
+	NotificationProcessFinished:   ProcessFinished{},
+	NotificationVMBoot:            VMBoot{},
+	NotificationHyperCompleted:    HyperCompleted{},
+}
+
+// Opcode is a named value of an enumeration of the protocol.
+type Opcode struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// CommandDescription describes a command. Payload and Response name the types
+// of the JSON payloads of the command and of its response, empty when the
+// frame has no payload.
+type CommandDescription struct {
+	Opcode
+	Payload  string `json:"payload,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// NotificationDescription describes a notification. Payload names the type of
+// its JSON payload, empty when the payload isn't JSON.
+type NotificationDescription struct {
+	Opcode
+	Payload string `json:"payload,omitempty"`
+}
+
+// Schema describes a JSON value. Type is one of:
+//
+//   - "boolean", "integer", "number" and "string"
+//   - "bytes", a base64 encoded string
+//   - "time", a RFC 3339 string
+//   - "json", any JSON value
+//   - "array" and "map", a JSON object with string keys, whose values are
+//     described by Items
+//   - "object", described by the type named by Ref
+//
+// Enum, if set, names the enumeration integers take their value from.
+type Schema struct {
+	Type  string  `json:"type"`
+	Ref   string  `json:"ref,omitempty"`
+	Enum  string  `json:"enum,omitempty"`
+	Items *Schema `json:"items,omitempty"`
+}
+
+// Field is a member of a JSON object. Optional fields can be omitted.
+type Field struct {
+	Name     string  `json:"name"`
+	Schema   *Schema `json:"schema"`
+	Optional bool    `json:"optional,omitempty"`
+}
+
+// TypeDescription describes a JSON object.
+type TypeDescription struct {
+	Fields []Field `json:"fields"`
+}
+
+// Description is a machine readable description of the protocol, for
+// generating bindings in other languages.
+type Description struct {
+	Version int `json:"version"`
+	// HeaderLength is the length, in bytes, of the frame headers this
+	// version sends.
+	HeaderLength  int                       `json:"headerLength"`
+	FrameTypes    []Opcode                  `json:"frameTypes"`
+	Commands      []CommandDescription      `json:"commands"`
+	Streams       []Opcode                  `json:"streams"`
+	Notifications []NotificationDescription `json:"notifications"`
+	ErrorCodes    []Opcode                  `json:"errorCodes"`
+	// ErrorPayload names the type of the payload of responses with the
+	// InError flag set.
+	ErrorPayload string `json:"errorPayload"`
+	// Compression lists the compression algorithms of stream frames.
+	Compression []string `json:"compression"`
+	// Types describes the JSON objects of the payloads, by name.
+	Types map[string]*TypeDescription `json:"types"`
+}
+
+// Describe returns the description of the protocol.
+func Describe() *Description {
+	d := &Description{
+		Version:      Version,
+		HeaderLength: MinHeaderLength,
+		Compression:  []string{CompressionDeflate},
+		Types:        make(map[string]*TypeDescription),
+	}
+
+	for t := FrameType(0); t < TypeMax; t++ {
+		d.FrameTypes = append(d.FrameTypes, Opcode{t.String(), int(t)})
+	}
+
+	for cmd := Command(0); cmd < CmdMax; cmd++ {
+		desc := CommandDescription{Opcode: Opcode{cmd.String(), int(cmd)}}
+		p := commandPayloads[cmd]
+		desc.Payload = d.typeName(p.command)
+		desc.Response = d.typeName(p.response)
+		d.Commands = append(d.Commands, desc)
+	}
+
+	for s := Stream(0); s < StreamMax; s++ {
+		d.Streams = append(d.Streams, Opcode{s.String(), int(s)})
+	}
+
+	for n := Notification(0); n < NotificationMax; n++ {
+		d.Notifications = append(d.Notifications, NotificationDescription{
+			Opcode:  Opcode{n.String(), int(n)},
+			Payload: d.typeName(notificationPayloads[n]),
+		})
+	}
+
+	for c := ErrorCode(0); c < ErrorCodeMax; c++ {
+		d.ErrorCodes = append(d.ErrorCodes, Opcode{c.String(), int(c)})
+	}
+	d.ErrorPayload = d.typeName(ErrorResponse{})
+
+	return d
+}
+
+// typeName adds the type of the payload v to d and returns its name.
+func (d *Description) typeName(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return d.schema(reflect.TypeOf(v)).Ref
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage{})
+	errorCodeType = reflect.TypeOf(ErrorCode(0))
+)
+
+func (d *Description) schema(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "time"}
+	case rawJSONType:
+		return &Schema{Type: "json"}
+	case errorCodeType:
+		return &Schema{Type: "integer", Enum: "ErrorCode"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return d.schema(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "bytes"}
+		}
+		return &Schema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "map", Items: d.schema(t.Elem())}
+	case reflect.Struct:
+		d.addType(t)
+		return &Schema{Type: "object", Ref: t.Name()}
+	default:
+		return &Schema{Type: "json"}
+	}
+}
+
+// addType adds the description of the struct t to d.Types.
+func (d *Description) addType(t reflect.Type) {
+	if _, ok := d.Types[t.Name()]; ok {
+		return
+	}
+
+	desc := &TypeDescription{Fields: []Field{}}
+	d.Types[t.Name()] = desc
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		var options []string
+		if tag := f.Tag.Get("json"); tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			options = parts[1:]
+		}
+
+		field := Field{
+			Name:     name,
+			Schema:   d.schema(f.Type),
+			Optional: f.Type.Kind() == reflect.Ptr,
+		}
+		for _, option := range options {
+			if option == "omitempty" {
+				field.Optional = true
+			}
+		}
+		desc.Fields = append(desc.Fields, field)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribe(t *testing.T) {
+	d := Describe()
+
+	assert.Equal(t, Version, d.Version)
+	assert.Len(t, d.FrameTypes, int(TypeMax))
+	assert.Len(t, d.Commands, int(CmdMax))
+	assert.Len(t, d.Streams, int(StreamMax))
+	assert.Len(t, d.Notifications, int(NotificationMax))
+	assert.Len(t, d.ErrorCodes, int(ErrorCodeMax))
+
+	// All commands have a payload and the types referenced are described.
+	for _, cmd := range d.Commands {
+		assert.NotEmpty(t, cmd.Payload, cmd.Name)
+		assert.Contains(t, d.Types, cmd.Payload)
+		if cmd.Response != "" {
+			assert.Contains(t, d.Types, cmd.Response)
+		}
+	}
+	for _, n := range d.Notifications {
+		if n.Value == NotificationProcessExited {
+			assert.Empty(t, n.Payload)
+			continue
+		}
+		assert.Contains(t, d.Types, n.Payload, n.Name)
+	}
+	assert.Contains(t, d.Types, d.ErrorPayload)
+
+	for name, typ := range d.Types {
+		for _, f := range typ.Fields {
+			if f.Schema.Ref != "" {
+				assert.Contains(t, d.Types, f.Schema.Ref, "%s.%s", name, f.Name)
+			}
+		}
+	}
+
+	// The description can be marshalled.
+	_, err := json.Marshal(d)
+	assert.Nil(t, err)
+}
+
+func TestDescribeFields(t *testing.T) {
+	d := Describe()
+
+	fields := make(map[string]Field)
+	for _, f := range d.Types["ConnectShim"].Fields {
+		fields[f.Name] = f
+	}
+
+	token := fields["token"]
+	assert.Equal(t, "string", token.Schema.Type)
+	assert.False(t, token.Optional)
+
+	errorResponse := make(map[string]Field)
+	for _, f := range d.Types["ErrorResponse"].Fields {
+		errorResponse[f.Name] = f
+	}
+	assert.Equal(t, "ErrorCode", errorResponse["code"].Schema.Enum)
+}
@@ -37,9 +37,9 @@
 //  0 1 2 3 4 5 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 //  ┌───────────────────────────┬───────────────┬───────────────┐
 //  │          Version          │ Header Length │   Reserved    │
-//  ├───────────────────────────┼─────┬─┬───────┼───────────────┤
-//  │          Reserved         │ Res.│E│ Type  │    Opcode     │
-//  ├───────────────────────────┴─────┴─┴───────┴───────────────┤
+//  ├───────────────────────────┼─┬─┬─┬─┬───────┼───────────────┤
+//  │         Stream ID         │R│C│F│E│ Type  │    Opcode     │
+//  ├───────────────────────────┴─┴─┴─┴─┴───────┴───────────────┤
 //  │                      Payload Length                       │
 //  ├───────────────────────────────────────────────────────────┤
 //  │                                                           │
@@ -57,6 +57,13 @@
 // • Header Length (8 bits) is the length of the header in number of 32-bit
 // words.  Header Length is greater or equal to 3 (12 bytes).
 //
+// • Stream ID (16 bits) identifies the I/O session a frame relates to when a
+// shim multiplexes several sessions on a single connection. Stream ID is set
+// by the shim in the ConnectShim command claiming the session and then used
+// in all the frames (commands, responses, streams and notifications)
+// exchanged for that session. 0 is the default session, used by clients
+// handling a single session per connection.
+//
 // • Type (4 bits) is the frame type: command (0x0), response (0x1),
 // stream (0x2) or notification (0x3).
 //
@@ -67,6 +74,17 @@
 // • E, Error. This flag is set when a response returns an error. Currently
 // Error can ony be set in response frames.
 //
+// • F, EOF. This flag is set on the last frame of a stdin stream, telling the
+// proxy to close the stdin of the process once the frame payload, possibly
+// empty, has been forwarded. Piped workloads such as "cat file | docker run
+// -i ..." rely on it to terminate. Currently EOF can only be set in stdin
+// stream frames.
+//
+// • C, Compressed. This flag is set on the stdout and stderr stream frames
+// whose payload is compressed, a raw DEFLATE (RFC 1951) stream decoded by
+// InflateFrame. Each frame is compressed independently. The proxy only sets
+// it for shims that have asked for compression in ConnectShim.
+//
 // • Payload Length (32 bits) is in bytes.
 //
 // • Payload is optional data that can be sent with the various frames.
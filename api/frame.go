@@ -90,6 +90,30 @@ const (
 	// CmdSignal sends a signal to the process inside the VM. A client
 	// needs to be connected as a shim before it can issue that command.
 	CmdSignal
+	// CmdStats returns the I/O statistics of the registered VMs.
+	CmdStats
+	// CmdCapture starts or stops recording the I/O traffic of a VM to a
+	// file, for debugging purposes.
+	CmdCapture
+	// CmdPause quiesces the I/O relay of a VM.
+	CmdPause
+	// CmdResume resumes the I/O relay of a VM paused with CmdPause.
+	CmdResume
+	// CmdWriteFile writes a file in a container of the VM the client is
+	// attached to.
+	CmdWriteFile
+	// CmdReadFile reads a file from a container of the VM the client is
+	// attached to.
+	CmdReadFile
+	// CmdHyperBatch sends a list of hyperstart commands, one after the
+	// other.
+	CmdHyperBatch
+	// CmdHotplug adds vCPUs and memory to a VM.
+	CmdHotplug
+	// CmdCancel cancels an asynchronous hyper command.
+	CmdCancel
+	// CmdRenewTokens re-issues I/O tokens before they expire.
+	CmdRenewTokens
 	// CmdMax is the number of commands.
 	CmdMax
 )
@@ -111,6 +135,26 @@ func (t Command) String() string {
 		return "DisconnectShim"
 	case CmdSignal:
 		return "Signal"
+	case CmdStats:
+		return "Stats"
+	case CmdCapture:
+		return "Capture"
+	case CmdPause:
+		return "Pause"
+	case CmdResume:
+		return "Resume"
+	case CmdWriteFile:
+		return "WriteFile"
+	case CmdReadFile:
+		return "ReadFile"
+	case CmdHyperBatch:
+		return "HyperBatch"
+	case CmdHotplug:
+		return "Hotplug"
+	case CmdCancel:
+		return "Cancel"
+	case CmdRenewTokens:
+		return "RenewTokens"
 	default:
 		return "unknown"
 	}
@@ -150,8 +194,48 @@ func (s Stream) String() string {
 type Notification int
 
 const (
-	// NotificationProcessExited is sent to signal a process in the VM has exited.
+	// NotificationProcessExited is sent to the shim of a process in the VM
+	// when that process has exited. Its payload is a single byte, the exit
+	// status of the process.
 	NotificationProcessExited = iota
+	// NotificationHyperTimeout is sent to the clients attached to a VM
+	// when hyperstart hasn't answered a command in time. See the
+	// HyperTimeout payload.
+	NotificationHyperTimeout
+	// NotificationVMDegraded is sent to the clients attached to a VM when
+	// the proxy has lost its connection to hyperstart and is trying to
+	// re-establish it. See the VMDegraded payload.
+	NotificationVMDegraded
+	// NotificationVMRecovered is sent to the clients attached to a VM when
+	// the connection to hyperstart has been re-established after a
+	// NotificationVMDegraded or when hyperstart answers a ping again after
+	// a NotificationAgentUnresponsive. See the VMRecovered payload.
+	NotificationVMRecovered
+	// NotificationProcessIdle is sent to the clients attached to a VM
+	// when a process hasn't had any I/O and hyperstart hasn't answered
+	// any ping for a while: the workload may be hung. See the
+	// ProcessIdle payload.
+	NotificationProcessIdle
+	// NotificationHyperstartLog is sent to the clients having subscribed
+	// to the hyperstart logs in RegisterVM or AttachVM for each message
+	// hyperstart writes to the VM console. See the HyperstartLog payload.
+	NotificationHyperstartLog
+	// NotificationAgentUnresponsive is sent to the clients attached to a
+	// VM when hyperstart has missed too many pings in a row. See the
+	// AgentUnresponsive payload.
+	NotificationAgentUnresponsive
+	// NotificationProcessFinished is sent to the clients attached to a VM
+	// when a process started with an I/O token has exited. See the
+	// ProcessFinished payload.
+	NotificationProcessFinished
+	// NotificationVMBoot is sent to the clients attached to a VM
+	// registered with RegisterVM.Async as the proxy connects to it. See
+	// the VMBoot payload.
+	NotificationVMBoot
+	// NotificationHyperCompleted is sent to the clients attached to a VM
+	// when hyperstart has answered a Hyper command sent with async set.
+	// See the HyperCompleted payload.
+	NotificationHyperCompleted
 	// NotificationMax is the number of notification types.
 	NotificationMax
 )
@@ -161,6 +245,24 @@ func (n Notification) String() string {
 	switch n {
 	case NotificationProcessExited:
 		return "ProcessExited"
+	case NotificationHyperTimeout:
+		return "HyperTimeout"
+	case NotificationVMDegraded:
+		return "VMDegraded"
+	case NotificationVMRecovered:
+		return "VMRecovered"
+	case NotificationProcessIdle:
+		return "ProcessIdle"
+	case NotificationHyperstartLog:
+		return "HyperstartLog"
+	case NotificationAgentUnresponsive:
+		return "AgentUnresponsive"
+	case NotificationProcessFinished:
+		return "ProcessFinished"
+	case NotificationVMBoot:
+		return "VMBoot"
+	case NotificationHyperCompleted:
+		return "HyperCompleted"
 	default:
 		return "unknown"
 	}
@@ -176,6 +278,16 @@ type FrameHeader struct {
 	Opcode        int
 	PayloadLength int
 	InError       bool
+	// EOF marks the last frame of a stdin stream: the proxy closes the
+	// stdin of the process once the payload of this frame, possibly
+	// empty, has been forwarded.
+	EOF bool
+	// Compressed is set on stream frames whose payload has been
+	// compressed by the proxy, see InflateFrame.
+	Compressed bool
+	// StreamID identifies, on connections multiplexing several I/O
+	// sessions, the session a frame belongs to. 0 is the default session.
+	StreamID int
 }
 
 // Frame is the basic communication unit with the proxy.
@@ -189,7 +301,7 @@ func NewFrame(t FrameType, op int, payload []byte) *Frame {
 	return &Frame{
 		Header: FrameHeader{
 			Version:       Version,
-			HeaderLength:  minHeaderLength,
+			HeaderLength:  MinHeaderLength,
 			Type:          t,
 			Opcode:        op,
 			PayloadLength: len(payload),
@@ -214,7 +326,7 @@ func NewFrameJSON(t FrameType, op int, payload interface{}) (*Frame, error) {
 	return &Frame{
 		Header: FrameHeader{
 			Version:       Version,
-			HeaderLength:  minHeaderLength,
+			HeaderLength:  MinHeaderLength,
 			Type:          t,
 			Opcode:        op,
 			PayloadLength: len(data),
@@ -49,6 +49,16 @@ func TestCommandString(t *testing.T) {
 		{CmdConnectShim, "ConnectShim"},
 		{CmdDisconnectShim, "DisconnectShim"},
 		{CmdSignal, "Signal"},
+		{CmdStats, "Stats"},
+		{CmdCapture, "Capture"},
+		{CmdPause, "Pause"},
+		{CmdResume, "Resume"},
+		{CmdWriteFile, "WriteFile"},
+		{CmdReadFile, "ReadFile"},
+		{CmdHyperBatch, "HyperBatch"},
+		{CmdHotplug, "Hotplug"},
+		{CmdCancel, "Cancel"},
+		{CmdRenewTokens, "RenewTokens"},
 		{CmdMax, "unknown"},
 	}
 
@@ -79,6 +89,15 @@ func TestNotificationString(t *testing.T) {
 		s string
 	}{
 		{NotificationProcessExited, "ProcessExited"},
+		{NotificationHyperTimeout, "HyperTimeout"},
+		{NotificationVMDegraded, "VMDegraded"},
+		{NotificationVMRecovered, "VMRecovered"},
+		{NotificationProcessIdle, "ProcessIdle"},
+		{NotificationHyperstartLog, "HyperstartLog"},
+		{NotificationAgentUnresponsive, "AgentUnresponsive"},
+		{NotificationProcessFinished, "ProcessFinished"},
+		{NotificationVMBoot, "VMBoot"},
+		{NotificationHyperCompleted, "HyperCompleted"},
 		{NotificationMax, "unknown"},
 	}
 
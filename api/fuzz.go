@@ -0,0 +1,217 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build gofuzz
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/clearcontainers/proxy/api/hyperstart"
+)
+
+// The Fuzz functions are entry points for go-fuzz, covering the parsing of
+// the data sent by the clients of the proxy:
+//
+//  $ go-fuzz-build -func FuzzFrame github.com/clearcontainers/proxy/api
+//  $ go-fuzz -bin api-fuzz.zip -workdir api/fuzz
+//
+// api/fuzz/corpus holds a frame of each kind, with valid payloads, to start
+// from.
+
+// FuzzFrame decodes data as a frame and checks it's encoded back to the same
+// frame.
+func FuzzFrame(data []byte) int {
+	frame, err := ReadFrame(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+
+	// Bigger headers than expected are decoded but WriteFrame only writes
+	// MinHeaderLength bytes of header.
+	frame.Header.HeaderLength = MinHeaderLength
+
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, frame); err != nil {
+		panic(err)
+	}
+
+	decoded, err := ReadFrame(&buf)
+	if err != nil {
+		panic(err)
+	}
+
+	if !reflect.DeepEqual(frame.Header, decoded.Header) ||
+		!bytes.Equal(frame.Payload, decoded.Payload) {
+		panic(fmt.Sprintf("frame %+v encoded as %+v", frame, decoded))
+	}
+
+	return 1
+}
+
+// commandPayload returns a new payload of command cmd to unmarshal into, nil
+// for the commands without a payload.
+func commandPayload(cmd Command) interface{} {
+	switch cmd {
+	case CmdRegisterVM:
+		return &RegisterVM{}
+	case CmdUnregisterVM:
+		return &UnregisterVM{}
+	case CmdAttachVM:
+		return &AttachVM{}
+	case CmdHyper:
+		return &Hyper{}
+	case CmdConnectShim:
+		return &ConnectShim{}
+	case CmdSignal:
+		return &Signal{}
+	case CmdStats:
+		return &Stats{}
+	case CmdCapture:
+		return &Capture{}
+	case CmdPause:
+		return &Pause{}
+	case CmdResume:
+		return &Resume{}
+	case CmdWriteFile:
+		return &WriteFile{}
+	case CmdReadFile:
+		return &ReadFile{}
+	case CmdHyperBatch:
+		return &HyperBatch{}
+	case CmdHotplug:
+		return &Hotplug{}
+	case CmdCancel:
+		return &Cancel{}
+	case CmdRenewTokens:
+		return &RenewTokens{}
+	default:
+		return nil
+	}
+}
+
+// checkHyper validates the hyperstart commands the proxy checks before
+// forwarding them. Valid commands are rewritten like the proxy does, with
+// the I/O sequence numbers it allocates, and the rewritten payload must
+// decode to the same command and still be valid. It returns 1 when hyper
+// holds one of those commands.
+func checkHyper(hyper *Hyper) int {
+	var cmd interface {
+		Validate() error
+	}
+	var process func() *hyperstart.Process
+
+	switch hyper.HyperName {
+	case hyperstart.CmdNewContainer:
+		c := &hyperstart.Container{}
+		cmd, process = c, func() *hyperstart.Process { return c.Process }
+	case hyperstart.CmdExecCmd:
+		e := &hyperstart.ExecCommand{}
+		cmd, process = e, func() *hyperstart.Process { return &e.Process }
+	default:
+		return 0
+	}
+
+	if err := json.Unmarshal(hyper.Data, cmd); err != nil {
+		return 0
+	}
+
+	if err := cmd.Validate(); err != nil {
+		specErr, ok := err.(*hyperstart.SpecError)
+		if !ok || specErr.Field == "" || specErr.Reason == "" {
+			panic(fmt.Sprintf("invalid spec error %#v", err))
+		}
+		return 1
+	}
+
+	p := process()
+	p.Stdio = 1
+	if !p.Terminal {
+		p.Stderr = 2
+	}
+
+	rewritten, err := json.Marshal(cmd)
+	if err != nil {
+		panic(err)
+	}
+
+	decoded := reflect.New(reflect.TypeOf(cmd).Elem()).Interface().(interface {
+		Validate() error
+	})
+	if err := json.Unmarshal(rewritten, decoded); err != nil {
+		panic(err)
+	}
+	if err := decoded.Validate(); err != nil {
+		panic(fmt.Sprintf("rewritten %s doesn't validate: %v", rewritten, err))
+	}
+
+	again, err := json.Marshal(decoded)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(rewritten, again) {
+		panic(fmt.Sprintf("%s rewritten as %s", rewritten, again))
+	}
+
+	return 1
+}
+
+// FuzzHyper decodes data as the payload of a Hyper command and checks the
+// newcontainer and execcmd commands like the proxy does before forwarding
+// them. api/fuzz/hyper/corpus holds valid and near-valid commands:
+//
+//  $ go-fuzz-build -func FuzzHyper github.com/clearcontainers/proxy/api
+//  $ go-fuzz -bin api-fuzz.zip -workdir api/fuzz/hyper
+func FuzzHyper(data []byte) int {
+	hyper := Hyper{}
+	if err := json.Unmarshal(data, &hyper); err != nil {
+		return 0
+	}
+
+	return checkHyper(&hyper)
+}
+
+// FuzzPayload decodes data as a command frame and unmarshals its payload as
+// the proxy does, validating the hyperstart commands it checks.
+func FuzzPayload(data []byte) int {
+	frame, err := ReadFrame(bytes.NewReader(data))
+	if err != nil || frame.Header.Type != TypeCommand {
+		return 0
+	}
+
+	cmd := Command(frame.Header.Opcode)
+	payload := commandPayload(cmd)
+	if payload == nil {
+		return 0
+	}
+
+	if err := json.Unmarshal(frame.Payload, payload); err != nil {
+		return 0
+	}
+
+	switch p := payload.(type) {
+	case *Hyper:
+		checkHyper(p)
+	case *HyperBatch:
+		for i := range p.Commands {
+			checkHyper(&p.Commands[i])
+		}
+	}
+
+	return 1
+}
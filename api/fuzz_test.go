@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build gofuzz
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFuzzCorpus runs the fuzz functions on the seed corpus, checking they
+// accept its frames. Run with go test -tags gofuzz.
+func TestFuzzCorpus(t *testing.T) {
+	files, err := filepath.Glob("fuzz/corpus/*")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+
+		assert.Equal(t, 1, FuzzFrame(data), file)
+
+		frame, err := ReadFrame(bytes.NewReader(data))
+		assert.Nil(t, err)
+		if frame.Header.Type == TypeCommand && commandPayload(Command(frame.Header.Opcode)) != nil {
+			assert.Equal(t, 1, FuzzPayload(data), file)
+		}
+	}
+}
+
+var updateCorpus = flag.Bool("update-corpus", false, "regenerate fuzz/hyper/corpus")
+
+// hyperCorpusDir holds the seed corpus of FuzzHyper.
+const hyperCorpusDir = "fuzz/hyper/corpus"
+
+func testProcess() hyperstart.Process {
+	return hyperstart.Process{
+		User:     "root",
+		Terminal: false,
+		Args:     []string{"/bin/sh", "-c", "echo $FOO"},
+		Envs: []hyperstart.EnvironmentVar{
+			{Env: "PATH", Value: "/usr/bin:/bin"},
+			{Env: "FOO", Value: "bar=baz"},
+		},
+		Workdir: "/",
+		Rlimits: []hyperstart.Rlimit{
+			{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 4096},
+		},
+	}
+}
+
+func testContainer() hyperstart.Container {
+	process := testProcess()
+	return hyperstart.Container{
+		ID:     "foo",
+		Rootfs: "rootfs",
+		Image:  "0123456789abcdef",
+		Fstype: "ext4",
+		Volumes: []*hyperstart.VolumeDescriptor{
+			{Device: "vdb", Mount: "/data", Fstype: "xfs"},
+		},
+		Fsmap: []*hyperstart.FsmapDescriptor{
+			{Source: "shared/etc-hosts", Path: "/etc/hosts", ReadOnly: true},
+		},
+		Sysctl:        map[string]string{"net.ipv4.ip_forward": "1"},
+		Process:       &process,
+		RestartPolicy: "never",
+		Initialize:    true,
+	}
+}
+
+// processMutations turn a valid process into the variants of the corpus,
+// valid or near-valid.
+var processMutations = map[string]func(p *hyperstart.Process){
+	"valid":             func(p *hyperstart.Process) {},
+	"terminal":          func(p *hyperstart.Process) { p.Terminal = true },
+	"minimal":           func(p *hyperstart.Process) { *p = hyperstart.Process{Args: []string{"true"}} },
+	"groups":            func(p *hyperstart.Process) { p.Group = "users"; p.AdditionalGroups = []string{"wheel", "10"} },
+	"unicode":           func(p *hyperstart.Process) { p.Args = []string{"/bin/echo", "héllo 世界", "\U0001f600"} },
+	"empty-value":       func(p *hyperstart.Process) { p.Envs = append(p.Envs, hyperstart.EnvironmentVar{Env: "EMPTY"}) },
+	"unlimited":         func(p *hyperstart.Process) { p.Rlimits[0].Soft, p.Rlimits[0].Hard = ^uint64(0), ^uint64(0) },
+	"no-args":           func(p *hyperstart.Process) { p.Args = nil },
+	"empty-command":     func(p *hyperstart.Process) { p.Args = []string{"", "-c"} },
+	"empty-env":         func(p *hyperstart.Process) { p.Envs[1].Env = "" },
+	"env-equal":         func(p *hyperstart.Process) { p.Envs[1].Env = "FOO=bar" },
+	"env-nul":           func(p *hyperstart.Process) { p.Envs[1].Env = "FOO\x00" },
+	"rlimit-no-type":    func(p *hyperstart.Process) { p.Rlimits[0].Type = "" },
+	"rlimit-soft-above": func(p *hyperstart.Process) { p.Rlimits[0].Soft = p.Rlimits[0].Hard + 1 },
+	"stdio":             func(p *hyperstart.Process) { p.Stdio, p.Stderr = 3, 4 },
+}
+
+// hyperCorpus returns the payloads of the FuzzHyper seed corpus, by file
+// name.
+func hyperCorpus() map[string]*Hyper {
+	corpus := make(map[string]*Hyper)
+
+	add := func(name, hyperName string, cmd interface{}) {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			panic(err)
+		}
+		corpus[name] = &Hyper{
+			HyperName: hyperName,
+			Tokens:    []string{"bwgxfmQj9uG3YCsFHrvontwDw41CJJ76Y7qVt4Bi9wc="},
+			Data:      data,
+		}
+	}
+
+	for name, mutate := range processMutations {
+		c := testContainer()
+		mutate(c.Process)
+		add("newcontainer-"+name, hyperstart.CmdNewContainer, &c)
+
+		e := hyperstart.ExecCommand{Container: "foo", Process: testProcess()}
+		mutate(&e.Process)
+		add("execcmd-"+name, hyperstart.CmdExecCmd, &e)
+	}
+
+	c := testContainer()
+	c.ID = ""
+	add("newcontainer-no-id", hyperstart.CmdNewContainer, &c)
+	c = testContainer()
+	c.Process = nil
+	add("newcontainer-no-process", hyperstart.CmdNewContainer, &c)
+	c = testContainer()
+	c.Volumes, c.Fsmap, c.Sysctl = nil, nil, nil
+	add("newcontainer-no-mounts", hyperstart.CmdNewContainer, &c)
+	add("execcmd-no-container", hyperstart.CmdExecCmd,
+		&hyperstart.ExecCommand{Process: testProcess()})
+
+	return corpus
+}
+
+// TestHyperCorpus checks fuzz/hyper/corpus is up to date with hyperCorpus
+// and accepted by FuzzHyper. Regenerate it with:
+//
+//  $ go test -tags gofuzz -run TestHyperCorpus ./api -update-corpus
+func TestHyperCorpus(t *testing.T) {
+	corpus := hyperCorpus()
+
+	if *updateCorpus {
+		files, err := filepath.Glob(filepath.Join(hyperCorpusDir, "*"))
+		assert.Nil(t, err)
+		for _, file := range files {
+			assert.Nil(t, os.Remove(file))
+		}
+		assert.Nil(t, os.MkdirAll(hyperCorpusDir, 0755))
+	}
+
+	for name, hyper := range corpus {
+		data, err := json.Marshal(hyper)
+		assert.Nil(t, err)
+
+		path := filepath.Join(hyperCorpusDir, name)
+		if *updateCorpus {
+			assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+		}
+
+		shipped, err := ioutil.ReadFile(path)
+		assert.Nil(t, err, "%s is missing, regenerate the corpus", path)
+		assert.Equal(t, string(data), string(shipped), path)
+		assert.Equal(t, 1, FuzzHyper(data), name)
+	}
+
+	files, err := filepath.Glob(filepath.Join(hyperCorpusDir, "*"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(corpus), len(files), "stale files in %s", hyperCorpusDir)
+}
+
+func TestCheckHyper(t *testing.T) {
+	for name, hyper := range hyperCorpus() {
+		valid := strings.HasSuffix(name, "-valid") || strings.HasSuffix(name, "-terminal")
+		if !valid {
+			continue
+		}
+		assert.Equal(t, 1, checkHyper(hyper), name)
+	}
+
+	// Payloads that don't decode and other commands aren't interesting.
+	assert.Equal(t, 0, FuzzHyper([]byte(`{"hyperName":"newcontainer","data":{"process":"ls"}}`)))
+	assert.Equal(t, 0, FuzzHyper([]byte(`{"hyperName":"ping"}`)))
+	assert.Equal(t, 0, FuzzHyper([]byte(`not json`)))
+}
@@ -0,0 +1,498 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package agentmock implements a fake hyperstart agent, to integration test
+// the proxy and the runtimes using it without booting a VM. The agent listens
+// on the ctl and io unix sockets a VM would expose, sends READY once the proxy
+// has connected to both and acknowledges the commands it receives. Processes
+// started with execcmd or newcontainer are handed to the test, which writes
+// their output, reads their stdin and makes them exit.
+//
+// An Agent serves a single connection of the proxy to the VM.
+package agentmock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// APIVersion is the API version the agent answers the version command with.
+const APIVersion = 4242
+
+// maxIOPayload is the largest payload of an io message. hyperstart can't
+// receive messages bigger than 10240 bytes, header included.
+const maxIOPayload = 10240 - hyperstart.TtyHdrSize
+
+// Handler answers a command sent to the agent. reply is the payload of the
+// ACK message. A non-nil err makes the agent answer with an ERROR message.
+type Handler func(data []byte) (reply []byte, err error)
+
+// Message is a command received by the agent.
+type Message struct {
+	Cmd  string
+	Data []byte
+}
+
+// Agent is a fake hyperstart.
+type Agent struct {
+	dir             string
+	ctlPath, ioPath string
+	ctlListener     net.Listener
+	ioListener      net.Listener
+	wg              sync.WaitGroup
+
+	// ctl and io are set once the proxy has connected, before connected
+	// is closed.
+	ctl, io   net.Conn
+	connected chan struct{}
+	ctlLock   sync.Mutex
+	ioLock    sync.Mutex
+
+	mu          sync.Mutex
+	closed      bool
+	handlers    map[string]Handler
+	messages    []Message
+	processes   []*Process
+	nextProcess int
+	// newProcess is closed, and replaced, when a process is started.
+	newProcess chan struct{}
+}
+
+// New starts a fake agent listening on sockets in a new temporary directory.
+// Close stops it.
+func New() (*Agent, error) {
+	dir, err := ioutil.TempDir("", "agentmock")
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Agent{
+		dir:        dir,
+		ctlPath:    filepath.Join(dir, "ctl.sock"),
+		ioPath:     filepath.Join(dir, "io.sock"),
+		connected:  make(chan struct{}),
+		handlers:   make(map[string]Handler),
+		newProcess: make(chan struct{}),
+	}
+
+	a.ctlListener, err = net.Listen("unix", a.ctlPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	a.ioListener, err = net.Listen("unix", a.ioPath)
+	if err != nil {
+		a.ctlListener.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	a.wg.Add(1)
+	go a.serve()
+
+	return a, nil
+}
+
+// CtlSocketPath returns the path of the ctl socket, as given to RegisterVM.
+func (a *Agent) CtlSocketPath() string {
+	return a.ctlPath
+}
+
+// IoSocketPath returns the path of the io socket, as given to RegisterVM.
+func (a *Agent) IoSocketPath() string {
+	return a.ioPath
+}
+
+// Close stops the agent, closing its connections to the proxy as a VM
+// shutting down would.
+func (a *Agent) Close() {
+	a.ctlListener.Close()
+	a.ioListener.Close()
+
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+
+	select {
+	case <-a.connected:
+		a.ctl.Close()
+		a.io.Close()
+	default:
+	}
+
+	a.wg.Wait()
+
+	a.mu.Lock()
+	for _, p := range a.processes {
+		p.stdin.close()
+	}
+	a.mu.Unlock()
+
+	os.RemoveAll(a.dir)
+}
+
+// Handle replaces the default answer to the hyperstart command cmd with
+// handler. By default, version answers with APIVersion and the other commands
+// are acknowledged with no data. The processes of execcmd and newcontainer
+// commands handler accepts are still handed to WaitProcess.
+func (a *Agent) Handle(cmd string, handler Handler) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.handlers[cmd] = handler
+}
+
+// Messages returns the commands received so far, in order.
+func (a *Agent) Messages() []Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	messages := make([]Message, len(a.messages))
+	copy(messages, a.messages)
+	return messages
+}
+
+// WaitProcess returns the next process started by execcmd or newcontainer,
+// waiting up to timeout for it.
+func (a *Agent) WaitProcess(timeout time.Duration) (*Process, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		a.mu.Lock()
+		if a.nextProcess < len(a.processes) {
+			p := a.processes[a.nextProcess]
+			a.nextProcess++
+			a.mu.Unlock()
+			return p, nil
+		}
+		newProcess := a.newProcess
+		a.mu.Unlock()
+
+		select {
+		case <-newProcess:
+		case <-timer.C:
+			return nil, fmt.Errorf("no process started after %s", timeout)
+		}
+	}
+}
+
+func (a *Agent) serve() {
+	defer a.wg.Done()
+
+	if err := a.accept(); err != nil {
+		return
+	}
+
+	a.wg.Add(1)
+	go a.serveIo()
+
+	a.serveCtl()
+}
+
+// accept waits for the proxy to connect to the ctl then io sockets and sends
+// READY.
+func (a *Agent) accept() error {
+	ctl, err := a.ctlListener.Accept()
+	if err != nil {
+		return err
+	}
+	io, err := a.ioListener.Accept()
+	if err != nil {
+		ctl.Close()
+		return err
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		ctl.Close()
+		io.Close()
+		return fmt.Errorf("agent closed")
+	}
+	a.ctl, a.io = ctl, io
+	close(a.connected)
+	a.mu.Unlock()
+
+	return a.writeCtl(hyperstart.ReadyCode, nil)
+}
+
+func (a *Agent) writeCtl(code uint32, data []byte) error {
+	msg := make([]byte, hyperstart.CtlHdrSize+len(data))
+	binary.BigEndian.PutUint32(msg[:], code)
+	binary.BigEndian.PutUint32(msg[hyperstart.CtlHdrLenOffset:], uint32(len(msg)))
+	copy(msg[hyperstart.CtlHdrSize:], data)
+
+	a.ctlLock.Lock()
+	defer a.ctlLock.Unlock()
+
+	_, err := a.ctl.Write(msg)
+	return err
+}
+
+func (a *Agent) writeIo(seq uint64, data []byte) error {
+	a.ioLock.Lock()
+	defer a.ioLock.Unlock()
+
+	return hyperstart.SendIoMessageWithConn(a.io, &hyperstart.TtyMessage{
+		Session: seq,
+		Message: data,
+	})
+}
+
+func commandName(code uint32) string {
+	for name, c := range hyperstart.CodeList {
+		if c == code {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", code)
+}
+
+func (a *Agent) serveCtl() {
+	for {
+		msg, err := hyperstart.ReadCtlMessage(a.ctl)
+		if err != nil {
+			return
+		}
+
+		// Like hyperstart, tell the sender how much data has been
+		// received before answering.
+		next := make([]byte, 4)
+		binary.BigEndian.PutUint32(next, uint32(hyperstart.CtlHdrSize+len(msg.Message)))
+		if err := a.writeCtl(hyperstart.NextCode, next); err != nil {
+			return
+		}
+
+		data := msg.Message
+		if len(data) == 0 {
+			data = nil
+		}
+		reply, err := a.handleCommand(commandName(msg.Code), data)
+		if err != nil {
+			err = a.writeCtl(hyperstart.ErrorCode, nil)
+		} else {
+			err = a.writeCtl(hyperstart.AckCode, reply)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *Agent) handleCommand(name string, data []byte) ([]byte, error) {
+	a.mu.Lock()
+	a.messages = append(a.messages, Message{Cmd: name, Data: data})
+	handler := a.handlers[name]
+	a.mu.Unlock()
+
+	if handler != nil {
+		reply, err := handler(data)
+		if err == nil {
+			a.startProcess(name, data)
+		}
+		return reply, err
+	}
+
+	switch name {
+	case hyperapi.CmdVersion:
+		reply := make([]byte, 4)
+		binary.BigEndian.PutUint32(reply, APIVersion)
+		return reply, nil
+	case hyperapi.CmdExecCmd, hyperapi.CmdNewContainer:
+		return nil, a.startProcess(name, data)
+	}
+
+	return nil, nil
+}
+
+// startProcess records the process started by the name command, if any.
+func (a *Agent) startProcess(name string, data []byte) error {
+	p := &Process{
+		agent: a,
+		stdin: newStdinBuffer(),
+	}
+
+	switch name {
+	case hyperapi.CmdExecCmd:
+		cmd := hyperapi.ExecCommand{}
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return err
+		}
+		p.Container = cmd.Container
+		p.Spec = cmd.Process
+	case hyperapi.CmdNewContainer:
+		container := hyperapi.Container{}
+		if err := json.Unmarshal(data, &container); err != nil {
+			return err
+		}
+		if container.Process == nil {
+			return fmt.Errorf("container %s has no process", container.ID)
+		}
+		p.Container = container.ID
+		p.Spec = *container.Process
+	default:
+		return nil
+	}
+
+	a.mu.Lock()
+	a.processes = append(a.processes, p)
+	close(a.newProcess)
+	a.newProcess = make(chan struct{})
+	a.mu.Unlock()
+
+	return nil
+}
+
+// processBySeq returns the process which stdin is the stream seq.
+func (a *Agent) processBySeq(seq uint64) *Process {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, p := range a.processes {
+		if p.Spec.Stdio == seq {
+			return p
+		}
+	}
+	return nil
+}
+
+func (a *Agent) serveIo() {
+	defer a.wg.Done()
+
+	for {
+		msg, err := hyperstart.ReadIoMessageWithConn(a.io)
+		if err != nil {
+			return
+		}
+
+		p := a.processBySeq(msg.Session)
+		if p == nil {
+			continue
+		}
+		if len(msg.Message) == 0 {
+			p.stdin.close()
+			continue
+		}
+		p.stdin.write(msg.Message)
+	}
+}
+
+// Process is a process started by execcmd or newcontainer.
+type Process struct {
+	// Container is the container the process runs in.
+	Container string
+	// Spec is the process, as sent to the agent. Its Stdio and Stderr
+	// fields are the sequence numbers the proxy has allocated for its
+	// streams.
+	Spec hyperapi.Process
+
+	agent *Agent
+	stdin *stdinBuffer
+}
+
+func (p *Process) send(seq uint64, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxIOPayload {
+			n = maxIOPayload
+		}
+		if err := p.agent.writeIo(seq, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// SendStdout writes data on the stdout of the process.
+func (p *Process) SendStdout(data []byte) error {
+	return p.send(p.Spec.Stdio, data)
+}
+
+// SendStderr writes data on the stderr of the process, stdout if the process
+// doesn't have a separate stderr stream.
+func (p *Process) SendStderr(data []byte) error {
+	if p.Spec.Stderr == 0 {
+		return p.SendStdout(data)
+	}
+	return p.send(p.Spec.Stderr, data)
+}
+
+// Exit makes the process exit with status, closing its output.
+func (p *Process) Exit(status uint8) error {
+	if err := p.agent.writeIo(p.Spec.Stdio, nil); err != nil {
+		return err
+	}
+	return p.agent.writeIo(p.Spec.Stdio, []byte{status})
+}
+
+// ReadStdin reads the stdin of the process, blocking until some is available.
+// It returns io.EOF once stdin has been closed and all its data read.
+func (p *Process) ReadStdin(buf []byte) (int, error) {
+	return p.stdin.Read(buf)
+}
+
+// stdinBuffer buffers the stdin of a process until the test reads it.
+type stdinBuffer struct {
+	sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newStdinBuffer() *stdinBuffer {
+	b := &stdinBuffer{}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+func (b *stdinBuffer) write(data []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.buf.Write(data)
+	b.cond.Broadcast()
+}
+
+func (b *stdinBuffer) close() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *stdinBuffer) Read(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+
+	// bytes.Buffer returns io.EOF once empty.
+	return b.buf.Read(p)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentmock
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+	"github.com/stretchr/testify/assert"
+)
+
+func connect(t *testing.T, a *Agent) *hyperstart.Hyperstart {
+	h := hyperstart.NewHyperstart(a.CtlSocketPath(), a.IoSocketPath(), "unix")
+	err := h.OpenSockets()
+	assert.Nil(t, err)
+	err = h.WaitForReady()
+	assert.Nil(t, err)
+	return h
+}
+
+func TestCommands(t *testing.T) {
+	a, err := New()
+	assert.Nil(t, err)
+	h := connect(t, a)
+
+	// version answers with the API version.
+	msg, err := h.SendCtlMessage(hyperstart.Version, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(hyperstart.AckCode), msg.Code)
+	assert.Equal(t, uint32(APIVersion), binary.BigEndian.Uint32(msg.Message))
+
+	// Other commands are acknowledged.
+	_, err = h.SendCtlMessage(hyperstart.Ping, nil)
+	assert.Nil(t, err)
+
+	// Unless a handler refuses them.
+	a.Handle(hyperapi.CmdKillContainer, func(data []byte) ([]byte, error) {
+		return nil, errors.New("no such container")
+	})
+	_, err = h.SendCtlMessage(hyperstart.KillContainer, []byte(`{"container":"foo"}`))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []Message{
+		{Cmd: hyperapi.CmdVersion},
+		{Cmd: hyperapi.CmdPing},
+		{Cmd: hyperapi.CmdKillContainer, Data: []byte(`{"container":"foo"}`)},
+	}, a.Messages())
+
+	a.Close()
+	h.CloseSockets()
+}
+
+func TestProcess(t *testing.T) {
+	a, err := New()
+	assert.Nil(t, err)
+	h := connect(t, a)
+
+	// No process has been started yet.
+	_, err = a.WaitProcess(time.Millisecond)
+	assert.NotNil(t, err)
+
+	execcmd, err := json.Marshal(&hyperapi.ExecCommand{
+		Container: "foo",
+		Process: hyperapi.Process{
+			Stdio:  1,
+			Stderr: 2,
+			Args:   []string{"/bin/sh"},
+		},
+	})
+	assert.Nil(t, err)
+	_, err = h.SendCtlMessage(hyperstart.ExecCmd, execcmd)
+	assert.Nil(t, err)
+
+	p, err := a.WaitProcess(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", p.Container)
+	assert.Equal(t, []string{"/bin/sh"}, p.Spec.Args)
+
+	// stdin, until it's closed.
+	err = h.SendIoMessage(&hyperstart.TtyMessage{Session: 1, Message: []byte("stdin\n")})
+	assert.Nil(t, err)
+	err = h.SendIoMessage(&hyperstart.TtyMessage{Session: 1})
+	assert.Nil(t, err)
+	buf := make([]byte, 32)
+	n, err := io.ReadFull(readerFunc(p.ReadStdin), buf)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "stdin\n", string(buf[:n]))
+
+	// stdout and stderr.
+	err = p.SendStdout([]byte("stdout\n"))
+	assert.Nil(t, err)
+	err = p.SendStderr([]byte("stderr\n"))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		seq  uint64
+		data string
+	}{
+		{1, "stdout\n"},
+		{2, "stderr\n"},
+		// The exit status follows an empty message.
+		{1, ""},
+		{1, "\x2a"},
+	}
+
+	err = p.Exit(42)
+	assert.Nil(t, err)
+
+	for _, test := range tests {
+		msg, err := h.ReadIoMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, test.seq, msg.Session)
+		assert.Equal(t, test.data, string(msg.Message))
+	}
+
+	// Output bigger than what hyperstart can send in one message is split.
+	err = p.SendStdout(make([]byte, maxIOPayload+1))
+	assert.Nil(t, err)
+	msg, err := h.ReadIoMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, maxIOPayload, len(msg.Message))
+	msg, err = h.ReadIoMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msg.Message))
+
+	a.Close()
+	h.CloseSockets()
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hyperstart defines the payloads of the hyperstart 0.7 messages
+// clients can send through the proxy with the Hyper command.
+//
+// The proxy decodes some of those payloads before forwarding them to the VM,
+// eg. to allocate the I/O sequence numbers of the processes started with
+// newcontainer and execcmd. Runtimes are encouraged to use the same
+// definitions so both sides agree on the format of each message: a field the
+// proxy doesn't know about would be dropped when the payload is rewritten.
+//
+// The Validate methods implement the checks done by the proxy before
+// forwarding newcontainer and execcmd, so runtimes can run them earlier.
+package hyperstart
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Names of the hyperstart commands, as given to the Hyper command.
+const (
+	CmdVersion         = "version"
+	CmdStartPod        = "startpod"
+	CmdDestroyPod      = "destroypod"
+	CmdExecCmd         = "execcmd"
+	CmdReady           = "ready"
+	CmdAck             = "ack"
+	CmdError           = "error"
+	CmdWinsize         = "winsize"
+	CmdPing            = "ping"
+	CmdNext            = "next"
+	CmdWriteFile       = "writefile"
+	CmdReadFile        = "readfile"
+	CmdNewContainer    = "newcontainer"
+	CmdKillContainer   = "killcontainer"
+	CmdOnlineCPUMem    = "onlinecpumem"
+	CmdSetupInterface  = "setupinterface"
+	CmdSetupRoute      = "setuproute"
+	CmdRemoveContainer = "removecontainer"
+)
+
+// EnvironmentVar holds an environment variable and its value.
+type EnvironmentVar struct {
+	Env   string `json:"env"`
+	Value string `json:"value"`
+}
+
+// Rlimit describes a resource limit.
+type Rlimit struct {
+	// Type of the rlimit to set
+	Type string `json:"type"`
+	// Hard is the hard limit for the specified type
+	Hard uint64 `json:"hard"`
+	// Soft is the soft limit for the specified type
+	Soft uint64 `json:"soft"`
+}
+
+// Process describes a process running in a container.
+//
+// Stdio and Stderr are allocated by the proxy and must be left to 0 by
+// clients.
+type Process struct {
+	User             string   `json:"user,omitempty"`
+	Group            string   `json:"group,omitempty"`
+	AdditionalGroups []string `json:"additionalGroups,omitempty"`
+	// Terminal creates an interactive terminal for the process.
+	Terminal bool `json:"terminal"`
+	// Sequence number for stdin and stdout
+	Stdio uint64 `json:"stdio,omitempty"`
+	// Sequence number for stderr if it is not shared with stdout
+	Stderr uint64 `json:"stderr,omitempty"`
+	// Args specifies the binary and arguments for the application to execute.
+	Args []string `json:"args"`
+	// Envs populates the process environment for the process.
+	Envs []EnvironmentVar `json:"envs,omitempty"`
+	// Workdir is the current working directory for the process and must be
+	// relative to the container's root.
+	Workdir string `json:"workdir"`
+	// Rlimits specifies rlimit options to apply to the process.
+	Rlimits []Rlimit `json:"rlimits,omitempty"`
+}
+
+// VolumeDescriptor describes a volume related to a container.
+type VolumeDescriptor struct {
+	Device       string `json:"device"`
+	Addr         string `json:"addr,omitempty"`
+	Mount        string `json:"mount"`
+	Fstype       string `json:"fstype,omitempty"`
+	ReadOnly     bool   `json:"readOnly"`
+	DockerVolume bool   `json:"dockerVolume"`
+}
+
+// FsmapDescriptor describes a filesystem map related to a container.
+type FsmapDescriptor struct {
+	Source       string `json:"source"`
+	Path         string `json:"path"`
+	ReadOnly     bool   `json:"readOnly"`
+	DockerVolume bool   `json:"dockerVolume"`
+}
+
+// Container is the payload of the newcontainer command.
+type Container struct {
+	ID            string              `json:"id"`
+	Rootfs        string              `json:"rootfs"`
+	Fstype        string              `json:"fstype,omitempty"`
+	Image         string              `json:"image"`
+	Addr          string              `json:"addr,omitempty"`
+	Volumes       []*VolumeDescriptor `json:"volumes,omitempty"`
+	Fsmap         []*FsmapDescriptor  `json:"fsmap,omitempty"`
+	Sysctl        map[string]string   `json:"sysctl,omitempty"`
+	Process       *Process            `json:"process"`
+	RestartPolicy string              `json:"restartPolicy"`
+	Initialize    bool                `json:"initialize"`
+}
+
+// ExecCommand is the payload of the execcmd command, starting a new process
+// in an existing container.
+type ExecCommand struct {
+	Container string  `json:"container,omitempty"`
+	Process   Process `json:"process"`
+}
+
+// KillCommand is the payload of the killcontainer command.
+type KillCommand struct {
+	Container string         `json:"container"`
+	Signal    syscall.Signal `json:"signal"`
+}
+
+// RemoveCommand is the payload of the removecontainer command.
+type RemoveCommand struct {
+	Container string `json:"container"`
+}
+
+// FileCommand is the header of the writefile and readfile commands. For
+// writefile, the content of the file follows the JSON header.
+type FileCommand struct {
+	Container string `json:"container"`
+	File      string `json:"file"`
+}
+
+// WindowSizeMessage is the payload of the winsize command. Seq identifies
+// the process and is filled in by the proxy.
+//
+// This payload has changed in hyperstart 0.8, which identifies the process
+// with a container and process name.
+type WindowSizeMessage struct {
+	Seq    uint64 `json:"seq"`
+	Row    uint16 `json:"row"`
+	Column uint16 `json:"column"`
+}
+
+// IPAddress describes an IP address and its network mask.
+type IPAddress struct {
+	IPAddress string `json:"ipAddress"`
+	NetMask   string `json:"netMask"`
+}
+
+// NetworkIface describes a network interface to set up in the VM.
+type NetworkIface struct {
+	Device      string      `json:"device,omitempty"`
+	NewDevice   string      `json:"newDeviceName,omitempty"`
+	IPAddresses []IPAddress `json:"ipAddresses"`
+	MTU         string      `json:"mtu"`
+	MACAddr     string      `json:"macAddr"`
+}
+
+// Route describes a route to set up in the VM.
+type Route struct {
+	Dest    string `json:"dest"`
+	Gateway string `json:"gateway,omitempty"`
+	Device  string `json:"device,omitempty"`
+}
+
+// Pod is the payload of the startpod command.
+type Pod struct {
+	Hostname   string         `json:"hostname"`
+	Containers []Container    `json:"containers,omitempty"`
+	Interfaces []NetworkIface `json:"interfaces,omitempty"`
+	DNS        []string       `json:"dns,omitempty"`
+	Routes     []Route        `json:"routes,omitempty"`
+	ShareDir   string         `json:"shareDir"`
+}
+
+// SpecError is returned by the Validate methods. Field is the path of the
+// invalid field in the JSON payload, eg. "process.args".
+type SpecError struct {
+	Field  string
+	Reason string
+}
+
+func (e *SpecError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+func specErrorf(field, format string, a ...interface{}) *SpecError {
+	return &SpecError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, a...),
+	}
+}
+
+// Validate checks p describes a process hyperstart can start. The I/O
+// sequence numbers are left to the proxy and aren't checked.
+func (p *Process) Validate() error {
+	if len(p.Args) == 0 {
+		return specErrorf("args", "no command given")
+	}
+	if p.Args[0] == "" {
+		return specErrorf("args[0]", "empty command")
+	}
+
+	for i, env := range p.Envs {
+		if env.Env == "" {
+			return specErrorf(fmt.Sprintf("envs[%d].env", i), "empty variable name")
+		}
+		if strings.ContainsAny(env.Env, "=\x00") {
+			return specErrorf(fmt.Sprintf("envs[%d].env", i),
+				"invalid variable name %q", env.Env)
+		}
+	}
+
+	for i, rlimit := range p.Rlimits {
+		if rlimit.Type == "" {
+			return specErrorf(fmt.Sprintf("rlimits[%d].type", i), "empty type")
+		}
+		if rlimit.Soft > rlimit.Hard {
+			return specErrorf(fmt.Sprintf("rlimits[%d]", i),
+				"soft limit %d above hard limit %d", rlimit.Soft, rlimit.Hard)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks c is a valid newcontainer payload.
+func (c *Container) Validate() error {
+	if c.ID == "" {
+		return specErrorf("id", "empty container ID")
+	}
+	if c.Process == nil {
+		return specErrorf("process", "no process given")
+	}
+	if err := c.Process.Validate(); err != nil {
+		return prefixSpecError("process", err)
+	}
+	return nil
+}
+
+// Validate checks e is a valid execcmd payload.
+func (e *ExecCommand) Validate() error {
+	if e.Container == "" {
+		return specErrorf("container", "empty container ID")
+	}
+	if err := e.Process.Validate(); err != nil {
+		return prefixSpecError("process", err)
+	}
+	return nil
+}
+
+func prefixSpecError(prefix string, err error) error {
+	if specErr, ok := err.(*SpecError); ok {
+		return &SpecError{
+			Field:  prefix + "." + specErr.Field,
+			Reason: specErr.Reason,
+		}
+	}
+	return err
+}
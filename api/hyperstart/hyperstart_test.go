@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hyperstart
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The proxy rewrites newcontainer payloads, make sure no field is lost when
+// decoding and encoding a container again.
+func TestContainerRoundTrip(t *testing.T) {
+	data := []byte(`{"id":"foo","rootfs":"rootfs","fstype":"ext4","image":"img",` +
+		`"addr":"0:0","volumes":[{"device":"vda","mount":"/mnt","readOnly":true,` +
+		`"dockerVolume":false}],"fsmap":[{"source":"/src","path":"/dst",` +
+		`"readOnly":false,"dockerVolume":true}],"sysctl":{"net.ipv4.ip_forward":"1"},` +
+		`"process":{"user":"root","terminal":true,"args":["/bin/sh"],` +
+		`"envs":[{"env":"PATH","value":"/bin"}],"workdir":"/",` +
+		`"rlimits":[{"type":"RLIMIT_NOFILE","hard":1024,"soft":1024}]},` +
+		`"restartPolicy":"never","initialize":true}`)
+
+	container := Container{}
+	err := json.Unmarshal(data, &container)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", container.ID)
+	assert.NotNil(t, container.Process)
+
+	encoded, err := json.Marshal(&container)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(data), string(encoded))
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Process {
+		return &Process{
+			Args: []string{"/bin/sh"},
+			Envs: []EnvironmentVar{{Env: "PATH", Value: "/bin"}},
+		}
+	}
+
+	tests := []struct {
+		container *Container
+		field     string
+	}{
+		{&Container{ID: "foo", Process: valid()}, ""},
+		{&Container{Process: valid()}, "id"},
+		{&Container{ID: "foo"}, "process"},
+		{&Container{ID: "foo", Process: &Process{}}, "process.args"},
+		{&Container{ID: "foo", Process: &Process{Args: []string{""}}}, "process.args[0]"},
+		{&Container{ID: "foo", Process: &Process{
+			Args: []string{"/bin/sh"},
+			Envs: []EnvironmentVar{{Env: "PATH=/bin"}},
+		}}, "process.envs[0].env"},
+		{&Container{ID: "foo", Process: &Process{
+			Args:    []string{"/bin/sh"},
+			Rlimits: []Rlimit{{Type: "RLIMIT_NOFILE", Soft: 2048, Hard: 1024}},
+		}}, "process.rlimits[0]"},
+	}
+
+	for _, test := range tests {
+		err := test.container.Validate()
+		if test.field == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		specErr, ok := err.(*SpecError)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, test.field, specErr.Field)
+		}
+	}
+
+	exec := &ExecCommand{Process: *valid()}
+	err := exec.Validate()
+	assert.NotNil(t, err)
+	exec.Container = "foo"
+	err = exec.Validate()
+	assert.Nil(t, err)
+}
@@ -16,6 +16,7 @@ package api
 
 import (
 	"encoding/json"
+	"time"
 )
 
 // The RegisterVM payload is issued first after connecting to the proxy socket.
@@ -23,13 +24,15 @@ import (
 // with the paths go hyperstart's command and I/O channels (AF_UNIX sockets).
 //
 // Console can be used to indicate the path of a socket linked to the VM
-// console. The proxy can output this data when asked for verbose output.
+// console. The proxy can output this data when asked for verbose output and
+// forwards it to the clients asking for Logs.
 //
 //  {
 //    "containerId": "756535dc6e9ab9b560f84c8...",
 //    "ctlSerial": "/tmp/sh.hyper.channel.0.sock",
 //    "ioSerial": "/tmp/sh.hyper.channel.1.sock",
-//    "numIOStreams: 1
+//    "numIOStreams: 1,
+//    "outputRateLimit": 1048576
 //  }
 type RegisterVM struct {
 	ContainerID string `json:"containerId"`
@@ -43,6 +46,44 @@ type RegisterVM struct {
 	// status, ...
 	// The response frame will contain NumIOStreams I/O tokens.
 	NumIOStreams int `json:"numIOStreams,omitempty"`
+	// OutputRateLimit caps the throughput, in bytes per second, of each
+	// stdout and stderr stream of the processes running in the VM. When
+	// not given, the proxy default applies.
+	OutputRateLimit int `json:"outputRateLimit,omitempty"`
+	// OutputRateBurst is the number of bytes a stream can send in a burst
+	// when rate limited. It defaults to OutputRateLimit.
+	OutputRateBurst int `json:"outputRateBurst,omitempty"`
+	// Logs subscribes the client to the HyperstartLog notifications,
+	// carrying the messages hyperstart writes to the VM Console.
+	Logs bool `json:"logs,omitempty"`
+	// LineBuffered makes the proxy coalesce the stdout and stderr of the
+	// processes into newline terminated chunks, which log collectors
+	// prefer. An incomplete line is forwarded after a short delay. Shims
+	// can override this setting in ConnectShim. By default, output is
+	// forwarded as soon as it's received, as interactive sessions need.
+	LineBuffered bool `json:"lineBuffered,omitempty"`
+	// HyperstartVersion is the version of the hyperstart protocol spoken
+	// by the agent in the VM, eg. "0.7". The proxy rejects the Hyper
+	// commands this version doesn't support instead of forwarding them.
+	// When not given, the latest version known by the proxy is assumed.
+	// With "auto", the proxy negotiates the version with the agent: it
+	// picks the newest version it knows that the API version reported by
+	// the agent supports, the oldest if the agent doesn't answer.
+	HyperstartVersion string `json:"hyperstartVersion,omitempty"`
+	// ProbeAgent makes the proxy check the agent answers a ping and query
+	// its version before answering. The result is returned in
+	// RegisterVMResponse.Agent.
+	ProbeAgent bool `json:"probeAgent,omitempty"`
+	// Async makes RegisterVM return as soon as the VM is registered,
+	// without waiting for hyperstart. The proxy connects to the VM in the
+	// background and reports its progress with VMBoot notifications.
+	// Commands targeting the VM fail with ErrorCodeVMBooting until it's
+	// ready. Async can't be used with ProbeAgent.
+	Async bool `json:"async,omitempty"`
+	// QMP is the path of the QMP socket of the QEMU process running the
+	// VM. When given, the proxy reports the state of QEMU in Stats and
+	// declares the VM lost as soon as QEMU exits.
+	QMP string `json:"qmp,omitempty"`
 }
 
 // IOResponse is the response data in RegisterVMResponse and AttachVMResponse
@@ -54,6 +95,10 @@ type IOResponse struct {
 	// IOTokens is a array of I/O tokens of length NumIOStreams. See
 	// RegisterVM for some details on I/O tokens.
 	Tokens []string `json:"tokens"`
+	// ReadOnlyTokens[i] gives read-only access to the I/O session of
+	// Tokens[i]: it can only be used with ConnectShim.ReadOnly set, eg. by
+	// a log collector, which then can't send stdin or signals.
+	ReadOnlyTokens []string `json:"readOnlyTokens,omitempty"`
 }
 
 // RegisterVMResponse is the result from a successful RegisterVM.
@@ -69,6 +114,34 @@ type IOResponse struct {
 type RegisterVMResponse struct {
 	// IO contains the proxy answer when asking for I/O tokens.
 	IO IOResponse `json:"io,omitempty"`
+	// Agent describes the agent running in the VM when RegisterVM was
+	// given ProbeAgent.
+	Agent *AgentInfo `json:"agent,omitempty"`
+}
+
+// AgentInfo describes the capabilities of the agent running in a VM, as
+// probed by RegisterVM.
+//
+//  {
+//    "responsive": true,
+//    "hyperstartVersion": "0.7",
+//    "apiVersion": 4242,
+//    "commands": [ "destroypod", "execcmd", "killcontainer", ... ]
+//  }
+type AgentInfo struct {
+	// Responsive is false when the agent hasn't answered the ping or
+	// version commands. The VM is registered nonetheless.
+	Responsive bool `json:"responsive"`
+	// HyperstartVersion is the version of the hyperstart protocol the
+	// proxy speaks with the agent.
+	HyperstartVersion string `json:"hyperstartVersion"`
+	// APIVersion is the API version reported by hyperstart's version
+	// command, 0 if it didn't report one.
+	APIVersion int `json:"apiVersion,omitempty"`
+	// Commands lists the Hyper commands supported by the agent, eg.
+	// winsize to resize terminals or execcmd to start a process in an
+	// existing container.
+	Commands []string `json:"commands"`
 }
 
 // The AttachVM payload can be used to associate clients to an already known
@@ -84,6 +157,9 @@ type AttachVM struct {
 	// NumIOStreams asks for a number of I/O tokens. See RegisterVM for
 	// some details on I/O tokens.
 	NumIOStreams int `json:"numIOStreams,omitempty"`
+	// Logs subscribes the client to the HyperstartLog notifications. See
+	// RegisterVM.
+	Logs bool `json:"logs,omitempty"`
 }
 
 // AttachVMResponse is the result from a successful AttachVM.
@@ -94,11 +170,34 @@ type AttachVM struct {
 //      "tokens": [
 //        "bwgxfmQj9uG3YCsFHrvontwDw41CJJ76Y7qVt4Bi9wc="
 //      ]
+//    },
+//    "health": {
+//      "state": "healthy",
+//      "responsive": true,
+//      "connected": true,
+//      "lastPing": "2017-06-12T10:36:55.987654321Z"
 //    }
 //  }
 type AttachVMResponse struct {
 	// IO contains the proxy answer when asking for I/O tokens.
 	IO IOResponse `json:"io,omitempty"`
+	// Health is the state of the VM when it was attached to, so a client
+	// reconnecting to the proxy knows whether the VM is usable before
+	// sending commands.
+	Health VMHealth `json:"health"`
+}
+
+// VMHealth is the health of a VM, as returned by AttachVM.
+type VMHealth struct {
+	// State is the health of the VM, one of the VMState constants.
+	State string `json:"state"`
+	// Responsive is false when hyperstart has stopped answering pings,
+	// see NotificationAgentUnresponsive.
+	Responsive bool `json:"responsive"`
+	// Connected is true while the hyperstart serial channels are open.
+	Connected bool `json:"connected"`
+	// LastPing is when hyperstart last answered a ping, if ever.
+	LastPing *time.Time `json:"lastPing,omitempty"`
 }
 
 // The UnregisterVM payload does the opposite of what RegisterVM does,
@@ -117,7 +216,20 @@ type UnregisterVM struct {
 // Note: the newcontainer and execmd hyperstart commands start one or more
 // processes. When sending those commands, tokens acquired through either
 // RegisterVM or AttachVM need to be sent along in the tokens array. The number
-// of tokens sent has to match the number of processes to be started.
+// of tokens sent has to match the number of processes to be started. The
+// winsize command must be given the token of the process to resize.
+//
+// Tokens stand for the hyperstart I/O sequence numbers, which the proxy owns:
+// it fills them in the commands it forwards and clients must leave them to 0.
+//
+// The payloads of the hyperstart commands are defined in the api/hyperstart
+// package.
+//
+// With async set, the proxy answers as soon as the command has been checked,
+// with an operation ID in HyperResponse, and sends the command to hyperstart in
+// the background. Its result comes later in a NotificationHyperCompleted
+// carrying the same operation ID. This lets clients have several commands in
+// flight, eg. the newcontainer commands of a pod.
 //
 //  {
 //    "hyperName": "newcontainer",
@@ -135,6 +247,72 @@ type Hyper struct {
 	HyperName string          `json:"hyperName"`
 	Tokens    []string        `json:"tokens"`
 	Data      json.RawMessage `json:"data,omitempty"`
+	Async     bool            `json:"async,omitempty"`
+}
+
+// HyperResponse is the result of a Hyper command sent with async set.
+//
+//  {
+//    "operationId": 3
+//  }
+type HyperResponse struct {
+	// OperationID identifies the command in the
+	// NotificationHyperCompleted sent once hyperstart has answered.
+	OperationID uint64 `json:"operationId,omitempty"`
+}
+
+// HyperBatch sends Commands, Hyper payloads, to hyperstart in order, sparing
+// the round trips of a fixed sequence of commands, eg. at pod startup. The
+// proxy stops at the first command that fails. The commands of a batch can't
+// be async.
+//
+//  {
+//    "commands": [
+//      {
+//        "hyperName": "startpod",
+//        "data": { ... }
+//      },
+//      {
+//        "hyperName": "newcontainer",
+//        "tokens": [
+//          "bwgxfmQj9uG3YCsFHrvontwDw41CJJ76Y7qVt4Bi9wc="
+//        ],
+//        "data": { ... }
+//      }
+//    ]
+//  }
+type HyperBatch struct {
+	Commands []Hyper `json:"commands"`
+}
+
+// HyperResult is the result of one command of a HyperBatch. Error and Code
+// are set when the command has failed, like they would be in the
+// ErrorResponse of a Hyper command.
+type HyperResult struct {
+	HyperName string `json:"hyperName"`
+	Error     string `json:"error,omitempty"`
+	// Code classifies Error, see ErrorCode.
+	Code ErrorCode `json:"code,omitempty"`
+}
+
+// HyperBatchResponse is the result of a HyperBatch. Results has one entry per
+// command sent to hyperstart: the commands following a failed one aren't sent
+// and have no result.
+//
+//  {
+//    "results": [
+//      {
+//        "hyperName": "startpod"
+//      },
+//      {
+//        "hyperName": "newcontainer",
+//        "error": "hyperstart failed to start container 756535dc6e9ab9b560f84c8...",
+//        "code": 10
+//      }
+//    ]
+//  }
+type HyperBatchResponse struct {
+	Results []HyperResult `json:"results"`
 }
 
 // ConnectShim identifies a shim against the proxy. A shim process is a process
@@ -146,6 +324,57 @@ type ConnectShim struct {
 	// the I/O streams, signals, exit status for. Tokens are allocated with
 	// a call to RegisterVM or AttachVM.
 	Token string `json:"token"`
+	// ReadOnly asks to receive a copy of stdout, stderr and the exit
+	// status of the process, eg. for a log collector, next to the shim
+	// that claimed the token. Read-only clients can't send stdin or
+	// signals. When they don't read their output fast enough, that output
+	// is dropped rather than slowing down the process. Read-only tokens,
+	// see IOResponse.ReadOnlyTokens, can only be used with ReadOnly set.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Terminal, when given, declares whether the shim has set up a
+	// terminal for the process. The proxy then rejects the newcontainer
+	// or execcmd hyper command starting the process in the other mode.
+	//
+	// Like with runc, a process with a terminal only has one output
+	// stream: stderr is merged into stdout. Without terminal, stdout and
+	// stderr are kept separate.
+	Terminal *bool `json:"terminal,omitempty"`
+	// ChunkSize is the maximum payload size, in bytes, of the stream
+	// frames the shim wants to exchange for this process, 0 for the
+	// proxy default. The proxy clamps it to the sizes it supports and
+	// returns the value in use in ConnectShimResponse. Output is split
+	// into frames no bigger than the chunk size and stdin frames must
+	// not exceed it.
+	ChunkSize int `json:"chunkSize,omitempty"`
+	// Compression lists the compression algorithms the shim can decode,
+	// eg. CompressionDeflate. The proxy picks one, returned in
+	// ConnectShimResponse, and compresses the output of the process while
+	// its throughput is high. Compressed frames have the Compressed flag
+	// set. Read-only clients don't get compressed output.
+	Compression []string `json:"compression,omitempty"`
+	// LineBuffered, when given, overrides the LineBuffered setting of
+	// RegisterVM for this process. The mode in use is returned in
+	// ConnectShimResponse.
+	LineBuffered *bool `json:"lineBuffered,omitempty"`
+}
+
+// ConnectShimResponse is the result from a successful ConnectShim.
+//
+//  {
+//    "chunkSize": 32768,
+//    "compression": "deflate",
+//    "lineBuffered": true
+//  }
+type ConnectShimResponse struct {
+	// ChunkSize is the maximum payload size of the stream frames
+	// exchanged with the shim.
+	ChunkSize int `json:"chunkSize"`
+	// Compression is the compression algorithm the proxy may use for the
+	// output of the process, empty when the output isn't compressed.
+	Compression string `json:"compression,omitempty"`
+	// LineBuffered is true when the output of the process is coalesced
+	// into newline terminated chunks.
+	LineBuffered bool `json:"lineBuffered,omitempty"`
 }
 
 // DisconnectShim unregister a shim from the proxy.
@@ -154,6 +383,13 @@ type DisconnectShim struct {
 
 // Signal is used to send signals to the container process inside the VM. This
 // payload is only valid after a successful ConnectShim.
+//
+// SIGWINCH changes the size of the process terminal. Sizes received before
+// the process is started by the newcontainer or execcmd hyper commands are
+// applied once it has been started, only the last one is kept.
+//
+// Signals are delivered out of band: they don't wait for the stdin data sent
+// before them to be written to the process. SIGKILL discards that data.
 type Signal struct {
 	SignalNumber int `json:"signalNumber"`
 	// Columns is only valid for SIGWINCH and is the new number of columns of
@@ -164,7 +400,588 @@ type Signal struct {
 	Rows int `json:"rows,omitempty"`
 }
 
+// Stats asks for the I/O statistics of the VM identified by ContainerID, or
+// of all the VMs when ContainerID is empty.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8..."
+//  }
+type Stats struct {
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// StreamStats counts the bytes relayed by the proxy for the processes of a
+// container, per stream.
+type StreamStats struct {
+	Stdin  uint64 `json:"stdin"`
+	Stdout uint64 `json:"stdout"`
+	Stderr uint64 `json:"stderr"`
+	// LastActivity is when a process of the container was last started
+	// or had I/O.
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// The health states of a VM reported in VMStats.
+const (
+	// VMStateHealthy is the state of a VM working as expected.
+	VMStateHealthy = "healthy"
+	// VMStateUnhealthy is the state of a VM marked as unhealthy after a
+	// hyper command timed out, see ErrorCodeVMUnhealthy.
+	VMStateUnhealthy = "unhealthy"
+	// VMStateDegraded is the state of a VM the proxy is reconnecting to,
+	// see NotificationVMDegraded.
+	VMStateDegraded = "degraded"
+	// VMStateUnresponsive is the state of a VM whose hyperstart has
+	// stopped answering pings, see NotificationAgentUnresponsive.
+	VMStateUnresponsive = "unresponsive"
+	// VMStateLost is the state of a VM whose hyperstart channels are gone
+	// for good. It's unregistered by the proxy after a grace period.
+	VMStateLost = "lost"
+	// VMStateBooting is the state of a VM registered with RegisterVM.Async
+	// the proxy isn't connected to yet, see NotificationVMBoot.
+	VMStateBooting = "booting"
+)
+
+// VMStats are the I/O statistics of a VM.
+type VMStats struct {
+	ContainerID string `json:"containerId"`
+	// State is the health of the VM, one of the VMState constants.
+	State string `json:"state"`
+	// LastPing is when hyperstart last answered a ping, if ever.
+	LastPing *time.Time `json:"lastPing,omitempty"`
+	// HyperstartVersion is the version of the hyperstart protocol the
+	// proxy speaks with the agent, given or negotiated at RegisterVM.
+	HyperstartVersion string `json:"hyperstartVersion"`
+	// AgentAPIVersion is the API version reported by the agent when the
+	// hyperstart version was negotiated.
+	AgentAPIVersion int `json:"agentApiVersion,omitempty"`
+	// QEMU is the state of the QEMU process running the VM, when it was
+	// registered with a QMP socket.
+	QEMU *QEMUState `json:"qemu,omitempty"`
+	// Resources are the host resources the proxy uses for the VM.
+	Resources VMResources `json:"resources"`
+	// HyperCommands is the number of commands sent to hyperstart, the
+	// pings of the proxy excepted.
+	HyperCommands uint64 `json:"hyperCommands"`
+	// Containers holds the statistics of the containers running in the
+	// VM, indexed by the container ID given in the newcontainer and
+	// execcmd hyper commands.
+	Containers map[string]StreamStats `json:"containers"`
+}
+
+// QEMUState is the state of a QEMU process, as reported by QMP.
+type QEMUState struct {
+	// Status is the run state of the VM, eg. "running" or "paused".
+	Status string `json:"status"`
+	// Running is true when the vCPUs are running.
+	Running bool `json:"running"`
+	// VCPUs is the number of vCPUs of the VM.
+	VCPUs int `json:"vcpus"`
+}
+
+// VMResources are the host resources the proxy uses for a VM, to attribute
+// leaks to a container rather than only observing them globally.
+type VMResources struct {
+	// Goroutines is the number of goroutines the proxy runs for the VM.
+	Goroutines int `json:"goroutines"`
+	// FDs is the number of file descriptors the proxy has opened for
+	// the VM: hyperstart channels, console, client connections and
+	// capture file.
+	FDs int `json:"fds"`
+	// BufferedBytes is the amount of I/O data waiting to be written to
+	// the clients or to hyperstart.
+	BufferedBytes int `json:"bufferedBytes"`
+	// Tokens is the number of I/O tokens allocated for the VM, of which
+	// ClaimedTokens have been claimed by a shim.
+	Tokens        int `json:"tokens"`
+	ClaimedTokens int `json:"claimedTokens"`
+}
+
+// StatsResponse is the result from a successful Stats.
+//
+//  {
+//    "vms": [
+//      {
+//        "containerId": "756535dc6e9ab9b560f84c8...",
+//        "state": "healthy",
+//        "lastPing": "2017-06-12T10:36:55.987654321Z",
+//        "hyperstartVersion": "0.7",
+//        "agentApiVersion": 4242,
+//        "qemu": {
+//          "status": "running",
+//          "running": true,
+//          "vcpus": 2
+//        },
+//        "resources": {
+//          "goroutines": 6,
+//          "fds": 4,
+//          "bufferedBytes": 0,
+//          "tokens": 1,
+//          "claimedTokens": 1
+//        },
+//        "hyperCommands": 3,
+//        "containers": {
+//          "756535dc6e9ab9b560f84c8...": {
+//            "stdin": 12,
+//            "stdout": 4096,
+//            "stderr": 0,
+//            "lastActivity": "2017-06-12T10:36:58.123456789Z"
+//          }
+//        }
+//      }
+//    ]
+//  }
+type StatsResponse struct {
+	VMs []VMStats `json:"vms"`
+}
+
+// Capture starts, or stops, recording the stdin, stdout and stderr traffic
+// of the VM identified by ContainerID to a file. This is a debugging aid,
+// eg. to investigate I/O corruption issues.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "enable": true
+//  }
+type Capture struct {
+	ContainerID string `json:"containerId"`
+	Enable      bool   `json:"enable"`
+}
+
+// CaptureResponse is the result from a successful Capture.
+//
+//  {
+//    "path": "/tmp/756535dc6e9ab9b560f84c8...-20170612T103658.123456789.capture"
+//  }
+type CaptureResponse struct {
+	// Path is the capture file on the proxy host.
+	Path string `json:"path"`
+}
+
+// Pause quiesces the I/O relay of the VM identified by ContainerID, eg.
+// before taking a snapshot of the VM or migrating it. Once Pause returns:
+//
+//  - the proxy doesn't read the io channel anymore, the output of the
+//    processes is left in the VM.
+//  - the output read before the pause has been written to the clients.
+//  - no stdin message is partially written to hyperstart. stdin data sent
+//    by shims while the VM is paused is held by the proxy until Resume.
+//
+// With vm set, the proxy then also stops the vCPUs of the VM through QMP,
+// eg. to implement docker pause. The VM must have been registered with a QMP
+// socket. Resume restarts them.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "vm": true
+//  }
+type Pause struct {
+	ContainerID string `json:"containerId"`
+	VM          bool   `json:"vm,omitempty"`
+}
+
+// Resume restarts the I/O relay of a VM paused with Pause, and its vCPUs if
+// Pause has stopped them.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8..."
+//  }
+type Resume struct {
+	ContainerID string `json:"containerId"`
+}
+
+// Hotplug adds CPUs vCPUs and MemoryMB MiB of memory to the VM identified by
+// ContainerID, eg. for docker update. The proxy plugs them in through QMP, so
+// the VM must have been registered with a QMP socket, then asks hyperstart to
+// online them. Hotplug returns once the guest has onlined them, with the
+// result in HotplugResponse.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "cpus": 2,
+//    "memoryMB": 512
+//  }
+type Hotplug struct {
+	ContainerID string `json:"containerId"`
+	CPUs        int    `json:"cpus,omitempty"`
+	MemoryMB    int    `json:"memoryMB,omitempty"`
+}
+
+// HotplugResponse is the result of a successful Hotplug.
+//
+//  {
+//    "vcpus": 4
+//  }
+type HotplugResponse struct {
+	// VCPUs is the number of vCPUs of the VM after the hotplug.
+	VCPUs int `json:"vcpus"`
+}
+
+// Cancel cancels the asynchronous hyper command OperationID, sent to the VM
+// identified by ContainerID with Hyper.Async. The proxy stops waiting for
+// hyperstart to answer the command, and retrying it, and sends the
+// NotificationHyperCompleted of the operation with ErrorCodeCancelled. Only
+// the client that sent the command can cancel it, others get an
+// ErrorCodeForbidden error.
+//
+// hyperstart has no way to abort a command: one it has already received may
+// still be executed in the VM.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "operationId": 3
+//  }
+type Cancel struct {
+	ContainerID string `json:"containerId"`
+	OperationID uint64 `json:"operationId"`
+}
+
+// RenewTokens re-issues the I/O tokens Tokens of the VM identified by
+// ContainerID, before they expire. The proxy can be configured to only accept
+// tokens for a limited time after issuing them: runtimes keeping tokens
+// around for long-lived containers, eg. to attach read-only clients later,
+// renew them. The new tokens give access to the same I/O sessions and the
+// old ones become invalid. Expired tokens can't be renewed, nor can read-only
+// tokens: renewing the token of a session gives a new read-only token too.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "tokens": [
+//      "eyJjb250YWluZXJJZCI6Ijc1NjUzNWRj...",
+//      "eyJjb250YWluZXJJZCI6Ijc1NjUzNWRj..."
+//    ]
+//  }
+type RenewTokens struct {
+	ContainerID string   `json:"containerId"`
+	Tokens      []string `json:"tokens"`
+}
+
+// RenewTokensResponse is the result of a successful RenewTokens, the new
+// tokens in the order of RenewTokens.Tokens and the read-only tokens of
+// their sessions, see IOResponse.ReadOnlyTokens.
+//
+//  {
+//    "tokens": [
+//      "eyJjb250YWluZXJJZCI6Ijc1NjUzNWRj...",
+//      "eyJjb250YWluZXJJZCI6Ijc1NjUzNWRj..."
+//    ],
+//    "readOnlyTokens": [
+//      "eyJjb250YWluZXJJZCI6Ijc1NjUzNWRj...",
+//      "eyJjb250YWluZXJJZCI6Ijc1NjUzNWRj..."
+//    ]
+//  }
+type RenewTokensResponse struct {
+	Tokens         []string `json:"tokens"`
+	ReadOnlyTokens []string `json:"readOnlyTokens,omitempty"`
+}
+
+// WriteFile writes Data to the file Path of the container Container, running
+// in the VM the client is attached to, creating the file or replacing its
+// content. Data is base64 encoded in the JSON payload.
+//
+// The whole file goes in a single hyperstart message, which can't be bigger
+// than 10KB: WriteFile is meant for small files, eg. configuration files.
+//
+//  {
+//    "container": "756535dc6e9ab9b560f84c8...",
+//    "path": "/etc/hosts",
+//    "data": "MTI3LjAuMC4xIGxvY2FsaG9zdAo="
+//  }
+type WriteFile struct {
+	Container string `json:"container"`
+	Path      string `json:"path"`
+	Data      []byte `json:"data"`
+}
+
+// ReadFile reads the file Path of the container Container, running in the VM
+// the client is attached to. The content of the file is returned in
+// ReadFileResponse.
+//
+// Like for WriteFile, the file comes back in a single hyperstart message:
+// ReadFile is meant for small files.
+//
+//  {
+//    "container": "756535dc6e9ab9b560f84c8...",
+//    "path": "/etc/resolv.conf"
+//  }
+type ReadFile struct {
+	Container string `json:"container"`
+	Path      string `json:"path"`
+}
+
+// ReadFileResponse is the result of a successful ReadFile. Data is base64
+// encoded.
+//
+//  {
+//    "data": "bmFtZXNlcnZlciAxMC4wLjAuMQo="
+//  }
+type ReadFileResponse struct {
+	Data []byte `json:"data"`
+}
+
+// ErrorCode classifies the errors returned by the proxy so clients can react
+// to them programmatically.
+type ErrorCode int
+
+const (
+	// ErrorCodeUnknown is used for errors that haven't been classified.
+	ErrorCodeUnknown ErrorCode = iota
+	// ErrorCodeHyperTimeout is returned when hyperstart hasn't answered a
+	// command in time.
+	ErrorCodeHyperTimeout
+	// ErrorCodeVMUnhealthy is returned when a command targets a VM that
+	// has been marked as unhealthy, eg. after hyperstart stopped
+	// answering commands.
+	ErrorCodeVMUnhealthy
+	// ErrorCodeVMDegraded is returned when a command targets a VM the
+	// proxy is trying to reconnect to.
+	ErrorCodeVMDegraded
+	// ErrorCodeAgentUnresponsive is returned when a command targets a VM
+	// whose hyperstart has stopped answering pings.
+	ErrorCodeAgentUnresponsive
+	// ErrorCodeUnsupportedCommand is returned when a Hyper command isn't
+	// supported by the hyperstart version running in the VM.
+	ErrorCodeUnsupportedCommand
+	// ErrorCodeVMBooting is returned when a command targets a VM
+	// registered with RegisterVM.Async the proxy isn't connected to yet.
+	ErrorCodeVMBooting
+	// ErrorCodeInvalidSpec is returned when the process or container
+	// given to the newcontainer or execcmd hyper commands is invalid. The
+	// message names the offending field.
+	ErrorCodeInvalidSpec
+	// ErrorCodeAgentError is returned when hyperstart has refused a hyper
+	// command the proxy can't classify further.
+	ErrorCodeAgentError
+	// ErrorCodeContainerExists is returned when hyperstart has refused a
+	// newcontainer for a container it has already created.
+	ErrorCodeContainerExists
+	// ErrorCodeExecFailed is returned when hyperstart has failed to
+	// start the container or process of a newcontainer or execcmd.
+	ErrorCodeExecFailed
+	// ErrorCodeProcessNotFound is returned when hyperstart has refused a
+	// winsize, killcontainer or removecontainer command, targeting a
+	// process or container it doesn't know.
+	ErrorCodeProcessNotFound
+	// ErrorCodeForbidden is returned when the hyper policy of the proxy
+	// doesn't allow the client to send a hyper command.
+	ErrorCodeForbidden
+	// ErrorCodeCancelled is returned when an asynchronous hyper command
+	// has been cancelled with CmdCancel.
+	ErrorCodeCancelled
+	// ErrorCodeInvalidPayload is returned when the JSON payload of a
+	// command doesn't match its schema, see ValidatePayload. The message
+	// names the offending field.
+	ErrorCodeInvalidPayload
+	// ErrorCodeMax is the number of error codes.
+	ErrorCodeMax
+)
+
+// String implements Stringer for ErrorCode.
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeUnknown:
+		return "unknown"
+	case ErrorCodeHyperTimeout:
+		return "HyperTimeout"
+	case ErrorCodeVMUnhealthy:
+		return "VMUnhealthy"
+	case ErrorCodeVMDegraded:
+		return "VMDegraded"
+	case ErrorCodeAgentUnresponsive:
+		return "AgentUnresponsive"
+	case ErrorCodeUnsupportedCommand:
+		return "UnsupportedCommand"
+	case ErrorCodeVMBooting:
+		return "VMBooting"
+	case ErrorCodeInvalidSpec:
+		return "InvalidSpec"
+	case ErrorCodeAgentError:
+		return "AgentError"
+	case ErrorCodeContainerExists:
+		return "ContainerExists"
+	case ErrorCodeExecFailed:
+		return "ExecFailed"
+	case ErrorCodeProcessNotFound:
+		return "ProcessNotFound"
+	case ErrorCodeForbidden:
+		return "Forbidden"
+	case ErrorCodeCancelled:
+		return "Cancelled"
+	case ErrorCodeInvalidPayload:
+		return "InvalidPayload"
+	default:
+		return "invalid"
+	}
+}
+
 // ErrorResponse is the payload send in Responses where the Error flag is set.
+//
+//  {
+//    "msg": "timeout waiting for hyperstart to answer newcontainer",
+//    "code": 1
+//  }
 type ErrorResponse struct {
 	Message string `json:"msg"`
+	// Code classifies the error, see ErrorCode.
+	Code ErrorCode `json:"code,omitempty"`
+}
+
+// HyperTimeout is the payload of the NotificationHyperTimeout notification.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "hyperName": "newcontainer",
+//    "unhealthy": true
+//  }
+type HyperTimeout struct {
+	ContainerID string `json:"containerId"`
+	// HyperName is the hyperstart command that timed out.
+	HyperName string `json:"hyperName"`
+	// Unhealthy is true when the VM has been marked as unhealthy as a
+	// result of the timeout. Subsequent hyper commands will be rejected.
+	Unhealthy bool `json:"unhealthy,omitempty"`
+}
+
+// HyperCompleted is the payload of the NotificationHyperCompleted
+// notification. Error and Code are set when the command has failed, like they
+// would be in the ErrorResponse of a synchronous Hyper command.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "operationId": 3,
+//    "hyperName": "newcontainer",
+//    "error": "timeout waiting for hyperstart to answer newcontainer (30s)",
+//    "code": 1
+//  }
+type HyperCompleted struct {
+	ContainerID string `json:"containerId"`
+	// OperationID is the ID returned in the HyperResponse.
+	OperationID uint64 `json:"operationId"`
+	HyperName   string `json:"hyperName"`
+	Error       string `json:"error,omitempty"`
+	// Code classifies Error, see ErrorCode.
+	Code ErrorCode `json:"code,omitempty"`
+}
+
+// VMDegraded is the payload of the NotificationVMDegraded notification.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "reason": "read unix @->/tmp/hyper-pod-io.sock: read: connection reset by peer"
+//  }
+type VMDegraded struct {
+	ContainerID string `json:"containerId"`
+	// Reason is the error that made the proxy lose its connection to
+	// hyperstart.
+	Reason string `json:"reason"`
+}
+
+// VMRecovered is the payload of the NotificationVMRecovered notification.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8..."
+//  }
+type VMRecovered struct {
+	ContainerID string `json:"containerId"`
+}
+
+// AgentUnresponsive is the payload of the NotificationAgentUnresponsive
+// notification. A NotificationVMRecovered is sent once hyperstart answers a
+// ping again.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "missedPings": 3,
+//    "lastPing": "2017-06-12T10:36:55.987654321Z"
+//  }
+type AgentUnresponsive struct {
+	ContainerID string `json:"containerId"`
+	// MissedPings is the number of pings hyperstart has missed in a row.
+	MissedPings int `json:"missedPings"`
+	// LastPing is when hyperstart last answered a ping, if ever.
+	LastPing *time.Time `json:"lastPing,omitempty"`
+}
+
+// ProcessIdle is the payload of the NotificationProcessIdle notification.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "token": "bwgxfmQj9uG3YWsFIrfPgpXe0WV97HmMhPq9b+wnP1Q=",
+//    "lastActivity": "2017-06-12T10:36:58.123456789Z",
+//    "lastPing": "2017-06-12T10:36:55.987654321Z"
+//  }
+type ProcessIdle struct {
+	ContainerID string `json:"containerId"`
+	// Token is the I/O token of the process.
+	Token string `json:"token"`
+	// LastActivity is when the process was started or last had I/O.
+	LastActivity time.Time `json:"lastActivity"`
+	// LastPing is when hyperstart last answered a ping, if ever.
+	LastPing *time.Time `json:"lastPing,omitempty"`
+}
+
+// ProcessFinished is the payload of the NotificationProcessFinished
+// notification.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "container": "756535dc6e9ab9b560f84c8...",
+//    "token": "bwgxfmQj9uG3YWsFIrfPgpXe0WV97HmMhPq9b+wnP1Q=",
+//    "exitStatus": 0
+//  }
+type ProcessFinished struct {
+	ContainerID string `json:"containerId"`
+	// Container is the container the process was running in, as given
+	// to newcontainer or execcmd.
+	Container string `json:"container,omitempty"`
+	// Token is the I/O token of the process.
+	Token string `json:"token"`
+	// ExitStatus is the exit status of the process.
+	ExitStatus int `json:"exitStatus"`
+	// Lost is set when the proxy has lost the VM: the process may still
+	// be running and ExitStatus is 255.
+	Lost bool `json:"lost,omitempty"`
+}
+
+// The boot states reported in VMBoot notifications, in order.
+const (
+	// VMBootConnected is reported once the hyperstart channels are open.
+	VMBootConnected = "connected"
+	// VMBootStarted is reported once hyperstart has signaled it's
+	// started.
+	VMBootStarted = "started"
+	// VMBootReady is reported once hyperstart has answered a first ping:
+	// the VM can be used.
+	VMBootReady = "ready"
+	// VMBootFailed is reported when the proxy couldn't connect to the VM
+	// or hyperstart didn't answer. It ends the boot.
+	VMBootFailed = "failed"
+)
+
+// VMBoot is the payload of the NotificationVMBoot notification.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "state": "failed",
+//    "error": "dial unix /tmp/sh.hyper.channel.0.sock: connect: no such file or directory"
+//  }
+type VMBoot struct {
+	ContainerID string `json:"containerId"`
+	// State is one of the VMBoot constants.
+	State string `json:"state"`
+	// Error is why the boot has failed.
+	Error string `json:"error,omitempty"`
+}
+
+// HyperstartLog is the payload of the NotificationHyperstartLog
+// notification. Message is a line written by hyperstart to the VM console,
+// without the line terminator.
+//
+//  {
+//    "containerId": "756535dc6e9ab9b560f84c8...",
+//    "message": "hyper_setup_container: mounting rootfs"
+//  }
+type HyperstartLog struct {
+	ContainerID string `json:"containerId"`
+	Message     string `json:"message"`
 }
@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodeString(t *testing.T) {
+	tests := []struct {
+		c ErrorCode
+		s string
+	}{
+		{ErrorCodeUnknown, "unknown"},
+		{ErrorCodeHyperTimeout, "HyperTimeout"},
+		{ErrorCodeVMUnhealthy, "VMUnhealthy"},
+		{ErrorCodeVMDegraded, "VMDegraded"},
+		{ErrorCodeAgentUnresponsive, "AgentUnresponsive"},
+		{ErrorCodeUnsupportedCommand, "UnsupportedCommand"},
+		{ErrorCodeVMBooting, "VMBooting"},
+		{ErrorCodeInvalidSpec, "InvalidSpec"},
+		{ErrorCodeAgentError, "AgentError"},
+		{ErrorCodeContainerExists, "ContainerExists"},
+		{ErrorCodeExecFailed, "ExecFailed"},
+		{ErrorCodeProcessNotFound, "ProcessNotFound"},
+		{ErrorCodeForbidden, "Forbidden"},
+		{ErrorCodeCancelled, "Cancelled"},
+		{ErrorCodeInvalidPayload, "InvalidPayload"},
+		{ErrorCodeMax, "invalid"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.s, test.c.String())
+	}
+}
+
+func BenchmarkPayloadRoundTrip(b *testing.B) {
+	terminal := true
+	payloads := []struct {
+		name  string
+		value interface{}
+		new   func() interface{}
+	}{
+		{
+			"RegisterVM",
+			&RegisterVM{
+				ContainerID:  "756535dc6e9ab9b560f84c8",
+				CtlSerial:    "/tmp/sh.hyper.channel.0.sock",
+				IoSerial:     "/tmp/sh.hyper.channel.1.sock",
+				NumIOStreams: 1,
+			},
+			func() interface{} { return &RegisterVM{} },
+		},
+		{
+			"Hyper",
+			&Hyper{
+				HyperName: "execcmd",
+				Tokens:    []string{"bwgxfmQj9uG3YWsFIrlUk4NDXz0Hqvkdiaje2kQuELo="},
+				Data: json.RawMessage(`{"container":"756535dc6e9ab9b560f84c8",` +
+					`"process":{"terminal":true,"args":["/bin/sh"],` +
+					`"envs":[{"env":"PATH","value":"/bin:/usr/bin"}],` +
+					`"workdir":"/"}}`),
+			},
+			func() interface{} { return &Hyper{} },
+		},
+		{
+			"ConnectShim",
+			&ConnectShim{
+				Token:       "bwgxfmQj9uG3YWsFIrlUk4NDXz0Hqvkdiaje2kQuELo=",
+				Terminal:    &terminal,
+				Compression: []string{"gzip"},
+			},
+			func() interface{} { return &ConnectShim{} },
+		},
+		{
+			"AttachVMResponse",
+			&AttachVMResponse{
+				IO: IOResponse{
+					URL:    "unix:///run/clear-containers/proxy.sock",
+					Tokens: []string{"bwgxfmQj9uG3YWsFIrlUk4NDXz0Hqvkdiaje2kQuELo="},
+				},
+				Health: VMHealth{
+					State:      "running",
+					Responsive: true,
+					Connected:  true,
+				},
+			},
+			func() interface{} { return &AttachVMResponse{} },
+		},
+	}
+
+	for _, payload := range payloads {
+		b.Run(payload.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				data, err := json.Marshal(payload.value)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := json.Unmarshal(data, payload.new()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
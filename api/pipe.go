@@ -0,0 +1,293 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pipeFiles are files written to a pipe with the data between start and
+// end.
+type pipeFiles struct {
+	start, end int64
+	files      []*os.File
+}
+
+// pipeBuffer is one direction of a pipe transport.
+type pipeBuffer struct {
+	sync.Mutex
+
+	data  []byte
+	files []pipeFiles
+	// read and written are the number of bytes read and written so far,
+	// to locate the attached files in the stream.
+	read, written int64
+
+	// eof is set when the writing end is closed, closed when the reading
+	// end is.
+	eof, closed bool
+
+	readDeadline, writeDeadline time.Time
+
+	// changed is closed and replaced every time the buffer changes.
+	changed chan struct{}
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{
+		changed: make(chan struct{}),
+	}
+}
+
+// broadcast wakes up the readers. Must be called with the lock held.
+func (b *pipeBuffer) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// closeFiles closes the files not received yet. Must be called with the lock
+// held.
+func (b *pipeBuffer) closeFiles() {
+	for _, f := range b.files {
+		closeAll(f.files)
+	}
+	b.files = nil
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// pipeTimeoutError is returned when a deadline is exceeded.
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "api: i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeTransport is one end of the transports returned by NewPipeTransport.
+type pipeTransport struct {
+	rx, tx *pipeBuffer
+}
+
+// NewPipeTransport returns two connected in-memory transports, to test
+// clients and servers without sockets. Data written to one end is read from
+// the other.
+//
+// The transports behave like the two ends of an AF_UNIX socket pair: writes
+// are buffered and don't block, files are duplicated when written and
+// received by the read returning the first byte they were sent with, reads
+// don't go past the data files were sent with and Read closes the files
+// attached to the data it returns. Deadlines are supported.
+func NewPipeTransport() (Transport, Transport) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &pipeTransport{rx: a, tx: b}, &pipeTransport{rx: b, tx: a}
+}
+
+func (p *pipeTransport) Read(b []byte) (int, error) {
+	n, files, err := p.ReadFiles(b)
+	closeAll(files)
+	return n, err
+}
+
+func (p *pipeTransport) ReadFiles(b []byte) (int, []*os.File, error) {
+	rx := p.rx
+
+	rx.Lock()
+	defer rx.Unlock()
+
+	for {
+		if rx.closed {
+			return 0, nil, io.ErrClosedPipe
+		}
+
+		if len(rx.data) > 0 {
+			break
+		}
+
+		if rx.eof {
+			return 0, nil, io.EOF
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !rx.readDeadline.IsZero() {
+			d := rx.readDeadline.Sub(time.Now())
+			if d <= 0 {
+				return 0, nil, pipeTimeoutError{}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		changed := rx.changed
+		rx.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		rx.Lock()
+	}
+
+	n := len(b)
+	if n > len(rx.data) {
+		n = len(rx.data)
+	}
+
+	var files []*os.File
+	if len(rx.files) > 0 {
+		f := rx.files[0]
+		if f.start < rx.read+int64(n) {
+			if f.end < rx.read+int64(n) {
+				n = int(f.end - rx.read)
+			}
+			files = f.files
+			rx.files = rx.files[1:]
+		}
+	}
+
+	copy(b, rx.data[:n])
+	rx.data = rx.data[n:]
+	rx.read += int64(n)
+
+	return n, files, nil
+}
+
+func (p *pipeTransport) Write(b []byte) (int, error) {
+	return p.WriteFiles(b, nil)
+}
+
+func (p *pipeTransport) WriteFiles(data []byte, files []*os.File) (int, error) {
+	if len(files) > MaxFiles {
+		return 0, syscall.ETOOMANYREFS
+	}
+	if len(files) > 0 && len(data) == 0 {
+		return 0, errNoData
+	}
+
+	tx := p.tx
+
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.eof || tx.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if !tx.writeDeadline.IsZero() && !time.Now().Before(tx.writeDeadline) {
+		return 0, pipeTimeoutError{}
+	}
+
+	// Like SCM_RIGHTS, give the reader its own descriptors.
+	if len(files) > 0 {
+		dups := make([]*os.File, 0, len(files))
+		for _, f := range files {
+			fd, err := syscall.Dup(int(f.Fd()))
+			if err != nil {
+				closeAll(dups)
+				return 0, err
+			}
+			dups = append(dups, os.NewFile(uintptr(fd), f.Name()))
+		}
+		tx.files = append(tx.files, pipeFiles{
+			start: tx.written,
+			end:   tx.written + int64(len(data)),
+			files: dups,
+		})
+	}
+
+	tx.data = append(tx.data, data...)
+	tx.written += int64(len(data))
+	tx.broadcast()
+
+	return len(data), nil
+}
+
+// CloseWrite closes the writing side of the transport, the other end reads
+// io.EOF once it has read the data written so far.
+func (p *pipeTransport) CloseWrite() error {
+	tx := p.tx
+
+	tx.Lock()
+	defer tx.Unlock()
+
+	tx.eof = true
+	tx.broadcast()
+
+	return nil
+}
+
+func (p *pipeTransport) Close() error {
+	p.CloseWrite()
+
+	rx := p.rx
+
+	rx.Lock()
+	defer rx.Unlock()
+
+	rx.closed = true
+	rx.data = nil
+	rx.closeFiles()
+	rx.broadcast()
+
+	return nil
+}
+
+func (p *pipeTransport) LocalAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (p *pipeTransport) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (p *pipeTransport) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+func (p *pipeTransport) SetReadDeadline(t time.Time) error {
+	p.rx.Lock()
+	defer p.rx.Unlock()
+
+	p.rx.readDeadline = t
+	p.rx.broadcast()
+
+	return nil
+}
+
+func (p *pipeTransport) SetWriteDeadline(t time.Time) error {
+	p.tx.Lock()
+	defer p.tx.Unlock()
+
+	p.tx.writeDeadline = t
+
+	return nil
+}
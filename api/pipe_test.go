@@ -0,0 +1,164 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeTransportFrames(t *testing.T) {
+	client, server := NewPipeTransport()
+	defer client.Close()
+	defer server.Close()
+
+	payload := []byte(`{"hyperName":"ping"}`)
+	assert.Nil(t, WriteCommand(client, CmdHyper, payload))
+
+	frame, err := ReadFrame(server)
+	assert.Nil(t, err)
+	assert.Equal(t, TypeCommand, frame.Header.Type)
+	assert.Equal(t, int(CmdHyper), frame.Header.Opcode)
+	assert.Equal(t, payload, frame.Payload)
+
+	assert.Nil(t, WriteResponse(server, CmdHyper, false, nil))
+	frame, err = ReadFrame(client)
+	assert.Nil(t, err)
+	assert.Equal(t, TypeResponse, frame.Header.Type)
+}
+
+func TestPipeTransportClose(t *testing.T) {
+	a, b := NewPipeTransport()
+
+	_, err := a.Write([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Close())
+
+	// Data written before Close is still read, then EOF.
+	data, err := ioutil.ReadAll(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	_, err = b.Write([]byte("bar"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	_, err = a.Read(make([]byte, 1))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	assert.Nil(t, b.Close())
+}
+
+func TestPipeTransportBlockingRead(t *testing.T) {
+	a, b := NewPipeTransport()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Write([]byte("foo"))
+	}()
+
+	buf := make([]byte, 8)
+	n, err := b.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(buf[:n]))
+}
+
+func TestPipeTransportDeadline(t *testing.T) {
+	a, b := NewPipeTransport()
+	defer a.Close()
+	defer b.Close()
+
+	assert.Nil(t, b.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := b.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	assert.Nil(t, b.SetReadDeadline(time.Time{}))
+	_, err = a.Write([]byte("f"))
+	assert.Nil(t, err)
+	_, err = b.Read(make([]byte, 1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, a.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = a.Write([]byte("f"))
+	netErr, ok = err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+}
+
+// testTransportFiles checks files sent from a are received by b.
+func testTransportFiles(t *testing.T, a, b Transport) {
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r.Close()
+
+	_, err = a.Write([]byte("foo"))
+	assert.Nil(t, err)
+	_, err = a.WriteFiles([]byte("bar"), []*os.File{w})
+	assert.Nil(t, err)
+	// The sender can close its copy of the file.
+	w.Close()
+	_, err = a.Write([]byte("baz"))
+	assert.Nil(t, err)
+
+	_, err = a.WriteFiles(nil, []*os.File{r})
+	assert.Equal(t, errNoData, err)
+
+	// Reads stop at the data the files were sent with.
+	buf := make([]byte, 16)
+	n, files, err := b.ReadFiles(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "foobar", string(buf[:n]))
+	assert.Len(t, files, 1)
+
+	n, others, err := b.ReadFiles(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "baz", string(buf[:n]))
+	assert.Len(t, others, 0)
+
+	// The received file is the write end of the pipe.
+	_, err = files[0].Write([]byte("qux"))
+	assert.Nil(t, err)
+	files[0].Close()
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "qux", string(data))
+}
+
+func TestPipeTransportFiles(t *testing.T) {
+	a, b := NewPipeTransport()
+	defer a.Close()
+	defer b.Close()
+
+	testTransportFiles(t, a, b)
+}
+
+func TestUnixTransportFiles(t *testing.T) {
+	c0, c1, err := socketpair()
+	assert.Nil(t, err)
+	a, b := NewUnixTransport(c0), NewUnixTransport(c1)
+	defer a.Close()
+	defer b.Close()
+
+	testTransportFiles(t, a, b)
+}
@@ -15,6 +15,7 @@
 package api
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -22,9 +23,13 @@ import (
 	"io"
 )
 
-// minHeaderLength is the length of the header in the version 2 of protocol.
+// MinHeaderLength is the length of the header in the version 2 of protocol.
 // It is guaranteed later versions will have a header at least that big.
-const minHeaderLength = 12 // in bytes
+const MinHeaderLength = 12 // in bytes
+
+// DefaultSocketPath is the path of the proxy socket when it's not given at
+// link time or on the command line, for the proxy and its tools alike.
+const DefaultSocketPath = "/var/run/cc-oci-runtime/proxy.sock"
 
 // A Request is a JSON message sent from a client to the proxy. This message
 // embed a payload identified by "id". A payload can have data associated with
@@ -54,6 +59,7 @@ type Response struct {
 const (
 	versionOffset       = 0
 	headerLengthOffset  = 2
+	streamIDOffset      = 4
 	typeOffset          = 6
 	flagsOffset         = 6
 	opcodeOffset        = 7
@@ -63,6 +69,7 @@ const (
 // Size (in bytes) of frame header fields (when larger than 1 byte).
 const (
 	versionSize       = 2
+	streamIDSize      = 2
 	payloadLengthSize = 4
 )
 
@@ -87,15 +94,19 @@ func maxOpcodeForFrameType(t FrameType) int {
 	}
 }
 
+// maxPreallocatedPayload is the biggest payload ReadFrame allocates at once,
+// the size of the largest stream chunks.
+const maxPreallocatedPayload = 1024 * 1024
+
 // ReadFrame reads a full frame (header and payload) from r.
 func ReadFrame(r io.Reader) (*Frame, error) {
 	// Read the header.
-	buf := make([]byte, minHeaderLength)
+	buf := make([]byte, MinHeaderLength)
 	n, err := r.Read(buf)
 	if err != nil {
 		return nil, err
 	}
-	if n != minHeaderLength {
+	if n != MinHeaderLength {
 		return nil, errors.New("frame: couldn't read the full header")
 	}
 
@@ -107,11 +118,21 @@ func ReadFrame(r io.Reader) (*Frame, error) {
 		return nil, fmt.Errorf("frame: bad version %d", header.Version)
 	}
 	header.HeaderLength = int(buf[headerLengthOffset]) * 4
+	if header.HeaderLength < MinHeaderLength {
+		return nil, fmt.Errorf("frame: bad header length %d", header.HeaderLength)
+	}
+	header.StreamID = int(binary.BigEndian.Uint16(buf[streamIDOffset : streamIDOffset+streamIDSize]))
 	header.Type = FrameType(buf[typeOffset] & typeMask)
 	flags := buf[flagsOffset] & flagsMask
 	if flags&flagInError != 0 {
 		header.InError = true
 	}
+	if flags&flagEOF != 0 {
+		header.EOF = true
+	}
+	if flags&flagCompressed != 0 {
+		header.Compressed = true
+	}
 	if header.Type >= TypeMax {
 		return nil, fmt.Errorf("frame: bad type %s", header.Type)
 	}
@@ -122,31 +143,91 @@ func ReadFrame(r io.Reader) (*Frame, error) {
 	}
 	header.PayloadLength = int(binary.BigEndian.Uint32(buf[payloadLengthOffset : payloadLengthOffset+payloadLengthSize]))
 
-	// Read the payload.
-	received := 0
-	need := header.HeaderLength - minHeaderLength + header.PayloadLength
-	payload := make([]byte, need)
-	for received < need {
-		n, err := r.Read(payload[received:need])
-		if err != nil {
+	// Read the payload. The buffer of big payloads grows as the data is
+	// received so a bogus length doesn't make us allocate gigabytes.
+	need := header.HeaderLength - MinHeaderLength + header.PayloadLength
+	var payload []byte
+	if need <= maxPreallocatedPayload {
+		received := 0
+		payload = make([]byte, need)
+		for received < need {
+			n, err := r.Read(payload[received:need])
+			if err != nil {
+				return nil, err
+			}
+
+			received += n
+		}
+	} else {
+		var buf bytes.Buffer
+		buf.Grow(maxPreallocatedPayload)
+		if _, err := io.CopyN(&buf, r, int64(need)); err != nil {
 			return nil, err
 		}
-
-		received += n
+		payload = buf.Bytes()
 	}
 
 	// Skip the bytes part of a bigger header than expected to just keep
 	// the payload.
-	frame.Payload = payload[header.HeaderLength-minHeaderLength : need]
+	frame.Payload = payload[header.HeaderLength-MinHeaderLength : need]
 
 	return frame, nil
 }
 
 const (
 	flagInError = 1 << (4 + iota)
+	flagEOF
+	flagCompressed
 )
 
-// WriteFrame writes a frame into w.
+// EncodeFrameHeader encodes header into the first MinHeaderLength bytes of
+// buf. Together with WriteFrameHeader, it allows callers to manage the buffers
+// frames are built into.
+func EncodeFrameHeader(buf []byte, header *FrameHeader) {
+	binary.BigEndian.PutUint16(buf[versionOffset:versionOffset+versionSize], uint16(header.Version))
+	buf[headerLengthOffset] = byte(header.HeaderLength / 4)
+	binary.BigEndian.PutUint16(buf[streamIDOffset:streamIDOffset+streamIDSize], uint16(header.StreamID))
+	flags := byte(0)
+	if header.InError {
+		flags |= flagInError
+	}
+	if header.EOF {
+		flags |= flagEOF
+	}
+	if header.Compressed {
+		flags |= flagCompressed
+	}
+	buf[typeOffset] = flags | byte(header.Type)&typeMask
+	buf[opcodeOffset] = byte(header.Opcode)
+	binary.BigEndian.PutUint32(buf[payloadLengthOffset:payloadLengthOffset+payloadLengthSize],
+		uint32(header.PayloadLength))
+}
+
+// BuffersWriter is implemented by writers able to write several buffers
+// without other writes being interleaved with them, eg. a connection shared
+// by several goroutines serializing writes with a lock.
+type BuffersWriter interface {
+	WriteBuffers(bufs [][]byte) (int64, error)
+}
+
+// writeConcatenated writes bufs to w with a single Write call.
+func writeConcatenated(w io.Writer, bufs [][]byte) (int64, error) {
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+
+	buf := make([]byte, 0, size)
+	for _, b := range bufs {
+		buf = append(buf, b...)
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// WriteFrame writes a frame into w. The header and the payload are written
+// together, see BuffersWriter and WriteBuffers.
 //
 // Note that frame.Header.PayloadLength dictates the amount of data of
 // frame.Payload to write, so frame.Header.Payload must be less or equal to
@@ -159,32 +240,45 @@ func WriteFrame(w io.Writer, frame *Frame) error {
 			header.PayloadLength)
 	}
 
-	// Prepare the header.
-	len := minHeaderLength + header.PayloadLength
-	buf := make([]byte, len)
-	binary.BigEndian.PutUint16(buf[versionOffset:versionOffset+versionSize], uint16(header.Version))
-	buf[headerLengthOffset] = byte(header.HeaderLength / 4)
-	flags := byte(0)
-	if frame.Header.InError {
-		flags |= flagInError
+	buf := make([]byte, MinHeaderLength)
+	EncodeFrameHeader(buf, header)
+	bufs := [][]byte{buf}
+	if header.PayloadLength > 0 {
+		bufs = append(bufs, frame.Payload[0:header.PayloadLength])
 	}
-	buf[typeOffset] = flags | byte(header.Type)&typeMask
-	buf[opcodeOffset] = byte(header.Opcode)
-	binary.BigEndian.PutUint32(buf[payloadLengthOffset:payloadLengthOffset+payloadLengthSize],
-		uint32(header.PayloadLength))
 
-	// Write payload if needed
-	if header.PayloadLength > 0 {
-		copy(buf[minHeaderLength:], frame.Payload[0:header.PayloadLength])
+	var n int64
+	var err error
+	if bw, ok := w.(BuffersWriter); ok {
+		n, err = bw.WriteBuffers(bufs)
+	} else {
+		n, err = WriteBuffers(w, bufs)
+	}
+	if err != nil {
+		return err
 	}
 
+	if n != int64(MinHeaderLength+header.PayloadLength) {
+		return errors.New("frame: couldn't write frame")
+	}
+
+	return nil
+}
+
+// WriteFrameHeader only writes the header of a frame into w. It's up to the
+// caller to write the header.PayloadLength bytes of payload that must
+// follow.
+func WriteFrameHeader(w io.Writer, header *FrameHeader) error {
+	buf := make([]byte, MinHeaderLength)
+	EncodeFrameHeader(buf, header)
+
 	n, err := w.Write(buf)
 	if err != nil {
 		return err
 	}
 
-	if n != len {
-		return errors.New("frame: couldn't write frame")
+	if n != MinHeaderLength {
+		return errors.New("frame: couldn't write frame header")
 	}
 
 	return nil
@@ -207,6 +301,15 @@ func WriteStream(w io.Writer, op Stream, payload []byte) error {
 	return WriteFrame(w, NewFrame(TypeStream, int(op), payload))
 }
 
+// WriteStdinEOF is a convenience wrapper around WriteFrame to signal the end
+// of the stdin stream of the I/O session streamID.
+func WriteStdinEOF(w io.Writer, streamID int) error {
+	frame := NewFrame(TypeStream, int(StreamStdin), nil)
+	frame.Header.StreamID = streamID
+	frame.Header.EOF = true
+	return WriteFrame(w, frame)
+}
+
 // WriteNotification is a convenience wrapper around WriteFrame to send notifications.
 func WriteNotification(w io.Writer, op Notification, payload []byte) error {
 	return WriteFrame(w, NewFrame(TypeNotification, int(op), payload))
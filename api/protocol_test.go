@@ -18,6 +18,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -50,7 +54,7 @@ func makeStreamFrame(v, hl int, op Stream, pl int) []byte {
 }
 
 func makeFrameReader(t FrameType, op, pl int) io.Reader {
-	frame := makeFrame(Version, minHeaderLength, t, op, pl)
+	frame := makeFrame(Version, MinHeaderLength, t, op, pl)
 	return bytes.NewReader(frame)
 }
 
@@ -61,7 +65,7 @@ func TestReadFrame(t *testing.T) {
 
 	header := &frame.Header
 	assert.Equal(t, Version, header.Version)
-	assert.Equal(t, minHeaderLength, header.HeaderLength)
+	assert.Equal(t, MinHeaderLength, header.HeaderLength)
 	assert.Equal(t, TypeStream, FrameType(header.Type))
 	assert.Equal(t, StreamStderr, Stream(header.Opcode))
 	assert.Equal(t, 1024, header.PayloadLength)
@@ -69,12 +73,38 @@ func TestReadFrame(t *testing.T) {
 }
 
 func TestReadFrameFlags(t *testing.T) {
-	buf := makeFrame(Version, minHeaderLength, TypeResponse, int(CmdSignal), 16)
+	buf := makeFrame(Version, MinHeaderLength, TypeResponse, int(CmdSignal), 16)
 	setFlags(buf, flagInError)
 	r := bytes.NewReader(buf)
 	frame, err := ReadFrame(r)
 	assert.Nil(t, err)
 	assert.Equal(t, true, frame.Header.InError)
+	assert.Equal(t, false, frame.Header.EOF)
+
+	buf = makeFrame(Version, MinHeaderLength, TypeStream, int(StreamStdin), 16)
+	setFlags(buf, flagEOF)
+	r = bytes.NewReader(buf)
+	frame, err = ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, false, frame.Header.InError)
+	assert.Equal(t, true, frame.Header.EOF)
+
+	buf = makeFrame(Version, MinHeaderLength, TypeStream, int(StreamStdout), 16)
+	setFlags(buf, flagCompressed)
+	r = bytes.NewReader(buf)
+	frame, err = ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, false, frame.Header.EOF)
+	assert.Equal(t, true, frame.Header.Compressed)
+}
+
+func TestReadFrameStreamID(t *testing.T) {
+	buf := makeFrame(Version, MinHeaderLength, TypeStream, int(StreamStdout), 16)
+	binary.BigEndian.PutUint16(buf[4:6], 0x1234)
+	r := bytes.NewReader(buf)
+	frame, err := ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, 0x1234, frame.Header.StreamID)
 }
 
 func TestReadFrameErrorPaths(t *testing.T) {
@@ -84,46 +114,68 @@ func TestReadFrameErrorPaths(t *testing.T) {
 	assert.NotNil(t, err)
 
 	// Truncated input, header too short.
-	buf := makeStreamFrame(Version, minHeaderLength, StreamStderr, 1024)
+	buf := makeStreamFrame(Version, MinHeaderLength, StreamStderr, 1024)
 	frame, err = ReadFrame(bytes.NewReader(buf[0:10]))
 	assert.Nil(t, frame)
 	assert.NotNil(t, err)
 
 	// Truncated input, payload too short.
-	buf = makeStreamFrame(Version, minHeaderLength, StreamStderr, 1024)
+	buf = makeStreamFrame(Version, MinHeaderLength, StreamStderr, 1024)
 	frame, err = ReadFrame(bytes.NewReader(buf[0:512]))
 	assert.Nil(t, frame)
 	assert.NotNil(t, err)
 
 	// Bad version
-	buf = makeStreamFrame(0x8fff, minHeaderLength, StreamStderr, 1024)
+	buf = makeStreamFrame(0x8fff, MinHeaderLength, StreamStderr, 1024)
 	frame, err = ReadFrame(bytes.NewReader(buf))
 	assert.Nil(t, frame)
 	assert.NotNil(t, err)
 
-	buf = makeStreamFrame(0, minHeaderLength, StreamStderr, 1024)
+	buf = makeStreamFrame(0, MinHeaderLength, StreamStderr, 1024)
 	frame, err = ReadFrame(bytes.NewReader(buf))
 	assert.Nil(t, frame)
 	assert.NotNil(t, err)
 
 	// Bad type
-	buf = makeFrame(Version, minHeaderLength, TypeMax, 0, 1024)
+	buf = makeFrame(Version, MinHeaderLength, TypeMax, 0, 1024)
+	frame, err = ReadFrame(bytes.NewReader(buf))
+	assert.Nil(t, frame)
+	assert.NotNil(t, err)
+
+	// Header length smaller than the header
+	buf = makeStreamFrame(Version, MinHeaderLength, StreamStderr, 1024)
+	buf[2] = 1
+	frame, err = ReadFrame(bytes.NewReader(buf))
+	assert.Nil(t, frame)
+	assert.NotNil(t, err)
+
+	// Payload length way bigger than the data sent
+	buf = makeStreamFrame(Version, MinHeaderLength, StreamStderr, 1024)
+	binary.BigEndian.PutUint32(buf[8:8+4], 0xffffffff)
 	frame, err = ReadFrame(bytes.NewReader(buf))
 	assert.Nil(t, frame)
 	assert.NotNil(t, err)
 }
 
-// TestLargerHeader makes sure we can read a larger header than minHeaderLength
+func TestReadFrameBigPayload(t *testing.T) {
+	reader := makeFrameReader(TypeStream, int(StreamStdout), 3*maxPreallocatedPayload)
+	frame, err := ReadFrame(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 3*maxPreallocatedPayload, frame.Header.PayloadLength)
+	assert.Equal(t, 3*maxPreallocatedPayload, len(frame.Payload))
+}
+
+// TestLargerHeader makes sure we can read a larger header than MinHeaderLength
 // without any issue.
 func TestReadFrameLargerHeader(t *testing.T) {
-	buf := makeFrame(Version, minHeaderLength+12, TypeStream,
+	buf := makeFrame(Version, MinHeaderLength+12, TypeStream,
 		int(StreamStderr), 1024)
 	frame, err := ReadFrame(bytes.NewReader(buf))
 	assert.Nil(t, err)
 
 	header := &frame.Header
 	assert.Equal(t, Version, header.Version)
-	assert.Equal(t, minHeaderLength+12, header.HeaderLength)
+	assert.Equal(t, MinHeaderLength+12, header.HeaderLength)
 	assert.Equal(t, TypeStream, FrameType(header.Type))
 	assert.Equal(t, StreamStderr, Stream(header.Opcode))
 	assert.Equal(t, 1024, header.PayloadLength)
@@ -131,7 +183,7 @@ func TestReadFrameLargerHeader(t *testing.T) {
 }
 
 func newBuffer(payloadLength int) *bytes.Buffer {
-	buf := make([]byte, 0, minHeaderLength+payloadLength)
+	buf := make([]byte, 0, MinHeaderLength+payloadLength)
 	return bytes.NewBuffer(buf)
 }
 
@@ -166,14 +218,14 @@ func TestWriteFrame(t *testing.T) {
 
 	version := int(binary.BigEndian.Uint16(buf[0:2]))
 	assert.Equal(t, Version, version)
-	assert.Equal(t, uint8(minHeaderLength/4), buf[2])
+	assert.Equal(t, uint8(MinHeaderLength/4), buf[2])
 	assert.Equal(t, byte(TypeStream), buf[6]&0xf)
 	assert.Equal(t, byte(StreamStderr), buf[7])
 	pl := int(binary.BigEndian.Uint32(buf[8 : 8+4]))
 	assert.Equal(t, 1024, pl)
 
-	for i := range buf[minHeaderLength : minHeaderLength+1024] {
-		assert.Equal(t, uint8(0xaa), buf[minHeaderLength+i])
+	for i := range buf[MinHeaderLength : MinHeaderLength+1024] {
+		assert.Equal(t, uint8(0xaa), buf[MinHeaderLength+i])
 	}
 }
 
@@ -186,6 +238,46 @@ func TestWriteFrameFlags(t *testing.T) {
 	assert.Nil(t, err)
 	buf := w.Bytes()
 	assert.Equal(t, uint8(flagInError), getFlags(buf))
+
+	w = newBuffer(1024)
+	err = WriteStdinEOF(w, 3)
+	assert.Nil(t, err)
+	buf = w.Bytes()
+	assert.Equal(t, uint8(flagEOF), getFlags(buf))
+	assert.Equal(t, MinHeaderLength, len(buf))
+
+	frame = newStreamFrame(StreamStdout, 16)
+	frame.Header.Compressed = true
+	w = newBuffer(1024)
+	err = WriteFrame(w, frame)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(flagCompressed), getFlags(w.Bytes()))
+}
+
+func TestWriteFrameStreamID(t *testing.T) {
+	frame := newStreamFrame(StreamStdout, 16)
+	frame.Header.StreamID = 0x1234
+
+	w := newBuffer(1024)
+	err := WriteFrame(w, frame)
+	assert.Nil(t, err)
+	buf := w.Bytes()
+	assert.Equal(t, uint16(0x1234), binary.BigEndian.Uint16(buf[4:6]))
+}
+
+func TestWriteFrameHeader(t *testing.T) {
+	frame := newStreamFrame(StreamStdout, 16)
+	frame.Header.StreamID = 2
+
+	w := newBuffer(1024)
+	err := WriteFrameHeader(w, &frame.Header)
+	assert.Nil(t, err)
+	w.Write(frame.Payload)
+
+	decoded, err := ReadFrame(w)
+	assert.Nil(t, err)
+	assert.Equal(t, frame.Header, decoded.Header)
+	assert.Equal(t, frame.Payload, decoded.Payload)
 }
 
 func TestWriteFrameErrorPaths(t *testing.T) {
@@ -199,6 +291,59 @@ func TestWriteFrameErrorPaths(t *testing.T) {
 	assert.Equal(t, 0, w.Len())
 }
 
+// buffersWriter records the buffers given to WriteBuffers.
+type buffersWriter struct {
+	bytes.Buffer
+	bufs [][]byte
+}
+
+func (w *buffersWriter) WriteBuffers(bufs [][]byte) (int64, error) {
+	w.bufs = bufs
+	return writeConcatenated(w, bufs)
+}
+
+func TestWriteFrameBuffersWriter(t *testing.T) {
+	w := &buffersWriter{}
+	frame := newStreamFrame(StreamStdout, 16)
+
+	err := WriteFrame(w, frame)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(w.bufs))
+	assert.Equal(t, MinHeaderLength, len(w.bufs[0]))
+	assert.Equal(t, frame.Payload, w.bufs[1])
+
+	decoded, err := ReadFrame(w)
+	assert.Nil(t, err)
+	assert.Equal(t, frame.Header, decoded.Header)
+	assert.Equal(t, frame.Payload, decoded.Payload)
+}
+
+func TestWriteBuffers(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	f0 := os.NewFile(uintptr(fds[0]), "")
+	f1 := os.NewFile(uintptr(fds[1]), "")
+	c0, err := net.FileConn(f0)
+	assert.Nil(t, err)
+	defer c0.Close()
+	c1, err := net.FileConn(f1)
+	assert.Nil(t, err)
+	defer c1.Close()
+	f0.Close()
+	f1.Close()
+
+	for _, w := range []io.Writer{c0, newBuffer(64)} {
+		n, err := WriteBuffers(w, [][]byte{[]byte("foo"), nil, []byte("bar")})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(6), n)
+	}
+
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(c1, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "foobar", string(buf))
+}
+
 func TestWriteCommand(t *testing.T) {
 	w := newBuffer(1024)
 	err := WriteCommand(w, CmdSignal, nil)
@@ -234,3 +379,51 @@ func TestWriteNotification(t *testing.T) {
 	buf := w.Bytes()
 	assert.Equal(t, byte(TypeNotification), buf[6]&0xf)
 }
+
+// benchmarkPayloadSizes are the payload sizes the frame benchmarks run with,
+// from a payload-less frame to a full default sized stream chunk.
+var benchmarkPayloadSizes = []int{0, 64, 4096, 65536}
+
+func BenchmarkReadFrame(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			w := newBuffer(size)
+			if err := WriteFrame(w, newStreamFrame(StreamStdout, size)); err != nil {
+				b.Fatal(err)
+			}
+			data := w.Bytes()
+			r := bytes.NewReader(data)
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				r.Reset(data)
+				if _, err := ReadFrame(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			frame := newStreamFrame(StreamStdout, size)
+			w := newBuffer(size)
+
+			b.SetBytes(int64(MinHeaderLength + size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				w.Reset()
+				if err := WriteFrame(w, frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
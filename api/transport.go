@@ -0,0 +1,104 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// MaxFiles is the maximum number of files a Transport carries with a single
+// WriteFiles.
+const MaxFiles = 16
+
+// errNoData is returned when trying to send files without data: file
+// descriptors are attached to the bytes written on AF_UNIX stream sockets.
+var errNoData = errors.New("api: files need to be sent with data")
+
+// Transport is a connection between a client and the proxy, able to carry
+// files along with the data. The proxy AF_UNIX socket is one, see
+// NewUnixTransport, NewPipeTransport returns in-memory ones for tests.
+type Transport interface {
+	net.Conn
+
+	// WriteFiles writes data with files attached to it. data can't be
+	// empty when sending files.
+	WriteFiles(data []byte, files []*os.File) (int, error)
+	// ReadFiles reads data into b and returns the files attached to
+	// the data read, if any. The caller is responsible for closing the
+	// files.
+	ReadFiles(b []byte) (int, []*os.File, error)
+}
+
+// unixTransport is a Transport on an AF_UNIX socket, files are passed with
+// SCM_RIGHTS.
+type unixTransport struct {
+	*net.UnixConn
+}
+
+// NewUnixTransport returns a Transport on conn.
+func NewUnixTransport(conn *net.UnixConn) Transport {
+	return unixTransport{conn}
+}
+
+func (t unixTransport) WriteFiles(data []byte, files []*os.File) (int, error) {
+	if len(files) > MaxFiles {
+		return 0, errors.New("api: too many files")
+	}
+	if len(files) > 0 && len(data) == 0 {
+		return 0, errNoData
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+
+	n, _, err := t.WriteMsgUnix(data, oob, nil)
+	return n, err
+}
+
+func (t unixTransport) ReadFiles(b []byte) (int, []*os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(MaxFiles*4))
+	n, oobn, _, _, err := t.ReadMsgUnix(b, oob)
+	if err != nil || oobn == 0 {
+		return n, nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, nil, err
+	}
+
+	var files []*os.File
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), ""))
+		}
+	}
+
+	return n, files, nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// description is the protocol description payloads are validated against.
+var description = Describe()
+
+// ValidatePayload checks raw is a valid JSON payload for cmd, according to
+// the schemas of Describe: the payload is a JSON object, the fields that
+// aren't optional are present and the fields have the type of their schema.
+// Fields the schema doesn't know about are ignored, for clients written
+// against a newer version of the protocol. An empty payload is valid when
+// all the fields are optional.
+//
+// The proxy validates the payload of every command it receives, and answers
+// the invalid ones with ErrorCodeInvalidPayload. Clients can use it to check
+// a payload before sending it.
+func ValidatePayload(cmd Command, raw json.RawMessage) error {
+	if cmd < 0 || cmd >= CmdMax {
+		return fmt.Errorf("unknown command %d", int(cmd))
+	}
+
+	name := description.Commands[cmd].Payload
+	if name == "" {
+		if len(raw) != 0 {
+			return fmt.Errorf("invalid %s payload: %s has no payload", cmd, cmd)
+		}
+		return nil
+	}
+
+	if len(raw) == 0 {
+		for _, field := range description.Types[name].Fields {
+			if !field.Optional {
+				return fmt.Errorf("invalid %s payload: empty payload", cmd)
+			}
+		}
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid %s payload: %v", cmd, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid %s payload: data after the JSON value", cmd)
+	}
+
+	if err := validateValue(&Schema{Type: "object", Ref: name}, value); err != nil {
+		return fmt.Errorf("invalid %s payload: %v", cmd, err)
+	}
+	return nil
+}
+
+// valueError is a value not matching its schema. path locates the value in
+// the payload.
+type valueError struct {
+	path string
+	msg  string
+}
+
+func (e *valueError) Error() string {
+	if e.path == "" {
+		return e.msg
+	}
+	return e.path + ": " + e.msg
+}
+
+// under prefixes the path of err, a *valueError, with the path of its
+// container.
+func under(err error, path string) error {
+	verr := err.(*valueError)
+	switch {
+	case verr.path == "":
+		verr.path = path
+	case verr.path[0] == '[':
+		verr.path = path + verr.path
+	default:
+		verr.path = path + "." + verr.path
+	}
+	return verr
+}
+
+// jsonTypeName returns the JSON type of value, as decoded with UseNumber.
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func mismatch(expected string, value interface{}) error {
+	return &valueError{msg: fmt.Sprintf("expected %s, got %s", expected, jsonTypeName(value))}
+}
+
+func validateValue(schema *Schema, value interface{}) error {
+	switch schema.Type {
+	case "json":
+		return nil
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return mismatch("boolean", value)
+		}
+	case "integer", "number":
+		return validateNumber(schema, value)
+	case "string", "bytes", "time":
+		return validateString(schema, value)
+	case "array":
+		return validateArray(schema, value)
+	case "map":
+		return validateMap(schema, value)
+	case "object":
+		return validateObject(schema, value)
+	}
+	return nil
+}
+
+func validateNumber(schema *Schema, value interface{}) error {
+	n, ok := value.(json.Number)
+	if !ok {
+		return mismatch(schema.Type, value)
+	}
+	if schema.Type == "number" {
+		return nil
+	}
+
+	i, err := strconv.ParseInt(string(n), 10, 64)
+	if schema.Enum == "ErrorCode" {
+		if err != nil || i < 0 || i >= int64(ErrorCodeMax) {
+			return &valueError{msg: fmt.Sprintf("unknown error code %s", n)}
+		}
+		return nil
+	}
+	if err != nil {
+		if _, err := strconv.ParseUint(string(n), 10, 64); err != nil {
+			return &valueError{msg: fmt.Sprintf("expected integer, got %s", n)}
+		}
+	}
+	return nil
+}
+
+func validateString(schema *Schema, value interface{}) error {
+	s, ok := value.(string)
+	if !ok {
+		return mismatch("string", value)
+	}
+
+	switch schema.Type {
+	case "bytes":
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return &valueError{msg: "expected base64 encoded data"}
+		}
+	case "time":
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return &valueError{msg: "expected RFC 3339 time"}
+		}
+	}
+	return nil
+}
+
+func validateArray(schema *Schema, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return mismatch("array", value)
+	}
+
+	for i, item := range items {
+		if err := validateValue(schema.Items, item); err != nil {
+			return under(err, fmt.Sprintf("[%d]", i))
+		}
+	}
+	return nil
+}
+
+func validateMap(schema *Schema, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	items, ok := value.(map[string]interface{})
+	if !ok {
+		return mismatch("object", value)
+	}
+
+	for key, item := range items {
+		if err := validateValue(schema.Items, item); err != nil {
+			return under(err, key)
+		}
+	}
+	return nil
+}
+
+func validateObject(schema *Schema, value interface{}) error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return mismatch("object", value)
+	}
+
+	for _, field := range description.Types[schema.Ref].Fields {
+		v, present := fields[field.Name]
+		if !present {
+			if field.Optional {
+				continue
+			}
+			return &valueError{path: field.Name, msg: "missing"}
+		}
+		if v == nil && field.Optional {
+			continue
+		}
+		if err := validateValue(field.Schema, v); err != nil {
+			return under(err, field.Name)
+		}
+	}
+	return nil
+}
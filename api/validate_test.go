@@ -0,0 +1,61 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePayload(t *testing.T) {
+	tests := []struct {
+		cmd     Command
+		payload string
+		err     string
+	}{
+		{CmdSignal, `{"signalNumber":15}`, ""},
+		{CmdSignal, `{"signalNumber":28,"columns":80,"rows":25}`, ""},
+		{CmdSignal, `{"signalNumber":15,"unknown":true}`, ""},
+		{CmdSignal, `{}`, "invalid Signal payload: signalNumber: missing"},
+		{CmdSignal, ``, "invalid Signal payload: empty payload"},
+		{CmdSignal, `{"signalNumber":"15"}`,
+			"invalid Signal payload: signalNumber: expected integer, got string"},
+		{CmdSignal, `{"signalNumber":1.5}`,
+			"invalid Signal payload: signalNumber: expected integer, got 1.5"},
+		{CmdSignal, `[15]`, "invalid Signal payload: expected object, got array"},
+		{CmdSignal, `{"signalNumber":15} {}`,
+			"invalid Signal payload: data after the JSON value"},
+		{CmdHyper, `{"hyperName":"ping","tokens":null}`, ""},
+		{CmdHyper, `{"hyperName":"ping","tokens":["a",2]}`,
+			"invalid Hyper payload: tokens[1]: expected string, got number"},
+		{CmdHyper, `{"hyperName":"ping","tokens":[],"data":{"any":[1]}}`, ""},
+		{CmdConnectShim, `{"token":"abc","readOnly":"yes"}`,
+			"invalid ConnectShim payload: readOnly: expected boolean, got string"},
+		{Command(-1), `{}`, "unknown command -1"},
+		{CmdMax, `{}`, fmt.Sprintf("unknown command %d", CmdMax)},
+	}
+
+	for _, test := range tests {
+		err := ValidatePayload(test.cmd, json.RawMessage(test.payload))
+		if test.err == "" {
+			assert.Nil(t, err, test.payload)
+			continue
+		}
+		assert.EqualError(t, err, test.err, test.payload)
+	}
+}
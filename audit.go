@@ -0,0 +1,413 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// Audit events, see logAuditf.
+const (
+	// auditClientEvicted is a client disconnected for going over one of
+	// the per connection limits.
+	auditClientEvicted = "ClientEvicted"
+	// auditConnectionRefused is a connection closed straight away because
+	// its user has too many connections open.
+	auditConnectionRefused = "ConnectionRefused"
+	// auditCommandForbidden is a command refused by the authorizers.
+	auditCommandForbidden = "CommandForbidden"
+	// auditVMRegistered is a VM registered with RegisterVM.
+	auditVMRegistered = "VMRegistered"
+	// auditVMUnregistered is a VM unregistered with UnregisterVM.
+	auditVMUnregistered = "VMUnregistered"
+)
+
+// auditSeverities are the CEF severities, from 0 to 10, of the audit events.
+var auditSeverities = map[string]int{
+	auditClientEvicted:     7,
+	auditConnectionRefused: 6,
+	auditCommandForbidden:  6,
+	auditVMRegistered:      3,
+	auditVMUnregistered:    3,
+}
+
+// logAuditf logs the audit event, a security relevant event such as a client
+// disconnected for abusing the proxy. Audit events are always logged, with
+// their name in the AUDIT_EVENT field, and exported to auditTarget.
+func logAuditf(event string, fields logFields, prefix, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+
+	if auditor != nil {
+		exported := make(logFields, len(fields))
+		for k, v := range fields {
+			exported[k] = v
+		}
+		auditor.export(&auditEvent{
+			Time:    time.Now(),
+			Event:   event,
+			Message: msg,
+			Fields:  exported,
+		})
+	}
+
+	fields["AUDIT_EVENT"] = event
+	logger.log(2, logPriorityInfo, fields, prefix+"[audit] ", msg)
+}
+
+// Formats of the exported audit events.
+const (
+	auditFormatJSON   = "json"
+	auditFormatCEF    = "cef"
+	auditFormatSyslog = "syslog"
+)
+
+var (
+	// auditTarget, when not empty, is where audit events are exported on
+	// top of being logged: a file://, udp://, tcp:// or unix:// URL.
+	auditTarget string
+	// auditFormat is the format of the exported audit events: json, cef
+	// or syslog.
+	auditFormat = auditFormatJSON
+)
+
+// auditor exports the audit events to auditTarget, nil when not exporting.
+var auditor *auditExporter
+
+// auditEvent is an exported audit event.
+type auditEvent struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Event   string    `json:"event"`
+	Message string    `json:"msg"`
+	Fields  logFields `json:"fields,omitempty"`
+}
+
+// auditQueueLength is the number of audit events waiting to be exported
+// from which new events are dropped.
+const auditQueueLength = 1024
+
+// auditExporter sends audit events to a file or a syslog server, from its own
+// goroutine so a slow destination doesn't hold up the proxy.
+type auditExporter struct {
+	// network is "file" or a network for net.Dial.
+	network string
+	address string
+	format  string
+	host    string
+
+	events chan *auditEvent
+	done   chan struct{}
+	// dropped is the number of events dropped because the queue was
+	// full. It's accessed atomically.
+	dropped uint64
+
+	// conn is only used from the exporter goroutine.
+	conn io.WriteCloser
+}
+
+// parseAuditTarget returns the network and address of target.
+func parseAuditTarget(target string) (string, string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("missing path in %s", target)
+		}
+		return "file", u.Path, nil
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("missing host in %s", target)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("missing path in %s", target)
+		}
+		// Syslog sockets such as /dev/log are datagram sockets.
+		return "unixgram", u.Path, nil
+	default:
+		return "", "", fmt.Errorf("unsupported audit target %s", target)
+	}
+}
+
+func validAuditFormat(format string) error {
+	switch format {
+	case auditFormatJSON, auditFormatCEF, auditFormatSyslog:
+		return nil
+	default:
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+}
+
+func newAuditExporter(target, format string) (*auditExporter, error) {
+	if err := validAuditFormat(format); err != nil {
+		return nil, err
+	}
+
+	network, address, err := parseAuditTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	e := &auditExporter{
+		network: network,
+		address: address,
+		format:  format,
+		host:    host,
+		events:  make(chan *auditEvent, auditQueueLength),
+		done:    make(chan struct{}),
+	}
+
+	// Report an unusable file straight away, network destinations may
+	// come and go.
+	if err := e.connect(); err != nil && network == "file" {
+		return nil, err
+	}
+
+	go e.run()
+
+	return e, nil
+}
+
+// setupAuditExport starts exporting the audit events to auditTarget, if set.
+func setupAuditExport() error {
+	if auditTarget == "" {
+		return nil
+	}
+
+	e, err := newAuditExporter(auditTarget, auditFormat)
+	if err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	auditor = e
+
+	if e.network == "file" {
+		landlockPaths = append(landlockPaths, filepath.Dir(e.address))
+	}
+
+	return nil
+}
+
+// stopAuditExport exports the events still queued and stops the exporter.
+func stopAuditExport() {
+	if auditor == nil {
+		return
+	}
+
+	auditor.close()
+	auditor = nil
+}
+
+func (e *auditExporter) connect() error {
+	if e.network == "file" {
+		file, err := os.OpenFile(e.address, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		e.conn = file
+		return nil
+	}
+
+	conn, err := net.DialTimeout(e.network, e.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	e.conn = conn
+	return nil
+}
+
+// export queues ev to be exported, dropping it if too many events are queued
+// already.
+func (e *auditExporter) export(ev *auditEvent) {
+	ev.Host = e.host
+
+	select {
+	case e.events <- ev:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+func (e *auditExporter) run() {
+	defer close(e.done)
+
+	for ev := range e.events {
+		if err := e.write(e.encode(ev)); err != nil {
+			logErrorf(logFields{}, "[audit] ", "couldn't export %s event: %v",
+				ev.Event, err)
+		}
+	}
+
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	if dropped := atomic.LoadUint64(&e.dropped); dropped > 0 {
+		logErrorf(logFields{}, "[audit] ", "dropped %d audit events", dropped)
+	}
+}
+
+// write writes the message msg, reconnecting if the previous write failed.
+func (e *auditExporter) write(msg []byte) error {
+	if e.conn == nil {
+		if err := e.connect(); err != nil {
+			return err
+		}
+	}
+
+	if conn, ok := e.conn.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	// Datagrams hold one message, files and streams are newline
+	// separated.
+	if e.network != "udp" && e.network != "unixgram" {
+		msg = append(msg, '\n')
+	}
+
+	if _, err := e.conn.Write(msg); err != nil {
+		e.conn.Close()
+		e.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (e *auditExporter) close() {
+	close(e.events)
+	<-e.done
+}
+
+// encode formats ev. Events sent to syslog servers, over the network or to a
+// local socket, always have a syslog header.
+func (e *auditExporter) encode(ev *auditEvent) []byte {
+	var msg []byte
+
+	switch e.format {
+	case auditFormatCEF:
+		msg = encodeCEF(ev)
+	case auditFormatSyslog:
+		return encodeSyslog(ev, true)
+	default:
+		msg, _ = json.Marshal(ev)
+	}
+
+	if e.network == "file" {
+		return msg
+	}
+
+	return append(encodeSyslog(ev, false), msg...)
+}
+
+// syslogAuthPriv is the security/authorization syslog facility.
+const syslogAuthPriv = 10
+
+// encodeSyslog formats ev as an RFC 5424 syslog message, with the fields of
+// the event as structured data when withData is set. Without it, only the
+// header is returned, for the caller to add the message.
+func encodeSyslog(ev *auditEvent, withData bool) []byte {
+	var buf bytes.Buffer
+
+	// Warning for the events above the CEF medium severity, notice for
+	// the others.
+	severity := 5
+	if auditSeverities[ev.Event] > 6 {
+		severity = 4
+	}
+	host := ev.Host
+	if host == "" {
+		host = "-"
+	}
+
+	fmt.Fprintf(&buf, "<%d>1 %s %s cc-proxy %d %s ", syslogAuthPriv*8+severity,
+		ev.Time.UTC().Format(time.RFC3339Nano), host, os.Getpid(), ev.Event)
+
+	if !withData {
+		buf.WriteString("- ")
+		return buf.Bytes()
+	}
+
+	// 32473 is the private enterprise number reserved for examples.
+	buf.WriteString("[audit@32473")
+	for _, key := range sortedKeys(ev.Fields) {
+		fmt.Fprintf(&buf, ` %s="%s"`, cefKey(key), syslogParamEscaper.Replace(ev.Fields[key]))
+	}
+	buf.WriteString("] ")
+	buf.WriteString(ev.Message)
+
+	return buf.Bytes()
+}
+
+var (
+	syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	cefHeaderEscaper   = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper    = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// encodeCEF formats ev as an ArcSight Common Event Format message.
+func encodeCEF(ev *auditEvent) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "CEF:0|Intel|cc-proxy|%d|%s|%s|%d|rt=%d",
+		api.Version, ev.Event, cefHeaderEscaper.Replace(ev.Message),
+		auditSeverities[ev.Event], ev.Time.UnixNano()/int64(time.Millisecond))
+	if ev.Host != "" {
+		fmt.Fprintf(&buf, " dvchost=%s", cefValueEscaper.Replace(ev.Host))
+	}
+	for _, key := range sortedKeys(ev.Fields) {
+		fmt.Fprintf(&buf, " %s=%s", cefKey(key), cefValueEscaper.Replace(ev.Fields[key]))
+	}
+
+	return buf.Bytes()
+}
+
+// cefKey turns the log field name key, eg. CONTAINER_ID, into a CEF
+// extension key, containerId.
+func cefKey(key string) string {
+	words := strings.Split(strings.ToLower(key), "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+func sortedKeys(fields logFields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAuditEvent() *auditEvent {
+	return &auditEvent{
+		Time:    time.Date(2017, 6, 12, 10, 36, 58, 123000000, time.UTC),
+		Host:    "node1",
+		Event:   auditCommandForbidden,
+		Message: `Signal forbidden: a|b\c`,
+		Fields: logFields{
+			"CLIENT_ID":    "12",
+			"CONTAINER_ID": "web=1\n",
+		},
+	}
+}
+
+func TestEncodeCEF(t *testing.T) {
+	assert.Equal(t,
+		`CEF:0|Intel|cc-proxy|2|CommandForbidden|Signal forbidden: a\|b\\c|6|`+
+			`rt=1497263818123 dvchost=node1 clientId=12 containerId=web\=1\n`,
+		string(encodeCEF(testAuditEvent())))
+}
+
+func TestEncodeSyslog(t *testing.T) {
+	ev := testAuditEvent()
+	ev.Fields["PEER_IDENTITY"] = `"runtime"]`
+
+	assert.Equal(t,
+		fmt.Sprintf(`<85>1 2017-06-12T10:36:58.123Z node1 cc-proxy %d CommandForbidden `+
+			`[audit@32473 clientId="12" containerId="web=1`+"\n"+`" peerIdentity="\"runtime\"\]"] `+
+			`Signal forbidden: a|b\c`, os.Getpid()),
+		string(encodeSyslog(ev, true)))
+
+	ev.Event = auditClientEvicted
+	ev.Host = ""
+	assert.Equal(t,
+		fmt.Sprintf("<84>1 2017-06-12T10:36:58.123Z - cc-proxy %d ClientEvicted - ", os.Getpid()),
+		string(encodeSyslog(ev, false)))
+}
+
+func TestParseAuditTarget(t *testing.T) {
+	tests := []struct {
+		target, network, address string
+	}{
+		{"file:///var/log/audit.log", "file", "/var/log/audit.log"},
+		{"udp://localhost:514", "udp", "localhost:514"},
+		{"tcp://10.0.0.1:601", "tcp", "10.0.0.1:601"},
+		{"unix:///dev/log", "unixgram", "/dev/log"},
+	}
+
+	for _, test := range tests {
+		network, address, err := parseAuditTarget(test.target)
+		assert.Nil(t, err, "%s", test.target)
+		assert.Equal(t, test.network, network)
+		assert.Equal(t, test.address, address)
+	}
+
+	for _, target := range []string{"", "/var/log/audit.log", "file://", "udp://", "http://localhost"} {
+		_, _, err := parseAuditTarget(target)
+		assert.NotNil(t, err, "%s", target)
+	}
+}
+
+func TestAuditExportFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-audit-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defer saveConfig()()
+	auditTarget = "file://" + filepath.Join(dir, "audit.log")
+	auditFormat = auditFormatJSON
+	assert.Nil(t, setupAuditExport())
+
+	logAuditf(auditVMRegistered, logFields{"CLIENT_ID": "3"}, "", "registered VM %s", "foo")
+	stopAuditExport()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.Len(t, lines, 1)
+
+	var ev auditEvent
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, auditVMRegistered, ev.Event)
+	assert.Equal(t, "registered VM foo", ev.Message)
+	assert.Equal(t, logFields{"CLIENT_ID": "3"}, ev.Fields)
+}
+
+func TestAuditExportUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	e, err := newAuditExporter("udp://"+server.LocalAddr().String(), auditFormatCEF)
+	assert.Nil(t, err)
+	defer e.close()
+
+	e.export(testAuditEvent())
+
+	buf := make([]byte, 4096)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err)
+
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<85>1 "), "%s", msg)
+	assert.Contains(t, msg, " CommandForbidden - CEF:0|Intel|cc-proxy|")
+	assert.False(t, strings.HasSuffix(msg, "\n"))
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// authRequest is a command an Authorizer is asked about.
+type authRequest struct {
+	// peer is the client at the other end of the connection.
+	peer *peer
+	cmd  api.Command
+	// containerID is the container the command is about, empty when the
+	// command isn't about a specific container.
+	containerID string
+	// hyperCommands are the hyper commands the command sends to
+	// hyperstart, if any.
+	hyperCommands []string
+}
+
+// Authorizer decides whether clients can send commands. Authorize is called
+// before every command. An error rejects the command and is sent back to the
+// client, with the code of proxyErrors, api.ErrorCodeForbidden usually.
+//
+// Authorizers are registered with registerAuthorizer, typically from the
+// init() function of the file implementing them.
+type Authorizer interface {
+	Authorize(req *authRequest) error
+}
+
+// authorizers are consulted in turn before each command. A command has to be
+// allowed by all of them.
+var authorizers []Authorizer
+
+func registerAuthorizer(a Authorizer) {
+	authorizers = append(authorizers, a)
+}
+
+// commandTarget holds the fields of the command payloads naming the
+// container they are about.
+type commandTarget struct {
+	ContainerID string `json:"containerId"`
+	Token       Token  `json:"token"`
+}
+
+// containerIDCommands are the commands whose handler acts on the container
+// named by the containerId field of their payload.
+var containerIDCommands = map[api.Command]bool{
+	api.CmdRegisterVM:   true,
+	api.CmdAttachVM:     true,
+	api.CmdUnregisterVM: true,
+	api.CmdStats:        true,
+	api.CmdCapture:      true,
+	api.CmdPause:        true,
+	api.CmdResume:       true,
+	api.CmdHotplug:      true,
+	api.CmdCancel:       true,
+	api.CmdRenewTokens:  true,
+}
+
+// commandContainerID returns the container the command cmd, with payload,
+// is about: the one it names for the commands of containerIDCommands, the
+// one of the token it claims for ConnectShim and, for the other commands,
+// the container of the VM the client is attached to. The other commands
+// can't name a container of their own: an error is returned if they name
+// another container than the one they act on.
+func (client *client) commandContainerID(cmd api.Command, payload []byte) (string, error) {
+	var target commandTarget
+
+	// Malformed payloads are rejected by the command handlers.
+	json.Unmarshal(payload, &target)
+
+	if containerIDCommands[cmd] {
+		return target.ContainerID, nil
+	}
+
+	var containerID string
+	if cmd == api.CmdConnectShim {
+		if claims, err := verifyToken(target.Token); err == nil {
+			containerID = claims.ContainerID
+		}
+	} else if client.vm != nil {
+		containerID = client.vm.containerID
+	}
+
+	if target.ContainerID != "" && target.ContainerID != containerID {
+		return "", newProxyError(api.ErrorCodeForbidden,
+			"%s is about container %s, not %s", cmd, containerID, target.ContainerID)
+	}
+
+	return containerID, nil
+}
+
+// authorizeCommand returns an error if the client userData isn't allowed to
+// send cmd, with payload, according to the authorizers.
+func authorizeCommand(cmd api.Command, payload []byte, userData interface{}) error {
+	client := userData.(*client)
+	containerID, err := client.commandContainerID(cmd, payload)
+	if err != nil {
+		client.audit(auditCommandForbidden, "%s forbidden: %v", cmd, err)
+		return err
+	}
+
+	req := &authRequest{
+		peer:          &client.peer,
+		cmd:           cmd,
+		containerID:   containerID,
+		hyperCommands: commandHyperCommands(cmd, payload),
+	}
+	for _, a := range authorizers {
+		if err := a.Authorize(req); err != nil {
+			client.audit(auditCommandForbidden, "%s forbidden: %v", cmd, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authPolicyFile is a JSON file holding the rules of authPolicy.
+var authPolicyFile string
+
+// authRule gives the commands the clients it matches are allowed to send
+// about the containers it matches. Containers are shell patterns matching
+// the IDs of the containers the rule applies to, a rule without Containers
+// applies to all the commands.
+type authRule struct {
+	peerMatcher
+	Containers []string    `json:"containers,omitempty"`
+	Commands   commandList `json:"commands"`
+}
+
+// authPolicy restricts the commands clients can send. The first rule matching
+// a client and the container a command is about applies, commands matched by
+// no rule are refused. An empty policy allows everything.
+var authPolicy []authRule
+
+func (r *authRule) validate() error {
+	if err := r.peerMatcher.validate(); err != nil {
+		return err
+	}
+
+	for _, pattern := range r.Containers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid container pattern '%s'", pattern)
+		}
+	}
+
+	for _, name := range r.Commands {
+		if name == anyCommand {
+			continue
+		}
+		if _, ok := commandNames[name]; !ok {
+			return fmt.Errorf("unknown command '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+func (r *authRule) matches(p *peer, containerID string) bool {
+	if !r.peerMatcher.matches(p) {
+		return false
+	}
+
+	if len(r.Containers) == 0 {
+		return true
+	}
+	if containerID == "" {
+		return false
+	}
+	for _, pattern := range r.Containers {
+		if matched, _ := path.Match(pattern, containerID); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadAuthPolicy reads and validates the rules of the policy file at path.
+func loadAuthPolicy(path string) ([]authRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []authRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %v", path, err)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("policy without rules")
+	}
+
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// setupAuthPolicy loads authPolicyFile, if set, into authPolicy.
+func setupAuthPolicy() error {
+	if authPolicyFile == "" {
+		authPolicy = nil
+		return nil
+	}
+
+	rules, err := loadAuthPolicy(authPolicyFile)
+	if err != nil {
+		return fmt.Errorf("authorization policy: %v", err)
+	}
+	authPolicy = rules
+
+	return nil
+}
+
+// policyAuthorizer enforces authPolicy.
+type policyAuthorizer struct{}
+
+func (policyAuthorizer) Authorize(req *authRequest) error {
+	if len(authPolicy) == 0 {
+		return nil
+	}
+
+	for i := range authPolicy {
+		rule := &authPolicy[i]
+		if !rule.matches(req.peer, req.containerID) {
+			continue
+		}
+		if rule.Commands.allows(req.cmd.String()) {
+			return nil
+		}
+		break
+	}
+
+	if req.containerID != "" {
+		return newProxyError(api.ErrorCodeForbidden,
+			"client isn't allowed to send %s for container %s", req.cmd,
+			req.containerID)
+	}
+	return newProxyError(api.ErrorCodeForbidden,
+		"client isn't allowed to send %s", req.cmd)
+}
+
+func init() {
+	registerAuthorizer(policyAuthorizer{})
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthPolicy(t *testing.T) {
+	root := uint32(0)
+	saved := authPolicy
+	defer func() {
+		authPolicy = saved
+	}()
+
+	authPolicy = []authRule{
+		{peerMatcher: peerMatcher{UID: &root}, Commands: commandList{anyCommand}},
+		{peerMatcher: peerMatcher{Type: "container_t"}, Containers: []string{"web-*"},
+			Commands: commandList{"ConnectShim", "Signal"}},
+		{peerMatcher: peerMatcher{Listener: listenerTLS, Identity: "monitor"},
+			Commands: commandList{"Stats"}},
+	}
+	authorize := func(p *peer, cmd api.Command, containerID string) error {
+		return policyAuthorizer{}.Authorize(&authRequest{
+			peer:        p,
+			cmd:         cmd,
+			containerID: containerID,
+		})
+	}
+
+	assert.Nil(t, authorize(&peer{listener: listenerUnix, hasUID: true},
+		api.CmdRegisterVM, "foo"))
+
+	shim := &peer{listener: listenerUnix, uid: 1000, hasUID: true,
+		label: "system_u:system_r:container_t:s0", hasLabel: true}
+	assert.Nil(t, authorize(shim, api.CmdConnectShim, "web-1"))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorize(shim, api.CmdConnectShim, "db-1")))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorize(shim, api.CmdRegisterVM, "web-1")))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorize(shim, api.CmdStats, "")))
+
+	monitor := &peer{listener: listenerTLS, identity: "monitor"}
+	assert.Nil(t, authorize(monitor, api.CmdStats, ""))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorize(monitor, api.CmdRegisterVM, "")))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorize(&peer{listener: listenerTLS}, api.CmdStats, "")))
+
+	// An empty policy allows everything.
+	authPolicy = nil
+	assert.Nil(t, authorize(&peer{listener: listenerTLS}, api.CmdRegisterVM, "foo"))
+}
+
+func TestLoadAuthPolicy(t *testing.T) {
+	path := writeTestConfig(t, `[
+		{ "uid": 0, "commands": ["*"] },
+		{ "type": "container_t", "containers": ["web-*"], "commands": ["ConnectShim"] }
+	]`)
+	defer os.Remove(path)
+	rules, err := loadAuthPolicy(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rules))
+
+	tests := []string{
+		``,
+		`[]`,
+		`{"commands": ["*"]}`,
+		`[{"commands": ["Foo"]}]`,
+		`[{"listener": "tcp", "commands": ["*"]}]`,
+		`[{"listener": "unix", "identity": "shim", "commands": ["*"]}]`,
+		`[{"containers": ["[web"], "commands": ["*"]}]`,
+	}
+	for _, test := range tests {
+		path := writeTestConfig(t, test)
+		_, err := loadAuthPolicy(path)
+		assert.NotNil(t, err, "%s", test)
+		os.Remove(path)
+	}
+}
+
+// recordingAuthorizer allows everything and records the commands it's asked
+// about.
+type recordingAuthorizer struct {
+	sync.Mutex
+	containers map[api.Command]string
+}
+
+func (r *recordingAuthorizer) Authorize(req *authRequest) error {
+	r.Lock()
+	defer r.Unlock()
+	r.containers[req.cmd] = req.containerID
+	return nil
+}
+
+func TestAuthorizerContainerID(t *testing.T) {
+	saved := authorizers
+	defer func() {
+		authorizers = saved
+	}()
+	recorder := &recordingAuthorizer{containers: make(map[api.Command]string)}
+	registerAuthorizer(recorder)
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	assert.Nil(t, rig.Client.Hyper("ping", nil))
+	shim := rig.ServeNewShim(token)
+	shim.close()
+
+	rig.Stop()
+
+	recorder.Lock()
+	defer recorder.Unlock()
+	assert.Equal(t, testContainerID, recorder.containers[api.CmdRegisterVM])
+	assert.Equal(t, testContainerID, recorder.containers[api.CmdHyper])
+	assert.Equal(t, testContainerID, recorder.containers[api.CmdConnectShim])
+}
+
+func TestAuthorizeSpoofedContainerID(t *testing.T) {
+	saved := authPolicy
+	defer func() {
+		authPolicy = saved
+	}()
+	authPolicy = []authRule{
+		{Containers: []string{"web-*"}, Commands: commandList{anyCommand}},
+	}
+
+	token, err := signToken(&tokenClaims{ContainerID: "db-1", IssuedAt: time.Now()})
+	assert.Nil(t, err)
+	client := &client{peer: peer{listener: listenerUnix}}
+
+	// A shim can't claim a token of another container by naming one it's
+	// allowed to send commands about.
+	payload := fmt.Sprintf(`{"token":"%s","containerId":"web-1"}`, token)
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorizeCommand(api.CmdConnectShim, []byte(payload), client)))
+	payload = fmt.Sprintf(`{"token":"%s"}`, token)
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorizeCommand(api.CmdConnectShim, []byte(payload), client)))
+
+	// Nor can a client attached to a VM send hyper commands about another
+	// container.
+	client.vm = &vm{containerID: "db-2"}
+	payload = `{"hyperName":"ping","containerId":"web-1"}`
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorizeCommand(api.CmdHyper, []byte(payload), client)))
+
+	client.vm = &vm{containerID: "web-2"}
+	assert.Nil(t, authorizeCommand(api.CmdHyper, []byte(`{"hyperName":"ping"}`), client))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorizeCommand(api.CmdHyper, []byte(payload), client)))
+
+	// The commands naming the container they act on are checked against it.
+	assert.Nil(t, authorizeCommand(api.CmdStats, []byte(`{"containerId":"web-1"}`), client))
+	assert.Equal(t, api.ErrorCodeForbidden,
+		errorCode(authorizeCommand(api.CmdStats, []byte(`{"containerId":"db-1"}`), client)))
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// benchHyperstart is a minimal hyperstart: it signals it's ready on the ctl
+// channel and leaves the io channel to the benchmark. The mock hyperstart
+// logs every packet through a *testing.T, which would both be unavailable in
+// benchmarks and dominate the measurements.
+type benchHyperstart struct {
+	dir             string
+	ctlPath, ioPath string
+	ctlListener     net.Listener
+	ioListener      net.Listener
+	ctl, io         net.Conn
+	connected       chan error
+}
+
+func startBenchHyperstart(b *testing.B) *benchHyperstart {
+	dir, err := ioutil.TempDir("", "cc-proxy-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	h := &benchHyperstart{
+		dir:       dir,
+		ctlPath:   filepath.Join(dir, "ctl.sock"),
+		ioPath:    filepath.Join(dir, "io.sock"),
+		connected: make(chan error, 1),
+	}
+
+	if h.ctlListener, err = net.Listen("unix", h.ctlPath); err != nil {
+		b.Fatal(err)
+	}
+	if h.ioListener, err = net.Listen("unix", h.ioPath); err != nil {
+		b.Fatal(err)
+	}
+
+	go func() {
+		h.connected <- h.accept()
+	}()
+
+	return h
+}
+
+// accept waits for the proxy to connect to both channels, the ctl one first,
+// and sends the READY message.
+func (h *benchHyperstart) accept() error {
+	var err error
+
+	if h.ctl, err = h.ctlListener.Accept(); err != nil {
+		return err
+	}
+	if h.io, err = h.ioListener.Accept(); err != nil {
+		return err
+	}
+
+	ready := make([]byte, 8)
+	binary.BigEndian.PutUint32(ready[:], uint32(hyperstart.ReadyCode))
+	binary.BigEndian.PutUint32(ready[4:], uint32(len(ready)))
+	_, err = h.ctl.Write(ready)
+	return err
+}
+
+func (h *benchHyperstart) close() {
+	h.ctlListener.Close()
+	h.ioListener.Close()
+	if h.ctl != nil {
+		h.ctl.Close()
+	}
+	if h.io != nil {
+		h.io.Close()
+	}
+	os.RemoveAll(h.dir)
+}
+
+// benchRig is an in-process proxy with a registered VM and a shim connected
+// to its only I/O session.
+type benchRig struct {
+	b  *testing.B
+	wg sync.WaitGroup
+
+	hyperstart *benchHyperstart
+	proxy      *proxy
+	protocol   *protocol
+	proxyConns []net.Conn
+
+	client *goapi.Client
+	shim   net.Conn
+	ioBase uint64
+}
+
+func newBenchRig(b *testing.B) *benchRig {
+	rig := &benchRig{
+		b:          b,
+		hyperstart: startBenchHyperstart(b),
+		proxy:      newProxy(),
+		protocol:   newTestProtocol(),
+	}
+
+	rig.client = goapi.NewClient(rig.serveNewClient().(*net.UnixConn))
+	ret, err := rig.client.RegisterVM(testContainerID, rig.hyperstart.ctlPath,
+		rig.hyperstart.ioPath, &goapi.RegisterVMOptions{NumIOStreams: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := <-rig.hyperstart.connected; err != nil {
+		b.Fatal(err)
+	}
+
+	token := ret.IO.Tokens[0]
+	rig.shim = rig.serveNewClient()
+	if err := goapi.NewClient(rig.shim.(*net.UnixConn)).ConnectShim(token); err != nil {
+		b.Fatal(err)
+	}
+	rig.ioBase = peekIOSession(rig.proxy, token).ioBase
+
+	return rig
+}
+
+func (rig *benchRig) serveNewClient() net.Conn {
+	clientConn, proxyConn, err := Socketpair()
+	if err != nil {
+		rig.b.Fatal(err)
+	}
+	rig.proxyConns = append(rig.proxyConns, proxyConn)
+	rig.wg.Add(1)
+	go func() {
+		rig.proxy.serveNewClient(rig.protocol, proxyConn)
+		rig.wg.Done()
+	}()
+
+	return clientConn
+}
+
+func (rig *benchRig) stop() {
+	// Closing the hyperstart side first lets the proxy tear down the VM
+	// without waiting for the ctl channel to time out.
+	rig.hyperstart.close()
+	rig.client.UnregisterVM(testContainerID)
+
+	rig.client.Close()
+	rig.shim.Close()
+	for _, conn := range rig.proxyConns {
+		conn.Close()
+	}
+
+	rig.wg.Wait()
+	rig.proxy.wg.Wait()
+}
+
+// newIOPacket returns a hyperstart I/O packet for stream seq carrying size
+// bytes of data.
+func newIOPacket(seq uint64, size int) []byte {
+	packet := make([]byte, 12+size)
+	binary.BigEndian.PutUint64(packet[:], seq)
+	binary.BigEndian.PutUint32(packet[8:], uint32(len(packet)))
+	for i := 12; i < len(packet); i++ {
+		packet[i] = 'x'
+	}
+	return packet
+}
+
+// readStdout reads stream frames from the shim connection until n bytes of
+// payload have been received.
+func (rig *benchRig) readStdout(n int) {
+	for n > 0 {
+		frame, err := api.ReadFrame(rig.shim)
+		if err != nil {
+			rig.b.Fatal(err)
+		}
+		if frame.Header.Type != api.TypeStream {
+			rig.b.Fatalf("unexpected %s frame", frame.Header.Type)
+		}
+		n -= len(frame.Payload)
+	}
+}
+
+// readStdin reads I/O packets from the hyperstart io channel until n bytes of
+// data have been received.
+func (rig *benchRig) readStdin(n int) {
+	header := make([]byte, 12)
+	for n > 0 {
+		if _, err := io.ReadFull(rig.hyperstart.io, header); err != nil {
+			rig.b.Fatal(err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[8:])) - 12
+		if _, err := io.CopyN(ioutil.Discard, rig.hyperstart.io, length); err != nil {
+			rig.b.Fatal(err)
+		}
+		n -= int(length)
+	}
+}
+
+var benchmarkStreamSizes = []int{64, 4096, 32768}
+
+// BenchmarkStdoutThroughput measures the relay of process output from
+// hyperstart to a shim.
+func BenchmarkStdoutThroughput(b *testing.B) {
+	for _, size := range benchmarkStreamSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			rig := newBenchRig(b)
+			packet := newIOPacket(rig.ioBase, size)
+
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+
+			done := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := rig.hyperstart.io.Write(packet); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			rig.readStdout(b.N * size)
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+
+			b.StopTimer()
+			rig.stop()
+		})
+	}
+}
+
+// BenchmarkStdinThroughput measures the relay of process input from a shim to
+// hyperstart.
+func BenchmarkStdinThroughput(b *testing.B) {
+	for _, size := range benchmarkStreamSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			rig := newBenchRig(b)
+			data := newIOPacket(0, size)[12:]
+
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+
+			done := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if err := api.WriteStream(rig.shim, api.StreamStdin, data); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			rig.readStdin(b.N * size)
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+
+			b.StopTimer()
+			rig.stop()
+		})
+	}
+}
+
+// BenchmarkStdoutLatency measures the time a single line of output takes to
+// go from hyperstart to the shim.
+func BenchmarkStdoutLatency(b *testing.B) {
+	rig := newBenchRig(b)
+	packet := newIOPacket(rig.ioBase, 64)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := rig.hyperstart.io.Write(packet); err != nil {
+			b.Fatal(err)
+		}
+		rig.readStdout(64)
+	}
+
+	b.StopTimer()
+	rig.stop()
+}
+
+// BenchmarkCommandLatency measures a command round trip between a client and
+// the proxy.
+func BenchmarkCommandLatency(b *testing.B) {
+	rig := newBenchRig(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := rig.client.Stats(testContainerID); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	rig.stop()
+}
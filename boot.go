@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+)
+
+// bootVM connects to vm, registered with RegisterVM.Async, in the background,
+// reporting each step to the clients attached to the VM. The VM is ready once
+// hyperstart has answered a first ping and, with negotiate, once the hyperstart
+// protocol version has been negotiated.
+func (proxy *proxy) bootVM(vm *vm, negotiate bool) {
+	progress := func(state string) {
+		vm.infof(1, "boot", "%s", state)
+		vm.notify(api.NotificationVMBoot, &api.VMBoot{
+			ContainerID: vm.containerID,
+			State:       state,
+		})
+	}
+
+	if err := vm.connect(progress); err != nil {
+		vm.bootFailed(err)
+		proxy.Lock()
+		if proxy.vms[vm.containerID] == vm {
+			delete(proxy.vms, vm.containerID)
+		}
+		proxy.Unlock()
+		proxy.forgetTokens(vm)
+		return
+	}
+
+	proxy.monitorVM(vm)
+
+	if _, err := vm.sendCtlMessage(hyperapi.CmdPing, nil); err != nil {
+		vm.bootFailed(err)
+		return
+	}
+
+	if negotiate {
+		vm.negotiateVersion()
+	}
+
+	vm.Lock()
+	vm.booting = false
+	vm.Unlock()
+
+	progress(api.VMBootReady)
+}
+
+// bootFailed marks vm, whose boot has failed because of err, unhealthy.
+func (vm *vm) bootFailed(err error) {
+	vm.infof(1, "boot", "failed: %v", err)
+
+	vm.Lock()
+	vm.booting = false
+	vm.unhealthy = true
+	vm.Unlock()
+
+	vm.notify(api.NotificationVMBoot, &api.VMBoot{
+		ContainerID: vm.containerID,
+		State:       api.VMBootFailed,
+		Error:       err.Error(),
+	})
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// bufferSizes are the size classes of the buffers handed out by getBuffer.
+// The biggest class holds the largest I/O message hyperstart can send plus
+// the header of the proxy frame it's forwarded in.
+var bufferSizes = [...]int{512, 2048, 16384}
+
+// bufferPools recycles the buffers used to relay I/O data. Buffers from a pool
+// have a capacity of the corresponding entry in bufferSizes.
+var bufferPools [len(bufferSizes)]sync.Pool
+
+func init() {
+	for i := range bufferPools {
+		size := bufferSizes[i]
+		bufferPools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+}
+
+// getBuffer returns a buffer of length n, taken from a pool when n fits in one
+// of the size classes. It should be given back with putBuffer once the caller
+// is done with it.
+func getBuffer(n int) []byte {
+	for i, size := range bufferSizes {
+		if n <= size {
+			return bufferPools[i].Get().([]byte)[:n]
+		}
+	}
+
+	return make([]byte, n)
+}
+
+// putBuffer gives buf back to its pool. Buffers that weren't allocated with
+// getBuffer are left to the garbage collector.
+func putBuffer(buf []byte) {
+	for i, size := range bufferSizes {
+		if cap(buf) == size {
+			bufferPools[i].Put(buf[:size])
+			return
+		}
+	}
+}
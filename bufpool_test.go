@@ -0,0 +1,45 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	tests := []struct {
+		n, capacity int
+	}{
+		{0, 512},
+		{1, 512},
+		{512, 512},
+		{513, 2048},
+		{16384, 16384},
+		{16385, 16385},
+	}
+
+	for _, test := range tests {
+		buf := getBuffer(test.n)
+		assert.Equal(t, test.n, len(buf))
+		assert.Equal(t, test.capacity, cap(buf))
+		putBuffer(buf)
+	}
+
+	// Buffers not coming from getBuffer are simply dropped.
+	putBuffer(make([]byte, 42))
+	putBuffer(nil)
+}
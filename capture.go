@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// captureDir is where I/O capture files are written. The system temporary
+// directory is used when empty.
+var captureDir string
+
+// captureRecord is an entry of a capture file. Capture files are a sequence
+// of JSON objects, one per line:
+//
+//  {"time":"2017-06-12T10:36:58.1Z","seq":3,"stream":"stdout","data":"aGVsbG8K"}
+//
+// data is base64 encoded.
+type captureRecord struct {
+	Time time.Time `json:"time"`
+	// Seq is the hyperstart sequence number of the stream.
+	Seq    uint64 `json:"seq"`
+	Stream string `json:"stream"`
+	Data   []byte `json:"data"`
+}
+
+// ioCapture records the I/O traffic of a VM to a file, for debugging
+// purposes.
+type ioCapture struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newIOCapture(containerID string) (*ioCapture, error) {
+	if err := checkContainerID(containerID); err != nil {
+		return nil, err
+	}
+
+	dir := captureDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s.capture", containerID,
+		time.Now().UTC().Format("20060102T150405.000000000"))
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ioCapture{
+		path:    path,
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (c *ioCapture) record(seq uint64, stream string, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	// Failing to capture shouldn't disturb the relay.
+	c.encoder.Encode(&captureRecord{
+		Time:   time.Now().UTC(),
+		Seq:    seq,
+		Stream: stream,
+		Data:   data,
+	})
+}
+
+func (c *ioCapture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.file.Close()
+}
+
+// startCapture starts recording the I/O traffic of vm, returning the path of
+// the capture file.
+func (vm *vm) startCapture() (string, error) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	if vm.capture != nil {
+		return "", fmt.Errorf("already capturing I/O to %s", vm.capture.path)
+	}
+
+	capture, err := newIOCapture(vm.containerID)
+	if err != nil {
+		return "", fmt.Errorf("couldn't start I/O capture: %v", err)
+	}
+	vm.capture = capture
+
+	return capture.path, nil
+}
+
+// stopCapture stops recording the I/O traffic of vm, returning the path of
+// the capture file.
+func (vm *vm) stopCapture() (string, error) {
+	vm.Lock()
+	capture := vm.capture
+	vm.capture = nil
+	vm.Unlock()
+
+	if capture == nil {
+		return "", fmt.Errorf("not capturing I/O")
+	}
+
+	return capture.path, capture.Close()
+}
+
+// capturing returns the current capture of vm, nil if none.
+func (vm *vm) capturing() *ioCapture {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.capture
+}
+
+// captureIO records data, relayed on the stream identified by seq, if the
+// I/O traffic of vm is being captured.
+func (vm *vm) captureIO(seq uint64, stream string, data []byte) {
+	if capture := vm.capturing(); capture != nil {
+		capture.record(seq, stream, data)
+	}
+}
+
+// "Capture"
+func capture(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+	payload := api.Capture{}
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.vms[payload.ContainerID]
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetErrorf("unknown containerID: %s", payload.ContainerID)
+		return
+	}
+
+	var path string
+	var err error
+	if payload.Enable {
+		path, err = vm.startCapture()
+	} else {
+		path, err = vm.stopCapture()
+	}
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.infof(1, "Capture(containerId=%s,enable=%v): %s", payload.ContainerID,
+		payload.Enable, path)
+
+	response.AddResult("path", path)
+}
@@ -16,8 +16,8 @@ package client
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net"
 	"syscall"
 
@@ -28,6 +28,25 @@ import (
 // high level API.
 type Client struct {
 	conn net.Conn
+
+	notificationHandler NotificationHandler
+}
+
+// NotificationHandler is the prototype of the function called when the proxy
+// sends a notification.
+type NotificationHandler func(notification api.Notification, payload []byte)
+
+// Error is the error type returned by the client methods when the proxy
+// answers a command with an error.
+type Error struct {
+	// Code classifies the error. See api.ErrorCode.
+	Code api.ErrorCode
+	// Message is the human readable error message.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
 }
 
 // NewClient creates a new client object to communicate with the proxy using
@@ -39,12 +58,21 @@ func NewClient(conn net.Conn) *Client {
 	}
 }
 
+// HandleNotifications registers a function to be called with the
+// notifications sent by the proxy. Notifications are only read from the
+// connection while waiting for the response of a command, so the handler is
+// called from the goroutine issuing that command. Notifications received
+// without a handler registered are discarded.
+func (client *Client) HandleNotifications(handler NotificationHandler) {
+	client.notificationHandler = handler
+}
+
 // Close a client, closing the underlying AF_UNIX socket.
 func (client *Client) Close() {
 	client.conn.Close()
 }
 
-func (client *Client) sendCommandFull(cmd api.Command, payload interface{},
+func (client *Client) sendCommandFull(cmd api.Command, streamID int, payload interface{},
 	waitForResponse bool) (*api.Frame, error) {
 	var data []byte
 	var frame *api.Frame
@@ -56,7 +84,9 @@ func (client *Client) sendCommandFull(cmd api.Command, payload interface{},
 		}
 	}
 
-	if err := api.WriteCommand(client.conn, cmd, data); err != nil {
+	frame = api.NewFrame(api.TypeCommand, int(cmd), data)
+	frame.Header.StreamID = streamID
+	if err := api.WriteFrame(client.conn, frame); err != nil {
 		return nil, err
 	}
 
@@ -64,8 +94,20 @@ func (client *Client) sendCommandFull(cmd api.Command, payload interface{},
 		return nil, nil
 	}
 
-	if frame, err = api.ReadFrame(client.conn); err != nil {
-		return nil, err
+	// The proxy may send notifications before answering our command.
+	for {
+		if frame, err = api.ReadFrame(client.conn); err != nil {
+			return nil, err
+		}
+
+		if frame.Header.Type != api.TypeNotification {
+			break
+		}
+
+		if client.notificationHandler != nil {
+			client.notificationHandler(api.Notification(frame.Header.Opcode),
+				frame.Payload)
+		}
 	}
 
 	if frame.Header.Type != api.TypeResponse {
@@ -76,15 +118,19 @@ func (client *Client) sendCommandFull(cmd api.Command, payload interface{},
 		return nil, fmt.Errorf("unexpected opcode %v", frame.Header.Opcode)
 	}
 
+	if frame.Header.StreamID != streamID {
+		return nil, fmt.Errorf("unexpected stream ID %d", frame.Header.StreamID)
+	}
+
 	return frame, nil
 }
 
 func (client *Client) sendCommand(cmd api.Command, payload interface{}) (*api.Frame, error) {
-	return client.sendCommandFull(cmd, payload, true)
+	return client.sendCommandFull(cmd, 0, payload, true)
 }
 
 func (client *Client) sendCommandNoResponse(cmd api.Command, payload interface{}) error {
-	_, err := client.sendCommandFull(cmd, payload, false)
+	_, err := client.sendCommandFull(cmd, 0, payload, false)
 	return err
 }
 
@@ -101,10 +147,13 @@ func errorFromResponse(resp *api.Frame) error {
 	}
 
 	if decoded.Message == "" {
-		return errors.New("unknown error")
+		decoded.Message = "unknown error"
 	}
 
-	return errors.New(decoded.Message)
+	return &Error{
+		Code:    decoded.Code,
+		Message: decoded.Message,
+	}
 }
 
 func unmarshalResponse(resp *api.Frame, decoded interface{}) error {
@@ -124,8 +173,16 @@ func unmarshalResponse(resp *api.Frame, decoded interface{}) error {
 //
 // See the api.RegisterVM payload for more details.
 type RegisterVMOptions struct {
-	Console      string
-	NumIOStreams int
+	Console           string
+	NumIOStreams      int
+	OutputRateLimit   int
+	OutputRateBurst   int
+	Logs              bool
+	LineBuffered      bool
+	HyperstartVersion string
+	ProbeAgent        bool
+	Async             bool
+	QMP               string
 }
 
 // RegisterVMReturn contains the return values from RegisterVM.
@@ -147,6 +204,14 @@ func (client *Client) RegisterVM(containerID, ctlSerial, ioSerial string,
 	if options != nil {
 		payload.Console = options.Console
 		payload.NumIOStreams = options.NumIOStreams
+		payload.OutputRateLimit = options.OutputRateLimit
+		payload.OutputRateBurst = options.OutputRateBurst
+		payload.Logs = options.Logs
+		payload.LineBuffered = options.LineBuffered
+		payload.HyperstartVersion = options.HyperstartVersion
+		payload.ProbeAgent = options.ProbeAgent
+		payload.Async = options.Async
+		payload.QMP = options.QMP
 	}
 
 	resp, err := client.sendCommand(api.CmdRegisterVM, &payload)
@@ -168,6 +233,7 @@ func (client *Client) RegisterVM(containerID, ctlSerial, ioSerial string,
 // See the api.AttachVM payload for more details.
 type AttachVMOptions struct {
 	NumIOStreams int
+	Logs         bool
 }
 
 // AttachVMReturn contains the return values from AttachVM.
@@ -185,6 +251,7 @@ func (client *Client) AttachVM(containerID string, options *AttachVMOptions) (*A
 
 	if options != nil {
 		payload.NumIOStreams = options.NumIOStreams
+		payload.Logs = options.Logs
 	}
 
 	resp, err := client.sendCommand(api.CmdAttachVM, &payload)
@@ -210,6 +277,114 @@ func (client *Client) Hyper(hyperName string, hyperMessage interface{}) error {
 //
 // See the api.Hyper payload description for more details.
 func (client *Client) HyperWithTokens(hyperName string, tokens []string, hyperMessage interface{}) error {
+	hyper, err := newHyper(hyperName, tokens, hyperMessage)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.sendCommand(api.CmdHyper, hyper)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// HyperAsync is a HyperWithTokens variant returning as soon as the proxy has
+// accepted the command. The returned operation ID identifies the
+// api.NotificationHyperCompleted notification carrying the result of the
+// command.
+//
+// See the api.Hyper and api.HyperCompleted payloads for more details.
+func (client *Client) HyperAsync(hyperName string, tokens []string, hyperMessage interface{}) (uint64, error) {
+	hyper, err := newHyper(hyperName, tokens, hyperMessage)
+	if err != nil {
+		return 0, err
+	}
+	hyper.Async = true
+
+	resp, err := client.sendCommand(api.CmdHyper, hyper)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return 0, err
+	}
+
+	decoded := api.HyperResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return decoded.OperationID, err
+}
+
+// Cancel wraps the api.Cancel payload, cancelling the asynchronous hyper
+// command operationID sent to the VM containerID with HyperAsync.
+//
+// See the api.Cancel payload description for more details.
+func (client *Client) Cancel(containerID string, operationID uint64) error {
+	payload := api.Cancel{
+		ContainerID: containerID,
+		OperationID: operationID,
+	}
+
+	resp, err := client.sendCommand(api.CmdCancel, &payload)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// RenewTokens wraps the api.RenewTokens payload, re-issuing the I/O tokens of
+// the VM containerID before they expire. It returns the new tokens, in the
+// order of tokens, and their read-only counterparts.
+//
+// See the api.RenewTokens payload description for more details.
+func (client *Client) RenewTokens(containerID string, tokens []string) (*api.RenewTokensResponse, error) {
+	payload := api.RenewTokens{
+		ContainerID: containerID,
+		Tokens:      tokens,
+	}
+
+	resp, err := client.sendCommand(api.CmdRenewTokens, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	decoded := api.RenewTokensResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return &decoded, err
+}
+
+// HyperBatch wraps the api.HyperBatch payload, sending commands to hyperstart
+// in order. It returns the result of each command sent: the proxy stops at the
+// first command that fails.
+//
+// See the api.HyperBatch and api.HyperBatchResponse payloads for more details.
+func (client *Client) HyperBatch(commands []api.Hyper) ([]api.HyperResult, error) {
+	payload := api.HyperBatch{
+		Commands: commands,
+	}
+
+	resp, err := client.sendCommand(api.CmdHyperBatch, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	decoded := api.HyperBatchResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return decoded.Results, err
+}
+
+func newHyper(hyperName string, tokens []string, hyperMessage interface{}) (*api.Hyper, error) {
 	var data []byte
 
 	if hyperMessage != nil {
@@ -217,11 +392,11 @@ func (client *Client) HyperWithTokens(hyperName string, tokens []string, hyperMe
 
 		data, err = json.Marshal(hyperMessage)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	hyper := api.Hyper{
+	hyper := &api.Hyper{
 		HyperName: hyperName,
 		Data:      data,
 	}
@@ -230,7 +405,167 @@ func (client *Client) HyperWithTokens(hyperName string, tokens []string, hyperMe
 		hyper.Tokens = tokens
 	}
 
-	resp, err := client.sendCommand(api.CmdHyper, &hyper)
+	return hyper, nil
+}
+
+// Stats wraps the api.Stats payload, returning the I/O statistics of the VM
+// containerID, or of all the VMs when containerID is empty.
+//
+// See the api.Stats and api.StatsResponse payloads.
+func (client *Client) Stats(containerID string) (*api.StatsResponse, error) {
+	payload := api.Stats{
+		ContainerID: containerID,
+	}
+
+	resp, err := client.sendCommand(api.CmdStats, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	decoded := api.StatsResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return &decoded, err
+}
+
+// Capture wraps the api.Capture payload, starting or stopping the capture of
+// the I/O traffic of the VM containerID. It returns the path of the capture
+// file.
+//
+// See the api.Capture and api.CaptureResponse payloads.
+func (client *Client) Capture(containerID string, enable bool) (string, error) {
+	payload := api.Capture{
+		ContainerID: containerID,
+		Enable:      enable,
+	}
+
+	resp, err := client.sendCommand(api.CmdCapture, &payload)
+	if err != nil {
+		return "", err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return "", err
+	}
+
+	decoded := api.CaptureResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return decoded.Path, err
+}
+
+// Pause wraps the api.Pause payload, quiescing the I/O relay of the VM
+// containerID.
+//
+// See the api.Pause payload description for more details.
+func (client *Client) Pause(containerID string) error {
+	payload := api.Pause{
+		ContainerID: containerID,
+	}
+
+	resp, err := client.sendCommand(api.CmdPause, &payload)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// PauseVM is a Pause variant also stopping the vCPUs of the VM containerID,
+// registered with a QMP socket.
+func (client *Client) PauseVM(containerID string) error {
+	payload := api.Pause{
+		ContainerID: containerID,
+		VM:          true,
+	}
+
+	resp, err := client.sendCommand(api.CmdPause, &payload)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// Hotplug wraps the api.Hotplug payload, adding cpus vCPUs and memoryMB MiB of
+// memory to the VM containerID. It returns once the guest has onlined them.
+//
+// See the api.Hotplug and api.HotplugResponse payloads.
+func (client *Client) Hotplug(containerID string, cpus, memoryMB int) (*api.HotplugResponse, error) {
+	payload := api.Hotplug{
+		ContainerID: containerID,
+		CPUs:        cpus,
+		MemoryMB:    memoryMB,
+	}
+
+	resp, err := client.sendCommand(api.CmdHotplug, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	decoded := api.HotplugResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return &decoded, err
+}
+
+// WriteFile wraps the api.WriteFile payload, writing data to the file path of
+// container, in the VM the client is attached to.
+//
+// See the api.WriteFile payload description for more details.
+func (client *Client) WriteFile(container, path string, data []byte) error {
+	payload := api.WriteFile{
+		Container: container,
+		Path:      path,
+		Data:      data,
+	}
+
+	resp, err := client.sendCommand(api.CmdWriteFile, &payload)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// ReadFile wraps the api.ReadFile payload, returning the content of the file
+// path of container, in the VM the client is attached to.
+//
+// See the api.ReadFile and api.ReadFileResponse payloads.
+func (client *Client) ReadFile(container, path string) ([]byte, error) {
+	payload := api.ReadFile{
+		Container: container,
+		Path:      path,
+	}
+
+	resp, err := client.sendCommand(api.CmdReadFile, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	decoded := api.ReadFileResponse{}
+	err = unmarshalResponse(resp, &decoded)
+	return decoded.Data, err
+}
+
+// Resume wraps the api.Resume payload.
+//
+// See the api.Resume payload description for more details.
+func (client *Client) Resume(containerID string) error {
+	payload := api.Resume{
+		ContainerID: containerID,
+	}
+
+	resp, err := client.sendCommand(api.CmdResume, &payload)
 	if err != nil {
 		return err
 	}
@@ -269,20 +604,39 @@ func (client *Client) ConnectShim(token string) error {
 	return errorFromResponse(resp)
 }
 
+// ConnectShimTerminal is a ConnectShim variant declaring whether the shim has
+// set up a terminal for the process. The proxy then refuses to start the
+// process in the other mode.
+//
+// See the api.ConnectShim payload for more details.
+func (client *Client) ConnectShimTerminal(token string, terminal bool) error {
+	payload := api.ConnectShim{
+		Token:    token,
+		Terminal: &terminal,
+	}
+
+	resp, err := client.sendCommand(api.CmdConnectShim, &payload)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
 // DisconnectShim wraps the api.CmdDisconnectShim command and associated
 // api.DisconnectShim payload.
 func (client *Client) DisconnectShim() error {
 	return client.sendCommandNoResponse(api.CmdDisconnectShim, nil)
 }
 
-func (client *Client) signal(signal syscall.Signal, columns, rows int) error {
+func (client *Client) signal(streamID int, signal syscall.Signal, columns, rows int) error {
 	payload := api.Signal{
 		SignalNumber: int(signal),
 		Columns:      columns,
 		Rows:         rows,
 	}
 
-	resp, err := client.sendCommand(api.CmdSignal, &payload)
+	resp, err := client.sendCommandFull(api.CmdSignal, streamID, &payload, true)
 	if err != nil {
 		return err
 	}
@@ -293,11 +647,265 @@ func (client *Client) signal(signal syscall.Signal, columns, rows int) error {
 // Kill wraps the api.CmdSignal command and can be used by a shim to send a
 // signal to the associated process.
 func (client *Client) Kill(signal syscall.Signal) error {
-	return client.signal(signal, 0, 0)
+	return client.signal(0, signal, 0, 0)
 }
 
 // SendTerminalSize wraps the api.CmdSignal command and can be used by a shim
 // to send a new signal to the associated process.
 func (client *Client) SendTerminalSize(columns, rows int) error {
-	return client.signal(syscall.SIGWINCH, columns, rows)
+	return client.signal(0, syscall.SIGWINCH, columns, rows)
+}
+
+// CloseStdin signals the end of the stdin stream to the proxy, which closes
+// the stdin of the process. Stdin data sent afterwards is discarded.
+func (client *Client) CloseStdin() error {
+	return api.WriteStdinEOF(client.conn, 0)
+}
+
+// ShimSession is one of the I/O sessions a shim has claimed on its
+// connection to the proxy. Multiplexing sessions on a single connection
+// spares a pod-level shim one socket per container.
+//
+// The frames related to a session carry its stream ID in their header: the
+// stdin stream frames written by the shim must have Header.StreamID set and
+// the stdout/stderr frames and notifications sent by the proxy have it set.
+type ShimSession struct {
+	client       *Client
+	streamID     int
+	chunkSize    int
+	compression  string
+	lineBuffered bool
+}
+
+// ConnectShimSession wraps the api.CmdConnectShim command, associating the
+// I/O session identified by token with streamID. streamID must be non-zero
+// and unique on this connection.
+func (client *Client) ConnectShimSession(token string, streamID int) (*ShimSession, error) {
+	return client.connectShimSession(streamID, &api.ConnectShim{
+		Token: token,
+	})
+}
+
+// ConnectShimSessionChunkSize is a ConnectShimSession variant asking for the
+// maximum payload size of the stream frames of the session. The size chosen
+// by the proxy is returned by the ChunkSize method of the session.
+//
+// See the api.ConnectShim payload for more details.
+func (client *Client) ConnectShimSessionChunkSize(token string, streamID, chunkSize int) (*ShimSession, error) {
+	return client.connectShimSession(streamID, &api.ConnectShim{
+		Token:     token,
+		ChunkSize: chunkSize,
+	})
+}
+
+// ConnectShimSessionCompression is a ConnectShimSession variant listing the
+// compression algorithms the shim can decode. The algorithm chosen by the
+// proxy is returned by the Compression method of the session and compressed
+// frames can be decoded with api.InflateFrame.
+//
+// See the api.ConnectShim payload for more details.
+func (client *Client) ConnectShimSessionCompression(token string, streamID int,
+	algorithms []string) (*ShimSession, error) {
+	return client.connectShimSession(streamID, &api.ConnectShim{
+		Token:       token,
+		Compression: algorithms,
+	})
+}
+
+// ConnectShimSessionLineBuffered is a ConnectShimSession variant choosing
+// whether the output of the session is coalesced into newline terminated
+// chunks, overriding the setting given in RegisterVM.
+//
+// See the api.ConnectShim payload for more details.
+func (client *Client) ConnectShimSessionLineBuffered(token string, streamID int,
+	lineBuffered bool) (*ShimSession, error) {
+	return client.connectShimSession(streamID, &api.ConnectShim{
+		Token:        token,
+		LineBuffered: &lineBuffered,
+	})
+}
+
+// ConnectShimReadOnly is a ConnectShimSession variant receiving a copy of
+// the output and exit status of the process associated with token, next to
+// the shim that claimed it. The returned session can't be used to send
+// stdin or signals.
+//
+// See the api.ConnectShim payload for more details.
+func (client *Client) ConnectShimReadOnly(token string, streamID int) (*ShimSession, error) {
+	return client.connectShimSession(streamID, &api.ConnectShim{
+		Token:    token,
+		ReadOnly: true,
+	})
+}
+
+func (client *Client) connectShimSession(streamID int, payload *api.ConnectShim) (*ShimSession, error) {
+	if streamID <= 0 || streamID > 0xffff {
+		return nil, fmt.Errorf("invalid stream ID %d", streamID)
+	}
+
+	resp, err := client.sendCommandFull(api.CmdConnectShim, streamID, payload, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	decoded := api.ConnectShimResponse{}
+	if err := unmarshalResponse(resp, &decoded); err != nil {
+		return nil, err
+	}
+
+	return &ShimSession{
+		client:       client,
+		streamID:     streamID,
+		chunkSize:    decoded.ChunkSize,
+		compression:  decoded.Compression,
+		lineBuffered: decoded.LineBuffered,
+	}, nil
+}
+
+// StreamID returns the stream ID of the session.
+func (session *ShimSession) StreamID() int {
+	return session.streamID
+}
+
+// ChunkSize returns the maximum payload size of the stream frames of the
+// session, 0 if the proxy didn't say.
+func (session *ShimSession) ChunkSize() int {
+	return session.chunkSize
+}
+
+// Compression returns the compression algorithm the proxy may use for the
+// output of the session, "" if the output isn't compressed.
+func (session *ShimSession) Compression() string {
+	return session.compression
+}
+
+// LineBuffered returns true if the output of the session is coalesced into
+// newline terminated chunks.
+func (session *ShimSession) LineBuffered() bool {
+	return session.lineBuffered
+}
+
+// Kill sends a signal to the process associated with the session.
+func (session *ShimSession) Kill(signal syscall.Signal) error {
+	return session.client.signal(session.streamID, signal, 0, 0)
+}
+
+// SendTerminalSize sends a new terminal size to the process associated with
+// the session.
+func (session *ShimSession) SendTerminalSize(columns, rows int) error {
+	return session.client.signal(session.streamID, syscall.SIGWINCH, columns, rows)
+}
+
+// CloseStdin closes the stdin of the process associated with the session.
+func (session *ShimSession) CloseStdin() error {
+	return api.WriteStdinEOF(session.client.conn, session.streamID)
+}
+
+// defaultStdinChunkSize is the payload size of the stdin frames written to a
+// session when the proxy hasn't given its chunk size.
+const defaultStdinChunkSize = 32 * 1024
+
+// StdinWriter writes the stdin stream of a session. It implements
+// io.ReaderFrom so io.Copy reads the source straight into the frames sent
+// to the proxy, one write per frame, rather than going through an
+// intermediate buffer.
+type StdinWriter struct {
+	conn      net.Conn
+	streamID  int
+	chunkSize int
+}
+
+// Stdin returns a writer for the stdin stream of the process associated with
+// the session. Closing it closes the stdin of the process.
+func (session *ShimSession) Stdin() *StdinWriter {
+	chunkSize := session.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultStdinChunkSize
+	}
+
+	return &StdinWriter{
+		conn:      session.client.conn,
+		streamID:  session.streamID,
+		chunkSize: chunkSize,
+	}
+}
+
+// writeChunk sends buf, whose first api.MinHeaderLength bytes are room for
+// the frame header, as a stdin frame.
+func (w *StdinWriter) writeChunk(buf []byte) error {
+	api.EncodeFrameHeader(buf, &api.FrameHeader{
+		Version:       api.Version,
+		HeaderLength:  api.MinHeaderLength,
+		Type:          api.TypeStream,
+		Opcode:        int(api.StreamStdin),
+		PayloadLength: len(buf) - api.MinHeaderLength,
+		StreamID:      w.streamID,
+	})
+
+	_, err := w.conn.Write(buf)
+	return err
+}
+
+// Write implements io.Writer, p is sent in frames of at most the chunk size
+// of the session.
+func (w *StdinWriter) Write(p []byte) (int, error) {
+	size := len(p)
+	if size > w.chunkSize {
+		size = w.chunkSize
+	}
+	buf := make([]byte, api.MinHeaderLength+size)
+
+	written := 0
+	for written < len(p) {
+		n := copy(buf[api.MinHeaderLength:], p[written:])
+		if err := w.writeChunk(buf[:api.MinHeaderLength+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// ReadFrom implements io.ReaderFrom, reading r until EOF.
+func (w *StdinWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, api.MinHeaderLength+w.chunkSize)
+
+	var written int64
+	for {
+		n, err := r.Read(buf[api.MinHeaderLength:])
+		if n > 0 {
+			if werr := w.writeChunk(buf[:api.MinHeaderLength+n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Close closes the stdin of the process.
+func (w *StdinWriter) Close() error {
+	return api.WriteStdinEOF(w.conn, w.streamID)
+}
+
+// Disconnect releases the session. Contrary to DisconnectShim, the proxy
+// doesn't close the connection, other sessions can still use it.
+func (session *ShimSession) Disconnect() error {
+	resp, err := session.client.sendCommandFull(api.CmdDisconnectShim,
+		session.streamID, nil, true)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
 }
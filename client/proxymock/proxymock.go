@@ -0,0 +1,418 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package proxymock implements an in-process fake cc-proxy, for the unit tests
+// of runtimes and shims. The fake proxy listens on a unix socket, records the
+// commands it receives and answers them with scripted responses. It also
+// hands out I/O tokens and emulates the I/O sessions shims claim with them:
+// tests write the output and exit status of a process and read the stdin the
+// shim has sent.
+package proxymock
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+)
+
+// Handler answers a command. result, if not nil, is marshalled into the JSON
+// payload of the response. A *client.Error error is sent back with its code.
+type Handler func(payload []byte) (result interface{}, err error)
+
+// Request is a command received by the fake proxy.
+type Request struct {
+	Command api.Command
+	// StreamID is the stream ID of the command frame, see
+	// client.ShimSession.
+	StreamID int
+	Payload  []byte
+}
+
+// conn is a client connection. Frames can be written from the goroutine
+// serving the connection and from the test.
+type conn struct {
+	sync.Mutex
+	net.Conn
+}
+
+func (c *conn) writeFrame(frame *api.Frame) error {
+	c.Lock()
+	defer c.Unlock()
+
+	return api.WriteFrame(c.Conn, frame)
+}
+
+// session is an I/O session, created with a token by RegisterVM or AttachVM.
+type session struct {
+	// conn and streamID are set once a shim has claimed the token.
+	conn     *conn
+	streamID int
+
+	stdin       []byte
+	stdinClosed bool
+}
+
+// Proxy is a fake proxy.
+type Proxy struct {
+	dir      string
+	path     string
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	handlers  map[api.Command]Handler
+	requests  []Request
+	conns     map[*conn]bool
+	sessions  map[string]*session
+	nextToken int
+}
+
+// New starts a fake proxy listening on a socket in a new temporary
+// directory. Close stops it.
+func New() (*Proxy, error) {
+	dir, err := ioutil.TempDir("", "proxymock")
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	p := &Proxy{
+		dir:      dir,
+		path:     path,
+		listener: l,
+		handlers: make(map[api.Command]Handler),
+		conns:    make(map[*conn]bool),
+		sessions: make(map[string]*session),
+	}
+
+	p.wg.Add(1)
+	go p.serve()
+
+	return p, nil
+}
+
+// SocketPath returns the path of the socket of the fake proxy.
+func (p *Proxy) SocketPath() string {
+	return p.path
+}
+
+// URL returns the URL of the fake proxy, as given in the io responses.
+func (p *Proxy) URL() string {
+	return "unix://" + p.path
+}
+
+// Client connects a new client to the fake proxy.
+func (p *Proxy) Client() (*goapi.Client, error) {
+	c, err := net.Dial("unix", p.path)
+	if err != nil {
+		return nil, err
+	}
+	return goapi.NewClient(c), nil
+}
+
+// Close stops the fake proxy, closing the client connections.
+func (p *Proxy) Close() {
+	p.listener.Close()
+
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	os.RemoveAll(p.dir)
+}
+
+// Handle replaces the default answer to cmd with handler. By default,
+// RegisterVM and AttachVM hand out the I/O tokens asked for, ConnectShim
+// claims a token and the other commands succeed with no result.
+func (p *Proxy) Handle(cmd api.Command, handler Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.handlers[cmd] = handler
+}
+
+// Requests returns the commands received so far, in order.
+func (p *Proxy) Requests() []Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	requests := make([]Request, len(p.requests))
+	copy(requests, p.requests)
+	return requests
+}
+
+// AllocateTokens creates n I/O sessions and returns their tokens, eg. for a
+// RegisterVM handler.
+func (p *Proxy) AllocateTokens(n int) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var tokens []string
+	for i := 0; i < n; i++ {
+		p.nextToken++
+		token := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("token-%d", p.nextToken)))
+		p.sessions[token] = &session{}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		conn := &conn{Conn: c}
+		p.mu.Lock()
+		p.conns[conn] = true
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go p.serveConn(conn)
+	}
+}
+
+func (p *Proxy) serveConn(c *conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, c)
+		p.mu.Unlock()
+		c.Close()
+	}()
+
+	for {
+		frame, err := api.ReadFrame(c)
+		if err != nil {
+			return
+		}
+
+		switch frame.Header.Type {
+		case api.TypeCommand:
+			resp := p.handleCommand(c, frame)
+			resp.Header.StreamID = frame.Header.StreamID
+			if err := c.writeFrame(resp); err != nil {
+				return
+			}
+		case api.TypeStream:
+			p.handleStdin(c, frame)
+		default:
+			return
+		}
+	}
+}
+
+func (p *Proxy) handleCommand(c *conn, frame *api.Frame) *api.Frame {
+	cmd := api.Command(frame.Header.Opcode)
+
+	p.mu.Lock()
+	p.requests = append(p.requests, Request{
+		Command:  cmd,
+		StreamID: frame.Header.StreamID,
+		Payload:  frame.Payload,
+	})
+	handler := p.handlers[cmd]
+	p.mu.Unlock()
+
+	var result interface{}
+	var err error
+	if handler != nil {
+		result, err = handler(frame.Payload)
+	} else {
+		result, err = p.defaultHandler(c, frame)
+	}
+	if err == nil {
+		var resp *api.Frame
+		resp, err = api.NewFrameJSON(api.TypeResponse, frame.Header.Opcode, result)
+		if err == nil {
+			return resp
+		}
+	}
+
+	errResp := &api.ErrorResponse{Message: err.Error()}
+	if perr, ok := err.(*goapi.Error); ok {
+		errResp.Code = perr.Code
+	}
+	resp, _ := api.NewFrameJSON(api.TypeResponse, frame.Header.Opcode, errResp)
+	resp.Header.InError = true
+	return resp
+}
+
+func (p *Proxy) defaultHandler(c *conn, frame *api.Frame) (interface{}, error) {
+	switch api.Command(frame.Header.Opcode) {
+	case api.CmdRegisterVM, api.CmdAttachVM:
+		var payload struct {
+			NumIOStreams int `json:"numIOStreams"`
+		}
+		if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+			return nil, err
+		}
+		if payload.NumIOStreams == 0 {
+			return nil, nil
+		}
+		return map[string]interface{}{
+			"io": api.IOResponse{
+				URL:    p.URL(),
+				Tokens: p.AllocateTokens(payload.NumIOStreams),
+			},
+		}, nil
+	case api.CmdConnectShim:
+		payload := api.ConnectShim{}
+		if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+			return nil, err
+		}
+		return nil, p.claimToken(c, frame.Header.StreamID, payload.Token)
+	}
+
+	return nil, nil
+}
+
+func (p *Proxy) claimToken(c *conn, streamID int, token string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.sessions[token]
+	if s == nil {
+		return fmt.Errorf("unknown token: %s", token)
+	}
+	if s.conn != nil {
+		return fmt.Errorf("token already claimed: %s", token)
+	}
+	s.conn = c
+	s.streamID = streamID
+	return nil
+}
+
+func (p *Proxy) handleStdin(c *conn, frame *api.Frame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, s := range p.sessions {
+		if s.conn != c || s.streamID != frame.Header.StreamID {
+			continue
+		}
+		s.stdin = append(s.stdin, frame.Payload...)
+		if frame.Header.EOF {
+			s.stdinClosed = true
+		}
+	}
+}
+
+// claimedSession returns the session of token, once a shim has claimed it.
+func (p *Proxy) claimedSession(token string) (*session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.sessions[token]
+	if s == nil {
+		return nil, fmt.Errorf("unknown token: %s", token)
+	}
+	if s.conn == nil {
+		return nil, fmt.Errorf("token not claimed: %s", token)
+	}
+	return s, nil
+}
+
+func (p *Proxy) sendStream(token string, stream api.Stream, data []byte) error {
+	s, err := p.claimedSession(token)
+	if err != nil {
+		return err
+	}
+
+	frame := api.NewFrame(api.TypeStream, int(stream), data)
+	frame.Header.StreamID = s.streamID
+	return s.conn.writeFrame(frame)
+}
+
+// SendStdout sends data as the stdout of the process of token to the shim
+// that has claimed it.
+func (p *Proxy) SendStdout(token string, data []byte) error {
+	return p.sendStream(token, api.StreamStdout, data)
+}
+
+// SendStderr sends data as the stderr of the process of token to the shim
+// that has claimed it.
+func (p *Proxy) SendStderr(token string, data []byte) error {
+	return p.sendStream(token, api.StreamStderr, data)
+}
+
+// SendExitStatus sends the NotificationProcessExited of the process of token
+// to the shim that has claimed it.
+func (p *Proxy) SendExitStatus(token string, status uint8) error {
+	s, err := p.claimedSession(token)
+	if err != nil {
+		return err
+	}
+
+	frame := api.NewFrame(api.TypeNotification, int(api.NotificationProcessExited),
+		[]byte{status})
+	frame.Header.StreamID = s.streamID
+	return s.conn.writeFrame(frame)
+}
+
+// Stdin returns the stdin data the shim has sent for the process of token so
+// far, and whether it has closed stdin.
+func (p *Proxy) Stdin(token string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.sessions[token]
+	if s == nil {
+		return nil, false
+	}
+	return append([]byte(nil), s.stdin...), s.stdinClosed
+}
+
+// Notify sends the notification n, with payload marshalled into JSON, to all
+// the connected clients.
+func (p *Proxy) Notify(n api.Notification, payload interface{}) error {
+	frame, err := api.NewFrameJSON(api.TypeNotification, int(n), payload)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	var conns []*conn
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		if err := c.writeFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
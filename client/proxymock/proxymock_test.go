@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxymock
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequests(t *testing.T) {
+	proxy, err := New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	client, err := proxy.Client()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	proxy.Handle(api.CmdStats, func(payload []byte) (interface{}, error) {
+		return &api.StatsResponse{
+			VMs: []api.VMStats{{ContainerID: "foo", State: api.VMStateHealthy}},
+		}, nil
+	})
+	proxy.Handle(api.CmdHyper, func(payload []byte) (interface{}, error) {
+		return nil, &goapi.Error{Code: api.ErrorCodeVMUnhealthy, Message: "unhealthy"}
+	})
+
+	_, err = client.RegisterVM("foo", "ctl", "io", nil)
+	assert.Nil(t, err)
+
+	stats, err := client.Stats("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", stats.VMs[0].ContainerID)
+
+	err = client.Hyper("ping", nil)
+	assert.Equal(t, &goapi.Error{Code: api.ErrorCodeVMUnhealthy, Message: "unhealthy"}, err)
+
+	requests := proxy.Requests()
+	assert.Equal(t, 3, len(requests))
+	assert.Equal(t, api.CmdRegisterVM, requests[0].Command)
+	register := api.RegisterVM{}
+	err = json.Unmarshal(requests[0].Payload, &register)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", register.ContainerID)
+	assert.Equal(t, api.CmdStats, requests[1].Command)
+	assert.Equal(t, api.CmdHyper, requests[2].Command)
+}
+
+func TestIOSession(t *testing.T) {
+	proxy, err := New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	runtime, err := proxy.Client()
+	assert.Nil(t, err)
+	defer runtime.Close()
+
+	ret, err := runtime.RegisterVM("foo", "ctl", "io",
+		&goapi.RegisterVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, proxy.URL(), ret.IO.URL)
+	assert.Equal(t, 1, len(ret.IO.Tokens))
+	token := ret.IO.Tokens[0]
+
+	// The token needs to be claimed to send output.
+	err = proxy.SendStdout(token, []byte("hello"))
+	assert.NotNil(t, err)
+
+	conn, err := net.Dial("unix", proxy.SocketPath())
+	assert.Nil(t, err)
+	shim := goapi.NewClient(conn)
+	defer shim.Close()
+
+	_, err = shim.ConnectShimSession("bar", 1)
+	assert.NotNil(t, err)
+	session, err := shim.ConnectShimSession(token, 1)
+	assert.Nil(t, err)
+
+	// stdin
+	stdin := session.Stdin()
+	_, err = stdin.Write([]byte("stdin"))
+	assert.Nil(t, err)
+	err = stdin.Close()
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	data, closed := proxy.Stdin(token)
+	for !closed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		data, closed = proxy.Stdin(token)
+	}
+	assert.True(t, closed)
+	assert.Equal(t, "stdin", string(data))
+
+	// stdout, stderr and exit status
+	err = proxy.SendStdout(token, []byte("stdout"))
+	assert.Nil(t, err)
+	err = proxy.SendStderr(token, []byte("stderr"))
+	assert.Nil(t, err)
+	err = proxy.SendExitStatus(token, 3)
+	assert.Nil(t, err)
+
+	frame, err := api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.StreamStdout, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, 1, frame.Header.StreamID)
+	assert.Equal(t, "stdout", string(frame.Payload))
+
+	frame, err = api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.StreamStderr, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, "stderr", string(frame.Payload))
+
+	frame, err = api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.TypeNotification, frame.Header.Type)
+	assert.Equal(t, api.NotificationProcessExited, frame.Header.Opcode)
+	assert.Equal(t, []byte{3}, frame.Payload)
+}
+
+func TestNotify(t *testing.T) {
+	proxy, err := New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	client, err := proxy.Client()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	var timeout *api.HyperTimeout
+	client.HandleNotifications(func(n api.Notification, payload []byte) {
+		assert.Equal(t, api.Notification(api.NotificationHyperTimeout), n)
+		timeout = &api.HyperTimeout{}
+		err := json.Unmarshal(payload, timeout)
+		assert.Nil(t, err)
+	})
+
+	// Make sure the connection has been accepted before notifying.
+	_, err = client.Stats("")
+	assert.Nil(t, err)
+
+	err = proxy.Notify(api.NotificationHyperTimeout, &api.HyperTimeout{
+		ContainerID: "foo",
+		HyperName:   "ping",
+	})
+	assert.Nil(t, err)
+
+	// Notifications are read while waiting for a response.
+	_, err = client.Stats("")
+	assert.Nil(t, err)
+	assert.NotNil(t, timeout)
+	if timeout != nil {
+		assert.Equal(t, "ping", timeout.HyperName)
+	}
+}
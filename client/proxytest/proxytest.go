@@ -0,0 +1,411 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxytest is a small DSL to write protocol tests, against the proxy
+// or the fake proxy of the proxymock package, that read like the exchange
+// they check:
+//
+//  c := proxytest.New(t, conn)
+//  c.Send(api.CmdRegisterVM, &api.RegisterVM{...})
+//  c.ExpectResponse(api.CmdRegisterVM).Matching(`{"version": 2}`)
+//  c.Within(time.Second).ExpectNotification(api.NotificationVMBoot)
+//
+// Frames are read in the background. An expectation waits for the first
+// frame it matches, for at most the timeout of the Conn, and fails the test
+// if none arrives. Frames read before the one matched are kept for the next
+// expectations, so notifications can be checked after the responses they
+// were interleaved with.
+package proxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// DefaultTimeout is how long expectations wait for their frame, unless
+// changed with Within.
+const DefaultTimeout = 5 * time.Second
+
+// reader reads the frames of a connection, handing them to the expectations.
+type reader struct {
+	t    testing.TB
+	conn net.Conn
+
+	frames chan *api.Frame
+	done   chan struct{}
+	// err is the error reading frames stopped on, set before frames is
+	// closed.
+	err error
+	// pending are the frames read but not matched yet.
+	pending []*api.Frame
+}
+
+// packageDir is the directory of this package, to locate the test code in
+// failures.
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// fatalf fails the test, locating the failure in the test code: testing.TB
+// has no Helper method before go 1.9.
+func (r *reader) fatalf(format string, args ...interface{}) {
+	for i := 1; ; i++ {
+		_, file, line, ok := runtime.Caller(i)
+		if !ok {
+			break
+		}
+		if filepath.Dir(file) != packageDir {
+			format = fmt.Sprintf("%s:%d: %s", filepath.Base(file), line, format)
+			break
+		}
+	}
+	r.t.Fatalf(format, args...)
+}
+
+func (r *reader) read() {
+	for {
+		frame, err := api.ReadFrame(r.conn)
+		if err != nil {
+			r.err = err
+			close(r.frames)
+			return
+		}
+		select {
+		case r.frames <- frame:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Conn is a connection to a proxy, real or fake, seen from a client.
+type Conn struct {
+	*reader
+	timeout time.Duration
+}
+
+// New starts reading the frames sent on conn. Close closes conn.
+func New(t testing.TB, conn net.Conn) *Conn {
+	r := &reader{
+		t:      t,
+		conn:   conn,
+		frames: make(chan *api.Frame, 16),
+		done:   make(chan struct{}),
+	}
+	go r.read()
+
+	return &Conn{
+		reader:  r,
+		timeout: DefaultTimeout,
+	}
+}
+
+// Within returns a Conn whose expectations wait for at most timeout. The
+// original Conn isn't changed.
+func (c *Conn) Within(timeout time.Duration) *Conn {
+	return &Conn{
+		reader:  c.reader,
+		timeout: timeout,
+	}
+}
+
+// Close closes the connection.
+func (c *Conn) Close() {
+	close(c.done)
+	c.conn.Close()
+}
+
+// SendFrame sends frame.
+func (c *Conn) SendFrame(frame *api.Frame) *Conn {
+	if err := api.WriteFrame(c.conn, frame); err != nil {
+		c.fatalf("sending %s: %v", describe(frame), err)
+	}
+	return c
+}
+
+// Send sends the command cmd. payload is sent as is if it's a []byte or a
+// string, marshalled into JSON otherwise. A nil payload sends no payload.
+func (c *Conn) Send(cmd api.Command, payload interface{}) *Conn {
+	var data []byte
+
+	switch p := payload.(type) {
+	case nil:
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			c.fatalf("sending %s: %v", cmd, err)
+		}
+	}
+
+	return c.SendFrame(api.NewFrame(api.TypeCommand, int(cmd), data))
+}
+
+// SendStdin sends data on the stdin stream of the I/O session claimed by
+// sending ConnectShim, an empty data closing it.
+func (c *Conn) SendStdin(data []byte) *Conn {
+	frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), data)
+	if len(data) == 0 {
+		frame.Header.EOF = true
+	}
+	return c.SendFrame(frame)
+}
+
+// expect returns the first frame match accepts, failing the test if none is
+// received within the timeout. what describes the frame in the failure.
+func (c *Conn) expect(what string, match func(*api.Frame) bool) *Frame {
+	for i, frame := range c.pending {
+		if match(frame) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return &Frame{Frame: frame, reader: c.reader}
+		}
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.fatalf("expected %s: %v%s", what, c.err, c.received())
+				return nil
+			}
+			if match(frame) {
+				return &Frame{Frame: frame, reader: c.reader}
+			}
+			c.pending = append(c.pending, frame)
+		case <-timer.C:
+			c.fatalf("expected %s within %s%s", what, c.timeout, c.received())
+			return nil
+		}
+	}
+}
+
+// received lists the frames received but not matched, for failures.
+func (c *Conn) received() string {
+	if len(c.pending) == 0 {
+		return ", received nothing"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(", received:")
+	for _, frame := range c.pending {
+		fmt.Fprintf(&buf, "\n  %s", describe(frame))
+	}
+	return buf.String()
+}
+
+func (c *Conn) expectResponse(cmd api.Command, inError bool) *Frame {
+	what := fmt.Sprintf("response to %s", cmd)
+	if inError {
+		what = fmt.Sprintf("error response to %s", cmd)
+	}
+
+	frame := c.expect(what, func(frame *api.Frame) bool {
+		return frame.Header.Type == api.TypeResponse &&
+			frame.Header.Opcode == int(cmd)
+	})
+	if frame != nil && frame.Header.InError != inError {
+		c.fatalf("expected %s, got %s", what, describe(frame.Frame))
+	}
+	return frame
+}
+
+// ExpectResponse waits for the response to cmd, failing the test if it's an
+// error.
+func (c *Conn) ExpectResponse(cmd api.Command) *Frame {
+	return c.expectResponse(cmd, false)
+}
+
+// ExpectError waits for the response to cmd, failing the test if it isn't an
+// error.
+func (c *Conn) ExpectError(cmd api.Command) *Frame {
+	return c.expectResponse(cmd, true)
+}
+
+// ExpectNotification waits for the notification n.
+func (c *Conn) ExpectNotification(n api.Notification) *Frame {
+	return c.expect(fmt.Sprintf("notification %s", n), func(frame *api.Frame) bool {
+		return frame.Header.Type == api.TypeNotification &&
+			frame.Header.Opcode == int(n)
+	})
+}
+
+// ExpectStream waits for a frame of the stream s.
+func (c *Conn) ExpectStream(s api.Stream) *Frame {
+	return c.expect(fmt.Sprintf("%s stream", s), func(frame *api.Frame) bool {
+		return frame.Header.Type == api.TypeStream &&
+			frame.Header.Opcode == int(s)
+	})
+}
+
+// ExpectNoFrame fails the test if a frame is received within the timeout, or
+// has been received and not matched by an expectation.
+func (c *Conn) ExpectNoFrame() {
+	if len(c.pending) > 0 {
+		c.fatalf("expected no frame%s", c.received())
+		return
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case frame, ok := <-c.frames:
+		if ok {
+			c.fatalf("expected no frame, received %s", describe(frame))
+		}
+	case <-timer.C:
+	}
+}
+
+// ExpectClosed fails the test if the connection isn't closed within the
+// timeout, or a frame is received before it is.
+func (c *Conn) ExpectClosed() {
+	if len(c.pending) > 0 {
+		c.fatalf("expected the connection to be closed%s", c.received())
+		return
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case frame, ok := <-c.frames:
+		if ok {
+			c.fatalf("expected the connection to be closed, received %s",
+				describe(frame))
+		}
+	case <-timer.C:
+		c.fatalf("expected the connection to be closed within %s", c.timeout)
+	}
+}
+
+// Frame is a frame matched by an expectation, whose payload can be checked
+// further.
+type Frame struct {
+	*api.Frame
+	*reader
+}
+
+// WithPayload fails the test if the payload of the frame isn't payload.
+func (f *Frame) WithPayload(payload []byte) *Frame {
+	if !bytes.Equal(f.Payload, payload) {
+		f.fatalf("expected payload %q, got %s", payload, describe(f.Frame))
+	}
+	return f
+}
+
+// Matching fails the test if the JSON payload of the frame doesn't match
+// expected: the objects of expected need to be in the payload, with their
+// fields matching, but the payload can have more fields. Other values,
+// including arrays, need to be equal.
+func (f *Frame) Matching(expected string) *Frame {
+	var want, got interface{}
+
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		f.fatalf("invalid expected payload %s: %v", expected, err)
+		return f
+	}
+	if err := json.Unmarshal(f.Payload, &got); err != nil {
+		f.fatalf("expected payload matching %s: %v, got %s", expected, err,
+			describe(f.Frame))
+		return f
+	}
+
+	if err := match("payload", want, got); err != nil {
+		f.fatalf("expected payload matching %s: %v, got %s", expected, err,
+			describe(f.Frame))
+	}
+	return f
+}
+
+// Decode unmarshals the JSON payload of the frame into v.
+func (f *Frame) Decode(v interface{}) *Frame {
+	if err := json.Unmarshal(f.Payload, v); err != nil {
+		f.fatalf("decoding %s: %v", describe(f.Frame), err)
+	}
+	return f
+}
+
+// match returns an error if got doesn't match want, see Frame.Matching. path
+// locates the values in the payload.
+func match(path string, want, got interface{}) error {
+	wantObject, ok := want.(map[string]interface{})
+	if !ok {
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("%s is %s, expected %s", path, marshal(got),
+				marshal(want))
+		}
+		return nil
+	}
+
+	gotObject, ok := got.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s is %s, expected an object", path, marshal(got))
+	}
+	for key, value := range wantObject {
+		field, ok := gotObject[key]
+		if !ok {
+			return fmt.Errorf("%s.%s is missing", path, key)
+		}
+		if err := match(path+"."+key, value, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func marshal(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// describe returns a one line description of frame.
+func describe(frame *api.Frame) string {
+	header := &frame.Header
+	op := fmt.Sprintf("%d", header.Opcode)
+	switch header.Type {
+	case api.TypeCommand, api.TypeResponse:
+		op = api.Command(header.Opcode).String()
+	case api.TypeStream:
+		op = api.Stream(header.Opcode).String()
+	case api.TypeNotification:
+		op = api.Notification(header.Opcode).String()
+	}
+
+	s := fmt.Sprintf("%s %s", header.Type, op)
+	if header.InError {
+		s += " (error)"
+	}
+	if len(frame.Payload) > 0 {
+		s += fmt.Sprintf(" %q", frame.Payload)
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/clearcontainers/proxy/client/proxymock"
+	"github.com/stretchr/testify/assert"
+)
+
+func dial(t *testing.T, proxy *proxymock.Proxy) net.Conn {
+	conn, err := net.Dial("unix", proxy.SocketPath())
+	assert.Nil(t, err)
+	return conn
+}
+
+func TestSession(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	runtime := New(t, dial(t, proxy))
+	defer runtime.Close()
+
+	resp := api.RegisterVMResponse{}
+	runtime.Send(api.CmdRegisterVM, &api.RegisterVM{
+		ContainerID:  "foo",
+		NumIOStreams: 1,
+	})
+	runtime.ExpectResponse(api.CmdRegisterVM).
+		Matching(`{"io": {"URL": "` + proxy.URL() + `"}}`).
+		Decode(&resp)
+	token := resp.IO.Tokens[0]
+
+	shim := New(t, dial(t, proxy))
+	defer shim.Close()
+
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: token})
+	shim.ExpectResponse(api.CmdConnectShim)
+
+	assert.Nil(t, proxy.SendStdout(token, []byte("stdout")))
+	shim.ExpectStream(api.StreamStdout).WithPayload([]byte("stdout"))
+
+	shim.SendStdin([]byte("stdin"))
+	shim.SendStdin(nil)
+	// Stdin is handled before the next command.
+	shim.Send(api.CmdSignal, &api.Signal{SignalNumber: 15})
+	shim.ExpectResponse(api.CmdSignal)
+	stdin, closed := proxy.Stdin(token)
+	assert.Equal(t, "stdin", string(stdin))
+	assert.True(t, closed)
+
+	assert.Nil(t, proxy.SendExitStatus(token, 3))
+	shim.ExpectNotification(api.NotificationProcessExited).WithPayload([]byte{3})
+	shim.Within(10 * time.Millisecond).ExpectNoFrame()
+}
+
+func TestInterleavedNotification(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	c := New(t, dial(t, proxy))
+	defer c.Close()
+
+	// Make sure the connection has been accepted before notifying.
+	c.Send(api.CmdStats, nil)
+	c.ExpectResponse(api.CmdStats)
+
+	assert.Nil(t, proxy.Notify(api.NotificationHyperTimeout, &api.HyperTimeout{
+		ContainerID: "foo",
+		HyperName:   "ping",
+	}))
+	c.Send(api.CmdStats, nil)
+
+	// The notification, read first, is kept for the next expectation.
+	c.ExpectResponse(api.CmdStats)
+	c.ExpectNotification(api.NotificationHyperTimeout).
+		Matching(`{"hyperName": "ping"}`)
+}
+
+func TestExpectError(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	proxy.Handle(api.CmdHyper, func(payload []byte) (interface{}, error) {
+		return nil, &goapi.Error{Code: api.ErrorCodeVMUnhealthy, Message: "unhealthy"}
+	})
+
+	c := New(t, dial(t, proxy))
+	defer c.Close()
+
+	c.Send(api.CmdHyper, `{"hyperName": "ping"}`)
+	c.ExpectError(api.CmdHyper).Matching(fmt.Sprintf(`{"msg": "unhealthy", "code": %d}`,
+		api.ErrorCodeVMUnhealthy))
+}
+
+// recorder records the failures of the tests of the DSL itself.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestFailures(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	r := &recorder{TB: t}
+	c := New(r, dial(t, proxy)).Within(10 * time.Millisecond)
+	defer c.Close()
+
+	c.ExpectNotification(api.NotificationVMBoot)
+	c.Send(api.CmdStats, nil)
+	c.ExpectError(api.CmdStats)
+	c.Send(api.CmdStats, nil)
+	c.ExpectResponse(api.CmdStats).Matching(`{"vms": []}`)
+	c.Send(api.CmdStats, nil)
+	c.ExpectNoFrame()
+
+	assert.Equal(t, 4, len(r.failures))
+	if len(r.failures) != 4 {
+		return
+	}
+	assert.True(t, strings.HasSuffix(r.failures[0],
+		"expected notification VMBoot within 10ms, received nothing"), r.failures[0])
+	assert.True(t, strings.HasSuffix(r.failures[1],
+		"expected error response to Stats, got response Stats"), r.failures[1])
+	assert.True(t, strings.HasSuffix(r.failures[2],
+		"expected payload matching {\"vms\": []}: unexpected end of JSON input, got response Stats"),
+		r.failures[2])
+	assert.True(t, strings.HasSuffix(r.failures[3],
+		"expected no frame, received response Stats"), r.failures[3])
+}
+
+func TestMatch(t *testing.T) {
+	got := map[string]interface{}{
+		"id":   "foo",
+		"io":   map[string]interface{}{"tokens": []interface{}{"a", "b"}},
+		"code": 1.0,
+	}
+
+	tests := []struct {
+		want interface{}
+		err  string
+	}{
+		{map[string]interface{}{}, ""},
+		{map[string]interface{}{"id": "foo"}, ""},
+		{map[string]interface{}{"io": map[string]interface{}{}}, ""},
+		{map[string]interface{}{"io": map[string]interface{}{
+			"tokens": []interface{}{"a", "b"}}}, ""},
+		{map[string]interface{}{"id": "bar"},
+			`payload.id is "foo", expected "bar"`},
+		{map[string]interface{}{"missing": "bar"}, "payload.missing is missing"},
+		{map[string]interface{}{"io": map[string]interface{}{
+			"tokens": []interface{}{"a"}}},
+			`payload.io.tokens is ["a","b"], expected ["a"]`},
+		{map[string]interface{}{"id": map[string]interface{}{}},
+			`payload.id is "foo", expected an object`},
+		{"foo", `payload is {"code":1,"id":"foo","io":{"tokens":["a","b"]}}, expected "foo"`},
+	}
+
+	for _, test := range tests {
+		err := match("payload", test.want, got)
+		if test.err == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		if assert.NotNil(t, err) {
+			assert.Equal(t, test.err, err.Error())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MetricsCollector receives the metrics of the proxy and makes them available
+// to a monitoring system.
+type MetricsCollector interface {
+	// Start is called once the proxy is set up, with the proxy whose VMs
+	// the collector can query.
+	Start(proxy *proxy) error
+	// ObserveCommand records that command, sent by a client about the
+	// container containerID, took d and failed with err, if not nil.
+	// containerID is only given when metricsContainerLabels is set and
+	// can be empty.
+	ObserveCommand(command, containerID string, d time.Duration, err error)
+	// ObserveHyperCommand records that the hyper command name took d to
+	// be answered by hyperstart and failed with err, if not nil.
+	ObserveHyperCommand(name string, d time.Duration, err error)
+	// Stop is called when the proxy exits, for the collector to flush
+	// the metrics it still holds.
+	Stop()
+}
+
+// metricsCollectors are the collectors that can be selected with
+// metricsCollectorName, indexed by name.
+var metricsCollectors = map[string]func() (MetricsCollector, error){
+	"prometheus": newPrometheusCollector,
+	"statsd":     newStatsdCollector,
+	"none":       newNopCollector,
+}
+
+// registerMetricsCollector makes the collector created by newCollector
+// available under name.
+func registerMetricsCollector(name string, newCollector func() (MetricsCollector, error)) {
+	metricsCollectors[name] = newCollector
+}
+
+// metricsCollectorName is the name of the collector the metrics go to.
+var metricsCollectorName = "prometheus"
+
+// collector is the metrics collector in use.
+var collector MetricsCollector = &prometheusCollector{}
+
+func validMetricsCollector(name string) error {
+	if _, ok := metricsCollectors[name]; ok {
+		return nil
+	}
+
+	names := make([]string, 0, len(metricsCollectors))
+	for n := range metricsCollectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("unknown collector '%s', expected one of %s", name,
+		strings.Join(names, ", "))
+}
+
+// setupMetricsCollector selects the metrics collector from its name.
+func setupMetricsCollector(name string) error {
+	if err := validMetricsCollector(name); err != nil {
+		return err
+	}
+
+	c, err := metricsCollectors[name]()
+	if err != nil {
+		return err
+	}
+	collector = c
+
+	return nil
+}
+
+// nopCollector drops the metrics.
+type nopCollector struct{}
+
+func newNopCollector() (MetricsCollector, error) {
+	return nopCollector{}, nil
+}
+
+func (nopCollector) Start(proxy *proxy) error {
+	return nil
+}
+
+func (nopCollector) ObserveCommand(command, containerID string, d time.Duration, err error) {
+}
+
+func (nopCollector) ObserveHyperCommand(name string, d time.Duration, err error) {
+}
+
+func (nopCollector) Stop() {
+}
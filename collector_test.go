@@ -0,0 +1,39 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupMetricsCollector(t *testing.T) {
+	saved := collector
+	defer func() {
+		collector = saved
+		delete(metricsCollectors, "test")
+	}()
+
+	assert.Nil(t, setupMetricsCollector("none"))
+	assert.Equal(t, nopCollector{}, collector)
+
+	err := setupMetricsCollector("graphite")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "none, prometheus, statsd")
+
+	registerMetricsCollector("test", newNopCollector)
+	assert.Nil(t, setupMetricsCollector("test"))
+}
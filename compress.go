@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// compressionThreshold is the output throughput, in bytes per second, from
+// which the output of the sessions that have negotiated compression is
+// compressed. 0 compresses all their output.
+var compressionThreshold = 1024 * 1024
+
+// compressionWindow is the period the output throughput is measured over.
+const compressionWindow = time.Second
+
+// negotiateCompression returns the compression algorithm to use with a shim
+// supporting the given algorithms, "" for none.
+func negotiateCompression(algorithms []string) string {
+	for _, algorithm := range algorithms {
+		if algorithm == api.CompressionDeflate {
+			return algorithm
+		}
+	}
+
+	return ""
+}
+
+// streamCompressor compresses the output of a stream while its throughput is
+// above compressionThreshold. It's only used by the goroutine reading the io
+// channel.
+type streamCompressor struct {
+	// windowStart and windowBytes measure the throughput of the current
+	// window.
+	windowStart time.Time
+	windowBytes int
+	// compressing is true when the throughput of the previous window
+	// was above the threshold.
+	compressing bool
+
+	// writer is only allocated once the stream needs compression, it
+	// isn't small.
+	writer *flate.Writer
+	buf    bytes.Buffer
+}
+
+// observe records n bytes of output at now and returns whether they should
+// be compressed.
+func (c *streamCompressor) observe(now time.Time, n int) bool {
+	if compressionThreshold == 0 {
+		return true
+	}
+
+	if elapsed := now.Sub(c.windowStart); elapsed >= compressionWindow {
+		c.compressing = elapsed < 2*compressionWindow &&
+			c.windowBytes >= compressionThreshold
+		c.windowStart = now
+		c.windowBytes = 0
+	}
+	c.windowBytes += n
+
+	return c.compressing || c.windowBytes >= compressionThreshold
+}
+
+// compress returns a copy of buf, as returned by splitOutput, with its
+// payload compressed. It returns nil when compressing doesn't make the
+// payload smaller.
+func (c *streamCompressor) compress(buf []byte) []byte {
+	data := buf[api.MinHeaderLength:]
+
+	c.buf.Reset()
+	if c.writer == nil {
+		c.writer, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	} else {
+		c.writer.Reset(&c.buf)
+	}
+
+	if _, err := c.writer.Write(data); err != nil {
+		return nil
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil
+	}
+
+	if c.buf.Len() >= len(data) {
+		return nil
+	}
+
+	compressed := getBuffer(api.MinHeaderLength + c.buf.Len())
+	copy(compressed[api.MinHeaderLength:], c.buf.Bytes())
+
+	return compressed
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	assert.Equal(t, "", negotiateCompression(nil))
+	assert.Equal(t, "", negotiateCompression([]string{"zstd"}))
+	assert.Equal(t, api.CompressionDeflate,
+		negotiateCompression([]string{"zstd", api.CompressionDeflate}))
+}
+
+func TestStreamCompressorThreshold(t *testing.T) {
+	oldThreshold := compressionThreshold
+	defer func() {
+		compressionThreshold = oldThreshold
+	}()
+	compressionThreshold = 1000
+
+	c := &streamCompressor{}
+	now := time.Now()
+
+	// Below the threshold.
+	assert.False(t, c.observe(now, 500))
+	// Compressing as soon as the threshold is reached and for the next
+	// window.
+	assert.True(t, c.observe(now.Add(100*time.Millisecond), 500))
+	assert.True(t, c.observe(now.Add(1100*time.Millisecond), 10))
+	// The throughput has dropped in the previous window.
+	assert.False(t, c.observe(now.Add(2200*time.Millisecond), 10))
+	// After an idle period.
+	assert.False(t, c.observe(now.Add(10*time.Second), 10))
+
+	compressionThreshold = 0
+	assert.True(t, c.observe(now.Add(10*time.Second), 10))
+}
+
+func TestStreamCompressorCompress(t *testing.T) {
+	c := &streamCompressor{}
+
+	data := bytes.Repeat([]byte("log line\n"), 100)
+	buf := make([]byte, api.MinHeaderLength+len(data))
+	copy(buf[api.MinHeaderLength:], data)
+
+	for i := 0; i < 2; i++ {
+		compressed := c.compress(buf)
+		assert.NotNil(t, compressed)
+		assert.True(t, len(compressed) < len(buf))
+
+		frame := api.NewFrame(api.TypeStream, int(api.StreamStdout),
+			compressed[api.MinHeaderLength:])
+		frame.Header.Compressed = true
+		err := api.InflateFrame(frame)
+		assert.Nil(t, err)
+		assert.Equal(t, data, frame.Payload)
+		putBuffer(compressed)
+	}
+
+	// Payloads that don't compress are sent as is.
+	assert.Nil(t, c.compress(buf[:api.MinHeaderLength+1]))
+}
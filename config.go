@@ -0,0 +1,596 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// duration is a time.Duration that can be (un)marshalled to and from JSON
+// strings such as "1m30s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings, eg. \"30s\": %v", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+// config is the content of the proxy configuration file, a JSON object:
+//
+//	{
+//	  "hyperTimeout": "30s",
+//	  "hyperTimeouts": {
+//	    "ping": "5s",
+//	    "newcontainer": "5m"
+//	  }
+//	}
+//
+// Fields absent from the configuration file keep their default value.
+// Command line options take precedence over the configuration file.
+type config struct {
+	// HyperTimeout is how long to wait for hyperstart to answer a
+	// command, unless overridden for this command in HyperTimeouts.
+	HyperTimeout duration `json:"hyperTimeout"`
+	// HyperTimeoutUnhealthy marks VMs as unhealthy when a command times
+	// out.
+	HyperTimeoutUnhealthy bool `json:"hyperTimeoutUnhealthy"`
+	// HyperTimeouts are per hyperstart command timeouts, indexed by
+	// command name.
+	HyperTimeouts map[string]duration `json:"hyperTimeouts,omitempty"`
+	// HyperReconnectRetries is the number of attempts at re-opening the
+	// hyperstart serial channels after an error. 0 disables reconnection.
+	HyperReconnectRetries int `json:"hyperReconnectRetries"`
+	// HyperReconnectDelay is the delay before the first reconnection
+	// attempt, doubled after each failed attempt.
+	HyperReconnectDelay duration `json:"hyperReconnectDelay"`
+	// HyperRetries is the number of times an idempotent hyper command
+	// is retried after a failure.
+	HyperRetries int `json:"hyperRetries"`
+	// HyperWriteRetries is the number of times a hyper command is
+	// retried after it couldn't be written to the ctl channel.
+	HyperWriteRetries int `json:"hyperWriteRetries"`
+	// HyperRetryDelay is the delay before the first retry of a hyper
+	// command, doubled after each attempt.
+	HyperRetryDelay duration `json:"hyperRetryDelay"`
+	// HyperPolicy restricts the hyper commands clients can send, see
+	// hyperRule.
+	HyperPolicy []hyperRule `json:"hyperPolicy,omitempty"`
+	// SELinuxPolicy restricts the commands clients can send according to
+	// their SELinux type, see selinuxRule.
+	SELinuxPolicy []selinuxRule `json:"selinuxPolicy,omitempty"`
+	// AuthPolicyFile is a JSON file restricting the commands clients can
+	// send, see authRule.
+	AuthPolicyFile string `json:"authPolicyFile"`
+	// RedactPatterns are the patterns of the names of the environment
+	// variables and payload fields redacted from the logs and
+	// recordings, see redactPatterns.
+	RedactPatterns []string `json:"redactPatterns"`
+	// SpliceIO relays process output to the shims with splice(2) when
+	// possible.
+	SpliceIO bool `json:"spliceIO"`
+	// IOSessionBufferSize is the maximum amount of output, in bytes,
+	// buffered for a client not reading it fast enough.
+	IOSessionBufferSize int `json:"ioSessionBufferSize"`
+	// StdinBufferSize is the maximum amount of stdin data, in bytes,
+	// buffered for a process.
+	StdinBufferSize int `json:"stdinBufferSize"`
+	// ObserverBufferSize is the maximum amount of output, in bytes,
+	// buffered for an observer before its output is dropped.
+	ObserverBufferSize int `json:"observerBufferSize"`
+	// VMBufferLimit is the maximum amount of data, in bytes, buffered in
+	// all the I/O queues of a VM. 0 disables the limit.
+	VMBufferLimit int `json:"vmBufferLimit"`
+	// OutputRateLimit is the default rate limit, in bytes per second, of
+	// each stdout and stderr stream. 0 disables rate limiting.
+	OutputRateLimit int `json:"outputRateLimit"`
+	// OutputRateBurst is the default burst size, in bytes, of rate
+	// limited streams.
+	OutputRateBurst int `json:"outputRateBurst"`
+	// CaptureDir is where I/O capture files are written.
+	CaptureDir string `json:"captureDir"`
+	// ConsoleDir is where the VM console output is written.
+	ConsoleDir string `json:"consoleDir"`
+	// RecordDir is where the sessions of the clients are recorded. Empty
+	// disables recording.
+	RecordDir string `json:"recordDir"`
+	// FaultInjection makes the proxy drop, delay, duplicate or corrupt
+	// frames and hyperstart commands, to test how clients cope. Only for
+	// testing.
+	FaultInjection *faultConfig `json:"faultInjection,omitempty"`
+	// DebugSocket is the unix socket the debug console listens on. Empty
+	// disables the console.
+	DebugSocket string `json:"debugSocket"`
+	// RelayEngine is how process output is written to the clients:
+	// "goroutine" or "epoll".
+	RelayEngine string `json:"relayEngine"`
+	// StreamChunkSize is the default maximum payload size, in bytes, of
+	// the stream frames exchanged with the shims.
+	StreamChunkSize int `json:"streamChunkSize"`
+	// CompressionThreshold is the output throughput, in bytes per
+	// second, from which the output of the shims supporting it is
+	// compressed.
+	CompressionThreshold int `json:"compressionThreshold"`
+	// IdleTimeout is how long a process can go without I/O, while
+	// hyperstart doesn't answer pings either, before a ProcessIdle
+	// notification is sent. 0 disables idle detection.
+	IdleTimeout duration `json:"idleTimeout"`
+	// PingInterval is how often hyperstart is pinged to check it's
+	// alive. 0 disables liveness probing.
+	PingInterval duration `json:"pingInterval"`
+	// PingMisses is the number of pings in a row hyperstart can miss
+	// before being declared unresponsive.
+	PingMisses int `json:"pingMisses"`
+	// VMLostGracePeriod is how long a VM stays registered once its
+	// hyperstart channels are gone for good.
+	VMLostGracePeriod duration `json:"vmLostGracePeriod"`
+	// TokenValidity is how long after being issued an I/O token can be
+	// used. 0 means tokens don't expire.
+	TokenValidity duration `json:"tokenValidity"`
+	// MaxFrameRate is the number of frames per second a client can send
+	// before being disconnected. 0 disables the limit.
+	MaxFrameRate int `json:"maxFrameRate"`
+	// MaxInFlight is the number of asynchronous hyper commands a client
+	// can have in flight before being disconnected. 0 disables the
+	// limit.
+	MaxInFlight int `json:"maxInFlight"`
+	// MaxQueuedBytes is the amount of data, in bytes, queued for the I/O
+	// sessions of a client from which it's disconnected. 0 disables the
+	// limit.
+	MaxQueuedBytes int `json:"maxQueuedBytes"`
+	// MaxConnsPerUID is the number of connections the processes of a
+	// user, or the remote clients with a TLS identity, can have open at
+	// once. 0 disables the limit.
+	MaxConnsPerUID int `json:"maxConnsPerUID"`
+	// Landlock restricts the filesystem accesses of the proxy to the
+	// directories it uses and to LandlockPaths.
+	Landlock bool `json:"landlock"`
+	// LandlockPaths are additional paths the proxy can access when
+	// Landlock is set.
+	LandlockPaths []string `json:"landlockPaths,omitempty"`
+	// AuditTarget is where audit events are exported: a file://, udp://,
+	// tcp:// or unix:// URL. Empty only logs them.
+	AuditTarget string `json:"auditTarget"`
+	// AuditFormat is the format of the exported audit events: json, cef
+	// or syslog.
+	AuditFormat string `json:"auditFormat"`
+	// MetricsContainerLabels is the number of containers for which
+	// metrics labelled with their container ID are kept. 0 disables
+	// those metrics.
+	MetricsContainerLabels int `json:"metricsContainerLabels"`
+	// MetricsCollector is where the metrics go: prometheus, statsd or
+	// none.
+	MetricsCollector string `json:"metricsCollector"`
+	// StatsdAddress is the host:port of the statsd server the metrics
+	// are sent to with the statsd collector.
+	StatsdAddress string `json:"statsdAddress"`
+	// StatsdPrefix is prepended to the names of the statsd metrics.
+	StatsdPrefix string `json:"statsdPrefix"`
+	// StatsdInterval is how often metrics are sent to the statsd server.
+	StatsdInterval duration `json:"statsdInterval"`
+}
+
+// newConfig returns a configuration holding the current settings.
+func newConfig() *config {
+	c := &config{
+		HyperTimeout:           duration(hyperTimeout),
+		HyperTimeoutUnhealthy:  hyperTimeoutUnhealthy,
+		HyperTimeouts:          make(map[string]duration),
+		HyperReconnectRetries:  hyperReconnectRetries,
+		HyperReconnectDelay:    duration(hyperReconnectDelay),
+		HyperRetries:           hyperRetries,
+		HyperWriteRetries:      hyperWriteRetries,
+		HyperRetryDelay:        duration(hyperRetryDelay),
+		AuthPolicyFile:         authPolicyFile,
+		SpliceIO:               spliceIO,
+		IOSessionBufferSize:    ioSessionBufferSize,
+		StdinBufferSize:        stdinBufferSize,
+		ObserverBufferSize:     observerBufferSize,
+		VMBufferLimit:          vmBufferLimit,
+		OutputRateLimit:        outputRateLimit,
+		OutputRateBurst:        outputRateBurst,
+		CaptureDir:             captureDir,
+		ConsoleDir:             consoleDir,
+		RecordDir:              recordDir,
+		FaultInjection:         faultInjection,
+		DebugSocket:            debugSocketPath,
+		RelayEngine:            relayEngine,
+		StreamChunkSize:        streamChunkSize,
+		CompressionThreshold:   compressionThreshold,
+		IdleTimeout:            duration(idleTimeout),
+		PingInterval:           duration(pingInterval),
+		PingMisses:             pingMisses,
+		VMLostGracePeriod:      duration(vmLostGracePeriod),
+		TokenValidity:          duration(tokenValidity),
+		MaxFrameRate:           maxFrameRate,
+		MaxInFlight:            maxInFlight,
+		MaxQueuedBytes:         maxQueuedBytes,
+		MaxConnsPerUID:         maxConnsPerUID,
+		Landlock:               landlock,
+		AuditTarget:            auditTarget,
+		AuditFormat:            auditFormat,
+		MetricsContainerLabels: metricsContainerLabels,
+		MetricsCollector:       metricsCollectorName,
+		StatsdAddress:          statsdAddress,
+		StatsdPrefix:           statsdPrefix,
+		StatsdInterval:         duration(statsdInterval),
+	}
+
+	for name, timeout := range hyperTimeouts {
+		c.HyperTimeouts[name] = duration(timeout)
+	}
+
+	c.HyperPolicy = append(c.HyperPolicy, hyperPolicy...)
+	c.SELinuxPolicy = append(c.SELinuxPolicy, selinuxPolicy...)
+	c.LandlockPaths = append(c.LandlockPaths, landlockPaths...)
+	c.RedactPatterns = append([]string{}, redactPatterns...)
+
+	return c
+}
+
+// loadConfig parses and validates the configuration file at path.
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %v", err)
+	}
+
+	c := newConfig()
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file %s: %v", path, err)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *config) validate() error {
+	if c.HyperTimeout < 0 {
+		return fmt.Errorf("hyperTimeout: negative duration %s",
+			time.Duration(c.HyperTimeout))
+	}
+
+	for name, timeout := range c.HyperTimeouts {
+		if _, ok := hyperstart.CodeList[name]; !ok {
+			return fmt.Errorf("hyperTimeouts: unknown hyper command '%s'", name)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("hyperTimeouts: negative duration %s for %s",
+				time.Duration(timeout), name)
+		}
+	}
+
+	if c.HyperReconnectRetries < 0 {
+		return fmt.Errorf("hyperReconnectRetries: negative value %d",
+			c.HyperReconnectRetries)
+	}
+
+	if c.HyperReconnectDelay < 0 {
+		return fmt.Errorf("hyperReconnectDelay: negative duration %s",
+			time.Duration(c.HyperReconnectDelay))
+	}
+
+	if c.HyperRetries < 0 {
+		return fmt.Errorf("hyperRetries: negative value %d", c.HyperRetries)
+	}
+
+	if c.HyperWriteRetries < 0 {
+		return fmt.Errorf("hyperWriteRetries: negative value %d",
+			c.HyperWriteRetries)
+	}
+
+	if c.HyperRetryDelay < 0 {
+		return fmt.Errorf("hyperRetryDelay: negative duration %s",
+			time.Duration(c.HyperRetryDelay))
+	}
+
+	for i := range c.HyperPolicy {
+		if err := c.HyperPolicy[i].validate(); err != nil {
+			return fmt.Errorf("hyperPolicy: rule %d: %v", i, err)
+		}
+	}
+
+	for i := range c.SELinuxPolicy {
+		if err := c.SELinuxPolicy[i].validate(); err != nil {
+			return fmt.Errorf("selinuxPolicy: rule %d: %v", i, err)
+		}
+	}
+
+	for _, pattern := range c.RedactPatterns {
+		if err := validRedactPattern(pattern); err != nil {
+			return fmt.Errorf("redactPatterns: %v", err)
+		}
+	}
+
+	if c.FaultInjection != nil {
+		if err := c.FaultInjection.validate(); err != nil {
+			return fmt.Errorf("faultInjection: %v", err)
+		}
+	}
+
+	if c.IOSessionBufferSize <= 0 {
+		return fmt.Errorf("ioSessionBufferSize: invalid size %d",
+			c.IOSessionBufferSize)
+	}
+
+	if c.StdinBufferSize <= 0 {
+		return fmt.Errorf("stdinBufferSize: invalid size %d", c.StdinBufferSize)
+	}
+
+	if c.ObserverBufferSize <= 0 {
+		return fmt.Errorf("observerBufferSize: invalid size %d",
+			c.ObserverBufferSize)
+	}
+
+	if c.VMBufferLimit < 0 {
+		return fmt.Errorf("vmBufferLimit: negative size %d", c.VMBufferLimit)
+	}
+
+	if c.OutputRateLimit < 0 {
+		return fmt.Errorf("outputRateLimit: negative rate %d", c.OutputRateLimit)
+	}
+
+	if c.OutputRateBurst < 0 {
+		return fmt.Errorf("outputRateBurst: negative size %d", c.OutputRateBurst)
+	}
+
+	if err := validRelayEngine(c.RelayEngine); err != nil {
+		return fmt.Errorf("relayEngine: %v", err)
+	}
+
+	if err := validStreamChunkSize(c.StreamChunkSize); err != nil {
+		return fmt.Errorf("streamChunkSize: %v", err)
+	}
+
+	if c.CompressionThreshold < 0 {
+		return fmt.Errorf("compressionThreshold: negative rate %d", c.CompressionThreshold)
+	}
+
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idleTimeout: negative duration %s", time.Duration(c.IdleTimeout))
+	}
+
+	if c.PingInterval < 0 {
+		return fmt.Errorf("pingInterval: negative duration %s", time.Duration(c.PingInterval))
+	}
+
+	if c.PingMisses < 1 {
+		return fmt.Errorf("pingMisses: should be at least 1, got %d", c.PingMisses)
+	}
+
+	if c.VMLostGracePeriod < 0 {
+		return fmt.Errorf("vmLostGracePeriod: negative duration %s",
+			time.Duration(c.VMLostGracePeriod))
+	}
+
+	if c.TokenValidity < 0 {
+		return fmt.Errorf("tokenValidity: negative duration %s",
+			time.Duration(c.TokenValidity))
+	}
+
+	if c.MaxFrameRate < 0 {
+		return fmt.Errorf("maxFrameRate: negative rate %d", c.MaxFrameRate)
+	}
+
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("maxInFlight: negative value %d", c.MaxInFlight)
+	}
+
+	if c.MaxQueuedBytes < 0 {
+		return fmt.Errorf("maxQueuedBytes: negative size %d", c.MaxQueuedBytes)
+	}
+
+	if c.MaxConnsPerUID < 0 {
+		return fmt.Errorf("maxConnsPerUID: negative value %d", c.MaxConnsPerUID)
+	}
+
+	if c.Landlock && !landlockSupported {
+		return fmt.Errorf("landlock: not supported by this build of cc-proxy")
+	}
+
+	for _, path := range c.LandlockPaths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("landlockPaths: %s isn't an absolute path", path)
+		}
+	}
+
+	if c.AuditTarget != "" {
+		if _, _, err := parseAuditTarget(c.AuditTarget); err != nil {
+			return fmt.Errorf("auditTarget: %v", err)
+		}
+	}
+
+	if err := validAuditFormat(c.AuditFormat); err != nil {
+		return fmt.Errorf("auditFormat: %v", err)
+	}
+
+	if c.MetricsContainerLabels < 0 {
+		return fmt.Errorf("metricsContainerLabels: negative value %d", c.MetricsContainerLabels)
+	}
+
+	if err := validMetricsCollector(c.MetricsCollector); err != nil {
+		return fmt.Errorf("metricsCollector: %v", err)
+	}
+
+	if c.MetricsCollector == "statsd" && c.StatsdAddress == "" {
+		return fmt.Errorf("statsdAddress: needed by the statsd collector")
+	}
+
+	if c.StatsdInterval <= 0 {
+		return fmt.Errorf("statsdInterval: should be positive, got %s",
+			time.Duration(c.StatsdInterval))
+	}
+
+	return nil
+}
+
+// checkDir returns an error if the directory at path, created by the proxy
+// when missing, can't be used.
+func checkDir(path string) error {
+	for p := path; ; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", p)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if p == filepath.Dir(p) {
+			return nil
+		}
+	}
+}
+
+// checkPaths checks the directories the proxy writes to under c. Unlike
+// validate, the result depends on the host the proxy runs on.
+func (c *config) checkPaths() error {
+	dirs := []struct {
+		name, path string
+	}{
+		{"captureDir", c.CaptureDir},
+		{"consoleDir", c.ConsoleDir},
+		{"recordDir", c.RecordDir},
+	}
+	if c.DebugSocket != "" {
+		dirs = append(dirs, struct{ name, path string }{"debugSocket",
+			filepath.Dir(c.DebugSocket)})
+	}
+
+	for _, dir := range dirs {
+		if dir.path == "" {
+			continue
+		}
+		if err := checkDir(dir.path); err != nil {
+			return fmt.Errorf("%s: %v", dir.name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkConfig checks the current configuration, the configuration file with
+// the command line options applied, and writes it to w, as a configuration
+// file with all the fields set.
+func checkConfig(w io.Writer) error {
+	c := newConfig()
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	if err := c.checkPaths(); err != nil {
+		return err
+	}
+
+	if c.AuthPolicyFile != "" {
+		if _, err := loadAuthPolicy(c.AuthPolicyFile); err != nil {
+			return fmt.Errorf("authPolicyFile: %v", err)
+		}
+	}
+
+	if tlsListenAddr != "" {
+		if _, err := newTLSConfig(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// apply makes c the current configuration.
+func (c *config) apply() {
+	hyperTimeout = time.Duration(c.HyperTimeout)
+	hyperTimeoutUnhealthy = c.HyperTimeoutUnhealthy
+
+	hyperTimeouts = make(map[string]time.Duration)
+	for name, timeout := range c.HyperTimeouts {
+		hyperTimeouts[name] = time.Duration(timeout)
+	}
+
+	hyperReconnectRetries = c.HyperReconnectRetries
+	hyperReconnectDelay = time.Duration(c.HyperReconnectDelay)
+	hyperRetries = c.HyperRetries
+	hyperWriteRetries = c.HyperWriteRetries
+	hyperRetryDelay = time.Duration(c.HyperRetryDelay)
+	hyperPolicy = c.HyperPolicy
+	selinuxPolicy = c.SELinuxPolicy
+	authPolicyFile = c.AuthPolicyFile
+	redactPatterns = c.RedactPatterns
+	spliceIO = c.SpliceIO
+	ioSessionBufferSize = c.IOSessionBufferSize
+	stdinBufferSize = c.StdinBufferSize
+	observerBufferSize = c.ObserverBufferSize
+	vmBufferLimit = c.VMBufferLimit
+	outputRateLimit = c.OutputRateLimit
+	outputRateBurst = c.OutputRateBurst
+	captureDir = c.CaptureDir
+	consoleDir = c.ConsoleDir
+	recordDir = c.RecordDir
+	faultInjection = c.FaultInjection
+	debugSocketPath = c.DebugSocket
+	relayEngine = c.RelayEngine
+	streamChunkSize = c.StreamChunkSize
+	compressionThreshold = c.CompressionThreshold
+	idleTimeout = time.Duration(c.IdleTimeout)
+	pingInterval = time.Duration(c.PingInterval)
+	pingMisses = c.PingMisses
+	vmLostGracePeriod = time.Duration(c.VMLostGracePeriod)
+	tokenValidity = time.Duration(c.TokenValidity)
+	maxFrameRate = c.MaxFrameRate
+	maxInFlight = c.MaxInFlight
+	maxQueuedBytes = c.MaxQueuedBytes
+	maxConnsPerUID = c.MaxConnsPerUID
+	landlock = c.Landlock
+	landlockPaths = c.LandlockPaths
+	auditTarget = c.AuditTarget
+	auditFormat = c.AuditFormat
+	metricsContainerLabels = c.MetricsContainerLabels
+	metricsCollectorName = c.MetricsCollector
+	statsdAddress = c.StatsdAddress
+	statsdPrefix = c.StatsdPrefix
+	statsdInterval = time.Duration(c.StatsdInterval)
+}
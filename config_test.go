@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "cc-proxy-config")
+	assert.Nil(t, err)
+	_, err = f.WriteString(content)
+	assert.Nil(t, err)
+	f.Close()
+
+	return f.Name()
+}
+
+// saveConfig returns a function restoring the current configuration.
+func saveConfig() func() {
+	saved := newConfig()
+	return saved.apply
+}
+
+func TestConfigHyperTimeouts(t *testing.T) {
+	defer saveConfig()()
+
+	path := writeTestConfig(t, `{
+		"hyperTimeouts": {
+			"ping": "5s",
+			"newcontainer": "5m"
+		}
+	}`)
+	defer os.Remove(path)
+
+	config, err := loadConfig(path)
+	assert.Nil(t, err)
+	config.apply()
+
+	// hyperTimeout isn't in the file and keeps its default value.
+	assert.Equal(t, 30*time.Second, hyperTimeout)
+	assert.Equal(t, 5*time.Second, hyperCommandTimeout("ping"))
+	assert.Equal(t, 5*time.Minute, hyperCommandTimeout("newcontainer"))
+	assert.Equal(t, 30*time.Second, hyperCommandTimeout("killcontainer"))
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := []string{
+		`{`,
+		`{"hyperTimeout": 30}`,
+		`{"hyperTimeout": "30 seconds"}`,
+		`{"hyperTimeout": "-1s"}`,
+		`{"hyperTimeouts": {"foo": "1s"}}`,
+		`{"hyperTimeouts": {"ping": "-1s"}}`,
+		`{"hyperRetries": -1}`,
+		`{"hyperWriteRetries": -1}`,
+		`{"hyperRetryDelay": "-1s"}`,
+		`{"hyperPolicy": [{"listener": "tcp", "commands": ["*"]}]}`,
+		`{"hyperPolicy": [{"commands": ["foo"]}]}`,
+		`{"hyperPolicy": [{"listener": "unix", "identity": "shim", "commands": ["*"]}]}`,
+		`{"selinuxPolicy": [{"commands": ["*"]}]}`,
+		`{"selinuxPolicy": [{"type": "container_runtime_t", "commands": ["Foo"]}]}`,
+		`{"redactPatterns": ["[password"]}`,
+		`{"ioSessionBufferSize": 0}`,
+		`{"stdinBufferSize": 0}`,
+		`{"observerBufferSize": -1}`,
+		`{"vmBufferLimit": -1}`,
+		`{"outputRateLimit": -1}`,
+		`{"relayEngine": "foo"}`,
+		`{"streamChunkSize": 0}`,
+		`{"streamChunkSize": 1073741824}`,
+		`{"compressionThreshold": -1}`,
+		`{"idleTimeout": "-1s"}`,
+		`{"pingInterval": "-1s"}`,
+		`{"pingMisses": 0}`,
+		`{"vmLostGracePeriod": "-1s"}`,
+		`{"tokenValidity": "-1s"}`,
+		`{"maxFrameRate": -1}`,
+		`{"maxInFlight": -1}`,
+		`{"maxQueuedBytes": -1}`,
+		`{"maxConnsPerUID": -1}`,
+		`{"landlockPaths": ["run/vc"]}`,
+		`{"auditTarget": "http://localhost:514"}`,
+		`{"auditTarget": "udp://"}`,
+		`{"auditFormat": "xml"}`,
+		`{"metricsContainerLabels": -1}`,
+		`{"metricsCollector": "graphite"}`,
+		`{"metricsCollector": "statsd"}`,
+		`{"statsdInterval": "0s"}`,
+	}
+
+	for _, test := range tests {
+		path := writeTestConfig(t, test)
+		_, err := loadConfig(path)
+		assert.NotNil(t, err, "%s", test)
+		os.Remove(path)
+	}
+
+	_, err := loadConfig("/does/not/exist")
+	assert.NotNil(t, err)
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer saveConfig()()
+
+	path := writeTestConfig(t, `{"hyperTimeout": "1m"}`)
+	defer os.Remove(path)
+	loaded, err := loadConfig(path)
+	assert.Nil(t, err)
+	loaded.apply()
+
+	// The configuration is printed with all its fields.
+	var buf bytes.Buffer
+	err = checkConfig(&buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `"hyperTimeout": "1m0s"`)
+	assert.Contains(t, buf.String(), `"pingMisses": 3`)
+
+	printed := &config{HyperTimeouts: make(map[string]duration)}
+	err = json.Unmarshal(buf.Bytes(), printed)
+	assert.Nil(t, err)
+	assert.Equal(t, newConfig(), printed)
+
+	// Directories the proxy can't create are rejected.
+	consoleDir = filepath.Join(path, "consoles")
+	err = checkConfig(ioutil.Discard)
+	assert.NotNil(t, err)
+	consoleDir = ""
+
+	// So are command line options.
+	pingMisses = 0
+	err = checkConfig(ioutil.Discard)
+	assert.NotNil(t, err)
+	pingMisses = 3
+
+	// And TLS listeners without certificates.
+	tlsListenAddr = "localhost:0"
+	err = checkConfig(ioutil.Discard)
+	assert.NotNil(t, err)
+	tlsListenAddr = ""
+}
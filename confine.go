@@ -0,0 +1,134 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// landlock, when true, makes the proxy restrict its own filesystem accesses
+// with a landlock ruleset once its sockets are listening.
+var landlock bool
+
+// landlockPaths are paths, on top of the directories the proxy writes to,
+// that stay accessible once the proxy has confined itself, eg. the
+// directories holding the hyperstart character devices of the VMs.
+var landlockPaths []string
+
+// confinedPaths returns the paths the proxy reads and writes to, rw, and the
+// ones it only reads, ro, once confined.
+func confinedPaths(proxy *proxy) (rw, ro []string) {
+	rw = append(rw, filepath.Dir(proxy.socketPath))
+
+	dir := captureDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	rw = append(rw, dir)
+
+	for _, dir := range []string{consoleDir, recordDir} {
+		if dir != "" {
+			rw = append(rw, dir)
+		}
+	}
+	if debugSocketPath != "" {
+		rw = append(rw, filepath.Dir(debugSocketPath))
+	}
+	if _, ok := logger.(*journalBackend); ok {
+		// Large messages are passed to journald as files.
+		rw = append(rw, "/dev/shm")
+	}
+	rw = append(rw, landlockPaths...)
+
+	ro = append(ro, "/proc/self")
+	for _, file := range []string{tlsCertFile, tlsKeyFile, tlsClientCAFile} {
+		if file != "" {
+			ro = append(ro, file)
+		}
+	}
+	if _, err := os.Stat("/etc/localtime"); err == nil {
+		ro = append(ro, "/etc/localtime")
+	}
+
+	return rw, ro
+}
+
+// confine restricts the filesystem accesses of the proxy to the paths it
+// needs, so a path crafted by a client can't make it read or write anything
+// else.
+func confine(proxy *proxy) error {
+	if profile := apparmorProfile(); profile != "" {
+		glog.V(1).Infof("confined by AppArmor profile %s", profile)
+	}
+
+	if !landlock {
+		return nil
+	}
+
+	rw, ro := confinedPaths(proxy)
+
+	// The directories written to are created lazily, create them now as
+	// they can't be once confined.
+	for _, dir := range rw {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	abi, err := landlockRestrict(rw, ro)
+	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("confined by landlock (ABI v%d) to %s, read-only %s", abi,
+		strings.Join(rw, ", "), strings.Join(ro, ", "))
+
+	return nil
+}
+
+// apparmorProfile returns the AppArmor profile confining the proxy, with its
+// mode, empty if it isn't confined.
+func apparmorProfile() string {
+	data, err := ioutil.ReadFile("/proc/self/attr/apparmor/current")
+	if err != nil {
+		// Kernels older than 5.1.
+		data, err = ioutil.ReadFile("/proc/self/attr/current")
+		if err != nil {
+			return ""
+		}
+	}
+
+	return parseAppArmorLabel(string(data))
+}
+
+// parseAppArmorLabel returns label, such as "cc-proxy (enforce)", if it's the
+// label of a process confined by AppArmor.
+func parseAppArmorLabel(label string) string {
+	label = strings.TrimRight(label, "\n\x00")
+	profile := strings.TrimSuffix(strings.TrimSuffix(label, " (enforce)"), " (complain)")
+
+	// Labels with a mode are AppArmor labels, anything else is the
+	// context of another LSM, SELinux's for instance.
+	if profile == label || profile == "unconfined" {
+		return ""
+	}
+
+	return label
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAppArmorLabel(t *testing.T) {
+	tests := []struct {
+		label, profile string
+	}{
+		{"cc-proxy (enforce)\n", "cc-proxy (enforce)"},
+		{"cc-proxy (complain)\n", "cc-proxy (complain)"},
+		{"unconfined\n", ""},
+		{"system_u:system_r:cc_proxy_t:s0\x00", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.profile, parseAppArmorLabel(test.label), "%q", test.label)
+	}
+}
+
+func TestConfinedPaths(t *testing.T) {
+	defer saveConfig()()
+	savedCert, savedKey := tlsCertFile, tlsKeyFile
+	defer func() {
+		tlsCertFile, tlsKeyFile = savedCert, savedKey
+	}()
+
+	captureDir = "/var/lib/cc-proxy/captures"
+	consoleDir = ""
+	recordDir = "/var/lib/cc-proxy/records"
+	debugSocketPath = "/run/cc-proxy/debug/proxy.sock"
+	tlsCertFile = "/etc/cc-proxy/cert.pem"
+	tlsKeyFile = "/etc/cc-proxy/key.pem"
+	landlockPaths = []string{"/run/virtcontainers"}
+
+	proxy := newProxy()
+	proxy.socketPath = "/run/cc-proxy/proxy.sock"
+
+	rw, ro := confinedPaths(proxy)
+	assert.Equal(t, []string{
+		"/run/cc-proxy",
+		"/var/lib/cc-proxy/captures",
+		"/var/lib/cc-proxy/records",
+		"/run/cc-proxy/debug",
+		"/run/virtcontainers",
+	}, rw)
+	for _, path := range []string{"/proc/self", tlsCertFile, tlsKeyFile} {
+		assert.Contains(t, ro, path)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// consoleDir is where the VM console output is written, one file per VM.
+// The console is only logged and forwarded to clients when empty.
+var consoleDir string
+
+// openConsoleFile opens the file the console output of containerID is
+// appended to.
+func openConsoleFile(containerID string) (*os.File, error) {
+	if err := checkContainerID(containerID); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(consoleDir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(consoleDir, containerID+".console")
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/golang/glog"
+)
+
+// debugSocketPath, when not empty, is the unix socket the debug console
+// listens on, see proxyctl debug.
+var debugSocketPath string
+
+// The debug console is line oriented: clients send a command per line and the
+// proxy answers with the output of the command followed by a status line,
+// either debugStatusOK or an error message prefixed by debugStatusError.
+const (
+	debugStatusOK    = "ok"
+	debugStatusError = "error: "
+)
+
+type debugCommand struct {
+	name  string
+	args  string
+	usage string
+	run   func(proxy *proxy, w io.Writer, args []string) error
+}
+
+// debugCommands are the commands of the debug console, help and quit aside.
+var debugCommands = []debugCommand{
+	{"vms", "", "list the VMs", debugVMs},
+	{"vm", "<containerId>", "print the state and statistics of a VM", debugVM},
+	{"tokens", "<containerId>", "list the I/O tokens of a VM", debugTokens},
+	{"trace", "<containerId> [on|off]",
+		"log everything about a VM, whatever the verbosity", debugTrace},
+	{"notify", "<containerId> <notification> [payload]",
+		"send a notification, with a JSON payload, to the clients of a VM", debugNotify},
+	{"gc-tokens", "[containerId]",
+		"free the tokens no shim has claimed and no process uses", debugGCTokens},
+}
+
+// listenDebugSocket creates the unix socket of the debug console. Only the
+// user running the proxy can connect to it.
+func listenDebugSocket(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0750); err != nil {
+		return nil, fmt.Errorf("couldn't create debug socket directory: %v", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("couldn't remove existing debug socket: %v", err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create debug socket: %v", err)
+	}
+	if err := os.Chmod(socketPath, 0600|os.ModeSocket); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("couldn't set mode on debug socket: %v", err)
+	}
+
+	glog.V(1).Info("debug console listening on ", socketPath)
+
+	return l, nil
+}
+
+// acceptDebugClients serves the clients of the debug console until the proxy
+// is shut down.
+func (proxy *proxy) acceptDebugClients(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if proxy.isClosing() {
+				break
+			}
+			fmt.Fprintln(os.Stderr, "couldn't accept debug connection:", err)
+			continue
+		}
+
+		go proxy.serveDebugClient(conn)
+	}
+}
+
+// serveDebugClient runs the commands read from conn until the client quits or
+// closes the connection.
+func (proxy *proxy) serveDebugClient(conn net.Conn) {
+	defer conn.Close()
+
+	glog.V(1).Info("debug console: client connected")
+
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" {
+			break
+		}
+
+		glog.V(1).Infof("debug console: %s", scanner.Text())
+
+		if err := proxy.runDebugCommand(w, args); err != nil {
+			fmt.Fprintf(w, "%s%v\n", debugStatusError, err)
+		} else {
+			fmt.Fprintln(w, debugStatusOK)
+		}
+		if err := w.Flush(); err != nil {
+			break
+		}
+	}
+
+	glog.V(1).Info("debug console: connection closed")
+}
+
+func (proxy *proxy) runDebugCommand(w io.Writer, args []string) error {
+	if args[0] == "help" {
+		return debugHelp(w)
+	}
+
+	for _, cmd := range debugCommands {
+		if cmd.name == args[0] {
+			return cmd.run(proxy, w, args[1:])
+		}
+	}
+
+	return fmt.Errorf("unknown command %s, try help", args[0])
+}
+
+func debugHelp(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, cmd := range debugCommands {
+		fmt.Fprintf(tw, "%s %s\t%s\n", cmd.name, cmd.args, cmd.usage)
+	}
+	fmt.Fprintf(tw, "help\tprint this help\n")
+	fmt.Fprintf(tw, "quit\tclose the console\n")
+	return tw.Flush()
+}
+
+// lookupVM returns the VM registered with containerID.
+func (proxy *proxy) lookupVM(containerID string) (*vm, error) {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	vm := proxy.vms[containerID]
+	if vm == nil {
+		return nil, fmt.Errorf("unknown containerID: %s", containerID)
+	}
+	return vm, nil
+}
+
+// vmArg returns the VM of the containerId argument of a command taking n
+// arguments.
+func (proxy *proxy) vmArg(args []string, n int) (*vm, error) {
+	if len(args) == 0 {
+		return nil, errors.New("expected a container ID")
+	}
+	if len(args) > n {
+		return nil, errors.New("unexpected arguments")
+	}
+	return proxy.lookupVM(args[0])
+}
+
+func debugVMs(proxy *proxy, w io.Writer, args []string) error {
+	if len(args) != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	proxy.Lock()
+	vms := make([]*vm, 0, len(proxy.vms))
+	for _, vm := range proxy.vms {
+		vms = append(vms, vm)
+	}
+	proxy.Unlock()
+
+	sort.Sort(vmsByContainerID(vms))
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tSTATE\tCLIENTS\tTOKENS\tTRACING")
+	for _, vm := range vms {
+		vm.Lock()
+		state := vm.stateUnlocked()
+		clients := len(vm.clients)
+		resources := vm.resourcesUnlocked()
+		vm.Unlock()
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d/%d\t%v\n", vm.containerID, state, clients,
+			resources.ClaimedTokens, resources.Tokens, vm.tracing())
+	}
+	return tw.Flush()
+}
+
+type vmsByContainerID []*vm
+
+func (s vmsByContainerID) Len() int           { return len(s) }
+func (s vmsByContainerID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s vmsByContainerID) Less(i, j int) bool { return s[i].containerID < s[j].containerID }
+
+func debugVM(proxy *proxy, w io.Writer, args []string) error {
+	vm, err := proxy.vmArg(args, 1)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(vm.stats(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func debugTokens(proxy *proxy, w io.Writer, args []string) error {
+	vm, err := proxy.vmArg(args, 1)
+	if err != nil {
+		return err
+	}
+
+	vm.Lock()
+	sessions := make([]*ioSession, 0, len(vm.tokenToSession))
+	for _, session := range vm.tokenToSession {
+		sessions = append(sessions, session)
+	}
+	vm.Unlock()
+
+	sort.Sort(sessionsByToken(sessions))
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tCONTAINER\tCLIENT\tSTARTED\tEXITED")
+	for _, session := range sessions {
+		// started is protected by resizeLock, which can't be taken
+		// with the vm lock held.
+		started := session.processHasStarted()
+
+		vm.Lock()
+		client := "-"
+		if session.client != nil {
+			client = fmt.Sprintf("#%d", session.clientID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\n", session.token, session.container,
+			client, started, session.terminated)
+		vm.Unlock()
+	}
+	return tw.Flush()
+}
+
+type sessionsByToken []*ioSession
+
+func (s sessionsByToken) Len() int           { return len(s) }
+func (s sessionsByToken) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionsByToken) Less(i, j int) bool { return s[i].token < s[j].token }
+
+// setTracing makes the log messages about vm be logged whatever the
+// verbosity, hyperstart commands and I/O dumps included.
+func (vm *vm) setTracing(on bool) {
+	var trace int32
+	if on {
+		trace = 1
+	}
+	atomic.StoreInt32(&vm.trace, trace)
+}
+
+func (vm *vm) tracing() bool {
+	return atomic.LoadInt32(&vm.trace) != 0
+}
+
+func debugTrace(proxy *proxy, w io.Writer, args []string) error {
+	vm, err := proxy.vmArg(args, 2)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 2 {
+		switch args[1] {
+		case "on":
+			vm.setTracing(true)
+		case "off":
+			vm.setTracing(false)
+		default:
+			return fmt.Errorf("expected on or off, got %s", args[1])
+		}
+	}
+
+	state := "off"
+	if vm.tracing() {
+		state = "on"
+	}
+	_, err = fmt.Fprintf(w, "tracing of %s is %s\n", vm.containerID, state)
+	return err
+}
+
+// parseNotification returns the notification named name, case insensitive.
+func parseNotification(name string) (api.Notification, error) {
+	for n := api.Notification(0); n < api.NotificationMax; n++ {
+		if strings.EqualFold(n.String(), name) {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown notification: %s", name)
+}
+
+func debugNotify(proxy *proxy, w io.Writer, args []string) error {
+	if len(args) < 2 {
+		return errors.New("expected a container ID and a notification")
+	}
+	vm, err := proxy.lookupVM(args[0])
+	if err != nil {
+		return err
+	}
+
+	notification, err := parseNotification(args[1])
+	if err != nil {
+		return err
+	}
+	// The exit status is sent on the stream of the process, not to the
+	// clients of the VM.
+	if notification == api.NotificationProcessExited {
+		return fmt.Errorf("%s can't be injected", notification)
+	}
+
+	payload := json.RawMessage("{}")
+	if len(args) > 2 {
+		payload = json.RawMessage(strings.Join(args[2:], " "))
+		var v interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return fmt.Errorf("invalid JSON payload: %v", err)
+		}
+	}
+
+	vm.info(1, "notify", "injecting "+notification.String()+" from the debug console")
+	vm.notify(notification, payload)
+
+	return nil
+}
+
+// collectTokens frees the tokens of vm in tokens whose I/O session is unused:
+// no shim has claimed them, no process has been started with them. It returns
+// the tokens freed.
+func (vm *vm) collectTokens(tokens []Token) []Token {
+	// started is protected by resizeLock, which can't be taken with the
+	// vm lock held.
+	var unused []Token
+	for _, token := range tokens {
+		session := vm.findSessionByToken(token)
+		if session != nil && !session.processHasStarted() {
+			unused = append(unused, token)
+		}
+	}
+
+	vm.Lock()
+	defer vm.Unlock()
+
+	var freed []Token
+	for _, token := range unused {
+		session := vm.tokenToSession[token]
+		if session == nil || session.client != nil || len(session.observers) > 0 {
+			continue
+		}
+		if err := vm.freeTokenUnlocked(token); err == nil {
+			freed = append(freed, token)
+		}
+	}
+
+	return freed
+}
+
+// gcTokens frees the unused tokens of the VM containerID, or of all the VMs if
+// containerID is empty, eg. the tokens allocated by a runtime which died
+// before starting the process. It returns the number of tokens freed.
+func (proxy *proxy) gcTokens(containerID string) (int, error) {
+	if containerID != "" {
+		if _, err := proxy.lookupVM(containerID); err != nil {
+			return 0, err
+		}
+	}
+
+	// Unclaimed tokens are marked claimed while we look at their sessions
+	// so no shim can claim them in the meantime.
+	candidates := make(map[*vm][]Token)
+	proxy.Lock()
+	for token, info := range proxy.tokenToVM {
+		if info.state != tokenStateAllocated {
+			continue
+		}
+		if containerID != "" && info.vm.containerID != containerID {
+			continue
+		}
+		info.state = tokenStateClaimed
+		candidates[info.vm] = append(candidates[info.vm], token)
+	}
+	proxy.Unlock()
+
+	n := 0
+	for vm, tokens := range candidates {
+		freed := make(map[Token]bool)
+		for _, token := range vm.collectTokens(tokens) {
+			freed[token] = true
+		}
+		n += len(freed)
+
+		proxy.Lock()
+		for _, token := range tokens {
+			if freed[token] {
+				proxy.removeTokenUnlocked(token)
+			} else if info := proxy.tokenToVM[token]; info != nil {
+				info.state = tokenStateAllocated
+			}
+		}
+		proxy.Unlock()
+
+		if len(freed) > 0 {
+			vm.infof(1, "io", "freed %d unused tokens from the debug console", len(freed))
+		}
+	}
+
+	return n, nil
+}
+
+func debugGCTokens(proxy *proxy, w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return errors.New("unexpected arguments")
+	}
+
+	containerID := ""
+	if len(args) == 1 {
+		containerID = args[0]
+	}
+
+	n, err := proxy.gcTokens(containerID)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "freed %d tokens\n", n)
+	return err
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// debugConsole is a client of the debug console of a test rig.
+type debugConsole struct {
+	t       *testing.T
+	conn    net.Conn
+	replies *bufio.Scanner
+	done    chan interface{}
+}
+
+func newDebugConsole(t *testing.T, proxy *proxy) *debugConsole {
+	conn, proxyConn, err := Socketpair()
+	assert.Nil(t, err)
+
+	console := &debugConsole{
+		t:       t,
+		conn:    conn,
+		replies: bufio.NewScanner(conn),
+		done:    make(chan interface{}),
+	}
+	go func() {
+		proxy.serveDebugClient(proxyConn)
+		close(console.done)
+	}()
+
+	return console
+}
+
+// run runs line, returning the output of the command and the error it
+// returned, if any.
+func (c *debugConsole) run(line string) (string, string) {
+	_, err := fmt.Fprintln(c.conn, line)
+	assert.Nil(c.t, err)
+
+	var output []string
+	for c.replies.Scan() {
+		reply := c.replies.Text()
+		if reply == debugStatusOK {
+			return strings.Join(output, "\n"), ""
+		}
+		if strings.HasPrefix(reply, debugStatusError) {
+			return strings.Join(output, "\n"), strings.TrimPrefix(reply, debugStatusError)
+		}
+		output = append(output, reply)
+	}
+
+	assert.Fail(c.t, "debug console closed")
+	return "", ""
+}
+
+func (c *debugConsole) close() {
+	fmt.Fprintln(c.conn, "quit")
+	<-c.done
+	c.conn.Close()
+}
+
+func TestDebugConsole(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+	token := rig.RegisterVM()
+
+	console := newDebugConsole(t, rig.proxy)
+
+	out, errMsg := console.run("help")
+	assert.Empty(t, errMsg)
+	assert.Contains(t, out, "gc-tokens")
+
+	_, errMsg = console.run("foo")
+	assert.Contains(t, errMsg, "unknown command")
+
+	out, errMsg = console.run("vms")
+	assert.Empty(t, errMsg)
+	assert.Contains(t, out, testContainerID)
+
+	out, errMsg = console.run("vm " + testContainerID)
+	assert.Empty(t, errMsg)
+	stats := api.VMStats{}
+	assert.Nil(t, json.Unmarshal([]byte(out), &stats))
+	assert.Equal(t, testContainerID, stats.ContainerID)
+
+	_, errMsg = console.run("vm foo")
+	assert.Contains(t, errMsg, "unknown containerID")
+
+	out, errMsg = console.run("tokens " + testContainerID)
+	assert.Empty(t, errMsg)
+	assert.Contains(t, out, token)
+
+	// Tracing.
+	vm := rig.proxy.vms[testContainerID]
+	_, errMsg = console.run("trace " + testContainerID + " on")
+	assert.Empty(t, errMsg)
+	assert.True(t, vm.tracing())
+	out, errMsg = console.run("trace " + testContainerID + " off")
+	assert.Empty(t, errMsg)
+	assert.Contains(t, out, "off")
+	assert.False(t, vm.tracing())
+	_, errMsg = console.run("trace " + testContainerID + " maybe")
+	assert.NotEmpty(t, errMsg)
+
+	// Notifications are sent to the clients of the VM.
+	var degraded []api.VMDegraded
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationVMDegraded {
+			return
+		}
+		d := api.VMDegraded{}
+		assert.Nil(t, json.Unmarshal(payload, &d))
+		degraded = append(degraded, d)
+	})
+	_, errMsg = console.run("notify " + testContainerID +
+		` vmdegraded {"containerId": "` + testContainerID + `"}`)
+	assert.Empty(t, errMsg)
+	// Notifications are only read while waiting for a response.
+	_, err := rig.Client.Stats("")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(degraded))
+	assert.Equal(t, testContainerID, degraded[0].ContainerID)
+
+	_, errMsg = console.run("notify " + testContainerID + " ProcessExited")
+	assert.NotEmpty(t, errMsg)
+	_, errMsg = console.run("notify " + testContainerID + " VMDegraded {")
+	assert.Contains(t, errMsg, "invalid JSON")
+
+	console.close()
+	rig.Stop()
+}
+
+func TestDebugGCTokens(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+	token := rig.RegisterVM()
+
+	// A claimed token isn't collected.
+	shim := rig.ServeNewShim(token)
+	resp, err := rig.Client.AttachVM(testContainerID,
+		&goapi.AttachVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.IO.Tokens))
+	unclaimed := resp.IO.Tokens[0]
+
+	console := newDebugConsole(t, rig.proxy)
+
+	out, errMsg := console.run("gc-tokens " + testContainerID)
+	assert.Empty(t, errMsg)
+	assert.Equal(t, "freed 1 tokens", out)
+
+	vm := rig.proxy.vms[testContainerID]
+	assert.NotNil(t, vm.findSessionByToken(Token(token)))
+	assert.Nil(t, vm.findSessionByToken(Token(unclaimed)))
+	_, err = rig.proxy.claimToken(Token(unclaimed))
+	assert.NotNil(t, err)
+
+	out, errMsg = console.run("gc-tokens")
+	assert.Empty(t, errMsg)
+	assert.Equal(t, "freed 0 tokens", out)
+
+	console.close()
+	shim.close()
+	rig.Stop()
+}
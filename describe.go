@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// chunkSizes are the stream chunk sizes ConnectShim can negotiate.
+type chunkSizes struct {
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Default int `json:"default"`
+}
+
+// protocolDescription is what -dump-protocol prints: the description of the
+// protocol completed with what this proxy supports.
+type protocolDescription struct {
+	*api.Description
+	// HyperstartCommands lists, per hyperstart protocol version, the
+	// commands Hyper accepts.
+	HyperstartCommands map[string][]string `json:"hyperstartCommands"`
+	StreamChunkSize    chunkSizes          `json:"streamChunkSize"`
+}
+
+func describeProtocol() *protocolDescription {
+	d := &protocolDescription{
+		Description:        api.Describe(),
+		HyperstartCommands: make(map[string][]string),
+		StreamChunkSize: chunkSizes{
+			Min:     minStreamChunkSize,
+			Max:     maxStreamChunkSize,
+			Default: streamChunkSize,
+		},
+	}
+
+	for version, commands := range hyperstartCommands {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		d.HyperstartCommands[version] = names
+	}
+
+	return d
+}
+
+// dumpProtocol writes the JSON description of the protocol to w.
+func dumpProtocol(w io.Writer) error {
+	data, err := json.MarshalIndent(describeProtocol(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
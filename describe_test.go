@@ -0,0 +1,40 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpProtocol(t *testing.T) {
+	var buf bytes.Buffer
+
+	assert.Nil(t, dumpProtocol(&buf))
+
+	var d struct {
+		Version            int                 `json:"version"`
+		HyperstartCommands map[string][]string `json:"hyperstartCommands"`
+		StreamChunkSize    chunkSizes          `json:"streamChunkSize"`
+	}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &d))
+	assert.NotZero(t, d.Version)
+	assert.Len(t, d.HyperstartCommands["0.7"], len(hyperstartCommands["0.7"]))
+	assert.Equal(t, minStreamChunkSize, d.StreamChunkSize.Min)
+	assert.Equal(t, maxStreamChunkSize, d.StreamChunkSize.Max)
+}
@@ -0,0 +1,407 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,go1.9
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+
+	"github.com/golang/glog"
+)
+
+// EPOLLET doesn't fit in the uint32 Events field as defined by the syscall
+// package.
+const epollET = 1 << 31
+
+// pollerLockRetry is how long the poller waits before trying again to write
+// to a client when another goroutine is writing a frame to it.
+const pollerLockRetry = time.Millisecond
+
+// poller is the epoll relay engine: a single goroutine writes the output
+// queues of all the I/O sessions to their clients. Client sockets are
+// non-blocking, when one is full the poller waits for epoll to report it
+// writable again instead of blocking a goroutine on it.
+type poller struct {
+	sync.Mutex
+
+	epfd int
+	// wakeR and wakeW are a pipe used to wake up the poller goroutine
+	// when frames are queued.
+	wakeR, wakeW int
+
+	conns   map[*clientConn]*pollConn
+	writers []*pollWriter
+	closed  bool
+
+	done chan interface{}
+}
+
+// pollConn is a client connection registered with the poller. Several
+// writers can share a connection, eg. when a shim multiplexes sessions on it.
+type pollConn struct {
+	conn     *clientConn
+	raw      syscall.RawConn
+	nWriters int
+}
+
+// pollWriter writes the frames of an output queue to a client, it's the
+// poller equivalent of writeOutputs. Only the poller goroutine uses it.
+type pollWriter struct {
+	vm       *vm
+	clientID uint64
+	conn     *pollConn
+	q        *outputQueue
+
+	// frame is the frame being written, off the number of bytes already
+	// written.
+	frame    outputFrame
+	hasFrame bool
+	off      int
+	// locked is true when we hold the write lock of the connection, ie.
+	// between the first and the last byte of frame.
+	locked bool
+	// notBefore is when the rate limiter lets us write frame.
+	notBefore time.Time
+	// failed is true once writing to the client has failed.
+	failed bool
+}
+
+const epollSupported = true
+
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	event := syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(fds[0]),
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fds[0], &event); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, err
+	}
+
+	p := &poller{
+		epfd:  epfd,
+		wakeR: fds[0],
+		wakeW: fds[1],
+		conns: make(map[*clientConn]*pollConn),
+		done:  make(chan interface{}),
+	}
+	go p.run()
+
+	return p, nil
+}
+
+// add makes the poller write the frames queued in q to client. It returns
+// false if client can't be polled.
+func (p *poller) add(vm *vm, clientID uint64, client net.Conn, q *outputQueue) bool {
+	conn, ok := client.(*clientConn)
+	if !ok {
+		return false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	pc := p.conns[conn]
+	if pc == nil {
+		raw, ok := rawConn(conn.Conn)
+		if !ok {
+			return false
+		}
+
+		var err error
+		ctlErr := raw.Control(func(fd uintptr) {
+			event := syscall.EpollEvent{
+				Events: syscall.EPOLLOUT | epollET,
+				Fd:     int32(fd),
+			}
+			err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, int(fd), &event)
+		})
+		if ctlErr != nil || err != nil {
+			return false
+		}
+
+		pc = &pollConn{
+			conn: conn,
+			raw:  raw,
+		}
+		p.conns[conn] = pc
+	}
+	pc.nWriters++
+
+	p.writers = append(p.writers, &pollWriter{
+		vm:       vm,
+		clientID: clientID,
+		conn:     pc,
+		q:        q,
+	})
+
+	q.Lock()
+	q.notify = p.wake
+	q.Unlock()
+
+	p.wake()
+
+	return true
+}
+
+// remove unregisters w, whose queue has been closed and emptied.
+func (p *poller) remove(w *pollWriter) {
+	w.q.Lock()
+	w.q.notify = nil
+	w.q.Unlock()
+
+	p.Lock()
+	defer p.Unlock()
+
+	for i := range p.writers {
+		if p.writers[i] == w {
+			p.writers = append(p.writers[:i], p.writers[i+1:]...)
+			break
+		}
+	}
+
+	pc := w.conn
+	pc.nWriters--
+	if pc.nWriters > 0 {
+		return
+	}
+
+	// If the connection is already closed, the kernel has removed it from
+	// the epoll set.
+	pc.raw.Control(func(fd uintptr) {
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, int(fd), &syscall.EpollEvent{})
+	})
+	delete(p.conns, pc.conn)
+}
+
+func (p *poller) wake() {
+	syscall.Write(p.wakeW, []byte{0})
+}
+
+func (p *poller) drainWake() {
+	var buf [64]byte
+
+	for {
+		n, err := syscall.Read(p.wakeR, buf[:])
+		if n <= 0 || err != nil {
+			return
+		}
+	}
+}
+
+func (p *poller) isClosed() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.closed
+}
+
+func (p *poller) run() {
+	defer close(p.done)
+
+	// We don't need to look at the events: every time we wake up, we go
+	// through all the writers.
+	events := make([]syscall.EpollEvent, 64)
+	timeout := -1
+
+	for {
+		_, err := syscall.EpollWait(p.epfd, events, timeout)
+		if err != nil && err != syscall.EINTR {
+			glog.Errorf("[poller] epoll_wait: %v", err)
+			return
+		}
+
+		p.drainWake()
+		if p.isClosed() {
+			return
+		}
+
+		timeout = p.writeAll()
+	}
+}
+
+// writeAll makes the writers write as much as they can and returns how long,
+// in milliseconds, the poller can wait for epoll events before some writer
+// needs to be looked at again. -1 means no timeout.
+func (p *poller) writeAll() int {
+	p.Lock()
+	writers := make([]*pollWriter, len(p.writers))
+	copy(writers, p.writers)
+	p.Unlock()
+
+	now := time.Now()
+	var next time.Time
+
+	for _, w := range writers {
+		retry, finished := w.write(now)
+		if finished {
+			p.remove(w)
+			continue
+		}
+		if !retry.IsZero() && (next.IsZero() || retry.Before(next)) {
+			next = retry
+		}
+	}
+
+	if next.IsZero() {
+		return -1
+	}
+
+	timeout := int((next.Sub(now) + time.Millisecond - 1) / time.Millisecond)
+	if timeout < 1 {
+		timeout = 1
+	}
+
+	return timeout
+}
+
+// write writes the queued frames until the client socket is full or the
+// queue is empty. retry, when not zero, is when write needs to be called
+// again. finished is true when the queue is closed and w can be removed.
+func (w *pollWriter) write(now time.Time) (retry time.Time, finished bool) {
+	conn := w.conn.conn
+
+	for {
+		if !w.hasFrame {
+			frame, ok, closed := w.q.tryPop()
+			if closed {
+				return time.Time{}, true
+			}
+			if !ok {
+				return time.Time{}, false
+			}
+
+			w.frame = frame
+			w.hasFrame = true
+			w.off = 0
+
+			if frame.limiter != nil && !w.failed {
+				n := len(frame.buf) - api.MinHeaderLength
+				if delay := frame.limiter.reserve(now, n); delay > 0 {
+					w.vm.infof(2, "io", "client #%d: rate limited for %v",
+						w.clientID, delay)
+					w.notBefore = now.Add(delay)
+				}
+			}
+		}
+
+		if now.Before(w.notBefore) {
+			return w.notBefore, false
+		}
+
+		// Same as writeOutputs: once the client has gone away, keep
+		// emptying the queue.
+		if !w.failed {
+			if !w.locked {
+				if !conn.tryLockWrite() {
+					return now.Add(pollerLockRetry), false
+				}
+				w.locked = true
+			}
+
+			n, err := w.conn.write(w.frame.buf[w.off:])
+			w.off += n
+			if err == syscall.EAGAIN {
+				// epoll will tell us when we can write again.
+				return time.Time{}, false
+			}
+			if err != nil {
+				w.vm.infof(1, "io", "error writing I/O data to client: %v", err)
+				w.failed = true
+			} else if w.off < len(w.frame.buf) {
+				continue
+			}
+
+			conn.unlockWrite()
+			w.locked = false
+		}
+
+		w.q.done(w.frame)
+		w.frame = outputFrame{}
+		w.hasFrame = false
+	}
+}
+
+// write does a non-blocking write of b to the connection.
+func (c *pollConn) write(b []byte) (int, error) {
+	var n int
+	var err error
+
+	ctlErr := c.raw.Write(func(fd uintptr) bool {
+		for {
+			n, err = syscall.Write(int(fd), b)
+			if err != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if ctlErr != nil {
+		return 0, ctlErr
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	return n, err
+}
+
+// close stops the poller. The frames still queued aren't written.
+func (p *poller) close() {
+	p.Lock()
+	p.closed = true
+	writers := p.writers
+	p.writers = nil
+	p.Unlock()
+
+	p.wake()
+	<-p.done
+
+	for _, w := range writers {
+		w.q.Lock()
+		w.q.notify = nil
+		w.q.Unlock()
+
+		if w.locked {
+			w.conn.conn.unlockWrite()
+		}
+	}
+
+	syscall.Close(p.epfd)
+	syscall.Close(p.wakeR)
+	syscall.Close(p.wakeW)
+}
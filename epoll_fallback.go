@@ -0,0 +1,40 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux !go1.9
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// The epoll relay engine needs to get to the file descriptor of client
+// connections without putting them in blocking mode, only possible from go
+// 1.9.
+
+const epollSupported = false
+
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("the epoll relay engine needs linux and go 1.9")
+}
+
+func (p *poller) add(vm *vm, clientID uint64, client net.Conn, q *outputQueue) bool {
+	return false
+}
+
+func (p *poller) close() {}
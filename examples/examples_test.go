@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package examples holds the smoke test of the example runtime and shim.
+package examples
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const pkg = "github.com/clearcontainers/proxy"
+
+type examplesRig struct {
+	t     *testing.T
+	dir   string
+	proxy *exec.Cmd
+}
+
+// newExamplesRig builds the proxy and the examples and starts the proxy.
+func newExamplesRig(t *testing.T) *examplesRig {
+	dir, err := ioutil.TempDir("", "examples")
+	assert.Nil(t, err)
+	rig := &examplesRig{
+		t:   t,
+		dir: dir,
+	}
+
+	for name, path := range map[string]string{
+		"cc-proxy": pkg,
+		"runtime":  pkg + "/examples/runtime",
+		"shim":     pkg + "/examples/shim",
+	} {
+		out, err := exec.Command("go", "build", "-o",
+			filepath.Join(dir, name), path).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("building %s: %v\n%s", name, err, out)
+		}
+	}
+
+	socket := rig.path("proxy.sock")
+	rig.proxy = exec.Command(rig.path("cc-proxy"), "-socket-path", socket)
+	assert.Nil(t, rig.proxy.Start())
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			return rig
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	rig.Stop()
+	t.Fatal("proxy socket not created")
+	return nil
+}
+
+func (rig *examplesRig) path(name string) string {
+	return filepath.Join(rig.dir, name)
+}
+
+func (rig *examplesRig) runtime() *exec.Cmd {
+	return exec.Command(rig.path("runtime"), "-proxy", rig.path("proxy.sock"),
+		"-shim", rig.path("shim"))
+}
+
+func (rig *examplesRig) Stop() {
+	rig.proxy.Process.Kill()
+	rig.proxy.Wait()
+	os.RemoveAll(rig.dir)
+}
+
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	return -1
+}
+
+func TestExamples(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the proxy")
+	}
+
+	rig := newExamplesRig(t)
+	defer rig.Stop()
+
+	// The process echoes stdin until it is closed.
+	runtime := rig.runtime()
+	runtime.Stdin = bytes.NewBufferString("hello\nworld\n")
+	out, err := runtime.Output()
+	assert.Nil(t, err)
+	assert.Equal(t, "HELLO\nWORLD\n", string(out))
+
+	// Interactive I/O, then SIGTERM, relayed down to the process.
+	runtime = rig.runtime()
+	stdin, err := runtime.StdinPipe()
+	assert.Nil(t, err)
+	stdout, err := runtime.StdoutPipe()
+	assert.Nil(t, err)
+	var stderr bytes.Buffer
+	runtime.Stderr = &stderr
+	assert.Nil(t, runtime.Start())
+
+	lines := bufio.NewReader(stdout)
+	for _, line := range []string{"foo", "bar"} {
+		_, err = stdin.Write([]byte(line + "\n"))
+		assert.Nil(t, err)
+		echo, err := lines.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, strings.ToUpper(line)+"\n", echo)
+	}
+
+	assert.Nil(t, runtime.Process.Signal(syscall.SIGTERM))
+	err = runtime.Wait()
+	assert.Equal(t, 128+int(syscall.SIGTERM), exitStatus(err))
+	assert.Equal(t, "process: terminated\n", stderr.String())
+	stdin.Close()
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// runtime is a minimal runtime, showing the commands a runtime sends to the
+// proxy to run a process in a VM. Instead of booting a VM, it starts the fake
+// hyperstart of the agentmock package and plays the process itself: the
+// process echoes the lines it reads on stdin in upper case, exits with 0 once
+// stdin is closed and with 128 + the signal number when signalled.
+//
+// The runtime registers the VM with the proxy, getting an I/O token back,
+// spawns the shim with that token, starts the process with execcmd and
+// waits for the shim to exit, with the exit status of the process. SIGTERM
+// is relayed to the shim, which forwards it to the process through the
+// proxy. See ../README.md.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/clearcontainers/proxy/api/hyperstart/agentmock"
+	goapi "github.com/clearcontainers/proxy/client"
+)
+
+const containerID = "example"
+
+// readerFunc turns a Read method into an io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// runProcess plays the process started by the runtime until it exits.
+func runProcess(process *agentmock.Process, signals <-chan syscall.Signal) {
+	lines := make(chan []byte)
+	go func() {
+		scanner := bufio.NewScanner(readerFunc(process.ReadStdin))
+		for scanner.Scan() {
+			lines <- append(bytes.ToUpper(scanner.Bytes()), '\n')
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				process.Exit(0)
+				return
+			}
+			process.SendStdout(line)
+		case sig := <-signals:
+			process.SendStderr([]byte(fmt.Sprintf("process: %s\n", sig)))
+			process.Exit(uint8(128 + sig))
+			return
+		}
+	}
+}
+
+func run(proxyPath, shimPath string) (int, error) {
+	// The fake hyperstart, forwarding the signals sent with killcontainer
+	// to the process.
+	agent, err := agentmock.New()
+	if err != nil {
+		return 0, err
+	}
+	defer agent.Close()
+
+	signals := make(chan syscall.Signal, 1)
+	agent.Handle(hyperstart.CmdKillContainer, func(data []byte) ([]byte, error) {
+		cmd := hyperstart.KillCommand{}
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return nil, err
+		}
+		signals <- cmd.Signal
+		return nil, nil
+	})
+
+	conn, err := net.Dial("unix", proxyPath)
+	if err != nil {
+		return 0, err
+	}
+	client := goapi.NewClient(conn)
+	defer client.Close()
+
+	// Register the VM, asking for the I/O token of the process.
+	ret, err := client.RegisterVM(containerID, agent.CtlSocketPath(),
+		agent.IoSocketPath(), &goapi.RegisterVMOptions{
+			NumIOStreams: 1,
+		})
+	if err != nil {
+		return 0, err
+	}
+	defer client.UnregisterVM(containerID)
+	token := ret.IO.Tokens[0]
+
+	// Spawn the shim, it claims the I/O session of the process with the
+	// token.
+	shim := exec.Command(shimPath, "-url", ret.IO.URL, "-token", token)
+	shim.Stdin = os.Stdin
+	shim.Stdout = os.Stdout
+	shim.Stderr = os.Stderr
+	if err := shim.Start(); err != nil {
+		return 0, err
+	}
+
+	// SIGINT from the terminal reaches the shim directly, SIGTERM sent to
+	// the runtime is relayed to it.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGTERM {
+				shim.Process.Signal(sig)
+			}
+		}
+	}()
+
+	// Start the process, its I/O is the session of token.
+	err = client.HyperWithTokens(hyperstart.CmdExecCmd, []string{token},
+		&hyperstart.ExecCommand{
+			Container: containerID,
+			Process: hyperstart.Process{
+				Args: []string{"/bin/upcase"},
+			},
+		})
+	if err != nil {
+		shim.Process.Kill()
+		shim.Wait()
+		return 0, err
+	}
+
+	process, err := agent.WaitProcess(5 * time.Second)
+	if err != nil {
+		shim.Process.Kill()
+		shim.Wait()
+		return 0, err
+	}
+	go runProcess(process, signals)
+
+	// The shim exits with the exit status of the process.
+	if err := shim.Wait(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0, err
+		}
+		return exitErr.Sys().(syscall.WaitStatus).ExitStatus(), nil
+	}
+
+	return 0, nil
+}
+
+func main() {
+	proxyPath := flag.String("proxy", "", "path of the proxy socket")
+	shimPath := flag.String("shim", "shim", "path of the shim binary")
+	flag.Parse()
+
+	if *proxyPath == "" {
+		fmt.Fprintln(os.Stderr, "-proxy is needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status, err := run(*proxyPath, *shimPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "runtime:", err)
+		os.Exit(1)
+	}
+
+	os.Exit(status)
+}
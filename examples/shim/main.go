@@ -0,0 +1,61 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// shim is a minimal shim: it claims the I/O session of the token it is
+// given, relays its stdin, stdout and stderr to the process in the VM,
+// forwards the signals it receives and exits with the exit status of the
+// process. It is spawned by the example runtime, see ../README.md.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/clearcontainers/proxy/shim"
+)
+
+func main() {
+	url := flag.String("url", "", "URL of the proxy, from the io response")
+	token := flag.String("token", "", "I/O token of the process")
+	flag.Parse()
+
+	if *url == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "-url and -token are needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	s, err := shim.Dial(*url, *token, &shim.Options{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shim:", err)
+		os.Exit(1)
+	}
+
+	stop := s.ForwardSignals(nil)
+	status, err := s.Wait()
+	stop()
+	s.Close()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shim:", err)
+		os.Exit(1)
+	}
+
+	os.Exit(status)
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// frameOpcodeOffset is the offset of the opcode in a frame header.
+const frameOpcodeOffset = 7
+
+// faultInjection, when not nil, makes the proxy misbehave on purpose so
+// runtime and shim authors can test their error handling. It's only set from
+// the configuration file.
+var faultInjection *faultConfig
+
+// Targets of the faults.
+const (
+	// faultTargetClient are the frames exchanged with the clients.
+	faultTargetClient = "client"
+	// faultTargetAgent are the commands sent to hyperstart.
+	faultTargetAgent = "agent"
+)
+
+// faultConfig describes the faults to inject. Each frame or agent command
+// suffers at most one fault, picked with the given probabilities.
+type faultConfig struct {
+	// Seed seeds the random generators deciding the faults. The faults
+	// injected on a client connection, identified by its client ID, or
+	// on a VM, identified by its container ID, are the same from one run
+	// to the next.
+	Seed int64 `json:"seed"`
+	// Targets restricts the faults to "client" or "agent", all the
+	// targets when empty.
+	Targets []string `json:"targets,omitempty"`
+	// Drop is the probability a frame or command is lost.
+	Drop float64 `json:"drop"`
+	// Delay is the probability a frame or command is delayed, by up to
+	// MaxDelay.
+	Delay    float64  `json:"delay"`
+	MaxDelay duration `json:"maxDelay"`
+	// Duplicate is the probability a frame or command is sent twice.
+	Duplicate float64 `json:"duplicate"`
+	// Corrupt is the probability a bit of a frame or command is
+	// flipped. The length of frames is left alone so the connection
+	// stays framed.
+	Corrupt float64 `json:"corrupt"`
+}
+
+func (c *faultConfig) validate() error {
+	for _, target := range c.Targets {
+		switch target {
+		case faultTargetClient, faultTargetAgent:
+		default:
+			return fmt.Errorf("unknown target '%s'", target)
+		}
+	}
+
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"drop", c.Drop},
+		{"delay", c.Delay},
+		{"duplicate", c.Duplicate},
+		{"corrupt", c.Corrupt},
+	}
+	sum := 0.0
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			return fmt.Errorf("%s: probability %v not between 0 and 1", p.name, p.value)
+		}
+		sum += p.value
+	}
+	if sum > 1 {
+		return fmt.Errorf("the probabilities add up to %v, more than 1", sum)
+	}
+
+	if c.MaxDelay < 0 {
+		return fmt.Errorf("maxDelay: negative duration %s", time.Duration(c.MaxDelay))
+	}
+	if c.Delay > 0 && c.MaxDelay == 0 {
+		return fmt.Errorf("maxDelay: delay needs a maximum delay")
+	}
+
+	return nil
+}
+
+func (c *faultConfig) hasTarget(target string) bool {
+	if len(c.Targets) == 0 {
+		return true
+	}
+	for _, t := range c.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+type faultKind int
+
+const (
+	faultNone faultKind = iota
+	faultDrop
+	faultDelay
+	faultDuplicate
+	faultCorrupt
+)
+
+func (k faultKind) String() string {
+	switch k {
+	case faultNone:
+		return "none"
+	case faultDrop:
+		return "drop"
+	case faultDelay:
+		return "delay"
+	case faultDuplicate:
+		return "duplicate"
+	case faultCorrupt:
+		return "corrupt"
+	default:
+		return fmt.Sprintf("faultKind(%d)", int(k))
+	}
+}
+
+// faultSource decides the faults injected in a sequence of frames or
+// commands.
+type faultSource struct {
+	sync.Mutex
+	config *faultConfig
+	rand   *rand.Rand
+}
+
+// newFaultSource returns the fault source of the sequence identified by
+// target and key, nil when no fault is injected in target.
+func newFaultSource(target, key string) *faultSource {
+	config := faultInjection
+	if config == nil || !config.hasTarget(target) {
+		return nil
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	h.Write([]byte(key))
+
+	return &faultSource{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed ^ int64(h.Sum64()))),
+	}
+}
+
+// next returns the fault to inject in the next frame or command, and how long
+// to delay it.
+func (s *faultSource) next() (faultKind, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	c := s.config
+	p := s.rand.Float64()
+	switch {
+	case p < c.Drop:
+		return faultDrop, 0
+	case p < c.Drop+c.Delay:
+		return faultDelay, time.Duration(s.rand.Int63n(int64(c.MaxDelay) + 1))
+	case p < c.Drop+c.Delay+c.Duplicate:
+		return faultDuplicate, 0
+	case p < c.Drop+c.Delay+c.Duplicate+c.Corrupt:
+		return faultCorrupt, 0
+	default:
+		return faultNone, 0
+	}
+}
+
+// corrupt flips a random bit of data.
+func (s *faultSource) corrupt(data []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	i := s.rand.Intn(len(data))
+	data[i] ^= 1 << uint(s.rand.Intn(8))
+}
+
+// faultyConn injects faults in the frames read from and written to a client
+// connection. Like recordingConn, it hides the file descriptor of the
+// connection so no frame bypasses it.
+type faultyConn struct {
+	net.Conn
+	id uint64
+
+	// Reads and writes are serialized by the protocol and clientConn,
+	// each direction only needs its own splitter and source.
+	in, out             frameSplitter
+	inFaults, outFaults *faultSource
+
+	// pending are the frames read, faults injected, not returned by Read
+	// yet. readErr is the error the connection has returned.
+	pending []byte
+	readBuf []byte
+	readErr error
+}
+
+func newFaultyConn(conn net.Conn, clientID uint64) net.Conn {
+	key := fmt.Sprintf("%d", clientID)
+	in := newFaultSource(faultTargetClient, "in "+key)
+	if in == nil {
+		return conn
+	}
+
+	return &faultyConn{
+		Conn:      conn,
+		id:        clientID,
+		inFaults:  in,
+		outFaults: newFaultSource(faultTargetClient, "out "+key),
+		readBuf:   make([]byte, 32*1024),
+	}
+}
+
+// inject injects a fault in frame, a raw frame, before handing it to emit.
+func (c *faultyConn) inject(faults *faultSource, direction string, frame []byte,
+	emit func([]byte) error) error {
+	kind, delay := faults.next()
+	if kind != faultNone {
+		logf(1, logFields{"CLIENT_ID": fmt.Sprintf("%d", c.id)},
+			fmt.Sprintf("[client #%d] ", c.id), "fault injection: %s frame %s %v",
+			direction, kind, delay)
+	}
+
+	switch kind {
+	case faultDrop:
+		return nil
+	case faultDelay:
+		time.Sleep(delay)
+	case faultDuplicate:
+		if err := emit(frame); err != nil {
+			return err
+		}
+	case faultCorrupt:
+		// Flip a bit of the payload or, without one, of the opcode.
+		if headerLength := frameHeaderLength(frame); len(frame) > headerLength {
+			faults.corrupt(frame[headerLength:])
+		} else {
+			faults.corrupt(frame[frameOpcodeOffset : frameOpcodeOffset+1])
+		}
+	}
+
+	return emit(frame)
+}
+
+func (c *faultyConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		n, err := c.Conn.Read(c.readBuf)
+		c.readErr = err
+		c.in.add(c.readBuf[:n])
+		for frame := c.in.next(); frame != nil; frame = c.in.next() {
+			c.inject(c.inFaults, "<-", frame, func(frame []byte) error {
+				c.pending = append(c.pending, frame...)
+				return nil
+			})
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	c.out.add(b)
+	for frame := c.out.next(); frame != nil; frame = c.out.next() {
+		err := c.inject(c.outFaults, "->", frame, func(frame []byte) error {
+			_, err := c.Conn.Write(frame)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// sendToAgent sends the command name to hyperstart through h, injecting the
+// agent faults of vm.
+func (vm *vm) sendToAgent(h *hyperstart.Hyperstart, name string,
+	data []byte) (*hyperstart.DecodedMessage, error) {
+	if vm.faults == nil {
+		return h.SendCtlMessage(name, data)
+	}
+
+	kind, delay := vm.faults.next()
+	if kind == faultCorrupt && len(data) == 0 {
+		kind = faultNone
+	}
+	if kind != faultNone {
+		vm.infof(1, "ctl", "fault injection: %s %s %v", name, kind, delay)
+	}
+
+	switch kind {
+	case faultDrop:
+		// hyperstart never gets the command, and so never answers.
+		vm.onHyperTimeout(name)
+		return nil, newProxyError(api.ErrorCodeHyperTimeout,
+			"timeout waiting for hyperstart to answer %s (fault injection)", name)
+	case faultDelay:
+		time.Sleep(delay)
+	case faultDuplicate:
+		if _, err := h.SendCtlMessage(name, data); err != nil {
+			return nil, err
+		}
+	case faultCorrupt:
+		corrupted := make([]byte, len(data))
+		copy(corrupted, data)
+		vm.faults.corrupt(corrupted)
+		data = corrupted
+	}
+
+	return h.SendCtlMessage(name, data)
+}
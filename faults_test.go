@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultConfigValidate(t *testing.T) {
+	tests := []struct {
+		config faultConfig
+		valid  bool
+	}{
+		{faultConfig{}, true},
+		{faultConfig{Targets: []string{"client", "agent"}, Drop: 0.5, Corrupt: 0.5}, true},
+		{faultConfig{Delay: 0.1, MaxDelay: duration(time.Second)}, true},
+		{faultConfig{Targets: []string{"vm"}}, false},
+		{faultConfig{Drop: -0.1}, false},
+		{faultConfig{Duplicate: 1.5}, false},
+		{faultConfig{Drop: 0.6, Corrupt: 0.6}, false},
+		{faultConfig{Delay: 0.1}, false},
+		{faultConfig{MaxDelay: duration(-time.Second)}, false},
+	}
+
+	for _, test := range tests {
+		err := test.config.validate()
+		assert.Equal(t, test.valid, err == nil, "%+v: %v", test.config, err)
+	}
+}
+
+// setFaultInjection enables fault injection with config until the returned
+// function is called.
+func setFaultInjection(config *faultConfig) func() {
+	old := faultInjection
+	faultInjection = config
+	return func() {
+		faultInjection = old
+	}
+}
+
+func TestFaultSource(t *testing.T) {
+	defer setFaultInjection(&faultConfig{
+		Seed:      42,
+		Targets:   []string{faultTargetClient},
+		Drop:      0.25,
+		Delay:     0.25,
+		MaxDelay:  duration(time.Millisecond),
+		Duplicate: 0.25,
+	})()
+
+	assert.Nil(t, newFaultSource(faultTargetAgent, "foo"))
+
+	// The faults only depend on the seed and key.
+	a := newFaultSource(faultTargetClient, "foo")
+	b := newFaultSource(faultTargetClient, "foo")
+	c := newFaultSource(faultTargetClient, "bar")
+	same := true
+	counts := make(map[faultKind]int)
+	for i := 0; i < 1000; i++ {
+		kind, delay := a.next()
+		otherKind, otherDelay := b.next()
+		assert.Equal(t, kind, otherKind)
+		assert.Equal(t, delay, otherDelay)
+		assert.True(t, delay <= time.Millisecond)
+
+		if k, _ := c.next(); k != kind {
+			same = false
+		}
+		counts[kind]++
+	}
+	assert.False(t, same)
+
+	for _, kind := range []faultKind{faultNone, faultDrop, faultDelay, faultDuplicate} {
+		assert.InDelta(t, 250, counts[kind], 75, kind.String())
+	}
+	assert.Equal(t, 0, counts[faultCorrupt])
+}
+
+// faultyFrames writes frames through a faultyConn injecting faults as
+// configured, returning the frames its peer receives.
+func faultyFrames(t *testing.T, config *faultConfig, frames ...*api.Frame) []*api.Frame {
+	defer setFaultInjection(config)()
+
+	conn, peer, err := Socketpair()
+	assert.Nil(t, err)
+	defer peer.Close()
+
+	c := newFaultyConn(conn, 1)
+	for _, frame := range frames {
+		assert.Nil(t, api.WriteFrame(c, frame))
+	}
+	c.Close()
+
+	var received []*api.Frame
+	for {
+		frame, err := api.ReadFrame(peer)
+		if err != nil {
+			break
+		}
+		received = append(received, frame)
+	}
+	return received
+}
+
+func TestFaultyConnWrite(t *testing.T) {
+	frame := api.NewFrame(api.TypeStream, int(api.StreamStdout), []byte("stdout"))
+
+	// Without fault, frames go through untouched.
+	received := faultyFrames(t, &faultConfig{}, frame, frame)
+	assert.Equal(t, []*api.Frame{frame, frame}, received)
+
+	received = faultyFrames(t, &faultConfig{Drop: 1}, frame, frame)
+	assert.Empty(t, received)
+
+	received = faultyFrames(t, &faultConfig{Duplicate: 1}, frame)
+	assert.Equal(t, []*api.Frame{frame, frame}, received)
+
+	start := time.Now()
+	received = faultyFrames(t, &faultConfig{Delay: 1, MaxDelay: duration(time.Millisecond)},
+		frame)
+	assert.Equal(t, []*api.Frame{frame}, received)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// A single bit of the payload is flipped.
+	received = faultyFrames(t, &faultConfig{Corrupt: 1}, frame)
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, frame.Header, received[0].Header)
+	assert.Equal(t, len(frame.Payload), len(received[0].Payload))
+	assert.NotEqual(t, frame.Payload, received[0].Payload)
+}
+
+func TestFaultyConnRead(t *testing.T) {
+	defer setFaultInjection(&faultConfig{Duplicate: 1})()
+
+	conn, peer, err := Socketpair()
+	assert.Nil(t, err)
+	c := newFaultyConn(conn, 1)
+
+	frame := api.NewFrame(api.TypeCommand, int(api.CmdStats), []byte("{}"))
+	assert.Nil(t, api.WriteFrame(peer, frame))
+	peer.Close()
+
+	for i := 0; i < 2; i++ {
+		received, err := api.ReadFrame(c)
+		assert.Nil(t, err)
+		assert.Equal(t, frame, received)
+	}
+	_, err = api.ReadFrame(c)
+	assert.NotNil(t, err)
+
+	c.Close()
+}
+
+func TestFaultInjectionAgent(t *testing.T) {
+	defer setFaultInjection(&faultConfig{
+		Targets: []string{faultTargetAgent},
+		Drop:    1,
+	})()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	var notifications []api.Notification
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		notifications = append(notifications, n)
+	})
+
+	rig.RegisterVM()
+
+	// The command never reaches hyperstart, as if it had timed out. ping
+	// is retried, and dropped again.
+	err := rig.Client.Hyper("ping", nil)
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	assert.Equal(t, api.ErrorCodeHyperTimeout, proxyErr.Code)
+	assert.Equal(t, 1+hyperRetries, len(notifications))
+	for _, n := range notifications {
+		assert.Equal(t, api.Notification(api.NotificationHyperTimeout), n)
+	}
+	assert.Empty(t, rig.Hyperstart.GetLastMessages())
+
+	rig.Stop()
+}
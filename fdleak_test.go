@@ -280,10 +280,11 @@ func TestFdDetectorLeak(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err = os.Open("/dev/null")
+	f, err := os.Open("/dev/null")
 	if err != nil {
 		t.Error(err)
 	}
+	defer f.Close()
 
 	new, err := detector.Snapshot()
 	if err != nil {
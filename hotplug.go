@@ -0,0 +1,134 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+)
+
+// Hotplug plugs cpus vCPUs and memoryMB MiB of memory into the VM through QMP,
+// then has hyperstart online them. It returns the number of vCPUs of the VM
+// once the guest has onlined the new resources, and the time spent waiting
+// for hyperstart.
+func (vm *vm) Hotplug(cpus, memoryMB int) (int, time.Duration, error) {
+	if cpus < 0 || memoryMB < 0 || cpus+memoryMB == 0 {
+		return 0, 0, fmt.Errorf("hotplug: invalid request for %d vCPUs and %d MiB",
+			cpus, memoryMB)
+	}
+
+	if err := vm.checkHealth(); err != nil {
+		return 0, 0, err
+	}
+
+	if err := vm.checkHyperCommand(hyperapi.CmdOnlineCPUMem); err != nil {
+		return 0, 0, err
+	}
+
+	vm.Lock()
+	q := vm.qmp
+	vm.Unlock()
+
+	if q == nil {
+		return 0, 0, fmt.Errorf("VM %s wasn't registered with a QMP socket", vm.containerID)
+	}
+
+	vcpus, err := q.countCPUs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// vCPUs are numbered from 0, the new ones follow the existing ones.
+	for i := 0; i < cpus; i++ {
+		if err := q.executeArgs("cpu-add", map[string]interface{}{
+			"id": vcpus,
+		}, nil); err != nil {
+			return 0, 0, err
+		}
+		vcpus++
+	}
+
+	if memoryMB > 0 {
+		vm.Lock()
+		slot := vm.nextDIMM
+		vm.nextDIMM++
+		vm.Unlock()
+
+		memdev := fmt.Sprintf("mem%d", slot)
+		if err := q.executeArgs("object-add", map[string]interface{}{
+			"qom-type": "memory-backend-ram",
+			"id":       memdev,
+			"props": map[string]interface{}{
+				"size": uint64(memoryMB) << 20,
+			},
+		}, nil); err != nil {
+			return 0, 0, err
+		}
+
+		if err := q.executeArgs("device_add", map[string]interface{}{
+			"driver": "pc-dimm",
+			"id":     fmt.Sprintf("dimm%d", slot),
+			"memdev": memdev,
+		}, nil); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	vm.infof(1, "qmp", "hotplugged %d vCPUs and %d MiB", cpus, memoryMB)
+
+	start := time.Now()
+	_, err = vm.sendCtlMessageRetry(hyperapi.CmdOnlineCPUMem, nil)
+	hyperTime := time.Since(start)
+	if err != nil {
+		return 0, hyperTime, err
+	}
+
+	return vcpus, hyperTime, nil
+}
+
+// "Hotplug"
+func hotplug(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+	payload := api.Hotplug{}
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.vms[payload.ContainerID]
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetErrorf("unknown containerID: %s", payload.ContainerID)
+		return
+	}
+
+	client.infof(1, "Hotplug(containerId=%s,cpus=%d,memoryMB=%d)", payload.ContainerID,
+		payload.CPUs, payload.MemoryMB)
+
+	vcpus, hyperTime, err := vm.Hotplug(payload.CPUs, payload.MemoryMB)
+	response.hyperTime = hyperTime
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+	response.AddResult("vcpus", vcpus)
+}
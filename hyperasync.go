@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// errCancelled is the error of the hyper command name cancelled with
+// CmdCancel.
+func errCancelled(name string) error {
+	return newProxyError(api.ErrorCodeCancelled, "%s cancelled", name)
+}
+
+// operation is a Hyper.Async command in flight.
+type operation struct {
+	// client is the ID of the client that sent the command, the only one
+	// allowed to cancel it.
+	client uint64
+	// Closing cancel cancels the command.
+	cancel chan interface{}
+}
+
+// SendMessageAsync sends the hyper command, marked with Hyper.Async, in the
+// background. The checks done before forwarding the command are still done
+// synchronously and their errors returned. Once hyperstart has answered, the
+// clients attached to the VM receive a NotificationHyperCompleted carrying the
+// returned operation ID. Only the client clientID can cancel the operation.
+// done, if not nil, is called once the command has completed, or straight
+// away if it couldn't be sent.
+func (vm *vm) SendMessageAsync(hyper *api.Hyper, clientID uint64, done func()) (uint64, error) {
+	if err := vm.prepareMessage(hyper); err != nil {
+		if done != nil {
+			done()
+		}
+		return 0, err
+	}
+
+	cancel := make(chan interface{})
+
+	vm.Lock()
+	id := vm.nextOperation
+	vm.nextOperation++
+	vm.operations[id] = &operation{
+		client: clientID,
+		cancel: cancel,
+	}
+	vm.Unlock()
+
+	vm.spawn(func() {
+		_, err := vm.sendMessage(hyper, cancel)
+
+		vm.Lock()
+		delete(vm.operations, id)
+		vm.Unlock()
+
+		if done != nil {
+			done()
+		}
+
+		completed := &api.HyperCompleted{
+			ContainerID: vm.containerID,
+			OperationID: id,
+			HyperName:   hyper.HyperName,
+		}
+		if err != nil {
+			vm.infof(1, "ctl", "async %s (operation %d) failed: %v", hyper.HyperName, id, err)
+			completed.Error = err.Error()
+			completed.Code = errorCode(err)
+		}
+		vm.notify(api.NotificationHyperCompleted, completed)
+	})
+
+	return id, nil
+}
+
+// CancelOperation cancels the Hyper.Async command id on behalf of the client
+// clientID, see api.Cancel. Clients can only cancel their own operations.
+func (vm *vm) CancelOperation(id, clientID uint64) error {
+	vm.Lock()
+	defer vm.Unlock()
+
+	op := vm.operations[id]
+	if op == nil {
+		return fmt.Errorf("no operation %d in flight for VM %s", id, vm.containerID)
+	}
+	if op.client != clientID {
+		return newProxyError(api.ErrorCodeForbidden,
+			"operation %d of VM %s belongs to another client", id, vm.containerID)
+	}
+	delete(vm.operations, id)
+	close(op.cancel)
+
+	return nil
+}
+
+// "Cancel"
+func cancel(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+	payload := api.Cancel{}
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.vms[payload.ContainerID]
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetErrorf("unknown containerID: %s", payload.ContainerID)
+		return
+	}
+
+	client.infof(1, "Cancel(containerId=%s,operationId=%d)", payload.ContainerID,
+		payload.OperationID)
+
+	if err := vm.CancelOperation(payload.OperationID, client.id); err != nil {
+		response.SetError(err)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+)
+
+// defaultHyperstartVersion is the hyperstart protocol version assumed when
+// RegisterVM doesn't give one.
+const defaultHyperstartVersion = "0.7"
+
+// autoHyperstartVersion, given as RegisterVM.HyperstartVersion, makes the proxy
+// negotiate the protocol version with the agent.
+const autoHyperstartVersion = "auto"
+
+// hyperstartAPIVersions maps the API versions reported by hyperstart's version
+// command to the protocol versions the proxy knows, oldest first: a version is
+// spoken with agents reporting at least minAPIVersion.
+var hyperstartAPIVersions = []struct {
+	version       string
+	minAPIVersion int
+}{
+	{"0.7", 0},
+}
+
+// hyperstartCommands lists, per hyperstart protocol version, the commands
+// clients can send with Hyper. The proxy rewrites some of their payloads so
+// only the versions it knows the format of are accepted.
+//
+// ready, ack, error and next are messages hyperstart sends to the host, not
+// commands, and are never forwarded.
+var hyperstartCommands = map[string]map[string]bool{
+	"0.7": {
+		hyperapi.CmdVersion:         true,
+		hyperapi.CmdStartPod:        true,
+		hyperapi.CmdDestroyPod:      true,
+		hyperapi.CmdExecCmd:         true,
+		hyperapi.CmdWinsize:         true,
+		hyperapi.CmdPing:            true,
+		hyperapi.CmdWriteFile:       true,
+		hyperapi.CmdReadFile:        true,
+		hyperapi.CmdNewContainer:    true,
+		hyperapi.CmdKillContainer:   true,
+		hyperapi.CmdOnlineCPUMem:    true,
+		hyperapi.CmdSetupInterface:  true,
+		hyperapi.CmdSetupRoute:      true,
+		hyperapi.CmdRemoveContainer: true,
+	},
+}
+
+func checkHyperstartVersion(version string) error {
+	if version == autoHyperstartVersion {
+		return nil
+	}
+	if _, ok := hyperstartCommands[version]; !ok {
+		return fmt.Errorf("unsupported hyperstart version %q", version)
+	}
+	return nil
+}
+
+// checkHyperCommand returns an error when the hyperstart running in vm
+// doesn't support the name command, saving a round trip to the VM and the
+// opaque error hyperstart would answer.
+func (vm *vm) checkHyperCommand(name string) error {
+	version := vm.protocolVersion()
+	if !hyperstartCommands[version][name] {
+		return newProxyError(api.ErrorCodeUnsupportedCommand,
+			"hyperstart %s doesn't support the %s command", version, name)
+	}
+	return nil
+}
+
+// protocolVersion returns the version of the hyperstart protocol spoken with
+// the agent of vm.
+func (vm *vm) protocolVersion() string {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.hyperstartVersion
+}
+
+// apiVersionProtocol returns the newest protocol version the proxy can speak
+// with an agent reporting apiVersion.
+func apiVersionProtocol(apiVersion int) string {
+	version := hyperstartAPIVersions[0].version
+	for _, v := range hyperstartAPIVersions {
+		if apiVersion >= v.minAPIVersion {
+			version = v.version
+		}
+	}
+	return version
+}
+
+// queryAPIVersion asks the agent of vm for its API version, 0 if it answers
+// without one.
+func (vm *vm) queryAPIVersion() (int, error) {
+	msg, err := vm.sendCtlMessageRetry(hyperapi.CmdVersion, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// hyperstart answers with its API version as a big endian uint32.
+	if msg == nil || len(msg.Message) < 4 {
+		return 0, nil
+	}
+	return int(binary.BigEndian.Uint32(msg.Message)), nil
+}
+
+// negotiateVersion picks the hyperstart protocol version spoken with the agent
+// of vm, registered with autoHyperstartVersion, from the API version it reports.
+// Agents not answering the version command are assumed to be the oldest
+// hyperstart the proxy knows.
+func (vm *vm) negotiateVersion() {
+	apiVersion, err := vm.queryAPIVersion()
+	version := apiVersionProtocol(apiVersion)
+	if err != nil {
+		version = hyperstartAPIVersions[0].version
+		vm.infof(1, "hyperstart", "couldn't query agent version, assuming %s: %v",
+			version, err)
+	}
+
+	vm.Lock()
+	vm.hyperstartVersion = version
+	vm.agentAPIVersion = apiVersion
+	vm.Unlock()
+
+	vm.infof(1, "hyperstart", "negotiated hyperstart %s with API version %d",
+		version, apiVersion)
+}
+
+// probeAgent checks the agent of vm answers a ping and queries its version,
+// returning what the proxy knows of its capabilities.
+func (vm *vm) probeAgent() *api.AgentInfo {
+	agent := &api.AgentInfo{
+		HyperstartVersion: vm.protocolVersion(),
+	}
+	for name := range hyperstartCommands[agent.HyperstartVersion] {
+		agent.Commands = append(agent.Commands, name)
+	}
+	sort.Strings(agent.Commands)
+
+	_, err := vm.sendCtlMessageRetry(hyperapi.CmdPing, nil)
+	if err == nil {
+		agent.APIVersion, err = vm.queryAPIVersion()
+	}
+	if err != nil {
+		vm.infof(1, "hyperstart", "couldn't probe agent: %v", err)
+		return agent
+	}
+
+	agent.Responsive = true
+	vm.infof(1, "hyperstart", "agent speaks hyperstart %s, API version %d",
+		agent.HyperstartVersion, agent.APIVersion)
+
+	return agent
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// idleTimeout is how long a process can go without I/O, while hyperstart
+// doesn't answer pings either, before the clients attached to the VM receive
+// a ProcessIdle notification. 0 disables idle detection.
+var idleTimeout time.Duration
+
+// Special values of ioSession.lastActivity.
+const (
+	activityNotStarted = 0
+	activityExited     = -1
+)
+
+// touch records the process of session has had some activity at now.
+func (session *ioSession) touch(now time.Time) {
+	atomic.StoreInt64(&session.lastActivity, now.UnixNano())
+}
+
+// processExited records the process of session has exited. It isn't
+// considered for idle detection anymore.
+func (session *ioSession) processExited() {
+	atomic.StoreInt64(&session.lastActivity, activityExited)
+}
+
+// lastActivityTime returns when the process of session last had some
+// activity. It returns false if the process isn't running.
+func (session *ioSession) lastActivityTime() (time.Time, bool) {
+	last := atomic.LoadInt64(&session.lastActivity)
+	if last == activityNotStarted || last == activityExited {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, last), true
+}
+
+// pingAnswered records hyperstart has answered a ping at now.
+func (vm *vm) pingAnswered(now time.Time) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	vm.lastPing = now
+}
+
+// watchIdle periodically looks for idle processes until stopIdleWatch is
+// closed.
+func (vm *vm) watchIdle() {
+	defer vm.wg.Done()
+
+	period := idleTimeout / 4
+	if period < time.Millisecond {
+		period = time.Millisecond
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	var notified map[*ioSession]bool
+	for {
+		select {
+		case <-vm.stopIdleWatch:
+			return
+		case now := <-ticker.C:
+			notified = vm.checkIdle(now, notified)
+		}
+	}
+}
+
+// checkIdle sends a ProcessIdle notification for the processes that have
+// become idle at now. notified holds the sessions already reported as idle,
+// the sessions still idle are returned.
+func (vm *vm) checkIdle(now time.Time, notified map[*ioSession]bool) map[*ioSession]bool {
+	vm.Lock()
+	lastPing := vm.lastPing
+	sessions := make([]*ioSession, 0, len(vm.tokenToSession))
+	for _, session := range vm.tokenToSession {
+		sessions = append(sessions, session)
+	}
+	vm.Unlock()
+
+	// A VM answering pings isn't hung, whatever its processes do.
+	if now.Sub(lastPing) < idleTimeout {
+		return nil
+	}
+
+	idle := make(map[*ioSession]bool)
+	for _, session := range sessions {
+		last, running := session.lastActivityTime()
+		if !running || now.Sub(last) < idleTimeout {
+			continue
+		}
+
+		idle[session] = true
+		if notified[session] {
+			continue
+		}
+
+		vm.infof(1, "io", "process with token %s idle since %s", session.token, last)
+
+		payload := &api.ProcessIdle{
+			ContainerID:  vm.containerID,
+			Token:        string(session.token),
+			LastActivity: last,
+		}
+		if !lastPing.IsZero() {
+			payload.LastPing = &lastPing
+		}
+		vm.notify(api.NotificationProcessIdle, payload)
+	}
+
+	return idle
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckIdle(t *testing.T) {
+	oldTimeout := idleTimeout
+	idleTimeout = time.Minute
+	defer func() {
+		idleTimeout = oldTimeout
+	}()
+
+	vm := newVM(testContainerID, "", "")
+	token, err := vm.AllocateToken()
+	assert.Nil(t, err)
+	session := vm.findSessionByToken(token)
+	now := time.Now()
+
+	// Processes that haven't started aren't idle.
+	idle := vm.checkIdle(now, nil)
+	assert.Equal(t, 0, len(idle))
+
+	session.touch(now.Add(-30 * time.Second))
+	idle = vm.checkIdle(now, idle)
+	assert.Equal(t, 0, len(idle))
+
+	session.touch(now.Add(-2 * time.Minute))
+	idle = vm.checkIdle(now, idle)
+	assert.True(t, idle[session])
+
+	// A VM answering pings isn't hung.
+	vm.pingAnswered(now.Add(-time.Second))
+	idle = vm.checkIdle(now, idle)
+	assert.Equal(t, 0, len(idle))
+
+	vm.pingAnswered(now.Add(-2 * time.Minute))
+	idle = vm.checkIdle(now, idle)
+	assert.True(t, idle[session])
+
+	// Exited processes aren't idle.
+	session.processExited()
+	idle = vm.checkIdle(now, idle)
+	assert.Equal(t, 0, len(idle))
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/api/hyperstart/agentmock"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAgentMockExec runs a process from registration to exit against the fake
+// hyperstart of the agentmock package, which speaks the wire protocol rather
+// than being driven message by message like the hyperstart mock.
+func TestAgentMockExec(t *testing.T) {
+	rig := newTestRig(t)
+	startFds, err := rig.detector.Snapshot()
+	assert.Nil(t, err)
+
+	agent, err := agentmock.New()
+	assert.Nil(t, err)
+	rig.Client = goapi.NewClient(rig.ServeNewClient().(*net.UnixConn))
+
+	// Register the VM, the agent is probed.
+	ret, err := rig.Client.RegisterVM(testContainerID, agent.CtlSocketPath(),
+		agent.IoSocketPath(), &goapi.RegisterVMOptions{
+			NumIOStreams: 1,
+			ProbeAgent:   true,
+		})
+	assert.Nil(t, err)
+	assert.True(t, ret.Agent.Responsive)
+	assert.Equal(t, agentmock.APIVersion, ret.Agent.APIVersion)
+	token := ret.IO.Tokens[0]
+
+	shim := newShimRig(t, rig.ServeNewClient(), token)
+	err = shim.connect()
+	assert.Nil(t, err)
+	session := peekIOSession(rig.proxy, token)
+
+	// Start a process, its streams are the ones of the session.
+	err = rig.Client.HyperWithTokens("execcmd", []string{token},
+		&hyperstart.ExecCommand{
+			Container: testContainerID,
+			Process: hyperstart.Process{
+				Args: []string{"/bin/sh"},
+			},
+		})
+	assert.Nil(t, err)
+	process, err := agent.WaitProcess(5 * time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, testContainerID, process.Container)
+	assert.Equal(t, session.ioBase, process.Spec.Stdio)
+	assert.Equal(t, session.ioBase+1, process.Spec.Stderr)
+
+	// stdin.
+	shim.writeIOString("stdin\n")
+	buf := make([]byte, 32)
+	n, err := process.ReadStdin(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "stdin\n", string(buf[:n]))
+
+	// stdout and stderr.
+	err = process.SendStdout([]byte("stdout\n"))
+	assert.Nil(t, err)
+	frame := shim.readIOStream()
+	assert.Equal(t, api.StreamStdout, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, "stdout\n", string(frame.Payload))
+
+	err = process.SendStderr([]byte("stderr\n"))
+	assert.Nil(t, err)
+	frame = shim.readIOStream()
+	assert.Equal(t, api.StreamStderr, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, "stderr\n", string(frame.Payload))
+
+	// And the exit status.
+	err = process.Exit(42)
+	assert.Nil(t, err)
+	frame, err = api.ReadFrame(shim.conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.TypeNotification, frame.Header.Type)
+	assert.Equal(t, api.NotificationProcessExited, frame.Header.Opcode)
+	assert.Equal(t, []byte{42}, frame.Payload)
+
+	// Stopping the agent first lets the proxy tear down the VM without
+	// waiting for the ctl channel to time out.
+	shim.close()
+	agent.Close()
+	err = rig.Client.UnregisterVM(testContainerID)
+	assert.Nil(t, err)
+
+	rig.Client.Close()
+	for _, conn := range rig.proxyConns {
+		conn.Close()
+	}
+	rig.wg.Wait()
+	rig.proxy.wg.Wait()
+
+	stopFds, err := rig.detector.Snapshot()
+	assert.Nil(t, err)
+	assert.True(t, rig.detector.Compare(os.Stdout, startFds, stopFds))
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// journalSocketPath is where journald listens for native protocol messages.
+var journalSocketPath = "/run/systemd/journal/socket"
+
+const journalIdentifier = "cc-proxy"
+
+// journalBackend sends log messages to journald using its native protocol so
+// the fields are stored alongside the message and can be queried, eg.:
+//
+//	journalctl CONTAINER_ID=756535dc6e9ab9b560f84c8...
+//
+// See https://www.freedesktop.org/wiki/Software/systemd/export/ for the
+// description of the format.
+type journalBackend struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func newJournalBackend() (*journalBackend, error) {
+	addr := &net.UnixAddr{
+		Name: journalSocketPath,
+		Net:  "unixgram",
+	}
+
+	if _, err := os.Stat(journalSocketPath); err != nil {
+		return nil, fmt.Errorf("couldn't find journald socket: %v", err)
+	}
+
+	// An unconnected socket so we can use WriteMsgUnix to send file
+	// descriptors along with the datagrams.
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create journald socket: %v", err)
+	}
+
+	return &journalBackend{
+		conn: conn,
+		addr: addr,
+	}, nil
+}
+
+// appendJournalField appends a KEY=value field to buf. Values containing new
+// lines need to use the binary encoding of the native protocol.
+func appendJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// encodeJournalEntry encodes a log message, recording as its code location
+// the caller depth stack frames above encodeJournalEntry's caller.
+func encodeJournalEntry(depth int, priority logPriority, fields logFields, msg string) []byte {
+	var buf bytes.Buffer
+
+	appendJournalField(&buf, "MESSAGE", msg)
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(int(priority)))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", journalIdentifier)
+	if pc, file, line, ok := runtime.Caller(depth + 1); ok {
+		appendJournalField(&buf, "CODE_FILE", file)
+		appendJournalField(&buf, "CODE_LINE", strconv.Itoa(line))
+		if f := runtime.FuncForPC(pc); f != nil {
+			appendJournalField(&buf, "CODE_FUNC", f.Name())
+		}
+	}
+	for key, value := range fields {
+		appendJournalField(&buf, key, value)
+	}
+
+	return buf.Bytes()
+}
+
+func (j *journalBackend) log(depth int, priority logPriority, fields logFields, prefix, msg string) {
+	data := encodeJournalEntry(depth+1, priority, fields, msg)
+
+	_, _, err := j.conn.WriteMsgUnix(data, nil, j.addr)
+	if err == nil {
+		return
+	}
+
+	// The entry doesn't fit in a datagram, journald accepts a file
+	// descriptor to a (sealed or deleted) file holding the data instead.
+	if isMsgTooBig(err) {
+		if err = j.sendAsFile(data); err == nil {
+			return
+		}
+	}
+
+	// Don't lose the log message if journald is unhappy.
+	glogBackend{}.log(depth+1, priority, fields, prefix, msg)
+}
+
+func isMsgTooBig(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+
+	return sysErr.Err == syscall.EMSGSIZE || sysErr.Err == syscall.ENOBUFS
+}
+
+func (j *journalBackend) sendAsFile(data []byte) error {
+	file, err := ioutil.TempFile("/dev/shm", "cc-proxy-journal.")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+
+	rights := syscall.UnixRights(int(file.Fd()))
+	_, _, err = j.conn.WriteMsgUnix(nil, rights, j.addr)
+	return err
+}
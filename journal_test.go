@@ -0,0 +1,82 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalFieldEncoding(t *testing.T) {
+	var buf bytes.Buffer
+
+	appendJournalField(&buf, "FOO", "bar")
+	assert.Equal(t, "FOO=bar\n", buf.String())
+
+	buf.Reset()
+	appendJournalField(&buf, "FOO", "multi\nline")
+	data := buf.Bytes()
+	assert.Equal(t, "FOO\n", string(data[:4]))
+	assert.Equal(t, uint64(10), binary.LittleEndian.Uint64(data[4:12]))
+	assert.Equal(t, "multi\nline\n", string(data[12:]))
+}
+
+func TestJournalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-journal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Fake journald socket.
+	oldPath := journalSocketPath
+	journalSocketPath = filepath.Join(dir, "socket")
+	defer func() { journalSocketPath = oldPath }()
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
+		Name: journalSocketPath,
+		Net:  "unixgram",
+	})
+	assert.Nil(t, err)
+	defer server.Close()
+
+	journal, err := newJournalBackend()
+	assert.Nil(t, err)
+	defer journal.conn.Close()
+
+	_, file, line, _ := runtime.Caller(0)
+	journal.log(0, logPriorityInfo, logFields{"CONTAINER_ID": "foo"}, "[prefix] ", "hello")
+
+	buf := make([]byte, 1024)
+	n, err := server.Read(buf)
+	assert.Nil(t, err)
+	entry := string(buf[:n])
+	assert.Contains(t, entry, "MESSAGE=hello\n")
+	assert.Contains(t, entry, "PRIORITY=6\n")
+	assert.Contains(t, entry, "CONTAINER_ID=foo\n")
+	assert.Contains(t, entry, "SYSLOG_IDENTIFIER=cc-proxy\n")
+
+	// The code location is the one of the caller of the backend.
+	assert.Contains(t, entry, "CODE_FILE="+file+"\n")
+	assert.Contains(t, entry, "CODE_LINE="+strconv.Itoa(line+1)+"\n")
+	assert.Contains(t, entry, ".TestJournalBackend\n")
+}
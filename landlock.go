@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,go1.16
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// landlock system calls, the same on all architectures.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+)
+
+// Filesystem access rights, see linux/landlock.h.
+const (
+	landlockAccessFSExecute = 1 << iota
+	landlockAccessFSWriteFile
+	landlockAccessFSReadFile
+	landlockAccessFSReadDir
+	landlockAccessFSRemoveDir
+	landlockAccessFSRemoveFile
+	landlockAccessFSMakeChar
+	landlockAccessFSMakeDir
+	landlockAccessFSMakeReg
+	landlockAccessFSMakeSock
+	landlockAccessFSMakeFifo
+	landlockAccessFSMakeBlock
+	landlockAccessFSMakeSym
+	landlockAccessFSRefer
+	landlockAccessFSTruncate
+)
+
+const (
+	// landlockFileAccess are the rights that apply to files, as opposed
+	// to directories.
+	landlockFileAccess = landlockAccessFSExecute | landlockAccessFSWriteFile |
+		landlockAccessFSReadFile | landlockAccessFSTruncate
+	landlockReadAccess = landlockAccessFSReadFile | landlockAccessFSReadDir
+)
+
+// landlockSupported is true when the proxy can confine itself with landlock,
+// provided the kernel supports it.
+const landlockSupported = true
+
+// landlockHandledAccess returns the rights the landlock ABI version abi can
+// restrict.
+func landlockHandledAccess(abi int) uint64 {
+	access := uint64(landlockAccessFSMakeSym<<1 - 1)
+	if abi >= 2 {
+		access |= landlockAccessFSRefer
+	}
+	if abi >= 3 {
+		access |= landlockAccessFSTruncate
+	}
+	return access
+}
+
+func landlockABI() (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0,
+		landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(abi), nil
+}
+
+// landlockAllow allows access to what's beneath path in the ruleset
+// rulesetFd.
+func landlockAllow(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+
+	// struct landlock_path_beneath_attr is packed.
+	var attr [12]byte
+	*(*uint64)(unsafe.Pointer(&attr[0])) = access
+	*(*int32)(unsafe.Pointer(&attr[8])) = int32(fd)
+
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd),
+		landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("%s: %v", path, errno)
+	}
+
+	return nil
+}
+
+// landlockRestrict restricts the filesystem accesses of all the threads of
+// the proxy to what's beneath the paths rw, read and written, and ro, only
+// read. It returns the landlock ABI version enforced.
+func landlockRestrict(rw, ro []string) (int, error) {
+	abi, err := landlockABI()
+	if err != nil {
+		return 0, fmt.Errorf("not supported by the kernel: %v", err)
+	}
+	handled := landlockHandledAccess(abi)
+
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("couldn't create ruleset: %v", errno)
+	}
+	defer unix.Close(int(fd))
+
+	for _, path := range rw {
+		err := landlockAllow(int(fd), path, handled&^landlockAccessFSExecute)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, path := range ro {
+		if err := landlockAllow(int(fd), path, landlockReadAccess); err != nil {
+			return 0, err
+		}
+	}
+
+	// Both calls fail with ENOTSUP when cc-proxy is built with cgo.
+	_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("couldn't set no_new_privs: %v", errno)
+	}
+	_, _, errno = syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("couldn't restrict the proxy: %v", errno)
+	}
+
+	return abi, nil
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux !go1.16
+
+package main
+
+import (
+	"errors"
+)
+
+const landlockSupported = false
+
+// Confining all the threads of a go program needs syscall.AllThreadsSyscall,
+// added in go 1.16.
+func landlockRestrict(rw, ro []string) (int, error) {
+	return 0, errors.New("cc-proxy needs to be built with go 1.16 or later")
+}
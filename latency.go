@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets. An
+// extra bucket counts the latencies above the last bound.
+var latencyBounds = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// histogram is a latency histogram.
+type histogram struct {
+	sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// latencyBucket is a cumulative histogram bucket: Count latencies were lower
+// or equal to LE seconds. The last bucket has LE set to "+Inf".
+type latencyBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// latencySnapshot is the JSON representation of a histogram.
+type latencySnapshot struct {
+	Count   uint64          `json:"count"`
+	Sum     float64         `json:"sumSeconds"`
+	Max     float64         `json:"maxSeconds"`
+	Buckets []latencyBucket `json:"buckets"`
+}
+
+func (h *histogram) snapshot() latencySnapshot {
+	h.Lock()
+	defer h.Unlock()
+
+	s := latencySnapshot{
+		Count:   h.count,
+		Sum:     h.sum.Seconds(),
+		Max:     h.max.Seconds(),
+		Buckets: make([]latencyBucket, len(h.counts)),
+	}
+
+	var cumulated uint64
+	for i, n := range h.counts {
+		cumulated += n
+		le := "+Inf"
+		if i < len(latencyBounds) {
+			le = fmt.Sprint(latencyBounds[i].Seconds())
+		}
+		s.Buckets[i] = latencyBucket{le, cumulated}
+	}
+
+	return s
+}
+
+// latencies is a set of histograms, indexed by name.
+type latencies struct {
+	sync.Mutex
+	histograms map[string]*histogram
+}
+
+func newLatencies() *latencies {
+	return &latencies{
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (l *latencies) observe(name string, d time.Duration) {
+	l.Lock()
+	h := l.histograms[name]
+	if h == nil {
+		h = newHistogram()
+		l.histograms[name] = h
+	}
+	l.Unlock()
+
+	h.observe(d)
+}
+
+func (l *latencies) snapshot() map[string]latencySnapshot {
+	l.Lock()
+	defer l.Unlock()
+
+	s := make(map[string]latencySnapshot, len(l.histograms))
+	for name, h := range l.histograms {
+		s[name] = h.snapshot()
+	}
+
+	return s
+}
+
+var (
+	// commandLatencies is the time spent by the proxy processing
+	// commands, indexed by command name. The time spent waiting for
+	// hyperstart to answer is accounted in hyperLatencies instead.
+	commandLatencies = newLatencies()
+	// hyperLatencies is the hyperstart round trip time, indexed by hyper
+	// command name.
+	hyperLatencies = newLatencies()
+)
+
+// publishLatencies exposes the latency histograms as the "commandLatencies"
+// and "hyperLatencies" expvars.
+func publishLatencies() {
+	expvar.Publish("commandLatencies", expvar.Func(func() interface{} {
+		return commandLatencies.snapshot()
+	}))
+	expvar.Publish("hyperLatencies", expvar.Func(func() interface{} {
+		return hyperLatencies.snapshot()
+	}))
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+
+	h.observe(50 * time.Microsecond)
+	h.observe(100 * time.Microsecond)
+	h.observe(3 * time.Millisecond)
+	h.observe(time.Minute)
+
+	s := h.snapshot()
+	assert.Equal(t, uint64(4), s.Count)
+	assert.Equal(t, time.Minute.Seconds(), s.Max)
+	assert.Equal(t, len(latencyBounds)+1, len(s.Buckets))
+
+	// Buckets are cumulative.
+	assert.Equal(t, latencyBucket{"0.0001", 2}, s.Buckets[0])
+	assert.Equal(t, latencyBucket{"0.0025", 2}, s.Buckets[4])
+	assert.Equal(t, latencyBucket{"0.005", 3}, s.Buckets[5])
+	assert.Equal(t, latencyBucket{"30", 3}, s.Buckets[len(latencyBounds)-1])
+	assert.Equal(t, latencyBucket{"+Inf", 4}, s.Buckets[len(latencyBounds)])
+}
+
+func TestLatencies(t *testing.T) {
+	l := newLatencies()
+
+	l.observe("foo", time.Millisecond)
+	l.observe("foo", time.Millisecond)
+	l.observe("bar", time.Second)
+
+	s := l.snapshot()
+	assert.Equal(t, 2, len(s))
+	assert.Equal(t, uint64(2), s["foo"].Count)
+	assert.Equal(t, uint64(1), s["bar"].Count)
+	assert.Equal(t, time.Second.Seconds(), s["bar"].Sum)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// Per connection limits protecting the proxy, and the other clients, from
+// misbehaving clients. Clients going over one of them are disconnected. 0
+// disables a limit.
+var (
+	// maxFrameRate is the number of frames per second a client can send,
+	// in bursts of up to one second worth of frames.
+	maxFrameRate int
+	// maxInFlight is the number of asynchronous hyper commands a client
+	// can have in flight.
+	maxInFlight int
+	// maxQueuedBytes is the amount of stdin and output data, in bytes,
+	// that can be queued for all the I/O sessions of a client.
+	maxQueuedBytes int
+	// maxConnsPerUID is the number of connections the processes of a
+	// user, or the remote clients with a TLS identity, can have open at
+	// once. Connections over the limit are closed straight away.
+	maxConnsPerUID int
+)
+
+// clientLimits tracks how close a client is to the per connection limits.
+type clientLimits struct {
+	// frames rate limits the frames sent by the client, nil when
+	// unlimited.
+	frames *tokenBucket
+	// inFlight is the number of asynchronous hyper commands started by
+	// the client still running. It's accessed atomically.
+	inFlight int32
+	// queued accounts for the bytes queued in the I/O sessions of the
+	// client.
+	queued *queueQuota
+}
+
+func newClientLimits() clientLimits {
+	return clientLimits{
+		frames: newTokenBucket(rateLimit{rate: maxFrameRate}),
+		queued: &queueQuota{limit: int64(maxQueuedBytes)},
+	}
+}
+
+// queueQuota accounts for the bytes queued in the stdin and output queues of
+// the I/O sessions of a client, see maxQueuedBytes.
+type queueQuota struct {
+	// size is the number of bytes queued. It's accessed atomically.
+	size  int64
+	limit int64
+
+	// exceeded, if not nil, is called once when size goes over limit.
+	exceeded func(size int64)
+	once     sync.Once
+}
+
+// add accounts for n more bytes queued, n being negative when bytes leave
+// the queues.
+func (q *queueQuota) add(n int) {
+	if q == nil {
+		return
+	}
+
+	size := atomic.AddInt64(&q.size, int64(n))
+	if n > 0 && q.limit > 0 && size > q.limit && q.exceeded != nil {
+		q.once.Do(func() {
+			q.exceeded(size)
+		})
+	}
+}
+
+// queued returns the number of bytes queued in the I/O sessions of client.
+func (client *client) queued() int {
+	return int(atomic.LoadInt64(&client.limits.queued.size))
+}
+
+// attachSession accounts for the bytes queued in session to client.
+func (client *client) attachSession(session *ioSession) {
+	if session.input != nil {
+		session.input.setQuota(client.limits.queued)
+	}
+	if session.output != nil {
+		session.output.setQuota(client.limits.queued)
+	}
+}
+
+// detachSession undoes attachSession.
+func (client *client) detachSession(session *ioSession) {
+	if session.input != nil {
+		session.input.setQuota(nil)
+	}
+	if session.output != nil {
+		session.output.setQuota(nil)
+	}
+}
+
+// queuesFull disconnects client when it has more than maxQueuedBytes
+// queued. Output is queued whether the client sends frames or not, a client
+// that stops reading its output is evicted even if it doesn't send anything.
+func (client *client) queuesFull(size int64) {
+	client.evict("%d bytes queued, more than %d", size, client.limits.queued.limit)
+	client.conn.Close()
+}
+
+// evict audits why client is disconnected and returns an error, to be
+// returned by the protocol, closing the connection.
+func (client *client) evict(format string, a ...interface{}) error {
+	err := fmt.Errorf(format, a...)
+	client.audit(auditClientEvicted, "disconnecting client: %v", err)
+	return err
+}
+
+// admitFrame checks client stays within the per connection limits when it
+// sends frame. It's called before the frame is processed and an error closes
+// the connection.
+func admitFrame(frame *api.Frame, userData interface{}) error {
+	client := userData.(*client)
+
+	if client.limits.frames != nil {
+		if wait := client.limits.frames.reserve(time.Now(), 1); wait > 0 {
+			return client.evict("more than %d frames per second", maxFrameRate)
+		}
+	}
+
+	// A client not reading its output gets evicted whatever it sends,
+	// stdin or commands, see queuesFull for clients sending nothing.
+	if limit := client.limits.queued.limit; limit > 0 {
+		if n := client.queued(); int64(n) > limit {
+			return client.evict("%d bytes queued, more than %d", n, limit)
+		}
+	}
+
+	return nil
+}
+
+// startInFlight accounts for a new asynchronous command of client. It returns
+// false, and the client is disconnected, if client has too many of them in
+// flight already. Otherwise endInFlight has to be called once the command
+// has completed.
+func (client *client) startInFlight() bool {
+	n := atomic.AddInt32(&client.limits.inFlight, 1)
+	if maxInFlight > 0 && int(n) > maxInFlight {
+		atomic.AddInt32(&client.limits.inFlight, -1)
+		client.evict("more than %d commands in flight", maxInFlight)
+		client.conn.Close()
+		return false
+	}
+	return true
+}
+
+func (client *client) endInFlight() {
+	atomic.AddInt32(&client.limits.inFlight, -1)
+}
+
+// acquireConn accounts for the connection of client. It returns false if the
+// user client runs as, or its TLS identity, has too many connections open
+// already, the connection is then to be closed. Otherwise releaseConn has to
+// be called once the connection is closed.
+func (proxy *proxy) acquireConn(client *client) bool {
+	if proxy.maxConnsPerUID <= 0 {
+		return true
+	}
+
+	p := &client.peer
+
+	proxy.Lock()
+	var n int
+	switch {
+	case p.hasUID:
+		n = proxy.uidConns[p.uid]
+		if n < proxy.maxConnsPerUID {
+			proxy.uidConns[p.uid] = n + 1
+		}
+	case p.identity != "":
+		n = proxy.identityConns[p.identity]
+		if n < proxy.maxConnsPerUID {
+			proxy.identityConns[p.identity] = n + 1
+		}
+	}
+	proxy.Unlock()
+
+	if n < proxy.maxConnsPerUID {
+		return true
+	}
+
+	if p.hasUID {
+		client.audit(auditConnectionRefused,
+			"refusing connection: user %d has %d connections open", p.uid, n)
+	} else {
+		client.audit(auditConnectionRefused,
+			"refusing connection: identity %s has %d connections open", p.identity, n)
+	}
+	return false
+}
+
+func (proxy *proxy) releaseConn(client *client) {
+	if proxy.maxConnsPerUID <= 0 {
+		return
+	}
+
+	p := &client.peer
+
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	switch {
+	case p.hasUID:
+		proxy.uidConns[p.uid]--
+		if proxy.uidConns[p.uid] == 0 {
+			delete(proxy.uidConns, p.uid)
+		}
+	case p.identity != "":
+		proxy.identityConns[p.identity]--
+		if proxy.identityConns[p.identity] == 0 {
+			delete(proxy.identityConns, p.identity)
+		}
+	}
+}
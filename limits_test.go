@@ -0,0 +1,204 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/client/proxytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxFrameRate(t *testing.T) {
+	defer saveConfig()()
+	maxFrameRate = 3
+
+	rig := newTestRig(t)
+	rig.Start()
+	rig.RegisterVM()
+
+	conn := rig.ServeNewClient()
+	c := proxytest.New(t, conn)
+	for i := 0; i < maxFrameRate; i++ {
+		c.Send(api.CmdStats, nil)
+		c.ExpectResponse(api.CmdStats)
+	}
+
+	// The burst is one second worth of frames.
+	c.Send(api.CmdStats, nil)
+	c.ExpectClosed()
+	conn.Close()
+
+	rig.Stop()
+}
+
+func TestMaxInFlight(t *testing.T) {
+	defer saveConfig()()
+	maxInFlight = 2
+
+	conn, peerConn, err := Socketpair()
+	assert.Nil(t, err)
+	defer peerConn.Close()
+	client := &client{conn: conn, limits: newClientLimits()}
+
+	assert.True(t, client.startInFlight())
+	assert.True(t, client.startInFlight())
+	client.endInFlight()
+	assert.True(t, client.startInFlight())
+
+	// Going over the limit disconnects the client.
+	assert.False(t, client.startInFlight())
+	_, err = peerConn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestMaxQueuedBytes(t *testing.T) {
+	defer saveConfig()()
+	maxQueuedBytes = 1024
+
+	session := &ioSession{
+		input:  newOutputQueue(stdinBufferSize),
+		output: newOutputQueue(ioSessionBufferSize),
+	}
+	client := &client{
+		sessions: map[int]*ioSession{1: session},
+		limits:   newClientLimits(),
+	}
+	client.attachSession(session)
+	stdin := api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte("stdin\n"))
+
+	session.input.push(outputFrame{buf: make([]byte, 512)})
+	session.output.push(outputFrame{buf: make([]byte, 512)})
+	assert.Equal(t, 1024, client.queued())
+	assert.Nil(t, admitFrame(stdin, client))
+
+	session.output.push(outputFrame{buf: make([]byte, 1)})
+	assert.NotNil(t, admitFrame(stdin, client))
+}
+
+func TestMaxQueuedBytesCommands(t *testing.T) {
+	defer saveConfig()()
+	maxQueuedBytes = 1024
+
+	// A client only sending commands, never reading the output of its
+	// session.
+	session := &ioSession{
+		output: newOutputQueue(ioSessionBufferSize),
+	}
+	client := &client{
+		sessions: map[int]*ioSession{1: session},
+		limits:   newClientLimits(),
+	}
+	client.attachSession(session)
+	stats := api.NewFrame(api.TypeCommand, int(api.CmdStats), nil)
+
+	session.output.push(outputFrame{buf: make([]byte, 1024)})
+	assert.Nil(t, admitFrame(stats, client))
+
+	session.output.push(outputFrame{buf: make([]byte, 1)})
+	assert.NotNil(t, admitFrame(stats, client))
+}
+
+func TestMaxQueuedBytesOutput(t *testing.T) {
+	defer saveConfig()()
+	maxQueuedBytes = 1024
+
+	conn, peerConn, err := Socketpair()
+	assert.Nil(t, err)
+	defer peerConn.Close()
+
+	// A client sending nothing and not reading its output either.
+	session := &ioSession{
+		output: newOutputQueue(ioSessionBufferSize),
+	}
+	client := &client{
+		conn:     conn,
+		sessions: map[int]*ioSession{1: session},
+		limits:   newClientLimits(),
+	}
+	client.limits.queued.exceeded = client.queuesFull
+	client.attachSession(session)
+
+	session.output.push(outputFrame{buf: make([]byte, 1024)})
+	session.output.push(outputFrame{buf: make([]byte, 1)})
+	_, err = peerConn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// Detaching the session gives the bytes back.
+	client.detachSession(session)
+	assert.Equal(t, 0, client.queued())
+}
+
+func TestMaxConnsPerUID(t *testing.T) {
+	defer saveConfig()()
+	maxConnsPerUID = 2
+
+	rig := newTestRig(t)
+	rig.Start()
+	rig.RegisterVM()
+
+	// rig.Client is the first connection.
+	conn := rig.ServeNewClient()
+	c := proxytest.New(t, conn)
+	c.Send(api.CmdStats, nil)
+	c.ExpectResponse(api.CmdStats)
+
+	refused := rig.ServeNewClient()
+	proxytest.New(t, refused).ExpectClosed()
+	refused.Close()
+
+	// Closing a connection makes room for a new one, once the proxy has
+	// noticed.
+	conn.Close()
+	uid := uint32(os.Getuid())
+	for i := 0; i < 100; i++ {
+		rig.proxy.Lock()
+		n := rig.proxy.uidConns[uid]
+		rig.proxy.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn = rig.ServeNewClient()
+	c = proxytest.New(t, conn)
+	c.Send(api.CmdStats, nil)
+	c.ExpectResponse(api.CmdStats)
+	conn.Close()
+
+	rig.Stop()
+}
+
+func TestMaxConnsPerIdentity(t *testing.T) {
+	defer saveConfig()()
+	maxConnsPerUID = 1
+
+	proxy := newProxy()
+	shim := &client{proxy: proxy, peer: peer{listener: listenerTLS, identity: "shim"}}
+	runtime := &client{proxy: proxy, peer: peer{listener: listenerTLS, identity: "runtime"}}
+
+	assert.True(t, proxy.acquireConn(shim))
+	assert.False(t, proxy.acquireConn(shim))
+	assert.True(t, proxy.acquireConn(runtime))
+
+	proxy.releaseConn(shim)
+	assert.True(t, proxy.acquireConn(shim))
+	proxy.releaseConn(shim)
+	proxy.releaseConn(runtime)
+	assert.Equal(t, 0, len(proxy.identityConns))
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// lineFlushDelay is how long a line buffered stream holds an incomplete line,
+// eg. a shell prompt, before forwarding it anyway.
+var lineFlushDelay = 100 * time.Millisecond
+
+// lineBuffer coalesces the output of a stream into newline terminated chunks,
+// which log collectors prefer to arbitrary pieces of lines.
+type lineBuffer struct {
+	sync.Mutex
+	// pending is the incomplete line waiting for its newline.
+	pending []byte
+	// timer, when not nil, flushes pending after lineFlushDelay.
+	timer *time.Timer
+}
+
+// add appends the data of buf, a buffer from readTtyPayload, to the pending
+// line and returns the complete lines, nil if there's none. Once more than
+// max bytes are pending, they are returned without waiting for a newline.
+// The returned buffer comes from getBuffer and starts with
+// api.MinHeaderLength bytes of room for the frame header. add takes
+// ownership of buf. It must be called with the lineBuffer lock held.
+func (lb *lineBuffer) add(buf []byte, max int) []byte {
+	data := buf[api.MinHeaderLength:]
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == 0 {
+		lb.pending = append(lb.pending, data...)
+		putBuffer(buf)
+		if max > 0 && len(lb.pending) > max {
+			return lb.flush()
+		}
+		return nil
+	}
+
+	if len(lb.pending) == 0 {
+		// Common case, forward buf in place.
+		lb.pending = append(lb.pending, data[end:]...)
+		return buf[:api.MinHeaderLength+end]
+	}
+
+	lines := getBuffer(api.MinHeaderLength + len(lb.pending) + end)
+	n := copy(lines[api.MinHeaderLength:], lb.pending)
+	copy(lines[api.MinHeaderLength+n:], data[:end])
+	lb.pending = append(lb.pending[:0], data[end:]...)
+	putBuffer(buf)
+
+	return lines
+}
+
+// flush returns the pending data, nil if there's none, in a buffer like the
+// ones returned by add. It must be called with the lineBuffer lock held.
+func (lb *lineBuffer) flush() []byte {
+	if len(lb.pending) == 0 {
+		return nil
+	}
+
+	buf := getBuffer(api.MinHeaderLength + len(lb.pending))
+	copy(buf[api.MinHeaderLength:], lb.pending)
+	lb.pending = lb.pending[:0]
+
+	return buf
+}
+
+// queueLines is the line buffered version of queueStreamOutput.
+func (session *ioSession) queueLines(seq uint64, buf []byte) bool {
+	lb := session.lineBuffers[seq-session.ioBase]
+
+	lb.Lock()
+	defer lb.Unlock()
+
+	lines := lb.add(buf, session.chunkSize)
+	if len(lb.pending) > 0 && lb.timer == nil {
+		lb.timer = time.AfterFunc(lineFlushDelay, func() {
+			session.flushLines(seq)
+		})
+	}
+
+	if lines == nil {
+		return true
+	}
+
+	return session.queueStreamOutput(seq, lines)
+}
+
+// flushLines forwards the incomplete line held for the stream seq, if any.
+func (session *ioSession) flushLines(seq uint64) {
+	lb := session.lineBuffers[seq-session.ioBase]
+
+	lb.Lock()
+	defer lb.Unlock()
+
+	if lb.timer != nil {
+		lb.timer.Stop()
+		lb.timer = nil
+	}
+
+	if buf := lb.flush(); buf != nil {
+		session.queueStreamOutput(seq, buf)
+	}
+}
+
+// flushAllLines forwards the incomplete lines of the line buffered streams of
+// session, eg. before its exit status.
+func (session *ioSession) flushAllLines() {
+	for i, lb := range session.lineBuffers {
+		if lb != nil {
+			session.flushLines(session.ioBase + uint64(i))
+		}
+	}
+}
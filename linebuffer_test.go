@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func payloadBuffer(data string) []byte {
+	buf := getBuffer(api.MinHeaderLength + len(data))
+	copy(buf[api.MinHeaderLength:], data)
+	return buf
+}
+
+func TestLineBuffer(t *testing.T) {
+	lb := &lineBuffer{}
+
+	lines := func(buf []byte) string {
+		if buf == nil {
+			return ""
+		}
+		defer putBuffer(buf)
+		return string(buf[api.MinHeaderLength:])
+	}
+
+	tests := []struct {
+		data     string
+		expected string
+		pending  string
+	}{
+		{"foo\n", "foo\n", ""},
+		{"foo", "", "foo"},
+		{"bar", "", "foobar"},
+		{"\nbaz", "foobar\n", "baz"},
+		{"\n1\n2\n3", "baz\n1\n2\n", "3"},
+		// More than max bytes pending.
+		{"456789", "3456789", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, lines(lb.add(payloadBuffer(test.data), 6)), test.data)
+		assert.Equal(t, test.pending, string(lb.pending), test.data)
+	}
+
+	assert.Nil(t, lb.flush())
+	lb.add(payloadBuffer("prompt$ "), 0)
+	assert.Equal(t, "prompt$ ", lines(lb.flush()))
+	assert.Nil(t, lb.flush())
+}
+
+func TestSessionLineFlushDelay(t *testing.T) {
+	oldDelay := lineFlushDelay
+	lineFlushDelay = 10 * time.Millisecond
+	defer func() {
+		lineFlushDelay = oldDelay
+	}()
+
+	vm := newVM(testVM, "", "")
+	session := &ioSession{
+		vm:       vm,
+		nStreams: 2,
+		ioBase:   firstIoBase,
+		output:   newOutputQueue(ioSessionBufferSize),
+	}
+	session.lineBuffers[0] = &lineBuffer{}
+
+	assert.True(t, session.queueLines(session.ioBase, payloadBuffer("prompt$ ")))
+
+	frame, ok := session.output.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "prompt$ ", string(frame.buf[api.MinHeaderLength:]))
+	session.output.done(frame)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// pingInterval is how often the proxy pings hyperstart to check it's alive. 0
+// disables liveness probing.
+var pingInterval time.Duration
+
+// pingMisses is the number of pings in a row hyperstart can miss before being
+// declared unresponsive.
+var pingMisses = 3
+
+// probeLiveness pings hyperstart every pingInterval until stopProbe is closed.
+// A ping is missed when it fails or when it's still unanswered at the next
+// tick, in which case no other ping is sent until hyperstart answers.
+func (vm *vm) probeLiveness() {
+	defer vm.wg.Done()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	var pending chan error
+	missed := 0
+	for {
+		select {
+		case <-vm.stopProbe:
+			return
+		case err := <-pending:
+			pending = nil
+			missed = vm.pingResult(err, missed)
+		case <-ticker.C:
+			if pending != nil {
+				missed = vm.pingResult(errPingPending, missed)
+				continue
+			}
+
+			vm.Lock()
+			degraded := vm.degraded
+			vm.Unlock()
+
+			// Reconnecting is dealt with by reconnect().
+			if !degraded {
+				pending = vm.ping()
+			}
+		}
+	}
+}
+
+var errPingPending = errors.New("previous ping still unanswered")
+
+// ping sends a ping to hyperstart, the result is sent on the returned
+// channel.
+func (vm *vm) ping() chan error {
+	result := make(chan error, 1)
+	vm.spawn(func() {
+		_, err := vm.sendCtlMessage("ping", nil)
+		result <- err
+	})
+
+	return result
+}
+
+// pingResult updates the liveness of hyperstart given the result of a ping
+// and the number of pings missed in a row before it. It returns the new
+// number of missed pings.
+func (vm *vm) pingResult(err error, missed int) int {
+	if err == nil {
+		vm.agentResponsive()
+		return 0
+	}
+
+	missed++
+	vm.infof(1, "ctl", "hyperstart missed a ping (%d/%d): %v", missed, pingMisses, err)
+	if missed >= pingMisses {
+		vm.agentUnresponsive(missed)
+	}
+
+	return missed
+}
+
+// agentUnresponsive marks hyperstart as unresponsive. Hyper commands are
+// rejected until it answers a ping again.
+func (vm *vm) agentUnresponsive(missed int) {
+	vm.Lock()
+	if vm.unresponsive {
+		vm.Unlock()
+		return
+	}
+	vm.unresponsive = true
+	lastPing := vm.lastPing
+	vm.Unlock()
+
+	vm.info(1, "ctl", "hyperstart is unresponsive")
+
+	payload := &api.AgentUnresponsive{
+		ContainerID: vm.containerID,
+		MissedPings: missed,
+	}
+	if !lastPing.IsZero() {
+		payload.LastPing = &lastPing
+	}
+	vm.notify(api.NotificationAgentUnresponsive, payload)
+}
+
+// agentResponsive clears the unresponsive state of hyperstart, if set.
+func (vm *vm) agentResponsive() {
+	vm.Lock()
+	if !vm.unresponsive {
+		vm.Unlock()
+		return
+	}
+	vm.unresponsive = false
+	vm.Unlock()
+
+	vm.info(1, "ctl", "hyperstart is answering pings again")
+	vm.notify(api.NotificationVMRecovered, &api.VMRecovered{
+		ContainerID: vm.containerID,
+	})
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backupTimeFormat is the timestamp appended to the name of rotated log
+// files. It sorts lexicographically in chronological order.
+const backupTimeFormat = "20060102-150405.000"
+
+// logFile redirects the proxy log messages to a file and rotates that file
+// when it grows too big or too old.
+//
+// glog, when configured to log to stderr, writes directly to fd 2. Instead of
+// intercepting those writes, we dup the log file onto stderr and re-do it each
+// time the file is rotated. This means there is no need for an external
+// logrotate configuration racing with the fd the proxy has opened, and panics
+// end up in the log file as well.
+type logFile struct {
+	path string
+	// targetFd is the file descriptor the log file is dup'ed onto, stderr
+	// unless told otherwise. -1 means no redirection.
+	targetFd int
+
+	// maxSize is the size, in bytes, a log file can reach before being
+	// rotated. 0 disables size-based rotation.
+	maxSize int64
+	// rotateInterval is the maximum age of the current log file before it's
+	// rotated. 0 disables age-based rotation.
+	rotateInterval time.Duration
+	// maxBackups is the number of rotated log files to keep around. 0 means
+	// keeping all of them.
+	maxBackups int
+	// maxAge is the age after which rotated files are removed. 0 means
+	// rotated files are never removed because they are too old.
+	maxAge time.Duration
+	// compress rotated log files with gzip.
+	compress bool
+
+	// checkInterval is how often we look at the log file to decide if it
+	// needs rotating.
+	checkInterval time.Duration
+
+	sync.Mutex
+	file     *os.File
+	openedAt time.Time
+
+	stop chan interface{}
+	wg   sync.WaitGroup
+}
+
+func newLogFile(path string) *logFile {
+	return &logFile{
+		path:          path,
+		targetFd:      syscall.Stderr,
+		checkInterval: 10 * time.Second,
+		stop:          make(chan interface{}),
+	}
+}
+
+// open (re)opens the log file and redirects targetFd to it.
+func (l *logFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0750); err != nil {
+		return fmt.Errorf("couldn't create log directory: %v", err)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("couldn't open log file: %v", err)
+	}
+
+	if l.targetFd >= 0 {
+		if err := dupFd(int(file.Fd()), l.targetFd); err != nil {
+			file.Close()
+			return fmt.Errorf("couldn't redirect log output: %v", err)
+		}
+	}
+
+	openedAt := time.Now()
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		// We are appending to an existing file, use its modification time
+		// as the best approximation of when it was started.
+		openedAt = info.ModTime()
+	}
+
+	l.Lock()
+	old := l.file
+	l.file = file
+	l.openedAt = openedAt
+	l.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+// Start opens the log file and starts monitoring it for rotation.
+func (l *logFile) Start() error {
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	l.wg.Add(1)
+	go l.monitor()
+
+	return nil
+}
+
+// Stop stops the monitoring goroutine and closes the log file. The target fd
+// is left pointing at the file.
+func (l *logFile) Stop() {
+	close(l.stop)
+	l.wg.Wait()
+
+	l.Lock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	l.Unlock()
+}
+
+func (l *logFile) monitor() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.maybeRotate(); err != nil {
+				fmt.Fprintln(os.Stderr, "log rotation:", err)
+			}
+		}
+	}
+}
+
+func (l *logFile) needsRotation() (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rotateInterval > 0 && time.Since(l.openedAt) >= l.rotateInterval {
+		return true, nil
+	}
+
+	if l.maxSize <= 0 {
+		return false, nil
+	}
+
+	info, err := l.file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return info.Size() >= l.maxSize, nil
+}
+
+func (l *logFile) maybeRotate() error {
+	rotate, err := l.needsRotation()
+	if err != nil || !rotate {
+		return err
+	}
+
+	return l.rotate()
+}
+
+// rotate moves the current log file aside, starts a new one and applies the
+// compression and retention policies to the rotated files.
+func (l *logFile) rotate() error {
+	backup := l.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(l.path, backup); err != nil {
+		return fmt.Errorf("couldn't rename log file: %v", err)
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	if l.compress {
+		if err := compressFile(backup); err != nil {
+			return err
+		}
+	}
+
+	return l.prune()
+}
+
+// backups returns the list of rotated log files, newest first.
+func (l *logFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if _, err := l.backupTime(match); err != nil {
+			continue
+		}
+		backups = append(backups, match)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	return backups, nil
+}
+
+// backupTime returns the time at which backup was rotated.
+func (l *logFile) backupTime(backup string) (time.Time, error) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(backup, l.path+"."), ".gz")
+	return time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+}
+
+// prune removes the rotated files exceeding the retention limits.
+func (l *logFile) prune() error {
+	backups, err := l.backups()
+	if err != nil {
+		return err
+	}
+
+	for i, backup := range backups {
+		tooMany := l.maxBackups > 0 && i >= l.maxBackups
+		rotatedAt, _ := l.backupTime(backup)
+		tooOld := l.maxAge > 0 && time.Since(rotatedAt) > l.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compressFile gzips path into path.gz and removes path.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLogFile creates a logFile in a temporary directory that doesn't
+// redirect stderr.
+func newTestLogFile(t *testing.T) (*logFile, string) {
+	dir, err := ioutil.TempDir("", "cc-proxy-log")
+	assert.Nil(t, err)
+
+	l := newLogFile(filepath.Join(dir, "proxy.log"))
+	l.targetFd = -1
+	err = l.open()
+	assert.Nil(t, err)
+
+	return l, dir
+}
+
+func (l *logFile) writeString(t *testing.T, s string) {
+	l.Lock()
+	_, err := l.file.WriteString(s)
+	l.Unlock()
+	assert.Nil(t, err)
+}
+
+func TestLogFileRotateOnSize(t *testing.T) {
+	l, dir := newTestLogFile(t)
+	defer os.RemoveAll(dir)
+	l.maxSize = 16
+
+	l.writeString(t, "short\n")
+	err := l.maybeRotate()
+	assert.Nil(t, err)
+	backups, err := l.backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(backups))
+
+	l.writeString(t, "this is a long line\n")
+	err = l.maybeRotate()
+	assert.Nil(t, err)
+	backups, err = l.backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(backups))
+
+	// The new log file should be empty.
+	info, err := os.Stat(l.path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	l.Stop()
+}
+
+func TestLogFileRotateOnAge(t *testing.T) {
+	l, dir := newTestLogFile(t)
+	defer os.RemoveAll(dir)
+	l.rotateInterval = time.Hour
+
+	rotate, err := l.needsRotation()
+	assert.Nil(t, err)
+	assert.False(t, rotate)
+
+	l.openedAt = time.Now().Add(-2 * time.Hour)
+	rotate, err = l.needsRotation()
+	assert.Nil(t, err)
+	assert.True(t, rotate)
+
+	l.Stop()
+}
+
+func TestLogFileCompress(t *testing.T) {
+	l, dir := newTestLogFile(t)
+	defer os.RemoveAll(dir)
+	l.compress = true
+
+	l.writeString(t, "compress me\n")
+	err := l.rotate()
+	assert.Nil(t, err)
+
+	backups, err := l.backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(backups))
+	assert.True(t, strings.HasSuffix(backups[0], ".gz"))
+
+	f, err := os.Open(backups[0])
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "compress me\n", string(data))
+
+	l.Stop()
+}
+
+func TestLogFileRetention(t *testing.T) {
+	l, dir := newTestLogFile(t)
+	defer os.RemoveAll(dir)
+	l.maxBackups = 2
+	l.maxAge = time.Hour
+
+	// A backup that is too old.
+	old := l.path + "." + time.Now().Add(-2*time.Hour).Format(backupTimeFormat)
+	err := ioutil.WriteFile(old, []byte("old\n"), 0640)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		l.writeString(t, "data\n")
+		err = l.rotate()
+		assert.Nil(t, err)
+		// Make sure the backup names are different.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, err := l.backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(backups))
+	for _, backup := range backups {
+		assert.NotEqual(t, old, backup)
+	}
+
+	l.Stop()
+}
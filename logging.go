@@ -0,0 +1,108 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// logFields are key/value pairs attached to a log message. Keys follow the
+// journald conventions: upper case letters, digits and underscores.
+type logFields map[string]string
+
+// logPriority is the syslog priority of a log message.
+type logPriority int
+
+const (
+	logPriorityErr   logPriority = 3
+	logPriorityInfo  logPriority = 6
+	logPriorityDebug logPriority = 7
+)
+
+// logBackend is where log messages end up. prefix is a human readable
+// summary of the fields, for backends that can't store them separately.
+// depth is the number of stack frames between the backend and the code that
+// issued the log message.
+type logBackend interface {
+	log(depth int, priority logPriority, fields logFields, prefix, msg string)
+}
+
+// glogBackend outputs the log messages with glog, flattening the fields into
+// a prefix.
+type glogBackend struct{}
+
+func (glogBackend) log(depth int, priority logPriority, fields logFields, prefix, msg string) {
+	if priority <= logPriorityErr {
+		glog.ErrorDepth(depth+1, prefix+msg)
+		return
+	}
+	glog.InfoDepth(depth+1, prefix+msg)
+}
+
+var logger logBackend = glogBackend{}
+
+// setupLogBackend selects the log backend from its name.
+func setupLogBackend(name string) error {
+	switch name {
+	case "", "stderr":
+		logger = glogBackend{}
+	case "journald":
+		journal, err := newJournalBackend()
+		if err != nil {
+			return err
+		}
+		logger = journal
+	default:
+		return fmt.Errorf("unknown log backend '%s'", name)
+	}
+
+	return nil
+}
+
+// logf logs a message at verbosity level lvl. It's meant to be called from
+// the per-object log helpers (vm.infof, client.infof, ...) so the location
+// reported is the one of the caller of those helpers.
+func logf(lvl glog.Level, fields logFields, prefix, format string, a ...interface{}) {
+	if !glog.V(lvl) {
+		return
+	}
+
+	priority := logPriorityInfo
+	if lvl > 1 {
+		priority = logPriorityDebug
+	}
+
+	logger.log(2, priority, fields, prefix, fmt.Sprintf(format, a...))
+}
+
+// logTracef is logf for the objects traced from the debug console: the
+// message is logged whatever the verbosity.
+func logTracef(fields logFields, prefix, format string, a ...interface{}) {
+	logger.log(2, logPriorityInfo, fields, prefix, fmt.Sprintf(format, a...))
+}
+
+// logErrorf is the logf counterpart for error messages. Errors are always
+// logged.
+func logErrorf(fields logFields, prefix, format string, a ...interface{}) {
+	logger.log(2, logPriorityErr, fields, prefix, fmt.Sprintf(format, a...))
+}
+
+// logFielder is implemented by objects which want to annotate the log
+// messages issued on their behalf, eg. by the protocol code.
+type logFielder interface {
+	logFields() logFields
+}
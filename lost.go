@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// vmLostGracePeriod is how long a VM stays registered once its hyperstart
+// channels are gone for good, giving its runtime a chance to unregister it,
+// before the proxy unregisters it itself.
+var vmLostGracePeriod = 30 * time.Second
+
+// lostProcessExitStatus is the exit status sent to the shims of the processes
+// still running when their VM is lost.
+const lostProcessExitStatus = 255
+
+// lostFlushTimeout is how long we wait for the shims to be sent their last
+// frames when the VM is lost.
+const lostFlushTimeout = time.Second
+
+// terminateSessions marks the VM as lost and sends an exit status to the shims
+// of the processes that haven't exited, as hyperstart won't do it anymore. It
+// returns once those exit statuses have been written, or lostFlushTimeout has
+// elapsed.
+func (vm *vm) terminateSessions() {
+	var sessions []*ioSession
+
+	vm.Lock()
+	vm.lost = true
+	for _, session := range vm.tokenToSession {
+		if session.output != nil && !session.terminated {
+			session.terminated = true
+			sessions = append(sessions, session)
+		}
+	}
+	vm.Unlock()
+
+	for _, session := range sessions {
+		vm.infof(1, "io", "client #%d: process lost, sending exit status %d",
+			session.clientID, lostProcessExitStatus)
+
+		session.flushAllLines()
+		session.processExited()
+		vm.processFinished(session, lostProcessExitStatus, true)
+
+		buf := getBuffer(api.MinHeaderLength + 1)
+		buf[api.MinHeaderLength] = lostProcessExitStatus
+		session.queueOutput(api.TypeNotification,
+			int(api.NotificationProcessExited), buf, nil, nil)
+	}
+
+	deadline := time.Now().Add(lostFlushTimeout)
+	for _, session := range sessions {
+		session.output.waitIdle(deadline.Sub(time.Now()))
+	}
+}
+
+// forgetTokens removes the tokens of vm, freed by vm.Close(), from the proxy.
+func (proxy *proxy) forgetTokens(vm *vm) {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	for token, info := range proxy.tokenToVM {
+		if info.vm == vm {
+			proxy.removeTokenUnlocked(token)
+		}
+	}
+}
+
+// unregisterLostVM unregisters vm, once lost, after vmLostGracePeriod unless
+// its runtime has done it before. UnregisterVM stops the timer so vm isn't
+// kept around for the grace period.
+func (proxy *proxy) unregisterLostVM(vm *vm) {
+	unregister := func() {
+		proxy.Lock()
+		defer proxy.Unlock()
+
+		if proxy.vms[vm.containerID] != vm {
+			return
+		}
+
+		vm.info(1, "io", "unregistering lost VM")
+		delete(proxy.vms, vm.containerID)
+	}
+
+	if vmLostGracePeriod == 0 {
+		unregister()
+		return
+	}
+
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	if proxy.vms[vm.containerID] != vm {
+		return
+	}
+	vm.lostTimer = time.AfterFunc(vmLostGracePeriod, unregister)
+}
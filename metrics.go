@@ -0,0 +1,406 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// Results of the commands, the "result" label of the command metrics.
+const (
+	resultSuccess     = "success"
+	resultClientError = "client_error"
+	resultAgentError  = "agent_error"
+	resultTimeout     = "timeout"
+)
+
+// commandResult classifies the outcome of a command from the error it failed
+// with, if any. Errors the proxy hasn't classified are considered as
+// unclassified.
+func commandResult(err error, unclassified string) string {
+	if err == nil {
+		return resultSuccess
+	}
+
+	switch errorCode(err) {
+	case api.ErrorCodeUnknown:
+		return unclassified
+	case api.ErrorCodeHyperTimeout:
+		return resultTimeout
+	case api.ErrorCodeVMUnhealthy, api.ErrorCodeVMDegraded,
+		api.ErrorCodeAgentUnresponsive, api.ErrorCodeVMBooting,
+		api.ErrorCodeAgentError, api.ErrorCodeContainerExists,
+		api.ErrorCodeExecFailed, api.ErrorCodeProcessNotFound:
+		return resultAgentError
+	default:
+		return resultClientError
+	}
+}
+
+// metricKey identifies a time series of opcodeMetrics: a command and the
+// result of that command or the code of its error.
+type metricKey struct {
+	command string
+	value   string
+}
+
+// opcodeMetrics are latency histograms, broken down by command and result,
+// and error counters, broken down by command and error code.
+type opcodeMetrics struct {
+	sync.Mutex
+	durations map[metricKey]*histogram
+	errors    map[metricKey]uint64
+	// unclassified is the result of the errors without error code.
+	unclassified string
+}
+
+func newOpcodeMetrics(unclassified string) *opcodeMetrics {
+	return &opcodeMetrics{
+		durations:    make(map[metricKey]*histogram),
+		errors:       make(map[metricKey]uint64),
+		unclassified: unclassified,
+	}
+}
+
+// observe records that command took d and failed with err, if not nil.
+func (m *opcodeMetrics) observe(command string, d time.Duration, err error) {
+	key := metricKey{command, commandResult(err, m.unclassified)}
+
+	m.Lock()
+	h := m.durations[key]
+	if h == nil {
+		h = newHistogram()
+		m.durations[key] = h
+	}
+	if err != nil {
+		m.errors[metricKey{command, errorCode(err).String()}]++
+	}
+	m.Unlock()
+
+	h.observe(d)
+}
+
+var (
+	// commandMetrics are the durations and errors of the commands sent
+	// by the clients, from the reception of the command to its response,
+	// hyperstart round trip included. The proxy mostly fails commands
+	// because of bad requests: errors without error code are counted as
+	// client errors.
+	commandMetrics = newOpcodeMetrics(resultClientError)
+	// hyperMetrics are the durations and errors of the hyper commands
+	// sent to hyperstart, indexed by hyper command name. A hyper command
+	// failing without error code is a broken hyperstart channel.
+	hyperMetrics = newOpcodeMetrics(resultAgentError)
+)
+
+// writeMetricHeader writes the description of the name metric family.
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeHistograms writes the durations of m as name histograms, with labels
+// prepended to the labels of each series.
+func (m *opcodeMetrics) writeHistograms(w io.Writer, name, labels string) {
+	m.Lock()
+	keys := make([]metricKey, 0, len(m.durations))
+	histograms := make(map[metricKey]latencySnapshot, len(m.durations))
+	for key, h := range m.durations {
+		keys = append(keys, key)
+		histograms[key] = h.snapshot()
+	}
+	m.Unlock()
+	sort.Sort(metricKeys(keys))
+
+	for _, key := range keys {
+		s := histograms[key]
+		labels := fmt.Sprintf(`%scommand="%s",result="%s"`, labels,
+			promLabelEscaper.Replace(key.command), key.value)
+		for _, b := range s.Buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, b.LE, b.Count)
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels, s.Sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, s.Count)
+	}
+}
+
+// writeErrors writes the error counters of m as name counters, with labels
+// prepended to the labels of each series.
+func (m *opcodeMetrics) writeErrors(w io.Writer, name, labels string) {
+	m.Lock()
+	keys := make([]metricKey, 0, len(m.errors))
+	errors := make(map[metricKey]uint64, len(m.errors))
+	for key, n := range m.errors {
+		keys = append(keys, key)
+		errors[key] = n
+	}
+	m.Unlock()
+	sort.Sort(metricKeys(keys))
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%scommand=\"%s\",code=\"%s\"} %d\n", name, labels,
+			promLabelEscaper.Replace(key.command), key.value, errors[key])
+	}
+}
+
+type metricKeys []metricKey
+
+func (k metricKeys) Len() int      { return len(k) }
+func (k metricKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k metricKeys) Less(i, j int) bool {
+	if k[i].command != k[j].command {
+		return k[i].command < k[j].command
+	}
+	return k[i].value < k[j].value
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the metrics of proxy in the Prometheus text exposition
+// format.
+func writeMetrics(w io.Writer, proxy *proxy) error {
+	bw := bufio.NewWriter(w)
+
+	writeMetricHeader(bw, "cc_proxy_command_duration_seconds", "histogram",
+		"Time taken to answer the commands of the clients, by command and result.")
+	commandMetrics.writeHistograms(bw, "cc_proxy_command_duration_seconds", "")
+	writeMetricHeader(bw, "cc_proxy_command_errors_total", "counter",
+		"Commands of the clients that failed, by command and error code.")
+	commandMetrics.writeErrors(bw, "cc_proxy_command_errors_total", "")
+	writeMetricHeader(bw, "cc_proxy_hyper_command_duration_seconds", "histogram",
+		"Hyperstart round trip time of the hyper commands, by hyper command and result.")
+	hyperMetrics.writeHistograms(bw, "cc_proxy_hyper_command_duration_seconds", "")
+	writeMetricHeader(bw, "cc_proxy_hyper_command_errors_total", "counter",
+		"Hyper commands that failed, by hyper command and error code.")
+	hyperMetrics.writeErrors(bw, "cc_proxy_hyper_command_errors_total", "")
+
+	streams := proxy.streamStats()
+	writeStreamMetrics(bw, streams)
+	containerMetrics.write(bw, streams)
+
+	return bw.Flush()
+}
+
+// prometheusCollector keeps the metrics for Prometheus to scrape them on
+// /metrics, served alongside pprof.
+type prometheusCollector struct{}
+
+func newPrometheusCollector() (MetricsCollector, error) {
+	return &prometheusCollector{}, nil
+}
+
+func (c *prometheusCollector) Start(proxy *proxy) error {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, proxy)
+	})
+	return nil
+}
+
+func (c *prometheusCollector) ObserveCommand(command, containerID string, d time.Duration, err error) {
+	commandMetrics.observe(command, d, err)
+	containerMetrics.observe(containerID, command, d, err)
+}
+
+func (c *prometheusCollector) ObserveHyperCommand(name string, d time.Duration, err error) {
+	hyperMetrics.observe(name, d, err)
+}
+
+func (c *prometheusCollector) Stop() {
+}
+
+// streamStats returns the I/O counters of the containers of all the VMs,
+// indexed by container ID.
+func (proxy *proxy) streamStats() map[string]api.StreamStats {
+	var vms []*vm
+
+	proxy.Lock()
+	for _, vm := range proxy.vms {
+		vms = append(vms, vm)
+	}
+	proxy.Unlock()
+
+	streams := make(map[string]api.StreamStats)
+	for _, vm := range vms {
+		vm.Lock()
+		for id, counters := range vm.counters {
+			streams[id] = counters.snapshot()
+		}
+		vm.Unlock()
+	}
+
+	return streams
+}
+
+// writeStreamMetrics writes the bytes relayed for all the containers.
+func writeStreamMetrics(w io.Writer, streams map[string]api.StreamStats) {
+	var total api.StreamStats
+	for _, s := range streams {
+		total.Stdin += s.Stdin
+		total.Stdout += s.Stdout
+		total.Stderr += s.Stderr
+	}
+
+	writeMetricHeader(w, "cc_proxy_stream_bytes_total", "counter",
+		"Bytes relayed for the processes of the containers of the VMs, by stream.")
+	writeStreamCounters(w, "cc_proxy_stream_bytes_total", "", total)
+}
+
+func writeStreamCounters(w io.Writer, name, labels string, s api.StreamStats) {
+	fmt.Fprintf(w, "%s{%sstream=\"stdin\"} %d\n", name, labels, s.Stdin)
+	fmt.Fprintf(w, "%s{%sstream=\"stdout\"} %d\n", name, labels, s.Stdout)
+	fmt.Fprintf(w, "%s{%sstream=\"stderr\"} %d\n", name, labels, s.Stderr)
+}
+
+// metricsContainerLabels is the number of containers for which metrics
+// labelled with their container ID are kept. 0 disables those metrics.
+var metricsContainerLabels int
+
+// containerMetrics are the per container metrics.
+var containerMetrics = newContainerLabels()
+
+// containerLabels holds the command metrics of the most recently active
+// containers, up to metricsContainerLabels of them. When a new container
+// shows up, the metrics of the container that has been inactive for the
+// longest time are evicted to make room for it.
+type containerLabels struct {
+	sync.Mutex
+	containers map[string]*containerEntry
+}
+
+type containerEntry struct {
+	lastSeen time.Time
+	commands *opcodeMetrics
+}
+
+func newContainerLabels() *containerLabels {
+	return &containerLabels{
+		containers: make(map[string]*containerEntry),
+	}
+}
+
+// admitUnlocked returns the entry of the container id, active at t, evicting
+// the least recently active container if needed. It returns nil if id is
+// empty, if per container metrics are disabled or if all the containers
+// tracked have been active more recently than id.
+func (l *containerLabels) admitUnlocked(id string, t time.Time) *containerEntry {
+	if metricsContainerLabels <= 0 || id == "" {
+		return nil
+	}
+
+	if entry := l.containers[id]; entry != nil {
+		if t.After(entry.lastSeen) {
+			entry.lastSeen = t
+		}
+		return entry
+	}
+
+	// The limit can be lowered at run time, hence the loop.
+	for len(l.containers) >= metricsContainerLabels {
+		var oldest string
+		for cid, entry := range l.containers {
+			if oldest == "" || entry.lastSeen.Before(l.containers[oldest].lastSeen) {
+				oldest = cid
+			}
+		}
+		if !l.containers[oldest].lastSeen.Before(t) {
+			return nil
+		}
+		delete(l.containers, oldest)
+	}
+
+	entry := &containerEntry{
+		lastSeen: t,
+		commands: newOpcodeMetrics(resultClientError),
+	}
+	l.containers[id] = entry
+
+	return entry
+}
+
+// observe records that command, about the container id, took d and failed
+// with err, if not nil.
+func (l *containerLabels) observe(id, command string, d time.Duration, err error) {
+	l.Lock()
+	entry := l.admitUnlocked(id, time.Now())
+	l.Unlock()
+
+	if entry != nil {
+		entry.commands.observe(command, d, err)
+	}
+}
+
+// write writes the per container command metrics and the I/O counters, from
+// streams, of the containers tracked. The containers with I/O more recent
+// than the last activity of the tracked containers take their place.
+func (l *containerLabels) write(w io.Writer, streams map[string]api.StreamStats) {
+	if metricsContainerLabels <= 0 {
+		return
+	}
+
+	l.Lock()
+	for id, s := range streams {
+		l.admitUnlocked(id, s.LastActivity)
+	}
+	ids := make([]string, 0, len(l.containers))
+	entries := make(map[string]*containerEntry, len(l.containers))
+	for id, entry := range l.containers {
+		ids = append(ids, id)
+		entries[id] = entry
+	}
+	l.Unlock()
+	sort.Strings(ids)
+
+	writeMetricHeader(w, "cc_proxy_container_command_duration_seconds", "histogram",
+		"Time taken to answer the commands of the clients, by container, command and result.")
+	for _, id := range ids {
+		entries[id].commands.writeHistograms(w, "cc_proxy_container_command_duration_seconds",
+			containerLabel(id))
+	}
+	writeMetricHeader(w, "cc_proxy_container_command_errors_total", "counter",
+		"Commands of the clients that failed, by container, command and error code.")
+	for _, id := range ids {
+		entries[id].commands.writeErrors(w, "cc_proxy_container_command_errors_total",
+			containerLabel(id))
+	}
+	writeMetricHeader(w, "cc_proxy_container_stream_bytes_total", "counter",
+		"Bytes relayed for the processes of the containers, by container and stream.")
+	for _, id := range ids {
+		if s, ok := streams[id]; ok {
+			writeStreamCounters(w, "cc_proxy_container_stream_bytes_total",
+				containerLabel(id), s)
+		}
+	}
+}
+
+func containerLabel(id string) string {
+	return fmt.Sprintf(`container_id="%s",`, promLabelEscaper.Replace(id))
+}
+
+// clientCommandContainer returns the container the command cmd, with
+// payload, of the client userData is about, see client.commandContainerID.
+func clientCommandContainer(cmd api.Command, payload []byte, userData interface{}) string {
+	containerID, _ := userData.(*client).commandContainerID(cmd, payload)
+	return containerID
+}
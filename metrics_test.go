@@ -0,0 +1,159 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandResult(t *testing.T) {
+	tests := []struct {
+		err    error
+		result string
+	}{
+		{nil, resultSuccess},
+		{errors.New("unknown token"), resultClientError},
+		{newProxyError(api.ErrorCodeForbidden, "no"), resultClientError},
+		{newProxyError(api.ErrorCodeInvalidPayload, "no"), resultClientError},
+		{newProxyError(api.ErrorCodeExecFailed, "no"), resultAgentError},
+		{newProxyError(api.ErrorCodeVMUnhealthy, "no"), resultAgentError},
+		{newProxyError(api.ErrorCodeHyperTimeout, "no"), resultTimeout},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.result, commandResult(test.err, resultClientError), "%v", test.err)
+	}
+
+	assert.Equal(t, resultAgentError, commandResult(errors.New("EOF"), resultAgentError))
+}
+
+func TestOpcodeMetrics(t *testing.T) {
+	m := newOpcodeMetrics(resultClientError)
+
+	m.observe("Hyper", 3*time.Millisecond, nil)
+	m.observe("Hyper", time.Second, newProxyError(api.ErrorCodeHyperTimeout, "timeout"))
+	m.observe("Hyper", time.Second, newProxyError(api.ErrorCodeHyperTimeout, "timeout"))
+	m.observe("AttachVM", time.Millisecond, errors.New("unknown VM"))
+
+	var buf bytes.Buffer
+	m.writeHistograms(&buf, "foo_seconds", "")
+	out := buf.String()
+
+	for _, line := range []string{
+		`foo_seconds_bucket{command="Hyper",result="success",le="0.0025"} 0`,
+		`foo_seconds_bucket{command="Hyper",result="success",le="0.005"} 1`,
+		`foo_seconds_bucket{command="Hyper",result="success",le="+Inf"} 1`,
+		`foo_seconds_count{command="Hyper",result="timeout"} 2`,
+		`foo_seconds_sum{command="Hyper",result="timeout"} 2`,
+		`foo_seconds_count{command="AttachVM",result="client_error"} 1`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+	// Series are sorted.
+	assert.True(t, strings.Index(out, `command="AttachVM"`) < strings.Index(out, `command="Hyper"`))
+
+	buf.Reset()
+	m.writeErrors(&buf, "foo_errors_total", `container_id="foo",`)
+	assert.Equal(t,
+		`foo_errors_total{container_id="foo",command="AttachVM",code="unknown"} 1`+"\n"+
+			`foo_errors_total{container_id="foo",command="Hyper",code="HyperTimeout"} 2`+"\n",
+		buf.String())
+}
+
+func TestCommandMetrics(t *testing.T) {
+	proto := newProtocol()
+	proto.HandleCommand(api.CmdRegisterVM, func(data []byte, userData interface{}, response *handlerResponse) {
+		response.SetError(newProxyError(api.ErrorCodeExecFailed, "exec failed"))
+	})
+
+	before := commandMetrics.count("RegisterVM", resultAgentError)
+	frame := api.NewFrame(api.TypeCommand, int(api.CmdRegisterVM), nil)
+	resp := proto.handleCommand(&clientCtx{}, frame)
+	assert.True(t, resp.Header.InError)
+	assert.Equal(t, before+1, commandMetrics.count("RegisterVM", resultAgentError))
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeMetrics(&buf, newProxy()))
+	assert.Contains(t, buf.String(), `cc_proxy_command_errors_total{command="RegisterVM",code="ExecFailed"}`)
+	assert.Contains(t, buf.String(), "# TYPE cc_proxy_hyper_command_duration_seconds histogram\n")
+}
+
+func TestContainerLabels(t *testing.T) {
+	defer saveConfig()()
+	metricsContainerLabels = 2
+
+	l := newContainerLabels()
+	now := time.Now()
+
+	l.observe("", "Hyper", time.Millisecond, nil)
+	l.observe("foo", "Hyper", time.Millisecond, nil)
+	l.observe("bar", "Hyper", time.Millisecond, nil)
+	assert.Len(t, l.containers, 2)
+
+	// baz evicts foo, the least recently active container.
+	l.observe("bar", "Signal", time.Millisecond, nil)
+	l.observe("baz", "Hyper", time.Millisecond, nil)
+	assert.Len(t, l.containers, 2)
+	assert.Nil(t, l.containers["foo"])
+	assert.NotNil(t, l.containers["bar"])
+	assert.Equal(t, uint64(1), l.containers["bar"].commands.count("Signal", resultSuccess))
+
+	// Containers with older I/O than the tracked ones don't make it.
+	streams := map[string]api.StreamStats{
+		"bar": {Stdout: 10, LastActivity: now},
+		"qux": {Stdout: 42, LastActivity: now.Add(-time.Hour)},
+	}
+	var buf bytes.Buffer
+	l.write(&buf, streams)
+	out := buf.String()
+	assert.Contains(t, out, `cc_proxy_container_stream_bytes_total{container_id="bar",stream="stdout"} 10`+"\n")
+	assert.Contains(t, out, `cc_proxy_container_command_duration_seconds_count{container_id="baz",command="Hyper",result="success"} 1`+"\n")
+	assert.NotContains(t, out, `container_id="qux"`)
+
+	// More recent I/O does.
+	streams["qux"] = api.StreamStats{Stdout: 42, LastActivity: time.Now().Add(time.Second)}
+	buf.Reset()
+	l.write(&buf, streams)
+	assert.Contains(t, buf.String(), `cc_proxy_container_stream_bytes_total{container_id="qux",stream="stdout"} 42`+"\n")
+	assert.Len(t, l.containers, 2)
+
+	// Nothing is tracked when disabled.
+	metricsContainerLabels = 0
+	l = newContainerLabels()
+	l.observe("foo", "Hyper", time.Millisecond, nil)
+	assert.Len(t, l.containers, 0)
+	buf.Reset()
+	l.write(&buf, streams)
+	assert.Equal(t, "", buf.String())
+}
+
+// count returns the number of commands command that ended with result.
+func (m *opcodeMetrics) count(command, result string) uint64 {
+	m.Lock()
+	h := m.durations[metricKey{command, result}]
+	m.Unlock()
+
+	if h == nil {
+		return 0
+	}
+	return h.snapshot().Count
+}
@@ -0,0 +1,530 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// ioSessionBufferSize is the maximum amount of output, in bytes, buffered for
+// a client not reading it fast enough.
+var ioSessionBufferSize = 1024 * 1024
+
+// stdinBufferSize is the maximum amount of stdin data, in bytes, buffered for
+// a process before the shim sending it is blocked.
+var stdinBufferSize = 1024 * 1024
+
+// vmBufferLimit is the maximum amount of data, in bytes, buffered in all the
+// queues of a VM, output, stdin and observers alike. 0 disables the limit.
+var vmBufferLimit int
+
+// observerBufferSize is the maximum amount of output, in bytes, buffered for
+// an observer before its output is dropped.
+var observerBufferSize = 1024 * 1024
+
+// outputQueue holds the frames waiting to be written to the client of an I/O
+// session. Each session has its own queue and writer, see relayEngine, so a
+// slow client doesn't hold up the output of the other processes of the VM.
+//
+// The io channel multiplexes the output of all the processes of a VM and
+// hyperstart has no per-process flow control: once the queue of a session is
+// full, the only way to push back on the process is to stop reading the io
+// channel.
+//
+// The same queue holds the stdin data of a session waiting to be written to
+// hyperstart, see ioSession.writeStdin.
+type outputQueue struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	frames []outputFrame
+	// size is the number of bytes in frames.
+	size int
+	// writing is true while a frame taken out of the queue is being
+	// written to the client.
+	writing bool
+	closed  bool
+	// held is set while the frames are kept in the queue, see hold.
+	held bool
+	// limit is the number of bytes from which the queue is full.
+	limit int
+
+	// notify, if not nil, is called when frames are queued or the queue
+	// is closed. It's used by the epoll relay engine, which doesn't wait
+	// on cond.
+	notify func()
+
+	// budget, if not nil, accounts for the bytes in the queue on top of
+	// the ones of the other queues of the VM. stdin is set for the queues
+	// holding stdin data.
+	budget *bufferBudget
+	stdin  bool
+	// quota, if not nil, accounts for the bytes in the queue on top of the
+	// ones of the other queues of the client of the session.
+	quota *queueQuota
+}
+
+// outputFrame is a frame waiting in an outputQueue.
+type outputFrame struct {
+	buf []byte
+	// limiter, if not nil, rate limits the stream the frame belongs to.
+	limiter *tokenBucket
+}
+
+// newOutputQueue returns a queue holding up to limit bytes of frames.
+func newOutputQueue(limit int) *outputQueue {
+	q := &outputQueue{limit: limit}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// push adds frame to the queue. frame.buf is a buffer from getBuffer. When
+// the queue is full, push blocks until there's enough room for frame. push
+// returns false if it had to wait.
+func (q *outputQueue) push(frame outputFrame) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	waited := false
+	for !q.closed && q.size > 0 && q.size+len(frame.buf) > q.limit {
+		waited = true
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		putBuffer(frame.buf)
+		return !waited
+	}
+
+	q.frames = append(q.frames, frame)
+	q.size += len(frame.buf)
+	q.budget.add(len(frame.buf), q.stdin)
+	q.quota.add(len(frame.buf))
+	q.cond.Broadcast()
+	q.notifyUnlocked()
+
+	return !waited
+}
+
+func (q *outputQueue) notifyUnlocked() {
+	if q.notify != nil {
+		q.notify()
+	}
+}
+
+// pop waits for a frame to be queued and returns it. It returns false once
+// the queue is closed. done must be called once the frame is written.
+func (q *outputQueue) pop() (outputFrame, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for !q.closed && (len(q.frames) == 0 || q.held) {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return outputFrame{}, false
+	}
+
+	return q.popUnlocked(), true
+}
+
+// tryPop is the non-blocking version of pop: ok is false when there's no
+// frame queued and closed is true once the queue is closed.
+func (q *outputQueue) tryPop() (frame outputFrame, ok, closed bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return outputFrame{}, false, true
+	}
+
+	if len(q.frames) == 0 || q.held {
+		return outputFrame{}, false, false
+	}
+
+	return q.popUnlocked(), true, false
+}
+
+func (q *outputQueue) popUnlocked() outputFrame {
+	frame := q.frames[0]
+	q.frames[0] = outputFrame{}
+	q.frames = q.frames[1:]
+	q.writing = true
+
+	return frame
+}
+
+// done signals the frame returned by pop has been written.
+func (q *outputQueue) done(frame outputFrame) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.size -= len(frame.buf)
+	q.budget.add(-len(frame.buf), q.stdin)
+	q.quota.add(-len(frame.buf))
+	q.writing = false
+	q.cond.Broadcast()
+
+	putBuffer(frame.buf)
+}
+
+// setQuota moves the accounting of the bytes in the queue to quota, nil to
+// stop accounting for them.
+func (q *outputQueue) setQuota(quota *queueQuota) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.quota.add(-q.size)
+	q.quota = quota
+	q.quota.add(q.size)
+}
+
+// buffered returns the number of bytes in the queue, including the frame
+// being written.
+func (q *outputQueue) buffered() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.size
+}
+
+// idle returns true when all the queued frames have been written.
+func (q *outputQueue) idle() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.frames) == 0 && !q.writing
+}
+
+// hold keeps the frames queued from now on: pop blocks until release is
+// called. The frame being written, if any, isn't affected.
+func (q *outputQueue) hold() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.held = true
+}
+
+// release undoes hold.
+func (q *outputQueue) release() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.held = false
+	q.cond.Broadcast()
+	q.notifyUnlocked()
+}
+
+// waitUnlocked waits, for at most timeout, for cond to be true. It returns
+// false on timeout.
+func (q *outputQueue) waitUnlocked(timeout time.Duration, cond func() bool) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		q.Lock()
+		expired = true
+		q.cond.Broadcast()
+		q.Unlock()
+	})
+	defer timer.Stop()
+
+	for !cond() {
+		if expired {
+			return false
+		}
+		q.cond.Wait()
+	}
+
+	return true
+}
+
+// waitIdle waits, for at most timeout, for all the queued frames to be
+// written. It returns false on timeout.
+func (q *outputQueue) waitIdle(timeout time.Duration) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.waitUnlocked(timeout, func() bool {
+		return q.closed || (len(q.frames) == 0 && !q.writing)
+	})
+}
+
+// waitWritten waits, for at most timeout, for the frame being written, if
+// any, to be written. It returns false on timeout.
+func (q *outputQueue) waitWritten(timeout time.Duration) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.waitUnlocked(timeout, func() bool {
+		return q.closed || !q.writing
+	})
+}
+
+// close discards the queued frames and wakes up the goroutines waiting on
+// the queue.
+func (q *outputQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, frame := range q.frames {
+		q.budget.add(-len(frame.buf), q.stdin)
+		putBuffer(frame.buf)
+	}
+	q.frames = nil
+	q.closed = true
+	q.cond.Broadcast()
+	q.notifyUnlocked()
+}
+
+// discard drops the queued frames, but not the one being written, if any. It
+// returns the number of bytes dropped.
+func (q *outputQueue) discard() int {
+	q.Lock()
+	defer q.Unlock()
+
+	n := 0
+	for _, frame := range q.frames {
+		n += len(frame.buf)
+		q.size -= len(frame.buf)
+		q.budget.add(-len(frame.buf), q.stdin)
+		q.quota.add(-len(frame.buf))
+		putBuffer(frame.buf)
+	}
+	q.frames = nil
+	q.cond.Broadcast()
+
+	return n
+}
+
+// tryPush adds frame to the queue if there's room for it, in the queue and in
+// its budget. Otherwise, frame is dropped and tryPush returns false.
+func (q *outputQueue) tryPush(frame outputFrame) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed || (q.size > 0 && q.size+len(frame.buf) > q.limit) || q.budget.full() {
+		putBuffer(frame.buf)
+		return false
+	}
+
+	q.frames = append(q.frames, frame)
+	q.size += len(frame.buf)
+	q.budget.add(len(frame.buf), q.stdin)
+	q.quota.add(len(frame.buf))
+	q.cond.Broadcast()
+	q.notifyUnlocked()
+
+	return true
+}
+
+// bufferBudget accounts for the bytes buffered in all the queues of a VM, see
+// vmBufferLimit. A nil budget is unlimited.
+//
+// Output can only wait for output to be written: the stdin data of a VM may
+// not be written until its io channel has been read, a VM waiting for its
+// stdin to be written before reading output would deadlock.
+type bufferBudget struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	// size is the number of bytes buffered, output the number of those
+	// which aren't stdin data.
+	size   int
+	output int
+	limit  int
+}
+
+func newBufferBudget(limit int) *bufferBudget {
+	if limit <= 0 {
+		return nil
+	}
+
+	b := &bufferBudget{limit: limit}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+// add accounts for n more bytes of stdin, or output, buffered, n being
+// negative when buffers are freed.
+func (b *bufferBudget) add(n int, stdin bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.size += n
+	if !stdin {
+		b.output += n
+	}
+	if n < 0 {
+		b.cond.Broadcast()
+	}
+}
+
+// full returns true when the limit has been reached.
+func (b *bufferBudget) full() bool {
+	if b == nil {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.size >= b.limit
+}
+
+// waitOutput waits for room to queue output. It returns false if it had to
+// wait.
+func (b *bufferBudget) waitOutput() bool {
+	return b.wait(func() bool {
+		return b.size < b.limit || b.output == 0
+	})
+}
+
+// waitStdin waits for room to queue stdin data. It returns false if it had to
+// wait.
+func (b *bufferBudget) waitStdin() bool {
+	return b.wait(func() bool {
+		return b.size < b.limit
+	})
+}
+
+func (b *bufferBudget) wait(room func() bool) bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	waited := false
+	for !room() {
+		waited = true
+		b.cond.Wait()
+	}
+
+	return !waited
+}
+
+// ioObserver is a client receiving a copy of the output of an I/O session,
+// eg. a log collector, without being able to interact with the process. An
+// observer has its own queue: when it can't keep up, the output is dropped
+// for that observer only.
+type ioObserver struct {
+	clientID uint64
+	client   net.Conn
+	streamID int
+	// chunkSize is the maximum payload size of the frames sent to the
+	// client.
+	chunkSize int
+	output    *outputQueue
+	// dropped is the number of frames the observer has missed.
+	dropped int
+}
+
+// relayEngine selects how the output queues are written to the clients:
+//
+//  - "goroutine": each queue has its own goroutine, see writeOutputs.
+//  - "epoll": a single goroutine writes all the queues, polling the client
+//    connections with epoll(7). Idle streams then don't cost a goroutine.
+var relayEngine = "goroutine"
+
+// outputPoller is the epoll relay engine, nil when not enabled.
+var outputPoller *poller
+
+func validRelayEngine(name string) error {
+	switch name {
+	case "goroutine":
+		return nil
+	case "epoll":
+		if !epollSupported {
+			return fmt.Errorf("the epoll relay engine needs linux and go 1.9")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown relay engine '%s'", name)
+	}
+}
+
+// setupRelayEngine starts the relay engine called name.
+func setupRelayEngine(name string) error {
+	if err := validRelayEngine(name); err != nil {
+		return err
+	}
+
+	if name != "epoll" {
+		return nil
+	}
+
+	p, err := newPoller()
+	if err != nil {
+		return err
+	}
+	outputPoller = p
+
+	return nil
+}
+
+// startOutputWriter starts writing the frames queued in q to client with the
+// configured relay engine.
+func (vm *vm) startOutputWriter(clientID uint64, client net.Conn, q *outputQueue) {
+	if outputPoller != nil && outputPoller.add(vm, clientID, client, q) {
+		return
+	}
+
+	vm.spawn(func() {
+		vm.writeOutputs(clientID, client, q)
+	})
+}
+
+// writeOutputs writes the frames queued in q to client until q is closed.
+func (vm *vm) writeOutputs(clientID uint64, client net.Conn, q *outputQueue) {
+	failed := false
+
+	for {
+		frame, ok := q.pop()
+		if !ok {
+			return
+		}
+
+		if frame.limiter != nil && !failed {
+			n := len(frame.buf) - api.MinHeaderLength
+			if delay := frame.limiter.reserve(time.Now(), n); delay > 0 {
+				vm.infof(2, "io", "client #%d: rate limited for %v",
+					clientID, delay)
+				time.Sleep(delay)
+			}
+		}
+
+		// When the shim is forcefully killed, it's possible we still
+		// have data to write. Keep emptying the queue, the relay
+		// loop shouldn't be blocked by a client that has gone away.
+		if !failed {
+			if _, err := client.Write(frame.buf); err != nil {
+				vm.infof(1, "io", "error writing I/O data to client: %v", err)
+				failed = true
+			}
+		}
+
+		q.done(frame)
+	}
+}
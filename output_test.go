@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputQueue(t *testing.T) {
+	q := newOutputQueue(1024)
+	assert.True(t, q.idle())
+
+	// A frame bigger than the limit is accepted in an empty queue.
+	assert.True(t, q.push(outputFrame{buf: getBuffer(2048)}))
+	assert.False(t, q.idle())
+
+	// The queue is full, the next push has to wait for the first frame to
+	// be written.
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(outputFrame{buf: getBuffer(16)})
+	}()
+
+	frame, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, 2048, len(frame.buf))
+	select {
+	case <-pushed:
+		assert.Fail(t, "push should wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.False(t, q.idle())
+
+	q.done(frame)
+	assert.False(t, <-pushed)
+
+	frame, ok = q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, 16, len(frame.buf))
+	q.done(frame)
+	assert.True(t, q.idle())
+
+	// Closing the queue wakes up the writer.
+	popped := make(chan bool)
+	go func() {
+		_, ok := q.pop()
+		popped <- ok
+	}()
+	q.close()
+	assert.False(t, <-popped)
+}
+
+func TestOutputQueueHold(t *testing.T) {
+	q := newOutputQueue(ioSessionBufferSize)
+	q.push(outputFrame{buf: getBuffer(16)})
+	q.hold()
+
+	_, ok, closed := q.tryPop()
+	assert.False(t, ok)
+	assert.False(t, closed)
+
+	// Nothing is being written.
+	assert.True(t, q.waitWritten(time.Second))
+	assert.False(t, q.waitIdle(50*time.Millisecond))
+
+	popped := make(chan outputFrame)
+	go func() {
+		frame, _ := q.pop()
+		popped <- frame
+	}()
+	select {
+	case <-popped:
+		assert.Fail(t, "pop should wait for the queue to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.release()
+	frame := <-popped
+	assert.False(t, q.waitWritten(50*time.Millisecond))
+	q.done(frame)
+	assert.True(t, q.waitIdle(time.Second))
+
+	q.close()
+}
+
+func TestBufferBudget(t *testing.T) {
+	budget := newBufferBudget(1024)
+	output, stdin, observer := newOutputQueue(1024), newOutputQueue(1024), newOutputQueue(1024)
+	output.budget = budget
+	stdin.budget = budget
+	stdin.stdin = true
+	observer.budget = budget
+
+	output.push(outputFrame{buf: getBuffer(512)})
+	stdin.push(outputFrame{buf: getBuffer(512)})
+	assert.True(t, budget.full())
+
+	// Observers drop their output once the VM has buffered too much.
+	assert.False(t, observer.tryPush(outputFrame{buf: getBuffer(16)}))
+
+	// Output and stdin wait for room in the budget.
+	waited := make(chan bool)
+	go func() {
+		waited <- budget.waitOutput()
+	}()
+	select {
+	case <-waited:
+		assert.Fail(t, "output should wait for room in the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	frame, ok := output.pop()
+	assert.True(t, ok)
+	output.done(frame)
+	assert.False(t, <-waited)
+
+	// Output doesn't wait for stdin, it may not be written until output
+	// is read.
+	stdin.push(outputFrame{buf: getBuffer(512)})
+	assert.True(t, budget.full())
+	assert.True(t, budget.waitOutput())
+
+	go func() {
+		waited <- budget.waitStdin()
+	}()
+	select {
+	case <-waited:
+		assert.Fail(t, "stdin should wait for room in the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	stdin.close()
+	assert.False(t, <-waited)
+	assert.False(t, budget.full())
+
+	// A nil budget is unlimited.
+	budget = nil
+	assert.False(t, budget.full())
+	assert.True(t, budget.waitOutput())
+	assert.True(t, budget.waitStdin())
+}
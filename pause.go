@@ -0,0 +1,303 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// pauseTimeout is how long Pause waits for the io goroutine to stop reading
+// and for the clients to read the output the proxy has buffered.
+var pauseTimeout = 10 * time.Second
+
+// errIOPaused is returned by readNextHeader when it has been interrupted by
+// Pause before reading anything.
+var errIOPaused = errors.New("io channel paused")
+
+// Pause quiesces the I/O relay of the VM: the io goroutine stops reading the
+// io channel, the output it has already read is written to the clients and
+// the stdin messages being written to hyperstart are completed. Stdin data
+// sent by the shims is held until Resume.
+//
+// The io goroutine can only be interrupted while waiting for the next
+// message, see readNextHeader, never in the middle of one. When waiting for
+// the io goroutine or the clients takes longer than pauseTimeout, the VM is
+// resumed and an error returned.
+func (vm *vm) Pause() error {
+	vm.Lock()
+	if !vm.connected {
+		vm.Unlock()
+		return fmt.Errorf("VM %s isn't connected", vm.containerID)
+	}
+	if vm.paused {
+		vm.Unlock()
+		return fmt.Errorf("I/O of VM %s is already paused", vm.containerID)
+	}
+	vm.paused = true
+	vm.resumed = make(chan interface{})
+	vm.parked = make(chan interface{})
+	parked := vm.parked
+	if vm.readingHeader {
+		// Wake up the io goroutine.
+		vm.hyperHandler.GetIoSock().SetReadDeadline(time.Now())
+	}
+	vm.Unlock()
+
+	deadline := time.Now().Add(pauseTimeout)
+
+	select {
+	case <-parked:
+	case <-vm.vmLost:
+		vm.Resume()
+		return fmt.Errorf("VM %s lost while pausing its I/O", vm.containerID)
+	case <-time.After(pauseTimeout):
+		vm.Resume()
+		return fmt.Errorf("timeout waiting for the I/O of VM %s to stop", vm.containerID)
+	}
+
+	// Nothing is added to the output queues anymore, wait for the clients
+	// to read them.
+	vm.Lock()
+	var outputs, inputs []*outputQueue
+	for _, session := range vm.tokenToSession {
+		if session.output != nil {
+			outputs = append(outputs, session.output)
+		}
+		if session.input != nil {
+			session.input.hold()
+			inputs = append(inputs, session.input)
+		}
+		for _, observer := range session.observers {
+			outputs = append(outputs, observer.output)
+		}
+	}
+	vm.Unlock()
+
+	for _, q := range inputs {
+		if !q.waitWritten(deadline.Sub(time.Now())) {
+			vm.Resume()
+			return fmt.Errorf("timeout writing the stdin of VM %s", vm.containerID)
+		}
+	}
+
+	for _, q := range outputs {
+		if !q.waitIdle(deadline.Sub(time.Now())) {
+			vm.Resume()
+			return fmt.Errorf("timeout waiting for the clients of VM %s to read their output",
+				vm.containerID)
+		}
+	}
+
+	vm.info(1, "io", "I/O paused")
+
+	return nil
+}
+
+// PauseVM quiesces the I/O relay of the VM, like Pause, then stops its vCPUs
+// through QMP. The output the processes write in between stays in the VM
+// until Resume.
+func (vm *vm) PauseVM() error {
+	vm.Lock()
+	q := vm.qmp
+	vm.Unlock()
+
+	if q == nil {
+		return fmt.Errorf("VM %s wasn't registered with a QMP socket", vm.containerID)
+	}
+
+	if err := vm.Pause(); err != nil {
+		return err
+	}
+
+	if err := q.execute("stop", nil); err != nil {
+		vm.Resume()
+		return fmt.Errorf("couldn't stop VM %s: %v", vm.containerID, err)
+	}
+
+	vm.Lock()
+	vm.vcpusStopped = true
+	vm.Unlock()
+
+	vm.info(1, "qmp", "vCPUs stopped")
+
+	return nil
+}
+
+// Resume restarts the I/O relay of a VM paused with Pause and, if PauseVM has
+// stopped them, the vCPUs of the VM, before the I/O relay.
+func (vm *vm) Resume() error {
+	vm.Lock()
+	if !vm.paused {
+		vm.Unlock()
+		return fmt.Errorf("I/O of VM %s isn't paused", vm.containerID)
+	}
+	q, stopped := vm.qmp, vm.vcpusStopped
+	vm.Unlock()
+
+	if stopped {
+		if err := q.execute("cont", nil); err != nil {
+			return fmt.Errorf("couldn't resume VM %s: %v", vm.containerID, err)
+		}
+		vm.info(1, "qmp", "vCPUs resumed")
+	}
+
+	vm.Lock()
+	defer vm.Unlock()
+
+	vm.vcpusStopped = false
+	vm.resumeUnlocked()
+	vm.info(1, "io", "I/O resumed")
+
+	return nil
+}
+
+// resumeUnlocked restarts the I/O relay, if paused. It must be called with
+// the vm lock held.
+func (vm *vm) resumeUnlocked() {
+	if !vm.paused {
+		return
+	}
+
+	vm.paused = false
+	vm.hyperHandler.GetIoSock().SetReadDeadline(time.Time{})
+	for _, session := range vm.tokenToSession {
+		if session.input != nil {
+			session.input.release()
+		}
+	}
+	close(vm.resumed)
+}
+
+// waitResumed is called by the io goroutine before reading a message. It
+// blocks while the VM is paused.
+func (vm *vm) waitResumed() {
+	vm.Lock()
+	if !vm.paused {
+		vm.Unlock()
+		return
+	}
+	resumed := vm.resumed
+	close(vm.parked)
+	vm.Unlock()
+
+	<-resumed
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// readNextHeader reads the header of the next message on the io channel, like
+// readTtyHeader, but can be interrupted by Pause, in which case errIOPaused
+// is returned. Once part of the header has been read, the message is read in
+// full.
+func (vm *vm) readNextHeader(conn net.Conn, buf []byte) (ttyHeader, error) {
+	vm.Lock()
+	vm.readingHeader = true
+	vm.Unlock()
+
+	n := 0
+	var err error
+	for n < len(buf) && err == nil {
+		var nr int
+		nr, err = conn.Read(buf[n:])
+		n += nr
+
+		if !isTimeout(err) {
+			continue
+		}
+
+		vm.Lock()
+		if n == 0 && vm.paused {
+			vm.readingHeader = false
+			vm.Unlock()
+			return ttyHeader{}, errIOPaused
+		}
+		if n > 0 {
+			// Too late, finish reading the message.
+			vm.readingHeader = false
+			conn.SetReadDeadline(time.Time{})
+		}
+		vm.Unlock()
+		err = nil
+	}
+
+	vm.Lock()
+	vm.readingHeader = false
+	if vm.paused {
+		// Pause may have set a deadline after we've read the header.
+		conn.SetReadDeadline(time.Time{})
+	}
+	vm.Unlock()
+
+	if err != nil {
+		return ttyHeader{}, err
+	}
+
+	return parseTtyHeader(buf), nil
+}
+
+func pauseOrResume(data []byte, userData interface{}, response *handlerResponse,
+	opcode api.Command) {
+	client := userData.(*client)
+	proxy := client.proxy
+	payload := api.Pause{}
+
+	// api.Resume is api.Pause without vm.
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.vms[payload.ContainerID]
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetErrorf("unknown containerID: %s", payload.ContainerID)
+		return
+	}
+
+	var err error
+	if opcode == api.CmdPause && payload.VM {
+		err = vm.PauseVM()
+	} else if opcode == api.CmdPause {
+		err = vm.Pause()
+	} else {
+		err = vm.Resume()
+	}
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.infof(1, "%s(containerId=%s,vm=%v)", opcode, payload.ContainerID, payload.VM)
+}
+
+// "Pause"
+func pause(data []byte, userData interface{}, response *handlerResponse) {
+	pauseOrResume(data, userData, response, api.CmdPause)
+}
+
+// "Resume"
+func resume(data []byte, userData interface{}, response *handlerResponse) {
+	pauseOrResume(data, userData, response, api.CmdResume)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build linux,go1.9
+
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// peerUID returns the UID of the process at the other end of the unix socket
+// conn.
+func peerUID(conn net.Conn) (uint32, bool) {
+	raw, ok := rawConn(conn)
+	if !ok {
+		return 0, false
+	}
+
+	var cred *syscall.Ucred
+	var err error
+	ctrlErr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if ctrlErr != nil || err != nil {
+		return 0, false
+	}
+
+	return cred.Uid, true
+}
+
+// peerLabel returns the SELinux context of the process at the other end of
+// the unix socket conn. It's not known when the kernel has no LSM labelling
+// sockets.
+func peerLabel(conn net.Conn) (string, bool) {
+	raw, ok := rawConn(conn)
+	if !ok {
+		return "", false
+	}
+
+	buf := make([]byte, 256)
+	size := uint32(len(buf))
+	var errno syscall.Errno
+	ctrlErr := raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.SOL_SOCKET, syscall.SO_PEERSEC,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if ctrlErr != nil || errno != 0 || size == 0 {
+		return "", false
+	}
+
+	return strings.TrimRight(string(buf[:size]), "\x00"), true
+}
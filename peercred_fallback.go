@@ -0,0 +1,31 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !linux !go1.9
+
+package main
+
+import (
+	"net"
+)
+
+// Before go 1.9, there's no way to get to the file descriptor of a net.Conn
+// without putting it in blocking mode: UID rules of the hyper policy never
+// match.
+func peerUID(conn net.Conn) (uint32, bool) {
+	return 0, false
+}
+
+func peerLabel(conn net.Conn) (string, bool) {
+	return "", false
+}
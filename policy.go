@@ -0,0 +1,335 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// Listeners a client can have connected through.
+const (
+	listenerUnix = "unix"
+	listenerTLS  = "tls"
+)
+
+// peerMatcher selects the clients the rules of the hyper, SELinux and
+// authorization policies apply to. It matches the clients running as UID,
+// when set, with the SELinux type Type, when set, connected through
+// Listener, when set, and, for TLS clients, authenticated with a certificate
+// whose common name is Identity, when set.
+type peerMatcher struct {
+	UID      *uint32 `json:"uid,omitempty"`
+	Type     string  `json:"type,omitempty"`
+	Listener string  `json:"listener,omitempty"`
+	Identity string  `json:"identity,omitempty"`
+}
+
+func (m *peerMatcher) validate() error {
+	switch m.Listener {
+	case "", listenerUnix, listenerTLS:
+	default:
+		return fmt.Errorf("unknown listener '%s'", m.Listener)
+	}
+
+	if m.Identity != "" && m.Listener == listenerUnix {
+		return fmt.Errorf("identity only applies to the %s listener", listenerTLS)
+	}
+
+	return nil
+}
+
+func (m *peerMatcher) matches(p *peer) bool {
+	if m.Listener != "" && m.Listener != p.listener {
+		return false
+	}
+
+	if m.UID != nil && (!p.hasUID || *m.UID != p.uid) {
+		return false
+	}
+
+	if m.Identity != "" && m.Identity != p.identity {
+		return false
+	}
+
+	if m.Type != "" {
+		if typ, ok := selinuxType(p.label); !p.hasLabel || !ok || typ != m.Type {
+			return false
+		}
+	}
+
+	return true
+}
+
+// anyCommand in the command list of a rule allows all the commands.
+const anyCommand = "*"
+
+// commandList is the list of commands a rule allows.
+type commandList []string
+
+func (l commandList) allows(name string) bool {
+	for _, allowed := range l {
+		if allowed == anyCommand || allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anyHyperCommand in hyperRule.Commands allows all the hyper commands.
+const anyHyperCommand = anyCommand
+
+// hyperRule gives the hyper commands the clients it matches are allowed to
+// send.
+type hyperRule struct {
+	peerMatcher
+	Commands commandList `json:"commands"`
+}
+
+// hyperPolicy restricts the hyper commands clients can send. The first rule
+// matching a client applies and clients matched by no rule can't send any
+// hyper command. An empty policy allows everything.
+var hyperPolicy []hyperRule
+
+func (r *hyperRule) validate() error {
+	if err := r.peerMatcher.validate(); err != nil {
+		return err
+	}
+
+	for _, name := range r.Commands {
+		if name == anyHyperCommand {
+			continue
+		}
+		if _, ok := hyperstart.CodeList[name]; !ok {
+			return fmt.Errorf("unknown hyper command '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// peer describes the process at the other end of a client connection.
+type peer struct {
+	listener string
+	// uid is the user the peer runs as, only known for unix socket
+	// clients (hasUID).
+	uid    uint32
+	hasUID bool
+	// identity is the common name of the certificate TLS clients
+	// authenticated with.
+	identity string
+	// label is the SELinux context of the peer, only known for unix
+	// socket clients on systems with SELinux (hasLabel).
+	label    string
+	hasLabel bool
+}
+
+// newPeer returns who's at the other end of conn. An error is returned if
+// the TLS handshake with a remote client fails, conn is then to be closed.
+func newPeer(conn net.Conn) (peer, error) {
+	if c, ok := conn.(*tls.Conn); ok {
+		return newTLSPeer(c)
+	}
+
+	p := peer{listener: listenerUnix}
+	p.uid, p.hasUID = peerUID(conn)
+	p.label, p.hasLabel = peerLabel(conn)
+
+	return p, nil
+}
+
+// newTLSPeer completes the handshake with the client at the other end of
+// conn to find out its identity. The client has tlsHandshakeTimeout to
+// complete the handshake.
+func newTLSPeer(conn *tls.Conn) (peer, error) {
+	p := peer{listener: listenerTLS}
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return p, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		p.identity = certs[0].Subject.CommonName
+	}
+
+	return p, nil
+}
+
+// checkHyperPolicy returns an error if the hyper policy doesn't allow the
+// client p to send the hyper command name.
+func checkHyperPolicy(p *peer, name string) error {
+	if len(hyperPolicy) == 0 {
+		return nil
+	}
+
+	for i := range hyperPolicy {
+		rule := &hyperPolicy[i]
+		if !rule.matches(p) {
+			continue
+		}
+		if rule.Commands.allows(name) {
+			return nil
+		}
+		break
+	}
+
+	return newProxyError(api.ErrorCodeForbidden,
+		"client isn't allowed to send the %s hyper command", name)
+}
+
+// commandHyperCommands returns the hyper commands cmd, with payload, sends
+// to hyperstart on behalf of the client.
+func commandHyperCommands(cmd api.Command, payload []byte) []string {
+	// Malformed payloads are rejected by the command handlers.
+	switch cmd {
+	case api.CmdHyper:
+		hyper := api.Hyper{}
+		json.Unmarshal(payload, &hyper)
+		return []string{hyper.HyperName}
+	case api.CmdHyperBatch:
+		batch := api.HyperBatch{}
+		json.Unmarshal(payload, &batch)
+		names := make([]string, len(batch.Commands))
+		for i := range batch.Commands {
+			names[i] = batch.Commands[i].HyperName
+		}
+		return names
+	case api.CmdWriteFile:
+		return []string{hyperapi.CmdWriteFile}
+	case api.CmdReadFile:
+		return []string{hyperapi.CmdReadFile}
+	case api.CmdHotplug:
+		return []string{hyperapi.CmdOnlineCPUMem}
+	}
+
+	return nil
+}
+
+// hyperAuthorizer enforces hyperPolicy.
+type hyperAuthorizer struct{}
+
+func (hyperAuthorizer) Authorize(req *authRequest) error {
+	for _, name := range req.hyperCommands {
+		if err := checkHyperPolicy(req.peer, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selinuxRule gives the proxy commands the clients it matches, running with
+// the SELinux type Type, eg. container_runtime_t, are allowed to send.
+type selinuxRule struct {
+	peerMatcher
+	Commands commandList `json:"commands"`
+}
+
+// selinuxPolicy restricts the commands clients can send according to their
+// SELinux type. The first rule matching the type of a client applies and
+// clients matched by no rule can't send any command. Clients whose SELinux
+// context isn't known, TLS clients or clients of a proxy running without
+// SELinux, aren't subject to it. An empty policy allows everything.
+var selinuxPolicy []selinuxRule
+
+// commandNames maps the names of the commands to their opcode.
+var commandNames = func() map[string]api.Command {
+	names := make(map[string]api.Command)
+	for cmd := api.Command(0); cmd < api.CmdMax; cmd++ {
+		names[cmd.String()] = cmd
+	}
+	return names
+}()
+
+func (r *selinuxRule) validate() error {
+	if r.Type == "" {
+		return errors.New("missing type")
+	}
+
+	if err := r.peerMatcher.validate(); err != nil {
+		return err
+	}
+
+	for _, name := range r.Commands {
+		if name == anyCommand {
+			continue
+		}
+		if _, ok := commandNames[name]; !ok {
+			return fmt.Errorf("unknown command '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// selinuxType returns the type of the SELinux context label,
+// user:role:type:level.
+func selinuxType(label string) (string, bool) {
+	fields := strings.SplitN(label, ":", 4)
+	if len(fields) < 3 || fields[2] == "" {
+		return "", false
+	}
+	return fields[2], true
+}
+
+// checkSELinuxPolicy returns an error if the SELinux policy doesn't allow the
+// client p to send cmd.
+func checkSELinuxPolicy(p *peer, cmd api.Command) error {
+	if len(selinuxPolicy) == 0 || !p.hasLabel {
+		return nil
+	}
+
+	typ, ok := selinuxType(p.label)
+	if !ok {
+		return nil
+	}
+
+	for i := range selinuxPolicy {
+		rule := &selinuxPolicy[i]
+		if !rule.matches(p) {
+			continue
+		}
+		if rule.Commands.allows(cmd.String()) {
+			return nil
+		}
+		break
+	}
+
+	return newProxyError(api.ErrorCodeForbidden,
+		"clients running as %s aren't allowed to send %s", typ, cmd)
+}
+
+// selinuxAuthorizer enforces selinuxPolicy.
+type selinuxAuthorizer struct{}
+
+func (selinuxAuthorizer) Authorize(req *authRequest) error {
+	return checkSELinuxPolicy(req.peer, req.cmd)
+}
+
+func init() {
+	registerAuthorizer(selinuxAuthorizer{})
+	registerAuthorizer(hyperAuthorizer{})
+}
@@ -18,8 +18,11 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/clearcontainers/proxy/api"
+
+	"github.com/golang/glog"
 )
 
 // XXX: could do with its own package to remove that ugly namespacing
@@ -29,6 +32,13 @@ type commandHandler func([]byte, interface{}, *handlerResponse)
 type handlerResponse struct {
 	err     error
 	results map[string]interface{}
+
+	// streamID is the stream ID of the command being handled. The
+	// response is sent back with the same stream ID.
+	streamID int
+
+	// hyperTime is the time spent by the handler waiting for hyperstart.
+	hyperTime time.Duration
 }
 
 func (r *handlerResponse) SetError(err error) {
@@ -43,6 +53,31 @@ func (r *handlerResponse) SetErrorf(format string, a ...interface{}) {
 	r.SetError(fmt.Errorf(format, a...))
 }
 
+// proxyError is an error carrying an api.ErrorCode back to the client.
+type proxyError struct {
+	code api.ErrorCode
+	msg  string
+}
+
+func newProxyError(code api.ErrorCode, format string, a ...interface{}) error {
+	return &proxyError{
+		code: code,
+		msg:  fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *proxyError) Error() string {
+	return e.msg
+}
+
+// errorCode returns the api.ErrorCode associated with err.
+func errorCode(err error) api.ErrorCode {
+	if perr, ok := err.(*proxyError); ok {
+		return perr.code
+	}
+	return api.ErrorCodeUnknown
+}
+
 func (r *handlerResponse) AddResult(key string, value interface{}) {
 	if r.results == nil {
 		r.results = make(map[string]interface{})
@@ -57,6 +92,23 @@ type streamHandler func(frame *api.Frame, userData interface{}) error
 type protocol struct {
 	cmdHandlers   [api.CmdMax]commandHandler
 	streamHandler streamHandler
+
+	// validatePayloads rejects the commands whose payload doesn't match
+	// the schema of api.ValidatePayload before calling their handler.
+	validatePayloads bool
+
+	// authorize, when set, is called before the handler of each command
+	// with its payload and the userData of the client. An error rejects
+	// the command.
+	authorize func(cmd api.Command, payload []byte, userData interface{}) error
+
+	// admit, when set, is called with each frame read from a client
+	// before it's processed. An error closes the connection.
+	admit func(frame *api.Frame, userData interface{}) error
+
+	// containerID, when set, returns the container a command, with
+	// payload, is about for the per container metrics.
+	containerID func(cmd api.Command, payload []byte, userData interface{}) string
 }
 
 func newProtocol() *protocol {
@@ -79,9 +131,27 @@ type clientCtx struct {
 	userData interface{}
 }
 
-func newErrorResponse(opcode int, errMsg string) *api.Frame {
+// logf logs a message about the processing of cmd. Messages are annotated
+// with the opcode of the command and whatever fields the userData object
+// wants to add.
+func (ctx *clientCtx) logf(lvl glog.Level, cmd *api.Frame, format string, a ...interface{}) {
+	if !glog.V(lvl) {
+		return
+	}
+
+	fields := logFields{}
+	if fielder, ok := ctx.userData.(logFielder); ok {
+		fields = fielder.logFields()
+	}
+	fields["OPCODE"] = api.Command(cmd.Header.Opcode).String()
+
+	logf(lvl, fields, "[protocol] ", format, a...)
+}
+
+func newErrorResponse(opcode int, code api.ErrorCode, errMsg string) *api.Frame {
 	frame, err := api.NewFrameJSON(api.TypeResponse, opcode, &api.ErrorResponse{
 		Message: errMsg,
+		Code:    code,
 	})
 	if err != nil {
 		frame, err = api.NewFrameJSON(api.TypeResponse, opcode, &api.ErrorResponse{
@@ -98,7 +168,27 @@ func newErrorResponse(opcode int, errMsg string) *api.Frame {
 }
 
 func (proto *protocol) handleCommand(ctx *clientCtx, cmd *api.Frame) *api.Frame {
-	hr := handlerResponse{}
+	resp := proto.runHandler(ctx, cmd)
+	resp.Header.StreamID = cmd.Header.StreamID
+	return resp
+}
+
+func (proto *protocol) runHandler(ctx *clientCtx, cmd *api.Frame) *api.Frame {
+	hr := handlerResponse{
+		streamID: cmd.Header.StreamID,
+	}
+
+	// cmdErr is the error the command fails with, for the metrics.
+	var cmdErr error
+	received := time.Now()
+	defer func() {
+		var containerID string
+		if proto.containerID != nil && metricsContainerLabels > 0 {
+			containerID = proto.containerID(api.Command(cmd.Header.Opcode), cmd.Payload, ctx.userData)
+		}
+		collector.ObserveCommand(api.Command(cmd.Header.Opcode).String(),
+			containerID, time.Since(received), cmdErr)
+	}()
 
 	// cmd.Header.Opcode is guaranteed to be within the right bounds by
 	// ReadFrame().
@@ -106,21 +196,48 @@ func (proto *protocol) handleCommand(ctx *clientCtx, cmd *api.Frame) *api.Frame
 	if handler == nil {
 		errMsg := fmt.Sprintf("no handler for command %s",
 			api.Command(cmd.Header.Opcode))
-		return newErrorResponse(cmd.Header.Opcode, errMsg)
+		cmdErr = errors.New(errMsg)
+		return newErrorResponse(cmd.Header.Opcode, api.ErrorCodeUnknown, errMsg)
+	}
+
+	if proto.authorize != nil {
+		if err := proto.authorize(api.Command(cmd.Header.Opcode), cmd.Payload, ctx.userData); err != nil {
+			cmdErr = err
+			ctx.logf(1, cmd, "%v", err)
+			return newErrorResponse(cmd.Header.Opcode, errorCode(err), err.Error())
+		}
 	}
 
+	if proto.validatePayloads {
+		err := api.ValidatePayload(api.Command(cmd.Header.Opcode), cmd.Payload)
+		if err != nil {
+			cmdErr = newProxyError(api.ErrorCodeInvalidPayload, "%v", err)
+			ctx.logf(1, cmd, "%v", err)
+			return newErrorResponse(cmd.Header.Opcode, api.ErrorCodeInvalidPayload, err.Error())
+		}
+	}
+
+	start := time.Now()
 	handler(cmd.Payload, ctx.userData, &hr)
+	processing := time.Since(start) - hr.hyperTime
+	commandLatencies.observe(api.Command(cmd.Header.Opcode).String(), processing)
+
 	if hr.err != nil {
-		return newErrorResponse(cmd.Header.Opcode, hr.err.Error())
+		cmdErr = hr.err
+		ctx.logf(1, cmd, "command %s failed: %v", api.Command(cmd.Header.Opcode), hr.err)
+		return newErrorResponse(cmd.Header.Opcode, errorCode(hr.err), hr.err.Error())
 	}
 
+	ctx.logf(2, cmd, "command %s succeeded (proxy: %s, hyperstart: %s)",
+		api.Command(cmd.Header.Opcode), processing, hr.hyperTime)
+
 	var payload interface{}
 	if len(hr.results) > 0 {
 		payload = hr.results
 	}
 	frame, err := api.NewFrameJSON(api.TypeResponse, cmd.Header.Opcode, payload)
 	if err != nil {
-		return newErrorResponse(cmd.Header.Opcode, err.Error())
+		return newErrorResponse(cmd.Header.Opcode, api.ErrorCodeUnknown, err.Error())
 	}
 	return frame
 }
@@ -139,6 +256,7 @@ func (proto *protocol) Serve(conn net.Conn, userData interface{}) error {
 	}
 
 	for {
+		stressYield()
 
 		frame, err := api.ReadFrame(conn)
 		if err != nil {
@@ -147,6 +265,12 @@ func (proto *protocol) Serve(conn net.Conn, userData interface{}) error {
 			return err
 		}
 
+		if proto.admit != nil {
+			if err := proto.admit(frame, userData); err != nil {
+				return err
+			}
+		}
+
 		switch frame.Header.Type {
 		case api.TypeCommand:
 			// Execute the corresponding handler
@@ -68,6 +68,7 @@ func (server *mockServer) ServeWithUserData(userData interface{}) {
 func (server *mockServer) Close() {
 	server.serverConn.Close()
 	server.wg.Wait()
+	server.clientConn.Close()
 }
 
 func setupMockServerWithUserData(t *testing.T, proto *protocol, userData interface{}) (client net.Conn, server *mockServer) {
@@ -178,6 +179,34 @@ func TestProtocol(t *testing.T) {
 	server.Close()
 }
 
+// Payloads not matching their schema don't reach the handler
+func TestValidatePayloads(t *testing.T) {
+	proto := newProtocol()
+	proto.validatePayloads = true
+	proto.HandleCommand(api.CmdSignal, returnDataHandler)
+
+	client, server := setupMockServer(t, proto)
+
+	err := api.WriteCommand(client, api.CmdSignal, []byte(`{"signalNumber":"TERM"}`))
+	assert.Nil(t, err)
+	frame, err := api.ReadFrame(client)
+	assert.Nil(t, err)
+	assert.True(t, frame.Header.InError)
+	errResp := api.ErrorResponse{}
+	assert.Nil(t, json.Unmarshal(frame.Payload, &errResp))
+	assert.Equal(t, api.ErrorCodeInvalidPayload, errResp.Code)
+	assert.Contains(t, errResp.Message, "signalNumber")
+
+	err = api.WriteCommand(client, api.CmdSignal, []byte(`{"signalNumber":15}`))
+	assert.Nil(t, err)
+	frame, err = api.ReadFrame(client)
+	assert.Nil(t, err)
+	assert.False(t, frame.Header.InError)
+	assert.Equal(t, `{"foo":"bar"}`, string(frame.Payload))
+
+	server.Close()
+}
+
 // Make sure the server closes the connection when encountering an error
 func TestCloseOnError(t *testing.T) {
 	proto := newProtocol()
@@ -199,5 +228,8 @@ func TestCloseOnError(t *testing.T) {
 
 func TestMain(m *testing.M) {
 	flag.Parse()
+	// The mock hyperstart doesn't accept new connections once stopped,
+	// don't spend time trying to reconnect to it at the end of each test.
+	hyperReconnectRetries = 0
 	os.Exit(m.Run())
 }
@@ -0,0 +1,489 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// proxy-bench measures the load a cc-proxy can sustain. It registers fake VMs,
+// served by the fake hyperstart of the agentmock package, starts processes in
+// them and connects a synthetic shim to each process. The shims and processes
+// then exchange I/O for a while and the latency and throughput percentiles are
+// printed.
+//
+// Each process exchanges records of -size bytes, starting with the time they
+// were sent, with its shim:
+//
+//   - stdout: the processes write records, the latency is how long they take
+//     to reach the shims
+//   - stdin: the shims write records, the latency is how long they take to
+//     reach the processes
+//   - echo: the shims write records the processes echo back, the latency is
+//     the round trip
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/clearcontainers/proxy/api/hyperstart/agentmock"
+	goapi "github.com/clearcontainers/proxy/client"
+)
+
+// defaultSocketPath is set at link time to the socket path cc-proxy is built
+// with.
+var defaultSocketPath = api.DefaultSocketPath
+
+// I/O patterns.
+const (
+	patternStdout = "stdout"
+	patternStdin  = "stdin"
+	patternEcho   = "echo"
+)
+
+// timestampSize is the size of the time records start with.
+const timestampSize = 8
+
+// shimStreamID is the stream ID of the I/O session of the shims.
+const shimStreamID = 1
+
+type benchConfig struct {
+	socketPath string
+	vms        int
+	processes  int
+	pattern    string
+	size       int
+	interval   time.Duration
+	duration   time.Duration
+}
+
+func (c *benchConfig) validate() error {
+	switch c.pattern {
+	case patternStdout, patternStdin, patternEcho:
+	default:
+		return fmt.Errorf("unknown I/O pattern %s", c.pattern)
+	}
+	if c.vms < 1 || c.processes < 1 {
+		return errors.New("at least one VM and one process per VM are needed")
+	}
+	if c.size < timestampSize {
+		return fmt.Errorf("records are at least %d bytes", timestampSize)
+	}
+	if c.duration <= 0 {
+		return errors.New("the duration must be positive")
+	}
+	return nil
+}
+
+// stamp writes the current time at the start of record.
+func stamp(record []byte) {
+	binary.BigEndian.PutUint64(record, uint64(time.Now().UnixNano()))
+}
+
+// sinceStamp returns the time elapsed since record was stamped.
+func sinceStamp(record []byte) time.Duration {
+	return time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(record))))
+}
+
+// benchVM is a fake VM registered with the proxy.
+type benchVM struct {
+	containerID string
+	agent       *agentmock.Agent
+	runtime     *goapi.Client
+	tokens      []string
+}
+
+func registerVM(config *benchConfig, n int, res *results) (*benchVM, error) {
+	agent, err := agentmock.New()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", config.socketPath)
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+
+	vm := &benchVM{
+		containerID: fmt.Sprintf("proxy-bench-%d-%d", os.Getpid(), n),
+		agent:       agent,
+		runtime:     goapi.NewClient(conn),
+	}
+
+	start := time.Now()
+	ret, err := vm.runtime.RegisterVM(vm.containerID, agent.CtlSocketPath(),
+		agent.IoSocketPath(), &goapi.RegisterVMOptions{NumIOStreams: config.processes})
+	if err != nil {
+		vm.runtime.Close()
+		agent.Close()
+		return nil, fmt.Errorf("RegisterVM: %v", err)
+	}
+	res.registrations.add(time.Since(start))
+	vm.tokens = ret.IO.Tokens
+
+	return vm, nil
+}
+
+// unregister tears vm down. The agent goes first so the proxy doesn't wait
+// for its channels to time out.
+func (vm *benchVM) unregister() error {
+	vm.agent.Close()
+	err := vm.runtime.UnregisterVM(vm.containerID)
+	vm.runtime.Close()
+	return err
+}
+
+// benchProcess is a process of a fake VM and its shim.
+type benchProcess struct {
+	config  *benchConfig
+	process *agentmock.Process
+	conn    net.Conn
+	session *goapi.ShimSession
+	// output accumulates the stdout payloads received by the shim.
+	output []byte
+}
+
+// startProcess connects a shim with token and starts its process.
+func (vm *benchVM) startProcess(config *benchConfig, token string) (*benchProcess, error) {
+	conn, err := net.Dial("unix", config.socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	shim := goapi.NewClient(conn)
+	session, err := shim.ConnectShimSession(token, shimStreamID)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ConnectShim: %v", err)
+	}
+
+	err = vm.runtime.HyperWithTokens(hyperstart.CmdExecCmd, []string{token},
+		&hyperstart.ExecCommand{
+			Container: vm.containerID,
+			Process: hyperstart.Process{
+				Args: []string{"proxy-bench"},
+			},
+		})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("execcmd: %v", err)
+	}
+
+	process, err := vm.agent.WaitProcess(10 * time.Second)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &benchProcess{
+		config:  config,
+		process: process,
+		conn:    conn,
+		session: session,
+	}, nil
+}
+
+var errExited = errors.New("process exited")
+
+// readRecord returns the next record written by the process, errExited once
+// the process has exited.
+func (p *benchProcess) readRecord() ([]byte, error) {
+	for len(p.output) < p.config.size {
+		frame, err := api.ReadFrame(p.conn)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Header.StreamID != shimStreamID {
+			continue
+		}
+
+		switch frame.Header.Type {
+		case api.TypeStream:
+			p.output = append(p.output, frame.Payload...)
+		case api.TypeNotification:
+			if api.Notification(frame.Header.Opcode) == api.NotificationProcessExited {
+				return nil, errExited
+			}
+		}
+	}
+
+	record := p.output[:p.config.size]
+	p.output = p.output[p.config.size:]
+	return record, nil
+}
+
+// waitExit reads the output of the process until it exits, calling handle
+// with each record.
+func (p *benchProcess) waitExit(handle func(record []byte)) error {
+	for {
+		record, err := p.readRecord()
+		if err == errExited {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		handle(record)
+	}
+}
+
+// stdinReader reads the stdin of an agent process.
+type stdinReader struct {
+	process *agentmock.Process
+}
+
+func (r stdinReader) Read(b []byte) (int, error) {
+	return r.process.ReadStdin(b)
+}
+
+// pace waits for the interval between records.
+func (p *benchProcess) pace() {
+	if p.config.interval > 0 {
+		time.Sleep(p.config.interval)
+	}
+}
+
+// run exchanges records between the process and its shim until deadline.
+func (p *benchProcess) run(deadline time.Time, res *results) error {
+	errs := make(chan error, 1)
+	record := make([]byte, p.config.size)
+
+	switch p.config.pattern {
+	case patternStdout:
+		go func() {
+			for time.Now().Before(deadline) {
+				stamp(record)
+				if err := p.process.SendStdout(record); err != nil {
+					errs <- err
+					return
+				}
+				p.pace()
+			}
+			errs <- p.process.Exit(0)
+		}()
+
+		if err := p.waitExit(func(record []byte) {
+			res.addRecord(len(record), sinceStamp(record))
+		}); err != nil {
+			return err
+		}
+
+	case patternStdin:
+		go func() {
+			buf := make([]byte, p.config.size)
+			for {
+				if _, err := io.ReadFull(stdinReader{p.process}, buf); err != nil {
+					break
+				}
+				res.addRecord(len(buf), sinceStamp(buf))
+			}
+			errs <- p.process.Exit(0)
+		}()
+
+		stdin := p.session.Stdin()
+		for time.Now().Before(deadline) {
+			stamp(record)
+			if _, err := stdin.Write(record); err != nil {
+				return err
+			}
+			p.pace()
+		}
+		if err := stdin.Close(); err != nil {
+			return err
+		}
+		if err := p.waitExit(func([]byte) {}); err != nil {
+			return err
+		}
+
+	case patternEcho:
+		go func() {
+			buf := make([]byte, p.config.size)
+			for {
+				if _, err := io.ReadFull(stdinReader{p.process}, buf); err != nil {
+					break
+				}
+				if err := p.process.SendStdout(buf); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- p.process.Exit(0)
+		}()
+
+		stdin := p.session.Stdin()
+		for time.Now().Before(deadline) {
+			stamp(record)
+			if _, err := stdin.Write(record); err != nil {
+				return err
+			}
+			echo, err := p.readRecord()
+			if err != nil {
+				return err
+			}
+			res.addRecord(len(echo), sinceStamp(echo))
+			p.pace()
+		}
+		if err := stdin.Close(); err != nil {
+			return err
+		}
+		if err := p.waitExit(func([]byte) {}); err != nil {
+			return err
+		}
+	}
+
+	return <-errs
+}
+
+func (p *benchProcess) close() {
+	p.conn.Close()
+}
+
+// firstError keeps the first error reported by concurrent goroutines.
+type firstError struct {
+	sync.Mutex
+	err error
+}
+
+func (e *firstError) set(err error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func run(config *benchConfig) error {
+	res := &results{}
+	var errs firstError
+	var wg sync.WaitGroup
+
+	// Register the VMs.
+	vms := make([]*benchVM, config.vms)
+	for i := range vms {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vm, err := registerVM(config, i, res)
+			if err != nil {
+				errs.set(err)
+				return
+			}
+			vms[i] = vm
+		}(i)
+	}
+	wg.Wait()
+
+	defer func() {
+		for _, vm := range vms {
+			if vm != nil {
+				if err := vm.unregister(); err != nil {
+					errs.set(err)
+				}
+			}
+		}
+	}()
+	if errs.err != nil {
+		return errs.err
+	}
+
+	// Start the processes, one at a time per VM as the agent hands them
+	// out in order.
+	var processes []*benchProcess
+	var processesLock sync.Mutex
+	for _, vm := range vms {
+		wg.Add(1)
+		go func(vm *benchVM) {
+			defer wg.Done()
+			for _, token := range vm.tokens {
+				p, err := vm.startProcess(config, token)
+				if err != nil {
+					errs.set(err)
+					return
+				}
+				processesLock.Lock()
+				processes = append(processes, p)
+				processesLock.Unlock()
+			}
+		}(vm)
+	}
+	wg.Wait()
+
+	defer func() {
+		for _, p := range processes {
+			p.close()
+		}
+	}()
+	if errs.err != nil {
+		return errs.err
+	}
+
+	// Push I/O.
+	start := time.Now()
+	deadline := start.Add(config.duration)
+	for _, p := range processes {
+		wg.Add(1)
+		go func(p *benchProcess) {
+			defer wg.Done()
+			if err := p.run(deadline, res); err != nil {
+				errs.set(err)
+			}
+		}(p)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if errs.err != nil {
+		return errs.err
+	}
+
+	fmt.Printf("%d VMs, %d processes per VM, %s pattern, %d byte records\n\n",
+		config.vms, config.processes, config.pattern, config.size)
+	return res.write(os.Stdout, config.pattern, elapsed)
+}
+
+func main() {
+	config := &benchConfig{}
+
+	flag.StringVar(&config.socketPath, "socket-path", defaultSocketPath, "path of the proxy socket")
+	flag.IntVar(&config.vms, "vms", 1, "number of fake VMs registered")
+	flag.IntVar(&config.processes, "processes", 1, "number of processes, each with its shim, per VM")
+	flag.StringVar(&config.pattern, "pattern", patternStdout, "I/O pattern: stdout, stdin or echo")
+	flag.IntVar(&config.size, "size", 4096, "size, in bytes, of the records exchanged")
+	flag.DurationVar(&config.interval, "interval", 0, "pause between the records of a process, 0 to send them back to back")
+	flag.DurationVar(&config.duration, "duration", 10*time.Second, "how long I/O is exchanged")
+	flag.Parse()
+
+	if err := config.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Don't hang forever if the proxy stops relaying I/O.
+	time.AfterFunc(config.duration+time.Minute, func() {
+		fmt.Fprintln(os.Stderr, "timeout: the processes didn't exit")
+		os.Exit(1)
+	})
+
+	if err := run(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// latencies collects the latencies of a kind of operation.
+type latencies struct {
+	sync.Mutex
+	values []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.Lock()
+	l.values = append(l.values, d)
+	l.Unlock()
+}
+
+type byDuration []time.Duration
+
+func (s byDuration) Len() int           { return len(s) }
+func (s byDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool { return s[i] < s[j] }
+
+// percentile returns the p-th percentile, 0 < p <= 100, of sorted, with the
+// nearest rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// summary holds the percentiles of a set of latencies.
+type summary struct {
+	count                    int
+	p50, p90, p99, p999, max time.Duration
+}
+
+func (l *latencies) summary() summary {
+	l.Lock()
+	sorted := make([]time.Duration, len(l.values))
+	copy(sorted, l.values)
+	l.Unlock()
+
+	sort.Sort(byDuration(sorted))
+
+	return summary{
+		count: len(sorted),
+		p50:   percentile(sorted, 50),
+		p90:   percentile(sorted, 90),
+		p99:   percentile(sorted, 99),
+		p999:  percentile(sorted, 99.9),
+		max:   percentile(sorted, 100),
+	}
+}
+
+// results are the measurements of a benchmark run.
+type results struct {
+	registrations latencies
+	io            latencies
+
+	sync.Mutex
+	bytes   int64
+	records int64
+}
+
+func (r *results) addRecord(size int, latency time.Duration) {
+	r.io.add(latency)
+
+	r.Lock()
+	r.bytes += int64(size)
+	r.records++
+	r.Unlock()
+}
+
+// write prints the results of a run which has pushed I/O for elapsed.
+func (r *results) write(w io.Writer, ioName string, elapsed time.Duration) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tCOUNT\tP50\tP90\tP99\tP99.9\tMAX\t")
+	for _, l := range []struct {
+		name string
+		s    summary
+	}{
+		{"RegisterVM", r.registrations.summary()},
+		{ioName, r.io.summary()},
+	} {
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%v\t%v\t%v\t\n", l.name, l.s.count,
+			l.s.p50, l.s.p90, l.s.p99, l.s.p999, l.s.max)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	seconds := elapsed.Seconds()
+	_, err := fmt.Fprintf(w, "\nthroughput: %.2f MB/s, %.0f records/s (%d bytes in %v)\n",
+		float64(r.bytes)/seconds/(1024*1024), float64(r.records)/seconds, r.bytes,
+		elapsed)
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	var l latencies
+	for i := 100; i > 0; i-- {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+
+	s := l.summary()
+	assert.Equal(t, 100, s.count)
+	assert.Equal(t, 50*time.Millisecond, s.p50)
+	assert.Equal(t, 90*time.Millisecond, s.p90)
+	assert.Equal(t, 99*time.Millisecond, s.p99)
+	assert.Equal(t, 100*time.Millisecond, s.p999)
+	assert.Equal(t, 100*time.Millisecond, s.max)
+
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+	assert.Equal(t, time.Second, percentile([]time.Duration{time.Second}, 1))
+}
+
+func TestBenchConfigValidate(t *testing.T) {
+	valid := benchConfig{
+		vms:       1,
+		processes: 1,
+		pattern:   patternEcho,
+		size:      timestampSize,
+		duration:  time.Second,
+	}
+	assert.Nil(t, valid.validate())
+
+	invalid := []func(c *benchConfig){
+		func(c *benchConfig) { c.vms = 0 },
+		func(c *benchConfig) { c.processes = 0 },
+		func(c *benchConfig) { c.pattern = "stderr" },
+		func(c *benchConfig) { c.size = timestampSize - 1 },
+		func(c *benchConfig) { c.duration = 0 },
+	}
+	for _, change := range invalid {
+		c := valid
+		change(&c)
+		assert.NotNil(t, c.validate())
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// proxy-check verifies sessions recorded by cc-proxy -record-dir obey the
+// protocol state machine, eg. to validate third-party runtimes. The
+// recordings given are merged in time order, so a trace spanning several
+// client connections is checked as a whole. Violations are printed with the
+// recording and frame they were found at, the frame being the line of the
+// recording.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/clearcontainers/proxy/sniff"
+)
+
+// frame is a record with the recording it comes from.
+type frame struct {
+	record *sniff.Record
+	path   string
+	// line is the line of the record in the recording, counting from 1.
+	line int
+}
+
+// byTime sorts frames by time, keeping the order of frames recorded at the
+// same time.
+type byTime []*frame
+
+func (f byTime) Len() int      { return len(f) }
+func (f byTime) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byTime) Less(i, j int) bool {
+	return f[i].record.Time.Before(f[j].record.Time)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <recording>...\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func readRecording(path string) ([]*frame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := sniff.ReadRecording(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	frames := make([]*frame, len(records))
+	for i, record := range records {
+		frames[i] = &frame{
+			record: record,
+			path:   path,
+			line:   i + 1,
+		}
+	}
+
+	return frames, nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var frames []*frame
+	for _, path := range flag.Args() {
+		f, err := readRecording(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		frames = append(frames, f...)
+	}
+	sort.Stable(byTime(frames))
+
+	violations := 0
+	checker := sniff.NewChecker()
+	for _, f := range frames {
+		v := checker.Check(f.record)
+		if v == nil {
+			continue
+		}
+		fmt.Printf("%s: frame %d (conn #%d): %s\n", f.path, f.line, v.Conn, v.Message)
+		violations++
+	}
+
+	if violations > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// proxy-replay replays a session recorded by cc-proxy -record-dir. By default,
+// it plays the client side of the session to a proxy. With -listen, it plays
+// the proxy side to the first client connecting to its socket. The frames sent
+// and received are printed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/sniff"
+)
+
+// defaultTarget is set at link time to the socket path cc-proxy is built
+// with.
+var defaultTarget = api.DefaultSocketPath
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [options] <recording>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func readRecording(path string) ([]*sniff.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return sniff.ReadRecording(f)
+}
+
+// accept waits for a client on a new socket at path.
+func accept(path string) (net.Conn, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	return l.Accept()
+}
+
+func main() {
+	target := flag.String("target", defaultTarget, "path of the proxy socket the client side is replayed to")
+	listen := flag.String("listen", "", "replay the proxy side to a client connecting to this socket")
+	speed := flag.Float64("speed", 1, "speed factor applied to the recorded delays between frames, 0 to send them at once")
+	linger := flag.Duration("linger", time.Second, "how long to wait for frames once the recording has been replayed")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	records, err := readRecording(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	replayer := &sniff.Replayer{
+		Direction: sniff.ToProxy,
+		Speed:     *speed,
+		Linger:    *linger,
+		Handler: func(record *sniff.Record) {
+			sniff.Format(os.Stdout, record)
+		},
+	}
+
+	var conn net.Conn
+	if *listen != "" {
+		replayer.Direction = sniff.FromProxy
+		conn, err = accept(*listen)
+	} else {
+		conn, err = net.Dial("unix", *target)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := replayer.Replay(conn, records); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
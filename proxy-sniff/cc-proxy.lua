@@ -0,0 +1,108 @@
+-- Copyright (c) 2016 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Wireshark dissector for the pcap files written by proxy-sniff -format pcap.
+-- Packets use the LINKTYPE_USER0 link type and are made of the pseudo-header
+-- described in the sniff package PcapWriter documentation followed by a
+-- proxy frame. To use it:
+--
+--   $ wireshark -X lua_script:cc-proxy.lua capture.pcap
+
+local proto = Proto("ccproxy", "Clear Containers proxy")
+
+local directions = { [0] = "to proxy", [1] = "from proxy" }
+local types = { [0] = "command", [1] = "response", [2] = "stream", [3] = "notification" }
+local commands = {
+	[0] = "RegisterVM", [1] = "UnregisterVM", [2] = "AttachVM", [3] = "Hyper",
+	[4] = "ConnectShim", [5] = "DisconnectShim", [6] = "Signal", [7] = "Stats",
+	[8] = "Capture", [9] = "Pause", [10] = "Resume", [11] = "WriteFile",
+	[12] = "ReadFile", [13] = "HyperBatch", [14] = "Hotplug", [15] = "Cancel",
+}
+local streams = { [0] = "stdin", [1] = "stdout", [2] = "stderr" }
+local notifications = {
+	[0] = "ProcessExited", [1] = "HyperTimeout", [2] = "VMDegraded",
+	[3] = "VMRecovered", [4] = "ProcessIdle", [5] = "HyperstartLog",
+	[6] = "AgentUnresponsive", [7] = "ProcessFinished", [8] = "VMBoot",
+	[9] = "HyperCompleted",
+}
+
+local f = proto.fields
+f.direction = ProtoField.uint8("ccproxy.direction", "Direction", base.DEC, directions)
+f.error = ProtoField.string("ccproxy.error", "Error")
+f.conn = ProtoField.uint64("ccproxy.conn", "Connection")
+f.version = ProtoField.uint16("ccproxy.version", "Version")
+f.header_length = ProtoField.uint8("ccproxy.header_length", "Header length")
+f.stream_id = ProtoField.uint16("ccproxy.stream_id", "Stream ID")
+f.type = ProtoField.uint8("ccproxy.type", "Type", base.DEC, types, 0x0f)
+f.in_error = ProtoField.bool("ccproxy.in_error", "In error", 8, nil, 0x10)
+f.eof = ProtoField.bool("ccproxy.eof", "EOF", 8, nil, 0x20)
+f.compressed = ProtoField.bool("ccproxy.compressed", "Compressed", 8, nil, 0x40)
+f.opcode = ProtoField.uint8("ccproxy.opcode", "Opcode")
+f.payload_length = ProtoField.uint32("ccproxy.payload_length", "Payload length")
+f.payload = ProtoField.string("ccproxy.payload", "Payload")
+
+local opcodes = { [0] = commands, [1] = commands, [2] = streams, [3] = notifications }
+
+function proto.dissector(buffer, pinfo, tree)
+	if buffer:len() < 12 then
+		return
+	end
+
+	pinfo.cols.protocol = "cc-proxy"
+	local subtree = tree:add(proto, buffer())
+	local conn = buffer(4, 8):uint64()
+	subtree:add(f.direction, buffer(1, 1))
+	subtree:add(f.conn, buffer(4, 8))
+
+	local arrow = buffer(1, 1):uint() == 0 and "->" or "<-"
+
+	if bit.band(buffer(2, 1):uint(), 1) ~= 0 then
+		local message = buffer(12):string()
+		subtree:add(f.error, buffer(12))
+		pinfo.cols.info = string.format("#%s %s error: %s", tostring(conn), arrow, message)
+		return
+	end
+
+	local frame = buffer(12)
+	if frame:len() < 12 then
+		return
+	end
+
+	local header_length = frame(2, 1):uint() * 4
+	local flags = frame(6, 1):uint()
+	local frame_type = bit.band(flags, 0x0f)
+	local opcode = frame(7, 1):uint()
+
+	subtree:add(f.version, frame(0, 2))
+	subtree:add(f.header_length, frame(2, 1), header_length)
+	subtree:add(f.stream_id, frame(4, 2))
+	subtree:add(f.type, frame(6, 1))
+	subtree:add(f.in_error, frame(6, 1))
+	subtree:add(f.eof, frame(6, 1))
+	subtree:add(f.compressed, frame(6, 1))
+
+	local names = opcodes[frame_type] or {}
+	local opcode_name = names[opcode] or "unknown"
+	subtree:add(f.opcode, frame(7, 1)):append_text(" (" .. opcode_name .. ")")
+	subtree:add(f.payload_length, frame(8, 4))
+
+	if frame:len() > header_length then
+		subtree:add(f.payload, frame(header_length))
+	end
+
+	pinfo.cols.info = string.format("#%s %s %s %s", tostring(conn), arrow,
+		types[frame_type] or "unknown", opcode_name)
+end
+
+DissectorTable.get("wtap_encap"):add(wtap.USER0, proto)
@@ -0,0 +1,128 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// proxy-sniff listens on a unix socket, relays the connections it accepts to
+// the cc-proxy socket and prints the frames going through. The frames can
+// also be exported as JSON lines or as a pcap file, and read from a
+// recording made with cc-proxy -record-dir rather than sniffed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/sniff"
+)
+
+// defaultTarget is set at link time to the socket path cc-proxy is built
+// with.
+var defaultTarget = api.DefaultSocketPath
+
+// newHandler returns a handler writing the records to w in format.
+func newHandler(w io.Writer, format string) (sniff.Handler, error) {
+	switch format {
+	case "text":
+		return func(record *sniff.Record) {
+			sniff.Format(w, record)
+		}, nil
+	case "json":
+		writer := sniff.NewJSONWriter(w)
+		return func(record *sniff.Record) {
+			writer.Write(record)
+		}, nil
+	case "pcap":
+		writer, err := sniff.NewPcapWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return func(record *sniff.Record) {
+			writer.Write(record)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// readRecording hands the records of the recording at path to handler.
+func readRecording(path string, handler sniff.Handler) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := sniff.ReadRecording(f)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		handler(record)
+	}
+
+	return nil
+}
+
+func main() {
+	listen := flag.String("listen", "", "path of the socket clients connect to")
+	target := flag.String("target", defaultTarget, "path of the proxy socket")
+	format := flag.String("format", "text", "output format: text, json or pcap")
+	read := flag.String("read", "", "read the frames from a recording rather than sniffing them")
+	flag.Parse()
+
+	if *listen == "" && *read == "" {
+		fmt.Fprintln(os.Stderr, "-listen or -read is needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	handler, err := newHandler(os.Stdout, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *read != "" {
+		if err := readRecording(*read, handler); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	l, err := net.Listen("unix", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Remove the socket on exit.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		l.Close()
+	}()
+
+	sniffer := &sniff.Sniffer{
+		Target:  *target,
+		Handler: handler,
+	}
+	sniffer.Serve(l)
+}
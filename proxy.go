@@ -16,19 +16,21 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/clearcontainers/proxy/api"
 
@@ -47,6 +49,9 @@ const (
 type tokenInfo struct {
 	state tokenState
 	vm    *vm
+	// readOnly is the read-only token of the session, see
+	// readOnlyToken.
+	readOnly Token
 }
 
 // Main struct holding the proxy state
@@ -58,15 +63,42 @@ type proxy struct {
 	// proxy socket
 	listener   net.Listener
 	socketPath string
+	// tlsListener, if not nil, accepts the clients connecting over TCP,
+	// see tlsListenAddr.
+	tlsListener net.Listener
+	// debugListener, if not nil, accepts the clients of the debug
+	// console, see debugSocketPath.
+	debugListener net.Listener
 
 	// vms are hashed by their containerID
 	vms map[string]*vm
 
 	// tokenToVM maps I/O token to their per-token info
 	tokenToVM map[Token]*tokenInfo
-
-	// Output the VM console on stderr
-	enableVMConsole bool
+	// readOnlyTokens maps the read-only tokens to the info of the token
+	// of their session.
+	readOnlyTokens map[Token]*tokenInfo
+
+	// uidConns is the number of connections open by each user, up to
+	// maxConnsPerUID, the value of the global of the same name when the
+	// proxy was created.
+	uidConns       map[uint32]int
+	maxConnsPerUID int
+	// identityConns is the number of connections open by each TLS
+	// identity, up to maxConnsPerUID too.
+	identityConns map[string]int
+
+	// clientConns are the connections of the clients being served,
+	// closed on shutdown, and clients the goroutines serving them.
+	clientConns map[uint64]net.Conn
+	clients     sync.WaitGroup
+
+	// singleVM is set when the proxy is a child of a spawner (see
+	// spawner.go). The proxy then serves a single VM and exits when that
+	// VM is gone.
+	singleVM   bool
+	registered bool
+	closing    bool
 
 	wg sync.WaitGroup
 }
@@ -87,29 +119,107 @@ type client struct {
 
 	kind clientKind
 
-	// token and session are populated once a client has issued a successful
-	// Connectshim.
-	token   Token
-	session *ioSession
+	// peer is who's at the other end of conn, matched against the hyper
+	// policy.
+	peer peer
+
+	// sessions are populated once a client has issued a successful
+	// ConnectShim. A shim can claim several I/O sessions on the same
+	// connection, they are indexed by the stream ID given in ConnectShim.
+	sessions map[int]*ioSession
+
+	// observed are the I/O sessions the client receives the output of
+	// after a read-only ConnectShim, indexed by stream ID.
+	observed map[int]*ioSession
+
+	// limits tracks the usage of the per connection limits.
+	limits clientLimits
 
 	conn net.Conn
 }
 
+// clientConn serializes the writes to a client connection: responses, I/O
+// streams and notifications are written from different goroutines and frames
+// must not interleave. api.WriteFrame issues a single Write per frame.
+type clientConn struct {
+	net.Conn
+	// writeLock serializes the frames written to the client. It's a
+	// channel rather than a mutex so the epoll relay engine can try to
+	// take it without blocking.
+	writeLock chan struct{}
+}
+
+func newClientConn(conn net.Conn) *clientConn {
+	return &clientConn{
+		Conn:      conn,
+		writeLock: make(chan struct{}, 1),
+	}
+}
+
+func (c *clientConn) lockWrite() {
+	stressYield()
+	c.writeLock <- struct{}{}
+}
+
+// tryLockWrite takes the write lock if it's free and returns whether it did.
+func (c *clientConn) tryLockWrite() bool {
+	select {
+	case c.writeLock <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *clientConn) unlockWrite() {
+	<-c.writeLock
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	c.lockWrite()
+	defer c.unlockWrite()
+
+	return c.Conn.Write(b)
+}
+
+// WriteBuffers implements api.BuffersWriter.
+func (c *clientConn) WriteBuffers(bufs [][]byte) (int64, error) {
+	c.lockWrite()
+	defer c.unlockWrite()
+
+	return api.WriteBuffers(c.Conn, bufs)
+}
+
+func (c *client) logFields() logFields {
+	fields := logFields{
+		"CLIENT_ID": strconv.FormatUint(c.id, 10),
+	}
+	if c.vm != nil {
+		fields["CONTAINER_ID"] = c.vm.containerID
+	}
+	if c.peer.identity != "" {
+		fields["PEER_IDENTITY"] = c.peer.identity
+	}
+	return fields
+}
+
 func (c *client) info(lvl glog.Level, msg string) {
 	if !glog.V(lvl) {
 		return
 	}
-	glog.Infof("[client #%d] %s", c.id, msg)
+	logf(lvl, c.logFields(), fmt.Sprintf("[client #%d] ", c.id), "%s", msg)
 }
 
-func (c *client) infof(lvl glog.Level, fmt string, a ...interface{}) {
+func (c *client) infof(lvl glog.Level, format string, a ...interface{}) {
 	if !glog.V(lvl) {
 		return
 	}
-	a = append(a, 0)
-	copy(a[1:], a[0:])
-	a[0] = c.id
-	glog.Infof("[client #%d] "+fmt, a...)
+	logf(lvl, c.logFields(), fmt.Sprintf("[client #%d] ", c.id), format, a...)
+}
+
+// audit logs the audit event about c.
+func (c *client) audit(event string, format string, a ...interface{}) {
+	logAuditf(event, c.logFields(), fmt.Sprintf("[client #%d] ", c.id), format, a...)
 }
 
 func (proxy *proxy) allocateTokens(vm *vm, numIOStreams int) (*api.IOResponse, error) {
@@ -125,6 +235,7 @@ func (proxy *proxy) allocateTokens(vm *vm, numIOStreams int) (*api.IOResponse, e
 	}
 
 	tokens := make([]string, 0, numIOStreams)
+	readOnly := make([]string, 0, numIOStreams)
 
 	for i := 0; i < numIOStreams; i++ {
 		token, err := vm.AllocateToken()
@@ -132,27 +243,94 @@ func (proxy *proxy) allocateTokens(vm *vm, numIOStreams int) (*api.IOResponse, e
 			return nil, err
 		}
 		tokens = append(tokens, string(token))
-		proxy.Lock()
-		proxy.tokenToVM[token] = &tokenInfo{
-			state: tokenStateAllocated,
-			vm:    vm,
+		roToken, err := readOnlyToken(token)
+		if err != nil {
+			return nil, err
 		}
+		readOnly = append(readOnly, string(roToken))
+		proxy.Lock()
+		proxy.addTokenUnlocked(token, &tokenInfo{
+			state:    tokenStateAllocated,
+			vm:       vm,
+			readOnly: roToken,
+		})
 		proxy.Unlock()
 	}
 
 	return &api.IOResponse{
-		URL:    url.String(),
-		Tokens: tokens,
+		URL:            url.String(),
+		Tokens:         tokens,
+		ReadOnlyTokens: readOnly,
 	}, nil
 }
 
+// addTokenUnlocked tracks token, and the read-only token of its session,
+// with info. proxy must be locked.
+func (proxy *proxy) addTokenUnlocked(token Token, info *tokenInfo) {
+	proxy.tokenToVM[token] = info
+	if info.readOnly != nilToken {
+		proxy.readOnlyTokens[info.readOnly] = info
+	}
+}
+
+// removeTokenUnlocked stops tracking token and the read-only token of its
+// session, revoking both. proxy must be locked.
+func (proxy *proxy) removeTokenUnlocked(token Token) {
+	if info := proxy.tokenToVM[token]; info != nil && info.readOnly != nilToken {
+		delete(proxy.readOnlyTokens, info.readOnly)
+	}
+	delete(proxy.tokenToVM, token)
+}
+
+// lookupToken returns the info and the claims of token, once its signature
+// has been checked and its claims match the VM it has been allocated for.
+// proxy must be locked.
+func (proxy *proxy) lookupToken(token Token) (*tokenInfo, *tokenClaims, error) {
+	claims, err := verifyToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if claims.Scope == tokenScopeReadOnly {
+		return nil, nil, newProxyError(api.ErrorCodeForbidden,
+			"read-only token: %s", token)
+	}
+
+	info := proxy.tokenToVM[token]
+	if info == nil {
+		return nil, nil, fmt.Errorf("unknown token: %s", token)
+	}
+
+	if claims.ContainerID != info.vm.containerID {
+		return nil, nil, fmt.Errorf("token issued for container %s, not %s",
+			claims.ContainerID, info.vm.containerID)
+	}
+
+	return info, claims, nil
+}
+
+// lookupValidToken is lookupToken for tokens that mustn't have expired,
+// see tokenValidity. proxy must be locked.
+func (proxy *proxy) lookupValidToken(token Token) (*tokenInfo, error) {
+	info, claims, err := proxy.lookupToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.expired(time.Now()) {
+		return nil, fmt.Errorf("token expired: %s", token)
+	}
+
+	return info, nil
+}
+
 func (proxy *proxy) claimToken(token Token) (*tokenInfo, error) {
 	proxy.Lock()
 	defer proxy.Unlock()
 
-	info := proxy.tokenToVM[token]
-	if info == nil {
-		return nil, fmt.Errorf("unknown token: %s", token)
+	info, err := proxy.lookupValidToken(token)
+	if err != nil {
+		return nil, err
 	}
 
 	if info.state == tokenStateClaimed {
@@ -164,19 +342,101 @@ func (proxy *proxy) claimToken(token Token) (*tokenInfo, error) {
 	return info, nil
 }
 
+// observeToken returns the VM and the claims of token, a token a read-only
+// client wants to observe the I/O session of. Both full and read-only tokens
+// can be observed.
+func (proxy *proxy) observeToken(token Token) (*vm, *tokenClaims, error) {
+	claims, err := verifyToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	if claims.Scope != tokenScopeReadOnly {
+		info, err := proxy.lookupValidToken(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		return info.vm, claims, nil
+	}
+
+	if claims.expired(time.Now()) {
+		return nil, nil, fmt.Errorf("token expired: %s", token)
+	}
+
+	// Read-only tokens are revoked with the token of their session, and
+	// when their VM is unregistered.
+	info := proxy.readOnlyTokens[token]
+	if info == nil || proxy.vms[claims.ContainerID] != info.vm {
+		return nil, nil, fmt.Errorf("unknown token: %s", token)
+	}
+
+	return info.vm, claims, nil
+}
+
 func (proxy *proxy) releaseToken(token Token) (*tokenInfo, error) {
 	proxy.Lock()
 	defer proxy.Unlock()
 
-	info := proxy.tokenToVM[token]
-	if info == nil {
-		return nil, fmt.Errorf("unknown token: %s", token)
+	info, _, err := proxy.lookupToken(token)
+	return info, err
+}
+
+// renewableToken returns the info of token if it's a token of the VM
+// containerID that hasn't expired yet.
+func (proxy *proxy) renewableToken(containerID string, token Token) (*tokenInfo, error) {
+	proxy.Lock()
+	info, err := proxy.lookupValidToken(token)
+	proxy.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.vm.containerID != containerID {
+		return nil, fmt.Errorf("token %s isn't a token of container %s",
+			token, containerID)
 	}
 
 	return info, nil
 }
 
+// renewToken re-issues token, whose info is info, see vm.RenewToken, along
+// with the read-only token of its session. The previous read-only token is
+// revoked with token.
+func (proxy *proxy) renewToken(info *tokenInfo, token Token) (Token, Token, error) {
+	renewed, err := info.vm.RenewToken(token)
+	if err != nil {
+		return nilToken, nilToken, err
+	}
+
+	readOnly, err := readOnlyToken(renewed)
+	if err != nil {
+		return nilToken, nilToken, err
+	}
+
+	proxy.Lock()
+	proxy.removeTokenUnlocked(token)
+	info.readOnly = readOnly
+	proxy.addTokenUnlocked(renewed, info)
+	proxy.Unlock()
+
+	return renewed, readOnly, nil
+}
+
 // "RegisterVM"
+// checkContainerID returns an error if containerID can't safely be used as
+// a file name: it names the per-VM files and sockets of the proxy.
+func checkContainerID(containerID string) error {
+	if containerID == "" || containerID == "." || containerID == ".." ||
+		filepath.Base(containerID) != containerID {
+		return fmt.Errorf("invalid containerID: '%s'", containerID)
+	}
+
+	return nil
+}
+
 func registerVM(data []byte, userData interface{}, response *handlerResponse) {
 	client := userData.(*client)
 	payload := api.RegisterVM{}
@@ -190,6 +450,29 @@ func registerVM(data []byte, userData interface{}, response *handlerResponse) {
 		response.SetErrorMsg("malformed RegisterVM command")
 	}
 
+	if err := checkContainerID(payload.ContainerID); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	if payload.OutputRateLimit < 0 || payload.OutputRateBurst < 0 {
+		response.SetErrorMsg("malformed RegisterVM command: negative output rate limit")
+		return
+	}
+
+	if payload.Async && payload.ProbeAgent {
+		response.SetErrorMsg("malformed RegisterVM command: can't probe the agent of an async VM")
+		return
+	}
+
+	if payload.HyperstartVersion == "" {
+		payload.HyperstartVersion = defaultHyperstartVersion
+	}
+	if err := checkHyperstartVersion(payload.HyperstartVersion); err != nil {
+		response.SetError(err)
+		return
+	}
+
 	proxy := client.proxy
 	proxy.Lock()
 	if _, ok := proxy.vms[payload.ContainerID]; ok {
@@ -200,18 +483,39 @@ func registerVM(data []byte, userData interface{}, response *handlerResponse) {
 		return
 	}
 
+	if proxy.singleVM && proxy.registered {
+		proxy.Unlock()
+		response.SetErrorMsg("this proxy only serves a single VM")
+		return
+	}
+	proxy.registered = true
+
 	client.infof(1,
-		"RegisterVM(containerId=%s,ctlSerial=%s,ioSerial=%s,console=%s)",
+		"RegisterVM(containerId=%s,ctlSerial=%s,ioSerial=%s,console=%s,hyperstart=%s)",
 		payload.ContainerID, payload.CtlSerial, payload.IoSerial,
-		payload.Console)
+		payload.Console, payload.HyperstartVersion)
+	client.audit(auditVMRegistered, "registered VM %s", payload.ContainerID)
 
 	vm := newVM(payload.ContainerID, payload.CtlSerial, payload.IoSerial)
+	if payload.OutputRateLimit > 0 {
+		vm.outputRateLimit = rateLimit{
+			rate:  payload.OutputRateLimit,
+			burst: payload.OutputRateBurst,
+		}
+	}
+	vm.lineBuffered = payload.LineBuffered
+	negotiate := payload.HyperstartVersion == autoHyperstartVersion
+	if !negotiate {
+		vm.hyperstartVersion = payload.HyperstartVersion
+	}
+	vm.booting = payload.Async
 	proxy.vms[payload.ContainerID] = vm
 	proxy.Unlock()
 
-	if payload.Console != "" && proxy.enableVMConsole {
+	if payload.Console != "" {
 		vm.setConsole(payload.Console)
 	}
+	vm.qmpPath = payload.QMP
 
 	io, err := proxy.allocateTokens(vm, payload.NumIOStreams)
 	if err != nil {
@@ -222,6 +526,15 @@ func registerVM(data []byte, userData interface{}, response *handlerResponse) {
 		response.AddResult("io", io)
 	}
 
+	if payload.Async {
+		client.vm = vm
+		vm.addClient(client.id, client.conn, payload.Logs)
+		vm.spawn(func() {
+			proxy.bootVM(vm, negotiate)
+		})
+		return
+	}
+
 	if err := vm.Connect(); err != nil {
 		proxy.Lock()
 		delete(proxy.vms, payload.ContainerID)
@@ -230,15 +543,36 @@ func registerVM(data []byte, userData interface{}, response *handlerResponse) {
 		return
 	}
 
+	if negotiate {
+		vm.negotiateVersion()
+	}
+
+	if payload.ProbeAgent {
+		response.AddResult("agent", vm.probeAgent())
+	}
+
 	client.vm = vm
+	vm.addClient(client.id, client.conn, payload.Logs)
+
+	proxy.monitorVM(vm)
+}
 
+// monitorVM starts the goroutine tearing down vm once it's lost.
+func (proxy *proxy) monitorVM(vm *vm) {
 	// We start one goroutine per-VM to monitor the qemu process
 	proxy.wg.Add(1)
-	go func() {
+	vm.spawn(func() {
 		<-vm.OnVMLost()
+		vm.terminateSessions()
 		vm.Close()
+		proxy.forgetTokens(vm)
+		if proxy.singleVM {
+			proxy.shutdown()
+		} else {
+			proxy.unregisterLostVM(vm)
+		}
 		proxy.wg.Done()
-	}()
+	})
 }
 
 // "attach"
@@ -269,10 +603,12 @@ func attachVM(data []byte, userData interface{}, response *handlerResponse) {
 	if io != nil {
 		response.AddResult("io", io)
 	}
+	response.AddResult("health", vm.health())
 
 	client.infof(1, "AttachVM(containerId=%s)", payload.ContainerID)
 
 	client.vm = vm
+	vm.addClient(client.id, client.conn, payload.Logs)
 }
 
 // "UnregisterVM"
@@ -302,11 +638,16 @@ func unregisterVM(data []byte, userData interface{}, response *handlerResponse)
 	}
 
 	client.info(1, "UnregisterVM()")
+	client.audit(auditVMUnregistered, "unregistered VM %s", vm.containerID)
 
 	proxy.Lock()
 	delete(proxy.vms, vm.containerID)
+	if vm.lostTimer != nil {
+		vm.lostTimer.Stop()
+	}
 	proxy.Unlock()
 
+	vm.removeClient(client.id)
 	client.vm = nil
 }
 
@@ -326,12 +667,134 @@ func hyper(data []byte, userData interface{}, response *handlerResponse) {
 		return
 	}
 
-	client.infof(1, "hyper(cmd=%s, data=%s)", hyper.HyperName, hyper.Data)
+	client.infof(1, "hyper(cmd=%s, data=%s, async=%v)", hyper.HyperName,
+		redactedJSON(hyper.Data), hyper.Async)
+
+	if hyper.Async {
+		if !client.startInFlight() {
+			response.SetErrorf("more than %d commands in flight", maxInFlight)
+			return
+		}
+		id, err := vm.SendMessageAsync(&hyper, client.id, client.endInFlight)
+		if err != nil {
+			response.SetError(err)
+			return
+		}
+		response.AddResult("operationId", id)
+		return
+	}
+
+	hyperTime, err := vm.SendMessage(&hyper)
+	response.hyperTime = hyperTime
+	response.SetError(err)
+}
+
+// "HyperBatch"
+func hyperBatch(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	batch := api.HyperBatch{}
+	vm := client.vm
+
+	if err := json.Unmarshal(data, &batch); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	if vm == nil {
+		response.SetErrorMsg("client not attached to a vm")
+		return
+	}
+
+	if len(batch.Commands) == 0 {
+		response.SetErrorMsg("empty hyper batch")
+		return
+	}
+
+	for i := range batch.Commands {
+		if batch.Commands[i].Async {
+			response.SetErrorMsg(fmt.Sprintf("batch command %d (%s) can't be async",
+				i, batch.Commands[i].HyperName))
+			return
+		}
+	}
+
+	client.infof(1, "HyperBatch(commands=%d)", len(batch.Commands))
+
+	results := make([]api.HyperResult, 0, len(batch.Commands))
+	for i := range batch.Commands {
+		hyper := &batch.Commands[i]
+		result := api.HyperResult{
+			HyperName: hyper.HyperName,
+		}
+
+		hyperTime, err := vm.SendMessage(hyper)
+		response.hyperTime += hyperTime
+		if err != nil {
+			client.infof(1, "HyperBatch: %s failed: %v", hyper.HyperName, err)
+			result.Error = err.Error()
+			result.Code = errorCode(err)
+		}
+		results = append(results, result)
+
+		if err != nil {
+			break
+		}
+	}
+
+	response.AddResult("results", results)
+}
+
+// "WriteFile"
+func writeFile(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	payload := api.WriteFile{}
+	vm := client.vm
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	if vm == nil {
+		response.SetErrorMsg("client not attached to a vm")
+		return
+	}
+
+	client.infof(1, "WriteFile(container=%s, path=%s, size=%d)",
+		payload.Container, payload.Path, len(payload.Data))
 
-	err := vm.SendMessage(&hyper)
+	hyperTime, err := vm.WriteFile(payload.Container, payload.Path, payload.Data)
+	response.hyperTime = hyperTime
 	response.SetError(err)
 }
 
+// "ReadFile"
+func readFile(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	payload := api.ReadFile{}
+	vm := client.vm
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	if vm == nil {
+		response.SetErrorMsg("client not attached to a vm")
+		return
+	}
+
+	client.infof(1, "ReadFile(container=%s, path=%s)", payload.Container, payload.Path)
+
+	content, hyperTime, err := vm.ReadFile(payload.Container, payload.Path)
+	response.hyperTime = hyperTime
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+	response.AddResult("data", content)
+}
+
 // "connectShim"
 func connectShim(data []byte, userData interface{}, response *handlerResponse) {
 	client := userData.(*client)
@@ -343,6 +806,24 @@ func connectShim(data []byte, userData interface{}, response *handlerResponse) {
 		return
 	}
 
+	streamID := response.streamID
+	if client.sessions[streamID] != nil || client.observed[streamID] != nil {
+		response.SetErrorf("stream %d is already associated with an I/O session",
+			streamID)
+		return
+	}
+
+	if payload.ReadOnly {
+		connectObserver(client, &payload, response)
+		return
+	}
+
+	chunkSize, err := negotiateChunkSize(payload.ChunkSize)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
 	token := Token(payload.Token)
 	info, err := proxy.claimToken(token)
 	if err != nil {
@@ -350,17 +831,77 @@ func connectShim(data []byte, userData interface{}, response *handlerResponse) {
 		return
 	}
 
-	session, err := info.vm.AssociateShim(token, client.id, client.conn)
+	compression := negotiateCompression(payload.Compression)
+	lineBuffered := info.vm.lineBuffered
+	if payload.LineBuffered != nil {
+		lineBuffered = *payload.LineBuffered
+	}
+	session, err := info.vm.AssociateShim(token, client.id, client.conn, streamID,
+		payload.Terminal, chunkSize, compression, lineBuffered)
 	if err != nil {
 		response.SetError(err)
 		return
 	}
 
 	client.kind = clientKindShim
-	client.token = token
-	client.session = session
+	if client.sessions == nil {
+		client.sessions = make(map[int]*ioSession)
+	}
+	client.sessions[streamID] = session
+	client.attachSession(session)
+
+	response.AddResult("chunkSize", chunkSize)
+	if compression != "" {
+		response.AddResult("compression", compression)
+	}
+	if lineBuffered {
+		response.AddResult("lineBuffered", true)
+	}
 
-	client.infof(1, "ConnectShim(token=%s)", payload.Token)
+	client.infof(1, "ConnectShim(token=%s,stream=%d,chunkSize=%d,compression=%s,lineBuffered=%v)",
+		payload.Token, streamID, chunkSize, compression, lineBuffered)
+}
+
+// connectObserver handles read-only ConnectShim commands.
+func connectObserver(client *client, payload *api.ConnectShim, response *handlerResponse) {
+	chunkSize, err := negotiateChunkSize(payload.ChunkSize)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	token := Token(payload.Token)
+	vm, claims, err := client.proxy.observeToken(token)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	streamID := response.streamID
+	session, err := vm.AddObserver(claims.IOBase, client.id, client.conn, streamID, chunkSize)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.kind = clientKindShim
+	if client.observed == nil {
+		client.observed = make(map[int]*ioSession)
+	}
+	client.observed[streamID] = session
+
+	response.AddResult("chunkSize", chunkSize)
+
+	client.infof(1, "ConnectShim(token=%s,stream=%d,chunkSize=%d,readOnly)", payload.Token,
+		streamID, chunkSize)
+}
+
+// disconnectObservers stops sending output to client.
+func (client *client) disconnectObservers() {
+	for streamID, session := range client.observed {
+		session.vm.RemoveObserver(session, client.id, streamID)
+		delete(client.observed, streamID)
+	}
 }
 
 // "disconnectShim"
@@ -373,22 +914,43 @@ func disconnectShim(data []byte, userData interface{}, response *handlerResponse
 		return
 	}
 
-	info, err := proxy.releaseToken(client.token)
+	streamID := response.streamID
+	if session := client.observed[streamID]; session != nil {
+		session.vm.RemoveObserver(session, client.id, streamID)
+		delete(client.observed, streamID)
+		client.infof(1, "DisconnectShim(stream=%d,readOnly)", streamID)
+		return
+	}
+
+	session := client.sessions[streamID]
+	if session == nil {
+		response.SetErrorf("stream %d isn't associated with an I/O session", streamID)
+		return
+	}
+
+	info, err := proxy.releaseToken(session.token)
 	if err != nil {
 		response.SetError(err)
 		return
 	}
 
-	err = info.vm.FreeToken(client.token)
+	err = info.vm.FreeToken(session.token)
 	if err != nil {
 		response.SetError(err)
 		return
 	}
 
-	client.session = nil
-	client.token = ""
+	delete(client.sessions, streamID)
+	client.detachSession(session)
 
-	client.infof(1, "DisconnectShim()")
+	client.infof(1, "DisconnectShim(stream=%d)", streamID)
+}
+
+// validTerminalSize returns whether a terminal geometry can be given to
+// hyperstart, which encodes each dimension on 16 bits.
+func validTerminalSize(columns, rows int) bool {
+	return columns > 0 && columns <= math.MaxUint16 &&
+		rows > 0 && rows <= math.MaxUint16
 }
 
 // "signal"
@@ -400,7 +962,12 @@ func signal(data []byte, userData interface{}, response *handlerResponse) {
 		response.SetErrorMsg("client isn't a shim")
 		return
 	}
-	session := client.session
+	session := client.sessions[response.streamID]
+	if session == nil {
+		response.SetErrorf("stream %d isn't associated with an I/O session",
+			response.streamID)
+		return
+	}
 
 	if err := json.Unmarshal(data, &payload); err != nil {
 		response.SetError(err)
@@ -413,7 +980,7 @@ func signal(data []byte, userData interface{}, response *handlerResponse) {
 		response.SetErrorf("invalid signal number %d", payload.SignalNumber)
 		return
 	}
-	if signal == syscall.SIGWINCH && (payload.Columns == 0 || payload.Rows == 0) {
+	if signal == syscall.SIGWINCH && !validTerminalSize(payload.Columns, payload.Rows) {
 		response.SetErrorf("received SIGWINCH but terminal size is invalid (%d,%d)",
 			payload.Columns, payload.Rows)
 		return
@@ -427,11 +994,13 @@ func signal(data []byte, userData interface{}, response *handlerResponse) {
 	client.infof(1, "Signal(%s,%d,%d)", signal, payload.Columns, payload.Rows)
 
 	var err error
+	start := time.Now()
 	if signal == syscall.SIGWINCH {
 		err = session.SendTerminalSize(payload.Columns, payload.Rows)
 	} else {
 		err = session.SendSignal(signal)
 	}
+	response.hyperTime = time.Since(start)
 	if err != nil {
 		response.SetError(err)
 		return
@@ -442,17 +1011,26 @@ func signal(data []byte, userData interface{}, response *handlerResponse) {
 func forwardStdin(frame *api.Frame, userData interface{}) error {
 	client := userData.(*client)
 
-	if client.session == nil {
-		return errors.New("stdin: client not associated with any I/O session")
+	session := client.sessions[frame.Header.StreamID]
+	if session == nil {
+		return fmt.Errorf("stdin: stream %d not associated with any I/O session",
+			frame.Header.StreamID)
 	}
 
-	return client.session.ForwardStdin(frame)
+	return session.ForwardStdin(frame)
 }
 
 func newProxy() *proxy {
 	return &proxy{
 		vms:       make(map[string]*vm),
 		tokenToVM: make(map[Token]*tokenInfo),
+		uidConns:  make(map[uint32]int),
+
+		readOnlyTokens: make(map[Token]*tokenInfo),
+
+		identityConns:  make(map[string]int),
+		maxConnsPerUID: maxConnsPerUID,
+		clientConns:    make(map[uint64]net.Conn),
 	}
 }
 
@@ -463,6 +1041,10 @@ var DefaultSocketPath string
 // ArgSocketPath is populated at runtime from the option -socket-path
 var ArgSocketPath = flag.String("socket-path", "", "specify path to socket file")
 
+// ArgSingleVM is populated at runtime from the option -single-vm
+var ArgSingleVM = flag.Bool("single-vm", false,
+	"serve a single VM and exit once it's gone (used by -spawner)")
+
 // getSocketPath computes the path of the proxy socket. Note that when socket
 // activated, the socket path is specified in the systemd socket file but the
 // same value is set in DefaultSocketPath at link time.
@@ -471,7 +1053,7 @@ func getSocketPath() string {
 	// populate DefaultSocketPath, so fallback to a reasonable
 	// path. People should really use the Makefile though.
 	if DefaultSocketPath == "" {
-		DefaultSocketPath = "/var/run/cc-oci-runtime/proxy.sock"
+		DefaultSocketPath = api.DefaultSocketPath
 	}
 
 	socketPath := DefaultSocketPath
@@ -483,71 +1065,201 @@ func getSocketPath() string {
 	return socketPath
 }
 
-func (proxy *proxy) init() error {
+// listenSocket returns a listener for socketPath, either the socket passed
+// by systemd when socket activated or a newly created one.
+func listenSocket(socketPath string) (net.Listener, error) {
 	var l net.Listener
 	var err error
 
-	// flags
-	v := flag.Lookup("v").Value.(flag.Getter).Get().(glog.Level)
-	proxy.enableVMConsole = v >= 3
-
-	// Open the proxy socket
-	proxy.socketPath = getSocketPath()
 	fds := listenFds()
 
 	if len(fds) > 1 {
-		return fmt.Errorf("too many activated sockets (%d)", len(fds))
+		return nil, fmt.Errorf("too many activated sockets (%d)", len(fds))
 	} else if len(fds) == 1 {
 		fd := fds[0]
 		l, err = net.FileListener(fd)
 		if err != nil {
-			return fmt.Errorf("couldn't listen on socket: %v", err)
+			return nil, fmt.Errorf("couldn't listen on socket: %v", err)
 		}
 
 	} else {
-		socketDir := filepath.Dir(proxy.socketPath)
+		socketDir := filepath.Dir(socketPath)
 		if err = os.MkdirAll(socketDir, 0750); err != nil {
-			return fmt.Errorf("couldn't create socket directory: %v", err)
+			return nil, fmt.Errorf("couldn't create socket directory: %v", err)
 		}
-		if err = os.Remove(proxy.socketPath); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("couldn't remove exiting socket: %v", err)
+		if err = os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("couldn't remove exiting socket: %v", err)
 		}
-		l, err = net.ListenUnix("unix", &net.UnixAddr{Name: proxy.socketPath, Net: "unix"})
+		l, err = net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
 		if err != nil {
-			return fmt.Errorf("couldn't create AF_UNIX socket: %v", err)
+			return nil, fmt.Errorf("couldn't create AF_UNIX socket: %v", err)
 		}
-		if err = os.Chmod(proxy.socketPath, 0660|os.ModeSocket); err != nil {
-			return fmt.Errorf("couldn't set mode on socket: %v", err)
+		if err = os.Chmod(socketPath, 0660|os.ModeSocket); err != nil {
+			return nil, fmt.Errorf("couldn't set mode on socket: %v", err)
 		}
 
-		glog.V(1).Info("listening on ", proxy.socketPath)
+		glog.V(1).Info("listening on ", socketPath)
+	}
+
+	return l, nil
+}
+
+func (proxy *proxy) init() error {
+	var err error
+
+	if err := setupAuthPolicy(); err != nil {
+		return err
+	}
+
+	// Open the proxy socket
+	proxy.socketPath = getSocketPath()
+	proxy.listener, err = listenSocket(proxy.socketPath)
+	if err != nil {
+		return err
+	}
+
+	// The children of a spawner are only reached through the spawner.
+	if tlsListenAddr != "" && !proxy.singleVM {
+		proxy.tlsListener, err = listenTLS(tlsListenAddr)
+		if err != nil {
+			proxy.listener.Close()
+			return err
+		}
 	}
 
-	proxy.listener = l
+	// The children of a spawner inherit its configuration, the spawner
+	// doesn't serve the console.
+	if debugSocketPath != "" && !proxy.singleVM {
+		proxy.debugListener, err = listenDebugSocket(debugSocketPath)
+		if err != nil {
+			proxy.listener.Close()
+			if proxy.tlsListener != nil {
+				proxy.tlsListener.Close()
+			}
+			return err
+		}
+	}
 
 	return nil
 }
 
+// shutdown stops accepting new clients, making serve() return, and
+// disconnects the clients being served.
+func (proxy *proxy) shutdown() {
+	proxy.Lock()
+	proxy.closing = true
+	for _, conn := range proxy.clientConns {
+		conn.Close()
+	}
+	proxy.Unlock()
+
+	proxy.listener.Close()
+	if proxy.tlsListener != nil {
+		proxy.tlsListener.Close()
+	}
+	if proxy.debugListener != nil {
+		proxy.debugListener.Close()
+	}
+}
+
+// wait waits for the goroutines serving the clients and the VMs to return,
+// once the proxy has been shut down.
+func (proxy *proxy) wait() {
+	proxy.clients.Wait()
+	proxy.wg.Wait()
+}
+
+// trackConn records conn is the connection of the client id, to be closed on
+// shutdown. It returns false if the proxy is shutting down already.
+func (proxy *proxy) trackConn(id uint64, conn net.Conn) bool {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	if proxy.closing {
+		return false
+	}
+	proxy.clientConns[id] = conn
+	return true
+}
+
+func (proxy *proxy) untrackConn(id uint64) {
+	proxy.Lock()
+	delete(proxy.clientConns, id)
+	proxy.Unlock()
+}
+
+func (proxy *proxy) isClosing() bool {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	return proxy.closing
+}
+
 var nextClientID = uint64(1)
 
 func (proxy *proxy) serveNewClient(proto *protocol, newConn net.Conn) {
 	newClient := &client{
-		id:    nextClientID,
-		proxy: proxy,
-		conn:  newConn,
+		id:     atomic.AddUint64(&nextClientID, 1) - 1,
+		proxy:  proxy,
+		limits: newClientLimits(),
 	}
 
-	atomic.AddUint64(&nextClientID, 1)
+	if !proxy.trackConn(newClient.id, newConn) {
+		newConn.Close()
+		return
+	}
+	defer proxy.untrackConn(newClient.id)
+
+	peer, err := newPeer(newConn)
+	if err != nil {
+		newClient.infof(1, "TLS handshake failed: %v", err)
+		newConn.Close()
+		return
+	}
+	newClient.peer = peer
 
 	// Unfortunately it's hard to find out information on the peer
 	// at the other end of a unix socket. We use a per-client ID to
 	// identify connections.
 	newClient.info(1, "client connected")
+	stressConn(newConn)
 
-	if err := proto.Serve(newConn, newClient); err != nil && err != io.EOF {
+	if !proxy.acquireConn(newClient) {
+		newConn.Close()
+		return
+	}
+	defer proxy.releaseConn(newClient)
+
+	if recordDir != "" {
+		if rc, err := newRecordingConn(newConn, newClient.id); err != nil {
+			newClient.infof(1, "couldn't record session: %v", err)
+		} else {
+			newClient.infof(1, "recording session to %s", rc.path)
+			newConn = rc
+		}
+	}
+
+	if faultInjection != nil {
+		newConn = newFaultyConn(newConn, newClient.id)
+	}
+
+	conn := newClientConn(newConn)
+	newClient.conn = conn
+	newClient.limits.queued.exceeded = newClient.queuesFull
+
+	if err := proto.Serve(conn, newClient); err != nil && err != io.EOF {
 		newClient.infof(1, "error serving client: %v", err)
 	}
 
+	for _, session := range newClient.sessions {
+		newClient.detachSession(session)
+	}
+
+	if newClient.vm != nil {
+		newClient.vm.removeClient(newClient.id)
+	}
+	newClient.disconnectObservers()
+
 	newConn.Close()
 	newClient.info(1, "connection closed")
 }
@@ -556,6 +1268,10 @@ func (proxy *proxy) serve() {
 
 	// Define the client (runtime/shim) <-> proxy protocol
 	proto := newProtocol()
+	proto.validatePayloads = true
+	proto.authorize = authorizeCommand
+	proto.admit = admitFrame
+	proto.containerID = clientCommandContainer
 	proto.HandleCommand(api.CmdRegisterVM, registerVM)
 	proto.HandleCommand(api.CmdAttachVM, attachVM)
 	proto.HandleCommand(api.CmdUnregisterVM, unregisterVM)
@@ -563,38 +1279,85 @@ func (proxy *proxy) serve() {
 	proto.HandleCommand(api.CmdConnectShim, connectShim)
 	proto.HandleCommand(api.CmdDisconnectShim, disconnectShim)
 	proto.HandleCommand(api.CmdSignal, signal)
+	proto.HandleCommand(api.CmdStats, stats)
+	proto.HandleCommand(api.CmdCapture, capture)
+	proto.HandleCommand(api.CmdPause, pause)
+	proto.HandleCommand(api.CmdResume, resume)
+	proto.HandleCommand(api.CmdWriteFile, writeFile)
+	proto.HandleCommand(api.CmdReadFile, readFile)
+	proto.HandleCommand(api.CmdHyperBatch, hyperBatch)
+	proto.HandleCommand(api.CmdHotplug, hotplug)
+	proto.HandleCommand(api.CmdCancel, cancel)
+	proto.HandleCommand(api.CmdRenewTokens, renewTokens)
 	proto.HandleStream(forwardStdin)
 
 	glog.V(1).Info("proxy started")
 
+	if proxy.tlsListener != nil {
+		go proxy.acceptClients(proto, proxy.tlsListener)
+	}
+	if proxy.debugListener != nil {
+		go proxy.acceptDebugClients(proxy.debugListener)
+	}
+	proxy.acceptClients(proto, proxy.listener)
+}
+
+// acceptClients serves the clients connecting to l until the proxy is shut
+// down.
+func (proxy *proxy) acceptClients(proto *protocol, l net.Listener) {
 	for {
-		conn, err := proxy.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			if proxy.isClosing() {
+				break
+			}
 			fmt.Fprintln(os.Stderr, "couldn't accept connection:", err)
 			continue
 		}
 
-		go proxy.serveNewClient(proto, conn)
+		proxy.clients.Add(1)
+		go func() {
+			proxy.serveNewClient(proto, conn)
+			proxy.clients.Done()
+		}()
 	}
 }
 
 func proxyMain() {
+	leaks := newLeakChecker()
 	proxy := newProxy()
+	proxy.singleVM = *ArgSingleVM
 	if err := proxy.init(); err != nil {
 		fmt.Fprintln(os.Stderr, "init:", err.Error())
 		os.Exit(1)
 	}
+	if err := confine(proxy); err != nil {
+		fmt.Fprintln(os.Stderr, "landlock:", err)
+		os.Exit(1)
+	}
+	publishStats(proxy)
+	publishLatencies()
+	if err := collector.Start(proxy); err != nil {
+		fmt.Fprintln(os.Stderr, "metrics:", err)
+		os.Exit(1)
+	}
 	proxy.serve()
 
 	// Wait for all the goroutines started by registerVMHandler to finish.
 	//
 	// Not strictly necessary as:
-	//   • currently proxy.serve() cannot return,
+	//   • proxy.serve() only returns in single VM mode, once the VM is gone,
 	//   • even if it was, the process is about to exit anyway...
 	//
 	// That said, this wait group is used in the tests to ensure proper
 	// serialisation between runs of proxyMain()(see proxy/proxy_test.go).
-	proxy.wg.Wait()
+	proxy.wait()
+	collector.Stop()
+
+	if err := leaks.check(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func initLogging() {
@@ -630,6 +1393,14 @@ func (p *profiler) setup() {
 
 func main() {
 	var pprof profiler
+	var logMaxSize int64
+	var logBackendName string
+	var configPath string
+	var validateConfig bool
+	var dumpProtocolDescription bool
+	var spawnerMode bool
+
+	logs := newLogFile("")
 
 	initLogging()
 
@@ -640,9 +1411,190 @@ func main() {
 	flag.UintVar(&pprof.port, "pprof-port", 6060,
 		"port the pprof server will be bound to")
 
+	flag.BoolVar(&spawnerMode, "spawner", false,
+		"spawn a dedicated child proxy for each registered VM")
+	flag.StringVar(&configPath, "config", "",
+		"read the configuration from this JSON file, command line options take precedence")
+	flag.BoolVar(&validateConfig, "validate-config", false,
+		"check the configuration, print it with all the options set and exit")
+	flag.BoolVar(&dumpProtocolDescription, "dump-protocol", false,
+		"print a JSON description of the protocol and of the commands, payloads and capabilities supported, and exit")
+	flag.DurationVar(&hyperTimeout, "hyper-timeout", hyperTimeout,
+		"fail hyper commands hyperstart hasn't answered within this duration (0 disables)")
+	flag.BoolVar(&hyperTimeoutUnhealthy, "hyper-timeout-unhealthy", false,
+		"mark a VM as unhealthy when one of its hyper commands times out")
+	flag.IntVar(&hyperReconnectRetries, "hyper-reconnect-retries", hyperReconnectRetries,
+		"number of attempts at reconnecting to hyperstart after an error on its serial channels (0 disables)")
+	flag.DurationVar(&hyperReconnectDelay, "hyper-reconnect-delay", hyperReconnectDelay,
+		"delay before the first reconnection attempt, doubled after each failed attempt")
+	flag.IntVar(&hyperRetries, "hyper-retries", hyperRetries,
+		"number of times an idempotent hyper command is retried after a failure (0 disables)")
+	flag.IntVar(&hyperWriteRetries, "hyper-write-retries", hyperWriteRetries,
+		"number of times a hyper command is retried after a write error on the ctl channel (0 disables)")
+	flag.DurationVar(&hyperRetryDelay, "hyper-retry-delay", hyperRetryDelay,
+		"delay before the first retry of a hyper command, doubled after each attempt")
+	flag.StringVar(&authPolicyFile, "auth-policy", authPolicyFile,
+		"JSON file restricting the commands clients can send")
+	flag.BoolVar(&spliceIO, "splice-io", spliceIO,
+		"relay process output to the shims with splice(2), avoiding copies, when possible")
+	flag.IntVar(&ioSessionBufferSize, "io-session-buffer-size", ioSessionBufferSize,
+		"maximum amount of output, in bytes, buffered for a shim not reading it fast enough")
+	flag.IntVar(&stdinBufferSize, "stdin-buffer-size", stdinBufferSize,
+		"maximum amount of stdin data, in bytes, buffered for a process")
+	flag.IntVar(&observerBufferSize, "observer-buffer-size", observerBufferSize,
+		"maximum amount of output, in bytes, buffered for a read-only client before dropping it")
+	flag.IntVar(&vmBufferLimit, "vm-buffer-limit", vmBufferLimit,
+		"maximum amount of data, in bytes, buffered in all the I/O queues of a VM (0 disables)")
+	flag.IntVar(&outputRateLimit, "output-rate-limit", outputRateLimit,
+		"default rate limit, in bytes per second, of each process stdout and stderr (0 disables)")
+	flag.IntVar(&outputRateBurst, "output-rate-burst", outputRateBurst,
+		"default burst size, in bytes, of rate limited streams (defaults to -output-rate-limit)")
+	flag.StringVar(&captureDir, "capture-dir", captureDir,
+		"directory where I/O capture files are written (defaults to the system temporary directory)")
+	flag.StringVar(&consoleDir, "console-dir", consoleDir,
+		"directory where the console output of each VM is written")
+	flag.StringVar(&recordDir, "record-dir", recordDir,
+		"directory where the frames exchanged with each client are recorded, for proxy-replay")
+	flag.StringVar(&debugSocketPath, "debug-socket", debugSocketPath,
+		"unix socket the debug console, used by proxyctl debug, listens on")
+	flag.StringVar(&relayEngine, "relay-engine", relayEngine,
+		"how process output is written to the shims: goroutine (one per stream) or epoll")
+	flag.IntVar(&streamChunkSize, "stream-chunk-size", streamChunkSize,
+		"default maximum payload size, in bytes, of the stream frames exchanged with the shims")
+	flag.IntVar(&compressionThreshold, "compression-threshold", compressionThreshold,
+		"output throughput, in bytes per second, from which the output of shims supporting it is compressed")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout,
+		"notify clients when a process has had no I/O and hyperstart no ping for that long (0 disables)")
+	flag.DurationVar(&pingInterval, "ping-interval", pingInterval,
+		"how often hyperstart is pinged to check it's alive (0 disables)")
+	flag.IntVar(&pingMisses, "ping-misses", pingMisses,
+		"number of pings in a row hyperstart can miss before being declared unresponsive")
+	flag.DurationVar(&vmLostGracePeriod, "vm-lost-grace-period", vmLostGracePeriod,
+		"how long a VM stays registered once its hyperstart channels are gone for good")
+	flag.DurationVar(&tokenValidity, "token-validity", tokenValidity,
+		"how long after being issued an I/O token can be used by a shim (0 disables expiry)")
+	flag.StringVar(&tlsListenAddr, "tls-listen", tlsListenAddr,
+		"TCP address to accept TLS encrypted connections from remote clients on")
+	flag.StringVar(&tlsCertFile, "tls-cert", tlsCertFile,
+		"PEM encoded certificate of the proxy on its TLS listener")
+	flag.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile,
+		"PEM encoded private key of the proxy on its TLS listener")
+	flag.StringVar(&tlsClientCAFile, "tls-client-ca", tlsClientCAFile,
+		"PEM encoded certificates of the authorities signing the TLS client certificates")
+	flag.IntVar(&maxFrameRate, "max-frame-rate", maxFrameRate,
+		"number of frames per second a client can send before being disconnected (0 disables)")
+	flag.IntVar(&maxInFlight, "max-in-flight", maxInFlight,
+		"number of asynchronous hyper commands a client can have in flight before being disconnected (0 disables)")
+	flag.IntVar(&maxQueuedBytes, "max-queued-bytes", maxQueuedBytes,
+		"amount of I/O data, in bytes, queued for a client from which it's disconnected (0 disables)")
+	flag.IntVar(&maxConnsPerUID, "max-conns-per-uid", maxConnsPerUID,
+		"number of connections the processes of a user, or a TLS identity, can have open at once (0 disables)")
+	flag.BoolVar(&landlock, "landlock", landlock,
+		"restrict the files cc-proxy can access with landlock, once its sockets are listening")
+	flag.StringVar(&auditTarget, "audit-target", auditTarget,
+		"export audit events to this file://, udp://, tcp:// or unix:// URL")
+	flag.StringVar(&auditFormat, "audit-format", auditFormat,
+		"format of the exported audit events: json, cef or syslog")
+	flag.IntVar(&metricsContainerLabels, "metrics-container-labels", metricsContainerLabels,
+		"number of containers for which metrics labelled with their container ID are kept (0 disables)")
+	flag.StringVar(&metricsCollectorName, "metrics-collector", metricsCollectorName,
+		"where the metrics go: prometheus, statsd or none")
+	flag.StringVar(&statsdAddress, "statsd-address", statsdAddress,
+		"host:port of the statsd server the statsd collector sends the metrics to")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", statsdPrefix,
+		"prefix of the names of the statsd metrics")
+	flag.DurationVar(&statsdInterval, "statsd-interval", statsdInterval,
+		"how often metrics are sent to the statsd server")
+	flag.StringVar(&logBackendName, "log-backend", "stderr",
+		"where to send log messages: stderr or journald")
+	flag.StringVar(&logs.path, "log-file", "",
+		"write log messages to this file instead of stderr")
+	flag.Int64Var(&logMaxSize, "log-max-size", 100,
+		"rotate the log file when it reaches this size in MB (0 disables)")
+	flag.DurationVar(&logs.rotateInterval, "log-rotate-interval", 24*time.Hour,
+		"rotate the log file when it gets older than this duration (0 disables)")
+	flag.IntVar(&logs.maxBackups, "log-max-backups", 7,
+		"number of rotated log files to keep (0 keeps them all)")
+	flag.DurationVar(&logs.maxAge, "log-max-age", 0,
+		"remove rotated log files older than this duration (0 disables)")
+	flag.BoolVar(&logs.compress, "log-compress", true,
+		"compress rotated log files")
+
 	flag.Parse()
 	defer glog.Flush()
 
+	if configPath != "" {
+		config, err := loadConfig(configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		config.apply()
+
+		// Parse the command line again so options given there override
+		// the configuration file.
+		flag.Parse()
+	}
+
+	if dumpProtocolDescription {
+		if err := dumpProtocol(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if validateConfig {
+		if err := checkConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if logs.path != "" {
+		logs.maxSize = logMaxSize * 1024 * 1024
+		if err := logs.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "log file:", err)
+			os.Exit(1)
+		}
+		defer logs.Stop()
+	}
+
+	if err := setupLogBackend(logBackendName); err != nil {
+		fmt.Fprintln(os.Stderr, "log backend:", err)
+		os.Exit(1)
+	}
+
+	if logs.path != "" {
+		landlockPaths = append(landlockPaths, filepath.Dir(logs.path))
+	}
+
+	if err := setupAuditExport(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer stopAuditExport()
+
 	pprof.setup()
+	if spawnerMode {
+		spawnerMain()
+		return
+	}
+
+	if err := validStreamChunkSize(streamChunkSize); err != nil {
+		fmt.Fprintln(os.Stderr, "stream chunk size:", err)
+		os.Exit(1)
+	}
+
+	if err := setupRelayEngine(relayEngine); err != nil {
+		fmt.Fprintln(os.Stderr, "relay engine:", err)
+		os.Exit(1)
+	}
+
+	if err := setupMetricsCollector(metricsCollectorName); err != nil {
+		fmt.Fprintln(os.Stderr, "metrics collector:", err)
+		os.Exit(1)
+	}
 	proxyMain()
 }
@@ -15,17 +15,25 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
 	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/clearcontainers/proxy/client/proxytest"
 	"github.com/containers/virtcontainers/pkg/hyperstart/mock"
 
 	"syscall"
@@ -57,9 +65,14 @@ type testRig struct {
 	// fd leak detection
 	detector          *FdLeakDetector
 	startFds, stopFds *FdSnapshot
+
+	// goroutine leak detection, with -tags stress
+	leaks *leakChecker
 }
 
-func newTestRig(t *testing.T) *testRig {
+// newTestProtocol returns a protocol with the same handlers as the one the
+// proxy serves.
+func newTestProtocol() *protocol {
 	proto := newProtocol()
 	proto.HandleCommand(api.CmdRegisterVM, registerVM)
 	proto.HandleCommand(api.CmdAttachVM, attachVM)
@@ -68,11 +81,28 @@ func newTestRig(t *testing.T) *testRig {
 	proto.HandleCommand(api.CmdConnectShim, connectShim)
 	proto.HandleCommand(api.CmdDisconnectShim, disconnectShim)
 	proto.HandleCommand(api.CmdSignal, signal)
+	proto.HandleCommand(api.CmdStats, stats)
+	proto.HandleCommand(api.CmdCapture, capture)
+	proto.HandleCommand(api.CmdPause, pause)
+	proto.HandleCommand(api.CmdResume, resume)
+	proto.HandleCommand(api.CmdWriteFile, writeFile)
+	proto.HandleCommand(api.CmdReadFile, readFile)
+	proto.HandleCommand(api.CmdHyperBatch, hyperBatch)
+	proto.HandleCommand(api.CmdHotplug, hotplug)
+	proto.HandleCommand(api.CmdCancel, cancel)
+	proto.HandleCommand(api.CmdRenewTokens, renewTokens)
 	proto.HandleStream(forwardStdin)
+	proto.authorize = authorizeCommand
+	proto.admit = admitFrame
+	proto.containerID = clientCommandContainer
+
+	return proto
+}
 
+func newTestRig(t *testing.T) *testRig {
 	return &testRig{
 		t:        t,
-		protocol: proto,
+		protocol: newTestProtocol(),
 		proxy:    newProxy(),
 		detector: NewFdLeadDetector(),
 	}
@@ -83,6 +113,7 @@ func (rig *testRig) Start() {
 
 	rig.startFds, err = rig.detector.Snapshot()
 	assert.Nil(rig.t, err)
+	rig.leaks = newLeakChecker()
 
 	initLogging()
 	flag.Parse()
@@ -127,6 +158,7 @@ func (rig *testRig) Stop() {
 
 	assert.True(rig.t,
 		rig.detector.Compare(os.Stdout, rig.startFds, rig.stopFds))
+	assert.Nil(rig.t, rig.leaks.check())
 }
 
 // RegisterVM registers a new VM, returning 1 token that can be used by a shim.
@@ -182,6 +214,12 @@ func TestRegisterVM(t *testing.T) {
 	_, err = rig.Client.RegisterVM(testContainerID, "fooCtl", "fooIo", nil)
 	assert.NotNil(t, err)
 
+	// containerIDs name files, they can't be paths.
+	for _, id := range []string{"../../etc/x", "foo/bar", ".."} {
+		_, err = rig.Client.RegisterVM(id, "fooCtl", "fooIo", nil)
+		assert.NotNil(t, err)
+	}
+
 	// RegisterVM should register a new vm object.
 	proxy := rig.proxy
 	proxy.Lock()
@@ -198,6 +236,188 @@ func TestRegisterVM(t *testing.T) {
 	rig.Stop()
 }
 
+func TestHyperInvalidSpec(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+
+	err := rig.Client.HyperWithTokens("newcontainer", []string{token},
+		hyperstart.Container{
+			ID:      "foo",
+			Process: &hyperstart.Process{},
+		})
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, api.ErrorCodeInvalidSpec, proxyErr.Code)
+		assert.Contains(t, proxyErr.Error(), "process.args")
+	}
+
+	// The command hasn't been forwarded.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 0, len(msgs))
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestRegisterVMProbeAgent(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{ProbeAgent: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, ret.Agent)
+	if ret.Agent != nil {
+		assert.True(t, ret.Agent.Responsive)
+		assert.Equal(t, defaultHyperstartVersion, ret.Agent.HyperstartVersion)
+		// The mock hyperstart doesn't report an API version.
+		assert.Equal(t, 0, ret.Agent.APIVersion)
+		assert.Contains(t, ret.Agent.Commands, "winsize")
+		assert.Contains(t, ret.Agent.Commands, "execcmd")
+		assert.NotContains(t, ret.Agent.Commands, "ready")
+	}
+
+	// The agent has been pinged and asked for its version.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 2, len(msgs))
+	if len(msgs) == 2 {
+		assert.Equal(t, hyperstart.PingCode, int(msgs[0].Code))
+		assert.Equal(t, hyperstart.VersionCode, int(msgs[1].Code))
+	}
+
+	rig.Stop()
+}
+
+func TestRegisterVMProbeAgentTimeout(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// The goroutine sending the timed out ping may stay blocked in the
+	// hyperstart package, see waitCtlMessage.
+	rig.leaks = nil
+
+	// The ping times out right away, as if hyperstart was hung.
+	oldTimeouts := hyperTimeouts
+	hyperTimeouts = map[string]time.Duration{"ping": time.Nanosecond}
+	defer func() { hyperTimeouts = oldTimeouts }()
+
+	// The VM is registered but reported unresponsive.
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{ProbeAgent: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, ret.Agent)
+	if ret.Agent != nil {
+		assert.False(t, ret.Agent.Responsive)
+		assert.Equal(t, defaultHyperstartVersion, ret.Agent.HyperstartVersion)
+	}
+
+	rig.Stop()
+}
+
+// collectBootStates collects the states of the VMBoot notifications received
+// by rig.Client. It must be called before RegisterVM as the notifications
+// may be sent before its response. The returned function waits for a state
+// ending the boot.
+func collectBootStates(t *testing.T, rig *testRig) func() []string {
+	var states []string
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationVMBoot {
+			return
+		}
+		boot := api.VMBoot{}
+		err := json.Unmarshal(payload, &boot)
+		assert.Nil(t, err)
+		assert.Equal(t, testContainerID, boot.ContainerID)
+		states = append(states, boot.State)
+	})
+
+	// Notifications are only read while waiting for a response.
+	ended := func() bool {
+		if len(states) == 0 {
+			return false
+		}
+		last := states[len(states)-1]
+		return last == api.VMBootReady || last == api.VMBootFailed
+	}
+
+	return func() []string {
+		deadline := time.Now().Add(5 * time.Second)
+		for !ended() && time.Now().Before(deadline) {
+			_, err := rig.Client.Stats("")
+			assert.Nil(t, err)
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return states
+	}
+}
+
+func TestRegisterVMAsync(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	bootStates := collectBootStates(t, rig)
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{Async: true, NumIOStreams: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret.IO.Tokens))
+
+	states := bootStates()
+	assert.Equal(t, []string{api.VMBootConnected, api.VMBootStarted,
+		api.VMBootReady}, states)
+
+	// The VM has been pinged and can now be used.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	stats, err := rig.Client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, api.VMStateHealthy, stats.VMs[0].State)
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	// Probing the agent needs to wait for the VM.
+	_, err = rig.Client.RegisterVM("foo", ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{Async: true, ProbeAgent: true})
+	assert.NotNil(t, err)
+
+	rig.Stop()
+}
+
+func TestRegisterVMAsyncFailure(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	bootStates := collectBootStates(t, rig)
+	_, err := rig.Client.RegisterVM(testContainerID, "fooCtl", "fooIo",
+		&goapi.RegisterVMOptions{Async: true})
+	assert.Nil(t, err)
+
+	states := bootStates()
+	assert.Equal(t, []string{api.VMBootFailed}, states)
+
+	// The VM is unregistered.
+	_, err = rig.Client.Stats(testContainerID)
+	assert.NotNil(t, err)
+	err = rig.Client.Hyper("ping", nil)
+	assert.NotNil(t, err)
+
+	// Its container ID can be registered again, which also consumes the
+	// ready message of the rig hyperstart.
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	rig.Stop()
+}
+
 func TestUnregisterVM(t *testing.T) {
 	rig := newTestRig(t)
 	rig.Start()
@@ -254,6 +474,11 @@ func TestAttachVM(t *testing.T) {
 	assert.Nil(t, err)
 	// We haven't asked for I/O tokens
 	assert.Equal(t, 0, len(ret.IO.Tokens))
+	assert.Equal(t, api.VMHealth{
+		State:      api.VMStateHealthy,
+		Responsive: true,
+		Connected:  true,
+	}, ret.Health)
 
 	err = rig.Client.UnregisterVM(testContainerID)
 	assert.Nil(t, err)
@@ -289,6 +514,338 @@ func TestHyperPing(t *testing.T) {
 	rig.Stop()
 }
 
+func TestHyperAsync(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	rig.RegisterVM()
+
+	completed := make(map[uint64]api.HyperCompleted)
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationHyperCompleted {
+			return
+		}
+		c := api.HyperCompleted{}
+		err := json.Unmarshal(payload, &c)
+		assert.Nil(t, err)
+		completed[c.OperationID] = c
+	})
+
+	id1, err := rig.Client.HyperAsync("ping", nil, nil)
+	assert.Nil(t, err)
+	id2, err := rig.Client.HyperAsync("ping", nil, nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	// Notifications are only read while waiting for a response.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(completed) < 2 && time.Now().Before(deadline) {
+		_, err := rig.Client.Stats("")
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, id := range []uint64{id1, id2} {
+		c, ok := completed[id]
+		assert.True(t, ok)
+		assert.Equal(t, testContainerID, c.ContainerID)
+		assert.Equal(t, "ping", c.HyperName)
+		assert.Equal(t, "", c.Error)
+	}
+
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 2, len(msgs))
+
+	// Commands are still checked before the proxy answers.
+	_, err = rig.Client.HyperAsync("newcontainer", nil, hyperstart.Container{
+		ID:      "foo",
+		Process: &hyperstart.Process{},
+	})
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, api.ErrorCodeInvalidSpec, proxyErr.Code)
+	}
+
+	rig.Stop()
+}
+
+func TestCancel(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// The ping times out right away and its retry is scheduled far in the
+	// future: the command stays in flight until cancelled.
+	oldTimeouts, oldRetries, oldDelay := hyperTimeouts, hyperRetries, hyperRetryDelay
+	hyperTimeouts = map[string]time.Duration{"ping": time.Nanosecond}
+	hyperRetries = 1
+	hyperRetryDelay = time.Hour
+	defer func() {
+		hyperTimeouts, hyperRetries, hyperRetryDelay = oldTimeouts, oldRetries, oldDelay
+	}()
+
+	rig.RegisterVM()
+
+	var completed *api.HyperCompleted
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationHyperCompleted {
+			return
+		}
+		completed = &api.HyperCompleted{}
+		err := json.Unmarshal(payload, completed)
+		assert.Nil(t, err)
+	})
+
+	id, err := rig.Client.HyperAsync("ping", nil, nil)
+	assert.Nil(t, err)
+
+	// Another client attached to the VM can't cancel the operation.
+	conn := rig.ServeNewClient()
+	other := goapi.NewClient(conn.(*net.UnixConn))
+	_, err = other.AttachVM(testContainerID, nil)
+	assert.Nil(t, err)
+	err = other.Cancel(testContainerID, id)
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, api.ErrorCodeForbidden, proxyErr.Code)
+	}
+	conn.Close()
+
+	err = rig.Client.Cancel(testContainerID, id)
+	assert.Nil(t, err)
+
+	// Notifications are only read while waiting for a response.
+	deadline := time.Now().Add(5 * time.Second)
+	for completed == nil && time.Now().Before(deadline) {
+		_, err := rig.Client.Stats("")
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, completed)
+	if completed != nil {
+		assert.Equal(t, id, completed.OperationID)
+		assert.Equal(t, api.ErrorCodeCancelled, completed.Code)
+	}
+
+	// The operation isn't in flight anymore.
+	err = rig.Client.Cancel(testContainerID, id)
+	assert.NotNil(t, err)
+	err = rig.Client.Cancel("foo", id)
+	assert.NotNil(t, err)
+
+	rig.Stop()
+}
+
+func TestHyperBatch(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// The client needs to be attached to a VM.
+	_, err := rig.Client.HyperBatch([]api.Hyper{{HyperName: "ping"}})
+	assert.NotNil(t, err)
+
+	rig.RegisterVM()
+
+	results, err := rig.Client.HyperBatch([]api.Hyper{
+		{HyperName: "ping"},
+		{HyperName: "ping"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []api.HyperResult{
+		{HyperName: "ping"},
+		{HyperName: "ping"},
+	}, results)
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 2, len(msgs))
+
+	// The batch stops at the first failed command.
+	invalid, _ := json.Marshal(hyperstart.Container{
+		ID:      "foo",
+		Process: &hyperstart.Process{},
+	})
+	results, err = rig.Client.HyperBatch([]api.Hyper{
+		{HyperName: "ping"},
+		{HyperName: "newcontainer", Data: invalid},
+		{HyperName: "ping"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	if len(results) == 2 {
+		assert.Equal(t, "", results[0].Error)
+		assert.Equal(t, "newcontainer", results[1].HyperName)
+		assert.Equal(t, api.ErrorCodeInvalidSpec, results[1].Code)
+		assert.NotEqual(t, "", results[1].Error)
+	}
+	msgs = rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+
+	// Empty batches and async commands are refused.
+	_, err = rig.Client.HyperBatch(nil)
+	assert.NotNil(t, err)
+	_, err = rig.Client.HyperBatch([]api.Hyper{{HyperName: "ping", Async: true}})
+	assert.NotNil(t, err)
+	msgs = rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 0, len(msgs))
+
+	rig.Stop()
+}
+
+func assertForbidden(t *testing.T, err error) {
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, api.ErrorCodeForbidden, proxyErr.Code)
+	}
+}
+
+func TestHyperPolicy(t *testing.T) {
+	defer saveConfig()()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	rig.RegisterVM()
+
+	// The rig client runs as our UID: the first rule doesn't match it.
+	uid := uint32(os.Getuid())
+	other := uid + 1
+	hyperPolicy = []hyperRule{
+		{peerMatcher{UID: &other}, commandList{anyHyperCommand}},
+		{peerMatcher{UID: &uid, Listener: listenerUnix}, commandList{"ping"}},
+	}
+
+	err := rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	err = rig.Client.Hyper("version", nil)
+	assertForbidden(t, err)
+	_, err = rig.Client.HyperAsync("version", nil, nil)
+	assertForbidden(t, err)
+	_, err = rig.Client.HyperBatch([]api.Hyper{
+		{HyperName: "ping"},
+		{HyperName: "version"},
+	})
+	assertForbidden(t, err)
+	err = rig.Client.WriteFile("foo", "/etc/hosts", []byte("hosts"))
+	assertForbidden(t, err)
+
+	// Only the first ping has been forwarded.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+
+	// Clients matched by no rule can't send anything.
+	hyperPolicy = []hyperRule{
+		{peerMatcher{Listener: listenerTLS}, commandList{anyHyperCommand}},
+	}
+	err = rig.Client.Hyper("ping", nil)
+	assertForbidden(t, err)
+
+	rig.Stop()
+}
+
+func TestSELinuxPolicy(t *testing.T) {
+	defer saveConfig()()
+
+	selinuxPolicy = []selinuxRule{
+		{peerMatcher{Type: "container_runtime_t"}, commandList{anyCommand}},
+		{peerMatcher{Type: "container_t"}, commandList{"ConnectShim", "DisconnectShim", "Signal"}},
+	}
+	labelled := func(label string) *client {
+		return &client{peer: peer{listener: listenerUnix, label: label, hasLabel: true}}
+	}
+
+	runtime := labelled("system_u:system_r:container_runtime_t:s0")
+	assert.Nil(t, checkSELinuxPolicy(&runtime.peer, api.CmdRegisterVM))
+
+	shim := labelled("system_u:system_r:container_t:s0:c1,c2")
+	assert.Nil(t, checkSELinuxPolicy(&shim.peer, api.CmdConnectShim))
+	assert.Equal(t, api.ErrorCodeForbidden, errorCode(checkSELinuxPolicy(&shim.peer, api.CmdRegisterVM)))
+
+	// Types matched by no rule can't send anything.
+	other := labelled("unconfined_u:unconfined_r:unconfined_t:s0")
+	assert.Equal(t, api.ErrorCodeForbidden, errorCode(checkSELinuxPolicy(&other.peer, api.CmdStats)))
+
+	// Clients without an SELinux context aren't subject to the policy.
+	assert.Nil(t, checkSELinuxPolicy(&peer{listener: listenerTLS}, api.CmdRegisterVM))
+	assert.Nil(t, checkSELinuxPolicy(&labelled("unconfined").peer, api.CmdRegisterVM))
+
+	// Forbidden commands don't reach their handler.
+	proto := newProtocol()
+	proto.authorize = authorizeCommand
+	proto.HandleCommand(api.CmdRegisterVM, returnDataHandler)
+	proto.HandleCommand(api.CmdConnectShim, returnDataHandler)
+	conn, server := setupMockServerWithUserData(t, proto, shim)
+	c := proxytest.New(t, conn)
+	c.Send(api.CmdRegisterVM, nil)
+	c.ExpectError(api.CmdRegisterVM).Matching(fmt.Sprintf(`{"code": %d}`, api.ErrorCodeForbidden))
+	c.Send(api.CmdConnectShim, nil)
+	c.ExpectResponse(api.CmdConnectShim).Matching(`{"foo": "bar"}`)
+	server.Close()
+}
+
+func TestHyperstartVersion(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// The proxy refuses to register a VM running an unknown hyperstart.
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{HyperstartVersion: "0.1"})
+	assert.NotNil(t, err)
+
+	_, err = rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{HyperstartVersion: "0.7"})
+	assert.Nil(t, err)
+
+	// Messages hyperstart sends to the host aren't commands.
+	for _, name := range []string{"ready", "ack", "error", "next", "foo"} {
+		err = rig.Client.Hyper(name, nil)
+		assert.NotNil(t, err)
+		proxyErr, ok := err.(*goapi.Error)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, api.ErrorCodeUnsupportedCommand, proxyErr.Code)
+		}
+	}
+
+	// None of them has reached hyperstart.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 0, len(msgs))
+
+	rig.Stop()
+}
+
+func TestHyperstartVersionNegotiation(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{HyperstartVersion: "auto"})
+	assert.Nil(t, err)
+
+	// The agent has been asked for its version.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint32(hyperstart.VersionCode), msgs[0].Code)
+
+	// The mock hyperstart doesn't report an API version: the proxy speaks
+	// the oldest protocol it knows.
+	stats, err := rig.Client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(stats.VMs))
+	assert.Equal(t, hyperstartAPIVersions[0].version, stats.VMs[0].HyperstartVersion)
+	assert.Equal(t, 0, stats.VMs[0].AgentAPIVersion)
+
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	rig.Stop()
+}
+
 func TestHyperStartpod(t *testing.T) {
 	rig := newTestRig(t)
 	rig.Start()
@@ -379,6 +936,11 @@ func TestConnectShim(t *testing.T) {
 	err := rig.Client.ConnectShim("notatoken")
 	assert.NotNil(t, err)
 
+	// So should a token not signed by the proxy
+	forged := strings.Split(token, ".")[0] + ".Zm9yZ2Vk"
+	err = rig.Client.ConnectShim(forged)
+	assert.NotNil(t, err)
+
 	// Register shim with an existing token, all should be good
 	err = rig.Client.ConnectShim(token)
 	assert.Nil(t, err)
@@ -399,41 +961,153 @@ func TestConnectShim(t *testing.T) {
 	rig.Stop()
 }
 
-// Relocations are thoroughly tested in vm_test.go, this is just to ensure we
-// have coverage at a higher level.
-func TestHyperSequenceNumberRelocation(t *testing.T) {
+func TestConnectShimErrors(t *testing.T) {
 	rig := newTestRig(t)
 	rig.Start()
 
 	token := rig.RegisterVM()
-	shim := rig.ServeNewShim(token)
+	shim := proxytest.New(t, rig.ServeNewClient())
 
-	// Send newcontainer hyper command
-	newcontainer := hyperstart.Container{
-		ID: testContainerID,
-		Process: &hyperstart.Process{
-			Args: []string{"/bin/sh"},
-		},
-	}
-	err := rig.Client.HyperWithTokens("newcontainer", []string{token}, &newcontainer)
-	assert.Nil(t, err)
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: "notatoken"})
+	shim.ExpectError(api.CmdConnectShim).
+		Matching(`{"msg": "malformed token: notatoken"}`)
 
-	// Verify hyperstart has received the message with relocation
-	msgs := rig.Hyperstart.GetLastMessages()
-	assert.Equal(t, 1, len(msgs))
-	msg := msgs[0]
-	assert.Equal(t, uint32(hyperstart.NewContainerCode), msg.Code)
-	payload := hyperstart.Container{}
-	err = json.Unmarshal(msg.Message, &payload)
-	assert.Nil(t, err)
-	assert.NotEqual(t, 0, payload.Process.Stdio)
-	assert.NotEqual(t, 0, payload.Process.Stderr)
+	forged := strings.Split(token, ".")[0] + ".Zm9yZ2Vk"
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: forged})
+	shim.ExpectError(api.CmdConnectShim).
+		Matching(`{"msg": "invalid token signature"}`)
+
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: token})
+	shim.ExpectResponse(api.CmdConnectShim)
+
+	// A token claimed by a shim can't be claimed from another connection
+	// either.
+	other := proxytest.New(t, rig.ServeNewClient())
+	other.Send(api.CmdConnectShim, &api.ConnectShim{Token: token})
+	other.ExpectError(api.CmdConnectShim).
+		Matching(`{"msg": "token already claimed: ` + token + `"}`)
+
+	// DisconnectShim has no response.
+	shim.Send(api.CmdDisconnectShim, nil)
+	shim.ExpectClosed()
+	shim.Close()
+	other.Close()
 
-	shim.close()
 	rig.Stop()
 }
 
-type shimRig struct {
+func TestTokenExpiry(t *testing.T) {
+	defer saveConfig()()
+	tokenValidity = 30 * time.Millisecond
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	ret, err := rig.Client.AttachVM(testContainerID, &goapi.AttachVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	renewable := ret.IO.Tokens[0]
+	time.Sleep(2 * tokenValidity)
+
+	shim := proxytest.New(t, rig.ServeNewClient())
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: token})
+	shim.ExpectError(api.CmdConnectShim).
+		Matching(`{"msg": "token expired: ` + token + `"}`)
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: token, ReadOnly: true})
+	shim.ExpectError(api.CmdConnectShim).
+		Matching(`{"msg": "token expired: ` + token + `"}`)
+
+	// Expired tokens can't be renewed.
+	_, err = rig.Client.RenewTokens(testContainerID, []string{renewable})
+	assert.NotNil(t, err)
+
+	shim.Close()
+	rig.Stop()
+}
+
+func TestRenewTokens(t *testing.T) {
+	defer saveConfig()()
+	tokenValidity = 60 * time.Millisecond
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	time.Sleep(tokenValidity / 2)
+
+	resp, err := rig.Client.RenewTokens(testContainerID, []string{token})
+	assert.Nil(t, err)
+	renewed := resp.Tokens
+	assert.Equal(t, 1, len(renewed))
+	assert.Equal(t, 1, len(resp.ReadOnlyTokens))
+	assert.NotEqual(t, token, renewed[0])
+
+	// The token to renew must be a token of the container.
+	_, err = rig.Client.RenewTokens("foo", renewed)
+	assert.NotNil(t, err)
+
+	// Tokens can only be listed once, and a failed renewal doesn't renew
+	// any of them.
+	_, err = rig.Client.RenewTokens(testContainerID, []string{renewed[0], renewed[0]})
+	assert.NotNil(t, err)
+	assert.NotNil(t, rig.proxy.vms[testContainerID].findSessionByToken(Token(renewed[0])))
+
+	// The old token is gone, the new one is valid past the expiry of the
+	// old one.
+	time.Sleep(tokenValidity / 2)
+	shim := proxytest.New(t, rig.ServeNewClient())
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: token})
+	shim.ExpectError(api.CmdConnectShim).
+		Matching(`{"msg": "unknown token: ` + token + `"}`)
+	shim.Send(api.CmdConnectShim, &api.ConnectShim{Token: renewed[0]})
+	shim.ExpectResponse(api.CmdConnectShim)
+
+	vm := rig.proxy.vms[testContainerID]
+	session := vm.findSessionByToken(Token(renewed[0]))
+	assert.NotNil(t, session)
+	assert.Nil(t, vm.findSessionByToken(Token(token)))
+
+	shim.Send(api.CmdDisconnectShim, nil)
+	shim.ExpectClosed()
+	shim.Close()
+	rig.Stop()
+}
+
+// Relocations are thoroughly tested in vm_test.go, this is just to ensure we
+// have coverage at a higher level.
+func TestHyperSequenceNumberRelocation(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+
+	// Send newcontainer hyper command
+	newcontainer := hyperstart.Container{
+		ID: testContainerID,
+		Process: &hyperstart.Process{
+			Args: []string{"/bin/sh"},
+		},
+	}
+	err := rig.Client.HyperWithTokens("newcontainer", []string{token}, &newcontainer)
+	assert.Nil(t, err)
+
+	// Verify hyperstart has received the message with relocation
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	msg := msgs[0]
+	assert.Equal(t, uint32(hyperstart.NewContainerCode), msg.Code)
+	payload := hyperstart.Container{}
+	err = json.Unmarshal(msg.Message, &payload)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, payload.Process.Stdio)
+	assert.NotEqual(t, 0, payload.Process.Stderr)
+
+	shim.close()
+	rig.Stop()
+}
+
+type shimRig struct {
 	t      *testing.T
 	token  string
 	conn   net.Conn
@@ -543,7 +1217,7 @@ func TestShimIO(t *testing.T) {
 	rig.Stop()
 }
 
-func TestShimSignal(t *testing.T) {
+func TestShimStdinEOF(t *testing.T) {
 	rig := newTestRig(t)
 	rig.Start()
 
@@ -551,79 +1225,1765 @@ func TestShimSignal(t *testing.T) {
 	shim := rig.ServeNewShim(token)
 	session := peekIOSession(rig.proxy, token)
 
-	// Send signal and check hyperstart receives the right thing.
-	shim.client.Kill(syscall.SIGUSR1)
-	msgs := rig.Hyperstart.GetLastMessages()
-	assert.Equal(t, 1, len(msgs))
-	decoded := hyperstart.KillCommand{}
-	err := json.Unmarshal(msgs[0].Message, &decoded)
+	// Empty stdin frames aren't forwarded, hyperstart would close stdin.
+	shim.writeIOString("")
+
+	// The last chunk of data can carry the EOF flag.
+	frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte("last\n"))
+	frame.Header.EOF = true
+	err := api.WriteFrame(shim.conn, frame)
 	assert.Nil(t, err)
-	assert.Equal(t, syscall.SIGUSR1, decoded.Signal)
-	assert.Equal(t, testContainerID, decoded.Container)
 
-	// Send new window size and check hyperstart receives the right thing.
-	shim.client.SendTerminalSize(42, 24)
-	msgs = rig.Hyperstart.GetLastMessages()
-	assert.Equal(t, 1, len(msgs))
-	decoded1 := windowSizeMessage07{}
-	err = json.Unmarshal(msgs[0].Message, &decoded1)
+	// Both messages may be read at once, read them one at a time.
+	buf := make([]byte, 12+len("last\n"))
+	n, seq := rig.Hyperstart.ReadIo(buf)
+	assert.Equal(t, session.ioBase, seq)
+	assert.Equal(t, "last\n", string(buf[12:n]))
+
+	// Followed by an empty message, closing stdin.
+	n, seq = rig.Hyperstart.ReadIo(buf[:12])
+	assert.Equal(t, session.ioBase, seq)
+	assert.Equal(t, 12, n)
+
+	// Once closed, stdin data is discarded. The Signal round trip makes
+	// sure the proxy has processed the stream frames.
+	shim.writeIOString("discarded\n")
+	err = shim.client.CloseStdin()
 	assert.Nil(t, err)
-	assert.Equal(t, session.ioBase, decoded1.Seq)
-	assert.Equal(t, uint16(42), decoded1.Column)
-	assert.Equal(t, uint16(24), decoded1.Row)
+	err = shim.client.Kill(syscall.SIGUSR1)
+	assert.Nil(t, err)
+	rig.Hyperstart.GetLastMessages()
+	assert.True(t, session.stdinClosed)
 
-	// Cleanup
 	shim.close()
-
 	rig.Stop()
 }
 
-// smallWaitForShimTimeout overrides the default timeout for the tests
-const smallWaitForShimTimeout = 20 * time.Millisecond
+func TestShimIOLargeOutput(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
 
-// TestShimConnectAfterExeccmd tests we correctly wait for the shim to connect
-// before forwarding the execcmd to hyperstart.
-func TestShimConnectAfterExeccmd(t *testing.T) {
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// Big enough to be spliced, followed by a small write going through
+	// userspace.
+	data := make([]byte, 8*spliceMinSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	rig.Hyperstart.SendIo(session.ioBase, data)
+	rig.Hyperstart.SendIoString(session.ioBase+1, "stderr\n")
+
+	frame := shim.readIOStream()
+	assert.Equal(t, api.StreamStdout, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, data, frame.Payload)
+
+	frame = shim.readIOStream()
+	assert.Equal(t, api.StreamStderr, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, "stderr\n", string(frame.Payload))
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestShimStdinWriter(t *testing.T) {
 	rig := newTestRig(t)
 	rig.Start()
 
 	token := rig.RegisterVM()
+	conn := rig.ServeNewClient()
+	client := goapi.NewClient(conn.(*net.UnixConn))
+	shimSession, err := client.ConnectShimSessionChunkSize(token, 1, 512)
+	assert.Nil(t, err)
+	session := peekIOSession(rig.proxy, token)
 
-	// Send an execcmd. Since we don't have the corresponding shim yet, this
-	// should time out.
-	oldTimeout := waitForShimTimeout
-	waitForShimTimeout = smallWaitForShimTimeout
-	execcmd := hyperstart.ExecCommand{
-		Container: testContainerID,
-		Process: hyperstart.Process{
-			Args: []string{"/bin/sh"},
-		},
+	// Hide the io.WriterTo of bytes.Reader so io.Copy uses ReadFrom.
+	data := []byte(strings.Repeat("0123456789", 130))
+	stdin := shimSession.Stdin()
+	n, err := io.Copy(stdin, struct{ io.Reader }{bytes.NewReader(data)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// The data has been sent in chunks of at most 512 bytes.
+	var received []byte
+	buf := make([]byte, 4096)
+	var pending []byte
+	for len(received) < len(data) {
+		n, _ := rig.Hyperstart.ReadIo(buf)
+		pending = append(pending, buf[:n]...)
+		for len(pending) >= hyperstart.TtyHdrSize {
+			header := parseTtyHeader(pending)
+			if len(pending) < hyperstart.TtyHdrSize+header.length {
+				break
+			}
+			assert.Equal(t, session.ioBase, header.seq)
+			assert.True(t, header.length <= 512)
+			received = append(received,
+				pending[hyperstart.TtyHdrSize:hyperstart.TtyHdrSize+header.length]...)
+			pending = pending[hyperstart.TtyHdrSize+header.length:]
+		}
 	}
-	err := rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	assert.Equal(t, data, received)
+
+	// Write splits its input too.
+	n2, err := stdin.Write(data[:600])
+	assert.Nil(t, err)
+	assert.Equal(t, 600, n2)
+
+	conn.Close()
+	rig.Stop()
+}
+
+func TestShimMultipleSessions(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ret.IO.Tokens))
+
+	// A single shim connection claiming both I/O sessions.
+	conn := rig.ServeNewClient()
+	client := goapi.NewClient(conn.(*net.UnixConn))
+	var sessions []*ioSession
+	for i, token := range ret.IO.Tokens {
+		shimSession, err := client.ConnectShimSession(token, i+1)
+		assert.Nil(t, err)
+		assert.Equal(t, i+1, shimSession.StreamID())
+		sessions = append(sessions, peekIOSession(rig.proxy, token))
+	}
+
+	// Stream IDs can't be claimed twice.
+	_, err = client.ConnectShimSession(ret.IO.Tokens[0], 2)
 	assert.NotNil(t, err)
-	assert.True(t, strings.Contains(err.Error(), "timeout"))
-	waitForShimTimeout = oldTimeout
 
-	// Send an execcmd again, but this time will connect the shim just after the command.
-	shimConn := rig.ServeNewClient()
-	shim := newShimRig(t, shimConn, token)
+	// Output is tagged with the stream ID of its session.
+	for i, session := range sessions {
+		rig.Hyperstart.SendIoString(session.ioBase, "stdout\n")
+		frame, err := api.ReadFrame(conn)
+		assert.Nil(t, err)
+		assert.Equal(t, api.TypeStream, frame.Header.Type)
+		assert.Equal(t, i+1, frame.Header.StreamID)
+		assert.Equal(t, "stdout\n", string(frame.Payload))
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		time.Sleep(smallWaitForShimTimeout)
-		err := shim.connect()
+	// Input is dispatched according to its stream ID.
+	frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte("stdin\n"))
+	frame.Header.StreamID = 2
+	err = api.WriteFrame(conn, frame)
+	assert.Nil(t, err)
+	buf := make([]byte, 32)
+	_, seq := rig.Hyperstart.ReadIo(buf)
+	assert.Equal(t, sessions[1].ioBase, seq)
+
+	conn.Close()
+	rig.Stop()
+}
+
+func TestShimChunkSize(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ret.IO.Tokens))
+
+	conn := rig.ServeNewClient()
+	client := goapi.NewClient(conn.(*net.UnixConn))
+
+	// Sizes are clamped.
+	small, err := client.ConnectShimSessionChunkSize(ret.IO.Tokens[0], 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, minStreamChunkSize, small.ChunkSize())
+	smallSession := peekIOSession(rig.proxy, ret.IO.Tokens[0])
+
+	def, err := client.ConnectShimSession(ret.IO.Tokens[1], 2)
+	assert.Nil(t, err)
+	assert.Equal(t, streamChunkSize, def.ChunkSize())
+	defSession := peekIOSession(rig.proxy, ret.IO.Tokens[1])
+
+	// Output is split in frames no bigger than the chunk size.
+	data := make([]byte, 3*minStreamChunkSize+100)
+	rig.Hyperstart.SendIo(smallSession.ioBase, data)
+	for _, size := range []int{minStreamChunkSize, minStreamChunkSize, minStreamChunkSize, 100} {
+		frame, err := api.ReadFrame(conn)
 		assert.Nil(t, err)
-		wg.Done()
+		assert.Equal(t, 1, frame.Header.StreamID)
+		assert.Equal(t, size, len(frame.Payload))
+	}
+
+	// Stdin frames bigger than what hyperstart accepts in one message are
+	// split.
+	stdin := make([]byte, maxTtyPayload+100)
+	frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), stdin)
+	frame.Header.StreamID = 2
+	err = api.WriteFrame(conn, frame)
+	assert.Nil(t, err)
+
+	buf := make([]byte, len(stdin)+2*hyperstart.TtyHdrSize)
+	for read := 0; read < len(buf); {
+		n, _ := rig.Hyperstart.ReadIo(buf[read:])
+		read += n
+	}
+	for _, size := range []int{maxTtyPayload, 100} {
+		seq := binary.BigEndian.Uint64(buf[:hyperstart.TtyHdrLenOffset])
+		length := binary.BigEndian.Uint32(buf[hyperstart.TtyHdrLenOffset:hyperstart.TtyHdrSize])
+		assert.Equal(t, defSession.ioBase, seq)
+		assert.Equal(t, uint32(hyperstart.TtyHdrSize+size), length)
+		buf = buf[hyperstart.TtyHdrSize+size:]
+	}
+
+	conn.Close()
+	rig.Stop()
+}
+
+func TestShimCompression(t *testing.T) {
+	oldThreshold := compressionThreshold
+	compressionThreshold = 0
+	defer func() {
+		compressionThreshold = oldThreshold
 	}()
 
-	err = rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 2})
 	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ret.IO.Tokens))
 
-	wg.Wait()
+	conn := rig.ServeNewClient()
+	client := goapi.NewClient(conn.(*net.UnixConn))
 
-	// Cleanup
-	shim.close()
+	compressed, err := client.ConnectShimSessionCompression(ret.IO.Tokens[0], 1,
+		[]string{"foo", api.CompressionDeflate})
+	assert.Nil(t, err)
+	assert.Equal(t, api.CompressionDeflate, compressed.Compression())
+	compressedSession := peekIOSession(rig.proxy, ret.IO.Tokens[0])
+
+	raw, err := client.ConnectShimSession(ret.IO.Tokens[1], 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "", raw.Compression())
+	rawSession := peekIOSession(rig.proxy, ret.IO.Tokens[1])
+
+	data := []byte(strings.Repeat("log line\n", 500))
+
+	rig.Hyperstart.SendIo(compressedSession.ioBase, data)
+	frame, err := api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, frame.Header.StreamID)
+	assert.True(t, frame.Header.Compressed)
+	assert.True(t, frame.Header.PayloadLength < len(data))
+	err = api.InflateFrame(frame)
+	assert.Nil(t, err)
+	assert.Equal(t, data, frame.Payload)
+
+	// Shims that haven't asked for it don't get compressed output.
+	rig.Hyperstart.SendIo(rawSession.ioBase, data)
+	frame, err = api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, frame.Header.StreamID)
+	assert.False(t, frame.Header.Compressed)
+	assert.Equal(t, data, frame.Payload)
+
+	conn.Close()
+	rig.Stop()
+}
+
+func TestShimLineBuffered(t *testing.T) {
+	oldDelay := lineFlushDelay
+	lineFlushDelay = time.Minute
+	defer func() {
+		lineFlushDelay = oldDelay
+	}()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{
+			NumIOStreams: 2,
+			LineBuffered: true,
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ret.IO.Tokens))
+
+	conn := rig.ServeNewClient()
+	client := goapi.NewClient(conn.(*net.UnixConn))
+
+	buffered, err := client.ConnectShimSession(ret.IO.Tokens[0], 1)
+	assert.Nil(t, err)
+	assert.True(t, buffered.LineBuffered())
+	bufferedSession := peekIOSession(rig.proxy, ret.IO.Tokens[0])
+
+	raw, err := client.ConnectShimSessionLineBuffered(ret.IO.Tokens[1], 2, false)
+	assert.Nil(t, err)
+	assert.False(t, raw.LineBuffered())
+	rawSession := peekIOSession(rig.proxy, ret.IO.Tokens[1])
+
+	readPayload := func(streamID int) string {
+		frame, err := api.ReadFrame(conn)
+		assert.Nil(t, err)
+		assert.Equal(t, streamID, frame.Header.StreamID)
+		return string(frame.Payload)
+	}
+
+	rig.Hyperstart.SendIoString(bufferedSession.ioBase, "foo")
+	rig.Hyperstart.SendIoString(bufferedSession.ioBase, "bar\nba")
+	rig.Hyperstart.SendIoString(bufferedSession.ioBase, "z\n")
+	assert.Equal(t, "foobar\n", readPayload(1))
+	assert.Equal(t, "baz\n", readPayload(1))
+
+	rig.Hyperstart.SendIoString(rawSession.ioBase, "foo")
+	assert.Equal(t, "foo", readPayload(2))
+
+	// The incomplete line is forwarded when the process exits.
+	rig.Hyperstart.SendIoString(bufferedSession.ioBase, "prompt$ ")
+	rig.Hyperstart.CloseIo(bufferedSession.ioBase)
+	assert.Equal(t, "prompt$ ", readPayload(1))
+
+	conn.Close()
+	rig.Stop()
+}
+
+func TestShimSlowClient(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ret.IO.Tokens))
+
+	slow := rig.ServeNewShim(ret.IO.Tokens[0])
+	slowSession := peekIOSession(rig.proxy, ret.IO.Tokens[0])
+	fast := rig.ServeNewShim(ret.IO.Tokens[1])
+	fastSession := peekIOSession(rig.proxy, ret.IO.Tokens[1])
+
+	// More than the socket buffer of the slow shim, that doesn't read its
+	// output for now.
+	data := make([]byte, 8192)
+	n := 64
+	for i := 0; i < n; i++ {
+		rig.Hyperstart.SendIo(slowSession.ioBase, data)
+	}
+
+	// The other shim still receives its output.
+	received := make(chan *api.Frame)
+	go func() {
+		received <- fast.readIOStream()
+	}()
+	rig.Hyperstart.SendIoString(fastSession.ioBase, "stdout\n")
+	select {
+	case frame := <-received:
+		assert.Equal(t, "stdout\n", string(frame.Payload))
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "output blocked by a slow shim")
+	}
+
+	// Nothing has been lost for the slow shim.
+	for i := 0; i < n; i++ {
+		frame := slow.readIOStream()
+		assert.Equal(t, data, frame.Payload)
+	}
+
+	slow.close()
+	fast.close()
+	rig.Stop()
+}
+
+func TestShimOutputRateLimit(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{
+			NumIOStreams:    1,
+			OutputRateLimit: 50000,
+			OutputRateBurst: 1000,
+		})
+	assert.Nil(t, err)
+
+	token := ret.IO.Tokens[0]
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// The first write fits in the burst, the next two have to wait for
+	// 20ms each.
+	data := make([]byte, 1000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		rig.Hyperstart.SendIo(session.ioBase, data)
+	}
+	for i := 0; i < 3; i++ {
+		frame := shim.readIOStream()
+		assert.Equal(t, data, frame.Payload)
+	}
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestStats(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+	start := time.Now()
+
+	// Associate the session with a container.
+	err := rig.Client.HyperWithTokens("newcontainer", []string{token},
+		hyperstart.Container{
+			ID:      "foo",
+			Process: &hyperstart.Process{Args: []string{"/bin/sh"}},
+		})
+	assert.Nil(t, err)
+
+	shim.writeIOString("stdin\n")
+	buf := make([]byte, 32)
+	rig.Hyperstart.ReadIo(buf)
+
+	rig.Hyperstart.SendIoString(session.ioBase, "stdout\n")
+	shim.readIOStream()
+	rig.Hyperstart.SendIoString(session.ioBase+1, "err")
+	shim.readIOStream()
+
+	stats, err := rig.Client.Stats("")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(stats.VMs))
+	assert.Equal(t, testContainerID, stats.VMs[0].ContainerID)
+	assert.Equal(t, api.VMStateHealthy, stats.VMs[0].State)
+	assert.Nil(t, stats.VMs[0].LastPing)
+	assert.Equal(t, 1, len(stats.VMs[0].Containers))
+	foo := stats.VMs[0].Containers["foo"]
+	assert.Equal(t, uint64(6), foo.Stdin)
+	assert.Equal(t, uint64(7), foo.Stdout)
+	assert.Equal(t, uint64(3), foo.Stderr)
+	assert.False(t, foo.LastActivity.Before(start))
+	assert.Equal(t, uint64(1), stats.VMs[0].HyperCommands)
+
+	// The hyperstart channels, the runtime and shim connections.
+	resources := stats.VMs[0].Resources
+	assert.Equal(t, 1, resources.Tokens)
+	assert.Equal(t, 1, resources.ClaimedTokens)
+	assert.True(t, resources.Goroutines > 0)
+	assert.True(t, resources.FDs >= 4)
+
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	stats, err = rig.Client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(stats.VMs))
+	assert.NotNil(t, stats.VMs[0].LastPing)
+
+	_, err = rig.Client.Stats("bar")
+	assert.NotNil(t, err)
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestProcessFinished(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	var finished *api.ProcessFinished
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationProcessFinished {
+			return
+		}
+		finished = &api.ProcessFinished{}
+		err := json.Unmarshal(payload, finished)
+		assert.Nil(t, err)
+	})
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	err := rig.Client.HyperWithTokens("newcontainer", []string{token},
+		hyperstart.Container{
+			ID:      "foo",
+			Process: &hyperstart.Process{Args: []string{"/bin/sh"}},
+		})
+	assert.Nil(t, err)
+
+	rig.Hyperstart.CloseIo(session.ioBase)
+	rig.Hyperstart.SendExitStatus(session.ioBase, 42)
+
+	// The shim receives the exit status.
+	frame, err := api.ReadFrame(shim.conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.NotificationProcessExited, frame.Header.Opcode)
+	assert.Equal(t, []byte{42}, frame.Payload)
+
+	// And so does the runtime, which only reads notifications while
+	// waiting for a response.
+	_, err = rig.Client.Stats("")
+	assert.Nil(t, err)
+	assert.NotNil(t, finished)
+	if finished != nil {
+		assert.Equal(t, testContainerID, finished.ContainerID)
+		assert.Equal(t, "foo", finished.Container)
+		assert.Equal(t, token, finished.Token)
+		assert.Equal(t, 42, finished.ExitStatus)
+		assert.False(t, finished.Lost)
+	}
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestVMLost(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	oldRetries, oldGracePeriod := hyperReconnectRetries, vmLostGracePeriod
+	hyperReconnectRetries = 0
+	vmLostGracePeriod = 100 * time.Millisecond
+
+	var finished *api.ProcessFinished
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationProcessFinished {
+			return
+		}
+		finished = &api.ProcessFinished{}
+		err := json.Unmarshal(payload, finished)
+		assert.Nil(t, err)
+	})
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+
+	err := rig.Client.HyperWithTokens("newcontainer", []string{token},
+		hyperstart.Container{
+			ID:      "foo",
+			Process: &hyperstart.Process{Args: []string{"/bin/sh"}},
+		})
+	assert.Nil(t, err)
+
+	// Lose the connection to hyperstart.
+	rig.proxy.Lock()
+	vm := rig.proxy.vms[testContainerID]
+	rig.proxy.Unlock()
+	h := vm.hyper()
+	h.GetCtlSock().Close()
+	h.GetIoSock().Close()
+
+	// The shim is told its process has exited, then disconnected.
+	frame, err := api.ReadFrame(shim.conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.TypeNotification, frame.Header.Type)
+	assert.Equal(t, api.NotificationProcessExited, frame.Header.Opcode)
+	assert.Equal(t, []byte{lostProcessExitStatus}, frame.Payload)
+	_, err = api.ReadFrame(shim.conn)
+	assert.NotNil(t, err)
+
+	stats, err := rig.Client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, api.VMStateLost, stats.VMs[0].State)
+
+	// The runtime is told too.
+	assert.NotNil(t, finished)
+	if finished != nil {
+		assert.Equal(t, token, finished.Token)
+		assert.Equal(t, lostProcessExitStatus, finished.ExitStatus)
+		assert.True(t, finished.Lost)
+	}
+
+	// The VM is unregistered after the grace period.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = rig.Client.Stats(testContainerID); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, err)
+
+	// Its token is gone too.
+	_, err = rig.proxy.claimToken(Token(token))
+	assert.NotNil(t, err)
+
+	shim.close()
+	rig.Stop()
+
+	hyperReconnectRetries, vmLostGracePeriod = oldRetries, oldGracePeriod
+}
+
+// testQMP is a fake QEMU serving QMP on a unix socket.
+type testQMP struct {
+	t        *testing.T
+	path     string
+	listener net.Listener
+	conns    chan net.Conn
+
+	sync.Mutex
+	// executed are the commands received, qmp_capabilities and queries
+	// excluded.
+	executed []qmpCommand
+}
+
+func newTestQMP(t *testing.T) *testQMP {
+	dir, err := ioutil.TempDir("", "cc-proxy-qmp")
+	assert.Nil(t, err)
+
+	q := &testQMP{
+		t:     t,
+		path:  filepath.Join(dir, "qmp.sock"),
+		conns: make(chan net.Conn, 1),
+	}
+	q.listener, err = net.Listen("unix", q.path)
+	assert.Nil(t, err)
+
+	go func() {
+		conn, err := q.listener.Accept()
+		if err != nil {
+			return
+		}
+		q.conns <- conn
+		q.serve(conn)
+	}()
+
+	return q
+}
+
+func (q *testQMP) serve(conn net.Conn) {
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	enc.Encode(map[string]interface{}{
+		"QMP": map[string]interface{}{"capabilities": []string{}},
+	})
+
+	status := map[string]interface{}{
+		"status":  "running",
+		"running": true,
+	}
+	cpus := []map[string]int{{"CPU": 0}, {"CPU": 1}}
+	empty := map[string]interface{}{}
+	replies := map[string]interface{}{
+		"qmp_capabilities": empty,
+		"query-status":     status,
+		"stop":             empty,
+		"cont":             empty,
+		"cpu-add":          empty,
+		"object-add":       empty,
+		"device_add":       empty,
+	}
+
+	for {
+		var cmd qmpCommand
+		if err := dec.Decode(&cmd); err != nil {
+			return
+		}
+
+		// Events can come at any time.
+		enc.Encode(map[string]interface{}{"event": "RTC_CHANGE"})
+
+		switch cmd.Execute {
+		case "stop":
+			status["status"], status["running"] = "paused", false
+		case "cont":
+			status["status"], status["running"] = "running", true
+		case "cpu-add":
+			cpus = append(cpus, map[string]int{"CPU": len(cpus)})
+		}
+		replies["query-cpus"] = cpus
+
+		if !strings.HasPrefix(cmd.Execute, "q") {
+			q.Lock()
+			q.executed = append(q.executed, cmd)
+			q.Unlock()
+		}
+
+		if ret, ok := replies[cmd.Execute]; ok {
+			enc.Encode(map[string]interface{}{"return": ret})
+		} else {
+			enc.Encode(map[string]interface{}{
+				"error": map[string]string{
+					"class": "CommandNotFound",
+					"desc":  "The command " + cmd.Execute + " has not been found",
+				},
+			})
+		}
+	}
+}
+
+// getExecuted returns the commands received so far, apart from the queries.
+func (q *testQMP) getExecuted() []qmpCommand {
+	q.Lock()
+	defer q.Unlock()
+
+	executed := q.executed
+	q.executed = nil
+	return executed
+}
+
+// exit simulates QEMU exiting.
+func (q *testQMP) exit() {
+	conn := <-q.conns
+	conn.Close()
+}
+
+func (q *testQMP) close() {
+	select {
+	case conn := <-q.conns:
+		conn.Close()
+	default:
+	}
+	q.listener.Close()
+	os.RemoveAll(filepath.Dir(q.path))
+}
+
+func TestQMP(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// Without QMP, the proxy would try to reconnect to hyperstart.
+	oldRetries, oldDelay := hyperReconnectRetries, hyperReconnectDelay
+	hyperReconnectRetries = 5
+	hyperReconnectDelay = 10 * time.Second
+
+	qemu := newTestQMP(t)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{QMP: qemu.path})
+	assert.Nil(t, err)
+
+	stats, err := rig.Client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(stats.VMs))
+	assert.Equal(t, &api.QEMUState{
+		Status:  "running",
+		Running: true,
+		VCPUs:   2,
+	}, stats.VMs[0].QEMU)
+
+	// The VM is lost as soon as QEMU exits.
+	qemu.exit()
+	deadline := time.Now().Add(5 * time.Second)
+	state := ""
+	for state != api.VMStateLost && time.Now().Before(deadline) {
+		stats, err = rig.Client.Stats(testContainerID)
+		assert.Nil(t, err)
+		state = stats.VMs[0].State
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, api.VMStateLost, state)
+	assert.Nil(t, stats.VMs[0].QEMU)
+
+	// An unreachable QMP socket fails the registration.
+	_, err = rig.Client.RegisterVM("foo", ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{QMP: "/does/not/exist"})
+	assert.NotNil(t, err)
+
+	qemu.close()
+	rig.Stop()
+
+	hyperReconnectRetries, hyperReconnectDelay = oldRetries, oldDelay
+}
+
+func TestPauseVM(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	qemu := newTestQMP(t)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{QMP: qemu.path})
+	assert.Nil(t, err)
+
+	qemuStatus := func() string {
+		stats, err := rig.Client.Stats(testContainerID)
+		assert.Nil(t, err)
+		if stats.VMs[0].QEMU == nil {
+			return ""
+		}
+		return stats.VMs[0].QEMU.Status
+	}
+
+	// The I/O relay is paused, then the vCPUs.
+	err = rig.Client.PauseVM(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, "paused", qemuStatus())
+	err = rig.Client.Pause(testContainerID)
+	assert.NotNil(t, err)
+
+	err = rig.Client.Resume(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, "running", qemuStatus())
+
+	// Pausing the I/O relay only leaves QEMU alone.
+	err = rig.Client.Pause(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, "running", qemuStatus())
+	err = rig.Client.Resume(testContainerID)
+	assert.Nil(t, err)
+
+	qemu.close()
+	rig.Stop()
+}
+
+func TestHotplug(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	qemu := newTestQMP(t)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{QMP: qemu.path})
+	assert.Nil(t, err)
+	qemu.getExecuted()
+
+	ret, err := rig.Client.Hotplug(testContainerID, 2, 512)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, ret.VCPUs)
+
+	// The new vCPUs follow the 2 existing ones, then a DIMM is plugged.
+	executed := qemu.getExecuted()
+	assert.Equal(t, 4, len(executed))
+	if len(executed) == 4 {
+		assert.Equal(t, "cpu-add", executed[0].Execute)
+		assert.Equal(t, float64(2), executed[0].Arguments["id"])
+		assert.Equal(t, float64(3), executed[1].Arguments["id"])
+		assert.Equal(t, "object-add", executed[2].Execute)
+		props := executed[2].Arguments["props"].(map[string]interface{})
+		assert.Equal(t, float64(512<<20), props["size"])
+		assert.Equal(t, "device_add", executed[3].Execute)
+		assert.Equal(t, "pc-dimm", executed[3].Arguments["driver"])
+		assert.Equal(t, executed[2].Arguments["id"], executed[3].Arguments["memdev"])
+	}
+
+	// hyperstart has been asked to online them.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint32(hyperstart.OnlineCPUMemCode), msgs[0].Code)
+
+	_, err = rig.Client.Hotplug(testContainerID, 0, 0)
+	assert.NotNil(t, err)
+	_, err = rig.Client.Hotplug("foo", 1, 0)
+	assert.NotNil(t, err)
+
+	qemu.close()
+	rig.Stop()
+}
+
+func TestAgentUnresponsive(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// Pings time out right away, as if hyperstart was hung.
+	oldInterval, oldMisses := pingInterval, pingMisses
+	oldTimeouts := hyperTimeouts
+	pingInterval = 10 * time.Millisecond
+	pingMisses = 2
+	hyperTimeouts = map[string]time.Duration{"ping": time.Nanosecond}
+
+	var unresponsive *api.AgentUnresponsive
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationAgentUnresponsive {
+			return
+		}
+		unresponsive = &api.AgentUnresponsive{}
+		err := json.Unmarshal(payload, unresponsive)
+		assert.Nil(t, err)
+	})
+
+	rig.RegisterVM()
+
+	// Notifications are only read while waiting for a response.
+	deadline := time.Now().Add(5 * time.Second)
+	for unresponsive == nil && time.Now().Before(deadline) {
+		_, err := rig.Client.Stats("")
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.NotNil(t, unresponsive)
+	if unresponsive != nil {
+		assert.Equal(t, testContainerID, unresponsive.ContainerID)
+		assert.True(t, unresponsive.MissedPings >= pingMisses)
+		assert.Nil(t, unresponsive.LastPing)
+	}
+
+	// Hyper commands are rejected and Stats reports the state.
+	err := rig.Client.Hyper("version", nil)
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	assert.Equal(t, api.ErrorCodeAgentUnresponsive, proxyErr.Code)
+
+	stats, err := rig.Client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.Equal(t, api.VMStateUnresponsive, stats.VMs[0].State)
+
+	rig.Stop()
+
+	pingInterval, pingMisses = oldInterval, oldMisses
+	hyperTimeouts = oldTimeouts
+}
+
+func TestProcessIdle(t *testing.T) {
+	oldTimeout := idleTimeout
+	idleTimeout = 5 * time.Millisecond
+	defer func() {
+		idleTimeout = oldTimeout
+	}()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	var notifications []api.Notification
+	var idle api.ProcessIdle
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		notifications = append(notifications, n)
+		err := json.Unmarshal(payload, &idle)
+		assert.Nil(t, err)
+	})
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+
+	err := rig.Client.HyperWithTokens("execcmd", []string{token},
+		&hyperstart.ExecCommand{
+			Container: testContainerID,
+			Process: hyperstart.Process{
+				Args: []string{"/bin/sh"},
+			},
+		})
+	assert.Nil(t, err)
+	start := time.Now()
+
+	// The process is only reported once while it stays idle. Notifications
+	// are read along with the response of the next command.
+	time.Sleep(10 * idleTimeout)
+	_, err = rig.Client.Stats("")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.Notification{api.NotificationProcessIdle}, notifications)
+	assert.Equal(t, testContainerID, idle.ContainerID)
+	assert.Equal(t, token, idle.Token)
+	assert.True(t, idle.LastActivity.Before(start))
+	assert.Nil(t, idle.LastPing)
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestHyperstartLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-console")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	consolePath := filepath.Join(dir, "console.sock")
+	listener, err := net.Listen("unix", consolePath)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	var logs []api.HyperstartLog
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationHyperstartLog {
+			return
+		}
+		log := api.HyperstartLog{}
+		err := json.Unmarshal(payload, &log)
+		assert.Nil(t, err)
+		logs = append(logs, log)
+	})
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{
+			Console: consolePath,
+			Logs:    true,
+		})
+	assert.Nil(t, err)
+
+	console, err := listener.Accept()
+	assert.Nil(t, err)
+	_, err = console.Write([]byte("hyper_setup_container: mounting rootfs\r\n"))
+	assert.Nil(t, err)
+
+	// Notifications are read along with the response of the next command.
+	for i := 0; i < 100 && len(logs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, err = rig.Client.Stats("")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []api.HyperstartLog{
+		{
+			ContainerID: testContainerID,
+			Message:     "hyper_setup_container: mounting rootfs",
+		},
+	}, logs)
+
+	console.Close()
+	rig.Stop()
+}
+
+func TestConsoleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-console")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	saved := consoleDir
+	consoleDir = filepath.Join(dir, "consoles")
+	defer func() { consoleDir = saved }()
+
+	consolePath := filepath.Join(dir, "console.sock")
+	listener, err := net.Listen("unix", consolePath)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{
+			Console: consolePath,
+		})
+	assert.Nil(t, err)
+
+	console, err := listener.Accept()
+	assert.Nil(t, err)
+	// A partial last line is kept as well.
+	_, err = console.Write([]byte("Linux version 4.9.35\nKernel panic"))
+	assert.Nil(t, err)
+	console.Close()
+
+	err = rig.Client.UnregisterVM(testContainerID)
+	assert.Nil(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(consoleDir,
+		testContainerID+".console"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Linux version 4.9.35\nKernel panic", string(data))
+
+	rig.Stop()
+}
+
+func TestCommandLatencies(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	rig.RegisterVM()
+
+	commands := commandLatencies.snapshot()["Hyper"].Count
+	pings := hyperLatencies.snapshot()["ping"].Count
+
+	err := rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, commands+1, commandLatencies.snapshot()["Hyper"].Count)
+	assert.Equal(t, pings+1, hyperLatencies.snapshot()["ping"].Count)
+
+	rig.Stop()
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	saved := captureDir
+	captureDir = dir
+	defer func() { captureDir = saved }()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	_, err = rig.Client.Capture(testContainerID, false)
+	assert.NotNil(t, err)
+
+	path, err := rig.Client.Capture(testContainerID, true)
+	assert.Nil(t, err)
+	assert.Equal(t, dir, filepath.Dir(path))
+	assert.True(t, strings.HasPrefix(filepath.Base(path), testContainerID+"-"))
+
+	// Only one capture at a time.
+	_, err = rig.Client.Capture(testContainerID, true)
+	assert.NotNil(t, err)
+
+	// Capture files can't be created outside of captureDir.
+	_, err = newIOCapture("../" + testContainerID)
+	assert.NotNil(t, err)
+
+	shim.writeIOString("stdin\n")
+	buf := make([]byte, 32)
+	rig.Hyperstart.ReadIo(buf)
+	rig.Hyperstart.SendIoString(session.ioBase+1, "stderr\n")
+	shim.readIOStream()
+
+	stopped, err := rig.Client.Capture(testContainerID, false)
+	assert.Nil(t, err)
+	assert.Equal(t, path, stopped)
+
+	// Not captured anymore.
+	rig.Hyperstart.SendIoString(session.ioBase, "stdout\n")
+	shim.readIOStream()
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	var records []captureRecord
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		record := captureRecord{}
+		assert.Nil(t, decoder.Decode(&record))
+		records = append(records, record)
+	}
+	f.Close()
+
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "stdin", records[0].Stream)
+	assert.Equal(t, session.ioBase, records[0].Seq)
+	assert.Equal(t, "stdin\n", string(records[0].Data))
+	assert.Equal(t, "stderr", records[1].Stream)
+	assert.Equal(t, session.ioBase+1, records[1].Seq)
+	assert.Equal(t, "stderr\n", string(records[1].Data))
+
+	_, err = rig.Client.Capture("bar", true)
+	assert.NotNil(t, err)
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestPause(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	err := rig.Client.Resume(testContainerID)
+	assert.NotNil(t, err)
+
+	err = rig.Client.Pause(testContainerID)
+	assert.Nil(t, err)
+	err = rig.Client.Pause(testContainerID)
+	assert.NotNil(t, err)
+
+	// The output isn't relayed anymore.
+	rig.Hyperstart.SendIoString(session.ioBase, "stdout\n")
+	shim.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = api.ReadFrame(shim.conn)
+	assert.NotNil(t, err)
+	shim.conn.SetReadDeadline(time.Time{})
+
+	// stdin is held by the proxy. Stats makes sure the stdin frame has
+	// been handled.
+	shim.writeIOString("stdin\n")
+	_, err = shim.client.Stats(testContainerID)
+	assert.Nil(t, err)
+	assert.True(t, session.input.buffered() > 0)
+
+	err = rig.Client.Resume(testContainerID)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 32)
+	n, seq := rig.Hyperstart.ReadIo(buf)
+	assert.Equal(t, session.ioBase, seq)
+	assert.Equal(t, "stdin\n", string(buf[12:n]))
+
+	frame := shim.readIOStream()
+	assert.Equal(t, "stdout\n", string(frame.Payload))
+
+	err = rig.Client.Pause("bar")
+	assert.NotNil(t, err)
+
+	// The VM has no QMP socket: its vCPUs can't be stopped.
+	err = rig.Client.PauseVM(testContainerID)
+	assert.NotNil(t, err)
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestShimReadOnly(t *testing.T) {
+	saved := observerBufferSize
+	observerBufferSize = 16 * 1024
+	defer func() { observerBufferSize = saved }()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// A log collector watching the output of the process.
+	conn := rig.ServeNewClient()
+	collector := goapi.NewClient(conn.(*net.UnixConn))
+	watch, err := collector.ConnectShimReadOnly(token, 1)
+	assert.Nil(t, err)
+
+	// It can't interact with the process.
+	err = watch.Kill(syscall.SIGUSR1)
+	assert.NotNil(t, err)
+
+	// Both get the output.
+	rig.Hyperstart.SendIoString(session.ioBase, "stdout\n")
+	frame := shim.readIOStream()
+	assert.Equal(t, "stdout\n", string(frame.Payload))
+	assert.Equal(t, 0, frame.Header.StreamID)
+	frame, err = api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.StreamStdout, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, 1, frame.Header.StreamID)
+	assert.Equal(t, "stdout\n", string(frame.Payload))
+
+	// The collector not reading its output doesn't hold up the shim, the
+	// output is dropped for the collector instead.
+	data := make([]byte, 8192)
+	n := 64
+	for i := 0; i < n; i++ {
+		rig.Hyperstart.SendIo(session.ioBase, data)
+		frame := shim.readIOStream()
+		assert.Equal(t, data, frame.Payload)
+	}
+
+	observers := session.vm.sessionObservers(session)
+	assert.Equal(t, 1, len(observers))
+	session.vm.Lock()
+	assert.True(t, observers[0].dropped > 0)
+	session.vm.Unlock()
+
+	// Closing the connection stops the observation.
+	conn.Close()
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestShimReadOnlyToken(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret.IO.ReadOnlyTokens))
+	token, readOnly := ret.IO.Tokens[0], ret.IO.ReadOnlyTokens[0]
+
+	// A read-only token can't be claimed by a shim, nor renewed.
+	other := proxytest.New(t, rig.ServeNewClient())
+	other.Send(api.CmdConnectShim, &api.ConnectShim{Token: readOnly})
+	other.ExpectError(api.CmdConnectShim).
+		Matching(fmt.Sprintf(`{"msg": "read-only token: %s", "code": %d}`, readOnly,
+			api.ErrorCodeForbidden))
+	other.Close()
+	_, err = rig.Client.RenewTokens(testContainerID, []string{readOnly})
+	assert.NotNil(t, err)
+
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// It gives a copy of the output of the session.
+	conn := rig.ServeNewClient()
+	collector := goapi.NewClient(conn.(*net.UnixConn))
+	_, err = collector.ConnectShimReadOnly(readOnly, 1)
+	assert.Nil(t, err)
+
+	rig.Hyperstart.SendIoString(session.ioBase, "stdout\n")
+	frame := shim.readIOStream()
+	assert.Equal(t, "stdout\n", string(frame.Payload))
+	frame, err = api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, frame.Header.StreamID)
+	assert.Equal(t, "stdout\n", string(frame.Payload))
+
+	conn.Close()
+	shim.close()
+	rig.Stop()
+}
+
+func TestRenewTokensRevokesReadOnly(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	ret, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	token, readOnly := ret.IO.Tokens[0], ret.IO.ReadOnlyTokens[0]
+
+	resp, err := rig.Client.RenewTokens(testContainerID, []string{token})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.ReadOnlyTokens))
+	renewed := resp.ReadOnlyTokens[0]
+	assert.NotEqual(t, readOnly, renewed)
+
+	// The read-only token of the old token is revoked with it.
+	conn := rig.ServeNewClient()
+	client := goapi.NewClient(conn.(*net.UnixConn))
+	_, err = client.ConnectShimReadOnly(readOnly, 1)
+	assert.NotNil(t, err)
+	_, err = client.ConnectShimReadOnly(renewed, 1)
+	assert.Nil(t, err)
+	conn.Close()
+
+	// Unregistering the VM revokes the new one.
+	err = rig.Client.UnregisterVM(testContainerID)
+	assert.Nil(t, err)
+	conn = rig.ServeNewClient()
+	client = goapi.NewClient(conn.(*net.UnixConn))
+	_, err = client.ConnectShimReadOnly(renewed, 1)
+	assert.NotNil(t, err)
+	conn.Close()
+
+	rig.Stop()
+}
+
+// TestEpollRelayEngine runs the I/O tests with the epoll relay engine.
+func TestEpollRelayEngine(t *testing.T) {
+	if !epollSupported {
+		t.Skip("the epoll relay engine isn't supported")
+	}
+
+	p, err := newPoller()
+	assert.Nil(t, err)
+	outputPoller = p
+	defer func() {
+		outputPoller = nil
+		p.close()
+	}()
+
+	t.Run("ShimIO", TestShimIO)
+	t.Run("ShimIOLargeOutput", TestShimIOLargeOutput)
+	t.Run("ShimMultipleSessions", TestShimMultipleSessions)
+	t.Run("ShimSlowClient", TestShimSlowClient)
+	t.Run("ShimOutputRateLimit", TestShimOutputRateLimit)
+	t.Run("ShimReadOnly", TestShimReadOnly)
+}
+
+func TestShimSignal(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// Send signal and check hyperstart receives the right thing.
+	shim.client.Kill(syscall.SIGUSR1)
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	decoded := hyperstart.KillCommand{}
+	err := json.Unmarshal(msgs[0].Message, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGUSR1, decoded.Signal)
+	assert.Equal(t, testContainerID, decoded.Container)
+
+	// Start the process.
+	err = rig.Client.HyperWithTokens("execcmd", []string{token},
+		&hyperstart.ExecCommand{
+			Container: testContainerID,
+			Process: hyperstart.Process{
+				Terminal: true,
+				Args:     []string{"/bin/sh"},
+			},
+		})
+	assert.Nil(t, err)
+	rig.Hyperstart.GetLastMessages()
+
+	// Send new window size and check hyperstart receives the right thing.
+	shim.client.SendTerminalSize(42, 24)
+	msgs = rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	decoded1 := hyperapi.WindowSizeMessage{}
+	err = json.Unmarshal(msgs[0].Message, &decoded1)
+	assert.Nil(t, err)
+	assert.Equal(t, session.ioBase, decoded1.Seq)
+	assert.Equal(t, uint16(42), decoded1.Column)
+	assert.Equal(t, uint16(24), decoded1.Row)
+
+	// Cleanup
+	shim.close()
+
+	rig.Stop()
+}
+
+// TestShimSignalOutOfBand tests signals aren't stuck behind stdin data
+// hyperstart doesn't read.
+func TestShimSignalOutOfBand(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// More than the io channel socket buffer.
+	data := make([]byte, 8192)
+	for i := 0; i < 64; i++ {
+		frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), data)
+		err := api.WriteFrame(shim.conn, frame)
+		assert.Nil(t, err)
+	}
+
+	killed := make(chan error)
+	go func() {
+		killed <- shim.client.Kill(syscall.SIGKILL)
+	}()
+	select {
+	case err := <-killed:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the signal to be delivered")
+	}
+
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	decoded := hyperstart.KillCommand{}
+	err := json.Unmarshal(msgs[0].Message, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGKILL, decoded.Signal)
+
+	// The stdin data still queued has been discarded.
+	session.input.Lock()
+	assert.Equal(t, 0, len(session.input.frames))
+	session.input.Unlock()
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestShimTerminalSizeBeforeStart(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+	shim := rig.ServeNewShim(token)
+	session := peekIOSession(rig.proxy, token)
+
+	// Invalid sizes are reported back to the shim.
+	err := shim.client.SendTerminalSize(0, 24)
+	assert.NotNil(t, err)
+	err = shim.client.SendTerminalSize(42, 0x10000)
+	assert.NotNil(t, err)
+
+	// The process isn't started yet, the size is kept for later. Only the
+	// last one matters.
+	err = shim.client.SendTerminalSize(80, 25)
+	assert.Nil(t, err)
+	err = shim.client.SendTerminalSize(42, 24)
+	assert.Nil(t, err)
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 0, len(msgs))
+
+	// And sent to hyperstart right after execcmd.
+	err = rig.Client.HyperWithTokens("execcmd", []string{token},
+		&hyperstart.ExecCommand{
+			Container: testContainerID,
+			Process: hyperstart.Process{
+				Terminal: true,
+				Args:     []string{"/bin/sh"},
+			},
+		})
+	assert.Nil(t, err)
+
+	msgs = rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, uint32(hyperstart.ExecCmdCode), msgs[0].Code)
+	assert.Equal(t, uint32(hyperstart.WinsizeCode), msgs[1].Code)
+	decoded := hyperapi.WindowSizeMessage{}
+	err = json.Unmarshal(msgs[1].Message, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, session.ioBase, decoded.Seq)
+	assert.Equal(t, uint16(42), decoded.Column)
+	assert.Equal(t, uint16(24), decoded.Row)
+
+	shim.close()
+	rig.Stop()
+}
+
+func TestShimTerminal(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// A shim without terminal.
+	token := rig.RegisterVM()
+	shim := newShimRig(t, rig.ServeNewClient(), token)
+	err := shim.client.ConnectShimTerminal(token, false)
+	assert.Nil(t, err)
+	session := peekIOSession(rig.proxy, token)
+
+	execcmd := hyperstart.ExecCommand{
+		Container: testContainerID,
+		Process: hyperstart.Process{
+			Terminal: true,
+			Args:     []string{"/bin/sh"},
+		},
+	}
+
+	// The process must be started without terminal too.
+	err = rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	assert.NotNil(t, err)
+	execcmd.Process.Terminal = false
+	err = rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	assert.Nil(t, err)
+
+	// stdout and stderr are kept separate.
+	rig.Hyperstart.SendIoString(session.ioBase+1, "stderr\n")
+	frame := shim.readIOStream()
+	assert.Equal(t, api.StreamStderr, api.Stream(frame.Header.Opcode))
+
+	// And the process can't be resized.
+	err = shim.client.SendTerminalSize(42, 24)
+	assert.NotNil(t, err)
+
+	shim.close()
+
+	// A shim with a terminal.
+	ret, err := rig.Client.AttachVM(testContainerID,
+		&goapi.AttachVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	token = ret.IO.Tokens[0]
+	shim = newShimRig(t, rig.ServeNewClient(), token)
+	err = shim.client.ConnectShimTerminal(token, true)
+	assert.Nil(t, err)
+	session = peekIOSession(rig.proxy, token)
+
+	execcmd.Process.Terminal = true
+	err = rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	assert.Nil(t, err)
+
+	// stderr is merged into stdout.
+	rig.Hyperstart.SendIoString(session.ioBase+1, "stderr\n")
+	frame = shim.readIOStream()
+	assert.Equal(t, api.StreamStdout, api.Stream(frame.Header.Opcode))
+	assert.Equal(t, "stderr\n", string(frame.Payload))
+
+	err = shim.client.SendTerminalSize(42, 24)
+	assert.Nil(t, err)
+
+	shim.close()
+	rig.Stop()
+}
+
+// smallWaitForShimTimeout overrides the default timeout for the tests
+const smallWaitForShimTimeout = 20 * time.Millisecond
+
+// TestShimConnectAfterExeccmd tests we correctly wait for the shim to connect
+// before forwarding the execcmd to hyperstart.
+func TestShimConnectAfterExeccmd(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	token := rig.RegisterVM()
+
+	// Send an execcmd. Since we don't have the corresponding shim yet, this
+	// should time out.
+	oldTimeout := waitForShimTimeout
+	waitForShimTimeout = smallWaitForShimTimeout
+	execcmd := hyperstart.ExecCommand{
+		Container: testContainerID,
+		Process: hyperstart.Process{
+			Args: []string{"/bin/sh"},
+		},
+	}
+	err := rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "timeout"))
+	waitForShimTimeout = oldTimeout
+
+	// Send an execcmd again, but this time will connect the shim just after the command.
+	shimConn := rig.ServeNewClient()
+	shim := newShimRig(t, shimConn, token)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		time.Sleep(smallWaitForShimTimeout)
+		err := shim.connect()
+		assert.Nil(t, err)
+		wg.Done()
+	}()
+
+	err = rig.Client.HyperWithTokens("execcmd", []string{token}, &execcmd)
+	assert.Nil(t, err)
+
+	wg.Wait()
+
+	// Cleanup
+	shim.close()
+
+	rig.Stop()
+}
+
+func TestWriteFile(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// The client needs to be attached to a VM.
+	err := rig.Client.WriteFile("foo", "/etc/hosts", []byte("hosts"))
+	assert.NotNil(t, err)
+
+	rig.RegisterVM()
+
+	content := []byte("127.0.0.1 localhost\n")
+	err = rig.Client.WriteFile("foo", "/etc/hosts", content)
+	assert.Nil(t, err)
+
+	// hyperstart receives the file command followed by the content.
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint32(hyperstart.WriteFileCode), msgs[0].Code)
+	cmd, _ := json.Marshal(&hyperstart.FileCommand{
+		Container: "foo",
+		File:      "/etc/hosts",
+	})
+	assert.Equal(t, append(cmd, content...), msgs[0].Message)
+
+	// Files have to fit in a single hyperstart message.
+	err = rig.Client.WriteFile("foo", "/big", make([]byte, maxCtlPayload))
+	assert.NotNil(t, err)
+
+	err = rig.Client.WriteFile("", "/etc/hosts", content)
+	assert.NotNil(t, err)
+
+	rig.Stop()
+}
+
+func TestReadFile(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	// The client needs to be attached to a VM.
+	_, err := rig.Client.ReadFile("foo", "/etc/hosts")
+	assert.NotNil(t, err)
+
+	rig.RegisterVM()
+
+	// The mock hyperstart acks with no data: the file is empty.
+	data, err := rig.Client.ReadFile("foo", "/etc/hosts")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(data))
+
+	msgs := rig.Hyperstart.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint32(hyperstart.ReadFileCode), msgs[0].Code)
+	cmd, _ := json.Marshal(&hyperstart.FileCommand{
+		Container: "foo",
+		File:      "/etc/hosts",
+	})
+	assert.Equal(t, cmd, msgs[0].Message)
+
+	_, err = rig.Client.ReadFile("foo", "")
+	assert.NotNil(t, err)
+
+	rig.Stop()
+}
+
+func TestHyperTimeout(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	oldTimeout, oldUnhealthy := hyperTimeout, hyperTimeoutUnhealthy
+	hyperTimeout = time.Nanosecond
+	hyperTimeoutUnhealthy = true
+	defer func() {
+		hyperTimeout, hyperTimeoutUnhealthy = oldTimeout, oldUnhealthy
+	}()
+
+	var notifications []api.Notification
+	var timeout api.HyperTimeout
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		notifications = append(notifications, n)
+		err := json.Unmarshal(payload, &timeout)
+		assert.Nil(t, err)
+	})
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.RegisterVM(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	// hyperstart can't answer in a nanosecond, the command should time out
+	// and the client should receive a notification.
+	err = rig.Client.Hyper("ping", nil)
+	assert.NotNil(t, err)
+	proxyErr, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+	assert.Equal(t, api.ErrorCodeHyperTimeout, proxyErr.Code)
+	assert.Equal(t, []api.Notification{api.NotificationHyperTimeout}, notifications)
+	assert.Equal(t, testContainerID, timeout.ContainerID)
+	assert.Equal(t, "ping", timeout.HyperName)
+	assert.True(t, timeout.Unhealthy)
+
+	// The VM is now unhealthy, further commands are rejected.
+	err = rig.Client.Hyper("ping", nil)
+	assert.NotNil(t, err)
+	proxyErr, ok = err.(*goapi.Error)
+	assert.True(t, ok)
+	assert.Equal(t, api.ErrorCodeVMUnhealthy, proxyErr.Code)
+
+	rig.Stop()
+}
+
+func TestHyperRetries(t *testing.T) {
+	rig := newTestRig(t)
+	rig.Start()
+
+	oldTimeouts, oldDelay := hyperTimeouts, hyperRetryDelay
+	hyperTimeouts = map[string]time.Duration{
+		"ping":     time.Nanosecond,
+		"startpod": time.Nanosecond,
+	}
+	hyperRetryDelay = time.Millisecond
+	defer func() {
+		hyperTimeouts, hyperRetryDelay = oldTimeouts, oldDelay
+	}()
+
+	var timeouts []string
+	rig.Client.HandleNotifications(func(n api.Notification, payload []byte) {
+		if n != api.NotificationHyperTimeout {
+			return
+		}
+		timeout := api.HyperTimeout{}
+		err := json.Unmarshal(payload, &timeout)
+		assert.Nil(t, err)
+		timeouts = append(timeouts, timeout.HyperName)
+	})
+
+	rig.RegisterVM()
+
+	// ping is idempotent and retried before failing.
+	err := rig.Client.Hyper("ping", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, hyperRetries+1, len(timeouts))
+
+	// startpod isn't.
+	timeouts = nil
+	err = rig.Client.Hyper("startpod", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"startpod"}, timeouts)
 
 	rig.Stop()
 }
@@ -0,0 +1,450 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// proxyctl is a command line tool to inspect and operate the VMs managed by
+// cc-proxy, eg. when debugging a node.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/api/hyperstart"
+	goapi "github.com/clearcontainers/proxy/client"
+)
+
+// defaultSocketPath is set at link time to the socket path cc-proxy is built
+// with.
+var defaultSocketPath = api.DefaultSocketPath
+
+var socketPath = flag.String("socket-path", defaultSocketPath, "path of the proxy socket")
+
+var debugSocketPath = flag.String("debug-socket", "/var/run/clear-containers/proxy-debug.sock",
+	"path of the debug console socket, see the -debug-socket option of cc-proxy")
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	// run executes the command. conn is the connection used by client,
+	// for the commands reading frames themselves.
+	run func(conn net.Conn, client *goapi.Client, args []string) error
+	// socket, if not nil, is the path of the socket to connect to instead
+	// of the proxy socket.
+	socket *string
+}
+
+var commands = []command{
+	{"list", "", "list the VMs known to the proxy", list, nil},
+	{"inspect", "<containerId>", "print the state and statistics of a VM", inspect, nil},
+	{"stats", "[containerId]", "print the I/O statistics of the containers", stats, nil},
+	{"top", "[-interval <duration>] [-n <iterations>]",
+		"show the I/O and command activity of the VMs, refreshed live", top, nil},
+	{"signal", "[-container <id>] <containerId> <signal>",
+		"send a signal to the processes of a container", signalContainer, nil},
+	{"attach", "[-read-only] <token>", "relay the I/O of the process of an I/O token", attach, nil},
+	{"shutdown", "<containerId>", "ask hyperstart to shut the VM down", shutdown, nil},
+	{"debug", "[command]", "run a debug console command, or an interactive console",
+		debug, debugSocketPath},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [arguments]\n\nCommands:\n",
+		os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.usage)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// lockedConn serializes the writes of the goroutines sharing a connection,
+// eg. stdin and signals when attached to a process.
+type lockedConn struct {
+	net.Conn
+	sync.Mutex
+}
+
+func (c *lockedConn) Write(b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	path := *socketPath
+	if cmd.socket != nil {
+		path = *cmd.socket
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	locked := &lockedConn{Conn: conn}
+	client := goapi.NewClient(locked)
+
+	err = cmd.run(locked, client, flag.Args()[1:])
+	client.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+// formatTime returns t as a duration relative to now, "-" for a zero or nil
+// time.
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	d := time.Since(*t)
+	return fmt.Sprintf("%s ago", d-d%time.Millisecond)
+}
+
+func list(conn net.Conn, client *goapi.Client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	resp, err := client.Stats("")
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tSTATE\tLAST PING\tHYPERSTART\tCONTAINERS\tTOKENS")
+	for _, vm := range resp.VMs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d/%d\n", vm.ContainerID, vm.State,
+			formatTime(vm.LastPing), vm.HyperstartVersion, len(vm.Containers),
+			vm.Resources.ClaimedTokens, vm.Resources.Tokens)
+	}
+	return w.Flush()
+}
+
+func inspect(conn net.Conn, client *goapi.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected a container ID")
+	}
+
+	resp, err := client.Stats(args[0])
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(resp.VMs[0])
+}
+
+func stats(conn net.Conn, client *goapi.Client, args []string) error {
+	if len(args) > 1 {
+		return errors.New("unexpected arguments")
+	}
+
+	containerID := ""
+	if len(args) == 1 {
+		containerID = args[0]
+	}
+
+	resp, err := client.Stats(containerID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VM\tCONTAINER\tSTDIN\tSTDOUT\tSTDERR\tLAST ACTIVITY")
+	for _, vm := range resp.VMs {
+		var ids []string
+		for id := range vm.Containers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			s := vm.Containers[id]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", vm.ContainerID, id,
+				s.Stdin, s.Stdout, s.Stderr, formatTime(&s.LastActivity))
+		}
+	}
+	return w.Flush()
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
+
+// parseSignal accepts a signal number or name, with or without the SIG
+// prefix, eg. 15, TERM or SIGTERM.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return syscall.Signal(n), nil
+	}
+
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(s), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal: %s", s)
+	}
+	return sig, nil
+}
+
+func signalContainer(conn net.Conn, client *goapi.Client, args []string) error {
+	flags := flag.NewFlagSet("signal", flag.ContinueOnError)
+	container := flags.String("container", "",
+		"container to signal, defaults to the container ID of the VM")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("expected a container ID and a signal")
+	}
+
+	containerID := flags.Arg(0)
+	sig, err := parseSignal(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *container == "" {
+		*container = containerID
+	}
+
+	if _, err := client.AttachVM(containerID, nil); err != nil {
+		return err
+	}
+
+	return client.Hyper(hyperstart.CmdKillContainer, &hyperstart.KillCommand{
+		Container: *container,
+		Signal:    sig,
+	})
+}
+
+func shutdown(conn net.Conn, client *goapi.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected a container ID")
+	}
+
+	if _, err := client.AttachVM(args[0], nil); err != nil {
+		return err
+	}
+
+	return client.Hyper(hyperstart.CmdDestroyPod, nil)
+}
+
+// attachStreamID is the stream ID of the session attach claims.
+const attachStreamID = 1
+
+// attach claims the I/O session of token, relaying its stdout and stderr to
+// ours and, unless readOnly, our stdin and SIGINT and SIGTERM to the process.
+// It exits with the exit status of the process.
+func attach(conn net.Conn, client *goapi.Client, args []string) error {
+	flags := flag.NewFlagSet("attach", flag.ContinueOnError)
+	readOnly := flags.Bool("read-only", false,
+		"only receive a copy of the output, next to the shim of the process")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("expected an I/O token")
+	}
+	token := flags.Arg(0)
+
+	var session *goapi.ShimSession
+	var err error
+	if *readOnly {
+		session, err = client.ConnectShimReadOnly(token, attachStreamID)
+	} else {
+		session, err = client.ConnectShimSession(token, attachStreamID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !*readOnly {
+		go func() {
+			stdin := session.Stdin()
+			io.Copy(stdin, os.Stdin)
+			stdin.Close()
+		}()
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			for sig := range sigCh {
+				session.Kill(sig.(syscall.Signal))
+			}
+		}()
+	}
+
+	status, err := relayOutput(conn)
+	if err != nil {
+		return err
+	}
+
+	client.Close()
+	os.Exit(status)
+	return nil
+}
+
+// relayOutput writes the output of the attached process to our stdout and
+// stderr until it exits, returning its exit status.
+func relayOutput(conn net.Conn) (int, error) {
+	for {
+		frame, err := api.ReadFrame(conn)
+		if err != nil {
+			return 0, err
+		}
+		if frame.Header.StreamID != attachStreamID {
+			continue
+		}
+
+		switch frame.Header.Type {
+		case api.TypeStream:
+			out := os.Stdout
+			if api.Stream(frame.Header.Opcode) == api.StreamStderr {
+				out = os.Stderr
+			}
+			if _, err := out.Write(frame.Payload); err != nil {
+				return 0, err
+			}
+		case api.TypeNotification:
+			if api.Notification(frame.Header.Opcode) != api.NotificationProcessExited {
+				continue
+			}
+			if len(frame.Payload) != 1 {
+				return 0, fmt.Errorf("invalid exit status payload: %v", frame.Payload)
+			}
+			return int(frame.Payload[0]), nil
+		}
+	}
+}
+
+// The debug console answers each command with its output followed by a status
+// line, either debugStatusOK or an error message prefixed by debugStatusError.
+const (
+	debugStatusOK    = "ok"
+	debugStatusError = "error: "
+)
+
+// debugError is an error returned by a debug console command.
+type debugError string
+
+func (e debugError) Error() string {
+	return string(e)
+}
+
+// debugCommand sends line to the debug console and writes the output of the
+// command to stdout.
+func debugCommand(conn net.Conn, replies *bufio.Scanner, line string) error {
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return err
+	}
+
+	for replies.Scan() {
+		reply := replies.Text()
+		switch {
+		case reply == debugStatusOK:
+			return nil
+		case strings.HasPrefix(reply, debugStatusError):
+			return debugError(strings.TrimPrefix(reply, debugStatusError))
+		}
+		fmt.Println(reply)
+	}
+
+	if err := replies.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// debug runs the debug console command given as arguments or, without any,
+// the commands read from stdin.
+func debug(conn net.Conn, client *goapi.Client, args []string) error {
+	replies := bufio.NewScanner(conn)
+
+	if len(args) > 0 {
+		return debugCommand(conn, replies, strings.Join(args, " "))
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "cc-proxy> ")
+		if !input.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return input.Err()
+		}
+
+		line := strings.TrimSpace(input.Text())
+		switch line {
+		case "":
+			continue
+		case "quit", "exit":
+			return nil
+		}
+
+		err := debugCommand(conn, replies, line)
+		if _, ok := err.(debugError); ok {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		s   string
+		sig syscall.Signal
+	}{
+		{"15", syscall.SIGTERM},
+		{"TERM", syscall.SIGTERM},
+		{"SIGTERM", syscall.SIGTERM},
+		{"sigkill", syscall.SIGKILL},
+		{"hup", syscall.SIGHUP},
+	}
+
+	for _, test := range tests {
+		sig, err := parseSignal(test.s)
+		assert.Nil(t, err)
+		assert.Equal(t, test.sig, sig)
+	}
+
+	_, err := parseSignal("SIGFOO")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+)
+
+// topRow is the activity of a VM between two samples of top.
+type topRow struct {
+	containerID string
+	state       string
+	containers  int
+	// Bytes per second relayed on each stream, summed over the
+	// containers of the VM.
+	stdin, stdout, stderr float64
+	buffered              int
+	// commands is the number of hyper commands per second.
+	commands     float64
+	lastActivity time.Time
+}
+
+func (r *topRow) io() float64 {
+	return r.stdin + r.stdout + r.stderr
+}
+
+// byActivity sorts the busiest VMs first.
+type byActivity []topRow
+
+func (s byActivity) Len() int      { return len(s) }
+func (s byActivity) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byActivity) Less(i, j int) bool {
+	if s[i].io() != s[j].io() {
+		return s[i].io() > s[j].io()
+	}
+	if s[i].commands != s[j].commands {
+		return s[i].commands > s[j].commands
+	}
+	return s[i].containerID < s[j].containerID
+}
+
+// rate returns the per second rate of a counter going from prev to cur over
+// elapsed. A counter going backwards belongs to a VM registered again.
+func rate(prev, cur uint64, elapsed time.Duration) float64 {
+	if cur < prev {
+		prev = 0
+	}
+	return float64(cur-prev) / elapsed.Seconds()
+}
+
+// topRows returns the activity of the VMs of cur since prev, elapsed
+// earlier. VMs not in prev have been registered in between, their counters
+// started from 0.
+func topRows(prev, cur *api.StatsResponse, elapsed time.Duration) []topRow {
+	before := make(map[string]*api.VMStats)
+	for i := range prev.VMs {
+		before[prev.VMs[i].ContainerID] = &prev.VMs[i]
+	}
+
+	rows := make([]topRow, 0, len(cur.VMs))
+	for _, vm := range cur.VMs {
+		row := topRow{
+			containerID: vm.ContainerID,
+			state:       vm.State,
+			containers:  len(vm.Containers),
+			buffered:    vm.Resources.BufferedBytes,
+		}
+
+		old := before[vm.ContainerID]
+		if old == nil {
+			old = &api.VMStats{}
+		}
+		row.commands = rate(old.HyperCommands, vm.HyperCommands, elapsed)
+
+		for id, s := range vm.Containers {
+			o := old.Containers[id]
+			row.stdin += rate(o.Stdin, s.Stdin, elapsed)
+			row.stdout += rate(o.Stdout, s.Stdout, elapsed)
+			row.stderr += rate(o.Stderr, s.Stderr, elapsed)
+			if s.LastActivity.After(row.lastActivity) {
+				row.lastActivity = s.LastActivity
+			}
+		}
+
+		rows = append(rows, row)
+	}
+	sort.Sort(byActivity(rows))
+
+	return rows
+}
+
+// formatBytes returns n bytes with a K, M or G suffix.
+func formatBytes(n float64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%.0f", n)
+	}
+
+	unit := ""
+	for _, u := range []string{"K", "M", "G"} {
+		if n < 1024 {
+			break
+		}
+		n /= 1024
+		unit = u
+	}
+	return fmt.Sprintf("%.1f%s", n, unit)
+}
+
+// renderTop writes the table of top at now to w.
+func renderTop(w io.Writer, now time.Time, rows []topRow) error {
+	var total topRow
+	for _, row := range rows {
+		total.stdin += row.stdin
+		total.stdout += row.stdout
+		total.stderr += row.stderr
+		total.commands += row.commands
+	}
+
+	fmt.Fprintf(w, "cc-proxy - %s, %d VMs, stdin %s/s, stdout %s/s, "+
+		"stderr %s/s, %.1f commands/s\n\n", now.Format("15:04:05"), len(rows),
+		formatBytes(total.stdin), formatBytes(total.stdout),
+		formatBytes(total.stderr), total.commands)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tSTATE\tCONTAINERS\tSTDIN/S\tSTDOUT/S\t"+
+		"STDERR/S\tBUFFERED\tCMDS/S\tLAST ACTIVITY")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%.1f\t%s\n",
+			row.containerID, row.state, row.containers,
+			formatBytes(row.stdin), formatBytes(row.stdout),
+			formatBytes(row.stderr), formatBytes(float64(row.buffered)),
+			row.commands, formatTime(&row.lastActivity))
+	}
+	return tw.Flush()
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// top samples the statistics of the VMs every interval and prints their
+// activity, the busiest VMs first, refreshing the screen when printing to a
+// terminal.
+func top(conn net.Conn, client *goapi.Client, args []string) error {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Second, "refresh interval")
+	iterations := flags.Int("n", 0, "number of refreshes before exiting, 0 for no limit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+	if *interval <= 0 {
+		return errors.New("the interval must be positive")
+	}
+
+	refresh := isTerminal(os.Stdout)
+
+	prev, err := client.Stats("")
+	if err != nil {
+		return err
+	}
+	last := time.Now()
+
+	for i := 0; *iterations == 0 || i < *iterations; i++ {
+		time.Sleep(*interval)
+
+		cur, err := client.Stats("")
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		if refresh {
+			// Home the cursor and clear the screen.
+			fmt.Print("\033[H\033[2J")
+		} else if i > 0 {
+			fmt.Println()
+		}
+		if err := renderTop(os.Stdout, now, topRows(prev, cur, now.Sub(last))); err != nil {
+			return err
+		}
+
+		prev, last = cur, now
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopRows(t *testing.T) {
+	activity := time.Date(2017, 6, 12, 10, 36, 58, 0, time.UTC)
+	prev := &api.StatsResponse{
+		VMs: []api.VMStats{
+			{
+				ContainerID:   "idle",
+				HyperCommands: 5,
+				Containers: map[string]api.StreamStats{
+					"idle": {Stdout: 100},
+				},
+			},
+			{
+				ContainerID:   "busy",
+				HyperCommands: 2,
+				Containers: map[string]api.StreamStats{
+					"a": {Stdin: 10, Stdout: 1000},
+				},
+			},
+		},
+	}
+	cur := &api.StatsResponse{
+		VMs: []api.VMStats{
+			{
+				ContainerID:   "idle",
+				State:         api.VMStateHealthy,
+				HyperCommands: 5,
+				Containers: map[string]api.StreamStats{
+					"idle": {Stdout: 100},
+				},
+			},
+			{
+				ContainerID:   "busy",
+				HyperCommands: 6,
+				Resources:     api.VMResources{BufferedBytes: 42},
+				Containers: map[string]api.StreamStats{
+					"a": {Stdin: 30, Stdout: 3000, LastActivity: activity},
+					// Started in between.
+					"b": {Stderr: 400},
+				},
+			},
+			// Registered in between.
+			{
+				ContainerID:   "new",
+				HyperCommands: 2,
+			},
+		},
+	}
+
+	rows := topRows(prev, cur, 2*time.Second)
+	assert.Equal(t, []topRow{
+		{
+			containerID:  "busy",
+			containers:   2,
+			stdin:        10,
+			stdout:       1000,
+			stderr:       200,
+			buffered:     42,
+			commands:     2,
+			lastActivity: activity,
+		},
+		{
+			containerID: "new",
+			commands:    1,
+		},
+		{
+			containerID: "idle",
+			state:       api.VMStateHealthy,
+			containers:  1,
+		},
+	}, rows)
+}
+
+func TestRate(t *testing.T) {
+	assert.Equal(t, 50.0, rate(100, 200, 2*time.Second))
+	// The VM has been registered again.
+	assert.Equal(t, 20.0, rate(100, 40, 2*time.Second))
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n float64
+		s string
+	}{
+		{0, "0"},
+		{1023, "1023"},
+		{1024, "1.0K"},
+		{1536, "1.5K"},
+		{5 << 20, "5.0M"},
+		{3 << 30, "3.0G"},
+		{2048 << 30, "2048.0G"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.s, formatBytes(test.n))
+	}
+}
+
+func TestRenderTop(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2017, 6, 12, 10, 36, 58, 0, time.UTC)
+	err := renderTop(&buf, now, []topRow{
+		{containerID: "busy", state: api.VMStateHealthy, stdout: 2048, commands: 1},
+		{containerID: "idle", state: api.VMStateHealthy},
+	})
+	assert.Nil(t, err)
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "cc-proxy - 10:36:58, 2 VMs, stdin 0/s, stdout 2.0K/s, "+
+		"stderr 0/s, 1.0 commands/s", lines[0])
+	assert.True(t, strings.HasPrefix(lines[2], "CONTAINER ID"))
+	assert.Equal(t, []string{"busy", "healthy", "0", "0", "2.0K", "0", "0", "1.0", "-"},
+		strings.Fields(lines[3]))
+	assert.Equal(t, "idle", strings.Fields(lines[4])[0])
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// qmpTimeout is how long we wait for QEMU to answer a QMP command.
+var qmpTimeout = 5 * time.Second
+
+// qmp is a minimal QEMU Machine Protocol client, used to query the state of
+// the QEMU process running a VM and to notice promptly when it's gone.
+type qmp struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+
+	// lock serializes the commands: QEMU answers them in order.
+	lock    sync.Mutex
+	replies chan *qmpMessage
+	// done is closed once the QMP connection is gone, ie. QEMU has
+	// exited or Close has been called.
+	done chan struct{}
+}
+
+// qmpMessage is what QEMU sends on the QMP socket: the greeting, command
+// replies and asynchronous events.
+type qmpMessage struct {
+	QMP    json.RawMessage `json:"QMP,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error,omitempty"`
+	Event string `json:"event,omitempty"`
+}
+
+type qmpCommand struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// dialQMP connects to the QMP socket at path and negotiates the capabilities,
+// leaving QEMU in command mode.
+func dialQMP(path string) (*qmp, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &qmp{
+		conn:    conn,
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		replies: make(chan *qmpMessage, 1),
+		done:    make(chan struct{}),
+	}
+
+	if err := q.handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: %v", err)
+	}
+
+	return q, nil
+}
+
+func (q *qmp) handshake() error {
+	q.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	defer q.conn.SetDeadline(time.Time{})
+
+	greeting := qmpMessage{}
+	if err := q.dec.Decode(&greeting); err != nil {
+		return err
+	}
+	if greeting.QMP == nil {
+		return errors.New("no QMP greeting")
+	}
+
+	if err := q.enc.Encode(&qmpCommand{Execute: "qmp_capabilities"}); err != nil {
+		return err
+	}
+
+	for {
+		reply := qmpMessage{}
+		if err := q.dec.Decode(&reply); err != nil {
+			return err
+		}
+		if reply.Event != "" {
+			continue
+		}
+		if reply.Error != nil {
+			return fmt.Errorf("qmp_capabilities: %s", reply.Error.Desc)
+		}
+		return nil
+	}
+}
+
+// serve reads what QEMU sends until the connection is gone, dispatching
+// command replies to execute and events to onEvent.
+func (q *qmp) serve(onEvent func(event string)) error {
+	defer close(q.done)
+
+	for {
+		msg := &qmpMessage{}
+		if err := q.dec.Decode(msg); err != nil {
+			return err
+		}
+
+		if msg.Event != "" {
+			onEvent(msg.Event)
+			continue
+		}
+
+		// Replies arriving after execute has given up are dropped.
+		select {
+		case q.replies <- msg:
+		default:
+		}
+	}
+}
+
+// execute runs the QMP command name and unmarshals its result in ret, unless
+// ret is nil.
+func (q *qmp) execute(name string, ret interface{}) error {
+	return q.executeArgs(name, nil, ret)
+}
+
+// executeArgs is execute for commands taking arguments.
+func (q *qmp) executeArgs(name string, args map[string]interface{}, ret interface{}) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Don't mistake the late reply of a command that timed out for ours.
+	select {
+	case <-q.replies:
+	default:
+	}
+
+	if err := q.enc.Encode(&qmpCommand{Execute: name, Arguments: args}); err != nil {
+		return err
+	}
+
+	var reply *qmpMessage
+	select {
+	case reply = <-q.replies:
+	case <-q.done:
+		return errors.New("qmp: connection closed")
+	case <-time.After(qmpTimeout):
+		return fmt.Errorf("qmp: timeout waiting for QEMU to answer %s", name)
+	}
+
+	if reply.Error != nil {
+		return fmt.Errorf("qmp: %s: %s", name, reply.Error.Desc)
+	}
+
+	if ret == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Return, ret)
+}
+
+// Close closes the QMP connection, making serve return.
+func (q *qmp) Close() {
+	q.conn.Close()
+}
+
+// watchQEMU runs the QMP client of vm. QEMU closing the QMP socket means it has
+// exited: the proxy then declares the VM lost rather than trying to reconnect
+// to hyperstart.
+func (vm *vm) watchQEMU(q *qmp) {
+	defer vm.wg.Done()
+
+	err := q.serve(func(event string) {
+		vm.infof(1, "qmp", "QEMU event: %s", event)
+	})
+
+	vm.Lock()
+	if !vm.connected {
+		// The VM is being closed.
+		vm.Unlock()
+		return
+	}
+	vm.qemuExited = true
+	h := vm.hyperHandler
+	vm.Unlock()
+
+	vm.infof(1, "qmp", "QEMU has exited: %v", err)
+
+	// The serial channels are gone with QEMU. Don't wait for the io
+	// goroutine to notice.
+	h.GetCtlSock().Close()
+	h.GetIoSock().Close()
+}
+
+// hasQEMUExited returns true once the QMP socket of vm has been closed by
+// QEMU.
+func (vm *vm) hasQEMUExited() bool {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.qemuExited
+}
+
+// qemuState queries QEMU for the state of vm, returning nil when the VM
+// wasn't registered with a QMP socket or QEMU didn't answer.
+func (vm *vm) qemuState() *api.QEMUState {
+	vm.Lock()
+	q := vm.qmp
+	vm.Unlock()
+
+	if q == nil {
+		return nil
+	}
+
+	var status struct {
+		Status  string `json:"status"`
+		Running bool   `json:"running"`
+	}
+	if err := q.execute("query-status", &status); err != nil {
+		vm.infof(1, "qmp", "couldn't query VM status: %v", err)
+		return nil
+	}
+
+	vcpus, err := q.countCPUs()
+	if err != nil {
+		vm.infof(1, "qmp", "couldn't query vCPUs: %v", err)
+		return nil
+	}
+
+	return &api.QEMUState{
+		Status:  status.Status,
+		Running: status.Running,
+		VCPUs:   vcpus,
+	}
+}
+
+// countCPUs returns the number of vCPUs of the VM.
+func (q *qmp) countCPUs() (int, error) {
+	var cpus []json.RawMessage
+	if err := q.execute("query-cpus", &cpus); err != nil {
+		return 0, err
+	}
+	return len(cpus), nil
+}
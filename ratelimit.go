@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+// outputRateLimit and outputRateBurst are the default rate limit, in bytes
+// per second, and burst size, in bytes, applied to each stdout and stderr
+// stream. A rate of 0 disables rate limiting. They can be overridden per VM
+// in RegisterVM.
+var (
+	outputRateLimit int
+	outputRateBurst int
+)
+
+// rateLimit is a rate limit in bytes per second, allowing bursts of burst
+// bytes. A rate of 0 means no limit.
+type rateLimit struct {
+	rate  int
+	burst int
+}
+
+func defaultOutputRateLimit() rateLimit {
+	return rateLimit{
+		rate:  outputRateLimit,
+		burst: outputRateBurst,
+	}
+}
+
+// tokenBucket implements rateLimit: one token allows one byte through.
+// tokenBucket isn't safe for concurrent use.
+type tokenBucket struct {
+	// rate is the number of tokens added to the bucket per second.
+	rate float64
+	// burst is the capacity of the bucket.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for limit, or nil if limit doesn't
+// limit anything. When not given, the burst size is one second worth of
+// data.
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	if limit.rate <= 0 {
+		return nil
+	}
+
+	burst := limit.burst
+	if burst <= 0 {
+		burst = limit.rate
+	}
+
+	return &tokenBucket{
+		rate:   float64(limit.rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller
+// needs to wait before sending n bytes. The bucket can go into debt to allow
+// n to be bigger than the burst size.
+func (b *tokenBucket) reserve(now time.Time, n int) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	assert.Nil(t, newTokenBucket(rateLimit{}))
+
+	b := newTokenBucket(rateLimit{rate: 1000, burst: 500})
+	now := time.Now()
+
+	// The bucket starts full.
+	assert.Equal(t, time.Duration(0), b.reserve(now, 500))
+
+	// And is refilled at rate.
+	assert.Equal(t, 100*time.Millisecond, b.reserve(now, 100))
+	now = now.Add(100 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.reserve(now, 0))
+
+	// But never holds more than burst tokens.
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, time.Duration(0), b.reserve(now, 500))
+	assert.Equal(t, 2*time.Second, b.reserve(now, 2000))
+
+	// The burst size defaults to the rate.
+	b = newTokenBucket(rateLimit{rate: 1000})
+	assert.Equal(t, time.Duration(0), b.reserve(now, 1000))
+	assert.Equal(t, time.Second, b.reserve(now, 1000))
+}
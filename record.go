@@ -0,0 +1,177 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/sniff"
+)
+
+// recordDir, when not empty, makes the proxy record the frames exchanged with
+// each client, one file per connection. Recordings can be replayed with
+// proxy-replay.
+var recordDir string
+
+// frameSplitter cuts the data sent in one direction of a connection into
+// frames.
+type frameSplitter struct {
+	buf []byte
+	// failed is set once the data couldn't be decoded. The rest of the
+	// data is then ignored.
+	failed bool
+}
+
+// frameHeaderLength returns the length of the header of the frame at the
+// start of buf, which must hold at least api.MinHeaderLength bytes.
+func frameHeaderLength(buf []byte) int {
+	headerLength := int(buf[2]) * 4
+	if headerLength < api.MinHeaderLength {
+		headerLength = api.MinHeaderLength
+	}
+	return headerLength
+}
+
+// frameLength returns the length of the frame at the start of buf, 0 if buf
+// doesn't hold a full header yet.
+func frameLength(buf []byte) int {
+	if len(buf) < api.MinHeaderLength {
+		return 0
+	}
+
+	return frameHeaderLength(buf) + int(binary.BigEndian.Uint32(buf[8:12]))
+}
+
+// add appends data to the splitter.
+func (s *frameSplitter) add(data []byte) {
+	s.buf = append(s.buf, data...)
+}
+
+// next returns the raw bytes of the next complete frame, nil if there's none.
+func (s *frameSplitter) next() []byte {
+	n := frameLength(s.buf)
+	if n == 0 || len(s.buf) < n {
+		return nil
+	}
+
+	raw := make([]byte, n)
+	copy(raw, s.buf)
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+
+	return raw
+}
+
+// write adds data to the splitter, calling handle with each frame it
+// completes.
+func (s *frameSplitter) write(data []byte, handle func(*api.Frame, error)) {
+	if s.failed {
+		return
+	}
+
+	s.add(data)
+
+	for raw := s.next(); raw != nil; raw = s.next() {
+		frame, err := api.ReadFrame(bytes.NewReader(raw))
+		handle(frame, err)
+		if err != nil {
+			s.failed = true
+			s.buf = nil
+			return
+		}
+	}
+}
+
+// recordingConn records the frames read from and written to a client
+// connection. It hides the file descriptor of the connection so the frames
+// sent to the client aren't spliced or written by the epoll relay engine,
+// bypassing the recording.
+type recordingConn struct {
+	net.Conn
+	id       uint64
+	path     string
+	file     *os.File
+	recorder *sniff.Recorder
+
+	// Reads and writes are serialized by the protocol and clientConn,
+	// each direction only needs its own splitter.
+	in, out frameSplitter
+}
+
+func newRecordingConn(conn net.Conn, clientID uint64) (*recordingConn, error) {
+	if err := os.MkdirAll(recordDir, 0700); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("client-%d-%s.record", clientID,
+		time.Now().UTC().Format("20060102T150405.000000000"))
+	path := filepath.Join(recordDir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingConn{
+		Conn:     conn,
+		id:       clientID,
+		path:     path,
+		file:     file,
+		recorder: sniff.NewRecorder(file),
+	}, nil
+}
+
+func (c *recordingConn) record(dir sniff.Direction) func(*api.Frame, error) {
+	return func(frame *api.Frame, err error) {
+		// frame is a copy, see frameSplitter.next, the payloads of
+		// commands, responses and notifications can be redacted in
+		// place.
+		if frame != nil && frame.Header.Type != api.TypeStream {
+			frame.Payload = redactJSON(frame.Payload)
+		}
+
+		// Failing to record shouldn't disturb the client.
+		c.recorder.Record(&sniff.Record{
+			Time:      time.Now(),
+			Conn:      c.id,
+			Direction: dir,
+			Frame:     frame,
+			Err:       err,
+		})
+	}
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.write(b[:n], c.record(sniff.ToProxy))
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.write(b[:n], c.record(sniff.FromProxy))
+	return n, err
+}
+
+func (c *recordingConn) Close() error {
+	err := c.Conn.Close()
+	c.file.Close()
+	return err
+}
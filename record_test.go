@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/sniff"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameSplitter(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []*api.Frame{
+		api.NewFrame(api.TypeCommand, int(api.CmdStats), []byte(`{}`)),
+		api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte{}),
+		api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte("stdin\n")),
+	}
+	for _, frame := range frames {
+		err := api.WriteFrame(&buf, frame)
+		assert.Nil(t, err)
+	}
+
+	// Frames are reported once complete, whatever the size of the writes.
+	var split []*api.Frame
+	s := frameSplitter{}
+	for _, b := range buf.Bytes() {
+		s.write([]byte{b}, func(frame *api.Frame, err error) {
+			assert.Nil(t, err)
+			split = append(split, frame)
+		})
+	}
+	assert.Equal(t, frames, split)
+	assert.Equal(t, 0, len(s.buf))
+
+	// Undecodable data stops the splitting.
+	garbage := make([]byte, api.MinHeaderLength)
+	garbage[2] = api.MinHeaderLength / 4
+	var errs []error
+	s.write(garbage, func(frame *api.Frame, err error) {
+		errs = append(errs, err)
+	})
+	s.write(buf.Bytes(), func(frame *api.Frame, err error) {
+		errs = append(errs, err)
+	})
+	assert.Equal(t, 1, len(errs))
+	assert.NotNil(t, errs[0])
+}
+
+func TestRecordSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-record")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	recordDir = dir
+	defer func() {
+		recordDir = ""
+	}()
+
+	rig := newTestRig(t)
+	rig.Start()
+
+	rig.RegisterVM()
+	_, err = rig.Client.Stats("")
+	assert.Nil(t, err)
+	err = rig.Client.Hyper("ping", map[string]string{"password": "hunter2"})
+	assert.Nil(t, err)
+
+	rig.Stop()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.record"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(paths))
+
+	f, err := os.Open(paths[0])
+	assert.Nil(t, err)
+	defer f.Close()
+	records, err := sniff.ReadRecording(f)
+	assert.Nil(t, err)
+
+	// The RegisterVM, Stats and Hyper commands and their responses.
+	assert.Equal(t, 6, len(records))
+	commands := []api.Command{api.CmdRegisterVM, api.CmdStats, api.CmdHyper}
+	for i, cmd := range commands {
+		command, response := records[2*i], records[2*i+1]
+		assert.Equal(t, sniff.ToProxy, command.Direction)
+		assert.Equal(t, api.TypeCommand, command.Frame.Header.Type)
+		assert.Equal(t, int(cmd), command.Frame.Header.Opcode)
+		assert.Equal(t, sniff.FromProxy, response.Direction)
+		assert.Equal(t, api.TypeResponse, response.Frame.Header.Type)
+		assert.False(t, response.Frame.Header.InError)
+		assert.Equal(t, command.Conn, response.Conn)
+	}
+
+	// Secrets aren't recorded.
+	payload := string(records[4].Frame.Payload)
+	assert.Contains(t, payload, `"data":{"password":"<redacted>"}`)
+	assert.NotContains(t, payload, "hunter2")
+}
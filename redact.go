@@ -0,0 +1,144 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// redactPatterns are shell patterns, matched case insensitively, of the names
+// of the environment variables and JSON fields whose values are secrets. Those
+// values are redacted from the payloads written to the logs, traces and
+// recordings.
+var redactPatterns = []string{
+	"*password*",
+	"*passwd*",
+	"*secret*",
+	"*credential*",
+	"*_token",
+	"*api_key*",
+	"*apikey*",
+	"*access_key*",
+	"*private_key*",
+}
+
+// redacted replaces the values of secrets.
+const redacted = "<redacted>"
+
+func validRedactPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%s'", pattern)
+	}
+	return nil
+}
+
+// isSecret returns true if name is the name of a variable or field holding a
+// secret.
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range redactPatterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// redactJSON returns data with the secrets it holds redacted:
+//   - the values of the object fields whose names match redactPatterns,
+//   - the values of hyperstart environment variables, {"env": "NAME",
+//     "value": "secret"}, whose names match,
+//   - the values of NAME=secret strings, eg. OCI environment variables or
+//     command line options, whose names match.
+//
+// data is returned as is when it isn't JSON or doesn't hold any secret.
+func redactJSON(data []byte) []byte {
+	if len(redactPatterns) == 0 || len(data) == 0 {
+		return data
+	}
+
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return data
+	}
+
+	v, changed := redactValue(v)
+	if !changed {
+		return data
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return data
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+func redactValue(v interface{}) (interface{}, bool) {
+	changed := false
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if name, ok := v["env"].(string); ok && isSecret(name) {
+			if _, ok := v["value"]; ok {
+				v["value"] = redacted
+				changed = true
+			}
+		}
+		for key, value := range v {
+			if isSecret(key) {
+				v[key] = redacted
+				changed = true
+				continue
+			}
+			if value, c := redactValue(value); c {
+				v[key] = value
+				changed = true
+			}
+		}
+		return v, changed
+	case []interface{}:
+		for i, value := range v {
+			if value, c := redactValue(value); c {
+				v[i] = value
+				changed = true
+			}
+		}
+		return v, changed
+	case string:
+		if i := strings.IndexByte(v, '='); i > 0 && isSecret(v[:i]) {
+			return v[:i+1] + redacted, true
+		}
+	}
+
+	return v, false
+}
+
+// redactedJSON is a JSON payload only redacted, with redactJSON, when
+// formatted. Log messages can then include payloads without paying for the
+// redaction when they aren't written.
+type redactedJSON []byte
+
+func (data redactedJSON) String() string {
+	return string(redactJSON(data))
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactJSON(t *testing.T) {
+	tests := []struct {
+		data, redacted string
+	}{
+		// hyperstart process environment.
+		{
+			`{"container":"foo","process":{"args":["sh"],"envs":[{"env":"PATH","value":"/bin"},{"env":"DB_PASSWORD","value":"hunter2"}]}}`,
+			`{"container":"foo","process":{"args":["sh"],"envs":[{"env":"PATH","value":"/bin"},{"env":"DB_PASSWORD","value":"<redacted>"}]}}`,
+		},
+		// OCI environment and command line options.
+		{
+			`{"env":["HOME=/root","GITHUB_TOKEN=abc=def"],"args":["mysql","--password=hunter2"]}`,
+			`{"args":["mysql","--password=<redacted>"],"env":["HOME=/root","GITHUB_TOKEN=<redacted>"]}`,
+		},
+		// Fields.
+		{
+			`{"hyperName":"execcmd","data":{"Secret":{"a":1},"size":12345678901234567890}}`,
+			`{"data":{"Secret":"<redacted>","size":12345678901234567890},"hyperName":"execcmd"}`,
+		},
+		// Tokens given to ConnectShim aren't redacted by default.
+		{`{"token":"abc"}`, `{"token":"abc"}`},
+		// Nothing to redact, or not JSON.
+		{`{ "args": ["sh"] }`, `{ "args": ["sh"] }`},
+		{`{"password"`, `{"password"`},
+		{``, ``},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.redacted, string(redactJSON([]byte(test.data))), "%s", test.data)
+	}
+
+	defer saveConfig()()
+	redactPatterns = nil
+	assert.Equal(t, `{"password":"foo"}`, redactedJSON(`{"password":"foo"}`).String())
+}
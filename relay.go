@@ -0,0 +1,364 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+	"github.com/golang/glog"
+)
+
+// spliceIO enables relaying the output of processes from the io serial
+// channel to the shims with splice(2), when possible.
+var spliceIO = true
+
+// spliceMinSize is the payload size from which we splice data instead of
+// copying it through userspace. Below that, the extra syscalls cost more than
+// the copy.
+const spliceMinSize = 1024
+
+// maxTtyPayload is the maximum payload of a message sent to hyperstart on the
+// io channel. That limit is from hyperstart src/init.c, hyper_channel_ops,
+// rbuf_size.
+const maxTtyPayload = 10240 - hyperstart.TtyHdrSize
+
+// maxCtlPayload is the maximum payload of a message sent to hyperstart on the
+// ctl channel, for the same reason.
+const maxCtlPayload = 10240 - hyperstart.CtlHdrSize
+
+// Bounds of the stream chunk size.
+const (
+	minStreamChunkSize = 512
+	maxStreamChunkSize = 1024 * 1024
+)
+
+// streamChunkSize is the default maximum payload size, in bytes, of the
+// stream frames exchanged with the shims. Small chunks keep interactive
+// sessions sharing a connection responsive, big chunks cost fewer frames for
+// bulk output. Shims can ask for a different size in ConnectShim.
+var streamChunkSize = 32 * 1024
+
+func validStreamChunkSize(size int) error {
+	if size < minStreamChunkSize || size > maxStreamChunkSize {
+		return fmt.Errorf("invalid chunk size %d, should be between %d and %d",
+			size, minStreamChunkSize, maxStreamChunkSize)
+	}
+
+	return nil
+}
+
+// negotiateChunkSize returns the chunk size of a session whose shim asked
+// for requested bytes, 0 meaning the default. Out of bounds sizes are
+// clamped.
+func negotiateChunkSize(requested int) (int, error) {
+	switch {
+	case requested < 0:
+		return 0, fmt.Errorf("invalid chunk size %d", requested)
+	case requested == 0:
+		return streamChunkSize, nil
+	case requested < minStreamChunkSize:
+		return minStreamChunkSize, nil
+	case requested > maxStreamChunkSize:
+		return maxStreamChunkSize, nil
+	}
+
+	return requested, nil
+}
+
+// ttyHeader is the header of the messages sent by hyperstart on the io
+// channel.
+type ttyHeader struct {
+	seq uint64
+	// length of the payload, not including the header.
+	length int
+}
+
+// readTtyHeader reads the header of the next message on the io channel. buf
+// is used to read the header and must be hyperstart.TtyHdrSize long.
+func readTtyHeader(conn net.Conn, buf []byte) (ttyHeader, error) {
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return ttyHeader{}, err
+	}
+
+	return parseTtyHeader(buf), nil
+}
+
+// parseTtyHeader decodes the hyperstart.TtyHdrSize bytes of buf.
+func parseTtyHeader(buf []byte) ttyHeader {
+	length := int(binary.BigEndian.Uint32(buf[hyperstart.TtyHdrLenOffset:hyperstart.TtyHdrSize]))
+	if length < hyperstart.TtyHdrSize {
+		// hyperstart sends a length of 0 for EOF paquets.
+		length = hyperstart.TtyHdrSize
+	}
+
+	return ttyHeader{
+		seq:    binary.BigEndian.Uint64(buf[:hyperstart.TtyHdrLenOffset]),
+		length: length - hyperstart.TtyHdrSize,
+	}
+}
+
+// readTtyPayload reads the payload described by header into a buffer from
+// getBuffer. The payload starts after api.MinHeaderLength bytes, leaving room
+// to build the frame forwarding it to the client in place.
+func readTtyPayload(conn net.Conn, header ttyHeader) ([]byte, error) {
+	buf := getBuffer(api.MinHeaderLength + header.length)
+	if _, err := io.ReadFull(conn, buf[api.MinHeaderLength:]); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// writeTtyMessage sends data to the process identified by seq, on the io
+// channel.
+func writeTtyMessage(conn net.Conn, seq uint64, data []byte) error {
+	if len(data) > maxTtyPayload {
+		return fmt.Errorf("message too long %d", hyperstart.TtyHdrSize+len(data))
+	}
+	length := hyperstart.TtyHdrSize + len(data)
+
+	var header [hyperstart.TtyHdrSize]byte
+	binary.BigEndian.PutUint64(header[:], seq)
+	binary.BigEndian.PutUint32(header[hyperstart.TtyHdrLenOffset:], uint32(length))
+
+	// The io channel is shared by all the sessions of the VM, the header
+	// and data must be written in one go.
+	_, err := api.WriteBuffers(conn, [][]byte{header[:], data})
+	return err
+}
+
+// outputStream returns whether seq is the stdout or stderr of session. The
+// output of processes with a terminal is always stdout.
+func (session *ioSession) outputStream(seq uint64) api.Stream {
+	if seq == session.ioBase || session.hasTerminal() {
+		return api.StreamStdout
+	}
+
+	return api.StreamStderr
+}
+
+// encodeOutputFrame encodes, in the room left at the beginning of buf by
+// readTtyPayload, the header of the frame of the given type, opcode and
+// stream ID carrying the payload, compressed or not.
+func encodeOutputFrame(buf []byte, frameType api.FrameType, opcode, streamID int,
+	compressed bool) {
+	header := api.FrameHeader{
+		Version:       api.Version,
+		HeaderLength:  api.MinHeaderLength,
+		Type:          frameType,
+		Opcode:        opcode,
+		PayloadLength: len(buf) - api.MinHeaderLength,
+		Compressed:    compressed,
+		StreamID:      streamID,
+	}
+	api.EncodeFrameHeader(buf, &header)
+}
+
+// splitOutput splits buf, as returned by readTtyPayload, in buffers holding
+// at most chunkSize bytes of payload, each with room for the frame header.
+// When copyBuf is false, buf is owned by splitOutput and returned as is if it
+// doesn't need to be split. A chunkSize of 0 doesn't split the payload.
+func splitOutput(buf []byte, chunkSize int, copyBuf bool) [][]byte {
+	data := buf[api.MinHeaderLength:]
+
+	if chunkSize <= 0 || len(data) <= chunkSize {
+		if !copyBuf {
+			return [][]byte{buf}
+		}
+		chunk := getBuffer(len(buf))
+		copy(chunk, buf)
+		return [][]byte{chunk}
+	}
+
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk := getBuffer(api.MinHeaderLength + n)
+		copy(chunk[api.MinHeaderLength:], data[:n])
+		chunks = append(chunks, chunk)
+		data = data[n:]
+	}
+
+	if !copyBuf {
+		putBuffer(buf)
+	}
+
+	return chunks
+}
+
+// queueOutput queues buf, as returned by readTtyPayload, to be sent to the
+// session's client and observers in frames of the given type and opcode, no
+// bigger than their chunk size. limiter, if not nil, rate limits the frames
+// sent to the client. compressor, if not nil, compresses them when the stream
+// throughput is high. It returns false if it had to wait for the client to
+// catch up.
+func (session *ioSession) queueOutput(frameType api.FrameType, opcode int, buf []byte,
+	limiter *tokenBucket, compressor *streamCompressor) bool {
+	vm := session.vm
+	compress := compressor != nil &&
+		compressor.observe(time.Now(), len(buf)-api.MinHeaderLength)
+
+	// Observers get their own copy of the frames.
+	for _, observer := range vm.sessionObservers(session) {
+		dropped := false
+		for _, frame := range splitOutput(buf, observer.chunkSize, true) {
+			encodeOutputFrame(frame, frameType, opcode, observer.streamID, false)
+
+			if !observer.output.tryPush(outputFrame{buf: frame}) {
+				dropped = true
+			}
+		}
+		if dropped {
+			vm.observerDropped(observer)
+		}
+	}
+
+	queued := true
+	for _, frame := range splitOutput(buf, session.chunkSize, false) {
+		compressed := false
+		if compress {
+			if c := compressor.compress(frame); c != nil {
+				putBuffer(frame)
+				frame = c
+				compressed = true
+			}
+		}
+		encodeOutputFrame(frame, frameType, opcode, session.streamID, compressed)
+
+		if !session.output.push(outputFrame{buf: frame, limiter: limiter}) {
+			queued = false
+		}
+	}
+
+	return queued
+}
+
+// queueStreamOutput queues buf, the stdout or stderr data of the stream seq.
+func (session *ioSession) queueStreamOutput(seq uint64, buf []byte) bool {
+	i := seq - session.ioBase
+
+	return session.queueOutput(api.TypeStream, int(session.outputStream(seq)), buf,
+		session.limiters[i], session.compressors[i])
+}
+
+// spliceable returns true if the payload described by header can be spliced
+// to session's client rather than being read in userspace.
+func (vm *vm) spliceable(pipe *splicePipe, session *ioSession, header ttyHeader, src net.Conn) bool {
+	if pipe == nil || header.length < spliceMinSize {
+		return false
+	}
+
+	// The payload has to be split in several frames.
+	if session.chunkSize > 0 && header.length > session.chunkSize {
+		return false
+	}
+
+	// The payload needs to be inspected or isn't forwarded.
+	if session == &vm.nullSession || session.terminated || session.output == nil {
+		return false
+	}
+
+	// Rate limiting happens when writing queued frames.
+	if session.limiters[0] != nil {
+		return false
+	}
+
+	// The payload may need to be compressed or coalesced into lines.
+	if session.compressors[0] != nil || session.lineBuffers[0] != nil {
+		return false
+	}
+
+	// Observers and captures need a copy of the payload.
+	if len(vm.sessionObservers(session)) > 0 || vm.capturing() != nil {
+		return false
+	}
+
+	// Frames are still waiting to be written to the client and the
+	// payload has to go after them.
+	if !session.output.idle() {
+		return false
+	}
+
+	// The payload is dumped in the logs.
+	if bool(glog.V(2)) || vm.tracing() {
+		return false
+	}
+
+	conn, ok := session.client.(*clientConn)
+	if !ok {
+		return false
+	}
+
+	if !canSplice(conn.Conn, src) {
+		return false
+	}
+
+	// Splicing blocks until the client has read enough of the payload.
+	// When the client has read everything sent so far, the payload, at
+	// most 10KB, fits in the socket buffer.
+	return sendQueueEmpty(conn.Conn)
+}
+
+// spliceOutput relays the payload described by header from src to the
+// session's client, through pipe. Only errors on src, the io channel, are
+// returned. As the payload is consumed from src even when writing to the
+// client fails, the caller can continue reading from src.
+func (session *ioSession) spliceOutput(pipe *splicePipe, header ttyHeader, src net.Conn) error {
+	vm := session.vm
+	conn := session.client.(*clientConn)
+
+	frame := api.NewFrame(api.TypeStream, int(session.outputStream(header.seq)), nil)
+	frame.Header.PayloadLength = header.length
+	frame.Header.StreamID = session.streamID
+
+	vm.infof(1, "io", "<- splicing %d bytes to client #%d", header.length, session.clientID)
+	session.account(session.outputStream(header.seq), header.length)
+
+	// The header and the payload must not be interleaved with other
+	// frames.
+	conn.lockWrite()
+	defer conn.unlockWrite()
+
+	dstErr := api.WriteFrameHeader(conn.Conn, &frame.Header)
+	var srcErr error
+	if dstErr == nil {
+		srcErr, dstErr = spliceN(conn.Conn, src, pipe, header.length)
+	} else {
+		// Still consume the payload.
+		_, srcErr = io.CopyN(ioutil.Discard, src, int64(header.length))
+	}
+
+	if dstErr != nil {
+		vm.infof(1, "io", "error writing I/O data to client: %v", dstErr)
+	}
+
+	if srcErr != nil {
+		return fmt.Errorf("couldn't splice I/O data: %v", srcErr)
+	}
+
+	return nil
+}
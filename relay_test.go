@@ -0,0 +1,150 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/clearcontainers/proxy/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadTtyHeader(t *testing.T) {
+	c0, c1, err := Socketpair()
+	assert.Nil(t, err)
+	defer c0.Close()
+	defer c1.Close()
+
+	tests := []struct {
+		seq, length uint32
+		expected    int
+	}{
+		{1, 12 + 42, 42},
+		{2, 12, 0},
+		// EOF paquets have a 0 length.
+		{3, 0, 0},
+	}
+
+	for _, test := range tests {
+		buf := make([]byte, 12)
+		binary.BigEndian.PutUint64(buf, uint64(test.seq))
+		binary.BigEndian.PutUint32(buf[8:], test.length)
+		_, err := c0.Write(buf)
+		assert.Nil(t, err)
+
+		header, err := readTtyHeader(c1, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(test.seq), header.seq)
+		assert.Equal(t, test.expected, header.length)
+	}
+}
+
+func TestSpliceN(t *testing.T) {
+	src0, src1, err := Socketpair()
+	assert.Nil(t, err)
+	defer src0.Close()
+	defer src1.Close()
+	dst0, dst1, err := Socketpair()
+	assert.Nil(t, err)
+	defer dst0.Close()
+
+	if !canSplice(dst0, src1) {
+		t.Skip("splice isn't supported")
+	}
+
+	pipe, err := newSplicePipe()
+	assert.Nil(t, err)
+	defer pipe.Close()
+
+	// More than the default pipe capacity.
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, len(data))
+		io.ReadFull(dst1, buf)
+		received <- buf
+	}()
+	go src0.Write(data)
+
+	srcErr, dstErr := spliceN(dst0, src1, pipe, len(data))
+	assert.Nil(t, srcErr)
+	assert.Nil(t, dstErr)
+	assert.True(t, bytes.Equal(data, <-received))
+
+	// When the destination goes away, the data is still consumed from the
+	// source, ready for the next read.
+	dst1.Close()
+	go src0.Write(append(data, []byte("next")...))
+
+	srcErr, dstErr = spliceN(dst0, src1, pipe, len(data))
+	assert.Nil(t, srcErr)
+	assert.NotNil(t, dstErr)
+
+	next := make([]byte, 4)
+	_, err = io.ReadFull(src1, next)
+	assert.Nil(t, err)
+	assert.Equal(t, "next", string(next))
+}
+
+func TestNegotiateChunkSize(t *testing.T) {
+	tests := []struct {
+		requested, expected int
+	}{
+		{0, streamChunkSize},
+		{1, minStreamChunkSize},
+		{4096, 4096},
+		{maxStreamChunkSize + 1, maxStreamChunkSize},
+	}
+
+	for _, test := range tests {
+		size, err := negotiateChunkSize(test.requested)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, size)
+	}
+
+	_, err := negotiateChunkSize(-1)
+	assert.NotNil(t, err)
+}
+
+func TestSplitOutput(t *testing.T) {
+	buf := getBuffer(api.MinHeaderLength + 10)
+	for i := range buf[api.MinHeaderLength:] {
+		buf[api.MinHeaderLength+i] = byte(i)
+	}
+
+	// Copies don't touch buf.
+	chunks := splitOutput(buf, 4, true)
+	assert.Equal(t, 3, len(chunks))
+	var data []byte
+	for _, chunk := range chunks {
+		data = append(data, chunk[api.MinHeaderLength:]...)
+		putBuffer(chunk)
+	}
+	assert.Equal(t, buf[api.MinHeaderLength:], data)
+
+	// buf is returned as is when it fits in a chunk.
+	chunks = splitOutput(buf, 10, false)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, &buf[0], &chunks[0][0])
+	putBuffer(buf)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// spawn runs f in a new goroutine, accounted to vm in its resources.
+func (vm *vm) spawn(f func()) {
+	atomic.AddInt64(&vm.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&vm.goroutines, -1)
+		stressYield()
+		f()
+	}()
+}
+
+// resourcesUnlocked returns the host resources used for vm. It must be
+// called with the vm lock held.
+func (vm *vm) resourcesUnlocked() api.VMResources {
+	resources := api.VMResources{
+		Goroutines: int(atomic.LoadInt64(&vm.goroutines)),
+		Tokens:     len(vm.tokenToSession),
+	}
+
+	// The ctl and io channels.
+	if vm.connected {
+		resources.FDs += 2
+	}
+	if vm.console.conn != nil {
+		resources.FDs++
+	}
+	if vm.console.file != nil {
+		resources.FDs++
+	}
+	if vm.qmp != nil {
+		resources.FDs++
+	}
+	if vm.capture != nil {
+		resources.FDs++
+	}
+
+	// Client connections can be shared by several sessions.
+	conns := make(map[net.Conn]bool)
+	for _, conn := range vm.clients {
+		conns[conn] = true
+	}
+
+	for _, session := range vm.tokenToSession {
+		if session.client != nil {
+			resources.ClaimedTokens++
+			conns[session.client] = true
+		}
+		if session.output != nil {
+			resources.BufferedBytes += session.output.buffered()
+		}
+		if session.input != nil {
+			resources.BufferedBytes += session.input.buffered()
+		}
+		for _, observer := range session.observers {
+			conns[observer.client] = true
+			resources.BufferedBytes += observer.output.buffered()
+		}
+	}
+	resources.FDs += len(conns)
+
+	return resources
+}
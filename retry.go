@@ -0,0 +1,99 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// hyperRetries is the number of times an idempotent hyper command is retried
+// after a failure, eg. a timeout. 0 disables retries.
+var hyperRetries = 2
+
+// hyperWriteRetries is the number of times any hyper command is retried after
+// it couldn't be written to the ctl channel. 0 disables retries.
+var hyperWriteRetries = 3
+
+// hyperRetryDelay is the delay before the first retry of a hyper command. It
+// doubles after each attempt.
+var hyperRetryDelay = 50 * time.Millisecond
+
+// idempotentCommands are the hyper commands that can safely be sent again
+// when we don't know whether hyperstart has executed them.
+var idempotentCommands = map[string]bool{
+	hyperapi.CmdPing:    true,
+	hyperapi.CmdVersion: true,
+}
+
+// shouldRetry returns whether the hyper command name, which has failed with
+// err after attempt retries, should be sent again.
+func shouldRetry(name string, err error, attempt int) bool {
+	if errorCode(err) == api.ErrorCodeCancelled {
+		return false
+	}
+
+	// The hyperstart package only returns net errors when writing the
+	// command: hyperstart hasn't received it.
+	if _, ok := err.(net.Error); ok {
+		return attempt < hyperWriteRetries
+	}
+
+	return idempotentCommands[name] && attempt < hyperRetries
+}
+
+// isUnhealthy returns whether vm has been marked unhealthy, in which case
+// retrying its commands is pointless.
+func (vm *vm) isUnhealthy() bool {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.unhealthy
+}
+
+// sendCtlMessageRetry is sendCtlMessage retrying, with backoff, the commands
+// that have failed transiently, so a brief hiccup of the serial channels
+// doesn't make them fail. The liveness probe doesn't retry pings: it has its
+// own tolerance to missed ones.
+func (vm *vm) sendCtlMessageRetry(name string, data []byte) (*hyperstart.DecodedMessage, error) {
+	return vm.sendCtlMessageCancel(name, data, nil)
+}
+
+// sendCtlMessageCancel is sendCtlMessageRetry giving up, retries included,
+// when cancel, if not nil, is closed.
+func (vm *vm) sendCtlMessageCancel(name string, data []byte,
+	cancel <-chan interface{}) (*hyperstart.DecodedMessage, error) {
+	delay := hyperRetryDelay
+	for attempt := 0; ; attempt++ {
+		msg, err := vm.waitCtlMessage(name, data, cancel)
+		if err == nil || !shouldRetry(name, err, attempt) || vm.isUnhealthy() {
+			return msg, err
+		}
+
+		vm.infof(1, "ctl", "%s failed, retrying in %s: %v", name, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-cancel:
+			timer.Stop()
+			return nil, errCancelled(name)
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package shim implements the proxy side of a shim: claiming the I/O session
+// of a process with the token handed out by RegisterVM or AttachVM, relaying
+// its stdin, stdout and stderr, forwarding signals and terminal size changes
+// and waiting for its exit status.
+//
+// A Shim owns its connection to the proxy. A single goroutine reads the
+// frames sent by the proxy, writing the output of the process and handing
+// out the responses to the commands issued by Kill and Resize, so those can
+// be called while the output is being relayed.
+package shim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+)
+
+// streamID is the stream ID of the I/O session. A Shim has one session on
+// its connection.
+const streamID = 1
+
+// defaultChunkSize is the payload size of the stdin frames when the proxy
+// hasn't given its chunk size.
+const defaultChunkSize = 32 * 1024
+
+// Options are the parameters of the I/O session of a Shim.
+type Options struct {
+	// Stdin is relayed to the process until EOF, when the stdin of the
+	// process is closed. A nil Stdin closes the stdin of the process
+	// straight away.
+	Stdin io.Reader
+	// Stdout and Stderr receive the output of the process. Output is
+	// discarded when nil.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Terminal declares the shim has set up a terminal for the process,
+	// see api.ConnectShim.
+	Terminal bool
+	// ChunkSize is the maximum payload size of the stream frames asked to
+	// the proxy, 0 for the proxy default.
+	ChunkSize int
+	// Compression asks the proxy to compress the output of the process.
+	Compression bool
+}
+
+// Shim is a claimed I/O session.
+type Shim struct {
+	conn      net.Conn
+	stdout    io.Writer
+	stderr    io.Writer
+	chunkSize int
+
+	// writeLock serializes the frames written by the stdin goroutine and
+	// the commands.
+	writeLock sync.Mutex
+	// cmdLock ensures a single command is waiting for its response.
+	cmdLock   sync.Mutex
+	responses chan *api.Frame
+
+	// exited is closed once the exit status has been received, done once
+	// the connection can't be read anymore. err is the reason why.
+	exited     chan struct{}
+	exitStatus int
+	done       chan struct{}
+	err        error
+}
+
+// Dial connects to the proxy at proxyURL, the URL given alongside the
+// tokens in the io responses, and claims the I/O session of token.
+func Dial(proxyURL, token string, opts *Options) (*Shim, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	path := proxyURL
+	switch u.Scheme {
+	case "unix":
+		path = u.Path
+	case "":
+	default:
+		return nil, fmt.Errorf("unsupported proxy URL scheme %q", u.Scheme)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	shim, err := Connect(conn, token, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return shim, nil
+}
+
+// Connect claims the I/O session of token on conn and starts relaying its
+// streams. The Shim takes ownership of conn, which is closed by Close.
+func Connect(conn net.Conn, token string, opts *Options) (*Shim, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	shim := &Shim{
+		conn:      conn,
+		stdout:    opts.Stdout,
+		stderr:    opts.Stderr,
+		chunkSize: defaultChunkSize,
+		responses: make(chan *api.Frame, 1),
+		exited:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if shim.stdout == nil {
+		shim.stdout = ioutil.Discard
+	}
+	if shim.stderr == nil {
+		shim.stderr = ioutil.Discard
+	}
+
+	if err := shim.connectShim(token, opts); err != nil {
+		return nil, err
+	}
+
+	go shim.readFrames()
+	go shim.relayStdin(opts.Stdin)
+
+	return shim, nil
+}
+
+func errorFromResponse(resp *api.Frame) error {
+	if !resp.Header.InError {
+		return nil
+	}
+
+	decoded := api.ErrorResponse{}
+	if err := json.Unmarshal(resp.Payload, &decoded); err != nil {
+		return err
+	}
+
+	if decoded.Message == "" {
+		decoded.Message = "unknown error"
+	}
+
+	return &goapi.Error{
+		Code:    decoded.Code,
+		Message: decoded.Message,
+	}
+}
+
+func checkResponse(resp *api.Frame, cmd api.Command) error {
+	if resp.Header.Opcode != int(cmd) {
+		return fmt.Errorf("unexpected opcode %v", resp.Header.Opcode)
+	}
+
+	return errorFromResponse(resp)
+}
+
+// connectShim sends the ConnectShim command. It's the only command sent
+// before the frames are read by readFrames.
+func (shim *Shim) connectShim(token string, opts *Options) error {
+	payload := api.ConnectShim{
+		Token:     token,
+		ChunkSize: opts.ChunkSize,
+	}
+	if opts.Terminal {
+		payload.Terminal = &opts.Terminal
+	}
+	if opts.Compression {
+		payload.Compression = []string{api.CompressionDeflate}
+	}
+
+	if err := shim.writeCommand(api.CmdConnectShim, &payload); err != nil {
+		return err
+	}
+
+	// Notifications unrelated to the session may be received first.
+	var resp *api.Frame
+	for {
+		frame, err := api.ReadFrame(shim.conn)
+		if err != nil {
+			return err
+		}
+		if frame.Header.Type == api.TypeResponse && frame.Header.StreamID == streamID {
+			resp = frame
+			break
+		}
+	}
+
+	if err := checkResponse(resp, api.CmdConnectShim); err != nil {
+		return err
+	}
+
+	decoded := api.ConnectShimResponse{}
+	if len(resp.Payload) > 0 {
+		if err := json.Unmarshal(resp.Payload, &decoded); err != nil {
+			return err
+		}
+	}
+	if decoded.ChunkSize > 0 {
+		shim.chunkSize = decoded.ChunkSize
+	}
+
+	return nil
+}
+
+func (shim *Shim) writeFrame(frame *api.Frame) error {
+	shim.writeLock.Lock()
+	defer shim.writeLock.Unlock()
+
+	return api.WriteFrame(shim.conn, frame)
+}
+
+func (shim *Shim) writeCommand(cmd api.Command, payload interface{}) error {
+	frame, err := api.NewFrameJSON(api.TypeCommand, int(cmd), payload)
+	if err != nil {
+		return err
+	}
+	frame.Header.StreamID = streamID
+
+	return shim.writeFrame(frame)
+}
+
+// sendCommand sends cmd and waits for its response, read by readFrames.
+func (shim *Shim) sendCommand(cmd api.Command, payload interface{}) error {
+	shim.cmdLock.Lock()
+	defer shim.cmdLock.Unlock()
+
+	if err := shim.writeCommand(cmd, payload); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-shim.responses:
+		return checkResponse(resp, cmd)
+	case <-shim.done:
+		return shim.err
+	}
+}
+
+// readFrames reads the frames sent by the proxy until the connection is
+// closed.
+func (shim *Shim) readFrames() {
+	defer close(shim.done)
+
+	for {
+		frame, err := api.ReadFrame(shim.conn)
+		if err != nil {
+			shim.err = err
+			return
+		}
+
+		if frame.Header.StreamID != streamID {
+			continue
+		}
+
+		switch frame.Header.Type {
+		case api.TypeStream:
+			err = shim.writeOutput(frame)
+		case api.TypeNotification:
+			err = shim.handleNotification(frame)
+		case api.TypeResponse:
+			shim.responses <- frame
+		}
+		if err != nil {
+			shim.err = err
+			return
+		}
+	}
+}
+
+func (shim *Shim) writeOutput(frame *api.Frame) error {
+	if err := api.InflateFrame(frame); err != nil {
+		return err
+	}
+
+	var w io.Writer
+	switch api.Stream(frame.Header.Opcode) {
+	case api.StreamStdout:
+		w = shim.stdout
+	case api.StreamStderr:
+		w = shim.stderr
+	default:
+		return nil
+	}
+
+	_, err := w.Write(frame.Payload)
+	return err
+}
+
+func (shim *Shim) handleNotification(frame *api.Frame) error {
+	if frame.Header.Opcode != api.NotificationProcessExited {
+		return nil
+	}
+
+	if len(frame.Payload) != 1 {
+		return fmt.Errorf("invalid exit status payload length %d", len(frame.Payload))
+	}
+
+	select {
+	case <-shim.exited:
+	default:
+		shim.exitStatus = int(frame.Payload[0])
+		close(shim.exited)
+	}
+
+	return nil
+}
+
+// relayStdin sends stdin to the process, in frames of at most the chunk size
+// of the session, then closes the stdin of the process.
+func (shim *Shim) relayStdin(stdin io.Reader) {
+	if stdin != nil {
+		buf := make([]byte, shim.chunkSize)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), buf[:n])
+				frame.Header.StreamID = streamID
+				if werr := shim.writeFrame(frame); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	shim.writeLock.Lock()
+	defer shim.writeLock.Unlock()
+
+	api.WriteStdinEOF(shim.conn, streamID)
+}
+
+// Wait waits for the process to exit and returns its exit status. The output
+// of the process has been written to Options.Stdout and Options.Stderr by
+// the time Wait returns.
+func (shim *Shim) Wait() (int, error) {
+	select {
+	case <-shim.exited:
+		return shim.exitStatus, nil
+	case <-shim.done:
+	}
+
+	// The exit status may have been received just before the connection
+	// was closed.
+	select {
+	case <-shim.exited:
+		return shim.exitStatus, nil
+	default:
+	}
+
+	if shim.err == nil || shim.err == io.EOF {
+		return -1, errors.New("connection closed before the process exited")
+	}
+	return -1, shim.err
+}
+
+// Kill sends signal to the process.
+func (shim *Shim) Kill(signal syscall.Signal) error {
+	return shim.sendCommand(api.CmdSignal, &api.Signal{
+		SignalNumber: int(signal),
+	})
+}
+
+// Resize changes the size of the terminal of the process.
+func (shim *Shim) Resize(columns, rows int) error {
+	return shim.sendCommand(api.CmdSignal, &api.Signal{
+		SignalNumber: int(syscall.SIGWINCH),
+		Columns:      columns,
+		Rows:         rows,
+	})
+}
+
+// Close closes the connection to the proxy, releasing the I/O session. The
+// goroutine relaying stdin only stops once its next read from
+// Options.Stdin returns.
+func (shim *Shim) Close() error {
+	err := shim.conn.Close()
+	<-shim.done
+	return err
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package shim
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/clearcontainers/proxy/client/proxymock"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitStdin(t *testing.T, proxy *proxymock.Proxy, token string) []byte {
+	deadline := time.Now().Add(5 * time.Second)
+	data, closed := proxy.Stdin(token)
+	for !closed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		data, closed = proxy.Stdin(token)
+	}
+	assert.True(t, closed)
+	return data
+}
+
+func TestShim(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	token := proxy.AllocateTokens(1)[0]
+	var stdout, stderr bytes.Buffer
+	shim, err := Dial(proxy.URL(), token, &Options{
+		Stdin:  strings.NewReader("stdin"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	assert.Nil(t, err)
+	defer shim.Close()
+
+	assert.Equal(t, "stdin", string(waitStdin(t, proxy, token)))
+
+	assert.Nil(t, proxy.SendStdout(token, []byte("out")))
+	assert.Nil(t, proxy.SendStderr(token, []byte("err")))
+	assert.Nil(t, proxy.SendStdout(token, []byte("put")))
+	assert.Nil(t, proxy.SendExitStatus(token, 3))
+
+	status, err := shim.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, status)
+	assert.Equal(t, "output", stdout.String())
+	assert.Equal(t, "err", stderr.String())
+
+	requests := proxy.Requests()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, api.CmdConnectShim, requests[0].Command)
+	assert.Equal(t, streamID, requests[0].StreamID)
+}
+
+func TestShimNilStdin(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	token := proxy.AllocateTokens(1)[0]
+	shim, err := Dial(proxy.SocketPath(), token, nil)
+	assert.Nil(t, err)
+	defer shim.Close()
+
+	assert.Equal(t, 0, len(waitStdin(t, proxy, token)))
+}
+
+func TestShimConnectOptions(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	token := proxy.AllocateTokens(1)[0]
+	shim, err := Dial(proxy.URL(), token, &Options{
+		Terminal:    true,
+		ChunkSize:   1024,
+		Compression: true,
+	})
+	assert.Nil(t, err)
+	defer shim.Close()
+
+	requests := proxy.Requests()
+	assert.Equal(t, 1, len(requests))
+	payload := api.ConnectShim{}
+	assert.Nil(t, json.Unmarshal(requests[0].Payload, &payload))
+	assert.Equal(t, token, payload.Token)
+	if assert.NotNil(t, payload.Terminal) {
+		assert.True(t, *payload.Terminal)
+	}
+	assert.Equal(t, 1024, payload.ChunkSize)
+	assert.Equal(t, []string{api.CompressionDeflate}, payload.Compression)
+}
+
+func TestShimConnectError(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	_, err = Dial(proxy.URL(), "foo", nil)
+	assert.NotNil(t, err)
+	_, ok := err.(*goapi.Error)
+	assert.True(t, ok)
+
+	_, err = Dial("tcp://localhost:1234", "foo", nil)
+	assert.NotNil(t, err)
+}
+
+func TestShimSignals(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	proxy.Handle(api.CmdSignal, func(payload []byte) (interface{}, error) {
+		signal := api.Signal{}
+		if err := json.Unmarshal(payload, &signal); err != nil {
+			return nil, err
+		}
+		if signal.SignalNumber == int(syscall.SIGKILL) {
+			return nil, &goapi.Error{
+				Code:    api.ErrorCodeUnsupportedCommand,
+				Message: "no SIGKILL",
+			}
+		}
+		return nil, nil
+	})
+
+	token := proxy.AllocateTokens(1)[0]
+	shim, err := Dial(proxy.URL(), token, nil)
+	assert.Nil(t, err)
+	defer shim.Close()
+
+	// Output is relayed while commands are waiting for their response.
+	assert.Nil(t, proxy.SendStdout(token, []byte("foo")))
+	assert.Nil(t, shim.Kill(syscall.SIGTERM))
+	assert.Nil(t, shim.Resize(80, 25))
+	err = shim.Kill(syscall.SIGKILL)
+	assert.Equal(t, &goapi.Error{Code: api.ErrorCodeUnsupportedCommand, Message: "no SIGKILL"}, err)
+
+	requests := proxy.Requests()
+	assert.Equal(t, 4, len(requests))
+	for _, r := range requests[1:] {
+		assert.Equal(t, api.CmdSignal, r.Command)
+		assert.Equal(t, streamID, r.StreamID)
+	}
+	signal := api.Signal{}
+	assert.Nil(t, json.Unmarshal(requests[1].Payload, &signal))
+	assert.Equal(t, api.Signal{SignalNumber: int(syscall.SIGTERM)}, signal)
+	signal = api.Signal{}
+	assert.Nil(t, json.Unmarshal(requests[2].Payload, &signal))
+	assert.Equal(t, api.Signal{SignalNumber: int(syscall.SIGWINCH), Columns: 80, Rows: 25}, signal)
+}
+
+func TestShimConnectionClosed(t *testing.T) {
+	proxy, err := proxymock.New()
+	assert.Nil(t, err)
+
+	token := proxy.AllocateTokens(1)[0]
+	shim, err := Dial(proxy.URL(), token, nil)
+	assert.Nil(t, err)
+	defer shim.Close()
+
+	proxy.Close()
+
+	_, err = shim.Wait()
+	assert.NotNil(t, err)
+	err = shim.Kill(syscall.SIGTERM)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package shim
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// forwardedSignals are the signals ForwardSignals relays to the process.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGCONT,
+}
+
+// ForwardSignals relays the signals received by the shim to the process
+// until stop is called. When terminal is not nil, its size is sent to the
+// process straight away and every time the shim receives SIGWINCH. It's up
+// to the caller to put terminal in raw mode.
+//
+// Errors are ignored: the process may have exited already.
+func (shim *Shim) ForwardSignals(terminal *os.File) (stop func()) {
+	sigCh := make(chan os.Signal, 8)
+	signals := forwardedSignals
+	if terminal != nil {
+		signals = append(signals[:len(signals):len(signals)], syscall.SIGWINCH)
+		shim.resizeFrom(terminal)
+	}
+	signal.Notify(sigCh, signals...)
+
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigCh:
+				if sig == syscall.SIGWINCH {
+					shim.resizeFrom(terminal)
+					continue
+				}
+				shim.Kill(sig.(syscall.Signal))
+			case <-quit:
+				return
+			case <-shim.done:
+				signal.Stop(sigCh)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(quit)
+	}
+}
+
+func (shim *Shim) resizeFrom(terminal *os.File) {
+	columns, rows, err := TerminalSize(terminal)
+	if err != nil {
+		return
+	}
+	shim.Resize(columns, rows)
+}
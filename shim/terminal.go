@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build linux
+
+package shim
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// TerminalSize returns the number of columns and rows of terminal.
+func TerminalSize(terminal *os.File) (columns, rows int, err error) {
+	var ws struct {
+		Row, Col, Xpixel, Ypixel uint16
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, terminal.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+
+	return int(ws.Col), int(ws.Row), nil
+}
@@ -0,0 +1,643 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// AgentChannel is one of the two serial links between the proxy and the
+// agent.
+type AgentChannel int
+
+const (
+	// CtlChannel carries the hyperstart commands and their responses.
+	CtlChannel AgentChannel = iota
+	// IoChannel carries the process stdin, stdout and stderr.
+	IoChannel
+)
+
+var channelNames = map[AgentChannel]string{
+	CtlChannel: "ctl",
+	IoChannel:  "io",
+}
+
+// String implements Stringer for AgentChannel.
+func (c AgentChannel) String() string {
+	return channelNames[c]
+}
+
+// AgentDirection tells which side of an agent channel has sent a message.
+type AgentDirection int
+
+const (
+	// ToAgent is a message sent by the proxy to the agent.
+	ToAgent AgentDirection = iota
+	// FromAgent is a message sent by the agent to the proxy.
+	FromAgent
+)
+
+var agentDirectionNames = map[AgentDirection]string{
+	ToAgent:   "toAgent",
+	FromAgent: "fromAgent",
+}
+
+// String implements Stringer for AgentDirection.
+func (d AgentDirection) String() string {
+	if d == ToAgent {
+		return "->"
+	}
+	return "<-"
+}
+
+// peer returns the other direction.
+func (d AgentDirection) peer() AgentDirection {
+	if d == ToAgent {
+		return FromAgent
+	}
+	return ToAgent
+}
+
+// AgentRecord is an hyperstart message exchanged on an agent channel. Data is
+// the message as sent on the channel, header included. Err is set, and Data
+// nil, when the data sent couldn't be decoded or, when replaying, when the
+// other side didn't send what the recording expected.
+type AgentRecord struct {
+	Time      time.Time
+	Channel   AgentChannel
+	Direction AgentDirection
+	Data      []byte
+	Err       error
+}
+
+// AgentHandler is called with each message seen on the agent channels. Calls
+// are serialized.
+type AgentHandler func(record *AgentRecord)
+
+// maxAgentMessage bounds the size of the messages read from the channels.
+// hyperstart itself doesn't accept messages bigger than 10240 bytes.
+const maxAgentMessage = 1024 * 1024
+
+// readAgentMessage reads a whole hyperstart message from r. Both channels
+// have a header ending with the big endian length of the message, header
+// included.
+func readAgentMessage(r io.Reader, channel AgentChannel) ([]byte, error) {
+	hdrSize, lenOffset := hyperstart.CtlHdrSize, hyperstart.CtlHdrLenOffset
+	if channel == IoChannel {
+		hdrSize, lenOffset = hyperstart.TtyHdrSize, hyperstart.TtyHdrLenOffset
+	}
+
+	header := make([]byte, hdrSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[lenOffset:]))
+	if length < hdrSize || length > maxAgentMessage {
+		return header, fmt.Errorf("invalid %s message length %d", channel, length)
+	}
+
+	msg := make([]byte, length)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[hdrSize:]); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// agentRecordEntry is an entry of an agent recording, one JSON object per
+// line:
+//
+//  {"time":"2017-06-12T10:36:58.123456789Z","channel":"ctl","direction":"toAgent","data":"AAAABgAAAFN7..."}
+//
+// data is the message as sent on the channel, base64 encoded.
+type agentRecordEntry struct {
+	Time      time.Time `json:"time"`
+	Channel   string    `json:"channel"`
+	Direction string    `json:"direction"`
+	Data      []byte    `json:"data,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AgentRecorder writes agent records to a recording, to be replayed later
+// with an AgentReplayer. Record can be called from several goroutines.
+type AgentRecorder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewAgentRecorder returns an AgentRecorder writing to w.
+func NewAgentRecorder(w io.Writer) *AgentRecorder {
+	return &AgentRecorder{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// Record appends record to the recording.
+func (r *AgentRecorder) Record(record *AgentRecord) error {
+	entry := agentRecordEntry{
+		Time:      record.Time.UTC(),
+		Channel:   record.Channel.String(),
+		Direction: agentDirectionNames[record.Direction],
+		Data:      record.Data,
+	}
+	if record.Err != nil {
+		entry.Error = record.Err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.encoder.Encode(&entry)
+}
+
+func parseAgentEntry(entry *agentRecordEntry) (*AgentRecord, error) {
+	record := &AgentRecord{
+		Time: entry.Time,
+		Data: entry.Data,
+	}
+
+	found := false
+	for c, name := range channelNames {
+		if name == entry.Channel {
+			record.Channel, found = c, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown channel %q", entry.Channel)
+	}
+
+	found = false
+	for d, name := range agentDirectionNames {
+		if name == entry.Direction {
+			record.Direction, found = d, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown direction %q", entry.Direction)
+	}
+
+	if entry.Error != "" {
+		record.Err = errors.New(entry.Error)
+	}
+
+	return record, nil
+}
+
+// ReadAgentRecording decodes the records of a recording written by an
+// AgentRecorder.
+func ReadAgentRecording(r io.Reader) ([]*AgentRecord, error) {
+	var records []*AgentRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*maxAgentMessage)
+	for line := 1; scanner.Scan(); line++ {
+		entry := agentRecordEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		record, err := parseAgentEntry(&entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// AgentRelay sits between the proxy and an agent: the proxy is given the
+// paths of sockets AgentRelay listens on in RegisterVM and the connections
+// are relayed to the agent ctl and io sockets, decoding the messages going
+// through.
+type AgentRelay struct {
+	// CtlTarget and IoTarget are the paths of the agent sockets.
+	CtlTarget string
+	IoTarget  string
+	Handler   AgentHandler
+
+	mu sync.Mutex
+}
+
+// Serve relays the connections accepted on ctlListener and ioListener until
+// one of them fails.
+func (r *AgentRelay) Serve(ctlListener, ioListener net.Listener) error {
+	errs := make(chan error, 2)
+
+	serve := func(l net.Listener, channel AgentChannel, target string) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			go r.serveConn(conn, channel, target)
+		}
+	}
+
+	go serve(ctlListener, CtlChannel, r.CtlTarget)
+	go serve(ioListener, IoChannel, r.IoTarget)
+
+	return <-errs
+}
+
+func (r *AgentRelay) serveConn(proxy net.Conn, channel AgentChannel, target string) {
+	defer proxy.Close()
+
+	agent, err := net.Dial("unix", target)
+	if err != nil {
+		r.handle(&AgentRecord{Time: time.Now(), Channel: channel, Err: err})
+		return
+	}
+	defer agent.Close()
+
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn, dir AgentDirection) {
+		r.relay(dst, src, channel, dir)
+		// Forward the EOF, the peer then closes the other direction.
+		if conn, ok := dst.(*net.UnixConn); ok {
+			conn.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+
+	go relay(agent, proxy, ToAgent)
+	go relay(proxy, agent, FromAgent)
+	<-done
+	<-done
+}
+
+// relay copies src to dst until src is closed, a message at a time. Data
+// that can't be decoded is reported once and forwarded as is.
+func (r *AgentRelay) relay(dst, src net.Conn, channel AgentChannel, dir AgentDirection) {
+	for {
+		msg, err := readAgentMessage(src, channel)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			r.handle(&AgentRecord{Time: time.Now(), Channel: channel, Direction: dir, Err: err})
+			if msg != nil {
+				if _, err := dst.Write(msg); err != nil {
+					return
+				}
+			}
+			break
+		}
+
+		if _, err := dst.Write(msg); err != nil {
+			return
+		}
+		r.handle(&AgentRecord{Time: time.Now(), Channel: channel, Direction: dir, Data: msg})
+	}
+
+	io.Copy(dst, src)
+}
+
+func (r *AgentRelay) handle(record *AgentRecord) {
+	if r.Handler == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Handler(record)
+}
+
+// AgentReplayer plays one side of recorded agent channels: it sends the
+// messages the recording has in Direction and reports the messages the other
+// side sends back.
+//
+// To make the replay deterministic, a message isn't sent before the other
+// side has sent, on each channel, as many messages as it had at that point of
+// the recording, eg. an ACK isn't replayed before the proxy has sent the
+// command it acknowledges.
+type AgentReplayer struct {
+	// Direction selects the recorded messages to send: ToAgent replays
+	// the proxy side, to an agent, FromAgent the agent side, to a proxy.
+	Direction AgentDirection
+	// Speed divides the recorded delays between messages. 0 sends the
+	// messages as soon as the other side is in sync.
+	Speed float64
+	// Sync is how long to wait for the other side to catch up with the
+	// recording before sending the next message anyway, reporting an
+	// error. 0 doesn't wait.
+	Sync time.Duration
+	// Linger is how long to wait for the messages the recording still
+	// expects from the other side once all the messages have been sent,
+	// reporting an error for the ones missing. 0 doesn't wait.
+	Linger  time.Duration
+	Handler AgentHandler
+
+	mu sync.Mutex
+}
+
+// agentEvent is sent by the receiving goroutines of Replay, for each message
+// read and once the channel is closed.
+type agentEvent struct {
+	channel AgentChannel
+	closed  bool
+}
+
+// agentReplay is the state of a replay.
+type agentReplay struct {
+	events   chan agentEvent
+	received [2]int
+	closed   [2]bool
+}
+
+// handleEvent accounts for e.
+func (s *agentReplay) handleEvent(e agentEvent) {
+	if e.closed {
+		s.closed[e.channel] = true
+	} else {
+		s.received[e.channel]++
+	}
+}
+
+// caughtUp returns whether the other side has sent want, or can't send
+// anything anymore.
+func (s *agentReplay) caughtUp(want [2]int) bool {
+	for c := range want {
+		if s.received[c] < want[c] && !s.closed[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitFor waits until the other side has sent want, for at most timeout.
+func (s *agentReplay) waitFor(want [2]int, timeout time.Duration) bool {
+	if s.caughtUp(want) {
+		return true
+	}
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for !s.caughtUp(want) {
+		select {
+		case e := <-s.events:
+			s.handleEvent(e)
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
+
+// sleep waits for d, keeping track of the messages received meanwhile.
+func (s *agentReplay) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case e := <-s.events:
+			s.handleEvent(e)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Replay replays records on the ctl and io channels, ctlConn and ioConn,
+// returning once the messages have been sent and the other side has sent what
+// the recording expects from it, Linger has elapsed or both channels have
+// been closed.
+func (r *AgentReplayer) Replay(ctlConn, ioConn net.Conn, records []*AgentRecord) error {
+	conns := [...]net.Conn{CtlChannel: ctlConn, IoChannel: ioConn}
+	s := &agentReplay{events: make(chan agentEvent)}
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for c, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn, channel AgentChannel) {
+			r.receive(conn, channel, s.events, done)
+			wg.Done()
+		}(conn, AgentChannel(c))
+	}
+
+	want, err := r.send(s, conns, records)
+	if err == nil && r.Linger > 0 && !s.waitFor(want, r.Linger) {
+		r.reportMissing(s, want)
+	}
+
+	close(done)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	wg.Wait()
+
+	return err
+}
+
+// send sends the records of r.Direction and returns how many messages the
+// recording expects from the other side.
+func (r *AgentReplayer) send(s *agentReplay, conns [2]net.Conn, records []*AgentRecord) ([2]int, error) {
+	var want [2]int
+
+	if len(records) == 0 {
+		return want, nil
+	}
+
+	start := time.Now()
+	recordStart := records[0].Time
+
+	for _, record := range records {
+		if record.Data == nil {
+			continue
+		}
+		if record.Direction != r.Direction {
+			want[record.Channel]++
+			continue
+		}
+
+		if !s.waitFor(want, r.Sync) && r.Sync > 0 {
+			r.reportMissing(s, want)
+		}
+
+		if r.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(recordStart)) / r.Speed)
+			s.sleep(start.Add(offset).Sub(time.Now()))
+		}
+
+		if s.closed[record.Channel] {
+			return want, fmt.Errorf("%s channel closed by the other side", record.Channel)
+		}
+
+		if _, err := conns[record.Channel].Write(record.Data); err != nil {
+			return want, err
+		}
+
+		r.handle(&AgentRecord{
+			Time:      time.Now(),
+			Channel:   record.Channel,
+			Direction: r.Direction,
+			Data:      record.Data,
+		})
+	}
+
+	return want, nil
+}
+
+// reportMissing reports the channels on which the other side hasn't sent
+// what the recording expects.
+func (r *AgentReplayer) reportMissing(s *agentReplay, want [2]int) {
+	for c := range want {
+		if s.received[c] >= want[c] {
+			continue
+		}
+		r.handle(&AgentRecord{
+			Time:      time.Now(),
+			Channel:   AgentChannel(c),
+			Direction: r.Direction.peer(),
+			Err: fmt.Errorf("expected %d messages, received %d",
+				want[c], s.received[c]),
+		})
+	}
+}
+
+func (r *AgentReplayer) receive(conn net.Conn, channel AgentChannel, events chan<- agentEvent, done <-chan struct{}) {
+	event := agentEvent{channel: channel}
+
+	for {
+		msg, err := readAgentMessage(conn, channel)
+		if err != nil {
+			break
+		}
+		r.handle(&AgentRecord{
+			Time:      time.Now(),
+			Channel:   channel,
+			Direction: r.Direction.peer(),
+			Data:      msg,
+		})
+
+		select {
+		case events <- event:
+		case <-done:
+			return
+		}
+	}
+
+	event.closed = true
+	select {
+	case events <- event:
+	case <-done:
+	}
+}
+
+func (r *AgentReplayer) handle(record *AgentRecord) {
+	if r.Handler == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Handler(record)
+}
+
+// ctlCodeNames maps the hyperstart ctl codes to the command names.
+var ctlCodeNames = func() map[uint32]string {
+	names := make(map[uint32]string)
+	for name, code := range hyperstart.CodeList {
+		names[code] = name
+	}
+	return names
+}()
+
+// FormatAgent writes a human readable version of record to w. ctl messages
+// are printed with the command name and JSON payload, io messages with their
+// sequence number and data:
+//
+//  10:36:58.123456 ctl -> execcmd
+//  {
+//    "container": "8e5f2c3a"
+//  }
+//  10:36:58.124012 ctl <- ack
+//  10:36:58.125001 io <- seq=3 "hello\n"
+func FormatAgent(w io.Writer, record *AgentRecord) {
+	prefix := fmt.Sprintf("%s %s %s", record.Time.Format("15:04:05.000000"),
+		record.Channel, record.Direction)
+
+	if record.Err != nil {
+		fmt.Fprintf(w, "%s error: %v\n", prefix, record.Err)
+		return
+	}
+
+	data := record.Data
+	if record.Channel == IoChannel {
+		payload := data[hyperstart.TtyHdrSize:]
+		line := fmt.Sprintf("%s seq=%d", prefix,
+			binary.BigEndian.Uint64(data[:hyperstart.TtyHdrLenOffset]))
+		switch {
+		case len(payload) == 0:
+			fmt.Fprintf(w, "%s eof\n", line)
+		case len(payload) > maxStreamData:
+			fmt.Fprintf(w, "%s %q... (%d bytes)\n", line, payload[:maxStreamData], len(payload))
+		default:
+			fmt.Fprintf(w, "%s %s\n", line, strconv.Quote(string(payload)))
+		}
+		return
+	}
+
+	code := binary.BigEndian.Uint32(data[:hyperstart.CtlHdrLenOffset])
+	name, ok := ctlCodeNames[code]
+	if !ok {
+		name = fmt.Sprintf("code %d", code)
+	}
+
+	payload := data[hyperstart.CtlHdrSize:]
+	if len(payload) == 0 {
+		fmt.Fprintf(w, "%s %s\n", prefix, name)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, payload, "", "  "); err != nil {
+		fmt.Fprintf(w, "%s %s %q\n", prefix, name, payload)
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n%s\n", prefix, name, buf.String())
+}
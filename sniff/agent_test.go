@@ -0,0 +1,382 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
+	"github.com/clearcontainers/proxy/api/hyperstart/agentmock"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+	"github.com/stretchr/testify/assert"
+)
+
+func ctlMessage(code uint32, data []byte) []byte {
+	msg := make([]byte, hyperstart.CtlHdrSize+len(data))
+	binary.BigEndian.PutUint32(msg, code)
+	binary.BigEndian.PutUint32(msg[hyperstart.CtlHdrLenOffset:], uint32(len(msg)))
+	copy(msg[hyperstart.CtlHdrSize:], data)
+	return msg
+}
+
+func ioMessage(seq uint64, data []byte) []byte {
+	msg := make([]byte, hyperstart.TtyHdrSize+len(data))
+	binary.BigEndian.PutUint64(msg, seq)
+	binary.BigEndian.PutUint32(msg[hyperstart.TtyHdrLenOffset:], uint32(len(msg)))
+	copy(msg[hyperstart.TtyHdrSize:], data)
+	return msg
+}
+
+func execCmd(t *testing.T) []byte {
+	data, err := json.Marshal(&hyperapi.ExecCommand{
+		Container: "foo",
+		Process:   hyperapi.Process{Stdio: 3, Args: []string{"/bin/true"}},
+	})
+	assert.Nil(t, err)
+	return ctlMessage(hyperstart.ExecCmdCode, data)
+}
+
+// testAgentRecords is the recording of a process started with execcmd and
+// writing hello to its stdout.
+func testAgentRecords(t *testing.T) []*AgentRecord {
+	start := time.Date(2017, 6, 12, 10, 36, 58, 0, time.UTC)
+	next := make([]byte, 4)
+	binary.BigEndian.PutUint32(next, uint32(len(execCmd(t))))
+
+	return []*AgentRecord{
+		{Time: start, Channel: CtlChannel, Direction: FromAgent, Data: ctlMessage(hyperstart.ReadyCode, nil)},
+		{Time: start.Add(time.Millisecond), Channel: CtlChannel, Direction: ToAgent, Data: execCmd(t)},
+		{Time: start.Add(2 * time.Millisecond), Channel: CtlChannel, Direction: FromAgent, Data: ctlMessage(hyperstart.NextCode, next)},
+		{Time: start.Add(2 * time.Millisecond), Channel: CtlChannel, Direction: FromAgent, Data: ctlMessage(hyperstart.AckCode, nil)},
+		{Time: start.Add(5 * time.Millisecond), Channel: IoChannel, Direction: FromAgent, Data: ioMessage(3, []byte("hello\n"))},
+	}
+}
+
+// playProxy plays the proxy side of testAgentRecords on ctl and io.
+func playProxy(t *testing.T, ctl, io net.Conn) {
+	msg, err := hyperstart.ReadCtlMessage(ctl)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(hyperstart.ReadyCode), msg.Code)
+
+	_, err = ctl.Write(execCmd(t))
+	assert.Nil(t, err)
+
+	for _, code := range []uint32{hyperstart.NextCode, hyperstart.AckCode} {
+		msg, err := hyperstart.ReadCtlMessage(ctl)
+		assert.Nil(t, err)
+		assert.Equal(t, code, msg.Code)
+	}
+
+	tty, err := hyperstart.ReadIoMessageWithConn(io)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), tty.Session)
+	assert.Equal(t, "hello\n", string(tty.Message))
+}
+
+// sayHello makes the process started on agent write hello.
+func sayHello(t *testing.T, agent *agentmock.Agent) {
+	p, err := agent.WaitProcess(5 * time.Second)
+	assert.Nil(t, err)
+	if p != nil {
+		p.SendStdout([]byte("hello\n"))
+	}
+}
+
+// assertSameMessages checks records hold the messages of expected. Messages
+// are only ordered within a channel: the agent may write to io before
+// acknowledging the command starting the process on ctl.
+func assertSameMessages(t *testing.T, expected, records []*AgentRecord) {
+	for _, record := range records {
+		assert.Nil(t, record.Err)
+	}
+
+	for _, channel := range []AgentChannel{CtlChannel, IoChannel} {
+		var want, got []*AgentRecord
+		for _, record := range expected {
+			if record.Channel == channel {
+				want = append(want, record)
+			}
+		}
+		for _, record := range records {
+			if record.Channel == channel {
+				got = append(got, record)
+			}
+		}
+
+		if !assert.Equal(t, len(want), len(got), "%s messages", channel) {
+			continue
+		}
+		for i := range want {
+			assert.Equal(t, want[i].Direction, got[i].Direction, "%s message %d", channel, i)
+			assert.Equal(t, want[i].Data, got[i].Data, "%s message %d", channel, i)
+		}
+	}
+}
+
+type agentRecords struct {
+	sync.Mutex
+	records []*AgentRecord
+}
+
+func (r *agentRecords) handle(record *AgentRecord) {
+	r.Lock()
+	defer r.Unlock()
+	r.records = append(r.records, record)
+}
+
+func (r *agentRecords) get() []*AgentRecord {
+	r.Lock()
+	defer r.Unlock()
+	return r.records
+}
+
+func TestAgentRecording(t *testing.T) {
+	records := append(testAgentRecords(t), &AgentRecord{
+		Time:      time.Date(2017, 6, 12, 10, 36, 59, 0, time.UTC),
+		Channel:   IoChannel,
+		Direction: ToAgent,
+		Err:       errors.New("invalid io message length 3"),
+	})
+
+	var buf bytes.Buffer
+	recorder := NewAgentRecorder(&buf)
+	for _, record := range records {
+		err := recorder.Record(record)
+		assert.Nil(t, err)
+	}
+
+	decoded, err := ReadAgentRecording(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, records, decoded)
+
+	_, err = ReadAgentRecording(bytes.NewBufferString(`{"channel":"serial","direction":"toAgent"}`))
+	assert.Equal(t, `line 1: unknown channel "serial"`, err.Error())
+}
+
+func TestAgentRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-agent-relay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	agent, err := agentmock.New()
+	assert.Nil(t, err)
+	defer agent.Close()
+
+	recorded := &agentRecords{}
+	relay := &AgentRelay{
+		CtlTarget: agent.CtlSocketPath(),
+		IoTarget:  agent.IoSocketPath(),
+		Handler:   recorded.handle,
+	}
+	ctlListener, err := net.Listen("unix", filepath.Join(dir, "ctl.sock"))
+	assert.Nil(t, err)
+	defer ctlListener.Close()
+	ioListener, err := net.Listen("unix", filepath.Join(dir, "io.sock"))
+	assert.Nil(t, err)
+	defer ioListener.Close()
+	go relay.Serve(ctlListener, ioListener)
+
+	ctl, err := net.Dial("unix", filepath.Join(dir, "ctl.sock"))
+	assert.Nil(t, err)
+	defer ctl.Close()
+	io, err := net.Dial("unix", filepath.Join(dir, "io.sock"))
+	assert.Nil(t, err)
+	defer io.Close()
+
+	go sayHello(t, agent)
+	playProxy(t, ctl, io)
+
+	assertSameMessages(t, testAgentRecords(t), recorded.get())
+}
+
+// pipes returns the two ends of the ctl and io channels.
+func pipes() (ctl, io, peerCtl, peerIo net.Conn) {
+	ctl, peerCtl = net.Pipe()
+	io, peerIo = net.Pipe()
+	return
+}
+
+func TestAgentReplayToProxy(t *testing.T) {
+	ctl, io, peerCtl, peerIo := pipes()
+
+	replayed := &agentRecords{}
+	replayer := &AgentReplayer{
+		Direction: FromAgent,
+		Sync:      5 * time.Second,
+		Linger:    time.Second,
+		Handler:   replayed.handle,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		playProxy(t, peerCtl, peerIo)
+		close(done)
+	}()
+
+	err := replayer.Replay(ctl, io, testAgentRecords(t))
+	assert.Nil(t, err)
+	<-done
+
+	// NEXT and ACK are only sent once execcmd has been received.
+	assertSameMessages(t, testAgentRecords(t), replayed.get())
+}
+
+func TestAgentReplayToAgent(t *testing.T) {
+	agent, err := agentmock.New()
+	assert.Nil(t, err)
+	defer agent.Close()
+
+	ctl, err := net.Dial("unix", agent.CtlSocketPath())
+	assert.Nil(t, err)
+	io, err := net.Dial("unix", agent.IoSocketPath())
+	assert.Nil(t, err)
+
+	replayed := &agentRecords{}
+	replayer := &AgentReplayer{
+		Direction: ToAgent,
+		Speed:     1,
+		Sync:      5 * time.Second,
+		Linger:    5 * time.Second,
+		Handler:   replayed.handle,
+	}
+
+	go sayHello(t, agent)
+	err = replayer.Replay(ctl, io, testAgentRecords(t))
+	assert.Nil(t, err)
+
+	assertSameMessages(t, testAgentRecords(t), replayed.get())
+	messages := agent.Messages()
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, hyperapi.CmdExecCmd, messages[0].Cmd)
+	}
+}
+
+func TestAgentReplayOutOfSync(t *testing.T) {
+	ctl, io, peerCtl, peerIo := pipes()
+	defer peerCtl.Close()
+	defer peerIo.Close()
+
+	// The other side never sends READY.
+	received := make(chan []byte, 1)
+	go func() {
+		msg, err := readAgentMessage(peerCtl, CtlChannel)
+		if err == nil {
+			received <- msg
+		}
+	}()
+	go ioutil.ReadAll(peerIo)
+
+	replayed := &agentRecords{}
+	replayer := &AgentReplayer{
+		Direction: ToAgent,
+		Sync:      10 * time.Millisecond,
+		Handler:   replayed.handle,
+	}
+
+	err := replayer.Replay(ctl, io, testAgentRecords(t)[:2])
+	assert.Nil(t, err)
+	assert.Equal(t, execCmd(t), <-received)
+
+	records := replayed.get()
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, CtlChannel, records[0].Channel)
+		assert.Equal(t, FromAgent, records[0].Direction)
+		assert.Equal(t, "expected 1 messages, received 0", records[0].Err.Error())
+		assert.Equal(t, execCmd(t), records[1].Data)
+	}
+}
+
+func TestReadAgentMessage(t *testing.T) {
+	msg := ioMessage(3, []byte("foo"))
+	binary.BigEndian.PutUint32(msg[hyperstart.TtyHdrLenOffset:], 3)
+
+	header, err := readAgentMessage(bytes.NewReader(msg), IoChannel)
+	assert.Equal(t, "invalid io message length 3", err.Error())
+	assert.Equal(t, msg[:hyperstart.TtyHdrSize], header)
+
+	_, err = readAgentMessage(bytes.NewReader(ctlMessage(hyperstart.PingCode, nil)[:4]), CtlChannel)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestFormatAgent(t *testing.T) {
+	now := time.Date(2017, 6, 12, 10, 36, 58, 123456000, time.UTC)
+	tests := []struct {
+		record   *AgentRecord
+		expected string
+	}{
+		{
+			&AgentRecord{
+				Time:      now,
+				Channel:   CtlChannel,
+				Direction: ToAgent,
+				Data:      ctlMessage(hyperstart.KillContainerCode, []byte(`{"container":"foo","signal":15}`)),
+			},
+			"10:36:58.123456 ctl -> killcontainer\n{\n  \"container\": \"foo\",\n  \"signal\": 15\n}\n",
+		},
+		{
+			&AgentRecord{
+				Time:      now,
+				Channel:   CtlChannel,
+				Direction: FromAgent,
+				Data:      ctlMessage(hyperstart.AckCode, nil),
+			},
+			"10:36:58.123456 ctl <- ack\n",
+		},
+		{
+			&AgentRecord{
+				Time:      now,
+				Channel:   IoChannel,
+				Direction: FromAgent,
+				Data:      ioMessage(3, []byte("hello\n")),
+			},
+			"10:36:58.123456 io <- seq=3 \"hello\\n\"\n",
+		},
+		{
+			&AgentRecord{
+				Time:      now,
+				Channel:   IoChannel,
+				Direction: ToAgent,
+				Data:      ioMessage(3, nil),
+			},
+			"10:36:58.123456 io -> seq=3 eof\n",
+		},
+		{
+			&AgentRecord{
+				Time:      now,
+				Channel:   IoChannel,
+				Direction: FromAgent,
+				Err:       errors.New("expected 1 messages, received 0"),
+			},
+			"10:36:58.123456 io <- error: expected 1 messages, received 0\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		FormatAgent(&buf, test.record)
+		assert.Equal(t, test.expected, buf.String())
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sniff
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// Violation is a frame breaking the sequence of commands the proxy expects.
+type Violation struct {
+	// Offset is the index of the frame in the trace given to the
+	// Checker, counting from 0.
+	Offset int
+	Conn   uint64
+	// Message describes the violation.
+	Message string
+}
+
+// String implements Stringer for Violation.
+func (v *Violation) String() string {
+	return fmt.Sprintf("frame %d (conn #%d): %s", v.Offset, v.Conn, v.Message)
+}
+
+type containerState int
+
+const (
+	containerUnknown containerState = iota
+	containerRegistered
+	containerUnregistered
+)
+
+type tokenState int
+
+const (
+	tokenUnknown tokenState = iota
+	tokenHandedOut
+	tokenClaimed
+)
+
+// connState is what a Checker knows of a client connection.
+type connState struct {
+	// vm is the container the connection has registered or attached to.
+	vm string
+	// unregistered is set once the connection has unregistered its VM.
+	unregistered bool
+	// pending are the commands waiting for their response, the proxy
+	// answers the commands of a connection in order.
+	pending []*api.Frame
+	// sessions are the stream IDs associated with an I/O session.
+	sessions map[int]bool
+}
+
+// Checker verifies a trace of the frames exchanged between the proxy and its
+// clients obeys the protocol state machine:
+//
+//  - a container is registered once, with RegisterVM, before being attached
+//    to or targeted by commands, and isn't used once unregistered,
+//  - hyper commands, and the other commands addressing the VM of the
+//    connection, are sent after RegisterVM or AttachVM and not after
+//    UnregisterVM,
+//  - I/O tokens are handed out by RegisterVM or AttachVM and claimed once
+//    with ConnectShim,
+//  - stdin, Signal and DisconnectShim are sent on a stream associated with
+//    an I/O session.
+//
+// A command only changes the state once the proxy has answered it
+// successfully. The trace must start with the first frame the proxy has
+// received: commands targeting a VM registered earlier are reported.
+type Checker struct {
+	offset     int
+	conns      map[uint64]*connState
+	containers map[string]containerState
+	tokens     map[string]tokenState
+}
+
+// NewChecker returns a Checker with no VM registered.
+func NewChecker() *Checker {
+	return &Checker{
+		conns:      make(map[uint64]*connState),
+		containers: make(map[string]containerState),
+		tokens:     make(map[string]tokenState),
+	}
+}
+
+// Check returns the violations of records, in order.
+func Check(records []*Record) []*Violation {
+	var violations []*Violation
+
+	checker := NewChecker()
+	for _, record := range records {
+		if v := checker.Check(record); v != nil {
+			violations = append(violations, v)
+		}
+	}
+
+	return violations
+}
+
+// vmCommands are the commands addressing the VM the connection has
+// registered or attached to.
+var vmCommands = map[api.Command]bool{
+	api.CmdHyper:      true,
+	api.CmdHyperBatch: true,
+	api.CmdWriteFile:  true,
+	api.CmdReadFile:   true,
+}
+
+// containerCommands are the commands whose payload names a registered
+// container.
+var containerCommands = map[api.Command]bool{
+	api.CmdUnregisterVM: true,
+	api.CmdAttachVM:     true,
+	api.CmdStats:        true,
+	api.CmdCapture:      true,
+	api.CmdPause:        true,
+	api.CmdResume:       true,
+	api.CmdHotplug:      true,
+	api.CmdCancel:       true,
+	api.CmdRenewTokens:  true,
+}
+
+// Check checks the next record of the trace, returning the violation it
+// causes, if any.
+func (c *Checker) Check(record *Record) *Violation {
+	offset := c.offset
+	c.offset++
+
+	frame := record.Frame
+	if frame == nil {
+		return nil
+	}
+
+	conn := c.conns[record.Conn]
+	if conn == nil {
+		conn = &connState{
+			sessions: make(map[int]bool),
+		}
+		c.conns[record.Conn] = conn
+	}
+
+	var msg string
+	switch {
+	case record.Direction == ToProxy && frame.Header.Type == api.TypeCommand:
+		msg = c.checkCommand(conn, frame)
+		// DisconnectShim on stream 0 closes the connection rather than
+		// being answered.
+		if api.Command(frame.Header.Opcode) != api.CmdDisconnectShim ||
+			frame.Header.StreamID != 0 {
+			conn.pending = append(conn.pending, frame)
+		}
+	case record.Direction == ToProxy && frame.Header.Type == api.TypeStream:
+		if !conn.sessions[frame.Header.StreamID] {
+			msg = fmt.Sprintf("stdin on stream %d before ConnectShim",
+				frame.Header.StreamID)
+		}
+	case record.Direction == FromProxy && frame.Header.Type == api.TypeResponse:
+		if len(conn.pending) == 0 {
+			return nil
+		}
+		cmd := conn.pending[0]
+		conn.pending = conn.pending[1:]
+		if !frame.Header.InError {
+			c.apply(conn, cmd, frame)
+		}
+	}
+
+	if msg == "" {
+		return nil
+	}
+
+	return &Violation{
+		Offset:  offset,
+		Conn:    record.Conn,
+		Message: msg,
+	}
+}
+
+// containerID returns the container named in the payload of a command.
+func containerID(frame *api.Frame) string {
+	payload := struct {
+		ContainerID string `json:"containerId"`
+	}{}
+	json.Unmarshal(frame.Payload, &payload)
+	return payload.ContainerID
+}
+
+func (c *Checker) checkCommand(conn *connState, frame *api.Frame) string {
+	cmd := api.Command(frame.Header.Opcode)
+
+	if vmCommands[cmd] && conn.vm == "" {
+		if conn.unregistered {
+			return fmt.Sprintf("%s after UnregisterVM", cmd)
+		}
+		return fmt.Sprintf("%s before RegisterVM or AttachVM", cmd)
+	}
+	if vmCommands[cmd] && c.containers[conn.vm] == containerUnregistered {
+		return fmt.Sprintf("%s to container %s after UnregisterVM", cmd, conn.vm)
+	}
+
+	if containerCommands[cmd] {
+		id := containerID(frame)
+		if id == "" && cmd == api.CmdStats {
+			return ""
+		}
+		switch c.containers[id] {
+		case containerUnknown:
+			return fmt.Sprintf("%s of container %s before RegisterVM", cmd, id)
+		case containerUnregistered:
+			return fmt.Sprintf("%s of container %s after UnregisterVM", cmd, id)
+		}
+	}
+
+	switch cmd {
+	case api.CmdRegisterVM:
+		id := containerID(frame)
+		if c.containers[id] == containerRegistered {
+			return fmt.Sprintf("container %s registered twice", id)
+		}
+	case api.CmdConnectShim:
+		return c.checkConnectShim(conn, frame)
+	case api.CmdSignal, api.CmdDisconnectShim:
+		if !conn.sessions[frame.Header.StreamID] {
+			return fmt.Sprintf("%s on stream %d before ConnectShim", cmd,
+				frame.Header.StreamID)
+		}
+	}
+
+	return ""
+}
+
+func (c *Checker) checkConnectShim(conn *connState, frame *api.Frame) string {
+	payload := api.ConnectShim{}
+	json.Unmarshal(frame.Payload, &payload)
+
+	if conn.sessions[frame.Header.StreamID] {
+		return fmt.Sprintf("stream %d already associated with an I/O session",
+			frame.Header.StreamID)
+	}
+
+	switch c.tokens[payload.Token] {
+	case tokenUnknown:
+		return fmt.Sprintf("token %s not handed out by RegisterVM or AttachVM",
+			payload.Token)
+	case tokenClaimed:
+		if !payload.ReadOnly {
+			return fmt.Sprintf("token %s claimed twice", payload.Token)
+		}
+	}
+
+	return ""
+}
+
+// apply updates the state with the effects of cmd, answered successfully by
+// resp.
+func (c *Checker) apply(conn *connState, cmd, resp *api.Frame) {
+	switch api.Command(cmd.Header.Opcode) {
+	case api.CmdRegisterVM, api.CmdAttachVM:
+		id := containerID(cmd)
+		c.containers[id] = containerRegistered
+		conn.vm = id
+		conn.unregistered = false
+
+		decoded := struct {
+			IO api.IOResponse `json:"io"`
+		}{}
+		json.Unmarshal(resp.Payload, &decoded)
+		for _, token := range decoded.IO.Tokens {
+			c.tokens[token] = tokenHandedOut
+		}
+	case api.CmdUnregisterVM:
+		c.containers[containerID(cmd)] = containerUnregistered
+		conn.vm = ""
+		conn.unregistered = true
+	case api.CmdConnectShim:
+		payload := api.ConnectShim{}
+		json.Unmarshal(cmd.Payload, &payload)
+		if !payload.ReadOnly {
+			c.tokens[payload.Token] = tokenClaimed
+		}
+		conn.sessions[cmd.Header.StreamID] = true
+	case api.CmdDisconnectShim:
+		delete(conn.sessions, cmd.Header.StreamID)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sniff
+
+import (
+	"testing"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// trace builds the records of a test trace.
+type trace []*Record
+
+func (t *trace) add(conn uint64, dir Direction, frame *api.Frame) *trace {
+	*t = append(*t, &Record{Conn: conn, Direction: dir, Frame: frame})
+	return t
+}
+
+func (t *trace) command(conn uint64, streamID int, cmd api.Command, payload string) *trace {
+	frame := api.NewFrame(api.TypeCommand, int(cmd), []byte(payload))
+	frame.Header.StreamID = streamID
+	return t.add(conn, ToProxy, frame)
+}
+
+func (t *trace) response(conn uint64, streamID int, cmd api.Command, payload string) *trace {
+	frame := api.NewFrame(api.TypeResponse, int(cmd), []byte(payload))
+	frame.Header.StreamID = streamID
+	return t.add(conn, FromProxy, frame)
+}
+
+func (t *trace) error(conn uint64, cmd api.Command) *trace {
+	frame := api.NewFrame(api.TypeResponse, int(cmd), []byte(`{"msg":"error"}`))
+	frame.Header.InError = true
+	return t.add(conn, FromProxy, frame)
+}
+
+func (t *trace) stdin(conn uint64, streamID int) *trace {
+	frame := api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte("foo"))
+	frame.Header.StreamID = streamID
+	return t.add(conn, ToProxy, frame)
+}
+
+const (
+	testRegister = `{"containerId":"foo","ctlSerial":"ctl","ioSerial":"io"}`
+	testAttach   = `{"containerId":"foo","numIOStreams":1}`
+	testTokens   = `{"io":{"url":"unix:///proxy.sock","tokens":["tok"]}}`
+	testFoo      = `{"containerId":"foo"}`
+	testHyper    = `{"hyperName":"ping"}`
+	testClaim    = `{"token":"tok"}`
+)
+
+func TestCheckValid(t *testing.T) {
+	records := &trace{}
+	records.command(1, 0, api.CmdRegisterVM, testRegister).
+		response(1, 0, api.CmdRegisterVM, "").
+		command(2, 0, api.CmdAttachVM, testAttach).
+		response(2, 0, api.CmdAttachVM, testTokens).
+		command(2, 0, api.CmdHyper, testHyper).
+		response(2, 0, api.CmdHyper, "").
+		command(3, 1, api.CmdConnectShim, testClaim).
+		response(3, 1, api.CmdConnectShim, `{"chunkSize":4096}`).
+		stdin(3, 1).
+		command(3, 1, api.CmdSignal, `{"signalNumber":15}`).
+		response(3, 1, api.CmdSignal, "").
+		command(3, 1, api.CmdDisconnectShim, "").
+		response(3, 1, api.CmdDisconnectShim, "").
+		command(1, 0, api.CmdStats, "{}").
+		response(1, 0, api.CmdStats, `{"vms":[]}`).
+		command(1, 0, api.CmdUnregisterVM, testFoo).
+		response(1, 0, api.CmdUnregisterVM, "").
+		// The container can be registered again.
+		command(4, 0, api.CmdRegisterVM, testRegister).
+		response(4, 0, api.CmdRegisterVM, "")
+
+	assert.Equal(t, 0, len(Check(*records)))
+}
+
+func TestCheckViolations(t *testing.T) {
+	register := func() *trace {
+		records := &trace{}
+		return records.command(1, 0, api.CmdRegisterVM, testRegister).
+			response(1, 0, api.CmdRegisterVM, testTokens)
+	}
+
+	tests := []struct {
+		records *trace
+		offset  int
+		message string
+	}{
+		{
+			(&trace{}).command(1, 0, api.CmdAttachVM, testAttach),
+			0, "AttachVM of container foo before RegisterVM",
+		},
+		{
+			// A failed RegisterVM doesn't register the container.
+			(&trace{}).command(1, 0, api.CmdRegisterVM, testRegister).
+				error(1, api.CmdRegisterVM).
+				command(1, 0, api.CmdAttachVM, testAttach),
+			2, "AttachVM of container foo before RegisterVM",
+		},
+		{
+			register().command(2, 0, api.CmdRegisterVM, testRegister),
+			2, "container foo registered twice",
+		},
+		{
+			register().command(2, 0, api.CmdHyper, testHyper),
+			2, "Hyper before RegisterVM or AttachVM",
+		},
+		{
+			register().command(1, 0, api.CmdUnregisterVM, testFoo).
+				response(1, 0, api.CmdUnregisterVM, "").
+				command(1, 0, api.CmdHyper, testHyper),
+			4, "Hyper after UnregisterVM",
+		},
+		{
+			register().command(2, 0, api.CmdAttachVM, testAttach).
+				response(2, 0, api.CmdAttachVM, "").
+				command(1, 0, api.CmdUnregisterVM, testFoo).
+				response(1, 0, api.CmdUnregisterVM, "").
+				command(2, 0, api.CmdHyper, testHyper),
+			6, "Hyper to container foo after UnregisterVM",
+		},
+		{
+			register().command(1, 0, api.CmdUnregisterVM, testFoo).
+				response(1, 0, api.CmdUnregisterVM, "").
+				command(2, 0, api.CmdPause, testFoo),
+			4, "Pause of container foo after UnregisterVM",
+		},
+		{
+			register().command(2, 1, api.CmdConnectShim, `{"token":"bar"}`),
+			2, "token bar not handed out by RegisterVM or AttachVM",
+		},
+		{
+			register().command(2, 1, api.CmdConnectShim, testClaim).
+				response(2, 1, api.CmdConnectShim, "").
+				command(3, 1, api.CmdConnectShim, testClaim),
+			4, "token tok claimed twice",
+		},
+		{
+			register().command(2, 1, api.CmdSignal, `{"signalNumber":15}`),
+			2, "Signal on stream 1 before ConnectShim",
+		},
+		{
+			register().stdin(2, 1),
+			2, "stdin on stream 1 before ConnectShim",
+		},
+	}
+
+	for _, test := range tests {
+		violations := Check(*test.records)
+		if !assert.Equal(t, 1, len(violations), test.message) {
+			continue
+		}
+		assert.Equal(t, test.offset, violations[0].Offset)
+		assert.Equal(t, test.message, violations[0].Message)
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	records := &trace{}
+	records.command(1, 0, api.CmdRegisterVM, testRegister).
+		response(1, 0, api.CmdRegisterVM, testTokens).
+		command(2, 1, api.CmdConnectShim, testClaim).
+		response(2, 1, api.CmdConnectShim, "").
+		// Observers can attach to claimed tokens.
+		command(3, 1, api.CmdConnectShim, `{"token":"tok","readOnly":true}`).
+		response(3, 1, api.CmdConnectShim, "")
+
+	assert.Equal(t, 0, len(Check(*records)))
+}
+
+func TestViolationString(t *testing.T) {
+	v := &Violation{Offset: 3, Conn: 2, Message: "token tok claimed twice"}
+	assert.Equal(t, "frame 3 (conn #2): token tok claimed twice", v.String())
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// jsonRecord is a decoded record, as written by JSONWriter.
+type jsonRecord struct {
+	Time       time.Time `json:"time"`
+	Conn       uint64    `json:"conn"`
+	Direction  string    `json:"direction"`
+	Type       string    `json:"type,omitempty"`
+	Opcode     string    `json:"opcode,omitempty"`
+	StreamID   int       `json:"streamId,omitempty"`
+	InError    bool      `json:"inError,omitempty"`
+	EOF        bool      `json:"eof,omitempty"`
+	Compressed bool      `json:"compressed,omitempty"`
+	// Payload is the JSON payload of the frame, Data the other payloads,
+	// stream data for instance.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// JSONWriter writes records as JSON objects, one per line, with the frames
+// decoded for tools like jq:
+//
+//  {"time":"2017-06-12T10:36:58.123456789Z","conn":1,"direction":"toProxy","type":"command","opcode":"Hyper","payload":{"hyperName":"ping"}}
+//
+// JSON payloads are embedded as is, the other payloads are base64 encoded in
+// data. Write can be called from several goroutines.
+type JSONWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONWriter returns a JSONWriter writing to w.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// Write appends record to the output.
+func (j *JSONWriter) Write(record *Record) error {
+	entry := jsonRecord{
+		Time:      record.Time.UTC(),
+		Conn:      record.Conn,
+		Direction: directionNames[record.Direction],
+	}
+
+	if record.Err != nil {
+		entry.Error = record.Err.Error()
+	} else {
+		header := &record.Frame.Header
+		entry.Type = header.Type.String()
+		entry.Opcode = opcodeString(header)
+		entry.StreamID = header.StreamID
+		entry.InError = header.InError
+		entry.EOF = header.EOF
+		entry.Compressed = header.Compressed
+
+		payload := record.Frame.Payload
+		var v interface{}
+		if header.Type != api.TypeStream && json.Unmarshal(payload, &v) == nil {
+			entry.Payload = payload
+		} else if len(payload) > 0 {
+			entry.Data = payload
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.encoder.Encode(&entry)
+}
+
+// PcapLinkType is the link type of the pcap files written by PcapWriter,
+// LINKTYPE_USER0.
+const PcapLinkType = 147
+
+// Sizes of the pcap headers and of the pseudo-header preceding each frame.
+const (
+	pcapHeaderLength       = 24
+	pcapRecordHeaderLength = 16
+	pcapPseudoHeaderLength = 12
+	pcapSnapLength         = 262144
+)
+
+// Pcap pseudo-header fields.
+const (
+	pcapPseudoHeaderVersion = 1
+	// pcapFlagError is set when the record is an error: the error message
+	// follows the pseudo-header instead of a frame.
+	pcapFlagError = 1
+)
+
+// PcapWriter writes records to a pcap file, with the PcapLinkType link type,
+// for Wireshark and other tools reading pcap files. Each packet is a frame as
+// sent on the socket, preceded by a 12 bytes pseudo-header:
+//
+//  offset  size  field
+//  0       1     version, 1
+//  1       1     direction, 0 for frames sent to the proxy, 1 for frames
+//                sent by the proxy
+//  2       1     flags, bit 0 set when the packet holds an error message
+//                rather than a frame
+//  3       1     reserved, 0
+//  4       8     client connection, big endian
+//
+// Write can be called from several goroutines.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPcapWriter writes the pcap file header to w and returns a PcapWriter
+// appending records to it.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, pcapHeaderLength)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	// thiszone and sigfigs are 0.
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLength)
+	binary.LittleEndian.PutUint32(header[20:24], PcapLinkType)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &PcapWriter{
+		w: w,
+	}, nil
+}
+
+// Write appends record to the pcap file as a packet.
+func (p *PcapWriter) Write(record *Record) error {
+	var buf bytes.Buffer
+
+	buf.Write(make([]byte, pcapRecordHeaderLength))
+
+	pseudo := make([]byte, pcapPseudoHeaderLength)
+	pseudo[0] = pcapPseudoHeaderVersion
+	if record.Direction == FromProxy {
+		pseudo[1] = 1
+	}
+	if record.Err != nil {
+		pseudo[2] |= pcapFlagError
+	}
+	binary.BigEndian.PutUint64(pseudo[4:12], record.Conn)
+	buf.Write(pseudo)
+
+	if record.Err != nil {
+		buf.WriteString(record.Err.Error())
+	} else if err := api.WriteFrame(&buf, record.Frame); err != nil {
+		return err
+	}
+
+	packet := buf.Bytes()
+	length := len(packet) - pcapRecordHeaderLength
+	captured := length
+	if captured > pcapSnapLength {
+		captured = pcapSnapLength
+	}
+
+	t := record.Time
+	binary.LittleEndian.PutUint32(packet[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(packet[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(packet[8:12], uint32(captured))
+	binary.LittleEndian.PutUint32(packet[12:16], uint32(length))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.w.Write(packet[:pcapRecordHeaderLength+captured])
+	return err
+}
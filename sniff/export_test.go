@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONWriter(t *testing.T) {
+	records := append(testRecords(), &Record{
+		Time:      time.Date(2017, 6, 12, 10, 36, 59, 0, time.UTC),
+		Conn:      3,
+		Direction: FromProxy,
+		Err:       errors.New("frame too big"),
+	})
+
+	var buf bytes.Buffer
+	writer := NewJSONWriter(&buf)
+	for _, record := range records {
+		assert.Nil(t, writer.Write(record))
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		`{"time":"2017-06-12T10:36:58Z","conn":3,"direction":"toProxy","type":"command","opcode":"Stats","payload":{}}`,
+		`{"time":"2017-06-12T10:36:58.001Z","conn":3,"direction":"fromProxy","type":"response","opcode":"Stats","payload":{"vms":[]}}`,
+		`{"time":"2017-06-12T10:36:58.02Z","conn":3,"direction":"toProxy","type":"stream","opcode":"stdin","streamId":2,"eof":true,"data":"c3RkaW4K"}`,
+		`{"time":"2017-06-12T10:36:59Z","conn":3,"direction":"fromProxy","error":"frame too big"}`,
+	}, lines)
+
+	// Payloads that aren't JSON are base64 encoded.
+	buf.Reset()
+	err := writer.Write(&Record{
+		Conn:      1,
+		Direction: ToProxy,
+		Frame:     api.NewFrame(api.TypeCommand, int(api.CmdHyper), []byte("{")),
+	})
+	assert.Nil(t, err)
+	decoded := jsonRecord{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Nil(t, decoded.Payload)
+	assert.Equal(t, []byte("{"), decoded.Data)
+}
+
+func TestPcapWriter(t *testing.T) {
+	records := append(testRecords(), &Record{
+		Time:      time.Date(2017, 6, 12, 10, 36, 59, 0, time.UTC),
+		Conn:      3,
+		Direction: FromProxy,
+		Err:       errors.New("frame too big"),
+	})
+
+	var buf bytes.Buffer
+	writer, err := NewPcapWriter(&buf)
+	assert.Nil(t, err)
+	for _, record := range records {
+		assert.Nil(t, writer.Write(record))
+	}
+
+	data := buf.Bytes()
+	assert.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(data[0:4]))
+	assert.Equal(t, uint32(PcapLinkType), binary.LittleEndian.Uint32(data[20:24]))
+	data = data[pcapHeaderLength:]
+
+	for _, record := range records {
+		sec := binary.LittleEndian.Uint32(data[0:4])
+		usec := binary.LittleEndian.Uint32(data[4:8])
+		captured := binary.LittleEndian.Uint32(data[8:12])
+		length := binary.LittleEndian.Uint32(data[12:16])
+		assert.Equal(t, record.Time.Unix(), int64(sec))
+		assert.Equal(t, record.Time.Nanosecond()/1000, int(usec))
+		assert.Equal(t, length, captured)
+
+		packet := data[pcapRecordHeaderLength : pcapRecordHeaderLength+captured]
+		data = data[pcapRecordHeaderLength+captured:]
+
+		assert.Equal(t, byte(pcapPseudoHeaderVersion), packet[0])
+		assert.Equal(t, record.Direction == FromProxy, packet[1] == 1)
+		assert.Equal(t, record.Conn, binary.BigEndian.Uint64(packet[4:12]))
+		flags := packet[2]
+		packet = packet[pcapPseudoHeaderLength:]
+
+		assert.Equal(t, record.Err != nil, flags&pcapFlagError != 0)
+		if record.Err != nil {
+			assert.Equal(t, record.Err.Error(), string(packet))
+			continue
+		}
+
+		frame, err := api.ReadFrame(bytes.NewReader(packet))
+		assert.Nil(t, err)
+		assert.Equal(t, record.Frame, frame)
+	}
+	assert.Equal(t, 0, len(data))
+}
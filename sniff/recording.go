@@ -0,0 +1,249 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// recordEntry is an entry of a recording. Recordings are a sequence of JSON
+// objects, one per line:
+//
+//  {"time":"2017-06-12T10:36:58.123456789Z","conn":1,"direction":"toProxy","frame":"AAEDAAEAAAAAAAAR..."}
+//
+// frame is the frame as sent on the socket, base64 encoded.
+type recordEntry struct {
+	Time      time.Time `json:"time"`
+	Conn      uint64    `json:"conn"`
+	Direction string    `json:"direction"`
+	Frame     []byte    `json:"frame,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var directionNames = map[Direction]string{
+	ToProxy:   "toProxy",
+	FromProxy: "fromProxy",
+}
+
+func parseDirection(name string) (Direction, error) {
+	for d, n := range directionNames {
+		if n == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown direction %q", name)
+}
+
+// Recorder writes records to a recording, to be replayed later with a
+// Replayer. Record can be called from several goroutines.
+type Recorder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// Record appends record to the recording.
+func (r *Recorder) Record(record *Record) error {
+	entry := recordEntry{
+		Time:      record.Time.UTC(),
+		Conn:      record.Conn,
+		Direction: directionNames[record.Direction],
+	}
+
+	if record.Err != nil {
+		entry.Error = record.Err.Error()
+	} else {
+		var buf bytes.Buffer
+		if err := api.WriteFrame(&buf, record.Frame); err != nil {
+			return err
+		}
+		entry.Frame = buf.Bytes()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.encoder.Encode(&entry)
+}
+
+// ReadRecording decodes the records of a recording written by a Recorder.
+func ReadRecording(r io.Reader) ([]*Record, error) {
+	var records []*Record
+
+	scanner := bufio.NewScanner(r)
+	// Lines hold whole frames.
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := recordEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		dir, err := parseDirection(entry.Direction)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		record := &Record{
+			Time:      entry.Time,
+			Conn:      entry.Conn,
+			Direction: dir,
+		}
+		if entry.Error != "" {
+			record.Err = errors.New(entry.Error)
+		} else {
+			record.Frame, err = api.ReadFrame(bytes.NewReader(entry.Frame))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Replayer plays one side of a recorded session: it sends the frames the
+// recording has in Direction, with the same delays between them, and reports
+// the frames the other side sends back.
+type Replayer struct {
+	// Direction selects the recorded frames to send: ToProxy replays the
+	// client side of the session, to a proxy, FromProxy the proxy side,
+	// to a client.
+	Direction Direction
+	// Speed divides the recorded delays between frames. 0 sends the
+	// frames as fast as possible.
+	Speed float64
+	// Linger is how long to wait for frames from the other side once all
+	// the frames have been sent.
+	Linger time.Duration
+	// Handler, if not nil, is called with the frames sent and received.
+	Handler Handler
+
+	mu sync.Mutex
+}
+
+// Replay replays records on conn, returning once the frames have been sent
+// and Linger has elapsed, or conn has been closed by the other side.
+func (r *Replayer) Replay(conn net.Conn, records []*Record) error {
+	var id uint64
+	if len(records) > 0 {
+		id = records[0].Conn
+	}
+
+	received := make(chan struct{})
+	go func() {
+		r.receive(conn, id)
+		close(received)
+	}()
+
+	err := r.send(conn, records, received)
+	if err == nil {
+		select {
+		case <-received:
+		case <-time.After(r.Linger):
+		}
+	}
+
+	conn.Close()
+	<-received
+
+	return err
+}
+
+func (r *Replayer) send(conn net.Conn, records []*Record, received <-chan struct{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	recordStart := records[0].Time
+
+	for _, record := range records {
+		if record.Direction != r.Direction || record.Frame == nil {
+			continue
+		}
+
+		if r.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(recordStart)) / r.Speed)
+			if delay := start.Add(offset).Sub(time.Now()); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-received:
+					return io.ErrClosedPipe
+				}
+			}
+		}
+
+		if err := api.WriteFrame(conn, record.Frame); err != nil {
+			return err
+		}
+
+		r.handle(&Record{
+			Time:      time.Now(),
+			Conn:      record.Conn,
+			Direction: r.Direction,
+			Frame:     record.Frame,
+		})
+	}
+
+	return nil
+}
+
+func (r *Replayer) receive(conn net.Conn, id uint64) {
+	dir := FromProxy
+	if r.Direction == FromProxy {
+		dir = ToProxy
+	}
+
+	for {
+		frame, err := api.ReadFrame(fullReader{conn})
+		if err != nil {
+			return
+		}
+		r.handle(&Record{Time: time.Now(), Conn: id, Direction: dir, Frame: frame})
+	}
+}
+
+func (r *Replayer) handle(record *Record) {
+	if r.Handler == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Handler(record)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecords() []*Record {
+	start := time.Date(2017, 6, 12, 10, 36, 58, 0, time.UTC)
+	command := api.NewFrame(api.TypeCommand, int(api.CmdStats), []byte(`{}`))
+	response := api.NewFrame(api.TypeResponse, int(api.CmdStats), []byte(`{"vms":[]}`))
+	stdin := api.NewFrame(api.TypeStream, int(api.StreamStdin), []byte("stdin\n"))
+	stdin.Header.StreamID = 2
+	stdin.Header.EOF = true
+
+	return []*Record{
+		{Time: start, Conn: 3, Direction: ToProxy, Frame: command},
+		{Time: start.Add(time.Millisecond), Conn: 3, Direction: FromProxy, Frame: response},
+		{Time: start.Add(20 * time.Millisecond), Conn: 3, Direction: ToProxy, Frame: stdin},
+	}
+}
+
+func TestRecording(t *testing.T) {
+	records := append(testRecords(), &Record{
+		Time:      time.Date(2017, 6, 12, 10, 36, 59, 0, time.UTC),
+		Conn:      3,
+		Direction: FromProxy,
+		Err:       errors.New("frame too big"),
+	})
+
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	for _, record := range records {
+		err := recorder.Record(record)
+		assert.Nil(t, err)
+	}
+
+	decoded, err := ReadRecording(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, records, decoded)
+
+	// Garbage is rejected.
+	_, err = ReadRecording(bytes.NewBufferString(`{"direction":"sideways"}` + "\n"))
+	assert.NotNil(t, err)
+	_, err = ReadRecording(bytes.NewBufferString("foo\n"))
+	assert.NotNil(t, err)
+}
+
+func TestReplayer(t *testing.T) {
+	records := testRecords()
+	proxy, client := net.Pipe()
+
+	// A proxy answering the command with the recorded response.
+	received := make(chan *api.Frame, 2)
+	go func() {
+		frame, err := api.ReadFrame(proxy)
+		if err != nil {
+			return
+		}
+		received <- frame
+		api.WriteFrame(proxy, records[1].Frame)
+
+		frame, err = api.ReadFrame(proxy)
+		if err != nil {
+			return
+		}
+		received <- frame
+		proxy.Close()
+	}()
+
+	var replayed []*Record
+	replayer := &Replayer{
+		Direction: ToProxy,
+		Speed:     1,
+		Linger:    time.Second,
+		Handler: func(record *Record) {
+			replayed = append(replayed, record)
+		},
+	}
+	start := time.Now()
+	err := replayer.Replay(client, records)
+	assert.Nil(t, err)
+
+	// The recorded delay between the frames has been kept.
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// The client side of the session has been replayed, with the frames
+	// received from the proxy reported.
+	assert.Equal(t, records[0].Frame, <-received)
+	assert.Equal(t, records[2].Frame, <-received)
+
+	assert.Equal(t, 3, len(replayed))
+	for i, record := range replayed {
+		assert.Equal(t, records[i].Direction, record.Direction)
+		assert.Equal(t, uint64(3), record.Conn)
+		assert.Equal(t, records[i].Frame, record.Frame)
+	}
+}
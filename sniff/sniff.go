@@ -0,0 +1,242 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package sniff decodes the frames exchanged between cc-proxy and its
+// clients. A Sniffer sits between the clients and the proxy socket as a
+// transparent man-in-the-middle, to debug protocol issues in the field.
+// AgentRelay does the same for the hyperstart messages exchanged between the
+// proxy and the agent of a VM.
+package sniff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// Direction tells which side of the connection has sent a frame.
+type Direction int
+
+const (
+	// ToProxy is a frame sent by the client to the proxy.
+	ToProxy Direction = iota
+	// FromProxy is a frame sent by the proxy to the client.
+	FromProxy
+)
+
+// String implements Stringer for Direction.
+func (d Direction) String() string {
+	if d == ToProxy {
+		return "->"
+	}
+	return "<-"
+}
+
+// Record is a frame seen by the sniffer. Err is set, and Frame nil, when the
+// data sent couldn't be decoded. The sniffer then stops decoding that side of
+// the connection but keeps relaying it.
+type Record struct {
+	Time time.Time
+	// Conn identifies the client connection, numbered from 1.
+	Conn      uint64
+	Direction Direction
+	Frame     *api.Frame
+	Err       error
+}
+
+// Handler is called with each frame seen by the sniffer. Calls are
+// serialized.
+type Handler func(record *Record)
+
+// Sniffer relays the connections it accepts to Target, decoding the frames
+// going through.
+type Sniffer struct {
+	// Target is the path of the proxy socket.
+	Target  string
+	Handler Handler
+
+	mu       sync.Mutex
+	lastConn uint64
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Sniffer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Sniffer) serveConn(client net.Conn) {
+	defer client.Close()
+
+	proxy, err := net.Dial("unix", s.Target)
+	if err != nil {
+		s.handle(&Record{Time: time.Now(), Err: err})
+		return
+	}
+	defer proxy.Close()
+
+	s.mu.Lock()
+	s.lastConn++
+	id := s.lastConn
+	s.mu.Unlock()
+
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn, dir Direction) {
+		s.relay(dst, src, id, dir)
+		// Forward the EOF, the peer then closes the other direction.
+		if conn, ok := dst.(*net.UnixConn); ok {
+			conn.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+
+	go relay(proxy, client, ToProxy)
+	go relay(client, proxy, FromProxy)
+	<-done
+	<-done
+}
+
+// fullReader makes every Read fill the whole buffer: api.ReadFrame expects
+// to read a frame header at once.
+type fullReader struct {
+	r io.Reader
+}
+
+func (f fullReader) Read(p []byte) (int, error) {
+	return io.ReadFull(f.r, p)
+}
+
+// relay copies src to dst until src is closed, decoding the frames as they
+// are forwarded. The data is forwarded as is, decoding it doesn't alter it.
+func (s *Sniffer) relay(dst, src net.Conn, id uint64, dir Direction) {
+	tee := fullReader{io.TeeReader(src, dst)}
+
+	for {
+		frame, err := api.ReadFrame(tee)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			s.handle(&Record{Time: time.Now(), Conn: id, Direction: dir, Err: err})
+			break
+		}
+
+		s.handle(&Record{Time: time.Now(), Conn: id, Direction: dir, Frame: frame})
+	}
+
+	io.Copy(dst, src)
+}
+
+func (s *Sniffer) handle(record *Record) {
+	if s.Handler == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Handler(record)
+}
+
+// maxStreamData is the number of bytes of stream data Format prints.
+const maxStreamData = 64
+
+// opcodeString returns the name of the opcode of frame.
+func opcodeString(header *api.FrameHeader) string {
+	switch header.Type {
+	case api.TypeCommand, api.TypeResponse:
+		return api.Command(header.Opcode).String()
+	case api.TypeStream:
+		return api.Stream(header.Opcode).String()
+	case api.TypeNotification:
+		return api.Notification(header.Opcode).String()
+	default:
+		return strconv.Itoa(header.Opcode)
+	}
+}
+
+// formatPayload returns a printable version of the payload of frame: JSON
+// payloads are indented, stream data is quoted and truncated.
+func formatPayload(frame *api.Frame) string {
+	payload := frame.Payload
+	if len(payload) == 0 {
+		return ""
+	}
+
+	if frame.Header.Type == api.TypeStream {
+		if frame.Header.Compressed {
+			return fmt.Sprintf("<%d compressed bytes>", len(payload))
+		}
+		if len(payload) > maxStreamData {
+			return fmt.Sprintf("%q... (%d bytes)", payload[:maxStreamData], len(payload))
+		}
+		return strconv.Quote(string(payload))
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, payload, "", "  "); err != nil {
+		return fmt.Sprintf("%v", payload)
+	}
+	return buf.String()
+}
+
+// Format writes a human readable version of record to w:
+//
+//  10:36:58.123456 #1 -> command Hyper
+//  {
+//    "hyperName": "ping"
+//  }
+func Format(w io.Writer, record *Record) {
+	prefix := fmt.Sprintf("%s #%d %s", record.Time.Format("15:04:05.000000"),
+		record.Conn, record.Direction)
+
+	if record.Err != nil {
+		fmt.Fprintf(w, "%s error: %v\n", prefix, record.Err)
+		return
+	}
+
+	header := &record.Frame.Header
+	line := fmt.Sprintf("%s %s %s", prefix, header.Type, opcodeString(header))
+	if header.StreamID != 0 {
+		line += fmt.Sprintf(" stream=%d", header.StreamID)
+	}
+	if header.InError {
+		line += " error"
+	}
+	if header.EOF {
+		line += " eof"
+	}
+
+	payload := formatPayload(record.Frame)
+	switch {
+	case payload == "":
+		fmt.Fprintln(w, line)
+	case header.Type == api.TypeStream:
+		fmt.Fprintf(w, "%s %s\n", line, payload)
+	default:
+		fmt.Fprintf(w, "%s\n%s\n", line, payload)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sniff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-sniff")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// A fake proxy answering the first command it receives.
+	target, err := net.Listen("unix", filepath.Join(dir, "proxy.sock"))
+	assert.Nil(t, err)
+	defer target.Close()
+	received := make(chan *api.Frame, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		frame, err := api.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		received <- frame
+		api.WriteResponse(conn, api.CmdStats, false, []byte(`{"vms":[]}`))
+	}()
+
+	records := make(chan *Record, 2)
+	sniffer := &Sniffer{
+		Target: filepath.Join(dir, "proxy.sock"),
+		Handler: func(record *Record) {
+			records <- record
+		},
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "sniff.sock"))
+	assert.Nil(t, err)
+	defer l.Close()
+	go sniffer.Serve(l)
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "sniff.sock"))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// The frames are forwarded untouched.
+	err = api.WriteCommand(conn, api.CmdStats, []byte(`{"containerId":"foo"}`))
+	assert.Nil(t, err)
+	frame := <-received
+	assert.Equal(t, api.TypeCommand, frame.Header.Type)
+	assert.Equal(t, `{"containerId":"foo"}`, string(frame.Payload))
+
+	resp, err := api.ReadFrame(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, api.TypeResponse, resp.Header.Type)
+	assert.Equal(t, `{"vms":[]}`, string(resp.Payload))
+
+	for _, dir := range []Direction{ToProxy, FromProxy} {
+		record := <-records
+		assert.Nil(t, record.Err)
+		assert.Equal(t, uint64(1), record.Conn)
+		assert.Equal(t, dir, record.Direction)
+		assert.Equal(t, api.CmdStats, api.Command(record.Frame.Header.Opcode))
+	}
+}
+
+func TestFormat(t *testing.T) {
+	now := time.Date(2017, 6, 12, 10, 36, 58, 123456000, time.UTC)
+	tests := []struct {
+		record   *Record
+		expected string
+	}{
+		{
+			&Record{
+				Time:      now,
+				Conn:      1,
+				Direction: ToProxy,
+				Frame:     api.NewFrame(api.TypeCommand, int(api.CmdHyper), []byte(`{"hyperName":"ping"}`)),
+			},
+			"10:36:58.123456 #1 -> command Hyper\n{\n  \"hyperName\": \"ping\"\n}\n",
+		},
+		{
+			&Record{
+				Time:      now,
+				Conn:      2,
+				Direction: FromProxy,
+				Frame:     api.NewFrame(api.TypeStream, int(api.StreamStdout), []byte("hello\n")),
+			},
+			"10:36:58.123456 #2 <- stream stdout \"hello\\n\"\n",
+		},
+		{
+			&Record{
+				Time:      now,
+				Conn:      2,
+				Direction: FromProxy,
+				Frame:     api.NewFrame(api.TypeNotification, int(api.NotificationProcessExited), []byte{3}),
+			},
+			"10:36:58.123456 #2 <- notification ProcessExited\n[3]\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		Format(&buf, test.record)
+		assert.Equal(t, test.expected, buf.String())
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/clearcontainers/proxy/api/hyperstart/agentmock"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+)
+
+// The soak test runs for -soak, eg. go test -run TestSoak -soak 4h
+// -timeout 5h.
+var (
+	soakDuration = flag.Duration("soak", 0,
+		"duration of TestSoak, which is skipped when 0")
+	soakInterval = flag.Duration("soak-interval", time.Minute,
+		"interval between the samples TestSoak reports")
+	soakHeapGrowth = flag.Uint64("soak-heap-growth", 16<<20,
+		"heap growth, in bytes, above which TestSoak fails")
+)
+
+// soakWarmup is the number of cycles run before taking the baseline sample,
+// for the pools and caches of the proxy to fill up.
+const soakWarmup = 100
+
+// soakSample is the resource usage of the proxy between two cycles.
+type soakSample struct {
+	elapsed    time.Duration
+	cycles     int
+	fds        int
+	goroutines int
+	tokens     int
+	vms        int
+	heap       uint64
+}
+
+func (s *soakSample) String() string {
+	return fmt.Sprintf("%s, %d cycles: %d fds, %d goroutines, %d tokens, "+
+		"%d VMs, %d KiB heap", s.elapsed, s.cycles, s.fds, s.goroutines,
+		s.tokens, s.vms, s.heap>>10)
+}
+
+func (rig *testRig) soakSample() (*soakSample, error) {
+	snap, err := rig.detector.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	rig.proxy.Lock()
+	tokens, vms := len(rig.proxy.tokenToVM), len(rig.proxy.vms)
+	rig.proxy.Unlock()
+
+	return &soakSample{
+		fds:        len(snap.Fds),
+		goroutines: runtime.NumGoroutine(),
+		tokens:     tokens,
+		vms:        vms,
+		heap:       mem.HeapAlloc,
+	}, nil
+}
+
+// soakCycle goes through the lifecycle of a session: a VM is registered, a
+// shim claims the I/O session of its process, the process is started,
+// exchanges data and exits and the VM is unregistered. All the connections
+// to the proxy are closed and their goroutines done when it returns.
+func (rig *testRig) soakCycle() error {
+	defer func() {
+		for _, conn := range rig.proxyConns {
+			conn.Close()
+		}
+		rig.proxyConns = nil
+		rig.wg.Wait()
+		rig.proxy.wg.Wait()
+	}()
+
+	agent, err := agentmock.New()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	client := goapi.NewClient(rig.ServeNewClient().(*net.UnixConn))
+	defer client.Close()
+
+	ret, err := client.RegisterVM(testContainerID, agent.CtlSocketPath(),
+		agent.IoSocketPath(), &goapi.RegisterVMOptions{NumIOStreams: 1})
+	if err != nil {
+		return err
+	}
+	token := ret.IO.Tokens[0]
+
+	shim := newShimRig(rig.t, rig.ServeNewClient(), token)
+	if err := shim.connect(); err != nil {
+		return err
+	}
+	defer shim.conn.Close()
+
+	err = client.HyperWithTokens("execcmd", []string{token},
+		&hyperstart.ExecCommand{
+			Container: testContainerID,
+			Process: hyperstart.Process{
+				Args: []string{"/bin/sh"},
+			},
+		})
+	if err != nil {
+		return err
+	}
+	process, err := agent.WaitProcess(5 * time.Second)
+	if err != nil {
+		return err
+	}
+
+	if err := api.WriteStream(shim.conn, api.StreamStdin, []byte("stdin\n")); err != nil {
+		return err
+	}
+	buf := make([]byte, 32)
+	n, err := process.ReadStdin(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != "stdin\n" {
+		return fmt.Errorf("unexpected stdin %q", buf[:n])
+	}
+
+	if err := process.SendStdout([]byte("stdout\n")); err != nil {
+		return err
+	}
+	frame, err := api.ReadFrame(shim.conn)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(frame.Payload, []byte("stdout\n")) {
+		return fmt.Errorf("unexpected stdout %q", frame.Payload)
+	}
+
+	if err := process.Exit(0); err != nil {
+		return err
+	}
+	frame, err = api.ReadFrame(shim.conn)
+	if err != nil {
+		return err
+	}
+	if frame.Header.Type != api.TypeNotification ||
+		frame.Header.Opcode != int(api.NotificationProcessExited) {
+		return errors.New("no exit status")
+	}
+
+	if err := shim.client.DisconnectShim(); err != nil {
+		return err
+	}
+
+	// Stopping the agent first lets the proxy tear down the VM without
+	// waiting for the ctl channel to time out.
+	agent.Close()
+	return client.UnregisterVM(testContainerID)
+}
+
+// TestSoak creates and destroys sessions for -soak, reporting the resources
+// used by the proxy every -soak-interval. It fails if the number of fds,
+// goroutines, tokens or VMs has grown by the end, or the heap has grown by
+// more than -soak-heap-growth, to catch the slow leaks the other tests are
+// too short to notice.
+func TestSoak(t *testing.T) {
+	if *soakDuration == 0 {
+		t.Skip("-soak not given")
+	}
+
+	// The VMs are agentmock ones, the rig isn't started: its fake
+	// hyperstart would wait for a connection.
+	initLogging()
+	rig := newTestRig(t)
+
+	cycles := 0
+	run := func(n int) bool {
+		for i := 0; i < n; i++ {
+			if err := rig.soakCycle(); err != nil {
+				t.Errorf("cycle %d: %v", cycles, err)
+				return false
+			}
+			cycles++
+		}
+		return true
+	}
+
+	if !run(soakWarmup) {
+		return
+	}
+
+	baseline, err := rig.soakSample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline.cycles = cycles
+	t.Logf("baseline: %s", baseline)
+
+	start := time.Now()
+	last := start
+	sample := baseline
+	for time.Since(start) < *soakDuration {
+		if !run(1) {
+			break
+		}
+
+		if time.Since(last) < *soakInterval {
+			continue
+		}
+		last = time.Now()
+
+		if sample, err = rig.soakSample(); err != nil {
+			t.Fatal(err)
+		}
+		sample.elapsed = time.Since(start)
+		sample.cycles = cycles
+		t.Logf("%s", sample)
+	}
+
+	if sample, err = rig.soakSample(); err != nil {
+		t.Fatal(err)
+	}
+	sample.elapsed = time.Since(start)
+	sample.cycles = cycles
+	t.Logf("end: %s", sample)
+
+	growth := func(what string, before, after int) {
+		if after > before {
+			t.Errorf("%s grew from %d to %d over %d cycles", what,
+				before, after, cycles-soakWarmup)
+		}
+	}
+	growth("fds", baseline.fds, sample.fds)
+	growth("goroutines", baseline.goroutines, sample.goroutines)
+	growth("tokens", baseline.tokens, sample.tokens)
+	growth("VMs", baseline.vms, sample.vms)
+	if sample.heap > baseline.heap+*soakHeapGrowth {
+		t.Errorf("heap grew from %d KiB to %d KiB over %d cycles",
+			baseline.heap>>10, sample.heap>>10, cycles-soakWarmup)
+	}
+}
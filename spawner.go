@@ -0,0 +1,487 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+
+	"github.com/golang/glog"
+)
+
+// childStartTimeout is how long we wait for a child proxy to listen on its
+// socket.
+var childStartTimeout = 10 * time.Second
+
+// childProcess is a proxy serving a single VM.
+type childProcess interface {
+	// Kill forcefully terminates the child.
+	Kill() error
+	// Wait blocks until the child has exited.
+	Wait() error
+}
+
+// startChildFunc starts a child proxy serving the VM containerID on
+// socketPath.
+type startChildFunc func(containerID, socketPath string) (childProcess, error)
+
+type child struct {
+	containerID string
+	socketPath  string
+	process     childProcess
+	// exited is closed when the child process has exited.
+	exited chan interface{}
+}
+
+// spawner is the registry/forwarder of the proxy-per-VM mode: each
+// registered VM is handled by a dedicated child proxy process with its own
+// socket and state. A crash or a corruption in one of those children only
+// affects one VM.
+//
+// The spawner routes each new connection to the right child by looking at
+// the first command sent on that connection (RegisterVM or AttachVM, maybe
+// UnregisterVM, Stats, Capture, Pause or Resume) and then forwards the rest
+// of the connection. Shims connect directly to the child proxy, using the URL
+// returned in the io response of RegisterVM and AttachVM.
+type spawner struct {
+	sync.Mutex
+
+	listener   net.Listener
+	socketPath string
+
+	// childDir is where the children sockets are created.
+	childDir string
+
+	// children are indexed by containerID.
+	children map[string]*child
+
+	startChild startChildFunc
+
+	wg sync.WaitGroup
+}
+
+func newSpawner(socketPath string) *spawner {
+	s := &spawner{
+		socketPath: socketPath,
+		childDir:   socketPath + ".d",
+		children:   make(map[string]*child),
+	}
+	s.startChild = s.execChild
+
+	return s
+}
+
+func (s *spawner) init() error {
+	if err := os.MkdirAll(s.childDir, 0750); err != nil {
+		return fmt.Errorf("couldn't create children socket directory: %v", err)
+	}
+
+	l, err := listenSocket(s.socketPath)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+
+	return nil
+}
+
+// execChild is the default startChildFunc, re-executing the proxy binary.
+// Children inherit the command line options of the spawner, minus the ones
+// that only make sense for the spawner.
+func (s *spawner) execChild(containerID, socketPath string) (childProcess, error) {
+	skip := map[string]bool{
+		"spawner":     true,
+		"socket-path": true,
+		"single-vm":   true,
+		"log-file":    true,
+		"pprof":       true,
+	}
+
+	args := []string{"-socket-path", socketPath, "-single-vm"}
+	flag.Visit(func(f *flag.Flag) {
+		if skip[f.Name] {
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Don't leave children behind if the spawner dies.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &execChild{cmd}, nil
+}
+
+type execChild struct {
+	cmd *exec.Cmd
+}
+
+func (c *execChild) Kill() error {
+	return c.cmd.Process.Kill()
+}
+
+func (c *execChild) Wait() error {
+	return c.cmd.Wait()
+}
+
+func (s *spawner) childSocketPath(containerID string) string {
+	return filepath.Join(s.childDir, containerID+".sock")
+}
+
+func (s *spawner) lookupChild(containerID string) (*child, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	c := s.children[containerID]
+	if c == nil {
+		return nil, fmt.Errorf("unknown containerID: %s", containerID)
+	}
+
+	return c, nil
+}
+
+// spawnChild starts the child proxy for a new VM and waits for it to be
+// ready to accept connections.
+func (s *spawner) spawnChild(containerID string) (*child, error) {
+	if err := checkContainerID(containerID); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	if s.children[containerID] != nil {
+		s.Unlock()
+		return nil, fmt.Errorf("%s: container already registered", containerID)
+	}
+
+	c := &child{
+		containerID: containerID,
+		socketPath:  s.childSocketPath(containerID),
+		exited:      make(chan interface{}),
+	}
+	s.children[containerID] = c
+	s.Unlock()
+
+	process, err := s.startChild(containerID, c.socketPath)
+	if err != nil {
+		s.removeChild(c)
+		return nil, fmt.Errorf("couldn't start child proxy: %v", err)
+	}
+	c.process = process
+
+	glog.V(1).Infof("[spawner] started child proxy for %s", containerID)
+
+	s.wg.Add(1)
+	go s.monitorChild(c)
+
+	if err := c.waitForSocket(childStartTimeout); err != nil {
+		c.process.Kill()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (s *spawner) monitorChild(c *child) {
+	err := c.process.Wait()
+	glog.V(1).Infof("[spawner] child proxy for %s exited (%v)", c.containerID, err)
+
+	s.removeChild(c)
+	os.Remove(c.socketPath)
+	close(c.exited)
+
+	s.wg.Done()
+}
+
+// removeChild removes c from the registry, if it's still there.
+func (s *spawner) removeChild(c *child) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.children[c.containerID] == c {
+		delete(s.children, c.containerID)
+	}
+}
+
+func (c *child) waitForSocket(timeout time.Duration) error {
+	deadline := time.After(timeout)
+
+	for {
+		conn, err := net.Dial("unix", c.socketPath)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-c.exited:
+			return fmt.Errorf("child proxy for %s exited", c.containerID)
+		case <-deadline:
+			return fmt.Errorf("timeout waiting for child proxy for %s", c.containerID)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// route returns the child that should handle a connection whose first frame
+// is cmd, starting it if cmd is a RegisterVM.
+func (s *spawner) route(cmd *api.Frame) (*child, error) {
+	var payload struct {
+		ContainerID string `json:"containerId"`
+	}
+
+	opcode := api.Command(cmd.Header.Opcode)
+
+	switch opcode {
+	case api.CmdRegisterVM, api.CmdAttachVM, api.CmdUnregisterVM, api.CmdStats,
+		api.CmdCapture, api.CmdPause, api.CmdResume, api.CmdHotplug,
+		api.CmdCancel, api.CmdRenewTokens:
+		if err := json.Unmarshal(cmd.Payload, &payload); err != nil {
+			return nil, err
+		}
+	case api.CmdConnectShim:
+		return nil, fmt.Errorf("shims should connect to the URL given in the io response")
+	default:
+		return nil, fmt.Errorf("%s isn't allowed as first command", opcode)
+	}
+
+	if opcode == api.CmdRegisterVM {
+		return s.spawnChild(payload.ContainerID)
+	}
+
+	return s.lookupChild(payload.ContainerID)
+}
+
+// forwardFirstCommand sends cmd to the child and forwards the frames the
+// child sends back to the client until we get the response to cmd.
+func forwardFirstCommand(conn, childConn net.Conn, cmd *api.Frame) (*api.Frame, error) {
+	if err := api.WriteFrame(childConn, cmd); err != nil {
+		return nil, err
+	}
+
+	for {
+		frame, err := api.ReadFrame(childConn)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := api.WriteFrame(conn, frame); err != nil {
+			return nil, err
+		}
+
+		if frame.Header.Type == api.TypeResponse {
+			return frame, nil
+		}
+	}
+}
+
+func (s *spawner) serveNewClient(conn net.Conn) {
+	defer conn.Close()
+
+	cmd, err := api.ReadFrame(conn)
+	if err != nil {
+		return
+	}
+
+	if cmd.Header.Type != api.TypeCommand {
+		glog.Errorf("[spawner] expected a command, got %s", cmd.Header.Type)
+		return
+	}
+
+	c, err := s.route(cmd)
+	if err != nil {
+		api.WriteFrame(conn, newErrorResponse(cmd.Header.Opcode, errorCode(err), err.Error()))
+		return
+	}
+
+	childConn, err := net.Dial("unix", c.socketPath)
+	if err != nil {
+		api.WriteFrame(conn, newErrorResponse(cmd.Header.Opcode, api.ErrorCodeUnknown,
+			fmt.Sprintf("couldn't connect to child proxy: %v", err)))
+		return
+	}
+	defer childConn.Close()
+
+	resp, err := forwardFirstCommand(conn, childConn, cmd)
+	if err != nil {
+		return
+	}
+
+	// A child without VM has nothing to do.
+	if api.Command(cmd.Header.Opcode) == api.CmdRegisterVM && resp.Header.InError {
+		c.process.Kill()
+		return
+	}
+	s.onResponse(c, cmd, resp)
+
+	// From now on, the child proxy does all the work. We still look at the
+	// commands and their responses to keep the registry up to date.
+	f := &forwarder{
+		spawner:   s,
+		child:     c,
+		commands:  make(chan *api.Frame, 16),
+		conn:      conn,
+		childConn: childConn,
+	}
+	f.run()
+}
+
+// onResponse updates the registry after cmd has been answered by the child c.
+func (s *spawner) onResponse(c *child, cmd, resp *api.Frame) {
+	if api.Command(cmd.Header.Opcode) != api.CmdUnregisterVM || resp.Header.InError {
+		return
+	}
+
+	// The child stays around until the VM is effectively gone, but the VM
+	// isn't visible to clients anymore.
+	s.removeChild(c)
+}
+
+// forwarder relays frames between a client and a child proxy.
+type forwarder struct {
+	spawner *spawner
+	child   *child
+
+	// commands are the commands sent to the child that haven't been
+	// answered yet. Responses come back in order.
+	commands chan *api.Frame
+
+	conn, childConn net.Conn
+}
+
+func (f *forwarder) run() {
+	done := make(chan interface{})
+	go func() {
+		f.toChild()
+		f.childConn.(*net.UnixConn).CloseWrite()
+		close(done)
+	}()
+	f.toClient()
+	f.conn.Close()
+	<-done
+}
+
+func (f *forwarder) toChild() {
+	defer close(f.commands)
+
+	for {
+		frame, err := api.ReadFrame(f.conn)
+		if err != nil {
+			return
+		}
+
+		if frame.Header.Type == api.TypeCommand {
+			f.commands <- frame
+		}
+
+		if err := api.WriteFrame(f.childConn, frame); err != nil {
+			return
+		}
+	}
+}
+
+func (f *forwarder) toClient() {
+	for {
+		frame, err := api.ReadFrame(f.childConn)
+		if err != nil {
+			return
+		}
+
+		if frame.Header.Type == api.TypeResponse {
+			if cmd, ok := <-f.commands; ok {
+				f.spawner.onResponse(f.child, cmd, frame)
+			}
+		}
+
+		if err := api.WriteFrame(f.conn, frame); err != nil {
+			return
+		}
+	}
+}
+
+func (s *spawner) serve() {
+	glog.V(1).Info("spawner started")
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't accept connection:", err)
+			continue
+		}
+
+		go s.serveNewClient(conn)
+	}
+}
+
+// checkSpawnerOptions returns an error if an option the spawner doesn't
+// support has been given along with -spawner.
+func checkSpawnerOptions() error {
+	// Children would all try to listen on the same address.
+	if tlsListenAddr != "" {
+		return errors.New("-tls-listen isn't supported by the spawner")
+	}
+
+	// Clients reach the children through the spawner: children only see
+	// the credentials of the spawner and the spawner doesn't enforce any
+	// limit or policy itself.
+	if maxConnsPerUID > 0 {
+		return errors.New("-max-conns-per-uid isn't supported by the spawner")
+	}
+	if len(hyperPolicy) > 0 {
+		return errors.New("hyperPolicy isn't supported by the spawner")
+	}
+	if len(selinuxPolicy) > 0 {
+		return errors.New("selinuxPolicy isn't supported by the spawner")
+	}
+	if authPolicyFile != "" {
+		return errors.New("-auth-policy isn't supported by the spawner")
+	}
+
+	return nil
+}
+
+func spawnerMain() {
+	if err := checkSpawnerOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, "init:", err.Error())
+		os.Exit(1)
+	}
+
+	s := newSpawner(getSocketPath())
+	if err := s.init(); err != nil {
+		fmt.Fprintln(os.Stderr, "init:", err.Error())
+		os.Exit(1)
+	}
+	s.serve()
+}
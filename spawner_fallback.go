@@ -0,0 +1,29 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The spawner relies on /proc/self/exe and on the parent death signal of
+// Linux to re-execute the proxy and not leave children behind.
+func spawnerMain() {
+	fmt.Fprintln(os.Stderr, "init: the spawner needs linux")
+	os.Exit(1)
+}
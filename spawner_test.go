@@ -0,0 +1,170 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/containers/virtcontainers/pkg/hyperstart"
+	"github.com/containers/virtcontainers/pkg/hyperstart/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+// testChild is a child proxy running in the test process.
+type testChild struct {
+	proxy *proxy
+	done  chan interface{}
+}
+
+func startTestChild(containerID, socketPath string) (childProcess, error) {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &testChild{
+		proxy: newProxy(),
+		done:  make(chan interface{}),
+	}
+	c.proxy.singleVM = true
+	c.proxy.socketPath = socketPath
+	c.proxy.listener = l
+
+	// The child is only done once the goroutines serving its clients have
+	// returned so they don't outlive the test.
+	go func() {
+		c.proxy.serve()
+		c.proxy.wait()
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+func (c *testChild) Kill() error {
+	c.proxy.shutdown()
+	return nil
+}
+
+func (c *testChild) Wait() error {
+	<-c.done
+	return nil
+}
+
+func TestSpawner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-spawner")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := newSpawner(filepath.Join(dir, "proxy.sock"))
+	s.startChild = startTestChild
+	err = os.MkdirAll(s.childDir, 0750)
+	assert.Nil(t, err)
+
+	hyper := mock.NewHyperstart(t)
+	hyper.Start()
+	go hyper.SendMessage(int(hyperstart.ReadyCode), []byte{})
+	ctlSocketPath, ioSocketPath := hyper.GetSocketPaths()
+
+	var clients []*goapi.Client
+	newClient := func() *goapi.Client {
+		clientConn, proxyConn, err := Socketpair()
+		assert.Nil(t, err)
+		go s.serveNewClient(proxyConn)
+		client := goapi.NewClient(clientConn)
+		clients = append(clients, client)
+		return client
+	}
+
+	// RegisterVM spawns a child, shims are pointed at it.
+	ret, err := newClient().RegisterVM(testContainerID, ctlSocketPath, ioSocketPath,
+		&goapi.RegisterVMOptions{NumIOStreams: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret.IO.Tokens))
+	assert.True(t, strings.HasSuffix(ret.IO.URL, s.childSocketPath(testContainerID)))
+	c, err := s.lookupChild(testContainerID)
+	assert.Nil(t, err)
+
+	// Only one child per VM.
+	_, err = newClient().RegisterVM(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.NotNil(t, err)
+
+	// AttachVM connections are routed to the child, the rest of the
+	// connection is forwarded.
+	client := newClient()
+	_, err = client.AttachVM(testContainerID, nil)
+	assert.Nil(t, err)
+	err = client.Hyper("ping", nil)
+	assert.Nil(t, err)
+	msgs := hyper.GetLastMessages()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, hyperstart.PingCode, int(msgs[0].Code))
+
+	_, err = newClient().AttachVM("foo", nil)
+	assert.NotNil(t, err)
+
+	// Other commands can't be used to start a connection.
+	err = newClient().Hyper("ping", nil)
+	assert.NotNil(t, err)
+
+	// UnregisterVM removes the VM from the registry.
+	err = client.UnregisterVM(testContainerID)
+	assert.Nil(t, err)
+	_, err = s.lookupChild(testContainerID)
+	assert.NotNil(t, err)
+
+	// The child exits once the VM is gone.
+	hyper.Stop()
+	select {
+	case <-c.exited:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timeout waiting for the child proxy to exit")
+	}
+
+	for _, client := range clients {
+		client.Close()
+	}
+	s.wg.Wait()
+}
+
+func TestSpawnerOptions(t *testing.T) {
+	defer saveConfig()()
+
+	assert.Nil(t, checkSpawnerOptions())
+
+	// Every child would try to listen on the same address.
+	tlsListenAddr = "localhost:0"
+	assert.NotNil(t, checkSpawnerOptions())
+	tlsListenAddr = ""
+
+	// Children only know the credentials of the spawner.
+	maxConnsPerUID = 8
+	assert.NotNil(t, checkSpawnerOptions())
+	maxConnsPerUID = 0
+	selinuxPolicy = []selinuxRule{{peerMatcher{Type: "container_t"}, commandList{anyCommand}}}
+	assert.NotNil(t, checkSpawnerOptions())
+	selinuxPolicy = nil
+	authPolicyFile = "/etc/cc-proxy/auth.json"
+	assert.NotNil(t, checkSpawnerOptions())
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,go1.9
+
+package main
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// splice(2) flags, not defined by the syscall package.
+const (
+	spliceFMove     = 0x1
+	spliceFNonblock = 0x2
+)
+
+// splicePipe is the intermediate buffer splice(2) needs: data can only be
+// spliced from or to a pipe.
+type splicePipe struct {
+	r, w int
+	// scratch is used to empty the pipe when we can't splice its content
+	// to the destination.
+	scratch []byte
+}
+
+func newSplicePipe() (*splicePipe, error) {
+	var fds [2]int
+
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+
+	return &splicePipe{
+		r: fds[0],
+		w: fds[1],
+	}, nil
+}
+
+func (p *splicePipe) Close() {
+	syscall.Close(p.r)
+	syscall.Close(p.w)
+}
+
+func rawConn(c net.Conn) (syscall.RawConn, bool) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+
+	return raw, true
+}
+
+// canSplice returns true if data can be spliced from src to dst.
+func canSplice(dst, src net.Conn) bool {
+	_, dstOk := rawConn(dst)
+	_, srcOk := rawConn(src)
+
+	return dstOk && srcOk
+}
+
+// drain discards n bytes from the pipe.
+func (p *splicePipe) drain(n int) error {
+	if p.scratch == nil {
+		p.scratch = make([]byte, 4096)
+	}
+
+	for n > 0 {
+		want := n
+		if want > len(p.scratch) {
+			want = len(p.scratch)
+		}
+
+		nr, err := syscall.Read(p.r, p.scratch[:want])
+		if err != nil {
+			return err
+		}
+		n -= nr
+	}
+
+	return nil
+}
+
+// spliceN moves n bytes from src to dst through p, without copying them to
+// userspace. srcErr and dstErr tell which side failed. When only dst fails,
+// the n bytes are still consumed from src so the caller can carry on reading
+// from it.
+func spliceN(dst, src net.Conn, p *splicePipe, n int) (srcErr, dstErr error) {
+	srcRaw, _ := rawConn(src)
+	dstRaw, _ := rawConn(dst)
+
+	for n > 0 {
+		// src -> pipe.
+		var in int64
+		var err error
+		rerr := srcRaw.Read(func(fd uintptr) bool {
+			in, err = syscall.Splice(int(fd), nil, p.w, nil, n, spliceFMove|spliceFNonblock)
+			return err != syscall.EAGAIN
+		})
+		if rerr != nil {
+			return rerr, dstErr
+		}
+		if err != nil {
+			return err, dstErr
+		}
+		if in == 0 {
+			return io.ErrUnexpectedEOF, dstErr
+		}
+		n -= int(in)
+
+		// pipe -> dst.
+		for in > 0 {
+			if dstErr != nil {
+				if err := p.drain(int(in)); err != nil {
+					return err, dstErr
+				}
+				break
+			}
+
+			var out int64
+			werr := dstRaw.Write(func(fd uintptr) bool {
+				out, err = syscall.Splice(p.r, nil, int(fd), nil, int(in), spliceFMove|spliceFNonblock)
+				return err != syscall.EAGAIN
+			})
+			if werr != nil {
+				dstErr = werr
+				continue
+			}
+			if err != nil {
+				dstErr = err
+				continue
+			}
+			in -= out
+		}
+	}
+
+	return nil, dstErr
+}
+
+// sendQueueEmpty returns true if the peer of c has read all the data written
+// to c.
+func sendQueueEmpty(c net.Conn) bool {
+	raw, ok := rawConn(c)
+	if !ok {
+		return false
+	}
+
+	var outq int32
+	var err error
+	cerr := raw.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ,
+			uintptr(unsafe.Pointer(&outq)))
+		if errno != 0 {
+			err = errno
+		}
+	})
+
+	return cerr == nil && err == nil && outq == 0
+}
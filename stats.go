@@ -0,0 +1,234 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+)
+
+// streamCounters count the bytes relayed for the processes of a container.
+// They are updated atomically.
+type streamCounters struct {
+	stdin  uint64
+	stdout uint64
+	stderr uint64
+	// lastActivity is when a process of the container was last started
+	// or had I/O, in nanoseconds since the epoch.
+	lastActivity int64
+}
+
+func newStreamCounters() *streamCounters {
+	return &streamCounters{
+		lastActivity: time.Now().UnixNano(),
+	}
+}
+
+func (c *streamCounters) touch(now time.Time) {
+	atomic.StoreInt64(&c.lastActivity, now.UnixNano())
+}
+
+func (c *streamCounters) add(stream api.Stream, n int) {
+	switch stream {
+	case api.StreamStdin:
+		atomic.AddUint64(&c.stdin, uint64(n))
+	case api.StreamStdout:
+		atomic.AddUint64(&c.stdout, uint64(n))
+	case api.StreamStderr:
+		atomic.AddUint64(&c.stderr, uint64(n))
+	}
+}
+
+func (c *streamCounters) snapshot() api.StreamStats {
+	return api.StreamStats{
+		Stdin:  atomic.LoadUint64(&c.stdin),
+		Stdout: atomic.LoadUint64(&c.stdout),
+		Stderr: atomic.LoadUint64(&c.stderr),
+
+		LastActivity: time.Unix(0, atomic.LoadInt64(&c.lastActivity)),
+	}
+}
+
+// account adds n bytes to the counters of the session's container, if
+// known.
+func (session *ioSession) account(stream api.Stream, n int) {
+	now := time.Now()
+	session.touch(now)
+	if session.counters != nil {
+		session.counters.add(stream, n)
+		session.counters.touch(now)
+	}
+}
+
+// setSessionContainer records session is used by a process of the container
+// containerID.
+func (vm *vm) setSessionContainer(session *ioSession, containerID string) {
+	// The null session is shared by processes we don't care about.
+	if session == &vm.nullSession {
+		return
+	}
+
+	vm.Lock()
+	defer vm.Unlock()
+
+	counters := vm.counters[containerID]
+	if counters == nil {
+		counters = newStreamCounters()
+		vm.counters[containerID] = counters
+	}
+	counters.touch(time.Now())
+	session.counters = counters
+	session.container = containerID
+}
+
+func (vm *vm) stats() api.VMStats {
+	// QEMU is queried without holding the VM lock.
+	qemu := vm.qemuState()
+
+	vm.Lock()
+	defer vm.Unlock()
+
+	stats := api.VMStats{
+		ContainerID:       vm.containerID,
+		State:             vm.stateUnlocked(),
+		LastPing:          vm.lastPingUnlocked(),
+		HyperstartVersion: vm.hyperstartVersion,
+		AgentAPIVersion:   vm.agentAPIVersion,
+		QEMU:              qemu,
+		HyperCommands:     atomic.LoadUint64(&vm.hyperCommands),
+		Containers:        make(map[string]api.StreamStats),
+	}
+	stats.Resources = vm.resourcesUnlocked()
+	for id, counters := range vm.counters {
+		stats.Containers[id] = counters.snapshot()
+	}
+
+	return stats
+}
+
+// stateUnlocked returns the health of the VM, in the same order of
+// precedence as checkHealth, a lost VM having no health left to check.
+func (vm *vm) stateUnlocked() string {
+	switch {
+	case vm.lost:
+		return api.VMStateLost
+	case vm.booting:
+		return api.VMStateBooting
+	case vm.unhealthy:
+		return api.VMStateUnhealthy
+	case vm.degraded:
+		return api.VMStateDegraded
+	case vm.unresponsive:
+		return api.VMStateUnresponsive
+	default:
+		return api.VMStateHealthy
+	}
+}
+
+// lastPingUnlocked returns when hyperstart last answered a ping, nil if it
+// never has.
+func (vm *vm) lastPingUnlocked() *time.Time {
+	if vm.lastPing.IsZero() {
+		return nil
+	}
+	lastPing := vm.lastPing
+	return &lastPing
+}
+
+// health returns the health of the VM, see api.VMHealth.
+func (vm *vm) health() api.VMHealth {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return api.VMHealth{
+		State:      vm.stateUnlocked(),
+		Responsive: !vm.unresponsive,
+		Connected:  vm.connected,
+		LastPing:   vm.lastPingUnlocked(),
+	}
+}
+
+type byContainerID []api.VMStats
+
+func (s byContainerID) Len() int           { return len(s) }
+func (s byContainerID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byContainerID) Less(i, j int) bool { return s[i].ContainerID < s[j].ContainerID }
+
+// stats returns the I/O statistics of the VM containerID, or of all the VMs
+// if containerID is empty.
+func (proxy *proxy) stats(containerID string) (*api.StatsResponse, error) {
+	var vms []*vm
+
+	proxy.Lock()
+	if containerID != "" {
+		vm := proxy.vms[containerID]
+		if vm == nil {
+			proxy.Unlock()
+			return nil, fmt.Errorf("unknown containerID: %s", containerID)
+		}
+		vms = append(vms, vm)
+	} else {
+		for _, vm := range proxy.vms {
+			vms = append(vms, vm)
+		}
+	}
+	proxy.Unlock()
+
+	resp := &api.StatsResponse{
+		VMs: make([]api.VMStats, 0, len(vms)),
+	}
+	for _, vm := range vms {
+		resp.VMs = append(resp.VMs, vm.stats())
+	}
+	sort.Sort(byContainerID(resp.VMs))
+
+	return resp, nil
+}
+
+// "Stats"
+func stats(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	payload := api.Stats{}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &payload); err != nil {
+			response.SetError(err)
+			return
+		}
+	}
+
+	resp, err := client.proxy.stats(payload.ContainerID)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	response.AddResult("vms", resp.VMs)
+}
+
+// publishStats exposes the I/O statistics of the VMs handled by proxy as the
+// "vms" expvar, served on /debug/vars alongside pprof.
+func publishStats(proxy *proxy) {
+	expvar.Publish("vms", expvar.Func(func() interface{} {
+		resp, _ := proxy.stats("")
+		return resp.VMs
+	}))
+}
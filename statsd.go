@@ -0,0 +1,209 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// statsdAddress is the host:port of the statsd server the statsd
+	// collector sends the metrics to, over UDP.
+	statsdAddress string
+	// statsdPrefix is prepended to the names of the statsd metrics.
+	statsdPrefix = "cc_proxy"
+	// statsdInterval is how often the statsd collector sends the queued
+	// metrics and the I/O counters.
+	statsdInterval = 10 * time.Second
+)
+
+const (
+	// statsdPacketSize is the maximum size of the UDP packets sent to
+	// the statsd server, fitting in the MTU of most networks.
+	statsdPacketSize = 1432
+	// statsdQueueLength is the number of metrics waiting to be sent from
+	// which new metrics are dropped.
+	statsdQueueLength = 4096
+)
+
+// statsdCollector sends the metrics to a statsd server: the durations of the
+// commands as timers, their errors as counters and the bytes relayed for the
+// containers as gauges.
+type statsdCollector struct {
+	conn   net.Conn
+	prefix string
+
+	// proxy is set by Start.
+	proxy *proxy
+
+	metrics chan string
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	// dropped is the number of metrics dropped because the queue was
+	// full. It's accessed atomically.
+	dropped uint64
+}
+
+func newStatsdCollector() (MetricsCollector, error) {
+	if statsdAddress == "" {
+		return nil, fmt.Errorf("statsd: no server address")
+	}
+
+	conn, err := net.Dial("udp", statsdAddress)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %v", err)
+	}
+
+	return &statsdCollector{
+		conn:    conn,
+		prefix:  statsdPrefix,
+		metrics: make(chan string, statsdQueueLength),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+func (c *statsdCollector) Start(proxy *proxy) error {
+	c.proxy = proxy
+	c.wg.Add(1)
+	go c.run()
+	return nil
+}
+
+// statsdNameReplacer replaces the characters statsd gives a meaning to in
+// the components of the metric names.
+var statsdNameReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_",
+	"@", "_", "#", "_", " ", "_", "\n", "_")
+
+// name returns the statsd metric name made of the prefix and of parts.
+func (c *statsdCollector) name(parts ...string) string {
+	for i, part := range parts {
+		parts[i] = statsdNameReplacer.Replace(part)
+	}
+	if c.prefix == "" {
+		return strings.Join(parts, ".")
+	}
+	return c.prefix + "." + strings.Join(parts, ".")
+}
+
+// send queues the metric to be sent with the next packet.
+func (c *statsdCollector) send(metric string) {
+	select {
+	case c.metrics <- metric:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+func (c *statsdCollector) observe(kind, command string, d time.Duration, err error) {
+	ms := float64(d) / float64(time.Millisecond)
+	c.send(fmt.Sprintf("%s:%g|ms", c.name(kind, command, commandResult(err, resultClientError)), ms))
+	if err != nil {
+		c.send(fmt.Sprintf("%s:1|c", c.name(kind+"_errors", command, errorCode(err).String())))
+	}
+}
+
+// ObserveCommand sends the duration of command and its error, if any. statsd
+// has no labels: containerID is ignored.
+func (c *statsdCollector) ObserveCommand(command, containerID string, d time.Duration, err error) {
+	c.observe("command", command, d, err)
+}
+
+func (c *statsdCollector) ObserveHyperCommand(name string, d time.Duration, err error) {
+	c.observe("hyper_command", name, d, err)
+}
+
+func (c *statsdCollector) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+	c.conn.Close()
+
+	if dropped := atomic.LoadUint64(&c.dropped); dropped > 0 {
+		logErrorf(logFields{}, "[statsd] ", "dropped %d metrics", dropped)
+	}
+}
+
+// streamMetrics returns the gauges of the bytes relayed for all the
+// containers.
+func (c *statsdCollector) streamMetrics() []string {
+	var stdin, stdout, stderr uint64
+	for _, s := range c.proxy.streamStats() {
+		stdin += s.Stdin
+		stdout += s.Stdout
+		stderr += s.Stderr
+	}
+
+	return []string{
+		fmt.Sprintf("%s:%d|g", c.name("stream_bytes", "stdin"), stdin),
+		fmt.Sprintf("%s:%d|g", c.name("stream_bytes", "stdout"), stdout),
+		fmt.Sprintf("%s:%d|g", c.name("stream_bytes", "stderr"), stderr),
+	}
+}
+
+// run packs the queued metrics into packets, newline separated, and sends
+// them every statsdInterval or when a packet is full.
+func (c *statsdCollector) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(statsdInterval)
+	defer ticker.Stop()
+
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet.Bytes()); err != nil {
+			logf(1, logFields{}, "[statsd] ", "couldn't send metrics: %v", err)
+		}
+		packet.Reset()
+	}
+	add := func(metric string) {
+		if packet.Len() > 0 && packet.Len()+1+len(metric) > statsdPacketSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(metric)
+	}
+
+	for {
+		select {
+		case metric := <-c.metrics:
+			add(metric)
+		case <-ticker.C:
+			for _, metric := range c.streamMetrics() {
+				add(metric)
+			}
+			flush()
+		case <-c.stop:
+			for {
+				select {
+				case metric := <-c.metrics:
+					add(metric)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
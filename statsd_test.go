@@ -0,0 +1,121 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// readStatsd returns the metrics of the next packet received by server.
+func readStatsd(t *testing.T, server net.PacketConn) []string {
+	buf := make([]byte, statsdPacketSize)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err)
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestStatsdCollector(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	defer saveConfig()()
+	statsdAddress = server.LocalAddr().String()
+	statsdPrefix = "proxy"
+	statsdInterval = time.Hour
+
+	c, err := newStatsdCollector()
+	assert.Nil(t, err)
+	assert.Nil(t, c.Start(newProxy()))
+
+	c.ObserveCommand("ConnectShim", "foo", 1500*time.Microsecond, nil)
+	c.ObserveHyperCommand("exec.cmd", 2*time.Second,
+		newProxyError(api.ErrorCodeHyperTimeout, "timeout"))
+	c.Stop()
+
+	assert.Equal(t, []string{
+		"proxy.command.ConnectShim.success:1.5|ms",
+		"proxy.hyper_command.exec_cmd.timeout:2000|ms",
+		"proxy.hyper_command_errors.exec_cmd.HyperTimeout:1|c",
+	}, readStatsd(t, server))
+}
+
+func TestStatsdCollectorStreams(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	defer saveConfig()()
+	statsdAddress = server.LocalAddr().String()
+	statsdInterval = 10 * time.Millisecond
+
+	proxy := newProxy()
+	vm := newVM("foo", "", "")
+	vm.counters["foo"] = &streamCounters{stdout: 42}
+	proxy.vms["foo"] = vm
+
+	c, err := newStatsdCollector()
+	assert.Nil(t, err)
+	assert.Nil(t, c.Start(proxy))
+	defer c.Stop()
+
+	metrics := readStatsd(t, server)
+	assert.Contains(t, metrics, "cc_proxy.stream_bytes.stdout:42|g")
+	assert.Contains(t, metrics, "cc_proxy.stream_bytes.stdin:0|g")
+}
+
+func TestStatsdCollectorPackets(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	defer saveConfig()()
+	statsdAddress = server.LocalAddr().String()
+	statsdInterval = time.Hour
+
+	c, err := newStatsdCollector()
+	assert.Nil(t, err)
+	assert.Nil(t, c.Start(newProxy()))
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		c.ObserveCommand("Hyper", "", time.Millisecond, nil)
+	}
+	c.Stop()
+
+	// Metrics are split into packets no bigger than statsdPacketSize.
+	received := 0
+	for received < n {
+		metrics := readStatsd(t, server)
+		assert.True(t, len(strings.Join(metrics, "\n")) <= statsdPacketSize)
+		received += len(metrics)
+	}
+	assert.Equal(t, n, received)
+}
+
+func TestStatsdCollectorAddress(t *testing.T) {
+	defer saveConfig()()
+	statsdAddress = ""
+
+	_, err := newStatsdCollector()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build stress
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Built with -tags stress, the proxy shakes out the concurrency bugs that
+// only show on loaded nodes: goroutines are rescheduled at random points of
+// the I/O paths, a background churn of short lived goroutines competes for
+// the CPUs, socket buffers are tiny so data goes through many partial reads
+// and writes, and goroutine and fd leaks are checked at shutdown. It's meant
+// to be combined with -race.
+
+const (
+	// stressSocketBuffer is the size of the send and receive buffers of
+	// the client sockets.
+	stressSocketBuffer = 1024
+	// stressChurners is the number of goroutines spawning short lived
+	// goroutines.
+	stressChurners = 4
+	// stressLeakTimeout is how long the goroutines have to exit before
+	// being reported as leaked.
+	stressLeakTimeout = 5 * time.Second
+)
+
+// churnGoroutines counts the goroutines of the churn, left out of the leak
+// checks.
+var churnGoroutines int64
+
+func init() {
+	for i := 0; i < stressChurners; i++ {
+		atomic.AddInt64(&churnGoroutines, 1)
+		go churn()
+	}
+}
+
+// churn keeps spawning goroutines that yield and allocate a bit before
+// exiting.
+func churn() {
+	for i := 0; ; i++ {
+		done := make(chan struct{})
+		atomic.AddInt64(&churnGoroutines, 1)
+		go func() {
+			defer atomic.AddInt64(&churnGoroutines, -1)
+			buf := make([]byte, 1+rand.Intn(4096))
+			runtime.Gosched()
+			buf[0] = 1
+			close(done)
+		}()
+		<-done
+
+		if i%1000 == 0 {
+			runtime.GC()
+		}
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	}
+}
+
+// stressYield gives the scheduler a chance to run other goroutines, or
+// sleeps a bit, at random.
+func stressYield() {
+	switch n := rand.Intn(16); {
+	case n == 0:
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+	case n < 4:
+		runtime.Gosched()
+	}
+}
+
+// stressConn shrinks the socket buffers of conn.
+func stressConn(conn net.Conn) {
+	if c, ok := conn.(*net.UnixConn); ok {
+		c.SetReadBuffer(stressSocketBuffer)
+		c.SetWriteBuffer(stressSocketBuffer)
+	}
+}
+
+// leakChecker compares the number of goroutines and fds at shutdown with
+// the number at startup.
+type leakChecker struct {
+	goroutines int
+	fds        int
+}
+
+func goroutines() int {
+	return runtime.NumGoroutine() - int(atomic.LoadInt64(&churnGoroutines))
+}
+
+func openFds() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return len(fds)
+}
+
+func newLeakChecker() *leakChecker {
+	return &leakChecker{
+		goroutines: goroutines(),
+		fds:        openFds(),
+	}
+}
+
+// check returns an error, with the stacks of the goroutines still running,
+// if goroutines or fds have leaked since newLeakChecker. A nil leakChecker
+// checks nothing.
+func (l *leakChecker) check() error {
+	if l == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(stressLeakTimeout)
+	for goroutines() > l.goroutines || openFds() > l.fds {
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := openFds() - l.fds; n > 0 {
+		return fmt.Errorf("stress: %d fds leaked", n)
+	}
+
+	if n := goroutines() - l.goroutines; n > 0 {
+		buf := make([]byte, 1024*1024)
+		buf = buf[:runtime.Stack(buf, true)]
+		return fmt.Errorf("stress: %d goroutines leaked:\n%s", n, buf)
+	}
+
+	return nil
+}
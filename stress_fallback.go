@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !stress
+
+package main
+
+import "net"
+
+// Without the stress tag, the stress hooks are no-ops the compiler inlines
+// away.
+
+func stressYield() {
+}
+
+func stressConn(conn net.Conn) {
+}
+
+type leakChecker struct{}
+
+func newLeakChecker() *leakChecker {
+	return nil
+}
+
+func (l *leakChecker) check() error {
+	return nil
+}
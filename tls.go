@@ -0,0 +1,169 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	ossignal "os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// tlsListenAddr, when not empty, is the TCP address the proxy listens on, on
+// top of its unix socket, for clients running on other hosts. Connections
+// are encrypted with TLS and clients must present a certificate signed by
+// tlsClientCAFile.
+var tlsListenAddr string
+
+// tlsCertFile and tlsKeyFile are the PEM encoded certificate and private key
+// of the proxy on its TLS listener.
+var tlsCertFile, tlsKeyFile string
+
+// tlsClientCAFile holds the PEM encoded certificates of the authorities
+// signing the client certificates.
+var tlsClientCAFile string
+
+// tlsHandshakeTimeout is how long clients have to complete the TLS handshake
+// before being disconnected.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// newTLSConfig returns the configuration of the TLS listener. As any client
+// can control the VMs, mutual authentication is mandatory.
+func newTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return nil, errors.New("a certificate and a private key are needed")
+	}
+	if tlsClientCAFile == "" {
+		return nil, errors.New("a client certificate authority is needed")
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := ioutil.ReadFile(tlsClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", tlsClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// tlsListener is a TLS listener whose certificates, and client certificate
+// authorities, are reloaded from their files when the proxy receives SIGHUP.
+// Certificates can then be rotated without restarting the proxy: clients
+// already connected keep their session, new ones are handshaken with the new
+// certificates.
+type tlsListener struct {
+	net.Listener
+
+	sync.Mutex
+	config *tls.Config
+
+	sigCh     chan os.Signal
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// getConfig returns the configuration to handshake a new client with.
+func (l *tlsListener) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.config, nil
+}
+
+// reload reads the certificates again. On error, the previous ones are kept.
+func (l *tlsListener) reload() error {
+	config, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.config = config
+	l.Unlock()
+
+	return nil
+}
+
+func (l *tlsListener) watchSIGHUP() {
+	for {
+		select {
+		case <-l.sigCh:
+			if err := l.reload(); err != nil {
+				glog.Errorf("tls: couldn't reload certificates, keeping the current ones: %v", err)
+				continue
+			}
+			glog.V(1).Info("tls: certificates reloaded")
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *tlsListener) Close() error {
+	l.closeOnce.Do(func() {
+		ossignal.Stop(l.sigCh)
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// listenTLS returns a TLS listener on the TCP address addr, see tlsListener.
+func listenTLS(addr string) (net.Listener, error) {
+	config, err := newTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+
+	inner, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %v", addr, err)
+	}
+
+	l := &tlsListener{
+		config: config,
+		sigCh:  make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+	}
+	l.Listener = tls.NewListener(inner, &tls.Config{
+		GetConfigForClient: l.getConfig,
+	})
+	ossignal.Notify(l.sigCh, syscall.SIGHUP)
+	go l.watchSIGHUP()
+
+	glog.V(1).Info("listening on ", l.Addr())
+
+	return l, nil
+}
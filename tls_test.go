@@ -0,0 +1,309 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
+	goapi "github.com/clearcontainers/proxy/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate and its private key, signed by parent or self
+// signed if parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and its key in dir, returning their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (certPath, keyPath string) {
+	certPath = filepath.Join(dir, name+".crt")
+	err := ioutil.WriteFile(certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	keyPath = filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	assert.Nil(t, err)
+
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.der},
+		PrivateKey:  c.key,
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	server := newTestCert(t, "proxy", false, ca)
+	client := newTestCert(t, "client", false, ca)
+	rogue := newTestCert(t, "rogue", false, nil)
+
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCAFile
+	defer func() {
+		tlsCertFile, tlsKeyFile, tlsClientCAFile = savedCert, savedKey, savedCA
+	}()
+
+	// Mutual authentication is mandatory.
+	tlsCertFile, tlsKeyFile = server.write(t, dir, "proxy")
+	tlsClientCAFile = ""
+	_, err = listenTLS("127.0.0.1:0")
+	assert.NotNil(t, err)
+
+	tlsClientCAFile, _ = ca.write(t, dir, "ca")
+	l, err := listenTLS("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	proto := newProtocol()
+	proto.HandleCommand(api.CmdStats, stats)
+	proxy := newProxy()
+	proxy.listener = l
+	done := make(chan interface{})
+	go func() {
+		proxy.acceptClients(proto, l)
+		close(done)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(cert *testCert) (*goapi.Client, net.Conn) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{cert.tlsCertificate()},
+			RootCAs:      roots,
+		})
+		if err != nil {
+			return nil, nil
+		}
+		return goapi.NewClient(conn), conn
+	}
+
+	// A client with a certificate signed by the CA is served.
+	c, conn := dial(client)
+	assert.NotNil(t, c)
+	if c != nil {
+		resp, err := c.Stats("")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resp.VMs))
+		conn.Close()
+	}
+
+	// Others aren't.
+	c, conn = dial(rogue)
+	if c != nil {
+		_, err = c.Stats("")
+		assert.NotNil(t, err)
+		conn.Close()
+	}
+
+	proxy.shutdown()
+	<-done
+}
+
+func TestTLSIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	server := newTestCert(t, "proxy", false, ca)
+	shim := newTestCert(t, "shim", false, ca)
+
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCAFile
+	defer func() {
+		tlsCertFile, tlsKeyFile, tlsClientCAFile = savedCert, savedKey, savedCA
+	}()
+	tlsCertFile, tlsKeyFile = server.write(t, dir, "proxy")
+	tlsClientCAFile, _ = ca.write(t, dir, "ca")
+
+	l, err := listenTLS("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	go func() {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{shim.tlsCertificate()},
+			RootCAs:      roots,
+		})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	p, err := newPeer(conn)
+	conn.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, listenerTLS, p.listener)
+	assert.Equal(t, "shim", p.identity)
+
+	rule := peerMatcher{Identity: "shim"}
+	assert.True(t, rule.matches(&p))
+	rule.Identity = "runtime"
+	assert.False(t, rule.matches(&p))
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	server := newTestCert(t, "proxy", false, ca)
+
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCAFile
+	savedTimeout := tlsHandshakeTimeout
+	defer func() {
+		tlsCertFile, tlsKeyFile, tlsClientCAFile = savedCert, savedKey, savedCA
+		tlsHandshakeTimeout = savedTimeout
+	}()
+	tlsCertFile, tlsKeyFile = server.write(t, dir, "proxy")
+	tlsClientCAFile, _ = ca.write(t, dir, "ca")
+	tlsHandshakeTimeout = 100 * time.Millisecond
+
+	l, err := listenTLS("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// A client never sending its ClientHello.
+	silent, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer silent.Close()
+
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	_, err = newPeer(conn)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	oldCA := newTestCert(t, "ca", true, nil)
+	newCA := newTestCert(t, "ca", true, nil)
+	oldClient := newTestCert(t, "client", false, oldCA)
+	newClient := newTestCert(t, "client", false, newCA)
+
+	savedCert, savedKey, savedCA := tlsCertFile, tlsKeyFile, tlsClientCAFile
+	defer func() {
+		tlsCertFile, tlsKeyFile, tlsClientCAFile = savedCert, savedKey, savedCA
+	}()
+	tlsCertFile, tlsKeyFile = newTestCert(t, "proxy", false, oldCA).write(t, dir, "proxy")
+	tlsClientCAFile, _ = oldCA.write(t, dir, "ca")
+
+	l, err := listenTLS("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	handshake := func(cert, root *testCert) error {
+		errCh := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			errCh <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(root.cert)
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{cert.tlsCertificate()},
+			RootCAs:      roots,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return <-errCh
+	}
+
+	assert.Nil(t, handshake(oldClient, oldCA))
+
+	// Rotate the certificates to ones signed by a new CA.
+	tlsCertFile, tlsKeyFile = newTestCert(t, "proxy", false, newCA).write(t, dir, "proxy")
+	newCA.write(t, dir, "ca")
+	assert.Nil(t, l.(*tlsListener).reload())
+
+	assert.NotNil(t, handshake(oldClient, newCA))
+	assert.Nil(t, handshake(newClient, newCA))
+
+	// Invalid certificates are not loaded, the current ones are kept.
+	assert.Nil(t, ioutil.WriteFile(tlsClientCAFile, []byte("garbage"), 0600))
+	assert.NotNil(t, l.(*tlsListener).reload())
+	assert.Nil(t, handshake(newClient, newCA))
+}
@@ -15,8 +15,18 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clearcontainers/proxy/api"
 )
 
 // Token represents the communication between the process inside the VM and the
@@ -42,12 +52,191 @@ func generateRandomBytes(n int) ([]byte, error) {
 	return b, nil
 }
 
-// GenerateToken returns a URL-safe, base64 encoded securely generated random
-// string.
-//
-// It will return an error if the system's secure random number generator
-// fails to function correctly, in which case the caller should not continue.
-func GenerateToken(s int) (Token, error) {
-	b, err := generateRandomBytes(s)
-	return Token(base64.URLEncoding.EncodeToString(b)), err
+// tokenClaims describe the I/O session a token gives access to. Tokens are
+// the base64 encoded JSON claims followed by their HMAC, so the proxy can
+// check a token it's given has been issued by itself, for the container the
+// shim wants to handle the I/O of.
+type tokenClaims struct {
+	ContainerID string `json:"containerId"`
+	// IOBase is the sequence number of the first stream of the session and
+	// NumStreams the number of streams it has.
+	IOBase     uint64 `json:"ioBase"`
+	NumStreams int    `json:"numStreams"`
+	// IssuedAt is when the token has been allocated.
+	IssuedAt time.Time `json:"issuedAt"`
+	// Scope restricts what the token can be used for, see
+	// tokenScopeReadOnly. Tokens without scope give full access to their
+	// session.
+	Scope string `json:"scope,omitempty"`
+	// Nonce makes tokens unguessable, even when all the other claims can be
+	// predicted.
+	Nonce []byte `json:"nonce"`
+}
+
+// tokenScopeReadOnly tokens can only be used by read-only clients, eg. log
+// collectors, to receive the output of a process. They can't send stdin or
+// signals. Read-only tokens are tracked along with the token of their
+// session, renewing or freeing that token revokes them.
+const tokenScopeReadOnly = "read-only"
+
+// readOnlyToken returns a read-only token for the session of token.
+func readOnlyToken(token Token) (Token, error) {
+	claims, err := verifyToken(token)
+	if err != nil {
+		return nilToken, err
+	}
+
+	return signToken(&tokenClaims{
+		ContainerID: claims.ContainerID,
+		IOBase:      claims.IOBase,
+		NumStreams:  claims.NumStreams,
+		IssuedAt:    claims.IssuedAt,
+		Scope:       tokenScopeReadOnly,
+	})
+}
+
+// tokenValidity is how long after being issued a token can be used to
+// connect to its I/O session. Clients can renew the tokens of long-lived
+// sessions with RenewTokens. 0 means tokens don't expire.
+var tokenValidity time.Duration
+
+// expired returns whether the token carrying claims can't be used anymore.
+func (claims *tokenClaims) expired(now time.Time) bool {
+	return tokenValidity > 0 && now.Sub(claims.IssuedAt) > tokenValidity
+}
+
+// tokenKeySize is the size, in bytes, of the key tokens are signed with.
+const tokenKeySize = 32
+
+var (
+	tokenKeyOnce sync.Once
+	tokenKey     []byte
+	tokenKeyErr  error
+)
+
+// getTokenKey returns the key tokens are signed with, generated when the
+// first token is issued. Tokens are only valid for the proxy having issued
+// them.
+func getTokenKey() ([]byte, error) {
+	tokenKeyOnce.Do(func() {
+		tokenKey, tokenKeyErr = generateRandomBytes(tokenKeySize)
+	})
+	return tokenKey, tokenKeyErr
+}
+
+func tokenMAC(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signToken returns a token carrying claims, signed with the key of the
+// proxy.
+func signToken(claims *tokenClaims) (Token, error) {
+	key, err := getTokenKey()
+	if err != nil {
+		return nilToken, err
+	}
+
+	if claims.Nonce == nil {
+		if claims.Nonce, err = generateRandomBytes(16); err != nil {
+			return nilToken, err
+		}
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nilToken, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := base64.RawURLEncoding.EncodeToString(tokenMAC(key, payload))
+
+	return Token(payload + "." + mac), nil
+}
+
+var errInvalidToken = errors.New("invalid token signature")
+
+// verifyToken checks token has been signed by the proxy and returns its
+// claims.
+func verifyToken(token Token) (*tokenClaims, error) {
+	key, err := getTokenKey()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed token: %s", token)
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, tokenMAC(key, parts[0])) {
+		return nil, errInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	claims := &tokenClaims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+
+	return claims, nil
+}
+
+// "RenewTokens"
+func renewTokens(data []byte, userData interface{}, response *handlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+	payload := api.RenewTokens{}
+
+	if err := json.Unmarshal(data, &payload); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	if len(payload.Tokens) == 0 {
+		response.SetErrorMsg("malformed RenewTokens command: no token")
+		return
+	}
+
+	client.infof(1, "RenewTokens(containerId=%s,tokens=%d)", payload.ContainerID,
+		len(payload.Tokens))
+
+	// All the tokens are checked before renewing any, so a RenewTokens
+	// that fails leaves them untouched.
+	infos := make([]*tokenInfo, len(payload.Tokens))
+	seen := make(map[string]bool)
+	for i, token := range payload.Tokens {
+		if seen[token] {
+			response.SetErrorf("malformed RenewTokens command: duplicate token %s", token)
+			return
+		}
+		seen[token] = true
+
+		info, err := proxy.renewableToken(payload.ContainerID, Token(token))
+		if err != nil {
+			response.SetError(err)
+			return
+		}
+		infos[i] = info
+	}
+
+	renewed := make([]string, len(payload.Tokens))
+	readOnly := make([]string, len(payload.Tokens))
+	for i, token := range payload.Tokens {
+		t, ro, err := proxy.renewToken(infos[i], Token(token))
+		if err != nil {
+			response.SetError(err)
+			return
+		}
+		renewed[i] = string(t)
+		readOnly[i] = string(ro)
+	}
+
+	response.AddResult("tokens", renewed)
+	response.AddResult("readOnlyTokens", readOnly)
 }
@@ -14,21 +14,45 @@
 package main
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-// base64Length computes the length of the base64 encoding for n bytes of data
-func base64Length(n int) int {
-	return ((4 * n / 3) + 3) & ^3
-}
+func TestSignToken(t *testing.T) {
+	now := time.Now()
+	token, err := signToken(&tokenClaims{
+		ContainerID: "foo",
+		IOBase:      4,
+		NumStreams:  2,
+		IssuedAt:    now,
+	})
+	assert.Nil(t, err)
+
+	claims, err := verifyToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", claims.ContainerID)
+	assert.Equal(t, uint64(4), claims.IOBase)
+	assert.Equal(t, 2, claims.NumStreams)
+	assert.True(t, now.Equal(claims.IssuedAt))
+	assert.Len(t, claims.Nonce, 16)
 
-func TestGenerateToken(t *testing.T) {
-	// 32 bytes of data, 256 bytes. Each digit in base64 represents 6 bits
-	// of input data. base64 add some stuffing so the number of bits to
-	// encode is divisible by 6.
-	token, err := GenerateToken(32)
+	// Two tokens with the same claims are different.
+	other, err := signToken(&tokenClaims{ContainerID: "foo", IOBase: 4, NumStreams: 2,
+		IssuedAt: now})
 	assert.Nil(t, err)
-	assert.Equal(t, base64Length(32), len(token))
+	assert.NotEqual(t, token, other)
+
+	// Tokens can't be forged from the claims of another one.
+	parts := strings.Split(string(token), ".")
+	forged := Token(parts[0] + "." + strings.Split(string(other), ".")[1])
+	_, err = verifyToken(forged)
+	assert.Equal(t, errInvalidToken, err)
+
+	for _, invalid := range []Token{"", "foo", "a.b.c", Token(parts[0] + ".!")} {
+		_, err = verifyToken(invalid)
+		assert.NotNil(t, err, "%s", invalid)
+	}
 }
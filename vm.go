@@ -18,14 +18,18 @@ import (
 	"bufio"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
 
 	"github.com/containers/virtcontainers/pkg/hyperstart"
 	"github.com/golang/glog"
@@ -33,6 +37,18 @@ import (
 
 // Represents a single qemu/hyperstart instance on the system
 type vm struct {
+	// goroutines is the number of goroutines started with spawn still
+	// running. It's accessed atomically and kept first for its 64-bit
+	// alignment.
+	goroutines int64
+	// trace is set, atomically, while the VM is traced from the debug
+	// console, see setTracing.
+	trace int32
+
+	// faults, if not nil, injects faults in the commands sent to
+	// hyperstart, see faultInjection.
+	faults *faultSource
+
 	sync.Mutex
 
 	containerID string
@@ -43,8 +59,23 @@ type vm struct {
 	console struct {
 		socketPath string
 		conn       net.Conn
+		// file receives the console output when consoleDir is set.
+		file *os.File
 	}
 
+	// buffers, if not nil, limits the amount of data buffered in the I/O
+	// queues of the VM, see vmBufferLimit.
+	buffers *bufferBudget
+
+	// qmpPath is the QMP socket of the QEMU process running the VM, if
+	// given at RegisterVM.
+	qmpPath string
+	qmp     *qmp
+	// qemuExited is set once QEMU has closed the QMP socket.
+	qemuExited bool
+	// nextDIMM numbers the memory devices hotplugged in the VM.
+	nextDIMM int
+
 	// Used to allocate globally unique IO sequence numbers
 	nextIoBase uint64
 
@@ -66,10 +97,100 @@ type vm struct {
 
 	// Channel to signal qemu has terminated.
 	vmLost chan interface{}
+
+	// clients are the connections of the clients attached to this VM
+	// (RegisterVM or AttachVM), indexed by client ID. They receive the VM
+	// notifications.
+	clients map[uint64]net.Conn
+	// logClients are the IDs of the clients that have subscribed to the
+	// hyperstart logs.
+	logClients map[uint64]bool
+
+	// unhealthy is set when hyperstart is deemed unable to process
+	// commands anymore.
+	unhealthy bool
+
+	// degraded is set while we are trying to re-establish the connection
+	// to hyperstart.
+	degraded bool
+
+	// lost is set once the connection to hyperstart is gone for good, see
+	// terminateSessions.
+	lost bool
+	// lostTimer, protected by the proxy lock, unregisters the VM once
+	// lost, see unregisterLostVM.
+	lostTimer *time.Timer
+
+	// outputRateLimit is applied to each stdout and stderr stream of the
+	// VM processes.
+	outputRateLimit rateLimit
+	// lineBuffered is the default output mode of the VM processes, see
+	// api.RegisterVM.
+	lineBuffered bool
+	// hyperstartVersion is the version of the hyperstart protocol spoken
+	// by the agent, deciding which Hyper commands are forwarded.
+	hyperstartVersion string
+	// agentAPIVersion is the API version the agent has reported when
+	// negotiating hyperstartVersion.
+	agentAPIVersion int
+
+	// counters hold the number of bytes relayed per container running in
+	// the VM, indexed by container ID.
+	counters map[string]*streamCounters
+	// hyperCommands counts the commands sent to hyperstart, pings
+	// excepted. It is updated atomically.
+	hyperCommands uint64
+
+	// capture, when not nil, records the I/O traffic of the VM.
+	capture *ioCapture
+
+	// connected is true between a successful Connect and Close, while
+	// the hyperstart channels are open.
+	connected bool
+	// booting is set while the proxy connects to a VM registered with
+	// RegisterVM.Async, see bootVM.
+	booting bool
+
+	// nextOperation is the ID given to the next Hyper.Async command.
+	nextOperation uint64
+	// operations are the Hyper.Async commands in flight, indexed by
+	// operation ID.
+	operations map[uint64]*operation
+
+	// lastPing is when hyperstart last answered a ping.
+	lastPing time.Time
+	// stopIdleWatch stops the watchIdle goroutine.
+	stopIdleWatch chan interface{}
+	// unresponsive is set when hyperstart has missed pingMisses pings in
+	// a row, see probeLiveness.
+	unresponsive bool
+	// containers are the containers hyperstart has created, see
+	// trackContainers.
+	containers map[string]bool
+	// stopProbe stops the probeLiveness goroutine.
+	stopProbe chan interface{}
+
+	// paused is set while the I/O relay is quiesced, see Pause. resumed
+	// is closed by Resume and parked by the io goroutine once it has
+	// stopped reading the io channel. readingHeader is true while the io
+	// goroutine waits for the next message, the only time Pause can
+	// interrupt it.
+	paused        bool
+	resumed       chan interface{}
+	parked        chan interface{}
+	readingHeader bool
+	// vcpusStopped is set when Pause has also stopped the vCPUs of the VM
+	// through QMP, see PauseVM.
+	vcpusStopped bool
 }
 
 // A set of I/O streams between a client and a process running inside the VM
 type ioSession struct {
+	// lastActivity is when the process was started or last had I/O, in
+	// nanoseconds since the epoch, or one of the activity constants. It's
+	// accessed atomically and kept first for its 64-bit alignment.
+	lastActivity int64
+
 	// token is what identifies the I/O session to the external world
 	token Token
 
@@ -80,6 +201,28 @@ type ioSession struct {
 	ioBase   uint64
 	// Have we received the EOF paquet from hyperstart for this session?
 	terminated bool
+	// Has the client closed stdin? Only accessed by the goroutine serving
+	// the client.
+	stdinClosed bool
+
+	// terminal is whether the process has a terminal, in which case
+	// stderr is merged into stdout. shimTerminal is the mode the shim
+	// has declared in ConnectShim, nil if it didn't. Both are protected
+	// by the vm lock.
+	terminal     bool
+	shimTerminal *bool
+	// container is the container the process runs in, protected by the
+	// vm lock.
+	container string
+
+	// resizeLock serializes the winsize commands of the session and
+	// protects started and pendingSize.
+	resizeLock sync.Mutex
+	// Has hyperstart started the process?
+	started bool
+	// pendingSize is the last terminal size received before the process
+	// was started, nil if none.
+	pendingSize *terminalSize
 
 	// id  of the client owning that ioSession (the shim process, usually).
 	clientID uint64
@@ -87,6 +230,36 @@ type ioSession struct {
 	// socket connected to the fd sent over to the client
 	client net.Conn
 
+	// output holds the frames waiting to be written to client.
+	output *outputQueue
+	// input holds the stdin data waiting to be written to hyperstart, an
+	// empty frame closing stdin. See writeStdin.
+	input *outputQueue
+	// limiters rate limit stdout and stderr, if enabled.
+	limiters [2]*tokenBucket
+	// compressors compress stdout and stderr, if the client has
+	// negotiated compression.
+	compressors [2]*streamCompressor
+	// lineBuffers coalesce stdout and stderr into complete lines, if the
+	// session is line buffered.
+	lineBuffers [2]*lineBuffer
+
+	// counters are the byte counters of the container the process
+	// belongs to.
+	counters *streamCounters
+
+	// observers receive a copy of the output. They are protected by the
+	// vm lock.
+	observers []*ioObserver
+
+	// streamID is the stream ID the client has associated with this
+	// session in ConnectShim. A non-zero streamID means the client
+	// connection may be shared with other sessions.
+	streamID int
+	// chunkSize is the maximum payload size of the stream frames
+	// exchanged with the client, negotiated in ConnectShim.
+	chunkSize int
+
 	// Channel to signal a shim has been associated with this session (hyper
 	// commands newcontainer and execcmd will wait for the shim to be ready
 	// before forwarding the command to hyperstart)
@@ -103,12 +276,24 @@ func newVM(id, ctlSerial, ioSerial string) *vm {
 	h := hyperstart.NewHyperstart(ctlSerial, ioSerial, "unix")
 
 	vm := &vm{
-		containerID:    id,
-		hyperHandler:   h,
-		nextIoBase:     firstIoBase,
-		ioSessions:     make(map[uint64]*ioSession),
-		tokenToSession: make(map[Token]*ioSession),
-		vmLost:         make(chan interface{}),
+		containerID:       id,
+		hyperHandler:      h,
+		faults:            newFaultSource(faultTargetAgent, id),
+		nextIoBase:        firstIoBase,
+		ioSessions:        make(map[uint64]*ioSession),
+		tokenToSession:    make(map[Token]*ioSession),
+		vmLost:            make(chan interface{}),
+		clients:           make(map[uint64]net.Conn),
+		logClients:        make(map[uint64]bool),
+		outputRateLimit:   defaultOutputRateLimit(),
+		hyperstartVersion: defaultHyperstartVersion,
+		counters:          make(map[string]*streamCounters),
+		containers:        make(map[string]bool),
+		nextOperation:     1,
+		operations:        make(map[uint64]*operation),
+		stopIdleWatch:     make(chan interface{}),
+		stopProbe:         make(chan interface{}),
+		buffers:           newBufferBudget(vmBufferLimit),
 	}
 
 	vm.nullSession = ioSession{
@@ -138,31 +323,55 @@ func (vm *vm) shortName() string {
 	return vm.containerID[0:length]
 }
 
+func (vm *vm) logFields(channel string) logFields {
+	return logFields{
+		"CONTAINER_ID": vm.containerID,
+		"CHANNEL":      channel,
+	}
+}
+
 func (vm *vm) info(lvl glog.Level, channel string, msg string) {
+	if vm.tracing() {
+		logTracef(vm.logFields(channel),
+			fmt.Sprintf("[vm %s %s] ", vm.shortName(), channel), "%s", msg)
+		return
+	}
 	if !glog.V(lvl) {
 		return
 	}
-	glog.Infof("[vm %s %s] %s", vm.shortName(), channel, msg)
+	logf(lvl, vm.logFields(channel),
+		fmt.Sprintf("[vm %s %s] ", vm.shortName(), channel), "%s", msg)
 }
 
-func (vm *vm) infof(lvl glog.Level, channel string, fmt string, a ...interface{}) {
+func (vm *vm) infof(lvl glog.Level, channel string, format string, a ...interface{}) {
+	if vm.tracing() {
+		logTracef(vm.logFields(channel),
+			fmt.Sprintf("[vm %s %s] ", vm.shortName(), channel), format, a...)
+		return
+	}
 	if !glog.V(lvl) {
 		return
 	}
-	a = append(a, 0, 0)
-	copy(a[2:], a[0:])
-	a[0] = vm.shortName()
-	a[1] = channel
-	glog.Infof("[vm %s %s] "+fmt, a...)
+	logf(lvl, vm.logFields(channel),
+		fmt.Sprintf("[vm %s %s] ", vm.shortName(), channel), format, a...)
 }
 
 func (vm *vm) dump(lvl glog.Level, data []byte) {
-	if !glog.V(lvl) {
+	if !vm.tracing() && !bool(glog.V(lvl)) {
 		return
 	}
 	glog.Infof("\n%s", hex.Dump(data))
 }
 
+// hyper returns the current hyperstart handler. It's replaced when
+// reconnecting to hyperstart.
+func (vm *vm) hyper() *hyperstart.Hyperstart {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.hyperHandler
+}
+
 func (vm *vm) findSessionBySeq(seq uint64) *ioSession {
 	vm.Lock()
 	defer vm.Unlock()
@@ -177,92 +386,198 @@ func (vm *vm) findSessionByToken(token Token) *ioSession {
 	return vm.tokenToSession[token]
 }
 
-func hyperstartTtyMessageToFrame(msg *hyperstart.TtyMessage, session *ioSession) *api.Frame {
-	// Exit status
-	if session.terminated && len(msg.Message) == 1 {
-		return api.NewFrame(api.TypeNotification, int(api.NotificationProcessExited), msg.Message)
-	}
-
-	// Regular stdout/err data
-	var stream api.Stream
-
-	if msg.Session == session.ioBase {
-		stream = api.StreamStdout
-	} else {
-		stream = api.StreamStderr
-	}
-
-	return api.NewFrame(api.TypeStream, int(stream), msg.Message)
-}
-
 // This function runs in a goroutine, reading data from the io channel and
 // dispatching it to the right client (the one with matching seq number)
 // There's only one instance of this goroutine per-VM
 func (vm *vm) ioHyperToClients() {
-	for {
-		msg, err := vm.hyperHandler.ReadIoMessage()
-		if err != nil {
-			break
+	var pipe *splicePipe
+	if spliceIO {
+		var err error
+		if pipe, err = newSplicePipe(); err != nil {
+			vm.infof(1, "io", "not using splice: %v", err)
+		} else {
+			defer pipe.Close()
 		}
+	}
 
-		session := vm.findSessionBySeq(msg.Session)
-		if session == nil {
-			fmt.Fprintf(os.Stderr,
-				"couldn't find client with seq number %d\n", msg.Session)
-			continue
-		}
+	headerBuf := make([]byte, hyperstart.TtyHdrSize)
 
-		// The nullSession acts like /dev/null, discard data associated with it
-		if session == &vm.nullSession {
-			vm.info(1, "io", "data received for the null session, discarding")
-			vm.dump(2, msg.Message)
+	for {
+		stressYield()
+		vm.waitResumed()
+
+		ioSock := vm.hyper().GetIoSock()
+
+		header, err := vm.readNextHeader(ioSock, headerBuf)
+		if err == errIOPaused {
 			continue
 		}
+		if err != nil {
+			if vm.reconnect(err) == nil {
+				continue
+			}
+			break
+		}
+
+		session := vm.findSessionBySeq(header.seq)
 
-		// When the process corresponding to a session exits:
-		//   1. hyperstart sends an EOF paquet, ie. data_length == 0
-		//      session.terminated tracks that condition
-		//   2. hyperstart sends the exit status paquet, ie. data_length == 1
-		if len(msg.Message) == 0 {
-			session.terminated = true
+		// Big chunks of output are spliced directly to the client.
+		if session != nil && vm.spliceable(pipe, session, header, ioSock) {
+			if err := session.spliceOutput(pipe, header, ioSock); err != nil {
+				if vm.reconnect(err) == nil {
+					continue
+				}
+				break
+			}
 			continue
 		}
 
-		vm.infof(1, "io", "<- writing to client #%d", session.clientID)
-		vm.dump(2, msg.Message)
-
-		frame := hyperstartTtyMessageToFrame(msg, session)
-		err = api.WriteFrame(session.client, frame)
+		buf, err := readTtyPayload(ioSock, header)
 		if err != nil {
-			// When the shim is forcefully killed, it's possible we
-			// still have data to write. Ignore errors for that case.
-			vm.infof(1, "io", "error writing I/O data to client:", err)
-			continue
+			if vm.reconnect(err) == nil {
+				continue
+			}
+			break
 		}
+
+		vm.forwardOutput(session, header.seq, buf)
 	}
 
-	// Having an error on the IO channel read is interpreted as having lost
-	// the VM.
+	// Having an error on the IO channel read we couldn't recover from is
+	// interpreted as having lost the VM.
 	vm.signalVMLost()
 	vm.wg.Done()
 }
 
-// Stream the VM console to stderr
+// forwardOutput forwards a message received on the io channel to the client of
+// session. buf is the message payload, as returned by readTtyPayload, and is
+// owned by forwardOutput.
+func (vm *vm) forwardOutput(session *ioSession, seq uint64, buf []byte) {
+	data := buf[api.MinHeaderLength:]
+
+	if session == nil {
+		fmt.Fprintf(os.Stderr,
+			"couldn't find client with seq number %d\n", seq)
+		putBuffer(buf)
+		return
+	}
+
+	// The nullSession acts like /dev/null, discard data associated with it
+	if session == &vm.nullSession {
+		vm.info(1, "io", "data received for the null session, discarding")
+		vm.dump(2, data)
+		putBuffer(buf)
+		return
+	}
+
+	// When the process corresponding to a session exits:
+	//   1. hyperstart sends an EOF paquet, ie. data_length == 0
+	//      session.terminated tracks that condition
+	//   2. hyperstart sends the exit status paquet, ie. data_length == 1
+	if len(data) == 0 {
+		session.flushAllLines()
+		session.terminated = true
+		session.processExited()
+		putBuffer(buf)
+		return
+	}
+
+	if session.output == nil {
+		vm.infof(1, "io", "no client for seq number %d, discarding data", seq)
+		putBuffer(buf)
+		return
+	}
+
+	vm.infof(1, "io", "<- writing to client #%d", session.clientID)
+	vm.dump(2, data)
+
+	if !session.terminated {
+		session.account(session.outputStream(seq), len(data))
+		vm.captureIO(seq, session.outputStream(seq).String(), data)
+	} else if len(data) == 1 {
+		vm.captureIO(seq, "exit", data)
+	}
+
+	if !vm.buffers.waitOutput() {
+		vm.infof(1, "io", "%d bytes buffered for the VM, had to stop reading the io channel",
+			vmBufferLimit)
+	}
+
+	var queued bool
+	if session.terminated && len(data) == 1 {
+		// Exit status
+		vm.processFinished(session, int(data[0]), false)
+		queued = session.queueOutput(api.TypeNotification,
+			int(api.NotificationProcessExited), buf, nil, nil)
+	} else if session.lineBuffers[seq-session.ioBase] != nil {
+		queued = session.queueLines(seq, buf)
+	} else {
+		// Regular stdout/err data
+		queued = session.queueStreamOutput(seq, buf)
+	}
+	if !queued {
+		vm.infof(1, "io", "client #%d is too slow, had to stop reading the io channel",
+			session.clientID)
+	}
+}
+
+// processFinished tells the clients attached to the VM the process of session
+// has exited with status. lost is set when the status is made up because the
+// VM has been lost.
+func (vm *vm) processFinished(session *ioSession, status int, lost bool) {
+	vm.Lock()
+	container := session.container
+	vm.Unlock()
+
+	vm.notify(api.NotificationProcessFinished, &api.ProcessFinished{
+		ContainerID: vm.containerID,
+		Container:   container,
+		Token:       string(session.token),
+		ExitStatus:  status,
+		Lost:        lost,
+	})
+}
+
+// Stream the VM console to stderr, and to the console file if any
 func (vm *vm) consoleToLog() {
 	reader := bufio.NewReader(vm.console.conn)
 	for {
 		line, err := reader.ReadString('\n')
+		if vm.console.file != nil && line != "" {
+			// The last words of a crashing kernel may not end with a
+			// newline, keep them in the file.
+			vm.console.file.WriteString(line)
+		}
 		if err != nil {
 			break
 		}
 
-		vm.infof(3, "hyperstart", line)
+		vm.info(3, "hyperstart", line)
+		vm.forwardLog(line)
+	}
+
+	if vm.console.file != nil {
+		vm.console.file.Close()
 	}
 
 	vm.wg.Done()
 }
 
+// closeConsole closes the console connection opened by connect, if any.
+// consoleToLog then closes the console file and returns.
+func (vm *vm) closeConsole() {
+	if vm.console.conn != nil {
+		vm.console.conn.Close()
+	}
+}
+
 func (vm *vm) Connect() error {
+	return vm.connect(func(string) {})
+}
+
+// connect opens the console and hyperstart channels, calling progress with
+// each VMBoot state reached.
+func (vm *vm) connect(progress func(state string)) error {
 	if vm.console.socketPath != "" {
 		var err error
 
@@ -271,28 +586,109 @@ func (vm *vm) Connect() error {
 			return err
 		}
 
+		if consoleDir != "" {
+			vm.console.file, err = openConsoleFile(vm.containerID)
+			if err != nil {
+				vm.console.conn.Close()
+				return err
+			}
+		}
+
 		vm.wg.Add(1)
-		go vm.consoleToLog()
+		vm.spawn(vm.consoleToLog)
+	}
+
+	var q *qmp
+	if vm.qmpPath != "" {
+		var err error
+
+		q, err = dialQMP(vm.qmpPath)
+		if err != nil {
+			vm.closeConsole()
+			return err
+		}
 	}
 
 	if err := vm.hyperHandler.OpenSockets(); err != nil {
+		if q != nil {
+			q.Close()
+		}
+		vm.closeConsole()
 		return err
 	}
+	progress(api.VMBootConnected)
 
 	if err := vm.hyperHandler.WaitForReady(); err != nil {
 		vm.hyperHandler.CloseSockets()
+		if q != nil {
+			q.Close()
+		}
+		vm.closeConsole()
 		return err
 	}
+	progress(api.VMBootStarted)
+
+	vm.Lock()
+	vm.connected = true
+	vm.qmp = q
+	vm.Unlock()
+
+	if q != nil {
+		vm.wg.Add(1)
+		vm.spawn(func() {
+			vm.watchQEMU(q)
+		})
+	}
 
 	vm.wg.Add(1)
-	go vm.ioHyperToClients()
+	vm.spawn(vm.ioHyperToClients)
+
+	if idleTimeout > 0 {
+		vm.wg.Add(1)
+		vm.spawn(vm.watchIdle)
+	}
+
+	if pingInterval > 0 {
+		vm.wg.Add(1)
+		vm.spawn(vm.probeLiveness)
+	}
 
 	return nil
 }
 
 type relocationHandler func(*vm, *api.Hyper, *ioSession) error
 
-func relocateProcess(process *hyperstart.Process, session *ioSession) error {
+// setSessionTerminal records whether the process of session has a terminal.
+func (vm *vm) setSessionTerminal(session *ioSession, terminal bool) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	session.terminal = terminal
+}
+
+// checkSessionTerminal verifies the process of session is started in the
+// terminal mode its shim expects, if any.
+func (vm *vm) checkSessionTerminal(session *ioSession) error {
+	vm.Lock()
+	defer vm.Unlock()
+
+	if session.shimTerminal == nil || *session.shimTerminal == session.terminal {
+		return nil
+	}
+
+	return fmt.Errorf("process terminal mode (%v) doesn't match the one of its shim (%v)",
+		session.terminal, *session.shimTerminal)
+}
+
+// hasTerminal returns whether the process of session has a terminal.
+func (session *ioSession) hasTerminal() bool {
+	session.vm.Lock()
+	defer session.vm.Unlock()
+
+	return session.terminal
+}
+
+func relocateProcess(process *hyperapi.Process, session *ioSession) error {
 	// Make sure clients don't prefill process.Stdio and proces.Stderr
 	if process.Stdio != 0 {
 		return fmt.Errorf("expected process.Stdio to be 0, got %d", process.Stdio)
@@ -313,15 +709,27 @@ func relocateProcess(process *hyperstart.Process, session *ioSession) error {
 	return nil
 }
 
+// invalidSpec returns the error of the name hyper command whose payload
+// hasn't passed validation.
+func invalidSpec(name string, err error) error {
+	return newProxyError(api.ErrorCodeInvalidSpec, "invalid %s: %v", name, err)
+}
+
 func execcmdHandler(vm *vm, hyper *api.Hyper, session *ioSession) error {
-	cmdIn := hyperstart.ExecCommand{}
+	cmdIn := hyperapi.ExecCommand{}
 	if err := json.Unmarshal(hyper.Data, &cmdIn); err != nil {
 		return err
 	}
 
+	if err := cmdIn.Validate(); err != nil {
+		return invalidSpec(hyper.HyperName, err)
+	}
+
 	if err := relocateProcess(&cmdIn.Process, session); err != nil {
 		return err
 	}
+	vm.setSessionContainer(session, cmdIn.Container)
+	vm.setSessionTerminal(session, cmdIn.Process.Terminal)
 
 	newData, err := json.Marshal(&cmdIn)
 	if err != nil {
@@ -334,12 +742,21 @@ func execcmdHandler(vm *vm, hyper *api.Hyper, session *ioSession) error {
 }
 
 func newcontainerHandler(vm *vm, hyper *api.Hyper, session *ioSession) error {
-	cmdIn := hyperstart.Container{}
+	cmdIn := hyperapi.Container{}
 	if err := json.Unmarshal(hyper.Data, &cmdIn); err != nil {
 		return err
 	}
 
-	relocateProcess(cmdIn.Process, session)
+	if err := cmdIn.Validate(); err != nil {
+		return invalidSpec(hyper.HyperName, err)
+	}
+
+	if err := relocateProcess(cmdIn.Process, session); err != nil {
+		return err
+	}
+	vm.setSessionContainer(session, cmdIn.ID)
+	vm.setSessionTerminal(session, cmdIn.Process.Terminal)
+
 	newData, err := json.Marshal(&cmdIn)
 	if err != nil {
 		return err
@@ -350,27 +767,66 @@ func newcontainerHandler(vm *vm, hyper *api.Hyper, session *ioSession) error {
 	return nil
 }
 
+func winsizeHandler(vm *vm, hyper *api.Hyper, session *ioSession) error {
+	msg := hyperapi.WindowSizeMessage{}
+	if err := json.Unmarshal(hyper.Data, &msg); err != nil {
+		return err
+	}
+
+	// Like for processes, the sequence number is the proxy's business.
+	if msg.Seq != 0 {
+		return fmt.Errorf("expected seq to be 0, got %d", msg.Seq)
+	}
+	msg.Seq = session.ioBase
+
+	newData, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+
+	hyper.Data = newData
+
+	return nil
+}
+
+// relocatedCommands are the hyper commands referring to I/O sequence numbers.
+// Clients identify processes with tokens and the proxy fills in the sequence
+// numbers, which clients never see.
+var relocatedCommands = []struct {
+	name    string
+	handler relocationHandler
+	// needsToken is true when the command has to be given the token of
+	// an existing process.
+	needsToken bool
+}{
+	{"newcontainer", newcontainerHandler, false},
+	{"execcmd", execcmdHandler, false},
+	{"winsize", winsizeHandler, true},
+}
+
+// startsProcess returns true if the hyper command name starts the process of
+// the token it's given.
+func startsProcess(name string) bool {
+	return name == "newcontainer" || name == "execcmd"
+}
+
 // RelocateHyperCommand performs the sequence number relocation in the
-// newcontainer and execcmd hyper commands given the corresponding list of
-// tokens. Starpod isn't handled as it's not currently use to start processes
-// and indicated as deprecated in the hyperstart API.
+// newcontainer, execcmd and winsize hyper commands given the corresponding
+// list of tokens. Starpod isn't handled as it's not currently use to start
+// processes and indicated as deprecated in the hyperstart API.
 func (vm *vm) relocateHyperCommand(hyper *api.Hyper) error {
-	cmds := []struct {
-		name    string
-		handler relocationHandler
-	}{
-		{"newcontainer", newcontainerHandler},
-		{"execcmd", execcmdHandler},
-	}
 	needsRelocation := false
 
 	nTokens := len(hyper.Tokens)
 
-	for _, cmd := range cmds {
+	for _, cmd := range relocatedCommands {
 		if hyper.HyperName == cmd.name {
 			if nTokens > 1 {
 				return fmt.Errorf("expected 0 or 1 token, got %d", nTokens)
 			}
+			if nTokens == 0 && cmd.needsToken {
+				return fmt.Errorf("%s needs the token of the process", cmd.name)
+			}
 
 			var session *ioSession
 			if nTokens == 0 {
@@ -395,6 +851,10 @@ func (vm *vm) relocateHyperCommand(hyper *api.Hyper) error {
 				return err
 			}
 
+			if err := vm.checkSessionTerminal(session); err != nil {
+				return err
+			}
+
 			needsRelocation = true
 			break
 		}
@@ -411,13 +871,424 @@ func (vm *vm) relocateHyperCommand(hyper *api.Hyper) error {
 	return nil
 }
 
-func (vm *vm) SendMessage(hyper *api.Hyper) error {
-	if err := vm.relocateHyperCommand(hyper); err != nil {
+// SendMessage sends a hyper command to hyperstart, returning the time spent
+// waiting for hyperstart to answer.
+func (vm *vm) SendMessage(hyper *api.Hyper) (time.Duration, error) {
+	if err := vm.prepareMessage(hyper); err != nil {
+		return 0, err
+	}
+
+	return vm.sendMessage(hyper, nil)
+}
+
+// prepareMessage checks hyper can be sent to the VM and relocates its I/O
+// sequence numbers.
+func (vm *vm) prepareMessage(hyper *api.Hyper) error {
+	if err := vm.checkHealth(); err != nil {
 		return err
 	}
 
-	_, err := vm.hyperHandler.SendCtlMessage(hyper.HyperName, hyper.Data)
-	return err
+	if err := vm.checkHyperCommand(hyper.HyperName); err != nil {
+		return err
+	}
+
+	return vm.relocateHyperCommand(hyper)
+}
+
+// sendMessage sends hyper, prepared with prepareMessage, to hyperstart. The
+// proxy stops waiting for the answer once cancel, if not nil, is closed.
+func (vm *vm) sendMessage(hyper *api.Hyper, cancel <-chan interface{}) (time.Duration, error) {
+	start := time.Now()
+	_, err := vm.sendCtlMessageCancel(hyper.HyperName, hyper.Data, cancel)
+	roundTrip := time.Since(start)
+	if err != nil {
+		return roundTrip, err
+	}
+
+	// The process of the session now exists in the VM.
+	if startsProcess(hyper.HyperName) && len(hyper.Tokens) == 1 {
+		if session := vm.findSessionByToken(Token(hyper.Tokens[0])); session != nil {
+			session.processStarted()
+		}
+	}
+
+	return roundTrip, nil
+}
+
+// WriteFile writes data to the file path of container with the writefile hyper
+// command, whose payload is the JSON file command followed by the content of
+// the file.
+func (vm *vm) WriteFile(container, path string, data []byte) (time.Duration, error) {
+	if container == "" || path == "" {
+		return 0, errors.New("writefile: container and path are needed")
+	}
+
+	if err := vm.checkHealth(); err != nil {
+		return 0, err
+	}
+
+	cmd, err := json.Marshal(&hyperapi.FileCommand{
+		Container: container,
+		File:      path,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if max := maxCtlPayload - len(cmd); len(data) > max {
+		return 0, fmt.Errorf("writefile: %d bytes is bigger than the %d bytes hyperstart accepts",
+			len(data), max)
+	}
+
+	start := time.Now()
+	_, err = vm.sendCtlMessageRetry("writefile", append(cmd, data...))
+
+	return time.Since(start), err
+}
+
+// ReadFile returns the content of the file path of container, read with the
+// readfile hyper command. hyperstart answers with the content of the file.
+func (vm *vm) ReadFile(container, path string) ([]byte, time.Duration, error) {
+	if container == "" || path == "" {
+		return nil, 0, errors.New("readfile: container and path are needed")
+	}
+
+	if err := vm.checkHealth(); err != nil {
+		return nil, 0, err
+	}
+
+	cmd, err := json.Marshal(&hyperapi.FileCommand{
+		Container: container,
+		File:      path,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	msg, err := vm.sendCtlMessageRetry("readfile", cmd)
+	roundTrip := time.Since(start)
+	if err != nil {
+		return nil, roundTrip, err
+	}
+
+	var data []byte
+	if msg != nil {
+		data = msg.Message
+	}
+	if data == nil {
+		data = []byte{}
+	}
+
+	return data, roundTrip, nil
+}
+
+// hyperTimeout is how long we wait for hyperstart to answer a command before
+// failing it. 0 disables the watchdog.
+var hyperTimeout = 30 * time.Second
+
+// hyperTimeoutUnhealthy controls if a VM is marked as unhealthy when one of
+// its hyper commands times out.
+var hyperTimeoutUnhealthy = false
+
+// hyperTimeouts overrides hyperTimeout for specific hyper commands, indexed
+// by command name. It's set from the configuration file.
+var hyperTimeouts = map[string]time.Duration{}
+
+// hyperCommandTimeout returns the watchdog timeout for the hyper command name.
+func hyperCommandTimeout(name string) time.Duration {
+	if timeout, ok := hyperTimeouts[name]; ok {
+		return timeout
+	}
+	return hyperTimeout
+}
+
+// sendCtlMessage sends a command to hyperstart and waits for its answer,
+// failing the command if hyperstart doesn't answer within the timeout
+// configured for that command. A command refused by hyperstart fails with a
+// classified error, see agentError.
+func (vm *vm) sendCtlMessage(name string, data []byte) (*hyperstart.DecodedMessage, error) {
+	return vm.waitCtlMessage(name, data, nil)
+}
+
+// waitCtlMessage is sendCtlMessage giving up waiting for the answer of
+// hyperstart when cancel, if not nil, is closed.
+func (vm *vm) waitCtlMessage(name string, data []byte,
+	cancel <-chan interface{}) (msg *hyperstart.DecodedMessage, err error) {
+	if name != "ping" {
+		atomic.AddUint64(&vm.hyperCommands, 1)
+	}
+	start := time.Now()
+	defer func() {
+		now := time.Now()
+		hyperLatencies.observe(name, now.Sub(start))
+		if name == "ping" && err == nil {
+			vm.pingAnswered(now)
+		}
+		if err == nil {
+			vm.trackContainers(name, data)
+		}
+		err = vm.agentError(name, data, err)
+		collector.ObserveHyperCommand(name, now.Sub(start), err)
+		if err != nil {
+			vm.infof(2, "hyper", "%s failed after %v: %v", name, now.Sub(start), err)
+		} else {
+			vm.infof(2, "hyper", "%s answered in %v", name, now.Sub(start))
+		}
+	}()
+
+	h := vm.hyper()
+	timeout := hyperCommandTimeout(name)
+	if timeout == 0 && cancel == nil {
+		msg, err := vm.sendToAgent(h, name, data)
+		vm.checkCtlError(h, err)
+		return msg, err
+	}
+
+	type reply struct {
+		msg *hyperstart.DecodedMessage
+		err error
+	}
+
+	// The hyperstart package gives us no way to cancel a command, so the
+	// command is sent from the one goroutine below while we wait for its
+	// reply, the timeout or the cancellation. If hyperstart never answers,
+	// this goroutine will stay blocked. If the answer eventually comes,
+	// it's consumed here and doesn't get mixed up with the answers of
+	// subsequent commands.
+	replyCh := make(chan reply, 1)
+	vm.spawn(func() {
+		msg, err := vm.sendToAgent(h, name, data)
+		vm.checkCtlError(h, err)
+		replyCh <- reply{msg, err}
+	})
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case r := <-replyCh:
+		return r.msg, r.err
+	case <-cancel:
+		return nil, errCancelled(name)
+	case <-expired:
+	}
+
+	vm.onHyperTimeout(name)
+
+	return nil, newProxyError(api.ErrorCodeHyperTimeout,
+		"timeout waiting for hyperstart to answer %s (%s)", name, timeout)
+}
+
+// onHyperTimeout is called when the hyper command name has timed out.
+func (vm *vm) onHyperTimeout(name string) {
+	vm.infof(1, "ctl", "hyperstart didn't answer %s in time", name)
+
+	if hyperTimeoutUnhealthy {
+		vm.Lock()
+		vm.unhealthy = true
+		vm.Unlock()
+	}
+
+	vm.notify(api.NotificationHyperTimeout, &api.HyperTimeout{
+		ContainerID: vm.containerID,
+		HyperName:   name,
+		Unhealthy:   hyperTimeoutUnhealthy,
+	})
+}
+
+// checkHealth returns an error if the VM has been marked as unhealthy,
+// degraded or if hyperstart isn't answering pings.
+func (vm *vm) checkHealth() error {
+	vm.Lock()
+	defer vm.Unlock()
+
+	if vm.booting {
+		return newProxyError(api.ErrorCodeVMBooting,
+			"vm %s is booting", vm.containerID)
+	}
+
+	if vm.unhealthy {
+		return newProxyError(api.ErrorCodeVMUnhealthy,
+			"vm %s is unhealthy", vm.containerID)
+	}
+
+	if vm.degraded {
+		return newProxyError(api.ErrorCodeVMDegraded,
+			"lost connection to vm %s, reconnecting", vm.containerID)
+	}
+
+	if vm.unresponsive {
+		return newProxyError(api.ErrorCodeAgentUnresponsive,
+			"hyperstart in vm %s isn't answering pings", vm.containerID)
+	}
+
+	return nil
+}
+
+// hyperReconnectRetries is the number of times we try to re-open the serial
+// channels after an error before declaring the VM lost. 0 disables
+// reconnection.
+var hyperReconnectRetries = 5
+
+// hyperReconnectDelay is the delay before the first reconnection attempt. It
+// doubles after each failed attempt, up to hyperReconnectMaxDelay.
+var hyperReconnectDelay = 100 * time.Millisecond
+
+const hyperReconnectMaxDelay = 5 * time.Second
+
+// reconnect tries to re-establish the connection to hyperstart after cause
+// made us lose it, eg. a virtio-serial hiccup or QEMU re-creating its chardev
+// sockets. Clients attached to the VM are notified of the degradation and of
+// the recovery. An error is returned if hyperstart couldn't be reached again.
+//
+// hyperstart isn't restarted and won't send its READY message again, so
+// there's nothing to wait for once the sockets are opened. Commands in flight
+// when the connection was lost won't get an answer, the watchdog will fail
+// them.
+func (vm *vm) reconnect(cause error) error {
+	if hyperReconnectRetries <= 0 {
+		return cause
+	}
+
+	// There's no hyperstart to reconnect to once QEMU is gone.
+	if vm.hasQEMUExited() {
+		return cause
+	}
+
+	vm.infof(1, "io", "lost connection to hyperstart: %v", cause)
+
+	vm.Lock()
+	vm.degraded = true
+	old := vm.hyperHandler
+	vm.Unlock()
+
+	vm.notify(api.NotificationVMDegraded, &api.VMDegraded{
+		ContainerID: vm.containerID,
+		Reason:      cause.Error(),
+	})
+
+	// Don't use CloseSockets() here, it waits for the ctl channel to be
+	// terminated, which won't happen if only the io channel has failed.
+	old.GetCtlSock().Close()
+	old.GetIoSock().Close()
+
+	delay := hyperReconnectDelay
+	for i := 1; i <= hyperReconnectRetries; i++ {
+		time.Sleep(delay)
+
+		h := hyperstart.NewHyperstart(old.GetCtlSockPath(), old.GetIoSockPath(),
+			old.GetSockType())
+		err := h.OpenSockets()
+		if err == nil {
+			vm.Lock()
+			vm.hyperHandler = h
+			vm.degraded = false
+			vm.Unlock()
+
+			vm.infof(1, "io", "reconnected to hyperstart")
+			vm.notify(api.NotificationVMRecovered, &api.VMRecovered{
+				ContainerID: vm.containerID,
+			})
+			return nil
+		}
+
+		vm.infof(1, "io", "reconnection attempt %d/%d failed: %v",
+			i, hyperReconnectRetries, err)
+
+		delay *= 2
+		if delay > hyperReconnectMaxDelay {
+			delay = hyperReconnectMaxDelay
+		}
+	}
+
+	return fmt.Errorf("couldn't reconnect to hyperstart: %v", cause)
+}
+
+// checkCtlError looks at the error returned by a hyper command sent with h.
+// I/O errors on the ctl channel are handled by closing the io channel so the
+// io goroutine, the only one reading from hyperstart, notices and tries to
+// reconnect.
+func (vm *vm) checkCtlError(h *hyperstart.Hyperstart, err error) {
+	if _, ok := err.(net.Error); !ok {
+		return
+	}
+
+	if vm.hyper() != h {
+		// We've already reconnected.
+		return
+	}
+
+	vm.infof(1, "ctl", "error on the ctl channel: %v", err)
+	h.GetIoSock().Close()
+}
+
+// addClient attaches a client to the VM so it receives the VM notifications,
+// and the hyperstart logs if logs is true.
+func (vm *vm) addClient(id uint64, conn net.Conn, logs bool) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	vm.clients[id] = conn
+	if logs {
+		vm.logClients[id] = true
+	}
+}
+
+func (vm *vm) removeClient(id uint64) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	delete(vm.clients, id)
+	delete(vm.logClients, id)
+}
+
+// notify sends a notification to all the clients attached to the VM.
+func (vm *vm) notify(notification api.Notification, payload interface{}) {
+	vm.notifyClients(notification, payload, false)
+}
+
+// forwardLog sends line, written by hyperstart to the console, to the clients
+// that have subscribed to the hyperstart logs.
+func (vm *vm) forwardLog(line string) {
+	vm.notifyClients(api.NotificationHyperstartLog, &api.HyperstartLog{
+		ContainerID: vm.containerID,
+		Message:     strings.TrimRight(line, "\r\n"),
+	}, true)
+}
+
+// notifyClients sends a notification to the clients attached to the VM, only
+// the ones that have subscribed to the hyperstart logs if logsOnly is true.
+func (vm *vm) notifyClients(notification api.Notification, payload interface{}, logsOnly bool) {
+	vm.Lock()
+	conns := make([]net.Conn, 0, len(vm.clients))
+	for id, conn := range vm.clients {
+		if logsOnly && !vm.logClients[id] {
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	vm.Unlock()
+
+	if len(conns) == 0 {
+		return
+	}
+
+	frame, err := api.NewFrameJSON(api.TypeNotification, int(notification), payload)
+	if err != nil {
+		vm.infof(1, "notify", "couldn't encode %s notification: %v", notification, err)
+		return
+	}
+
+	for _, conn := range conns {
+		if err := api.WriteFrame(conn, frame); err != nil {
+			vm.infof(1, "notify", "couldn't send %s notification: %v", notification, err)
+		}
+	}
 }
 
 var waitForShimTimeout = 30 * time.Second
@@ -450,30 +1321,161 @@ func (session *ioSession) ForwardStdin(frame *api.Frame) error {
 	}
 
 	vm := session.vm
-	msg := &hyperstart.TtyMessage{
-		Session: session.ioBase,
-		Message: frame.Payload,
+
+	if frame.Header.Compressed {
+		return fmt.Errorf("compressed stdin frames aren't supported")
+	}
+
+	if session.chunkSize > 0 && len(frame.Payload) > session.chunkSize {
+		return fmt.Errorf("stdin frame of %d bytes is bigger than the chunk size (%d)",
+			len(frame.Payload), session.chunkSize)
+	}
+
+	if session.stdinClosed {
+		vm.infof(1, "io", "stdin of client #%d is closed, discarding data",
+			session.clientID)
+		return nil
+	}
+
+	// An empty frame would close stdin, see below.
+	if len(frame.Payload) > 0 {
+		vm.infof(1, "io", "-> writing to hyper from #%d", session.clientID)
+		vm.dump(2, frame.Payload)
+		session.account(api.StreamStdin, len(frame.Payload))
+		vm.captureIO(session.ioBase, api.StreamStdin.String(), frame.Payload)
+
+		if !vm.buffers.waitStdin() {
+			vm.infof(1, "io", "%d bytes buffered for the VM, blocked stdin of client #%d",
+				vmBufferLimit, session.clientID)
+		}
+		session.input.push(outputFrame{buf: frame.Payload})
+	}
+
+	if !frame.Header.EOF {
+		return nil
+	}
+
+	vm.infof(1, "io", "-> closing stdin for #%d", session.clientID)
+	session.stdinClosed = true
+	session.input.push(outputFrame{})
+
+	return nil
+}
+
+// writeStdin writes the stdin data queued in q to hyperstart until q is
+// closed.
+//
+// Writing to the io channel blocks when hyperstart doesn't keep up. Doing it
+// here rather than in the goroutine serving the shim means the commands sent
+// by the shim, signals in particular, aren't stuck behind stdin data. That
+// goroutine only blocks once stdinBufferSize bytes of stdin are queued.
+func (session *ioSession) writeStdin(q *outputQueue) {
+	vm := session.vm
+
+	for {
+		frame, ok := q.pop()
+		if !ok {
+			return
+		}
+
+		if err := session.writeStdinData(frame.buf); err != nil {
+			vm.infof(1, "io", "error writing stdin of client #%d: %v",
+				session.clientID, err)
+		}
+
+		q.done(frame)
 	}
+}
+
+// writeStdinData sends data to the stdin of the process, closing stdin when
+// data is empty.
+func (session *ioSession) writeStdinData(data []byte) error {
+	ioSock := session.vm.hyper().GetIoSock()
 
-	vm.infof(1, "io", "-> writing to hyper from #%d", session.clientID)
-	vm.dump(2, msg.Message)
+	// hyperstart closes the stdin of the process when receiving a message
+	// without data.
+	if len(data) == 0 {
+		return writeTtyMessage(ioSock, session.ioBase, nil)
+	}
+
+	// The chunk size can be bigger than what hyperstart accepts in one
+	// message.
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxTtyPayload {
+			n = maxTtyPayload
+		}
 
-	return vm.hyperHandler.SendIoMessage(msg)
+		if err := writeTtyMessage(ioSock, session.ioBase, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
 }
 
-// windowSizeMessage07 is the hyperstart 0.7 winsize message payload for the
-// winsize command. This payload has changed in 0.8 so we can't use the
-// definition in the hyperstart package.
-type windowSizeMessage07 struct {
-	Seq    uint64 `json:"seq"`
-	Row    uint16 `json:"row"`
-	Column uint16 `json:"column"`
+type terminalSize struct {
+	columns, rows int
 }
 
 // SendTerminalSize sends a new terminal geometry to the process represented by
 // session.
+//
+// Shims usually send the initial size of the terminal as soon as they are
+// connected, before the process is started by newcontainer or execcmd, and
+// hyperstart rejects winsize commands for processes it doesn't know about. In
+// that case, the size is sent once the process has been started.
 func (session *ioSession) SendTerminalSize(columns, rows int) error {
-	msg := &windowSizeMessage07{
+	session.resizeLock.Lock()
+	defer session.resizeLock.Unlock()
+
+	if !session.started {
+		session.vm.infof(1, "io", "process of #%d not started, delaying terminal size (%d,%d)",
+			session.clientID, columns, rows)
+		session.pendingSize = &terminalSize{columns, rows}
+		return nil
+	}
+
+	if !session.hasTerminal() {
+		return fmt.Errorf("process doesn't have a terminal")
+	}
+
+	return session.sendTerminalSize(columns, rows)
+}
+
+// processHasStarted returns true once hyperstart has started the process of
+// the session.
+func (session *ioSession) processHasStarted() bool {
+	session.resizeLock.Lock()
+	defer session.resizeLock.Unlock()
+
+	return session.started
+}
+
+// processStarted is called once hyperstart has started the process of the
+// session, sending the terminal size received before, if any.
+func (session *ioSession) processStarted() {
+	session.resizeLock.Lock()
+	defer session.resizeLock.Unlock()
+
+	session.started = true
+	session.touch(time.Now())
+
+	size := session.pendingSize
+	session.pendingSize = nil
+	if size == nil || !session.hasTerminal() {
+		return
+	}
+
+	if err := session.sendTerminalSize(size.columns, size.rows); err != nil {
+		session.vm.infof(1, "io", "couldn't set the terminal size of #%d: %v",
+			session.clientID, err)
+	}
+}
+
+func (session *ioSession) sendTerminalSize(columns, rows int) error {
+	msg := &hyperapi.WindowSizeMessage{
 		Seq:    session.ioBase,
 		Column: uint16(columns),
 		Row:    uint16(rows),
@@ -484,13 +1486,22 @@ func (session *ioSession) SendTerminalSize(columns, rows int) error {
 		return err
 	}
 
-	_, err = session.vm.hyperHandler.SendCtlMessage("winsize", data)
+	_, err = session.vm.sendCtlMessage("winsize", data)
 	return err
 }
 
-// SendSignal
+// SendSignal sends signal to the process represented by session. Signals
+// don't wait for the stdin data queued before them to be written, and a
+// SIGKILL discards that data: the process won't read it.
 func (session *ioSession) SendSignal(signal syscall.Signal) error {
-	msg := &hyperstart.KillCommand{
+	if signal == syscall.SIGKILL && session.input != nil {
+		if n := session.input.discard(); n > 0 {
+			session.vm.infof(1, "io", "discarded %d bytes of stdin for #%d",
+				n, session.clientID)
+		}
+	}
+
+	msg := &hyperapi.KillCommand{
 		Container: session.vm.containerID,
 		Signal:    signal,
 	}
@@ -500,7 +1511,7 @@ func (session *ioSession) SendSignal(signal syscall.Signal) error {
 		return err
 	}
 
-	_, err = session.vm.hyperHandler.SendCtlMessage("killcontainer", data)
+	_, err = session.vm.sendCtlMessage("killcontainer", data)
 	return err
 }
 
@@ -514,7 +1525,12 @@ func (vm *vm) AllocateToken() (Token, error) {
 	ioBase := vm.nextIoBase
 	vm.nextIoBase += uint64(nStreams)
 
-	token, err := GenerateToken(32)
+	token, err := signToken(&tokenClaims{
+		ContainerID: vm.containerID,
+		IOBase:      ioBase,
+		NumStreams:  nStreams,
+		IssuedAt:    time.Now(),
+	})
 	if err != nil {
 		return nilToken, err
 	}
@@ -542,8 +1558,14 @@ func (vm *vm) AllocateToken() (Token, error) {
 // AssociateShim associates a shim given by the triplet (token, clientID,
 // clientConn) to a vm (POD). After associating the shim, a hyper command can
 // be issued to start the process inside the VM and data can flow between shim
-// and containerized process through the shim.
-func (vm *vm) AssociateShim(token Token, clientID uint64, clientConn net.Conn) (*ioSession, error) {
+// and containerized process through the shim. streamID identifies the session
+// on clientConn when the shim multiplexes several sessions on it. terminal,
+// when not nil, is the terminal mode the shim expects the process to have.
+// chunkSize is the maximum payload size of the stream frames exchanged with
+// the shim, 0 for no limit. compression is the compression algorithm
+// negotiated with the shim, "" for none.
+func (vm *vm) AssociateShim(token Token, clientID uint64, clientConn net.Conn, streamID int,
+	terminal *bool, chunkSize int, compression string, lineBuffered bool) (*ioSession, error) {
 	vm.Lock()
 	defer vm.Unlock()
 
@@ -554,6 +1576,31 @@ func (vm *vm) AssociateShim(token Token, clientID uint64, clientConn net.Conn) (
 
 	session.clientID = clientID
 	session.client = clientConn
+	session.streamID = streamID
+	session.shimTerminal = terminal
+	session.chunkSize = chunkSize
+	session.output = newOutputQueue(ioSessionBufferSize)
+	session.output.budget = vm.buffers
+	for i := range session.limiters {
+		session.limiters[i] = newTokenBucket(vm.outputRateLimit)
+		if compression != "" {
+			session.compressors[i] = &streamCompressor{}
+		}
+		if lineBuffered {
+			session.lineBuffers[i] = &lineBuffer{}
+		}
+	}
+	vm.startOutputWriter(clientID, clientConn, session.output)
+	session.input = newOutputQueue(stdinBufferSize)
+	session.input.budget = vm.buffers
+	session.input.stdin = true
+	if vm.paused {
+		session.input.hold()
+	}
+	input := session.input
+	vm.spawn(func() {
+		session.writeStdin(input)
+	})
 
 	// Signal a runtime waiting that the shim is connected
 	close(session.shimConnected)
@@ -561,6 +1608,102 @@ func (vm *vm) AssociateShim(token Token, clientID uint64, clientConn net.Conn) (
 	return session, nil
 }
 
+// AddObserver makes the client clientID receive a copy of the output of the
+// session whose first stream is ioBase, tagged with streamID, in frames of at
+// most chunkSize bytes of payload.
+func (vm *vm) AddObserver(ioBase uint64, clientID uint64, clientConn net.Conn, streamID int,
+	chunkSize int) (*ioSession, error) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	session := vm.ioSessions[ioBase]
+	if session == nil || session.ioBase != ioBase {
+		return nil, fmt.Errorf("vm: unknown I/O session %d", ioBase)
+	}
+
+	observer := &ioObserver{
+		clientID:  clientID,
+		client:    clientConn,
+		streamID:  streamID,
+		chunkSize: chunkSize,
+		output:    newOutputQueue(observerBufferSize),
+	}
+	observer.output.budget = vm.buffers
+	session.observers = append(session.observers, observer)
+	vm.startOutputWriter(clientID, clientConn, observer.output)
+
+	return session, nil
+}
+
+// RemoveObserver stops sending the output of session to the client clientID
+// on streamID.
+func (vm *vm) RemoveObserver(session *ioSession, clientID uint64, streamID int) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	for i, observer := range session.observers {
+		if observer.clientID == clientID && observer.streamID == streamID {
+			observer.output.close()
+			session.observers = append(session.observers[:i], session.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// sessionObservers returns the current observers of session.
+func (vm *vm) sessionObservers(session *ioSession) []*ioObserver {
+	vm.Lock()
+	defer vm.Unlock()
+
+	if len(session.observers) == 0 {
+		return nil
+	}
+
+	observers := make([]*ioObserver, len(session.observers))
+	copy(observers, session.observers)
+	return observers
+}
+
+// observerDropped records observer missed a frame because it isn't reading
+// its output fast enough.
+func (vm *vm) observerDropped(observer *ioObserver) {
+	vm.Lock()
+	observer.dropped++
+	dropped := observer.dropped
+	vm.Unlock()
+
+	vm.infof(1, "io", "client #%d is too slow, dropped output (%d frames so far)",
+		observer.clientID, dropped)
+}
+
+// RenewToken re-issues token, returning a new token giving access to the
+// same I/O session. token isn't valid anymore.
+func (vm *vm) RenewToken(token Token) (Token, error) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	session := vm.tokenToSession[token]
+	if session == nil {
+		return nilToken, fmt.Errorf("vm: unknown token %s", token)
+	}
+
+	renewed, err := signToken(&tokenClaims{
+		ContainerID: vm.containerID,
+		IOBase:      session.ioBase,
+		NumStreams:  session.nStreams,
+		IssuedAt:    time.Now(),
+	})
+	if err != nil {
+		return nilToken, err
+	}
+
+	delete(vm.tokenToSession, token)
+	vm.tokenToSession[renewed] = session
+	session.token = renewed
+
+	return renewed, nil
+}
+
 func (vm *vm) freeTokenUnlocked(token Token) error {
 	session := vm.tokenToSession[token]
 	if session == nil {
@@ -586,18 +1729,38 @@ func (vm *vm) FreeToken(token Token) error {
 }
 
 func (session *ioSession) Close() {
+	if session.output != nil {
+		session.output.close()
+	}
+	if session.input != nil {
+		session.input.close()
+	}
+	for _, observer := range session.observers {
+		observer.output.close()
+	}
+	session.observers = nil
+
 	// We can have a session created, but no shim associated with just yet.
-	// In that case, client is nil.
-	if session.client != nil {
+	// In that case, client is nil. A connection multiplexing several
+	// sessions is left to the shim to close.
+	if session.client != nil && session.streamID == 0 {
 		session.client.Close()
 	}
 }
 
 func (vm *vm) Close() {
-	vm.hyperHandler.CloseSockets()
+	vm.hyper().CloseSockets()
+	vm.Lock()
+	vm.connected = false
+	// Let the io goroutine notice the channel is closed.
+	vm.resumeUnlocked()
+	vm.Unlock()
 	if vm.console.conn != nil {
 		vm.console.conn.Close()
 	}
+	if vm.qmp != nil {
+		vm.qmp.Close()
+	}
 
 	// Garbage collect I/O sessions in case Close() was called without
 	// properly cleaning up all sessions.
@@ -606,8 +1769,17 @@ func (vm *vm) Close() {
 		vm.freeTokenUnlocked(token)
 		delete(vm.tokenToSession, token)
 	}
+	capture := vm.capture
+	vm.capture = nil
 	vm.Unlock()
 
+	if capture != nil {
+		capture.Close()
+	}
+
+	close(vm.stopIdleWatch)
+	close(vm.stopProbe)
+
 	// Wait for VM global goroutines
 	vm.wg.Wait()
 }
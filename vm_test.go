@@ -16,10 +16,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/clearcontainers/proxy/api"
+	hyperapi "github.com/clearcontainers/proxy/api/hyperstart"
 	"github.com/containers/virtcontainers/pkg/hyperstart"
 	"github.com/containers/virtcontainers/pkg/hyperstart/mock"
 
@@ -109,6 +117,7 @@ func (rig *vmRig) createHyperCmd(vm *vm, cmdName string, numTokens int, data []b
 func (rig *vmRig) createNewcontainer(vm *vm, numTokens int) *api.Hyper {
 	process := rig.createBaseProcess()
 	cmd := hyperstart.Container{
+		ID:      testContainerID,
 		Process: process,
 	}
 
@@ -129,7 +138,7 @@ func TestHyperRelocationNewcontainer(t *testing.T) {
 	cmd := rig.createNewcontainer(vm, 1)
 	token := cmd.Tokens[0]
 	// associate a dummy shim
-	vm.AssociateShim(Token(token), 1, nil)
+	vm.AssociateShim(Token(token), 1, nil, 0, nil, 0, "", false)
 	// relocate
 	err := vm.relocateHyperCommand(cmd)
 	assert.Nil(t, err)
@@ -188,7 +197,8 @@ func TestHyperRelocationNewcontainerNoToken(t *testing.T) {
 func (rig *vmRig) createExecmd(vm *vm, numTokens int) *api.Hyper {
 	process := rig.createBaseProcess()
 	cmd := hyperstart.ExecCommand{
-		Process: *process,
+		Container: testContainerID,
+		Process:   *process,
 	}
 
 	data, err := json.Marshal(&cmd)
@@ -208,7 +218,7 @@ func TestHyperRelocationExeccmd(t *testing.T) {
 	cmd := rig.createExecmd(vm, 1)
 	token := cmd.Tokens[0]
 	// associate a dummy shim
-	vm.AssociateShim(Token(token), 1, nil)
+	vm.AssociateShim(Token(token), 1, nil, 0, nil, 0, "", false)
 	// relocate
 	err := vm.relocateHyperCommand(cmd)
 	assert.Nil(t, err)
@@ -253,8 +263,62 @@ func TestHyperRelocationPing(t *testing.T) {
 	vm.Close()
 }
 
+func TestHyperRelocationNewcontainerNoProcess(t *testing.T) {
+	rig := newVMRig(t)
+	rig.Start()
+
+	vm := rig.CreateVM()
+
+	data, err := json.Marshal(&hyperstart.Container{ID: "foo"})
+	assert.Nil(t, err)
+	cmd := rig.createHyperCmd(vm, "newcontainer", 1, data)
+	err = vm.relocateHyperCommand(cmd)
+	assert.NotNil(t, err)
+
+	rig.Stop()
+
+	vm.Close()
+}
+
+func TestHyperRelocationWinsize(t *testing.T) {
+	rig := newVMRig(t)
+	rig.Start()
+
+	vm := rig.CreateVM()
+
+	data, err := json.Marshal(&hyperapi.WindowSizeMessage{Column: 80, Row: 24})
+	assert.Nil(t, err)
+	cmd := rig.createHyperCmd(vm, "winsize", 1, data)
+	token := cmd.Tokens[0]
+	vm.AssociateShim(Token(token), 1, nil, 0, nil, 0, "", false)
+	err = vm.relocateHyperCommand(cmd)
+	assert.Nil(t, err)
+
+	session := vm.findSessionByToken(Token(token))
+	msg := hyperapi.WindowSizeMessage{}
+	err = json.Unmarshal(cmd.Data, &msg)
+	assert.Nil(t, err)
+	assert.Equal(t, session.ioBase, msg.Seq)
+	assert.Equal(t, uint16(80), msg.Column)
+	assert.Equal(t, uint16(24), msg.Row)
+
+	// Clients don't know about sequence numbers.
+	cmd.Tokens = []string{token}
+	err = vm.relocateHyperCommand(cmd)
+	assert.NotNil(t, err)
+
+	// The process has to be identified by its token.
+	cmd = rig.createHyperCmd(vm, "winsize", 0, data)
+	err = vm.relocateHyperCommand(cmd)
+	assert.NotNil(t, err)
+
+	rig.Stop()
+
+	vm.Close()
+}
+
 func TestRelocateProcessNonZeroSequenceNumbers(t *testing.T) {
-	process := &hyperstart.Process{
+	process := &hyperapi.Process{
 		Args: []string{"/bin/sh"},
 	}
 	session := &ioSession{
@@ -273,7 +337,7 @@ func TestRelocateProcessNonZeroSequenceNumbers(t *testing.T) {
 }
 
 func TestRelocateInteractiveProcess(t *testing.T) {
-	process := &hyperstart.Process{
+	process := &hyperapi.Process{
 		Args:     []string{"/bin/sh"},
 		Terminal: true,
 	}
@@ -286,3 +350,256 @@ func TestRelocateInteractiveProcess(t *testing.T) {
 	assert.NotEqual(t, uint64(0), process.Stdio)
 	assert.Equal(t, uint64(0), process.Stderr)
 }
+
+// acceptAll accepts connections on l until it's closed, returning them on the
+// conns channel.
+func acceptAll(l net.Listener, conns chan<- net.Conn) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}
+}
+
+func TestVMReconnect(t *testing.T) {
+	oldRetries, oldDelay := hyperReconnectRetries, hyperReconnectDelay
+	hyperReconnectRetries = 5
+	hyperReconnectDelay = time.Millisecond
+	defer func() {
+		hyperReconnectRetries, hyperReconnectDelay = oldRetries, oldDelay
+	}()
+
+	// Simple stand-ins for the QEMU chardev sockets. We don't need a
+	// hyperstart answering on them.
+	dir, err := ioutil.TempDir("", "cc-proxy-reconnect")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ctlPath := filepath.Join(dir, "ctl.sock")
+	ioPath := filepath.Join(dir, "io.sock")
+
+	conns := make(chan net.Conn, 4)
+	ctlListener, err := net.Listen("unix", ctlPath)
+	assert.Nil(t, err)
+	go acceptAll(ctlListener, conns)
+	ioListener, err := net.Listen("unix", ioPath)
+	assert.Nil(t, err)
+	go acceptAll(ioListener, conns)
+
+	// Wait for the proxy to be connected to both sockets before dropping
+	// the connections.
+	closeConns := func() {
+		accepted := []net.Conn{<-conns, <-conns}
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	}
+
+	vm := newVM(testVM, ctlPath, ioPath)
+	err = vm.hyper().OpenSockets()
+	assert.Nil(t, err)
+	vm.wg.Add(1)
+	go vm.ioHyperToClients()
+
+	// A client attached to the VM, receiving its notifications.
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	vm.addClient(1, proxyConn, false)
+	notifications := make(chan api.Notification, 8)
+	go func() {
+		for {
+			frame, err := api.ReadFrame(clientConn)
+			if err != nil {
+				return
+			}
+			notifications <- api.Notification(frame.Header.Opcode)
+		}
+	}()
+	expectNotification := func(expected api.Notification) {
+		select {
+		case n := <-notifications:
+			assert.Equal(t, expected, n)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timeout waiting for notification", "%s", expected)
+		}
+	}
+
+	// Drop the connections, the proxy should reconnect.
+	closeConns()
+	expectNotification(api.NotificationVMDegraded)
+	expectNotification(api.NotificationVMRecovered)
+	assert.Nil(t, vm.checkHealth())
+
+	// This time the sockets don't come back.
+	accepted := []net.Conn{<-conns, <-conns}
+	ctlListener.Close()
+	ioListener.Close()
+	for _, conn := range accepted {
+		conn.Close()
+	}
+
+	expectNotification(api.NotificationVMDegraded)
+	select {
+	case <-vm.OnVMLost():
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timeout waiting for the VM to be declared lost")
+	}
+
+	vm.Close()
+}
+
+func TestVMPingResult(t *testing.T) {
+	oldMisses := pingMisses
+	pingMisses = 2
+	defer func() {
+		pingMisses = oldMisses
+	}()
+
+	vm := newVM(testVM, "", "")
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	vm.addClient(1, proxyConn, false)
+	notifications := make(chan api.Notification, 8)
+	go func() {
+		for {
+			frame, err := api.ReadFrame(clientConn)
+			if err != nil {
+				return
+			}
+			notifications <- api.Notification(frame.Header.Opcode)
+		}
+	}()
+	expectNotification := func(expected api.Notification) {
+		select {
+		case n := <-notifications:
+			assert.Equal(t, expected, n)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timeout waiting for notification", "%s", expected)
+		}
+	}
+
+	// A single missed ping is tolerated.
+	missed := vm.pingResult(errPingPending, 0)
+	assert.Equal(t, 1, missed)
+	assert.Nil(t, vm.checkHealth())
+
+	// An answered ping resets the count.
+	missed = vm.pingResult(nil, missed)
+	assert.Equal(t, 0, missed)
+
+	// Missing pingMisses pings in a row makes hyperstart unresponsive.
+	missed = vm.pingResult(errPingPending, missed)
+	missed = vm.pingResult(errPingPending, missed)
+	assert.Equal(t, 2, missed)
+	expectNotification(api.NotificationAgentUnresponsive)
+	err := vm.checkHealth()
+	assert.NotNil(t, err)
+	assert.Equal(t, api.ErrorCodeAgentUnresponsive, err.(*proxyError).code)
+	assert.Equal(t, api.VMStateUnresponsive, vm.stats().State)
+
+	// The notification is only sent once.
+	missed = vm.pingResult(errPingPending, missed)
+	assert.Equal(t, 3, missed)
+
+	// hyperstart answers again.
+	missed = vm.pingResult(nil, missed)
+	assert.Equal(t, 0, missed)
+	expectNotification(api.NotificationVMRecovered)
+	assert.Nil(t, vm.checkHealth())
+	assert.Equal(t, api.VMStateHealthy, vm.stats().State)
+
+	select {
+	case n := <-notifications:
+		assert.Fail(t, "unexpected notification", "%s", n)
+	default:
+	}
+}
+
+func TestAPIVersionProtocol(t *testing.T) {
+	saved := hyperstartAPIVersions
+	defer func() { hyperstartAPIVersions = saved }()
+
+	hyperstartAPIVersions = []struct {
+		version       string
+		minAPIVersion int
+	}{
+		{"0.7", 0},
+		{"0.8", 4243},
+		{"0.9", 4300},
+	}
+
+	tests := []struct {
+		apiVersion int
+		version    string
+	}{
+		{0, "0.7"},
+		{4242, "0.7"},
+		{4243, "0.8"},
+		{4299, "0.8"},
+		{4300, "0.9"},
+		{5000, "0.9"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.version, apiVersionProtocol(test.apiVersion),
+			"API version %d", test.apiVersion)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	writeErr := &net.OpError{Op: "write", Err: syscall.EPIPE}
+	timeoutErr := newProxyError(api.ErrorCodeHyperTimeout, "timeout")
+
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		retry   bool
+	}{
+		// Idempotent commands are retried after any failure.
+		{"ping", timeoutErr, 0, true},
+		{"version", timeoutErr, hyperRetries - 1, true},
+		{"ping", timeoutErr, hyperRetries, false},
+		// Others only when they couldn't be written.
+		{"newcontainer", timeoutErr, 0, false},
+		{"newcontainer", writeErr, 0, true},
+		{"newcontainer", writeErr, hyperWriteRetries, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.retry, shouldRetry(test.name, test.err, test.attempt),
+			"%s after %d attempts: %v", test.name, test.attempt, test.err)
+	}
+}
+
+func TestAgentError(t *testing.T) {
+	vm := newVM(testContainerID, "ctl", "io")
+	refused := errors.New(hyperstartErrorReply)
+
+	newcontainer, err := json.Marshal(&hyperapi.Container{ID: "foo"})
+	assert.Nil(t, err)
+	removecontainer, err := json.Marshal(&hyperapi.RemoveCommand{Container: "foo"})
+	assert.Nil(t, err)
+
+	code := func(name string, data []byte) api.ErrorCode {
+		return errorCode(vm.agentError(name, data, refused))
+	}
+
+	// Other errors are left alone.
+	other := errors.New("foo")
+	assert.Equal(t, other, vm.agentError("execcmd", nil, other))
+
+	assert.Equal(t, api.ErrorCodeExecFailed, code("newcontainer", newcontainer))
+	assert.Equal(t, api.ErrorCodeExecFailed, code("execcmd", nil))
+	assert.Equal(t, api.ErrorCodeProcessNotFound, code("winsize", nil))
+	assert.Equal(t, api.ErrorCodeProcessNotFound, code("killcontainer", nil))
+	assert.Equal(t, api.ErrorCodeAgentError, code("startpod", nil))
+
+	// Once created, the container exists until it's removed.
+	vm.trackContainers("newcontainer", newcontainer)
+	assert.Equal(t, api.ErrorCodeContainerExists, code("newcontainer", newcontainer))
+	vm.trackContainers("removecontainer", removecontainer)
+	assert.Equal(t, api.ErrorCodeExecFailed, code("newcontainer", newcontainer))
+}